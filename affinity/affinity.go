@@ -0,0 +1,104 @@
+// Package affinity tracks UDP session metadata for external load balancers.
+//
+// When multiple instances are deployed behind one virtual IP, an L4 load balancer
+// doing consistent hashing can poll the session table of each instance to learn
+// which instance owns which client session, and keep sessions sticky across
+// client address changes and rebalancing.
+package affinity
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Session contains metadata about an active UDP session.
+type Session struct {
+	// ClientSessionID is the client session ID.
+	ClientSessionID uint64 `json:"clientSessionID"`
+
+	// ClientAddress is the last seen address of the client.
+	ClientAddress netip.AddrPort `json:"clientAddress"`
+
+	// Username is the authenticated user of the session, if any.
+	Username string `json:"username,omitempty"`
+
+	// Client is the name of the client (backend) chosen by the router.
+	Client string `json:"client"`
+
+	// StartTime is when the session was established.
+	StartTime time.Time `json:"startTime"`
+}
+
+// tableEntry is an entry in the session table.
+type tableEntry struct {
+	Session
+	expire func()
+}
+
+// Table is a concurrency-safe table of active UDP sessions keyed by client session ID.
+//
+// The zero value is ready for use.
+type Table struct {
+	mu       sync.RWMutex
+	sessions map[uint64]tableEntry
+}
+
+// Add adds or replaces the session with the same client session ID.
+// expire is called by [Table.Expire] to end the session. It must not call methods of the table.
+func (t *Table) Add(s Session, expire func()) {
+	t.mu.Lock()
+	if t.sessions == nil {
+		t.sessions = make(map[uint64]tableEntry)
+	}
+	t.sessions[s.ClientSessionID] = tableEntry{s, expire}
+	t.mu.Unlock()
+}
+
+// UpdateClientAddress updates the client address of the session, if it exists.
+func (t *Table) UpdateClientAddress(csid uint64, clientAddrPort netip.AddrPort) {
+	t.mu.Lock()
+	if e, ok := t.sessions[csid]; ok {
+		e.ClientAddress = clientAddrPort
+		t.sessions[csid] = e
+	}
+	t.mu.Unlock()
+}
+
+// Remove removes the session with the client session ID.
+func (t *Table) Remove(csid uint64) {
+	t.mu.Lock()
+	delete(t.sessions, csid)
+	t.mu.Unlock()
+}
+
+// Expire ends the session with the client session ID immediately, without waiting for it to time out.
+// The session is removed from the table when its relay has stopped.
+// It returns false if the session does not exist.
+func (t *Table) Expire(csid uint64) bool {
+	t.mu.RLock()
+	e, ok := t.sessions[csid]
+	t.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	e.expire()
+	return true
+}
+
+// Snapshot returns all active sessions sorted by client session ID.
+func (t *Table) Snapshot() []Session {
+	t.mu.RLock()
+	sessions := make([]Session, 0, len(t.sessions))
+	for _, e := range t.sessions {
+		sessions = append(sessions, e.Session)
+	}
+	t.mu.RUnlock()
+
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return cmp.Compare(a.ClientSessionID, b.ClientSessionID)
+	})
+	return sessions
+}
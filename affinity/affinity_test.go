@@ -0,0 +1,61 @@
+package affinity
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	var table Table
+	if sessions := table.Snapshot(); len(sessions) != 0 {
+		t.Fatalf("len(sessions) = %d, expected 0", len(sessions))
+	}
+
+	addr1 := netip.MustParseAddrPort("[2001:db8::1]:1")
+	addr2 := netip.MustParseAddrPort("[2001:db8::2]:2")
+	now := time.Now()
+
+	table.Add(Session{ClientSessionID: 2, ClientAddress: addr1, Client: "b", StartTime: now}, func() {})
+	table.Add(Session{ClientSessionID: 1, ClientAddress: addr1, Username: "Steve", Client: "a", StartTime: now}, func() {})
+	table.UpdateClientAddress(2, addr2)
+	table.UpdateClientAddress(3, addr2)
+
+	sessions := table.Snapshot()
+	if len(sessions) != 2 {
+		t.Fatalf("len(sessions) = %d, expected 2", len(sessions))
+	}
+	if sessions[0].ClientSessionID != 1 || sessions[0].Client != "a" || sessions[0].Username != "Steve" {
+		t.Errorf("sessions[0] = %+v", sessions[0])
+	}
+	if sessions[1].ClientSessionID != 2 || sessions[1].ClientAddress != addr2 {
+		t.Errorf("sessions[1] = %+v", sessions[1])
+	}
+
+	table.Remove(1)
+	if sessions := table.Snapshot(); len(sessions) != 1 || sessions[0].ClientSessionID != 2 {
+		t.Errorf("sessions = %+v, expected only session 2", sessions)
+	}
+}
+
+func TestTableExpire(t *testing.T) {
+	var (
+		table   Table
+		expired bool
+	)
+	table.Add(Session{ClientSessionID: 1, Client: "a", StartTime: time.Now()}, func() { expired = true })
+
+	if table.Expire(2) {
+		t.Error("Expire(2) = true, expected false")
+	}
+	if expired {
+		t.Error("Expire(2) expired session 1")
+	}
+
+	if !table.Expire(1) {
+		t.Error("Expire(1) = false, expected true")
+	}
+	if !expired {
+		t.Error("Expire(1) did not expire session 1")
+	}
+}
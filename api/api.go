@@ -5,8 +5,18 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/database64128/shadowsocks-go/api/clientgroups"
+	"github.com/database64128/shadowsocks-go/api/configs"
+	"github.com/database64128/shadowsocks-go/api/dashboard"
+	"github.com/database64128/shadowsocks-go/api/events"
+	"github.com/database64128/shadowsocks-go/api/live"
+	"github.com/database64128/shadowsocks-go/api/metrics"
+	"github.com/database64128/shadowsocks-go/api/routing"
 	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/clientgroup"
+	"github.com/database64128/shadowsocks-go/event"
 	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/router"
 	"github.com/gofiber/contrib/fiberzap/v2"
 	"github.com/gofiber/fiber/v2"
 	fiberlog "github.com/gofiber/fiber/v2/log"
@@ -60,14 +70,54 @@ type Config struct {
 	// FiberConfigPath overrides the [fiber.Config] settings we use.
 	// If empty, no overrides are applied.
 	FiberConfigPath string `json:"fiberConfigPath"`
+
+	// BasicAuthUsers maps usernames to passwords for HTTP basic authentication.
+	// If not empty, all routes require authentication. Users have full access.
+	BasicAuthUsers map[string]string `json:"basicAuthUsers"`
+
+	// BearerTokens is the list of tokens for bearer token authentication.
+	// If not empty, all routes require authentication, with either a bearer token
+	// or a user in BasicAuthUsers. Read-only tokens can only make GET and HEAD requests
+	// to stats, metrics and live streaming routes.
+	//
+	// Serve the API over TLS with CertFile and KeyFile when exposing it beyond localhost,
+	// so that tokens are not sent in plaintext.
+	BearerTokens []BearerTokenConfig `json:"bearerTokens"`
+
+	// EnableDashboard enables the built-in web dashboard at /dashboard.
+	//
+	// The dashboard requires at least one of BasicAuthUsers, BearerTokens, SecretPath or ClientCertFile,
+	// so that it is not exposed without authentication. With BearerTokens, the dashboard and the API
+	// routes it calls need an admin token.
+	EnableDashboard bool `json:"enableDashboard"`
+
+	// EnableMetrics enables the Prometheus metrics endpoint at /metrics.
+	EnableMetrics bool `json:"enableMetrics"`
+
+	// OnlineConfigKey enables serving each user's SIP008 online config document at /sip008/v1/<token>,
+	// with an entry for each multi-user server that has the user and a sip008Address.
+	// The route does not require authentication, as the token authenticates the user.
+	//
+	// Tokens are derived from the key and the username, and are listed at
+	// /api/ssm/v1/servers/<server>/users/<username>/sip008. Change the key to revoke all tokens.
+	// The key must be 32 bytes.
+	OnlineConfigKey []byte `json:"onlineConfigKey"`
 }
 
 // Server returns a new API server from the config.
-func (c *Config) Server(logger *zap.Logger) (*Server, *ssm.ServerManager, error) {
+// If bus is not nil, the event API is served at /api/events/v1.
+// If r is not nil, the routing API is served at /api/routing/v1.
+// The client group API is served at /api/clientgroups/v1.
+// If sections is not empty, the configuration API is served at /api/configs/v1.
+func (c *Config) Server(logger *zap.Logger, bus *event.Bus, r *router.Router, groups []clientgroup.StatusReporter, sections []configs.Section) (*Server, *ssm.ServerManager, error) {
 	if !c.Enabled {
 		return nil, nil, nil
 	}
 
+	if c.EnableDashboard && len(c.BasicAuthUsers) == 0 && len(c.BearerTokens) == 0 && c.SecretPath == "" && c.ClientCertFile == "" {
+		return nil, nil, errors.New("dashboard requires authentication: set basicAuthUsers, bearerTokens, secretPath, or clientCertFile")
+	}
+
 	fiberlog.SetLogger(fiberzap.NewLogger(fiberzap.LoggerConfig{
 		SetLogger: logger,
 	}))
@@ -86,6 +136,10 @@ func (c *Config) Server(logger *zap.Logger) (*Server, *ssm.ServerManager, error)
 		}
 	}
 
+	if c.OnlineConfigKey != nil && len(c.OnlineConfigKey) != ssm.OnlineConfigKeyLength {
+		return nil, nil, fmt.Errorf("onlineConfigKey must be %d bytes, got %d", ssm.OnlineConfigKeyLength, len(c.OnlineConfigKey))
+	}
+
 	app := fiber.New(fc)
 
 	app.Use(etag.New())
@@ -102,6 +156,22 @@ func (c *Config) Server(logger *zap.Logger) (*Server, *ssm.ServerManager, error)
 		router = app.Group(c.SecretPath)
 	}
 
+	sm := ssm.NewServerManager()
+
+	// /sip008/v1, registered before authentication, as SIP008 clients cannot authenticate.
+	if c.OnlineConfigKey != nil {
+		sm.SetOnlineConfigKey(c.OnlineConfigKey)
+		sm.RegisterOnlineConfigRoutes(router.Group("/sip008/v1"))
+	}
+
+	if len(c.BasicAuthUsers) > 0 || len(c.BearerTokens) > 0 {
+		auth, err := newAuthHandler(c.SecretPath, c.BasicAuthUsers, c.BearerTokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		router.Use(auth)
+	}
+
 	if c.DebugPprof {
 		app.Use(pprof.New(pprof.Config{
 			Prefix: c.SecretPath,
@@ -111,9 +181,42 @@ func (c *Config) Server(logger *zap.Logger) (*Server, *ssm.ServerManager, error)
 	api := router.Group("/api")
 
 	// /api/ssm/v1
-	sm := ssm.NewServerManager()
 	sm.RegisterRoutes(api.Group("/ssm/v1"))
 
+	// /api/events/v1
+	if bus != nil {
+		events.NewEventManager(bus).RegisterRoutes(api.Group("/events/v1"))
+	}
+
+	// /api/live/v1
+	live.NewLiveManager(sm, bus).RegisterRoutes(api.Group("/live/v1"))
+
+	// /api/routing/v1
+	if r != nil {
+		routing.NewRouteManager(r).RegisterRoutes(api.Group("/routing/v1"))
+	}
+
+	// /api/clientgroups/v1
+	gm := clientgroups.NewGroupManager(groups)
+	gm.RegisterRoutes(api.Group("/clientgroups/v1"))
+
+	// /api/configs/v1
+	var cm *configs.ConfigManager
+	if len(sections) > 0 {
+		cm = configs.NewConfigManager(sections)
+		cm.RegisterRoutes(api.Group("/configs/v1"))
+	}
+
+	// /dashboard
+	if c.EnableDashboard {
+		dashboard.RegisterRoutes(router.Group("/dashboard"))
+	}
+
+	// /metrics
+	if c.EnableMetrics {
+		metrics.NewExporter(sm).RegisterRoutes(router)
+	}
+
 	if c.StaticPath != "" {
 		router.Static("/", c.StaticPath, fiber.Static{
 			ByteRange: true,
@@ -127,6 +230,8 @@ func (c *Config) Server(logger *zap.Logger) (*Server, *ssm.ServerManager, error)
 		certFile:       c.CertFile,
 		keyFile:        c.KeyFile,
 		clientCertFile: c.ClientCertFile,
+		groups:         gm,
+		configs:        cm,
 	}, sm, nil
 }
 
@@ -138,9 +243,21 @@ type Server struct {
 	certFile       string
 	keyFile        string
 	clientCertFile string
+	groups         *clientgroups.GroupManager
+	configs        *configs.ConfigManager
 	ctx            context.Context
 }
 
+// Groups returns the manager of the client group API.
+func (s *Server) Groups() *clientgroups.GroupManager {
+	return s.groups
+}
+
+// Configs returns the manager of the configuration API, or nil if it is not served.
+func (s *Server) Configs() *configs.ConfigManager {
+	return s.configs
+}
+
 // String implements [service.Service.String].
 func (s *Server) String() string {
 	return "API server"
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/basicauth"
+)
+
+// TokenScope is the scope of a bearer token.
+type TokenScope string
+
+const (
+	// TokenScopeRead allows GET and HEAD requests to the routes in readScopeRoutes,
+	// like reading stats and metrics, and streaming live traffic.
+	TokenScopeRead TokenScope = "read"
+
+	// TokenScopeAdmin allows all requests, like managing credentials and terminating connections.
+	TokenScopeAdmin TokenScope = "admin"
+)
+
+// BearerTokenConfig is the configuration of a bearer token for API authentication.
+type BearerTokenConfig struct {
+	// Name identifies the token in configuration errors.
+	Name string `json:"name"`
+
+	// Token is the secret sent in the Authorization header as "Bearer <token>".
+	Token string `json:"token"`
+
+	// Scope is the scope of the token: "read" or "admin".
+	//
+	// The default value is "read".
+	Scope TokenScope `json:"scope"`
+}
+
+// readScopeRoutes are the routes allowed for tokens with the read scope.
+// Segments starting with ":" match any non-empty path segment.
+//
+// Routes exposing credentials or configs, like users, SIP008 documents and config sections,
+// are deliberately not listed.
+var readScopeRoutes = [...]string{
+	"/api/ssm/v1/servers",
+	"/api/ssm/v1/servers/:server",
+	"/api/ssm/v1/servers/:server/stats",
+	"/api/ssm/v1/servers/:server/rejections",
+	"/api/ssm/v1/servers/:server/resources",
+	"/api/events/v1/stats",
+	"/api/events/v1/stream",
+	"/api/live/v1/stream",
+	"/api/routing/v1/stats",
+	"/api/clientgroups/v1/groups",
+	"/api/clientgroups/v1/groups/:group",
+	"/metrics",
+}
+
+// newAuthHandler returns a handler that authenticates requests with either a bearer token
+// or HTTP basic authentication, and rejects requests outside the token's scope.
+// pathPrefix is the path under which the routes are registered, like the secret path.
+//
+// Basic authentication users have the admin scope.
+func newAuthHandler(pathPrefix string, basicAuthUsers map[string]string, tokenConfigs []BearerTokenConfig) (fiber.Handler, error) {
+	// Tokens are looked up by their hashes, so that the lookup time does not depend on the token.
+	tokens := make(map[[sha256.Size]byte]TokenScope, len(tokenConfigs))
+
+	for i, tc := range tokenConfigs {
+		if tc.Token == "" {
+			return nil, fmt.Errorf("bearer token %d (%s): empty token", i, tc.Name)
+		}
+		scope := tc.Scope
+		switch scope {
+		case "":
+			scope = TokenScopeRead
+		case TokenScopeRead, TokenScopeAdmin:
+		default:
+			return nil, fmt.Errorf("bearer token %d (%s): unknown scope: %q", i, tc.Name, tc.Scope)
+		}
+		hash := sha256.Sum256([]byte(tc.Token))
+		if _, ok := tokens[hash]; ok {
+			return nil, fmt.Errorf("bearer token %d (%s): duplicate token", i, tc.Name)
+		}
+		tokens[hash] = scope
+	}
+
+	var basicAuth fiber.Handler
+	if len(basicAuthUsers) > 0 {
+		basicAuth = basicauth.New(basicauth.Config{
+			Users: basicAuthUsers,
+			Realm: "shadowsocks-go",
+		})
+	}
+
+	if len(tokens) == 0 {
+		if basicAuth == nil {
+			return nil, errors.New("no authentication methods")
+		}
+		return basicAuth, nil
+	}
+
+	return func(c *fiber.Ctx) error {
+		token, ok := cutBearerToken(c.Get(fiber.HeaderAuthorization))
+		if !ok {
+			if basicAuth != nil {
+				return basicAuth(c)
+			}
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="shadowsocks-go"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(&ssm.StandardError{Message: "missing bearer token"})
+		}
+
+		scope, ok := tokens[sha256.Sum256([]byte(token))]
+		if !ok {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="shadowsocks-go", error="invalid_token"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(&ssm.StandardError{Message: "invalid bearer token"})
+		}
+
+		if scope == TokenScopeRead && !readScopeAllows(pathPrefix, c.Method(), c.Path()) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="shadowsocks-go", error="insufficient_scope", scope="admin"`)
+			return c.Status(fiber.StatusForbidden).JSON(&ssm.StandardError{Message: "The token does not have the admin scope."})
+		}
+
+		return c.Next()
+	}, nil
+}
+
+// readScopeAllows returns whether a token with the read scope may make the request.
+func readScopeAllows(pathPrefix, method, path string) bool {
+	switch method {
+	case fiber.MethodGet, fiber.MethodHead:
+	default:
+		return false
+	}
+
+	path, ok := strings.CutPrefix(path, pathPrefix)
+	if !ok {
+		return false
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	for _, route := range readScopeRoutes {
+		if matchRoute(route, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute returns whether path matches the route pattern segment by segment.
+func matchRoute(route, path string) bool {
+	for {
+		routeSeg, routeRest, routeMore := strings.Cut(route, "/")
+		pathSeg, pathRest, pathMore := strings.Cut(path, "/")
+		if routeMore != pathMore {
+			return false
+		}
+		if routeSeg != pathSeg && (routeSeg == "" || routeSeg[0] != ':' || pathSeg == "") {
+			return false
+		}
+		if !routeMore {
+			return true
+		}
+		route, path = routeRest, pathRest
+	}
+}
+
+// cutBearerToken returns the token in the value of the Authorization header,
+// and whether the header uses the bearer scheme.
+func cutBearerToken(authorization string) (string, bool) {
+	const scheme = "Bearer "
+	if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return "", false
+	}
+	return authorization[len(scheme):], true
+}
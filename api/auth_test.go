@@ -0,0 +1,182 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+func newAuthTestApp(t *testing.T, basicAuthUsers map[string]string, tokens []BearerTokenConfig) *fiber.App {
+	t.Helper()
+
+	auth, err := newAuthHandler("", basicAuthUsers, tokens)
+	if err != nil {
+		t.Fatalf("newAuthHandler failed: %v", err)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(auth)
+	app.Get("/metrics", func(c *fiber.Ctx) error {
+		return c.SendString("metrics")
+	})
+	app.Post("/users", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusCreated)
+	})
+	return app
+}
+
+func testAuthRequest(t *testing.T, app *fiber.App, method, target, authorization string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuthHandler(t *testing.T) {
+	app := newAuthTestApp(t, map[string]string{"admin": "hunter2"}, []BearerTokenConfig{
+		{Name: "grafana", Token: "read-token"},
+		{Name: "provisioner", Token: "admin-token", Scope: TokenScopeAdmin},
+	})
+
+	for _, c := range []struct {
+		name          string
+		method        string
+		target        string
+		authorization string
+		wantStatus    int
+	}{
+		{"NoAuth", http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+		{"InvalidToken", http.MethodGet, "/metrics", "Bearer wrong-token", http.StatusUnauthorized},
+		{"ReadTokenGet", http.MethodGet, "/metrics", "Bearer read-token", http.StatusOK},
+		{"ReadTokenLowercaseScheme", http.MethodGet, "/metrics", "bearer read-token", http.StatusOK},
+		{"ReadTokenPost", http.MethodPost, "/users", "Bearer read-token", http.StatusForbidden},
+		{"AdminTokenGet", http.MethodGet, "/metrics", "Bearer admin-token", http.StatusOK},
+		{"AdminTokenPost", http.MethodPost, "/users", "Bearer admin-token", http.StatusCreated},
+		{"BasicAuth", http.MethodPost, "/users", "Basic YWRtaW46aHVudGVyMg==", http.StatusCreated},
+		{"BasicAuthWrongPassword", http.MethodGet, "/metrics", "Basic YWRtaW46aHVudGVyMw==", http.StatusUnauthorized},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if status := testAuthRequest(t, app, c.method, c.target, c.authorization); status != c.wantStatus {
+				t.Errorf("Status = %d, expected %d", status, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAuthHandlerReadScope(t *testing.T) {
+	auth, err := newAuthHandler("/secret", nil, []BearerTokenConfig{
+		{Name: "grafana", Token: "read-token"},
+		{Name: "provisioner", Token: "admin-token", Scope: TokenScopeAdmin},
+	})
+	if err != nil {
+		t.Fatalf("newAuthHandler failed: %v", err)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	router := app.Group("/secret")
+	router.Use(auth)
+	router.Get("/*", func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	for _, target := range []string{
+		"/secret/api/ssm/v1/servers",
+		"/secret/api/ssm/v1/servers/ss-2022",
+		"/secret/api/ssm/v1/servers/ss-2022/stats",
+		"/secret/api/ssm/v1/servers/ss-2022/stats/",
+		"/secret/api/events/v1/stats",
+		"/secret/api/live/v1/stream",
+		"/secret/api/routing/v1/stats",
+		"/secret/api/clientgroups/v1/groups/proxies",
+		"/secret/metrics",
+	} {
+		if status := testAuthRequest(t, app, http.MethodGet, target, "Bearer read-token"); status != http.StatusOK {
+			t.Errorf("GET %s with read token: status = %d, expected %d", target, status, http.StatusOK)
+		}
+	}
+
+	for _, target := range []string{
+		"/secret/api/ssm/v1/servers/ss-2022/users",
+		"/secret/api/ssm/v1/servers/ss-2022/users/Steve",
+		"/secret/api/ssm/v1/servers/ss-2022/users/Steve/sip008",
+		"/secret/api/ssm/v1/servers/ss-2022/sip008",
+		"/secret/api/ssm/v1/servers/ss-2022/conns",
+		"/secret/api/ssm/v1/servers/ss-2022/capture",
+		"/secret/api/ssm/v1/servers//stats",
+		"/secret/api/configs/v1/sections",
+		"/secret/api/configs/v1/sections/servers/ss-2022",
+		"/secret/api/routing/v1/routes",
+		"/secret/metrics/extra",
+	} {
+		if status := testAuthRequest(t, app, http.MethodGet, target, "Bearer read-token"); status != http.StatusForbidden {
+			t.Errorf("GET %s with read token: status = %d, expected %d", target, status, http.StatusForbidden)
+		}
+		if status := testAuthRequest(t, app, http.MethodGet, target, "Bearer admin-token"); status != http.StatusOK {
+			t.Errorf("GET %s with admin token: status = %d, expected %d", target, status, http.StatusOK)
+		}
+	}
+}
+
+func TestAuthHandlerBearerOnly(t *testing.T) {
+	app := newAuthTestApp(t, nil, []BearerTokenConfig{{Name: "grafana", Token: "read-token", Scope: TokenScopeRead}})
+
+	if status := testAuthRequest(t, app, http.MethodGet, "/metrics", "Basic YWRtaW46aHVudGVyMg=="); status != http.StatusUnauthorized {
+		t.Errorf("Basic auth status = %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := testAuthRequest(t, app, http.MethodGet, "/metrics", "Bearer read-token"); status != http.StatusOK {
+		t.Errorf("Bearer token status = %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestAuthHandlerInvalidConfig(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tokens []BearerTokenConfig
+	}{
+		{"EmptyToken", []BearerTokenConfig{{Name: "empty"}}},
+		{"UnknownScope", []BearerTokenConfig{{Name: "root", Token: "token", Scope: "root"}}},
+		{"DuplicateToken", []BearerTokenConfig{{Name: "a", Token: "token"}, {Name: "b", Token: "token", Scope: TokenScopeAdmin}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := newAuthHandler("", nil, c.tokens); err == nil {
+				t.Error("newAuthHandler succeeded")
+			}
+		})
+	}
+}
+
+func TestDashboardRequiresAuthentication(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"None", Config{}, false},
+		{"BasicAuthUsers", Config{BasicAuthUsers: map[string]string{"admin": "secret"}}, true},
+		{"BearerTokens", Config{BearerTokens: []BearerTokenConfig{{Name: "dashboard", Token: "secret", Scope: "admin"}}}, true},
+		{"SecretPath", Config{SecretPath: "/secret"}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.config.Enabled = true
+			c.config.EnableDashboard = true
+			_, _, err := c.config.Server(zap.NewNop(), nil, nil, nil, nil)
+			if c.ok && err != nil {
+				t.Errorf("Server() failed: %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Error("Server() succeeded without authentication")
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Package clientgroups implements the client group API v1.
+package clientgroups
+
+import (
+	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/clientgroup"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GroupManager handles client group API requests.
+type GroupManager struct {
+	state atomic.Pointer[groupState]
+}
+
+// groupState contains the client groups served by a [GroupManager].
+type groupState struct {
+	groups      []clientgroup.StatusReporter
+	groupByName map[string]clientgroup.StatusReporter
+}
+
+// NewGroupManager returns a new group manager for the client groups.
+func NewGroupManager(groups []clientgroup.StatusReporter) *GroupManager {
+	var gm GroupManager
+	gm.SetGroups(groups)
+	return &gm
+}
+
+// SetGroups replaces the client groups served by the group manager.
+func (gm *GroupManager) SetGroups(groups []clientgroup.StatusReporter) {
+	groupByName := make(map[string]clientgroup.StatusReporter, len(groups))
+	for _, g := range groups {
+		groupByName[g.Status().Name] = g
+	}
+	gm.state.Store(&groupState{
+		groups:      groups,
+		groupByName: groupByName,
+	})
+}
+
+// RegisterRoutes sets up routes for the client group API.
+func (gm *GroupManager) RegisterRoutes(v1 fiber.Router) {
+	v1.Get("/groups", gm.ListGroups)
+	v1.Get("/groups/:group", gm.GetGroup)
+}
+
+// GroupStatusList contains the status of all client groups.
+type GroupStatusList struct {
+	Groups []clientgroup.Status `json:"groups"`
+}
+
+// ListGroups returns the status of all client groups.
+func (gm *GroupManager) ListGroups(c *fiber.Ctx) error {
+	groups := gm.state.Load().groups
+	list := GroupStatusList{
+		Groups: make([]clientgroup.Status, len(groups)),
+	}
+	for i, g := range groups {
+		list.Groups[i] = g.Status()
+	}
+	return c.JSON(&list)
+}
+
+// GetGroup returns the status of a client group.
+func (gm *GroupManager) GetGroup(c *fiber.Ctx) error {
+	g, ok := gm.state.Load().groupByName[c.Params("group")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(&ssm.StandardError{Message: "client group not found"})
+	}
+	status := g.Status()
+	return c.JSON(&status)
+}
@@ -0,0 +1,67 @@
+package clientgroups
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/clientgroup"
+	"github.com/gofiber/fiber/v2"
+)
+
+type testStatusReporter clientgroup.Status
+
+func (r testStatusReporter) Status() clientgroup.Status {
+	return clientgroup.Status(r)
+}
+
+func TestGroups(t *testing.T) {
+	status := clientgroup.Status{
+		Name:        "fallback",
+		Type:        "failover",
+		TCPSelected: "direct",
+		Members: []clientgroup.MemberStatus{
+			{Name: "socks5-upstream", ConsecutiveFailures: 3, LastError: "connection refused"},
+			{Name: "direct", Up: true},
+		},
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	NewGroupManager([]clientgroup.StatusReporter{testStatusReporter(status)}).RegisterRoutes(app.Group("/api/clientgroups/v1"))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/clientgroups/v1/groups", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list GroupStatusList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(list.Groups) != 1 || list.Groups[0].Name != "fallback" || len(list.Groups[0].Members) != 2 {
+		t.Errorf("list = %+v, expected the fallback group with 2 members", list)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/api/clientgroups/v1/groups/fallback", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got clientgroup.Status
+	if err = json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got.TCPSelected != "direct" || got.Members[0].Up || got.Members[0].LastError != "connection refused" {
+		t.Errorf("got = %+v, expected %+v", got, status)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/api/clientgroups/v1/groups/nonexistent", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("resp.StatusCode = %d, expected %d", resp.StatusCode, fiber.StatusNotFound)
+	}
+}
@@ -0,0 +1,169 @@
+// Package configs implements the configuration API v1.
+package configs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Section is a section of the configuration in normalized JSON.
+type Section struct {
+	// Kind is the kind of the section, such as "server", "client", "dns" or "router".
+	Kind string `json:"kind"`
+
+	// Name is the name of the server, client or DNS resolver, or empty for the router.
+	Name string `json:"name,omitempty"`
+
+	// Hash is the hex-encoded SHA-256 hash of Config.
+	Hash string `json:"hash"`
+
+	// Config is the section in normalized JSON, or empty if only hashes are requested.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// NewSection returns a new section of the given kind and name with the normalized JSON encoding of v.
+//
+// The encoding is compact, with struct fields in declaration order, map keys sorted,
+// and omitted fields present with their zero values, so that configuration files
+// that only differ in formatting or key order produce the same hash.
+func NewSection(kind, name string, v any) (Section, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Section{}, err
+	}
+	sum := sha256.Sum256(b)
+	return Section{
+		Kind:   kind,
+		Name:   name,
+		Hash:   hex.EncodeToString(sum[:]),
+		Config: b,
+	}, nil
+}
+
+// SectionList contains all sections of the configuration.
+type SectionList struct {
+	// Hash is the hex-encoded SHA-256 hash of the kinds, names and hashes of all sections, in order.
+	Hash string `json:"hash"`
+
+	// Sections is the list of sections, in the order they appear in the configuration.
+	Sections []Section `json:"sections"`
+}
+
+// ConfigManager handles configuration API requests.
+type ConfigManager struct {
+	lists  atomic.Pointer[sectionLists]
+	reload func() error
+}
+
+// sectionLists contains the section list with and without the sections' configs.
+type sectionLists struct {
+	list       SectionList
+	hashesOnly SectionList
+}
+
+// NewConfigManager returns a new config manager for the sections.
+func NewConfigManager(sections []Section) *ConfigManager {
+	var cm ConfigManager
+	cm.SetSections(sections)
+	return &cm
+}
+
+// SetSections replaces the sections served by the config manager.
+// It must not be called concurrently with [ConfigManager.SetSection].
+func (cm *ConfigManager) SetSections(sections []Section) {
+	h := sha256.New()
+	hashesOnly := make([]Section, len(sections))
+
+	for i, s := range sections {
+		h.Write([]byte(s.Kind))
+		h.Write([]byte{0})
+		h.Write([]byte(s.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(s.Hash))
+		h.Write([]byte{'\n'})
+
+		s.Config = nil
+		hashesOnly[i] = s
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	cm.lists.Store(&sectionLists{
+		list: SectionList{
+			Hash:     hash,
+			Sections: sections,
+		},
+		hashesOnly: SectionList{
+			Hash:     hash,
+			Sections: hashesOnly,
+		},
+	})
+}
+
+// SetSection replaces the section with the same kind and name as s.
+// It does nothing if there is no such section.
+func (cm *ConfigManager) SetSection(s Section) {
+	sections := cm.lists.Load().list.Sections
+	i := slices.IndexFunc(sections, func(existing Section) bool {
+		return existing.Kind == s.Kind && existing.Name == s.Name
+	})
+	if i == -1 {
+		return
+	}
+	sections = slices.Clone(sections)
+	sections[i] = s
+	cm.SetSections(sections)
+}
+
+// SetReloadFunc sets the function that reloads the configuration for reload requests.
+// It must be called before the routes are served.
+func (cm *ConfigManager) SetReloadFunc(reload func() error) {
+	cm.reload = reload
+}
+
+// RegisterRoutes sets up routes for the configuration API.
+func (cm *ConfigManager) RegisterRoutes(v1 fiber.Router) {
+	v1.Get("/sections", cm.ListSections)
+	v1.Get("/sections/:kind/:name?", cm.GetSection)
+	v1.Post("/reload", cm.Reload)
+}
+
+// ListSections returns all sections of the configuration and their hashes.
+// With the hashOnly query parameter set to true, the sections' configs are omitted.
+func (cm *ConfigManager) ListSections(c *fiber.Ctx) error {
+	lists := cm.lists.Load()
+	if c.QueryBool("hashOnly") {
+		return c.JSON(&lists.hashesOnly)
+	}
+	return c.JSON(&lists.list)
+}
+
+// GetSection returns a section of the configuration by kind and name.
+func (cm *ConfigManager) GetSection(c *fiber.Ctx) error {
+	kind, name := c.Params("kind"), c.Params("name")
+	sections := cm.lists.Load().list.Sections
+	for i := range sections {
+		s := &sections[i]
+		if s.Kind == kind && s.Name == name {
+			return c.JSON(s)
+		}
+	}
+	return c.Status(fiber.StatusNotFound).JSON(&ssm.StandardError{Message: "section not found"})
+}
+
+// Reload reloads the configuration, and returns the hashes of the sections in effect.
+func (cm *ConfigManager) Reload(c *fiber.Ctx) error {
+	if cm.reload == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&ssm.StandardError{Message: "reload not supported"})
+	}
+	if err := cm.reload(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: err.Error()})
+	}
+	return c.JSON(&cm.lists.Load().hashesOnly)
+}
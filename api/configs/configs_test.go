@@ -0,0 +1,209 @@
+package configs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type testServerConfig struct {
+	Name   string            `json:"name"`
+	Listen string            `json:"listen"`
+	Users  map[string]string `json:"users"`
+}
+
+func TestNewSectionNormalized(t *testing.T) {
+	var a, b testServerConfig
+	if err := json.Unmarshal([]byte(`{"users": {"bob": "b", "alice": "a"}, "name": "ss"}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{
+		"name": "ss",
+		"listen": "",
+		"users": {"alice": "a", "bob": "b"}
+	}`), &b); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := NewSection("server", a.Name, &a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := NewSection("server", b.Name, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Hash != sb.Hash || string(sa.Config) != string(sb.Config) {
+		t.Errorf("sa = %s %s, sb = %s %s, expected the same", sa.Hash, sa.Config, sb.Hash, sb.Config)
+	}
+
+	b.Listen = ":20220"
+	sb, err = NewSection("server", b.Name, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa.Hash == sb.Hash {
+		t.Error("Different configs have the same hash")
+	}
+}
+
+func TestSections(t *testing.T) {
+	server, err := NewSection("server", "ss", &testServerConfig{Name: "ss", Listen: ":20220"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewSection("router", "", map[string]any{"routes": []any{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	NewConfigManager([]Section{server, router}).RegisterRoutes(app.Group("/api/configs/v1"))
+
+	getList := func(target string) SectionList {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list SectionList
+		if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	list := getList("/api/configs/v1/sections")
+	if len(list.Sections) != 2 || list.Sections[0].Hash != server.Hash || string(list.Sections[0].Config) != string(server.Config) {
+		t.Errorf("list = %+v, expected the server and router sections", list)
+	}
+	if len(list.Hash) != 64 {
+		t.Errorf("list.Hash = %q, expected a hex-encoded SHA-256 hash", list.Hash)
+	}
+
+	hashes := getList("/api/configs/v1/sections?hashOnly=true")
+	if hashes.Hash != list.Hash || len(hashes.Sections) != 2 || hashes.Sections[1].Hash != router.Hash || hashes.Sections[1].Config != nil {
+		t.Errorf("hashes = %+v, expected hashes of %+v without configs", hashes, list)
+	}
+
+	for _, c := range []struct {
+		target     string
+		statusCode int
+		hash       string
+	}{
+		{"/api/configs/v1/sections/server/ss", fiber.StatusOK, server.Hash},
+		{"/api/configs/v1/sections/router", fiber.StatusOK, router.Hash},
+		{"/api/configs/v1/sections/client/ss", fiber.StatusNotFound, ""},
+	} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, c.target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s Section
+		if err = json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.statusCode || s.Hash != c.hash {
+			t.Errorf("GET %s = %d %+v, expected %d with hash %q", c.target, resp.StatusCode, s, c.statusCode, c.hash)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	server, err := NewSection("server", "ss", &testServerConfig{Name: "ss", Listen: ":20220"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewSection("server", "ss", &testServerConfig{Name: "ss", Listen: ":20221"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	cm := NewConfigManager([]Section{server})
+	cm.RegisterRoutes(app.Group("/api/configs/v1"))
+
+	reload := func() *http.Response {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/api/configs/v1/reload", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := reload()
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("resp.StatusCode = %d, expected %d", resp.StatusCode, fiber.StatusNotFound)
+	}
+
+	var reloadErr error
+	cm.SetReloadFunc(func() error {
+		if reloadErr != nil {
+			return reloadErr
+		}
+		cm.SetSections([]Section{reloaded})
+		return nil
+	})
+
+	reloadErr = errors.New("bad config")
+	resp = reload()
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("resp.StatusCode = %d, expected %d", resp.StatusCode, fiber.StatusBadRequest)
+	}
+
+	reloadErr = nil
+	resp = reload()
+	var list SectionList
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(list.Sections) != 1 || list.Sections[0].Hash != reloaded.Hash || list.Sections[0].Config != nil {
+		t.Errorf("list = %+v, expected the hash of the reloaded server section", list)
+	}
+}
+
+func TestSetSection(t *testing.T) {
+	server, err := NewSection("server", "ss", &testServerConfig{Name: "ss", Listen: ":20220"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewSection("router", "", map[string]any{"routes": []any{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := NewConfigManager([]Section{server, router})
+	oldHash := cm.lists.Load().list.Hash
+
+	newRouter, err := NewSection("router", "", map[string]any{"routes": []any{map[string]any{"name": "example"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.SetSection(newRouter)
+
+	lists := cm.lists.Load()
+	if sections := lists.list.Sections; len(sections) != 2 || sections[0].Hash != server.Hash || sections[1].Hash != newRouter.Hash {
+		t.Errorf("sections = %+v, expected the server and new router sections", sections)
+	}
+	if lists.list.Hash == oldHash || lists.hashesOnly.Hash != lists.list.Hash {
+		t.Errorf("list hash = %q, hashes-only hash = %q, expected a new hash for both", lists.list.Hash, lists.hashesOnly.Hash)
+	}
+
+	client, err := NewSection("client", "direct", map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.SetSection(client)
+	if sections := cm.lists.Load().list.Sections; len(sections) != 2 {
+		t.Errorf("SetSection() added %+v to the sections", client)
+	}
+}
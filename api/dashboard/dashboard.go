@@ -0,0 +1,24 @@
+// Package dashboard serves the built-in web dashboard.
+//
+// The dashboard is a single page that polls the server management and routing APIs,
+// for deployments without a separate monitoring stack.
+package dashboard
+
+import (
+	_ "embed"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// RegisterRoutes serves the dashboard at the router's root.
+// The router must be mounted at /dashboard next to the /api group, as the page derives the API path from its own.
+func RegisterRoutes(r fiber.Router) {
+	r.Get("/", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		return c.Send(indexHTML)
+	})
+}
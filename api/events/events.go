@@ -0,0 +1,102 @@
+// Package events implements the event streaming API v1.
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// streamBufferSize is the number of events buffered for each stream subscriber.
+	streamBufferSize = 256
+
+	// streamKeepAliveInterval is the interval between keep-alive comments on idle streams.
+	streamKeepAliveInterval = 15 * time.Second
+)
+
+// EventManager handles event API requests.
+type EventManager struct {
+	bus *event.Bus
+}
+
+// NewEventManager returns a new event manager for the bus.
+func NewEventManager(bus *event.Bus) *EventManager {
+	return &EventManager{bus: bus}
+}
+
+// RegisterRoutes sets up routes for the event API.
+func (em *EventManager) RegisterRoutes(v1 fiber.Router) {
+	v1.Get("/stats", em.GetStats)
+	v1.Get("/stream", em.Stream)
+}
+
+// GetStats returns the event bus counters.
+func (em *EventManager) GetStats(c *fiber.Ctx) error {
+	return c.JSON(em.bus.Stats())
+}
+
+// Stream streams events to the client as server-sent events.
+//
+// The optional "kind" query parameter (repeatable) selects event kinds,
+// and the optional "server" query parameter (repeatable) selects servers.
+func (em *EventManager) Stream(c *fiber.Ctx) error {
+	var kinds []event.Kind
+	for _, v := range c.Context().QueryArgs().PeekMulti("kind") {
+		var k event.Kind
+		if err := k.UnmarshalText(v); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: err.Error()})
+		}
+		kinds = append(kinds, k)
+	}
+
+	var servers []string
+	for _, v := range c.Context().QueryArgs().PeekMulti("server") {
+		servers = append(servers, string(v))
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+
+	sub := em.bus.Subscribe(streamBufferSize, kinds...)
+	done := c.Context().Done()
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer sub.Close()
+
+		ticker := time.NewTicker(streamKeepAliveInterval)
+		defer ticker.Stop()
+
+		enc := json.NewEncoder(w)
+		events := sub.Events()
+
+		for {
+			select {
+			case e := <-events:
+				if len(servers) > 0 && !slices.Contains(servers, e.Server) {
+					continue
+				}
+				w.WriteString("data: ")
+				// Encode appends a newline, which, together with the one below, ends the event.
+				if err := enc.Encode(&e); err != nil {
+					return
+				}
+				w.WriteByte('\n')
+			case <-ticker.C:
+				w.WriteString(": keep-alive\n\n")
+			case <-done:
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
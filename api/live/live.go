@@ -0,0 +1,268 @@
+// Package live implements the live statistics streaming API v1.
+package live
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// statsInterval is the interval between traffic delta messages.
+	statsInterval = time.Second
+
+	// streamBufferSize is the number of events buffered for each stream subscriber.
+	streamBufferSize = 256
+
+	// writeTimeout is the timeout for writing a message to the client.
+	writeTimeout = 10 * time.Second
+
+	// closeStatusGoingAway is the close status sent when the API server shuts down.
+	closeStatusGoingAway = 1001
+)
+
+// streamedEventKinds are the event kinds forwarded to live stream clients.
+var streamedEventKinds = [...]event.Kind{
+	event.KindConnOpened,
+	event.KindConnClosed,
+	event.KindSessionCreated,
+	event.KindSessionExpired,
+}
+
+// MessageType is the type of a live stream message.
+type MessageType string
+
+const (
+	// MessageTypeStats is a message containing traffic deltas of the last interval.
+	MessageTypeStats MessageType = "stats"
+
+	// MessageTypeEvent is a message containing a session open or close event.
+	MessageTypeEvent MessageType = "event"
+)
+
+// Message is a JSON message sent over the live stream.
+type Message struct {
+	Type MessageType `json:"type"`
+	Time time.Time   `json:"time"`
+
+	// Servers contains the traffic deltas of each server. Only set for stats messages.
+	Servers []ServerTraffic `json:"servers,omitempty"`
+
+	// Event is the relay event. Only set for event messages.
+	Event *event.Event `json:"event,omitempty"`
+}
+
+// ServerTraffic contains the traffic of a server and its users in a stats interval.
+//
+// Users without traffic in the interval are omitted.
+type ServerTraffic struct {
+	Name string `json:"server"`
+	stats.Traffic
+	Users []stats.User `json:"users,omitempty"`
+}
+
+// LiveManager handles live streaming API requests.
+type LiveManager struct {
+	sm  *ssm.ServerManager
+	bus *event.Bus
+}
+
+// NewLiveManager returns a new live manager for the servers managed by sm.
+// If bus is nil, session open and close events are not streamed.
+func NewLiveManager(sm *ssm.ServerManager, bus *event.Bus) *LiveManager {
+	return &LiveManager{sm: sm, bus: bus}
+}
+
+// RegisterRoutes sets up routes for the live streaming API.
+func (lm *LiveManager) RegisterRoutes(v1 fiber.Router) {
+	v1.Get("/stream", lm.Stream)
+}
+
+// Stream upgrades the connection to WebSocket, and streams per-second traffic deltas
+// and session open and close events as JSON text messages.
+//
+// The optional "server" query parameter (repeatable) selects servers.
+func (lm *LiveManager) Stream(c *fiber.Ctx) error {
+	if !strings.EqualFold(c.Get(fiber.HeaderUpgrade), "websocket") {
+		return c.Status(fiber.StatusUpgradeRequired).JSON(&ssm.StandardError{Message: "expected WebSocket upgrade"})
+	}
+	if c.Get(fiber.HeaderSecWebSocketVersion) != "13" {
+		c.Set(fiber.HeaderSecWebSocketVersion, "13")
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: errWebSocketVersionMismatch.Error()})
+	}
+	key := c.Get(fiber.HeaderSecWebSocketKey)
+	if key == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: errMissingWebSocketClientKey.Error()})
+	}
+
+	var servers []string
+	for _, v := range c.Context().QueryArgs().PeekMulti("server") {
+		servers = append(servers, string(v))
+	}
+
+	var sub *event.Subscription
+	if lm.bus != nil {
+		sub = lm.bus.Subscribe(streamBufferSize, streamedEventKinds[:]...)
+	}
+	done := c.Context().Done()
+
+	c.Set(fiber.HeaderUpgrade, "websocket")
+	c.Set(fiber.HeaderConnection, "Upgrade")
+	c.Set(fiber.HeaderSecWebSocketAccept, websocketAcceptKey(key))
+	c.Status(fiber.StatusSwitchingProtocols)
+
+	c.Context().Hijack(func(conn net.Conn) {
+		lm.serve(conn, servers, sub, done)
+	})
+	return nil
+}
+
+type serverSnapshot struct {
+	name  string
+	stats stats.Server
+}
+
+// snapshot returns the traffic statistics of the selected servers, or all servers if servers is empty.
+func (lm *LiveManager) snapshot(servers []string) []serverSnapshot {
+	var snapshots []serverSnapshot
+	for name, sc := range lm.sm.Collectors() {
+		if len(servers) > 0 && !slices.Contains(servers, name) {
+			continue
+		}
+		snapshots = append(snapshots, serverSnapshot{name: name, stats: sc.Snapshot()})
+	}
+	return snapshots
+}
+
+// trafficDeltas returns the traffic of each server and its users between prev and cur.
+//
+// Servers are matched by name, as a config reload may add, remove or reorder servers
+// between snapshots. A server missing from prev is treated as having no previous traffic.
+func trafficDeltas(cur, prev []serverSnapshot) []ServerTraffic {
+	prevByName := make(map[string]*stats.Server, len(prev))
+	for i := range prev {
+		prevByName[prev[i].name] = &prev[i].stats
+	}
+
+	var zero stats.Server
+	deltas := make([]ServerTraffic, len(cur))
+	for i := range cur {
+		c, p := &cur[i].stats, prevByName[cur[i].name]
+		if p == nil {
+			p = &zero
+		}
+		st := ServerTraffic{
+			Name:    cur[i].name,
+			Traffic: c.Traffic.Delta(p.Traffic),
+		}
+		for _, u := range c.Users {
+			var pt stats.Traffic
+			if j, ok := slices.BinarySearchFunc(p.Users, u.Name, func(pu stats.User, name string) int {
+				return cmp.Compare(pu.Name, name)
+			}); ok {
+				pt = p.Users[j].Traffic
+			}
+			if d := u.Traffic.Delta(pt); d != (stats.Traffic{}) {
+				st.Users = append(st.Users, stats.User{Name: u.Name, Traffic: d})
+			}
+		}
+		deltas[i] = st
+	}
+	return deltas
+}
+
+// serve streams messages to the hijacked WebSocket connection until the client goes away
+// or the API server shuts down.
+func (lm *LiveManager) serve(conn net.Conn, servers []string, sub *event.Subscription, done <-chan struct{}) {
+	var events <-chan event.Event
+	if sub != nil {
+		defer sub.Close()
+		events = sub.Events()
+	}
+
+	var mu sync.Mutex
+	writeFrame := func(opcode byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := conn.Write(appendFrame(nil, opcode, payload))
+		return err
+	}
+
+	// The client is not expected to send messages.
+	// Read frames only to answer pings and detect closure.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		r := bufio.NewReader(conn)
+		buf := make([]byte, maxControlPayloadLength)
+		for {
+			opcode, payload, err := readFrame(r, buf)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case opcodePing:
+				if err := writeFrame(opcodePong, payload); err != nil {
+					return
+				}
+			case opcodeClose:
+				// Echo the close status code, if any.
+				_ = writeFrame(opcodeClose, payload[:min(len(payload), 2)])
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	prev := lm.snapshot(servers)
+
+	for {
+		var msg Message
+		select {
+		case t := <-ticker.C:
+			cur := lm.snapshot(servers)
+			msg = Message{
+				Type:    MessageTypeStats,
+				Time:    t,
+				Servers: trafficDeltas(cur, prev),
+			}
+			prev = cur
+		case e := <-events:
+			if len(servers) > 0 && !slices.Contains(servers, e.Server) {
+				continue
+			}
+			msg = Message{
+				Type:  MessageTypeEvent,
+				Time:  e.Time,
+				Event: &e,
+			}
+		case <-closed:
+			return
+		case <-done:
+			_ = writeFrame(opcodeClose, binary.BigEndian.AppendUint16(nil, closeStatusGoingAway))
+			return
+		}
+
+		b, err := json.Marshal(&msg)
+		if err != nil {
+			return
+		}
+		if err = writeFrame(opcodeText, b); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package live
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/net/websocket"
+)
+
+func TestStream(t *testing.T) {
+	sc := stats.Config{Enabled: true}.Collector()
+	sm := ssm.NewServerManager()
+	sm.AddServer("ss-2022", nil, sc, nil, nil, nil, nil, conn.Addr{})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	NewLiveManager(sm, nil).RegisterRoutes(app.Group("/api/live/v1"))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+
+	addr := ln.Addr().String()
+	ws, err := websocket.Dial("ws://"+addr+"/api/live/v1/stream", "", "http://"+addr)
+	if err != nil {
+		t.Fatalf("websocket.Dial() failed: %v", err)
+	}
+	defer ws.Close()
+
+	sc.CollectTCPSession("Steve", 1024, 2048)
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err = websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("websocket.JSON.Receive() failed: %v", err)
+	}
+	if msg.Type != MessageTypeStats {
+		t.Fatalf("msg.Type = %q, expected %q", msg.Type, MessageTypeStats)
+	}
+	if len(msg.Servers) != 1 {
+		t.Fatalf("len(msg.Servers) = %d, expected 1", len(msg.Servers))
+	}
+	st := msg.Servers[0]
+	if st.Name != "ss-2022" || st.DownlinkBytes != 1024 || st.UplinkBytes != 2048 {
+		t.Errorf("msg.Servers[0] = %+v, expected ss-2022 with 1024 downlink and 2048 uplink bytes", st)
+	}
+	if len(st.Users) != 1 || st.Users[0].Name != "Steve" || st.Users[0].TCPSessions != 1 {
+		t.Errorf("msg.Servers[0].Users = %+v, expected one TCP session for Steve", st.Users)
+	}
+
+	// No traffic in the next interval.
+	msg = Message{}
+	if err = websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("websocket.JSON.Receive() failed: %v", err)
+	}
+	if st := msg.Servers[0]; st.Traffic != (stats.Traffic{}) || len(st.Users) != 0 {
+		t.Errorf("msg.Servers[0] = %+v, expected no traffic", st)
+	}
+}
+
+func TestTrafficDeltas(t *testing.T) {
+	prev := []serverSnapshot{
+		{name: "removed", stats: stats.Server{Traffic: stats.Traffic{UplinkBytes: 100}}},
+		{name: "kept", stats: stats.Server{
+			Traffic: stats.Traffic{UplinkBytes: 100},
+			Users:   []stats.User{{Name: "Steve", Traffic: stats.Traffic{UplinkBytes: 100}}},
+		}},
+	}
+	cur := []serverSnapshot{
+		{name: "added", stats: stats.Server{Traffic: stats.Traffic{UplinkBytes: 50}}},
+		{name: "kept", stats: stats.Server{
+			Traffic: stats.Traffic{UplinkBytes: 300},
+			Users:   []stats.User{{Name: "Steve", Traffic: stats.Traffic{UplinkBytes: 300}}},
+		}},
+	}
+
+	deltas := trafficDeltas(cur, prev)
+	if len(deltas) != 2 {
+		t.Fatalf("len(deltas) = %d, expected 2", len(deltas))
+	}
+	if d := deltas[0]; d.Name != "added" || d.UplinkBytes != 50 {
+		t.Errorf("deltas[0] = %+v, expected added with 50 uplink bytes", d)
+	}
+	if d := deltas[1]; d.Name != "kept" || d.UplinkBytes != 200 || len(d.Users) != 1 || d.Users[0].UplinkBytes != 200 {
+		t.Errorf("deltas[1] = %+v, expected kept with 200 uplink bytes from Steve", d)
+	}
+}
+
+func TestStreamReload(t *testing.T) {
+	sc := stats.Config{Enabled: true}.Collector()
+	sm := ssm.NewServerManager()
+	sm.AddServer("ss-2022", nil, sc, nil, nil, nil, nil, conn.Addr{})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	NewLiveManager(sm, nil).RegisterRoutes(app.Group("/api/live/v1"))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+
+	addr := ln.Addr().String()
+	ws, err := websocket.Dial("ws://"+addr+"/api/live/v1/stream", "", "http://"+addr)
+	if err != nil {
+		t.Fatalf("websocket.Dial() failed: %v", err)
+	}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err = websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("websocket.JSON.Receive() failed: %v", err)
+	}
+
+	// Simulate a reload that replaces the server and adds new ones before it.
+	sm.RemoveServer("ss-2022")
+	newSC := stats.Config{Enabled: true}.Collector()
+	addedSC := stats.Config{Enabled: true}.Collector()
+	sm.AddServer("added", nil, addedSC, nil, nil, nil, nil, conn.Addr{})
+	sm.AddServer("ss-2022", nil, newSC, nil, nil, nil, nil, conn.Addr{})
+	addedSC.CollectTCPSession("Alex", 1, 2)
+	newSC.CollectTCPSession("Steve", 3, 4)
+
+	msg = Message{}
+	if err = websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("websocket.JSON.Receive() failed: %v", err)
+	}
+	if len(msg.Servers) != 2 {
+		t.Fatalf("len(msg.Servers) = %d, expected 2", len(msg.Servers))
+	}
+	for _, st := range msg.Servers {
+		switch st.Name {
+		case "added":
+			if st.DownlinkBytes != 1 || st.UplinkBytes != 2 {
+				t.Errorf("added = %+v, expected 1 downlink and 2 uplink bytes", st)
+			}
+		case "ss-2022":
+			if st.DownlinkBytes != 3 || st.UplinkBytes != 4 {
+				t.Errorf("ss-2022 = %+v, expected 3 downlink and 4 uplink bytes", st)
+			}
+		default:
+			t.Errorf("unexpected server %q", st.Name)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package live
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// websocketGUID is the magic string appended to the client key to compute the accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	opcodeText  = 0x1
+	opcodeClose = 0x8
+	opcodePing  = 0x9
+	opcodePong  = 0xA
+)
+
+// maxControlPayloadLength is the maximum payload length of a control frame.
+const maxControlPayloadLength = 125
+
+var (
+	errUnmaskedClientFrame       = errors.New("client frame is not masked")
+	errControlFrameTooLong       = errors.New("control frame payload too long")
+	errFragmentedControlFrame    = errors.New("control frame is fragmented")
+	errWebSocketVersionMismatch  = errors.New("unsupported WebSocket version")
+	errMissingWebSocketClientKey = errors.New("missing Sec-WebSocket-Key header")
+)
+
+// websocketAcceptKey returns the Sec-WebSocket-Accept value for the given Sec-WebSocket-Key.
+func websocketAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// appendFrame appends an unfragmented, unmasked server frame to b.
+func appendFrame(b []byte, opcode byte, payload []byte) []byte {
+	b = append(b, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, payload...)
+}
+
+// readFrame reads a client frame from r, and returns its opcode and unmasked payload.
+//
+// Payloads of data frames are discarded, as the stream does not accept client messages.
+func readFrame(r *bufio.Reader, buf []byte) (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if !masked {
+		return 0, nil, errUnmaskedClientFrame
+	}
+
+	isControl := opcode&0x8 != 0
+	if isControl {
+		if !fin {
+			return 0, nil, errFragmentedControlFrame
+		}
+		if length > maxControlPayloadLength {
+			return 0, nil, errControlFrameTooLong
+		}
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var maskKey [4]byte
+	if _, err = io.ReadFull(r, maskKey[:]); err != nil {
+		return 0, nil, err
+	}
+
+	if !isControl {
+		for length > 0 {
+			n := min(length, 1<<20)
+			if _, err = r.Discard(int(n)); err != nil {
+				return 0, nil, err
+			}
+			length -= n
+		}
+		return opcode, nil, nil
+	}
+
+	payload = buf[:length]
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= maskKey[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,84 @@
+package live
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestWebSocketAcceptKey(t *testing.T) {
+	// Example from RFC 6455 Section 1.3.
+	const expected = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got := websocketAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != expected {
+		t.Errorf("websocketAcceptKey() = %q, expected %q", got, expected)
+	}
+}
+
+func TestAppendFrame(t *testing.T) {
+	for _, c := range []struct {
+		payloadLength int
+		headerLength  int
+	}{
+		{0, 2},
+		{125, 2},
+		{126, 4},
+		{65535, 4},
+		{65536, 10},
+	} {
+		b := appendFrame(nil, opcodeText, make([]byte, c.payloadLength))
+		if len(b) != c.headerLength+c.payloadLength {
+			t.Errorf("len(appendFrame(%d)) = %d, expected %d", c.payloadLength, len(b), c.headerLength+c.payloadLength)
+		}
+		if b[0] != 0x80|opcodeText {
+			t.Errorf("appendFrame(%d)[0] = %#x, expected %#x", c.payloadLength, b[0], 0x80|opcodeText)
+		}
+	}
+}
+
+// appendMaskedFrame appends a masked client frame to b.
+func appendMaskedFrame(b []byte, opcode byte, payload []byte, maskKey [4]byte) []byte {
+	frame := appendFrame(nil, opcode, payload)
+	headerLength := len(frame) - len(payload)
+	b = append(b, frame[:headerLength]...)
+	b[len(b)-headerLength+1] |= 0x80
+	b = append(b, maskKey[:]...)
+	for i, c := range payload {
+		b = append(b, c^maskKey[i%4])
+	}
+	return b
+}
+
+func TestReadFrame(t *testing.T) {
+	maskKey := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	var b []byte
+	b = appendMaskedFrame(b, opcodeText, make([]byte, 70000), maskKey)
+	b = appendMaskedFrame(b, opcodePing, []byte("hello"), maskKey)
+	b = appendMaskedFrame(b, opcodeClose, []byte{0x03, 0xe8}, maskKey)
+
+	r := bufio.NewReader(bytes.NewReader(b))
+	buf := make([]byte, maxControlPayloadLength)
+
+	for _, expected := range []struct {
+		opcode  byte
+		payload []byte
+	}{
+		{opcodeText, nil},
+		{opcodePing, []byte("hello")},
+		{opcodeClose, []byte{0x03, 0xe8}},
+	} {
+		opcode, payload, err := readFrame(r, buf)
+		if err != nil {
+			t.Fatalf("readFrame() failed: %v", err)
+		}
+		if opcode != expected.opcode {
+			t.Errorf("opcode = %#x, expected %#x", opcode, expected.opcode)
+		}
+		if !bytes.Equal(payload, expected.payload) {
+			t.Errorf("payload = %q, expected %q", payload, expected.payload)
+		}
+	}
+
+	if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(appendFrame(nil, opcodeText, nil))), buf); err != errUnmaskedClientFrame {
+		t.Errorf("readFrame(unmasked) = %v, expected %v", err, errUnmaskedClientFrame)
+	}
+}
@@ -0,0 +1,155 @@
+// Package metrics exports server statistics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"iter"
+	"strconv"
+	"strings"
+
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter handles metrics requests.
+type Exporter struct {
+	sm *ssm.ServerManager
+}
+
+// NewExporter returns a new exporter for the servers managed by sm.
+func NewExporter(sm *ssm.ServerManager) *Exporter {
+	return &Exporter{sm: sm}
+}
+
+// RegisterRoutes sets up routes for the metrics endpoint.
+func (e *Exporter) RegisterRoutes(router fiber.Router) {
+	router.Get("/metrics", e.GetMetrics)
+}
+
+// GetMetrics returns the counters of all managed servers and their users.
+func (e *Exporter) GetMetrics(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, ContentType)
+	return c.Send(AppendMetrics(nil, e.sm.Collectors()))
+}
+
+type serverStats struct {
+	name       string
+	stats      stats.Server
+	rejections stats.Rejections
+}
+
+type trafficCounter struct {
+	name  string
+	help  string
+	value func(*stats.Traffic) uint64
+}
+
+var trafficCounters = [...]trafficCounter{
+	{"downlink_packets_total", "Number of packets sent to clients.", func(t *stats.Traffic) uint64 { return t.DownlinkPackets }},
+	{"downlink_bytes_total", "Number of bytes sent to clients.", func(t *stats.Traffic) uint64 { return t.DownlinkBytes }},
+	{"uplink_packets_total", "Number of packets received from clients.", func(t *stats.Traffic) uint64 { return t.UplinkPackets }},
+	{"uplink_bytes_total", "Number of bytes received from clients.", func(t *stats.Traffic) uint64 { return t.UplinkBytes }},
+	{"tcp_sessions_total", "Number of finished TCP sessions.", func(t *stats.Traffic) uint64 { return t.TCPSessions }},
+	{"udp_sessions_total", "Number of finished UDP sessions.", func(t *stats.Traffic) uint64 { return t.UDPSessions }},
+	{"rate_limit_delayed_bytes_total", "Number of bytes delayed by rate limiting.", func(t *stats.Traffic) uint64 { return t.RateLimitDelayedBytes }},
+	{"rate_limit_dropped_packets_total", "Number of packets dropped by rate limiting.", func(t *stats.Traffic) uint64 { return t.RateLimitDroppedPackets }},
+	{"tcp_urgent_bytes_discarded_total", "Number of TCP urgent data bytes discarded from client streams.", func(t *stats.Traffic) uint64 { return t.TCPUrgentBytesDiscarded }},
+	{"oversized_packets_dropped_total", "Number of oversized UDP packets dropped.", func(t *stats.Traffic) uint64 { return t.OversizedPacketsDropped }},
+	{"oversized_packets_truncated_total", "Number of oversized UDP packets truncated.", func(t *stats.Traffic) uint64 { return t.OversizedPacketsTruncated }},
+	{"udp_sessions_evicted_total", "Number of UDP sessions evicted to make room for new sessions.", func(t *stats.Traffic) uint64 { return t.UDPSessionsEvicted }},
+}
+
+type rejectionCounter struct {
+	kind  stats.RejectionKind
+	value func(*stats.Rejections) uint64
+}
+
+var rejectionCounters = [...]rejectionCounter{
+	{stats.RejectionKindHandshake, func(r *stats.Rejections) uint64 { return r.Handshake }},
+	{stats.RejectionKindUnpack, func(r *stats.Rejections) uint64 { return r.Unpack }},
+	{stats.RejectionKindRoute, func(r *stats.Rejections) uint64 { return r.Route }},
+	{stats.RejectionKindHandshakeTimeout, func(r *stats.Rejections) uint64 { return r.HandshakeTimeout }},
+	{stats.RejectionKindLimit, func(r *stats.Rejections) uint64 { return r.Limit }},
+	{stats.RejectionKindACL, func(r *stats.Rejections) uint64 { return r.ACL }},
+	{stats.RejectionKindReplay, func(r *stats.Rejections) uint64 { return r.Replay }},
+}
+
+// AppendMetrics appends the counters of the given servers in the Prometheus text exposition format to b.
+//
+// Server-wide counters are named shadowsocks_server_* with a server label.
+// Per-user counters are named shadowsocks_user_* with server and user labels.
+// Rejection counters are only populated when rejection sampling is enabled.
+func AppendMetrics(b []byte, collectors iter.Seq2[string, stats.Collector]) []byte {
+	var servers []serverStats
+	for name, sc := range collectors {
+		servers = append(servers, serverStats{
+			name:       name,
+			stats:      sc.Snapshot(),
+			rejections: sc.Rejections(),
+		})
+	}
+
+	for _, tc := range trafficCounters {
+		b = appendHeader(b, "shadowsocks_server_"+tc.name, tc.help)
+		for i := range servers {
+			s := &servers[i]
+			b = appendSample(b, "shadowsocks_server_"+tc.name, tc.value(&s.stats.Traffic), "server", s.name)
+		}
+	}
+
+	for _, tc := range trafficCounters {
+		b = appendHeader(b, "shadowsocks_user_"+tc.name, tc.help)
+		for i := range servers {
+			s := &servers[i]
+			for j := range s.stats.Users {
+				u := &s.stats.Users[j]
+				b = appendSample(b, "shadowsocks_user_"+tc.name, tc.value(&u.Traffic), "server", s.name, "user", u.Name)
+			}
+		}
+	}
+
+	b = appendHeader(b, "shadowsocks_server_rejections_total", "Number of rejected connections and packets.")
+	for i := range servers {
+		s := &servers[i]
+		for _, rc := range rejectionCounters {
+			b = appendSample(b, "shadowsocks_server_rejections_total", rc.value(&s.rejections), "server", s.name, "kind", rc.kind.String())
+		}
+	}
+
+	return b
+}
+
+func appendHeader(b []byte, name, help string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, help...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, name...)
+	b = append(b, " counter\n"...)
+	return b
+}
+
+// appendSample appends a sample line to b. labels must be name-value pairs.
+func appendSample(b []byte, name string, value uint64, labels ...string) []byte {
+	b = append(b, name...)
+	b = append(b, '{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, labels[i]...)
+		b = append(b, `="`...)
+		b = append(b, labelValueReplacer.Replace(labels[i+1])...)
+		b = append(b, '"')
+	}
+	b = append(b, "} "...)
+	b = strconv.AppendUint(b, value, 10)
+	b = append(b, '\n')
+	return b
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
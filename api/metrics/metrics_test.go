@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/stats"
+)
+
+func TestAppendMetrics(t *testing.T) {
+	sc := stats.Config{Enabled: true, RejectionSampleRate: 1}.Collector()
+	sc.CollectTCPSession("Steve", 1024, 2048)
+	sc.CollectUDPSessionDownlink(`Alex "the\great"`, 3, 300)
+	sc.CollectRejection(stats.RejectionKindReplay, "udp", netip.AddrPort{}, "", conn.Addr{}, errors.New("detected replay"))
+
+	b := AppendMetrics(nil, func(yield func(string, stats.Collector) bool) {
+		yield("ss-2022", sc)
+	})
+	s := string(b)
+
+	for _, line := range []string{
+		"# TYPE shadowsocks_server_downlink_bytes_total counter",
+		`shadowsocks_server_downlink_bytes_total{server="ss-2022"} 1324`,
+		`shadowsocks_server_tcp_sessions_total{server="ss-2022"} 1`,
+		`shadowsocks_user_uplink_bytes_total{server="ss-2022",user="Steve"} 2048`,
+		`shadowsocks_user_downlink_packets_total{server="ss-2022",user="Alex \"the\\great\""} 3`,
+		`shadowsocks_server_rejections_total{server="ss-2022",kind="replay"} 1`,
+		`shadowsocks_server_rejections_total{server="ss-2022",kind="handshake"} 0`,
+	} {
+		if !strings.Contains(s, line+"\n") {
+			t.Errorf("missing line %q in output:\n%s", line, s)
+		}
+	}
+}
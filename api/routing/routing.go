@@ -0,0 +1,72 @@
+// Package routing implements the routing API v1.
+package routing
+
+import (
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/gofiber/fiber/v2"
+)
+
+// RouteManager handles routing API requests.
+type RouteManager struct {
+	router *router.Router
+}
+
+// NewRouteManager returns a new route manager for the router.
+func NewRouteManager(router *router.Router) *RouteManager {
+	return &RouteManager{router: router}
+}
+
+// RegisterRoutes sets up routes for the routing API.
+func (rm *RouteManager) RegisterRoutes(v1 fiber.Router) {
+	v1.Get("/stats", rm.GetStats)
+	v1.Get("/routes", rm.GetRoutes)
+	v1.Put("/routes", rm.ReplaceRoutes)
+	v1.Patch("/routes", rm.PatchRoutes)
+}
+
+// RouteStatsList contains the hit counters of all routes.
+type RouteStatsList struct {
+	Routes []router.RouteStats `json:"routes"`
+}
+
+// GetStats returns the number of connections and sessions routed by each route.
+func (rm *RouteManager) GetStats(c *fiber.Ctx) error {
+	return c.JSON(&RouteStatsList{Routes: rm.router.Stats()})
+}
+
+// RouteList contains the configs of all routes, excluding the default route.
+type RouteList struct {
+	Routes []router.RouteConfig `json:"routes"`
+}
+
+// GetRoutes returns the configs of the routes in the order of evaluation.
+func (rm *RouteManager) GetRoutes(c *fiber.Ctx) error {
+	return c.JSON(&RouteList{Routes: rm.router.Routes()})
+}
+
+// ReplaceRoutes replaces all routes with the routes in the request body.
+// Invalid routes are rejected, and the routes are left unchanged.
+func (rm *RouteManager) ReplaceRoutes(c *fiber.Ctx) error {
+	var list RouteList
+	if err := c.BodyParser(&list); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: err.Error()})
+	}
+	if err := rm.router.ReplaceRoutes(list.Routes); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: err.Error()})
+	}
+	return rm.GetRoutes(c)
+}
+
+// PatchRoutes deletes and upserts routes by name as specified in the request body.
+// Invalid patches are rejected, and the routes are left unchanged.
+func (rm *RouteManager) PatchRoutes(c *fiber.Ctx) error {
+	var patch router.RoutesPatch
+	if err := c.BodyParser(&patch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: err.Error()})
+	}
+	if err := rm.router.PatchRoutes(patch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&ssm.StandardError{Message: err.Error()})
+	}
+	return rm.GetRoutes(c)
+}
@@ -0,0 +1,100 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+func TestRoutes(t *testing.T) {
+	config := router.Config{
+		DefaultTCPClientName: "direct",
+		DefaultUDPClientName: "direct",
+		Routes: []router.RouteConfig{
+			{
+				Name:    "block-smtp",
+				Network: "tcp",
+				Client:  "reject",
+				ToPorts: []uint16{25},
+			},
+		},
+	}
+	r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	NewRouteManager(r).RegisterRoutes(app.Group("/api/routing/v1"))
+
+	for _, c := range []struct {
+		method     string
+		body       string
+		wantStatus int
+		wantRoutes []string
+	}{
+		{http.MethodGet, "", fiber.StatusOK, []string{"block-smtp"}},
+		{http.MethodPut, `{"routes":[{"name":"block-ads","client":"reject","toDomains":["ads.example.com"]}]}`, fiber.StatusOK, []string{"block-ads"}},
+		{http.MethodPut, `{"routes":[{"name":"default","client":"reject"}]}`, fiber.StatusBadRequest, []string{"block-ads"}},
+		{http.MethodPatch, `{"upsert":[{"name":"block-smtp","network":"tcp","client":"reject","toPorts":[25]}]}`, fiber.StatusOK, []string{"block-ads", "block-smtp"}},
+		{http.MethodPatch, `{"delete":["block-ads"]}`, fiber.StatusOK, []string{"block-smtp"}},
+		{http.MethodPatch, `{"delete":["block-ads"]}`, fiber.StatusBadRequest, []string{"block-smtp"}},
+	} {
+		req := httptest.NewRequest(c.method, "/api/routing/v1/routes", strings.NewReader(c.body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", c.method, c.body, resp.StatusCode, c.wantStatus)
+		}
+
+		resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/api/routing/v1/routes", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list RouteList
+		if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		names := make([]string, len(list.Routes))
+		for i, route := range list.Routes {
+			names[i] = route.Name
+		}
+		if strings.Join(names, ",") != strings.Join(c.wantRoutes, ",") {
+			t.Errorf("%s %s: routes = %q, want %q", c.method, c.body, names, c.wantRoutes)
+		}
+	}
+
+	// Returned routes can be put back as is.
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/api/routing/v1/routes", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/api/routing/v1/routes", bytes.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if resp, err = app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("PUT %s: status = %d, want %d", body, resp.StatusCode, fiber.StatusOK)
+	}
+}
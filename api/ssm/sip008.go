@@ -0,0 +1,120 @@
+package ssm
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/gofiber/fiber/v2"
+	"lukechampine.com/blake3"
+)
+
+// OnlineConfigKeyLength is the length of the key for deriving online config tokens.
+const OnlineConfigKeyLength = 32
+
+// onlineConfigMACLength is the length of the MAC in online config tokens.
+const onlineConfigMACLength = 16
+
+// SetOnlineConfigKey enables serving users' SIP008 online config documents,
+// with tokens derived from the key, which must be [OnlineConfigKeyLength] bytes.
+// It must be called before the server manager is used.
+func (sm *ServerManager) SetOnlineConfigKey(key []byte) {
+	sm.onlineConfigKey = key
+}
+
+// onlineConfigMAC returns the MAC of the username in online config tokens.
+func (sm *ServerManager) onlineConfigMAC(username string) []byte {
+	h := blake3.New(onlineConfigMACLength, sm.onlineConfigKey)
+	h.Write([]byte(username))
+	return h.Sum(nil)
+}
+
+// onlineConfigToken returns the user's online config token,
+// which is the base64url-encoded username and its MAC, separated by '.'.
+//
+// The token does not depend on the user's credential, so it stays valid across uPSK rotations,
+// and is only revoked by deleting the user or changing the key.
+func (sm *ServerManager) onlineConfigToken(username string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + base64.RawURLEncoding.EncodeToString(sm.onlineConfigMAC(username))
+}
+
+// onlineConfigUsername returns the username in the online config token, if the token is valid.
+func (sm *ServerManager) onlineConfigUsername(token string) (string, bool) {
+	encodedUsername, encodedMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+	username, err := base64.RawURLEncoding.DecodeString(encodedUsername)
+	if err != nil {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare(mac, sm.onlineConfigMAC(string(username))) != 1 {
+		return "", false
+	}
+	return string(username), true
+}
+
+// RegisterOnlineConfigRoutes sets up the route for users' SIP008 online config documents.
+// The route is authenticated by the token in the path, and must not require API authentication,
+// as SIP008 clients only fetch plain URLs.
+func (sm *ServerManager) RegisterOnlineConfigRoutes(r fiber.Router) {
+	r.Get("/:token", sm.GetOnlineConfig)
+}
+
+// GetOnlineConfig returns the SIP008 document of the user identified by the token,
+// with an entry for each server that has the user and a SIP008 address.
+func (sm *ServerManager) GetOnlineConfig(c *fiber.Ctx) error {
+	username, ok := sm.onlineConfigUsername(c.Params("token"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "online config not found"})
+	}
+
+	sm.mu.RLock()
+	names := sm.managedServerNames
+	sm.mu.RUnlock()
+
+	var servers []cred.SIP008Server
+	for _, name := range names {
+		ms := sm.managedServer(name)
+		if ms == nil || ms.cms == nil || !ms.sip008Address.IsValid() {
+			continue
+		}
+		server, ok := ms.cms.UserSIP008Server(username, ms.sip008Address.Host(), ms.sip008Address.Port())
+		if ok {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "online config not found"})
+	}
+
+	// The document has the user's PSKs, which must not be cached by intermediaries.
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(&cred.SIP008Config{
+		Version: 1,
+		Servers: servers,
+	})
+}
+
+// OnlineConfigToken contains a user's online config token.
+type OnlineConfigToken struct {
+	Token string `json:"token"`
+}
+
+// GetOnlineConfigToken returns the user's online config token.
+func (sm *ServerManager) GetOnlineConfigToken(c *fiber.Ctx) error {
+	if sm.onlineConfigKey == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "Online config is not enabled."})
+	}
+	ms := managedServerFromContext(c)
+	username := c.Params("username")
+	if _, ok := ms.cms.GetCredential(username); !ok {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "user not found"})
+	}
+	return c.JSON(&OnlineConfigToken{Token: sm.onlineConfigToken(username)})
+}
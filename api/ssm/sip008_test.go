@@ -0,0 +1,159 @@
+package ssm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func testRequest(t *testing.T, app *fiber.App, target string, v any) int {
+	t.Helper()
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil))
+	if err != nil {
+		t.Fatalf("app.Test failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err = json.Unmarshal(body, v); err != nil {
+			t.Fatalf("failed to decode response %q: %v", body, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestOnlineConfig(t *testing.T) {
+	const method = "2022-blake3-aes-128-gcm"
+	iPSK := []byte("fedcba9876543210")
+	credman := cred.NewManager(nil, zaptest.NewLogger(t))
+	sm := NewServerManager()
+	sm.SetOnlineConfigKey([]byte("0123456789abcdef0123456789abcdef"))
+
+	addServer := func(name, content string, sip008Address conn.Addr) *cred.ManagedServer {
+		path := filepath.Join(t.TempDir(), "upsks.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var tcp ss2022.CredStore
+		cms, err := credman.RegisterServer(name, method, path, iPSK, &tcp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm.AddServer(name, cms, nil, nil, nil, nil, nil, sip008Address)
+		return cms
+	}
+
+	tokyo := addServer("tokyo", `{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg==","Sam":"YWJjZGVmMDEyMzQ1Njc4OQ=="}`, conn.MustAddrFromDomainPort("tokyo.example.com", 20220))
+	addServer("seattle", `{"Alex":"MTIzNDU2Nzg5YWJjZGVmMA=="}`, conn.MustAddrFromDomainPort("seattle.example.com", 20221))
+	addServer("internal", `{"Alex":"MTIzNDU2Nzg5YWJjZGVmMA=="}`, conn.Addr{})
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	sm.RegisterOnlineConfigRoutes(app.Group("/sip008/v1"))
+	// Like API authentication, reject everything else without credentials.
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Get("X-Admin") == "" {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+		return c.Next()
+	})
+	sm.RegisterRoutes(app.Group("/api/ssm/v1"))
+
+	getToken := func(server, username string) string {
+		req := httptest.NewRequest(http.MethodGet, "/api/ssm/v1/servers/"+server+"/users/"+username+"/sip008", nil)
+		req.Header.Set("X-Admin", "1")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("token status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		var token OnlineConfigToken
+		if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+
+	token := getToken("tokyo", "Alex")
+	if other := getToken("seattle", "Alex"); other != token {
+		t.Errorf("token from seattle = %q, want %q as from tokyo", other, token)
+	}
+
+	var cfg cred.SIP008Config
+	if status := testRequest(t, app, "/sip008/v1/"+token, &cfg); status != http.StatusOK {
+		t.Fatalf("online config status = %d, want %d", status, http.StatusOK)
+	}
+	if cfg.Version != 1 || len(cfg.Servers) != 2 {
+		t.Fatalf("online config = %+v, want 2 servers", cfg)
+	}
+	if s := cfg.Servers[0]; s.Remarks != "tokyo" || s.Server != "tokyo.example.com" || s.ServerPort != 20220 || s.Password != "ZmVkY2JhOTg3NjU0MzIxMA==:MDEyMzQ1Njc4OWFiY2RlZg==" {
+		t.Errorf("servers[0] = %+v, want Alex's entry on tokyo", s)
+	}
+	if s := cfg.Servers[1]; s.Remarks != "seattle" || s.Server != "seattle.example.com" || s.ServerPort != 20221 || s.Password != "ZmVkY2JhOTg3NjU0MzIxMA==:MTIzNDU2Nzg5YWJjZGVmMA==" {
+		t.Errorf("servers[1] = %+v, want Alex's entry on seattle", s)
+	}
+	if want := tokyo.ExportSIP008("tokyo.example.com", 20220).Servers[0].ID; cfg.Servers[0].ID != want {
+		t.Errorf("servers[0].ID = %q, want %q as in the admin export", cfg.Servers[0].ID, want)
+	}
+
+	// Rotated uPSKs are picked up with the same token.
+	if err := tokyo.UpdateCredential("Alex", []byte("9876543210fedcba")); err != nil {
+		t.Fatal(err)
+	}
+	if status := testRequest(t, app, "/sip008/v1/"+token, &cfg); status != http.StatusOK {
+		t.Fatalf("online config status after rotation = %d, want %d", status, http.StatusOK)
+	}
+	if want := "ZmVkY2JhOTg3NjU0MzIxMA==:OTg3NjU0MzIxMGZlZGNiYQ=="; cfg.Servers[0].Password != want {
+		t.Errorf("password after rotation = %q, want %q", cfg.Servers[0].Password, want)
+	}
+
+	username, mac, _ := strings.Cut(token, ".")
+	samToken := getToken("tokyo", "Sam")
+	_, samMAC, _ := strings.Cut(samToken, ".")
+
+	for _, c := range []struct {
+		name  string
+		token string
+	}{
+		{"NoSeparator", username + mac},
+		{"BadMAC", username + "." + samMAC},
+		{"BadBase64", username + ".!!!"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if status := testRequest(t, app, "/sip008/v1/"+c.token, nil); status != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", status, http.StatusNotFound)
+			}
+		})
+	}
+
+	// Deleted users can no longer fetch their documents.
+	if err := tokyo.DeleteCredential("Sam"); err != nil {
+		t.Fatal(err)
+	}
+	if status := testRequest(t, app, "/sip008/v1/"+samToken, nil); status != http.StatusNotFound {
+		t.Errorf("deleted user status = %d, want %d", status, http.StatusNotFound)
+	}
+
+	// Admin routes still require authentication.
+	if status := testRequest(t, app, "/api/ssm/v1/servers/tokyo/users/Alex/sip008", nil); status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated token status = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
@@ -3,8 +3,19 @@ package ssm
 
 import (
 	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"slices"
+	"strconv"
+	"sync"
 
+	"github.com/database64128/shadowsocks-go/affinity"
+	"github.com/database64128/shadowsocks-go/capture"
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
 	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/gofiber/fiber/v2"
 )
@@ -31,14 +42,24 @@ func GetServerInfo(c *fiber.Ctx) error {
 }
 
 type managedServer struct {
-	cms *cred.ManagedServer
-	sc  stats.Collector
+	cms       *cred.ManagedServer
+	sc        stats.Collector
+	sessions  *affinity.Table
+	conns     *conntrack.Table
+	captures  *capture.Server
+	resources *resource.Server
+
+	// sip008Address is the address of the server in users' SIP008 documents,
+	// or the zero value if the server is left out.
+	sip008Address conn.Addr
 }
 
 // ServerManager handles server management API requests.
 type ServerManager struct {
+	mu                 sync.RWMutex
 	managedServers     map[string]*managedServer
 	managedServerNames []string
+	onlineConfigKey    []byte
 }
 
 // NewServerManager returns a new server manager.
@@ -49,14 +70,70 @@ func NewServerManager() *ServerManager {
 }
 
 // AddServer adds a server to the server manager.
-func (sm *ServerManager) AddServer(name string, cms *cred.ManagedServer, sc stats.Collector) {
+// sessions may be nil if the server does not track UDP sessions.
+// conns may be nil if the server does not track live connections.
+// captures may be nil if the server does not allow traffic capture.
+// resources may be nil if the server does not count resource usage.
+// sip008Address may be the zero value to leave the server out of users' SIP008 documents.
+func (sm *ServerManager) AddServer(name string, cms *cred.ManagedServer, sc stats.Collector, sessions *affinity.Table, conns *conntrack.Table, captures *capture.Server, resources *resource.Server, sip008Address conn.Addr) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
 	sm.managedServers[name] = &managedServer{
-		cms: cms,
-		sc:  sc,
+		cms:           cms,
+		sc:            sc,
+		sessions:      sessions,
+		conns:         conns,
+		captures:      captures,
+		resources:     resources,
+		sip008Address: sip008Address,
 	}
 	sm.managedServerNames = append(sm.managedServerNames, name)
 }
 
+// RemoveServer removes a server from the server manager.
+// It is a no-op if the server is not managed.
+func (sm *ServerManager) RemoveServer(name string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.managedServers[name]; !ok {
+		return
+	}
+	delete(sm.managedServers, name)
+	// Replace instead of modifying in place, as the slice may be in use by readers.
+	sm.managedServerNames = slices.DeleteFunc(slices.Clone(sm.managedServerNames), func(n string) bool {
+		return n == name
+	})
+}
+
+// managedServer returns the managed server with the given name, or nil if there is none.
+func (sm *ServerManager) managedServer(name string) *managedServer {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.managedServers[name]
+}
+
+// Collectors returns an iterator over the names and stats collectors of managed servers,
+// in the order they were added.
+func (sm *ServerManager) Collectors() iter.Seq2[string, stats.Collector] {
+	return func(yield func(string, stats.Collector) bool) {
+		sm.mu.RLock()
+		names := sm.managedServerNames
+		sm.mu.RUnlock()
+
+		for _, name := range names {
+			ms := sm.managedServer(name)
+			if ms == nil {
+				continue
+			}
+			if !yield(name, ms.sc) {
+				return
+			}
+		}
+	}
+}
+
 // RegisterRoutes sets up routes for the /servers endpoint.
 func (sm *ServerManager) RegisterRoutes(v1 fiber.Router) {
 	v1.Get("/servers", sm.ListServers)
@@ -64,25 +141,46 @@ func (sm *ServerManager) RegisterRoutes(v1 fiber.Router) {
 	server := v1.Group("/servers/:server", sm.ContextManagedServer)
 	server.Get("", GetServerInfo)
 	server.Get("/stats", sm.GetStats)
+	server.Get("/rejections", sm.GetRejections)
+	server.Get("/sessions", sm.GetSessions)
+	server.Delete("/sessions/:csid", sm.ExpireSession)
+	server.Get("/resources", sm.GetResources)
+
+	conns := server.Group("/conns", sm.CheckConnTracking)
+	conns.Get("", sm.ListConns)
+	conns.Delete("", sm.CloseUserConns)
+	conns.Delete("/:id", sm.CloseConn)
+
+	captures := server.Group("/capture", sm.CheckTrafficCapture)
+	captures.Get("", sm.GetCapture)
+	captures.Post("", sm.StartCapture)
+	captures.Delete("", sm.StopCapture)
+
+	server.Get("/sip008", sm.CheckMultiUserSupport, sm.ExportSIP008)
 
 	users := server.Group("/users", sm.CheckMultiUserSupport)
 	users.Get("", sm.ListUsers)
 	users.Post("", sm.AddUser)
+	users.Post("/import", sm.ImportUsers)
 	users.Get("/:username", sm.GetUser)
+	users.Get("/:username/sip008", sm.GetOnlineConfigToken)
 	users.Patch("/:username", sm.UpdateUser)
 	users.Delete("/:username", sm.DeleteUser)
 }
 
 // ListServers lists all managed servers.
 func (sm *ServerManager) ListServers(c *fiber.Ctx) error {
-	return c.JSON(&sm.managedServerNames)
+	sm.mu.RLock()
+	names := sm.managedServerNames
+	sm.mu.RUnlock()
+	return c.JSON(&names)
 }
 
 // ContextManagedServer is a middleware for the servers group.
 // It adds the server with the given name to the request context.
 func (sm *ServerManager) ContextManagedServer(c *fiber.Ctx) error {
 	name := c.Params("server")
-	ms := sm.managedServers[name]
+	ms := sm.managedServer(name)
 	if ms == nil {
 		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "server not found"})
 	}
@@ -104,6 +202,164 @@ func (sm *ServerManager) GetStats(c *fiber.Ctx) error {
 	return c.JSON(ms.sc.Snapshot())
 }
 
+// GetRejections returns server rejection counters and sampled rejection events.
+func (sm *ServerManager) GetRejections(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	return c.JSON(ms.sc.Rejections())
+}
+
+// SessionList contains a list of active UDP sessions.
+type SessionList struct {
+	Sessions []affinity.Session `json:"sessions"`
+}
+
+// GetSessions returns the server's active UDP sessions,
+// for external load balancers to keep sessions sticky to this instance.
+func (sm *ServerManager) GetSessions(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	if ms.sessions == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "The server does not track UDP sessions."})
+	}
+	return c.JSON(&SessionList{Sessions: ms.sessions.Snapshot()})
+}
+
+// ExpireSession ends the UDP session with the given client session ID immediately,
+// without waiting for it to time out.
+func (sm *ServerManager) ExpireSession(c *fiber.Ctx) error {
+	csid, err := strconv.ParseUint(c.Params("csid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: "invalid client session ID"})
+	}
+
+	ms := managedServerFromContext(c)
+	if ms.sessions == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "The server does not track UDP sessions."})
+	}
+	if !ms.sessions.Expire(csid) {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "session not found"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// GetResources returns the resource usage of the server's relay services,
+// for capacity planning and leak detection.
+func (sm *ServerManager) GetResources(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	if ms.resources == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "The server does not count resource usage."})
+	}
+	return c.JSON(ms.resources.Snapshot())
+}
+
+// CheckConnTracking is a middleware for the conns group.
+// It checks whether the selected server tracks live connections.
+func (sm *ServerManager) CheckConnTracking(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	if ms.conns == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "The server does not track connections."})
+	}
+	return c.Next()
+}
+
+// ConnList contains a list of live TCP connections and UDP sessions.
+type ConnList struct {
+	Conns []conntrack.Conn `json:"conns"`
+}
+
+// ListConns lists the server's live TCP connections and UDP sessions.
+func (sm *ServerManager) ListConns(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	return c.JSON(&ConnList{Conns: ms.conns.Snapshot()})
+}
+
+// CloseConn terminates the connection or session with the given ID.
+func (sm *ServerManager) CloseConn(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: "invalid connection ID"})
+	}
+
+	ms := managedServerFromContext(c)
+	if !ms.conns.Close(id) {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "connection not found"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ClosedConns contains the number of terminated connections and sessions.
+type ClosedConns struct {
+	Closed int `json:"closed"`
+}
+
+// CloseUserConns terminates all connections and sessions of the user given by the username query parameter.
+func (sm *ServerManager) CloseUserConns(c *fiber.Ctx) error {
+	username := c.Query("username")
+	if username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: "missing username"})
+	}
+
+	ms := managedServerFromContext(c)
+	return c.JSON(&ClosedConns{Closed: ms.conns.CloseUser(username)})
+}
+
+// CheckTrafficCapture is a middleware for the capture group.
+// It checks whether the selected server allows traffic capture.
+func (sm *ServerManager) CheckTrafficCapture(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	if ms.captures == nil {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: "The server does not allow traffic capture."})
+	}
+	return c.Next()
+}
+
+// GetCapture returns the status of the server's running or last traffic capture.
+func (sm *ServerManager) GetCapture(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	status := ms.captures.Status()
+	return c.JSON(&status)
+}
+
+// StartCapture starts capturing decrypted traffic of the server's new connections and sessions
+// that match the capture config in the request body.
+func (sm *ServerManager) StartCapture(c *fiber.Ctx) error {
+	var cfg capture.Config
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&cfg); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
+		}
+	}
+
+	ms := managedServerFromContext(c)
+	status, err := ms.captures.StartCapture(cfg)
+	if err != nil {
+		return c.Status(captureErrorStatus(err)).JSON(&StandardError{Message: err.Error()})
+	}
+	return c.JSON(&status)
+}
+
+// StopCapture stops the server's running traffic capture, and returns its final status.
+func (sm *ServerManager) StopCapture(c *fiber.Ctx) error {
+	ms := managedServerFromContext(c)
+	status, err := ms.captures.StopCapture()
+	if err != nil {
+		return c.Status(captureErrorStatus(err)).JSON(&StandardError{Message: err.Error()})
+	}
+	return c.JSON(&status)
+}
+
+// captureErrorStatus returns the HTTP status code for an error from starting or stopping a capture.
+func captureErrorStatus(err error) int {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, capture.ErrRunning), errors.Is(err, capture.ErrNotRunning):
+		return fiber.StatusConflict
+	case errors.As(err, &pathErr):
+		return fiber.StatusInternalServerError
+	default:
+		return fiber.StatusBadRequest
+	}
+}
+
 // CheckMultiUserSupport is a middleware for the users group.
 // It checks whether the selected server supports user management.
 func (sm *ServerManager) CheckMultiUserSupport(c *fiber.Ctx) error {
@@ -126,19 +382,73 @@ func (sm *ServerManager) ListUsers(c *fiber.Ctx) error {
 }
 
 // AddUser adds a new user credential to the server.
+// The quota and ACL are validated with the credential, so an invalid user is not added.
 func (sm *ServerManager) AddUser(c *fiber.Ctx) error {
 	var uc cred.UserCredential
 	if err := c.BodyParser(&uc); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
 	}
+	uc.Usage = nil
 
 	ms := managedServerFromContext(c)
-	if err := ms.cms.AddCredential(uc.Name, uc.UPSK); err != nil {
+	if err := ms.cms.ImportCredentials([]cred.UserCredential{uc}); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
 	}
+	uc, _ = ms.cms.GetCredential(uc.Name)
 	return c.JSON(&uc)
 }
 
+// ImportUsers adds users in bulk. Either all users are added, or none.
+//
+// The format query parameter selects the request body format:
+// "upsks" (default) for the uPSK store file format, or "sip008" for a SIP008 document.
+func (sm *ServerManager) ImportUsers(c *fiber.Ctx) error {
+	var (
+		ucs []cred.UserCredential
+		err error
+	)
+
+	switch format := c.Query("format", "upsks"); format {
+	case "upsks":
+		ucs, err = cred.UsersFromUPSKMap(c.Body())
+	case "sip008":
+		var cfg cred.SIP008Config
+		if err = c.BodyParser(&cfg); err == nil {
+			ucs, err = cred.UsersFromSIP008(&cfg)
+		}
+	default:
+		err = fmt.Errorf("unknown import format: %s", format)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
+	}
+
+	ms := managedServerFromContext(c)
+	if err = ms.cms.ImportCredentials(ucs); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
+	}
+
+	for i := range ucs {
+		ucs[i], _ = ms.cms.GetCredential(ucs[i].Name)
+	}
+	slices.SortFunc(ucs, cred.UserCredential.Compare)
+	return c.JSON(&UserList{Users: ucs})
+}
+
+// ExportSIP008 exports all users as a SIP008 document.
+//
+// The address query parameter is required, and specifies the server address
+// in the exported entries as host:port.
+func (sm *ServerManager) ExportSIP008(c *fiber.Ctx) error {
+	addr, err := conn.ParseAddr(c.Query("address"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: "invalid address: " + err.Error()})
+	}
+	ms := managedServerFromContext(c)
+	cfg := ms.cms.ExportSIP008(addr.Host(), addr.Port())
+	return c.JSON(&cfg)
+}
+
 // UserInfo contains information about a user.
 type UserInfo struct {
 	cred.UserCredential
@@ -156,26 +466,41 @@ func (sm *ServerManager) GetUser(c *fiber.Ctx) error {
 	return c.JSON(&UserInfo{uc, ms.sc.Snapshot().Traffic})
 }
 
-// UpdateUser updates a user's credential.
+// UpdateUser updates a user's credential, quota, usage, or ACL.
+// The update is applied as a whole, or not at all.
 func (sm *ServerManager) UpdateUser(c *fiber.Ctx) error {
 	var update struct {
-		UPSK []byte `json:"uPSK"`
+		UPSK       []byte      `json:"uPSK"`
+		Quota      *cred.Quota `json:"quota"`
+		ResetUsage bool        `json:"resetUsage"`
+		ACL        *cred.ACL   `json:"acl"`
 	}
 	if err := c.BodyParser(&update); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
 	}
+	if update.UPSK == nil && update.Quota == nil && !update.ResetUsage && update.ACL == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: "empty update"})
+	}
 
 	ms := managedServerFromContext(c)
-	username := c.Params("username")
-	if err := ms.cms.UpdateCredential(username, update.UPSK); err != nil {
-		if errors.Is(err, cred.ErrNonexistentUser) {
-			return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: err.Error()})
-		}
-		return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
+	if err := ms.cms.UpdateUser(c.Params("username"), cred.UserUpdate{
+		UPSK:       update.UPSK,
+		Quota:      update.Quota,
+		ResetUsage: update.ResetUsage,
+		ACL:        update.ACL,
+	}); err != nil {
+		return userUpdateError(c, err)
 	}
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
+func userUpdateError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, cred.ErrNonexistentUser) {
+		return c.Status(fiber.StatusNotFound).JSON(&StandardError{Message: err.Error()})
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(&StandardError{Message: err.Error()})
+}
+
 // DeleteUser deletes a user's credential.
 func (sm *ServerManager) DeleteUser(c *fiber.Ctx) error {
 	ms := managedServerFromContext(c)
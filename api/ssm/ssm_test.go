@@ -0,0 +1,96 @@
+package ssm
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsersRejectInvalidChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp ss2022.CredStore
+	credman := cred.NewManager(nil, zaptest.NewLogger(t))
+	cms, err := credman.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewServerManager()
+	sm.AddServer("ss-2022", cms, nil, nil, nil, nil, nil, conn.Addr{})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	sm.RegisterRoutes(app.Group("/api/ssm/v1"))
+
+	send := func(method, target, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A user with an invalid ACL is not added.
+	for _, body := range []string{
+		`{"username":"Sam","uPSK":"YWJjZGVmMDEyMzQ1Njc4OQ==","acl":{"deny":{"ports":"bogus"}}}`,
+		`{"username":"Sam","uPSK":"YWJjZGVmMDEyMzQ1Njc4OQ==","quota":{"totalBytes":1024},"acl":{"allow":{"domains":[""]}}}`,
+	} {
+		if status := send(http.MethodPost, "/api/ssm/v1/servers/ss-2022/users", body); status != http.StatusBadRequest {
+			t.Errorf("POST users %s = %d, expected %d", body, status, http.StatusBadRequest)
+		}
+		if _, ok := cms.GetCredential("Sam"); ok {
+			t.Errorf("POST users %s added the user", body)
+		}
+	}
+
+	if status := send(http.MethodPost, "/api/ssm/v1/servers/ss-2022/users", `{"username":"Sam","uPSK":"YWJjZGVmMDEyMzQ1Njc4OQ==","acl":{"deny":{"ports":"25"}}}`); status != http.StatusOK {
+		t.Fatalf("POST users = %d, expected %d", status, http.StatusOK)
+	}
+	if uc, ok := cms.GetCredential("Sam"); !ok || uc.ACL == nil || uc.ACL.Deny.Ports != "25" {
+		t.Errorf("added user = %+v, %t, expected an ACL denying port 25", uc, ok)
+	}
+
+	// An update with an invalid ACL changes nothing.
+	if status := send(http.MethodPatch, "/api/ssm/v1/servers/ss-2022/users/Alex", `{"uPSK":"MTIzNDU2Nzg5YWJjZGVmMA==","quota":{"totalBytes":1024},"acl":{"deny":{"ports":"bogus"}}}`); status != http.StatusBadRequest {
+		t.Errorf("PATCH user = %d, expected %d", status, http.StatusBadRequest)
+	}
+	uc, ok := cms.GetCredential("Alex")
+	if !ok {
+		t.Fatal("user not found")
+	}
+	if string(uc.UPSK) != "0123456789abcdef" || uc.Quota != nil || uc.ACL != nil {
+		t.Errorf("user after failed update = %+v, expected unchanged", uc)
+	}
+
+	for _, c := range []struct {
+		target     string
+		body       string
+		statusCode int
+	}{
+		{"/api/ssm/v1/servers/ss-2022/users/Alex", `{}`, http.StatusBadRequest},
+		{"/api/ssm/v1/servers/ss-2022/users/Nobody", `{"resetUsage":true}`, http.StatusNotFound},
+		{"/api/ssm/v1/servers/ss-2022/users/Alex", `{"quota":{"totalBytes":1024},"acl":{"deny":{"ports":"25"}}}`, http.StatusNoContent},
+	} {
+		if status := send(http.MethodPatch, c.target, c.body); status != c.statusCode {
+			t.Errorf("PATCH %s %s = %d, expected %d", c.target, c.body, status, c.statusCode)
+		}
+	}
+	if uc, _ = cms.GetCredential("Alex"); uc.Quota == nil || uc.Quota.TotalBytes != 1024 || uc.ACL == nil {
+		t.Errorf("user after update = %+v, expected the new quota and ACL", uc)
+	}
+}
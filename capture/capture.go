@@ -0,0 +1,508 @@
+// Package capture writes decrypted traffic of a server's connections and sessions to pcapng files,
+// so that protocol issues can be diagnosed without external MITM tooling.
+//
+// Relayed payloads are wrapped in synthetic IP, TCP and UDP headers between the client address
+// and the target address. TCP connections get a synthetic handshake and teardown,
+// so that packet analyzers can reassemble the streams.
+package capture
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxSize is the default maximum size of a capture file.
+const DefaultMaxSize = 64 << 20
+
+var (
+	// ErrRunning is returned when starting a capture on a server that is already capturing.
+	ErrRunning = errors.New("traffic capture is already running")
+
+	// ErrNotRunning is returned when stopping a capture on a server that is not capturing.
+	ErrNotRunning = errors.New("traffic capture is not running")
+)
+
+// Config selects the connections and sessions to capture, and how to capture them.
+type Config struct {
+	// Network is "tcp" or "udp" to only capture TCP connections or UDP sessions.
+	// If empty, both are captured.
+	Network string `json:"network"`
+
+	// ClientPrefix restricts the capture to clients with addresses in the prefix.
+	// If unset, all clients are captured.
+	ClientPrefix netip.Prefix `json:"clientPrefix"`
+
+	// Username restricts the capture to the user's connections and sessions.
+	// If empty, all users are captured.
+	Username string `json:"username"`
+
+	// HeadersOnly only writes the synthetic headers of each packet,
+	// leaving out the payloads while keeping their lengths.
+	HeadersOnly bool `json:"headersOnly"`
+
+	// MaxSize is the size in bytes after which the capture file stops growing.
+	// Packets are dropped until the capture is stopped.
+	//
+	// The default value is 64 MiB.
+	MaxSize int64 `json:"maxSize"`
+}
+
+// matches returns whether a connection or session matches the config.
+func (c *Config) matches(network string, clientAddrPort netip.AddrPort, username string) bool {
+	if c.Network != "" && c.Network != network {
+		return false
+	}
+	if c.ClientPrefix.IsValid() && !c.ClientPrefix.Contains(clientAddrPort.Addr().Unmap()) {
+		return false
+	}
+	return c.Username == "" || c.Username == username
+}
+
+// Status contains information about the running or last capture of a server.
+type Status struct {
+	// Running is whether the capture is running.
+	Running bool `json:"running"`
+
+	// Config is the config of the capture.
+	Config Config `json:"config"`
+
+	// Path is the path to the capture file.
+	Path string `json:"path,omitempty"`
+
+	// StartTime is when the capture was started.
+	StartTime time.Time `json:"startTime"`
+
+	// Flows is the number of captured connections and sessions.
+	Flows uint64 `json:"flows"`
+
+	// Packets is the number of written packets.
+	Packets uint64 `json:"packets"`
+
+	// PacketsDropped is the number of packets dropped because the capture file reached its maximum size.
+	PacketsDropped uint64 `json:"packetsDropped"`
+
+	// Size is the size of the capture file in bytes.
+	Size int64 `json:"size"`
+
+	// Error is the first error encountered when writing the capture file, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Server controls traffic capture of a server.
+//
+// Server implements the Service interface, so that a running capture is stopped
+// when the server is stopped.
+//
+// A nil *Server does not capture anything, and [Server.NewFlow] returns a nil *Flow.
+type Server struct {
+	name   string
+	dir    string
+	logger *zap.Logger
+
+	// mu serializes starting and stopping captures.
+	mu     sync.Mutex
+	active atomic.Pointer[session]
+	last   Status
+}
+
+// NewServer returns a new capture controller for the named server.
+// Capture files are created in dir.
+func NewServer(name, dir string, logger *zap.Logger) *Server {
+	return &Server{
+		name:   name,
+		dir:    dir,
+		logger: logger,
+	}
+}
+
+var fileNameReplacer = strings.NewReplacer("/", "_", "\\", "_")
+
+// String implements the Service String method.
+func (s *Server) String() string {
+	return "traffic capture for " + s.name
+}
+
+// Start implements the Service Start method.
+// It does nothing, as captures are started by [Server.StartCapture].
+func (s *Server) Start(_ context.Context) error {
+	return nil
+}
+
+// Stop implements the Service Stop method.
+// It stops the running capture, if any.
+func (s *Server) Stop() error {
+	if _, err := s.StopCapture(); err != nil && err != ErrNotRunning {
+		return err
+	}
+	return nil
+}
+
+// StartCapture starts capturing new connections and sessions that match the config to a new file.
+// Connections and sessions that already exist are not captured.
+func (s *Server) StartCapture(cfg Config) (Status, error) {
+	switch cfg.Network {
+	case "", "tcp", "udp":
+	default:
+		return Status{}, fmt.Errorf("invalid network: %q", cfg.Network)
+	}
+	if cfg.MaxSize < 0 {
+		return Status{}, fmt.Errorf("negative max size: %d", cfg.MaxSize)
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	cfg.ClientPrefix = cfg.ClientPrefix.Masked()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active.Load() != nil {
+		return Status{}, ErrRunning
+	}
+
+	startTime := time.Now()
+	name := fileNameReplacer.Replace(s.name) + "-" + startTime.UTC().Format("20060102T150405.000000000Z") + ".pcapng"
+	path := filepath.Join(s.dir, name)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	bw := bufio.NewWriter(f)
+	w, err := newPcapngWriter(bw, s.name)
+	if err != nil {
+		f.Close()
+		return Status{}, fmt.Errorf("failed to write capture file header: %w", err)
+	}
+
+	sess := &session{
+		config:    cfg,
+		path:      path,
+		startTime: startTime,
+		file:      f,
+		bw:        bw,
+		w:         w,
+	}
+	s.active.Store(sess)
+
+	var clientPrefix string
+	if cfg.ClientPrefix.IsValid() {
+		clientPrefix = cfg.ClientPrefix.String()
+	}
+
+	s.logger.Info("Started traffic capture",
+		zap.String("server", s.name),
+		zap.String("path", path),
+		zap.String("network", cfg.Network),
+		zap.String("clientPrefix", clientPrefix),
+		zap.String("username", cfg.Username),
+		zap.Bool("headersOnly", cfg.HeadersOnly),
+	)
+
+	return sess.status(), nil
+}
+
+// StopCapture stops the running capture and closes its file.
+// It returns the final status of the capture.
+func (s *Server) StopCapture() (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.active.Swap(nil)
+	if sess == nil {
+		return Status{}, ErrNotRunning
+	}
+
+	err := sess.close()
+	s.last = sess.status()
+
+	s.logger.Info("Stopped traffic capture",
+		zap.String("server", s.name),
+		zap.String("path", s.last.Path),
+		zap.Uint64("flows", s.last.Flows),
+		zap.Uint64("packets", s.last.Packets),
+		zap.Uint64("packetsDropped", s.last.PacketsDropped),
+		zap.Int64("size", s.last.Size),
+		zap.Error(err),
+	)
+
+	if err != nil {
+		return s.last, fmt.Errorf("failed to close capture file: %w", err)
+	}
+	return s.last, nil
+}
+
+// Status returns the status of the running capture, or the last capture if none is running.
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess := s.active.Load(); sess != nil {
+		return sess.status()
+	}
+	return s.last
+}
+
+// NewFlow returns a flow for capturing a new TCP connection or UDP session,
+// or nil if no capture is running or the connection or session does not match.
+//
+// For TCP connections, the synthetic handshake is written immediately.
+func (s *Server) NewFlow(network string, clientAddrPort netip.AddrPort, username string, targetAddr conn.Addr) *Flow {
+	if s == nil {
+		return nil
+	}
+	sess := s.active.Load()
+	if sess == nil || !sess.config.matches(network, clientAddrPort, username) {
+		return nil
+	}
+
+	f := &Flow{
+		session:        sess,
+		clientAddrPort: clientAddrPort,
+		targetAddrPort: framingAddrPort(targetAddr),
+	}
+
+	var comment strings.Builder
+	if username != "" {
+		comment.WriteString("username=")
+		comment.WriteString(username)
+		comment.WriteByte(' ')
+	}
+	comment.WriteString("target=")
+	comment.WriteString(targetAddr.String())
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	sess.flows++
+
+	if network == "tcp" {
+		sess.writePacket(f.clientAddrPort, f.targetAddrPort, protocolTCP, 0, 0, tcpFlagSYN, nil, comment.String())
+		sess.writePacket(f.targetAddrPort, f.clientAddrPort, protocolTCP, 0, 1, tcpFlagSYN|tcpFlagACK, nil, "")
+		sess.writePacket(f.clientAddrPort, f.targetAddrPort, protocolTCP, 1, 1, tcpFlagACK, nil, "")
+		f.uplinkSeq, f.downlinkSeq = 1, 1
+	} else {
+		f.comment = comment.String()
+	}
+
+	return f
+}
+
+// framingAddrPort returns the address and port of the target in synthetic headers.
+// Domain name targets have an invalid address.
+func framingAddrPort(targetAddr conn.Addr) netip.AddrPort {
+	if targetAddr.IsIP() {
+		return targetAddr.IPPort()
+	}
+	return netip.AddrPortFrom(netip.Addr{}, targetAddr.Port())
+}
+
+// session is a running capture.
+type session struct {
+	config    Config
+	path      string
+	startTime time.Time
+
+	mu             sync.Mutex
+	file           *os.File
+	bw             *bufio.Writer
+	w              *pcapngWriter
+	b              []byte
+	closed         bool
+	flows          uint64
+	packets        uint64
+	packetsDropped uint64
+	err            error
+}
+
+// status returns the status of the capture.
+func (s *session) status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := Status{
+		Running:        !s.closed,
+		Config:         s.config,
+		Path:           s.path,
+		StartTime:      s.startTime,
+		Flows:          s.flows,
+		Packets:        s.packets,
+		PacketsDropped: s.packetsDropped,
+		Size:           s.w.n,
+	}
+	if s.err != nil {
+		status.Error = s.err.Error()
+	}
+	return status
+}
+
+// writePacket writes a synthetic packet from src to dst.
+// seq, ack and flags are only used for TCP segments.
+//
+// s.mu must be held.
+func (s *session) writePacket(src, dst netip.AddrPort, protocol uint8, seq, ack uint32, flags uint8, payload []byte, comment string) {
+	if s.closed || s.err != nil {
+		return
+	}
+
+	srcAddr, dstAddr := framingAddrs(src.Addr(), dst.Addr())
+
+	transportLength := len(payload)
+	switch protocol {
+	case protocolTCP:
+		transportLength += tcpHeaderLength
+	case protocolUDP:
+		transportLength += udpHeaderLength
+	}
+
+	s.b = appendIPHeader(s.b[:0], srcAddr, dstAddr, protocol, transportLength)
+	switch protocol {
+	case protocolTCP:
+		s.b = appendTCPHeader(s.b, src.Port(), dst.Port(), seq, ack, flags)
+	case protocolUDP:
+		s.b = appendUDPHeader(s.b, src.Port(), dst.Port(), len(payload))
+	}
+	originalLength := len(s.b) + len(payload)
+	if !s.config.HeadersOnly {
+		s.b = append(s.b, payload...)
+	}
+
+	if s.w.n+int64(packetBlockLength(len(s.b), comment)) > s.config.MaxSize {
+		s.packetsDropped++
+		return
+	}
+
+	if err := s.w.writePacket(time.Now(), s.b, originalLength, comment); err != nil {
+		s.err = err
+		return
+	}
+	s.packets++
+}
+
+// close flushes and closes the capture file.
+// Flows of the session stop writing after close returns.
+func (s *session) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	err := s.bw.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if s.err == nil {
+		s.err = err
+	}
+	return err
+}
+
+// Flow captures a TCP connection or UDP session.
+//
+// All methods are safe to call on a nil *Flow, which does nothing.
+type Flow struct {
+	session        *session
+	clientAddrPort netip.AddrPort
+	targetAddrPort netip.AddrPort
+
+	// comment is attached to the first packet of a UDP session.
+	comment string
+
+	// uplinkSeq and downlinkSeq are the next sequence numbers of a TCP connection.
+	// They are guarded by session.mu.
+	uplinkSeq   uint32
+	downlinkSeq uint32
+}
+
+// Uplink captures TCP payload sent from the client to the target.
+func (f *Flow) Uplink(payload []byte) {
+	if f == nil || len(payload) == 0 {
+		return
+	}
+	f.session.mu.Lock()
+	defer f.session.mu.Unlock()
+
+	for segment := range slices.Chunk(payload, maxSegmentPayloadLength) {
+		f.session.writePacket(f.clientAddrPort, f.targetAddrPort, protocolTCP, f.uplinkSeq, f.downlinkSeq, tcpFlagPSH|tcpFlagACK, segment, "")
+		f.uplinkSeq += uint32(len(segment))
+	}
+}
+
+// Downlink captures TCP payload sent from the target to the client.
+func (f *Flow) Downlink(payload []byte) {
+	if f == nil || len(payload) == 0 {
+		return
+	}
+	f.session.mu.Lock()
+	defer f.session.mu.Unlock()
+
+	for segment := range slices.Chunk(payload, maxSegmentPayloadLength) {
+		f.session.writePacket(f.targetAddrPort, f.clientAddrPort, protocolTCP, f.downlinkSeq, f.uplinkSeq, tcpFlagPSH|tcpFlagACK, segment, "")
+		f.downlinkSeq += uint32(len(segment))
+	}
+}
+
+// Close captures the synthetic teardown of a TCP connection.
+func (f *Flow) Close() {
+	if f == nil {
+		return
+	}
+	f.session.mu.Lock()
+	defer f.session.mu.Unlock()
+
+	f.session.writePacket(f.clientAddrPort, f.targetAddrPort, protocolTCP, f.uplinkSeq, f.downlinkSeq, tcpFlagFIN|tcpFlagACK, nil, "")
+	f.uplinkSeq++
+	f.session.writePacket(f.targetAddrPort, f.clientAddrPort, protocolTCP, f.downlinkSeq, f.uplinkSeq, tcpFlagFIN|tcpFlagACK, nil, "")
+	f.downlinkSeq++
+	f.session.writePacket(f.clientAddrPort, f.targetAddrPort, protocolTCP, f.uplinkSeq, f.downlinkSeq, tcpFlagACK, nil, "")
+}
+
+// UplinkDatagram captures a UDP payload sent from the client to the target.
+func (f *Flow) UplinkDatagram(targetAddr conn.Addr, payload []byte) {
+	if f == nil {
+		return
+	}
+	var targetComment string
+	if !targetAddr.IsIP() {
+		targetComment = "target=" + targetAddr.String()
+	}
+	f.writeDatagram(f.clientAddrPort, framingAddrPort(targetAddr), payload, targetComment)
+}
+
+// DownlinkDatagram captures a UDP payload sent from the source to the client.
+func (f *Flow) DownlinkDatagram(sourceAddrPort netip.AddrPort, payload []byte) {
+	if f == nil {
+		return
+	}
+	f.writeDatagram(sourceAddrPort, f.clientAddrPort, payload, "")
+}
+
+// writeDatagram writes a UDP datagram with the flow's comment if it is the first packet,
+// or with comment otherwise.
+func (f *Flow) writeDatagram(src, dst netip.AddrPort, payload []byte, comment string) {
+	if len(payload) > maxDatagramPayloadLength {
+		payload = payload[:maxDatagramPayloadLength]
+	}
+
+	f.session.mu.Lock()
+	defer f.session.mu.Unlock()
+
+	if f.comment != "" {
+		comment = f.comment
+		f.comment = ""
+	}
+	f.session.writePacket(src, dst, protocolUDP, 0, 0, 0, payload, comment)
+}
@@ -0,0 +1,307 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"go.uber.org/zap"
+)
+
+// testPacket is an enhanced packet block read from a capture file.
+type testPacket struct {
+	data           []byte
+	originalLength int
+	comment        string
+}
+
+// readCapture parses the capture file at path, checks its section header and interface description blocks,
+// and returns its packets.
+func readCapture(t *testing.T, path string) []testPacket {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		blockTypes []uint32
+		packets    []testPacket
+	)
+
+	for len(b) > 0 {
+		if len(b) < blockOverhead {
+			t.Fatalf("Truncated block: %x", b)
+		}
+		blockType := binary.LittleEndian.Uint32(b)
+		totalLength := int(binary.LittleEndian.Uint32(b[4:]))
+		if totalLength%4 != 0 || totalLength > len(b) {
+			t.Fatalf("Invalid block total length %d", totalLength)
+		}
+		if trailer := int(binary.LittleEndian.Uint32(b[totalLength-4:])); trailer != totalLength {
+			t.Fatalf("Block trailing length %d, expected %d", trailer, totalLength)
+		}
+		body := b[8 : totalLength-4]
+		b = b[totalLength:]
+
+		blockTypes = append(blockTypes, blockType)
+
+		switch blockType {
+		case blockTypeSectionHeader:
+			if magic := binary.LittleEndian.Uint32(body); magic != byteOrderMagic {
+				t.Errorf("Byte order magic = %#x, expected %#x", magic, byteOrderMagic)
+			}
+		case blockTypeInterfaceDescription:
+			if linkType := binary.LittleEndian.Uint16(body); linkType != linkTypeRaw {
+				t.Errorf("Link type = %d, expected %d", linkType, linkTypeRaw)
+			}
+		case blockTypeEnhancedPacket:
+			capturedLength := int(binary.LittleEndian.Uint32(body[12:]))
+			p := testPacket{
+				data:           body[enhancedPacketFixedLength : enhancedPacketFixedLength+capturedLength],
+				originalLength: int(binary.LittleEndian.Uint32(body[16:])),
+			}
+			if options := body[enhancedPacketFixedLength+padLength(capturedLength):]; len(options) > 0 {
+				if code := binary.LittleEndian.Uint16(options); code == optionComment {
+					p.comment = string(options[4 : 4+binary.LittleEndian.Uint16(options[2:])])
+				}
+			}
+			packets = append(packets, p)
+		default:
+			t.Errorf("Unexpected block type %#x", blockType)
+		}
+	}
+
+	if len(blockTypes) < 2 || blockTypes[0] != blockTypeSectionHeader || blockTypes[1] != blockTypeInterfaceDescription {
+		t.Fatalf("Block types = %x, expected section header and interface description first", blockTypes)
+	}
+	return packets
+}
+
+// tcpSegment returns the flags, sequence number, acknowledgment number and payload of an IPv4 TCP packet.
+func tcpSegment(t *testing.T, p testPacket) (flags uint8, seq, ack uint32, payload []byte) {
+	t.Helper()
+	if len(p.data) < ipv4HeaderLength+tcpHeaderLength || p.data[0] != 0x45 || p.data[9] != protocolTCP {
+		t.Fatalf("Not an IPv4 TCP packet: %x", p.data)
+	}
+	if ipv4HeaderChecksum(p.data) != 0 {
+		t.Errorf("Invalid IPv4 header checksum: %x", p.data[:ipv4HeaderLength])
+	}
+	segment := p.data[ipv4HeaderLength:]
+	return segment[13], binary.BigEndian.Uint32(segment[4:]), binary.BigEndian.Uint32(segment[8:]), segment[tcpHeaderLength:]
+}
+
+func TestServerCaptureTCP(t *testing.T) {
+	s := NewServer("test", t.TempDir(), zap.NewNop())
+
+	if _, err := s.StopCapture(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("s.StopCapture() before starting = %v, expected %v", err, ErrNotRunning)
+	}
+
+	if _, err := s.StartCapture(Config{}); err != nil {
+		t.Fatalf("s.StartCapture failed: %v", err)
+	}
+	if _, err := s.StartCapture(Config{}); !errors.Is(err, ErrRunning) {
+		t.Errorf("s.StartCapture() when running = %v, expected %v", err, ErrRunning)
+	}
+
+	clientAddrPort := netip.MustParseAddrPort("192.0.2.1:12345")
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+
+	f := s.NewFlow("tcp", clientAddrPort, "Alex", targetAddr)
+	if f == nil {
+		t.Fatal("s.NewFlow returned nil while capturing")
+	}
+	f.Uplink([]byte("hello"))
+	f.Downlink([]byte("world!"))
+	f.Uplink(nil)
+	f.Close()
+
+	status, err := s.StopCapture()
+	if err != nil {
+		t.Fatalf("s.StopCapture failed: %v", err)
+	}
+	if status.Running || status.Flows != 1 || status.Packets != 8 {
+		t.Errorf("status = %+v, expected stopped capture of 1 flow and 8 packets", status)
+	}
+
+	// Writes after stopping are ignored.
+	f.Uplink([]byte("ignored"))
+	if f := s.NewFlow("tcp", clientAddrPort, "Alex", targetAddr); f != nil {
+		t.Error("s.NewFlow returned non-nil after stopping")
+	}
+
+	packets := readCapture(t, status.Path)
+	if len(packets) != 8 {
+		t.Fatalf("len(packets) = %d, expected 8", len(packets))
+	}
+
+	if want := "username=Alex target=example.com:443"; packets[0].comment != want {
+		t.Errorf("packets[0].comment = %q, expected %q", packets[0].comment, want)
+	}
+	if src, dst := netip.AddrFrom4([4]byte(packets[0].data[12:16])), netip.AddrFrom4([4]byte(packets[0].data[16:20])); src != clientAddrPort.Addr() || dst != netip.IPv4Unspecified() {
+		t.Errorf("packets[0] addresses = %s -> %s, expected %s -> 0.0.0.0", src, dst, clientAddrPort.Addr())
+	}
+
+	for i, c := range []struct {
+		flags   uint8
+		seq     uint32
+		ack     uint32
+		payload string
+	}{
+		{tcpFlagSYN, 0, 0, ""},
+		{tcpFlagSYN | tcpFlagACK, 0, 1, ""},
+		{tcpFlagACK, 1, 1, ""},
+		{tcpFlagPSH | tcpFlagACK, 1, 1, "hello"},
+		{tcpFlagPSH | tcpFlagACK, 1, 6, "world!"},
+		{tcpFlagFIN | tcpFlagACK, 6, 7, ""},
+		{tcpFlagFIN | tcpFlagACK, 7, 7, ""},
+		{tcpFlagACK, 7, 8, ""},
+	} {
+		flags, seq, ack, payload := tcpSegment(t, packets[i])
+		if flags != c.flags || seq != c.seq || ack != c.ack || string(payload) != c.payload {
+			t.Errorf("packets[%d] = flags %#x seq %d ack %d payload %q, expected flags %#x seq %d ack %d payload %q",
+				i, flags, seq, ack, payload, c.flags, c.seq, c.ack, c.payload)
+		}
+	}
+
+	if got := s.Status(); got.Path != status.Path || got.Running {
+		t.Errorf("s.Status() = %+v, expected last capture %+v", got, status)
+	}
+}
+
+func TestServerCaptureUDP(t *testing.T) {
+	s := NewServer("test", t.TempDir(), zap.NewNop())
+
+	if _, err := s.StartCapture(Config{
+		Network:      "udp",
+		ClientPrefix: netip.MustParsePrefix("2001:db8::/32"),
+		Username:     "Alex",
+		HeadersOnly:  true,
+	}); err != nil {
+		t.Fatalf("s.StartCapture failed: %v", err)
+	}
+
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	targetAddrPort := netip.MustParseAddrPort("192.0.2.2:53")
+	targetAddr := conn.AddrFromIPPort(targetAddrPort)
+
+	for _, c := range []struct {
+		name           string
+		network        string
+		clientAddrPort netip.AddrPort
+		username       string
+	}{
+		{"Network", "tcp", clientAddrPort, "Alex"},
+		{"ClientPrefix", "udp", netip.MustParseAddrPort("192.0.2.1:12345"), "Alex"},
+		{"Username", "udp", clientAddrPort, "Bob"},
+	} {
+		if f := s.NewFlow(c.network, c.clientAddrPort, c.username, targetAddr); f != nil {
+			t.Errorf("s.NewFlow with mismatched %s returned non-nil", c.name)
+		}
+	}
+
+	f := s.NewFlow("udp", clientAddrPort, "Alex", targetAddr)
+	if f == nil {
+		t.Fatal("s.NewFlow returned nil for matching session")
+	}
+	f.UplinkDatagram(targetAddr, []byte("query"))
+	f.DownlinkDatagram(targetAddrPort, []byte("response"))
+	f.UplinkDatagram(conn.MustAddrFromDomainPort("example.com", 53), []byte("query"))
+
+	status, err := s.StopCapture()
+	if err != nil {
+		t.Fatalf("s.StopCapture failed: %v", err)
+	}
+
+	packets := readCapture(t, status.Path)
+	if len(packets) != 3 {
+		t.Fatalf("len(packets) = %d, expected 3", len(packets))
+	}
+
+	for i, c := range []struct {
+		comment       string
+		srcPort       uint16
+		dstPort       uint16
+		payloadLength int
+	}{
+		{"username=Alex target=192.0.2.2:53", 12345, 53, 5},
+		{"", 53, 12345, 8},
+		{"target=example.com:53", 12345, 53, 5},
+	} {
+		p := packets[i]
+		if p.comment != c.comment {
+			t.Errorf("packets[%d].comment = %q, expected %q", i, p.comment, c.comment)
+		}
+		if len(p.data) != ipv6HeaderLength+udpHeaderLength || p.data[0]>>4 != 6 || p.data[6] != protocolUDP {
+			t.Fatalf("packets[%d] is not a headers-only IPv6 UDP packet: %x", i, p.data)
+		}
+		if p.originalLength != len(p.data)+c.payloadLength {
+			t.Errorf("packets[%d].originalLength = %d, expected %d", i, p.originalLength, len(p.data)+c.payloadLength)
+		}
+		datagram := p.data[ipv6HeaderLength:]
+		if srcPort, dstPort := binary.BigEndian.Uint16(datagram), binary.BigEndian.Uint16(datagram[2:]); srcPort != c.srcPort || dstPort != c.dstPort {
+			t.Errorf("packets[%d] ports = %d -> %d, expected %d -> %d", i, srcPort, dstPort, c.srcPort, c.dstPort)
+		}
+	}
+
+	// The IPv4 target is mapped into the IPv6 header.
+	if dst := netip.AddrFrom16([16]byte(packets[0].data[24:40])); dst.Unmap() != targetAddrPort.Addr() || !dst.Is4In6() {
+		t.Errorf("packets[0] destination = %s, expected v4-mapped %s", dst, targetAddrPort.Addr())
+	}
+}
+
+func TestServerCaptureMaxSize(t *testing.T) {
+	s := NewServer("test", t.TempDir(), zap.NewNop())
+
+	if _, err := s.StartCapture(Config{MaxSize: 256}); err != nil {
+		t.Fatalf("s.StartCapture failed: %v", err)
+	}
+
+	f := s.NewFlow("udp", netip.MustParseAddrPort("192.0.2.1:12345"), "", conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.2:53")))
+	payload := bytes.Repeat([]byte{'a'}, 64)
+	for range 4 {
+		f.UplinkDatagram(conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.2:53")), payload)
+	}
+
+	status, err := s.StopCapture()
+	if err != nil {
+		t.Fatalf("s.StopCapture failed: %v", err)
+	}
+	if status.Size > 256 || status.Packets == 0 || status.PacketsDropped == 0 || status.Packets+status.PacketsDropped != 4 {
+		t.Errorf("status = %+v, expected some of 4 packets dropped within 256 bytes", status)
+	}
+	if packets := readCapture(t, status.Path); uint64(len(packets)) != status.Packets {
+		t.Errorf("len(packets) = %d, expected %d", len(packets), status.Packets)
+	}
+}
+
+func TestServerStartCaptureInvalidConfig(t *testing.T) {
+	s := NewServer("test", t.TempDir(), zap.NewNop())
+	for _, cfg := range []Config{
+		{Network: "ip"},
+		{MaxSize: -1},
+	} {
+		if _, err := s.StartCapture(cfg); err == nil {
+			t.Errorf("s.StartCapture(%+v) succeeded", cfg)
+		}
+	}
+}
+
+func TestNilServerAndFlow(t *testing.T) {
+	var s *Server
+	f := s.NewFlow("tcp", netip.MustParseAddrPort("192.0.2.1:12345"), "", conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.2:443")))
+	if f != nil {
+		t.Fatal("nil Server returned non-nil flow")
+	}
+	f.Uplink([]byte("hello"))
+	f.Downlink([]byte("world"))
+	f.UplinkDatagram(conn.Addr{}, nil)
+	f.DownlinkDatagram(netip.AddrPort{}, nil)
+	f.Close()
+}
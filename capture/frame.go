@@ -0,0 +1,130 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// Protocol numbers and header sizes of synthetic packets.
+const (
+	protocolTCP = 6
+	protocolUDP = 17
+
+	ipv4HeaderLength = 20
+	ipv6HeaderLength = 40
+	tcpHeaderLength  = 20
+	udpHeaderLength  = 8
+
+	// maxSegmentPayloadLength is the maximum payload length of a synthetic TCP segment,
+	// which fits in both IPv4 and IPv6 packets.
+	maxSegmentPayloadLength = 65535 - ipv6HeaderLength - tcpHeaderLength
+
+	// maxDatagramPayloadLength is the maximum payload length of a synthetic UDP datagram.
+	// Longer payloads are truncated.
+	maxDatagramPayloadLength = 65535 - ipv6HeaderLength - udpHeaderLength
+)
+
+// TCP flags of synthetic segments.
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// framingAddrs returns the source and destination addresses to use in a synthetic IP header.
+//
+// IPv4 is used if both addresses are IPv4 or IPv4-mapped IPv6 addresses, and IPv6 otherwise.
+// Invalid addresses, such as those of domain name targets, are replaced with
+// the unspecified address of the other address's family.
+func framingAddrs(src, dst netip.Addr) (netip.Addr, netip.Addr) {
+	src, dst = src.Unmap(), dst.Unmap()
+
+	switch {
+	case !src.IsValid() && !dst.IsValid():
+		return netip.IPv4Unspecified(), netip.IPv4Unspecified()
+	case !src.IsValid():
+		src = unspecifiedOfFamily(dst)
+	case !dst.IsValid():
+		dst = unspecifiedOfFamily(src)
+	}
+
+	if src.Is4() && dst.Is4() {
+		return src, dst
+	}
+	return netip.AddrFrom16(src.As16()), netip.AddrFrom16(dst.As16())
+}
+
+// unspecifiedOfFamily returns the unspecified address of addr's family.
+func unspecifiedOfFamily(addr netip.Addr) netip.Addr {
+	if addr.Is4() {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
+
+// appendIPHeader appends an IPv4 or IPv6 header for a packet from src to dst
+// carrying a transport segment of transportLength bytes.
+// src and dst must be of the same family, as returned by [framingAddrs].
+func appendIPHeader(b []byte, src, dst netip.Addr, protocol uint8, transportLength int) []byte {
+	if src.Is4() {
+		start := len(b)
+		b = append(b,
+			0x45, 0, // version, IHL, TOS
+			0, 0, // total length
+			0, 0, // identification
+			0x40, 0, // don't fragment
+			64, protocol,
+			0, 0, // header checksum
+		)
+		binary.BigEndian.PutUint16(b[start+2:], uint16(ipv4HeaderLength+transportLength))
+		src4, dst4 := src.As4(), dst.As4()
+		b = append(b, src4[:]...)
+		b = append(b, dst4[:]...)
+		binary.BigEndian.PutUint16(b[start+10:], ipv4HeaderChecksum(b[start:]))
+		return b
+	}
+
+	b = append(b, 0x60, 0, 0, 0) // version, traffic class, flow label
+	b = binary.BigEndian.AppendUint16(b, uint16(transportLength))
+	b = append(b, protocol, 64)
+	src16, dst16 := src.As16(), dst.As16()
+	b = append(b, src16[:]...)
+	return append(b, dst16[:]...)
+}
+
+// ipv4HeaderChecksum returns the checksum of the IPv4 header.
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < ipv4HeaderLength; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+// appendTCPHeader appends a TCP header without options.
+// The checksum is left as zero, which packet analyzers do not validate by default.
+func appendTCPHeader(b []byte, srcPort, dstPort uint16, seq, ack uint32, flags uint8) []byte {
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	b = binary.BigEndian.AppendUint16(b, dstPort)
+	b = binary.BigEndian.AppendUint32(b, seq)
+	b = binary.BigEndian.AppendUint32(b, ack)
+	return append(b,
+		tcpHeaderLength/4<<4, flags,
+		0xFF, 0xFF, // window
+		0, 0, // checksum
+		0, 0, // urgent pointer
+	)
+}
+
+// appendUDPHeader appends a UDP header for a payload of payloadLength bytes.
+// The checksum is left as zero.
+func appendUDPHeader(b []byte, srcPort, dstPort uint16, payloadLength int) []byte {
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	b = binary.BigEndian.AppendUint16(b, dstPort)
+	b = binary.BigEndian.AppendUint16(b, uint16(udpHeaderLength+payloadLength))
+	return append(b, 0, 0)
+}
@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types, option codes, and link types.
+// See https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html.
+const (
+	blockTypeSectionHeader        = 0x0A0D0D0A
+	blockTypeInterfaceDescription = 0x00000001
+	blockTypeEnhancedPacket       = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optionEndOfOpt    = 0
+	optionComment     = 1
+	optionIfName      = 2
+	optionSHBUserAppl = 4
+
+	// linkTypeRaw is LINKTYPE_RAW, for packets that begin with an IPv4 or IPv6 header.
+	linkTypeRaw = 101
+
+	// blockOverhead is the size of the block type and the two block total length fields.
+	blockOverhead = 12
+
+	// enhancedPacketFixedLength is the size of the fixed fields of an enhanced packet block body.
+	enhancedPacketFixedLength = 20
+)
+
+// pcapngWriter writes a pcapng section with a single interface of raw IP packets
+// with microsecond timestamps.
+type pcapngWriter struct {
+	w io.Writer
+	b []byte
+
+	// n is the number of bytes written so far.
+	n int64
+}
+
+// newPcapngWriter writes the section header block and the interface description block to w,
+// and returns a writer for packets on the interface.
+func newPcapngWriter(w io.Writer, interfaceName string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+
+	// Section header block.
+	body := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major version
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor version
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0))
+	body = appendOption(body, optionSHBUserAppl, "shadowsocks-go")
+	body = appendOption(body, optionEndOfOpt, "")
+	if err := pw.writeBlock(blockTypeSectionHeader, body); err != nil {
+		return nil, err
+	}
+
+	// Interface description block.
+	body = binary.LittleEndian.AppendUint16(body[:0], linkTypeRaw)
+	body = binary.LittleEndian.AppendUint16(body, 0) // reserved
+	body = binary.LittleEndian.AppendUint32(body, 0) // no snap length limit
+	if interfaceName != "" {
+		body = appendOption(body, optionIfName, interfaceName)
+		body = appendOption(body, optionEndOfOpt, "")
+	}
+	if err := pw.writeBlock(blockTypeInterfaceDescription, body); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// packetBlockLength returns the size of the enhanced packet block
+// for a packet of capturedLength bytes with the comment.
+func packetBlockLength(capturedLength int, comment string) int {
+	n := blockOverhead + enhancedPacketFixedLength + padLength(capturedLength)
+	if comment != "" {
+		n += 4 + padLength(len(comment)) + 4
+	}
+	return n
+}
+
+// writePacket writes an enhanced packet block with the packet on the interface.
+// originalLength is the length of the packet before it was truncated for capture.
+// If comment is not empty, it is attached to the packet.
+func (w *pcapngWriter) writePacket(ts time.Time, packet []byte, originalLength int, comment string) error {
+	us := uint64(ts.UnixMicro())
+	w.b = binary.LittleEndian.AppendUint32(w.b[:0], 0) // interface ID
+	w.b = binary.LittleEndian.AppendUint32(w.b, uint32(us>>32))
+	w.b = binary.LittleEndian.AppendUint32(w.b, uint32(us))
+	w.b = binary.LittleEndian.AppendUint32(w.b, uint32(len(packet)))
+	w.b = binary.LittleEndian.AppendUint32(w.b, uint32(originalLength))
+	w.b = append(w.b, packet...)
+	w.b = appendPadding(w.b, len(packet))
+	if comment != "" {
+		w.b = appendOption(w.b, optionComment, comment)
+		w.b = appendOption(w.b, optionEndOfOpt, "")
+	}
+	return w.writeBlock(blockTypeEnhancedPacket, w.b)
+}
+
+// writeBlock writes a block with the body, which must be padded to 32 bits.
+func (w *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	totalLength := uint32(blockOverhead + len(body))
+
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:], blockType)
+	binary.LittleEndian.PutUint32(header[4:], totalLength)
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], totalLength)
+
+	for _, b := range [][]byte{header[:], body, trailer[:]} {
+		n, err := w.w.Write(b)
+		w.n += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendOption appends an option with the code and value, padded to 32 bits.
+func appendOption(b []byte, code uint16, value string) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return appendPadding(b, len(value))
+}
+
+// appendPadding appends zero bytes to pad a field of length n to 32 bits.
+func appendPadding(b []byte, n int) []byte {
+	return append(b, make([]byte, padLength(n)-n)...)
+}
+
+// padLength returns n rounded up to a multiple of 4.
+func padLength(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,35 @@
+package capture
+
+import "github.com/database64128/shadowsocks-go/zerocopy"
+
+// StreamReadWriter wraps a client-side [zerocopy.ReadWriter] and captures its decrypted traffic into a flow.
+//
+// Reads are captured as uplink, and writes as downlink.
+// StreamReadWriter deliberately does not implement [zerocopy.DirectReader] or [zerocopy.DirectWriter],
+// so that relays always go through the capturing methods.
+type StreamReadWriter struct {
+	zerocopy.ReadWriter
+	flow *Flow
+}
+
+// NewStreamReadWriter returns rw with its traffic captured into f.
+func NewStreamReadWriter(rw zerocopy.ReadWriter, f *Flow) *StreamReadWriter {
+	return &StreamReadWriter{
+		ReadWriter: rw,
+		flow:       f,
+	}
+}
+
+// ReadZeroCopy implements the Reader ReadZeroCopy method.
+func (rw *StreamReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	payloadLen, err = rw.ReadWriter.ReadZeroCopy(b, payloadBufStart, payloadBufLen)
+	rw.flow.Uplink(b[payloadBufStart : payloadBufStart+payloadLen])
+	return
+}
+
+// WriteZeroCopy implements the Writer WriteZeroCopy method.
+func (rw *StreamReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	// Capture before writing, as the writer may encrypt the payload in place.
+	rw.flow.Downlink(b[payloadStart : payloadStart+payloadLen])
+	return rw.ReadWriter.WriteZeroCopy(b, payloadStart, payloadLen)
+}
@@ -0,0 +1,424 @@
+package clientgroup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultFailoverInterval is the default interval between health checks.
+	DefaultFailoverInterval = 30 * time.Second
+
+	// DefaultFailoverFailureThreshold is the default number of consecutive failures that mark a member as down.
+	DefaultFailoverFailureThreshold = 3
+)
+
+// FailoverConfig is the configuration of a [Failover] group.
+type FailoverConfig struct {
+	// URL is the HTTP or HTTPS URL to check members' health with.
+	URL string
+
+	// Interval is the time between health checks.
+	Interval time.Duration
+
+	// Timeout is how long to wait for a health check response.
+	Timeout time.Duration
+
+	// FailureThreshold is the number of consecutive dial or health check failures
+	// that mark a member as down.
+	FailureThreshold int
+}
+
+// failoverMember is a member with its health state.
+type failoverMember struct {
+	Member
+
+	// failures is the number of consecutive failures.
+	failures atomic.Int64
+
+	// lastError is the error of the latest failure, or nil if the latest attempt succeeded.
+	lastError atomic.Pointer[string]
+}
+
+// Failover is a client group that uses its first member that is up, in the configured order.
+//
+// A member is down when its consecutive dial or health check failures reach the failure threshold,
+// and is up again after a successful health check. Failures to dial through the selected member count,
+// including failures to reach the target when the member connects to targets directly.
+// When all members are down, the first member is used.
+//
+// Failover implements [zerocopy.TCPClient], and [Failover.UDPClient] returns it as a [zerocopy.UDPClient].
+// It also has the String, Start and Stop methods of a service, which run the health checks.
+type Failover struct {
+	name    string
+	config  FailoverConfig
+	members []failoverMember
+	prober  httpProber
+	logger  *zap.Logger
+
+	// tcpMembers and udpMembers are the indices of members with a TCP or UDP client.
+	tcpMembers []int
+	udpMembers []int
+
+	// udpPackerHeadroom is the maximum packer headroom of members' UDP clients.
+	udpPackerHeadroom zerocopy.Headroom
+
+	// mu serializes selection updates.
+	mu sync.Mutex
+
+	// tcpSelected and udpSelected are the indices of the selected members.
+	tcpSelected atomic.Int64
+	udpSelected atomic.Int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewFailover returns a new Failover group with the given name, configuration and members.
+// Members may support only one of TCP and UDP. Health checks are only sent to members with TCP.
+func NewFailover(name string, config FailoverConfig, members []Member, logger *zap.Logger) (*Failover, error) {
+	if len(members) == 0 {
+		return nil, errNoMembers
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("non-positive interval: %s", config.Interval)
+	}
+	if config.Timeout <= 0 {
+		return nil, fmt.Errorf("non-positive timeout: %s", config.Timeout)
+	}
+	if config.FailureThreshold <= 0 {
+		return nil, fmt.Errorf("non-positive failure threshold: %d", config.FailureThreshold)
+	}
+
+	prober, err := newHTTPProber(config.URL, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	g := Failover{
+		name:    name,
+		config:  config,
+		members: make([]failoverMember, len(members)),
+		prober:  prober,
+		logger:  logger,
+	}
+
+	for i, m := range members {
+		if m.TCPClient == nil && m.UDPClient == nil {
+			return nil, fmt.Errorf("member %s has neither TCP nor UDP", m.Name)
+		}
+		g.members[i].Member = m
+		if m.TCPClient != nil {
+			g.tcpMembers = append(g.tcpMembers, i)
+		}
+		if m.UDPClient != nil {
+			g.udpMembers = append(g.udpMembers, i)
+			g.udpPackerHeadroom = zerocopy.MaxHeadroom(g.udpPackerHeadroom, m.UDPClient.Info().PackerHeadroom)
+		}
+	}
+
+	if len(g.tcpMembers) > 0 {
+		g.tcpSelected.Store(int64(g.tcpMembers[0]))
+	}
+	if len(g.udpMembers) > 0 {
+		g.udpSelected.Store(int64(g.udpMembers[0]))
+	}
+
+	return &g, nil
+}
+
+// HasTCP returns whether any member supports TCP.
+func (g *Failover) HasTCP() bool {
+	return len(g.tcpMembers) > 0
+}
+
+// HasUDP returns whether any member supports UDP.
+func (g *Failover) HasUDP() bool {
+	return len(g.udpMembers) > 0
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+// It returns the info of the selected member, so the member's name shows up in logs and statistics.
+func (g *Failover) Info() zerocopy.TCPClientInfo {
+	return g.members[g.tcpSelected.Load()].TCPClient.Info()
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (g *Failover) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	m := &g.members[g.tcpSelected.Load()]
+	rawRW, rw, err = m.TCPClient.Dial(ctx, targetAddr, payload)
+	if ctx.Err() == nil {
+		g.record(m, "dial", err)
+	}
+	return rawRW, rw, err
+}
+
+// UDPClient returns the group as a [zerocopy.UDPClient].
+// It must only be used if [Failover.HasUDP] returns true.
+func (g *Failover) UDPClient() zerocopy.UDPClient {
+	return (*failoverUDPClient)(g)
+}
+
+// failoverUDPClient is a [Failover] group as a [zerocopy.UDPClient].
+type failoverUDPClient Failover
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *failoverUDPClient) Info() zerocopy.UDPClientInfo {
+	g := (*Failover)(c)
+	info := g.members[g.udpSelected.Load()].UDPClient.Info()
+	// Members may be switched after the relay's buffers have been allocated.
+	info.PackerHeadroom = g.udpPackerHeadroom
+	return info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *failoverUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	g := (*Failover)(c)
+	m := &g.members[g.udpSelected.Load()]
+	info, session, err := m.UDPClient.NewSession(ctx)
+	if ctx.Err() == nil {
+		g.record(m, "new UDP session", err)
+	}
+	return info, session, err
+}
+
+// record updates the member's health state with the result of an attempt.
+func (g *Failover) record(m *failoverMember, op string, err error) {
+	threshold := int64(g.config.FailureThreshold)
+
+	if err == nil {
+		m.lastError.Store(nil)
+		if m.failures.Swap(0) >= threshold {
+			g.logger.Info("Member is up",
+				zap.String("group", g.name),
+				zap.String("member", m.Name),
+				zap.String("op", op),
+			)
+			g.updateSelection()
+		}
+		return
+	}
+
+	errString := err.Error()
+	m.lastError.Store(&errString)
+	if m.failures.Add(1) == threshold {
+		g.logger.Warn("Member is down",
+			zap.String("group", g.name),
+			zap.String("member", m.Name),
+			zap.String("op", op),
+			zap.Int64("failures", threshold),
+			zap.Error(err),
+		)
+		g.updateSelection()
+	}
+}
+
+// isUp returns whether the member is up.
+func (g *Failover) isUp(m *failoverMember) bool {
+	return m.failures.Load() < int64(g.config.FailureThreshold)
+}
+
+// updateSelection selects the first member that is up for each network.
+func (g *Failover) updateSelection() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.tcpMembers) > 0 {
+		g.updateNetworkSelection(&g.tcpSelected, "tcp", g.tcpMembers)
+	}
+	if len(g.udpMembers) > 0 {
+		g.updateNetworkSelection(&g.udpSelected, "udp", g.udpMembers)
+	}
+}
+
+func (g *Failover) updateNetworkSelection(selected *atomic.Int64, network string, candidates []int) {
+	next := candidates[0]
+	for _, i := range candidates {
+		if g.isUp(&g.members[i]) {
+			next = i
+			break
+		}
+	}
+
+	current := int(selected.Swap(int64(next)))
+	if current == next {
+		return
+	}
+
+	g.logger.Info("Switched selected member",
+		zap.String("group", g.name),
+		zap.String("network", network),
+		zap.String("from", g.members[current].Name),
+		zap.String("to", g.members[next].Name),
+	)
+}
+
+// String returns the name of the health check service.
+func (g *Failover) String() string {
+	return "health check for client group " + g.name
+}
+
+// Start starts health checks in a new goroutine.
+func (g *Failover) Start(ctx context.Context) error {
+	ctx, g.cancel = context.WithCancel(ctx)
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+
+		ticker := time.NewTicker(g.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			g.checkAll(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	g.logger.Info("Started health check",
+		zap.String("group", g.name),
+		zap.String("url", g.config.URL),
+		zap.Duration("interval", g.config.Interval),
+	)
+	return nil
+}
+
+// Stop stops health checks and waits for ongoing checks to finish.
+func (g *Failover) Stop() error {
+	g.cancel()
+	g.wg.Wait()
+	return nil
+}
+
+// checkAll checks the health of all members with TCP concurrently.
+func (g *Failover) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, i := range g.tcpMembers {
+		m := &g.members[i]
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			latency, err := g.prober.probe(ctx, m.TCPClient)
+			if ctx.Err() != nil {
+				return
+			}
+			g.record(m, "health check", err)
+
+			if err != nil {
+				if g.isUp(m) {
+					g.logger.Warn("Health check failed",
+						zap.String("group", g.name),
+						zap.String("member", m.Name),
+						zap.Error(err),
+					)
+				}
+				return
+			}
+
+			if ce := g.logger.Check(zap.DebugLevel, "Health check succeeded"); ce != nil {
+				ce.Write(
+					zap.String("group", g.name),
+					zap.String("member", m.Name),
+					zap.Duration("latency", latency),
+				)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Status returns the selected members and the health state of all members.
+func (g *Failover) Status() Status {
+	s := Status{
+		Name:    g.name,
+		Type:    "failover",
+		Members: make([]MemberStatus, len(g.members)),
+	}
+
+	if len(g.tcpMembers) > 0 {
+		s.TCPSelected = g.members[g.tcpSelected.Load()].Name
+	}
+	if len(g.udpMembers) > 0 {
+		s.UDPSelected = g.members[g.udpSelected.Load()].Name
+	}
+
+	for i := range g.members {
+		m := &g.members[i]
+		ms := MemberStatus{
+			Name:                m.Name,
+			Up:                  g.isUp(m),
+			ConsecutiveFailures: m.failures.Load(),
+		}
+		if lastError := m.lastError.Load(); lastError != nil {
+			ms.LastError = *lastError
+		}
+		s.Members[i] = ms
+	}
+
+	return s
+}
+
+// Status is the status of a client group.
+type Status struct {
+	// Name is the name of the group.
+	Name string `json:"name"`
+
+	// Type is the type of the group.
+	Type string `json:"type"`
+
+	// TCPSelected is the name of the member selected for TCP, or empty if the group does not support TCP.
+	TCPSelected string `json:"tcpSelected,omitempty"`
+
+	// UDPSelected is the name of the member selected for UDP, or empty if the group does not support UDP.
+	UDPSelected string `json:"udpSelected,omitempty"`
+
+	// Members is the status of each member, in the configured order.
+	Members []MemberStatus `json:"members"`
+}
+
+// MemberStatus is the health state of a group member.
+type MemberStatus struct {
+	// Name is the name of the member client.
+	Name string `json:"name"`
+
+	// Up is whether the member is considered healthy.
+	Up bool `json:"up"`
+
+	// ConsecutiveFailures is the number of consecutive dial or health check failures.
+	ConsecutiveFailures int64 `json:"consecutiveFailures"`
+
+	// LastError is the error of the latest attempt, or empty if it succeeded.
+	LastError string `json:"lastError,omitempty"`
+
+	// Latency is the latest URL test latency, or omitted if the latest probe failed or the group does not probe latency.
+	Latency jsonhelper.Duration `json:"latency,omitempty"`
+
+	// UDPRTT is the latest UDP round-trip time, or omitted if the latest UDP probe failed or the group does not probe UDP.
+	UDPRTT jsonhelper.Duration `json:"udpRTT,omitempty"`
+
+	// UDPLoss is the packet loss ratio of the latest UDP probe, in [0, 1],
+	// or omitted if the group does not probe UDP.
+	UDPLoss *float64 `json:"udpLoss,omitempty"`
+}
+
+// StatusReporter is implemented by client groups that report their status.
+type StatusReporter interface {
+	Status() Status
+}
@@ -0,0 +1,140 @@
+package clientgroup
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+var errTestDialFailure = errors.New("test dial failure")
+
+// switchableTCPClient fails all dials when fail is set.
+type switchableTCPClient struct {
+	zerocopy.TCPClient
+	fail atomic.Bool
+}
+
+func (c *switchableTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	if c.fail.Load() {
+		return nil, nil, errTestDialFailure
+	}
+	return c.TCPClient.Dial(ctx, targetAddr, payload)
+}
+
+func TestFailover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	primary := &switchableTCPClient{TCPClient: direct.NewTCPClient("primary", "tcp", conn.DefaultTCPDialer, 0)}
+	backup := direct.NewTCPClient("backup", "tcp", conn.DefaultTCPDialer, 0)
+
+	g, err := NewFailover("failover", FailoverConfig{
+		URL:              server.URL,
+		Interval:         time.Hour,
+		Timeout:          time.Second,
+		FailureThreshold: 2,
+	}, []Member{
+		{Name: "primary", TCPClient: primary},
+		{Name: "backup", TCPClient: backup},
+		{Name: "udp-only", UDPClient: direct.NewEchoUDPClient("udp-only", 1500, conn.ListenConfig{})},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewFailover failed: %v", err)
+	}
+
+	assertSelected := func(tcpSelected string, primaryUp bool) {
+		t.Helper()
+		s := g.Status()
+		if s.TCPSelected != tcpSelected {
+			t.Errorf("s.TCPSelected = %q, expected %q", s.TCPSelected, tcpSelected)
+		}
+		if s.UDPSelected != "udp-only" {
+			t.Errorf("s.UDPSelected = %q, expected %q", s.UDPSelected, "udp-only")
+		}
+		if s.Members[0].Up != primaryUp {
+			t.Errorf("s.Members[0].Up = %v, expected %v", s.Members[0].Up, primaryUp)
+		}
+		if got := g.Info().Name; got != tcpSelected {
+			t.Errorf("g.Info().Name = %q, expected %q", got, tcpSelected)
+		}
+	}
+
+	ctx := context.Background()
+	targetAddr := conn.AddrFromIPPort(server.Listener.Addr().(*net.TCPAddr).AddrPort())
+
+	assertSelected("primary", true)
+
+	// Fail the primary until it reaches the threshold.
+	primary.fail.Store(true)
+	for range 2 {
+		if _, _, err = g.Dial(ctx, targetAddr, nil); err != errTestDialFailure {
+			t.Fatalf("g.Dial() error = %v, expected %v", err, errTestDialFailure)
+		}
+	}
+	assertSelected("backup", false)
+
+	s := g.Status()
+	if s.Members[0].ConsecutiveFailures != 2 || s.Members[0].LastError != errTestDialFailure.Error() {
+		t.Errorf("s.Members[0] = %+v, expected 2 failures with last error %q", s.Members[0], errTestDialFailure)
+	}
+
+	rawRW, _, err := g.Dial(ctx, targetAddr, nil)
+	if err != nil {
+		t.Fatalf("g.Dial() through backup failed: %v", err)
+	}
+	rawRW.Close()
+
+	// Health checks keep the primary down while it fails.
+	g.checkAll(ctx)
+	assertSelected("backup", false)
+
+	// Fail back after the primary recovers.
+	primary.fail.Store(false)
+	g.checkAll(ctx)
+	assertSelected("primary", true)
+
+	s = g.Status()
+	if s.Members[0].ConsecutiveFailures != 0 || s.Members[0].LastError != "" {
+		t.Errorf("s.Members[0] = %+v, expected no failures", s.Members[0])
+	}
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	a := &switchableTCPClient{TCPClient: direct.NewEchoTCPClient("a")}
+	b := &switchableTCPClient{TCPClient: direct.NewEchoTCPClient("b")}
+	a.fail.Store(true)
+	b.fail.Store(true)
+
+	g, err := NewFailover("failover", FailoverConfig{
+		URL:              "http://127.0.0.1:1/",
+		Interval:         time.Hour,
+		Timeout:          time.Second,
+		FailureThreshold: 1,
+	}, []Member{{Name: "a", TCPClient: a}, {Name: "b", TCPClient: b}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewFailover failed: %v", err)
+	}
+
+	g.checkAll(context.Background())
+
+	// With all members down, the first member is used.
+	s := g.Status()
+	if s.TCPSelected != "a" || s.Members[0].Up || s.Members[1].Up {
+		t.Errorf("g.Status() = %+v, expected a selected and all members down", s)
+	}
+	if s.UDPSelected != "" {
+		t.Errorf("s.UDPSelected = %q, expected empty", s.UDPSelected)
+	}
+}
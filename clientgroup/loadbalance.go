@@ -0,0 +1,215 @@
+package clientgroup
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sync"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// LoadBalanceConfig is the configuration of a [LoadBalance] group.
+type LoadBalanceConfig struct {
+	// Weights are the weights of the members, in the same order as the members.
+	// If empty, all members have a weight of 1.
+	Weights []uint
+
+	// ConsistentHashing selects members by hashing the target host,
+	// so that connections and sessions to the same destination use the same member,
+	// instead of spreading them in weighted round-robin order.
+	ConsistentHashing bool
+}
+
+// LoadBalance is a client group that spreads new TCP connections and UDP sessions across its members by weight.
+//
+// By default, members are selected in smooth weighted round-robin order.
+// With consistent hashing, members are selected by weighted rendezvous hashing of the target host,
+// so only destinations of a removed member are moved when the members change.
+// The target host of a UDP session is taken from [zerocopy.UDPSessionTargetAddrFromContext].
+//
+// LoadBalance implements [zerocopy.TCPClient], and [LoadBalance.UDPClient] returns it as a [zerocopy.UDPClient].
+type LoadBalance struct {
+	name              string
+	tcp               balancer
+	udp               balancer
+	consistentHashing bool
+	seed              maphash.Seed
+
+	// nativeInitialPayload is whether any member's TCP client natively supports initial payload.
+	nativeInitialPayload bool
+
+	// udpInfo is the info of the first member's UDP client, with the group name and the maximum headroom.
+	udpInfo zerocopy.UDPClientInfo
+}
+
+// NewLoadBalance returns a new LoadBalance group with the given name, configuration and members.
+// Members may support only one of TCP and UDP.
+func NewLoadBalance(name string, config LoadBalanceConfig, members []Member) (*LoadBalance, error) {
+	if len(members) == 0 {
+		return nil, errNoMembers
+	}
+	if len(config.Weights) != 0 && len(config.Weights) != len(members) {
+		return nil, fmt.Errorf("got %d weights for %d members", len(config.Weights), len(members))
+	}
+
+	g := LoadBalance{
+		name:              name,
+		consistentHashing: config.ConsistentHashing,
+		seed:              maphash.MakeSeed(),
+	}
+
+	for i, m := range members {
+		weight := uint(1)
+		if len(config.Weights) != 0 {
+			weight = config.Weights[i]
+			if weight == 0 || weight > math.MaxInt32 {
+				return nil, fmt.Errorf("bad weight %d for member %s", weight, m.Name)
+			}
+		}
+
+		if m.TCPClient == nil && m.UDPClient == nil {
+			return nil, fmt.Errorf("member %s has neither TCP nor UDP", m.Name)
+		}
+
+		if m.TCPClient != nil {
+			g.tcp.add(m.Name, int64(weight))
+			g.tcp.tcpClients = append(g.tcp.tcpClients, m.TCPClient)
+			if m.TCPClient.Info().NativeInitialPayload {
+				g.nativeInitialPayload = true
+			}
+		}
+
+		if m.UDPClient != nil {
+			info := m.UDPClient.Info()
+			if len(g.udp.names) == 0 {
+				g.udpInfo = info
+				g.udpInfo.Name = name
+			}
+			g.udpInfo.PackerHeadroom = zerocopy.MaxHeadroom(g.udpInfo.PackerHeadroom, info.PackerHeadroom)
+			g.udp.add(m.Name, int64(weight))
+			g.udp.udpClients = append(g.udp.udpClients, m.UDPClient)
+		}
+	}
+
+	return &g, nil
+}
+
+// HasTCP returns whether any member supports TCP.
+func (g *LoadBalance) HasTCP() bool {
+	return len(g.tcp.names) > 0
+}
+
+// HasUDP returns whether any member supports UDP.
+func (g *LoadBalance) HasUDP() bool {
+	return len(g.udp.names) > 0
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+func (g *LoadBalance) Info() zerocopy.TCPClientInfo {
+	return zerocopy.TCPClientInfo{
+		Name:                 g.name,
+		NativeInitialPayload: g.nativeInitialPayload,
+	}
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (g *LoadBalance) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	var i int
+	if g.consistentHashing {
+		i = g.tcp.pick(g.seed, targetAddr.Host())
+	} else {
+		i = g.tcp.next()
+	}
+	return g.tcp.tcpClients[i].Dial(ctx, targetAddr, payload)
+}
+
+// UDPClient returns the group as a [zerocopy.UDPClient].
+// It must only be used if [LoadBalance.HasUDP] returns true.
+func (g *LoadBalance) UDPClient() zerocopy.UDPClient {
+	return (*loadBalanceUDPClient)(g)
+}
+
+// loadBalanceUDPClient is a [LoadBalance] group as a [zerocopy.UDPClient].
+type loadBalanceUDPClient LoadBalance
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *loadBalanceUDPClient) Info() zerocopy.UDPClientInfo {
+	return c.udpInfo
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *loadBalanceUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	g := (*LoadBalance)(c)
+	var i int
+	if targetAddr, ok := zerocopy.UDPSessionTargetAddrFromContext(ctx); g.consistentHashing && ok {
+		i = g.udp.pick(g.seed, targetAddr.Host())
+	} else {
+		i = g.udp.next()
+	}
+	return g.udp.udpClients[i].NewSession(ctx)
+}
+
+// balancer selects members of one network by weight.
+type balancer struct {
+	names      []string
+	weights    []int64
+	tcpClients []zerocopy.TCPClient
+	udpClients []zerocopy.UDPClient
+
+	mu          sync.Mutex
+	current     []int64
+	totalWeight int64
+}
+
+func (b *balancer) add(name string, weight int64) {
+	b.names = append(b.names, name)
+	b.weights = append(b.weights, weight)
+	b.current = append(b.current, 0)
+	b.totalWeight += weight
+}
+
+// next returns the index of the next member in smooth weighted round-robin order.
+func (b *balancer) next() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best := 0
+	for i, weight := range b.weights {
+		b.current[i] += weight
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= b.totalWeight
+	return best
+}
+
+// pick returns the index of the member for key by weighted rendezvous hashing.
+func (b *balancer) pick(seed maphash.Seed, key string) int {
+	var (
+		h         maphash.Hash
+		best      int
+		bestScore = math.Inf(-1)
+	)
+
+	h.SetSeed(seed)
+
+	for i, name := range b.names {
+		h.Reset()
+		_, _ = h.WriteString(key)
+		_ = h.WriteByte(0)
+		_, _ = h.WriteString(name)
+
+		// Map the hash to (0, 1), and score it so that each member wins in proportion to its weight.
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(b.weights[i]) / -math.Log(u)
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,173 @@
+package clientgroup
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// testTCPClient records the names of dialed clients.
+type testTCPClient struct {
+	name   string
+	dialed *[]string
+}
+
+func (c testTCPClient) Info() zerocopy.TCPClientInfo {
+	return zerocopy.TCPClientInfo{Name: c.name}
+}
+
+func (c testTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	*c.dialed = append(*c.dialed, c.name)
+	return nil, nil, nil
+}
+
+func newTestLoadBalance(t *testing.T, config LoadBalanceConfig, names ...string) (*LoadBalance, *[]string) {
+	t.Helper()
+
+	var dialed []string
+	members := make([]Member, len(names))
+	for i, name := range names {
+		members[i] = Member{
+			Name:      name,
+			TCPClient: testTCPClient{name, &dialed},
+			UDPClient: direct.NewEchoUDPClient(name, 1500, conn.ListenConfig{}),
+		}
+	}
+
+	g, err := NewLoadBalance("lb", config, members)
+	if err != nil {
+		t.Fatalf("NewLoadBalance failed: %v", err)
+	}
+	return g, &dialed
+}
+
+func TestLoadBalanceRoundRobin(t *testing.T) {
+	g, dialed := newTestLoadBalance(t, LoadBalanceConfig{Weights: []uint{3, 1, 2}}, "a", "b", "c")
+
+	if info := g.Info(); info.Name != "lb" {
+		t.Errorf("g.Info().Name = %q, expected %q", info.Name, "lb")
+	}
+
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	for range 12 {
+		if _, _, err := g.Dial(context.Background(), targetAddr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Smooth weighted round-robin interleaves members instead of sending bursts to one member.
+	expected := []string{"a", "c", "a", "b", "c", "a"}
+	for i, name := range *dialed {
+		if name != expected[i%len(expected)] {
+			t.Fatalf("Dialed %v, expected repetitions of %v", *dialed, expected)
+		}
+	}
+
+	udpClient := g.UDPClient()
+	if info := udpClient.Info(); info.Name != "lb" {
+		t.Errorf("udpClient.Info().Name = %q, expected %q", info.Name, "lb")
+	}
+
+	counts := make(map[string]int)
+	for range 6 {
+		info, session, err := udpClient.NewSession(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = session.Close()
+		counts[info.Name]++
+	}
+	if counts["a"] != 3 || counts["b"] != 1 || counts["c"] != 2 {
+		t.Errorf("UDP session counts = %v, expected a:3 b:1 c:2", counts)
+	}
+}
+
+func TestLoadBalanceConsistentHashing(t *testing.T) {
+	g, dialed := newTestLoadBalance(t, LoadBalanceConfig{Weights: []uint{1, 3}, ConsistentHashing: true}, "a", "b")
+
+	const hostCount = 4096
+	selected := make([]string, hostCount)
+	counts := make(map[string]int)
+
+	for i := range selected {
+		host := "host" + strconv.Itoa(i) + ".example.com"
+
+		// Different ports of the same host use the same member.
+		for _, port := range []uint16{80, 443} {
+			if _, _, err := g.Dial(context.Background(), conn.MustAddrFromDomainPort(host, port), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if (*dialed)[0] != (*dialed)[1] {
+			t.Fatalf("Host %s dialed %v, expected the same member", host, *dialed)
+		}
+		selected[i] = (*dialed)[0]
+		counts[selected[i]]++
+		*dialed = (*dialed)[:0]
+
+		// UDP sessions to the same host use the same member as TCP.
+		ctx := zerocopy.WithUDPSessionTargetAddr(context.Background(), conn.MustAddrFromDomainPort(host, 53))
+		info, session, err := g.UDPClient().NewSession(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = session.Close()
+		if info.Name != selected[i] {
+			t.Fatalf("UDP session to %s used %q, expected %q", host, info.Name, selected[i])
+		}
+	}
+
+	// Expect about 1/4 of hosts on a.
+	if counts["a"] < hostCount/8 || counts["a"] > hostCount*3/8 {
+		t.Errorf("Member counts = %v, expected about 1:3", counts)
+	}
+
+	// Removing a member only moves the hosts of that member.
+	g2, dialed2 := newTestLoadBalance(t, LoadBalanceConfig{ConsistentHashing: true}, "b")
+	g2.seed = g.seed
+	for i, name := range selected {
+		if name != "b" {
+			continue
+		}
+		host := "host" + strconv.Itoa(i) + ".example.com"
+		if _, _, err := g2.Dial(context.Background(), conn.MustAddrFromDomainPort(host, 443), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*dialed2) != counts["b"] {
+		t.Errorf("Dialed %d times, expected %d", len(*dialed2), counts["b"])
+	}
+}
+
+func TestNewLoadBalanceBadConfig(t *testing.T) {
+	member := Member{Name: "a", UDPClient: direct.NewEchoUDPClient("a", 1500, conn.ListenConfig{})}
+
+	for _, c := range []struct {
+		name    string
+		config  LoadBalanceConfig
+		members []Member
+	}{
+		{"NoMembers", LoadBalanceConfig{}, nil},
+		{"WeightCountMismatch", LoadBalanceConfig{Weights: []uint{1, 2}}, []Member{member}},
+		{"ZeroWeight", LoadBalanceConfig{Weights: []uint{0}}, []Member{member}},
+		{"NoClients", LoadBalanceConfig{}, []Member{{Name: "b"}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewLoadBalance("lb", c.config, c.members); err == nil {
+				t.Error("NewLoadBalance succeeded, expected error")
+			}
+		})
+	}
+
+	g, err := NewLoadBalance("lb", LoadBalanceConfig{}, []Member{member})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.HasTCP() || !g.HasUDP() {
+		t.Errorf("g.HasTCP() = %v, g.HasUDP() = %v, expected false, true", g.HasTCP(), g.HasUDP())
+	}
+}
@@ -0,0 +1,135 @@
+package clientgroup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// httpProber checks the health and latency of clients by sending an HTTP(S) request through them.
+type httpProber struct {
+	targetAddr conn.Addr
+	tlsConfig  *tls.Config
+	request    []byte
+	timeout    time.Duration
+}
+
+// newHTTPProber returns a new prober that sends a GET request to rawURL.
+// Any HTTP response within timeout counts as a successful probe.
+func newHTTPProber(rawURL string, timeout time.Duration) (httpProber, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return httpProber{}, fmt.Errorf("bad URL: %w", err)
+	}
+
+	var (
+		defaultPort uint16
+		tlsConfig   *tls.Config
+	)
+
+	switch u.Scheme {
+	case "http":
+		defaultPort = 80
+	case "https":
+		defaultPort = 443
+		tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			NextProtos: []string{"http/1.1"},
+		}
+	default:
+		return httpProber{}, fmt.Errorf("unsupported URL scheme: %q", u.Scheme)
+	}
+
+	port := defaultPort
+	if p := u.Port(); p != "" {
+		pn, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return httpProber{}, fmt.Errorf("bad URL port: %w", err)
+		}
+		port = uint16(pn)
+	}
+
+	targetAddr, err := conn.AddrFromHostPort(u.Hostname(), port)
+	if err != nil {
+		return httpProber{}, fmt.Errorf("bad URL host: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return httpProber{}, err
+	}
+	req.Header.Set("User-Agent", "shadowsocks-go")
+	req.Close = true
+
+	var reqBuf bytes.Buffer
+	if err = req.Write(&reqBuf); err != nil {
+		return httpProber{}, err
+	}
+
+	return httpProber{
+		targetAddr: targetAddr,
+		tlsConfig:  tlsConfig,
+		request:    reqBuf.Bytes(),
+		timeout:    timeout,
+	}, nil
+}
+
+// probe sends the request through the client, and returns the time it takes to receive the response.
+func (p *httpProber) probe(ctx context.Context, c zerocopy.TCPClient) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	// Send the plaintext request along with the connection request.
+	var payload []byte
+	if p.tlsConfig == nil {
+		payload = p.request
+	}
+
+	rawRW, rw, err := c.Dial(ctx, p.targetAddr, payload)
+	if err != nil {
+		return 0, err
+	}
+	defer rawRW.Close()
+
+	// Unblock reads when the probe times out.
+	stop := context.AfterFunc(ctx, func() {
+		_ = rawRW.Close()
+	})
+	defer stop()
+
+	stream := zerocopy.NewStreamConn(rawRW, rw)
+
+	var r *bufio.Reader
+
+	if p.tlsConfig != nil {
+		tc := tls.Client(stream, p.tlsConfig)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			return 0, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		if _, err = tc.Write(p.request); err != nil {
+			return 0, err
+		}
+		r = bufio.NewReader(tc)
+	} else {
+		r = bufio.NewReader(stream)
+	}
+
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,212 @@
+package clientgroup
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultUDPProbeCount is the default number of packets sent in each UDP probe.
+	DefaultUDPProbeCount = 10
+
+	// udpProbePacketInterval is the time between packets of a UDP probe.
+	udpProbePacketInterval = 20 * time.Millisecond
+)
+
+var errUDPProbeNoReplies = errors.New("no replies to UDP probe")
+
+// udpProber measures the round-trip time and packet loss of UDP clients
+// by sending a burst of DNS queries through them to a DNS server.
+type udpProber struct {
+	targetAddr conn.Addr
+	queries    [][]byte
+	timeout    time.Duration
+}
+
+// udpProbeResult is the result of a UDP probe.
+type udpProbeResult struct {
+	// rtt is the mean round-trip time of the answered queries.
+	rtt time.Duration
+
+	// loss is the fraction of queries that were not answered, in [0, 1].
+	loss float64
+}
+
+// newUDPProber returns a new prober that sends count DNS queries to the DNS server at targetAddr.
+// Queries not answered within timeout of the first query are counted as lost.
+func newUDPProber(targetAddr conn.Addr, count int, timeout time.Duration) (udpProber, error) {
+	if !targetAddr.IsValid() {
+		return udpProber{}, errors.New("missing UDP probe address")
+	}
+	if count <= 0 || count > 1<<16 {
+		return udpProber{}, fmt.Errorf("UDP probe count out of range [1, 65536]: %d", count)
+	}
+
+	queries := make([][]byte, count)
+	for i := range queries {
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:               uint16(i),
+			RecursionDesired: true,
+		})
+		if err := builder.StartQuestions(); err != nil {
+			return udpProber{}, err
+		}
+		if err := builder.Question(dnsmessage.Question{
+			Name:  dnsmessage.MustNewName("."),
+			Type:  dnsmessage.TypeNS,
+			Class: dnsmessage.ClassINET,
+		}); err != nil {
+			return udpProber{}, err
+		}
+		query, err := builder.Finish()
+		if err != nil {
+			return udpProber{}, err
+		}
+		queries[i] = query
+	}
+
+	return udpProber{
+		targetAddr: targetAddr,
+		queries:    queries,
+		timeout:    timeout,
+	}, nil
+}
+
+// probe sends the queries through the client, and returns the mean round-trip time and the fraction of lost queries.
+// It returns an error if no queries are answered.
+func (p *udpProber) probe(ctx context.Context, c zerocopy.UDPClient) (udpProbeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	clientInfo, clientSession, err := c.NewSession(ctx)
+	if err != nil {
+		return udpProbeResult{loss: 1}, err
+	}
+	defer clientSession.Close()
+
+	udpConn, _, err := clientInfo.ListenConfig.ListenUDP(ctx, "udp", "")
+	if err != nil {
+		return udpProbeResult{loss: 1}, err
+	}
+	defer udpConn.Close()
+
+	// Unblock reads when the probe times out.
+	stop := context.AfterFunc(ctx, func() {
+		_ = udpConn.SetReadDeadline(conn.ALongTimeAgo)
+	})
+	defer stop()
+
+	// sentTimes stores when each query was sent, in nanoseconds since start, plus 1.
+	// 0 means the query has not been sent, or has been answered.
+	start := time.Now()
+	sentTimes := make([]atomic.Int64, len(p.queries))
+	sendErrCh := make(chan error, 1)
+
+	go func() {
+		b := make([]byte, clientInfo.PackerHeadroom.Front+len(p.queries[0])+clientInfo.PackerHeadroom.Rear)
+
+		for i, query := range p.queries {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					sendErrCh <- nil
+					return
+				case <-time.After(udpProbePacketInterval):
+				}
+			}
+
+			copy(b[clientInfo.PackerHeadroom.Front:], query)
+			destAddrPort, packetStart, packetLength, err := clientSession.Packer.PackInPlace(ctx, b, p.targetAddr, clientInfo.PackerHeadroom.Front, len(query))
+			if err != nil {
+				sendErrCh <- fmt.Errorf("failed to pack UDP probe packet: %w", err)
+				cancel()
+				return
+			}
+
+			sentTimes[i].Store(int64(time.Since(start)) + 1)
+
+			if _, err = udpConn.WriteToUDPAddrPort(b[packetStart:packetStart+packetLength], destAddrPort); err != nil {
+				sendErrCh <- fmt.Errorf("failed to write UDP probe packet: %w", err)
+				cancel()
+				return
+			}
+		}
+
+		sendErrCh <- nil
+	}()
+
+	var (
+		answered int
+		rttSum   time.Duration
+	)
+
+	recvBuf := make([]byte, clientSession.MaxPacketSize)
+
+	for answered < len(p.queries) {
+		n, _, flags, packetSourceAddrPort, err := udpConn.ReadMsgUDPAddrPort(recvBuf, nil)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			continue
+		}
+		if err = conn.ParseFlagsForError(flags); err != nil {
+			continue
+		}
+
+		payloadSourceAddrPort, payloadStart, payloadLength, err := clientSession.Unpacker.UnpackInPlace(recvBuf, packetSourceAddrPort, 0, n)
+		if err != nil {
+			continue
+		}
+		if p.targetAddr.IsIP() && !conn.AddrPortMappedEqual(payloadSourceAddrPort, p.targetAddr.IPPort()) {
+			continue
+		}
+		if payloadLength < 2 {
+			continue
+		}
+
+		id := int(binary.BigEndian.Uint16(recvBuf[payloadStart:]))
+		if id >= len(sentTimes) {
+			continue
+		}
+		sentTime := sentTimes[id].Swap(0)
+		if sentTime == 0 {
+			continue
+		}
+
+		answered++
+		rttSum += time.Since(start) - time.Duration(sentTime-1)
+	}
+
+	cancel()
+	if err = <-sendErrCh; err != nil {
+		return udpProbeResult{loss: 1}, err
+	}
+
+	if answered == 0 {
+		return udpProbeResult{loss: 1}, errUDPProbeNoReplies
+	}
+
+	return udpProbeResult{
+		rtt:  rttSum / time.Duration(answered),
+		loss: 1 - float64(answered)/float64(len(p.queries)),
+	}, nil
+}
+
+// score returns the expected time to deliver a packet over the path with retransmissions,
+// which ranks lossy paths behind clean paths with similar round-trip times.
+func (r udpProbeResult) score() time.Duration {
+	if r.loss >= 1 {
+		return -1
+	}
+	return time.Duration(float64(r.rtt) / (1 - r.loss))
+}
@@ -0,0 +1,183 @@
+package clientgroup
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"go.uber.org/zap"
+)
+
+// startDNSResponder starts a UDP server that answers queries by echoing them back as responses,
+// except for queries whose IDs drop returns true for.
+func startDNSResponder(t *testing.T, drop func(id uint16) bool) conn.Addr {
+	t.Helper()
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addrPort, err := pc.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if n < 12 || drop(binary.BigEndian.Uint16(b)) {
+				continue
+			}
+			b[2] |= 0x80 // QR
+			_, _ = pc.WriteToUDPAddrPort(b[:n], addrPort)
+		}
+	}()
+
+	return conn.AddrFromIPPort(pc.LocalAddr().(*net.UDPAddr).AddrPort())
+}
+
+func TestUDPProberProbe(t *testing.T) {
+	client := direct.NewDirectUDPClient("direct", "ip", 1500, conn.DefaultUDPClientListenConfig)
+
+	for _, c := range []struct {
+		name     string
+		drop     func(id uint16) bool
+		wantLoss float64
+		wantErr  error
+	}{
+		{"NoLoss", func(uint16) bool { return false }, 0, nil},
+		{"HalfLoss", func(id uint16) bool { return id%2 == 1 }, 0.5, nil},
+		{"TotalLoss", func(uint16) bool { return true }, 1, errUDPProbeNoReplies},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			addr := startDNSResponder(t, c.drop)
+
+			p, err := newUDPProber(addr, 4, 500*time.Millisecond)
+			if err != nil {
+				t.Fatalf("newUDPProber failed: %v", err)
+			}
+
+			result, err := p.probe(context.Background(), client)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("probe() error = %v, want %v", err, c.wantErr)
+			}
+			if result.loss != c.wantLoss {
+				t.Errorf("loss = %v, want %v", result.loss, c.wantLoss)
+			}
+			if err == nil && result.rtt <= 0 {
+				t.Errorf("rtt = %v, want positive", result.rtt)
+			}
+		})
+	}
+}
+
+func TestNewUDPProberInvalid(t *testing.T) {
+	if _, err := newUDPProber(conn.Addr{}, 1, time.Second); err == nil {
+		t.Error("newUDPProber with invalid address succeeded")
+	}
+
+	addr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Loopback(), 53))
+	for _, count := range []int{0, -1, 1<<16 + 1} {
+		if _, err := newUDPProber(addr, count, time.Second); err == nil {
+			t.Errorf("newUDPProber with count %d succeeded", count)
+		}
+	}
+}
+
+func TestUDPProbeResultScore(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		result udpProbeResult
+		want   time.Duration
+	}{
+		{"NoLoss", udpProbeResult{rtt: 100 * time.Millisecond}, 100 * time.Millisecond},
+		{"HalfLoss", udpProbeResult{rtt: 100 * time.Millisecond, loss: 0.5}, 200 * time.Millisecond},
+		{"TotalLoss", udpProbeResult{rtt: 100 * time.Millisecond, loss: 1}, -1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.result.score(); got != c.want {
+				t.Errorf("score() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestURLTestUDPProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	addr := startDNSResponder(t, func(uint16) bool { return false })
+
+	// The unreachable member sends queries to a closed port, so its UDP probes get no replies.
+	unreachableAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 1))
+
+	members := []Member{
+		{
+			Name:      "unreachable",
+			TCPClient: direct.NewTCPClient("unreachable", "tcp", conn.DefaultTCPDialer, 0),
+			UDPClient: direct.NewShadowsocksNoneUDPClient("unreachable", "ip", unreachableAddr, 1500, conn.DefaultUDPClientListenConfig),
+		},
+		{
+			Name:      "direct",
+			TCPClient: direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer, 0),
+			UDPClient: direct.NewDirectUDPClient("direct", "ip", 1500, conn.DefaultUDPClientListenConfig),
+		},
+	}
+
+	g, err := NewURLTest("auto", URLTestConfig{
+		URL:             server.URL + "/generate_204",
+		Interval:        time.Hour,
+		Timeout:         500 * time.Millisecond,
+		UDPProbeAddress: addr,
+		UDPProbeCount:   4,
+	}, members, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewURLTest failed: %v", err)
+	}
+
+	if got := g.UDPClient().Info().Name; got != "unreachable" {
+		t.Errorf("Selected UDP member before probing = %q, expected %q", got, "unreachable")
+	}
+
+	g.probeAll(context.Background())
+
+	if got := g.UDPClient().Info().Name; got != "direct" {
+		t.Errorf("Selected UDP member after probing = %q, expected %q", got, "direct")
+	}
+
+	status := g.Status()
+	if status.Type != "urltest" {
+		t.Errorf("status.Type = %q, expected %q", status.Type, "urltest")
+	}
+	if status.UDPSelected != "direct" {
+		t.Errorf("status.UDPSelected = %q, expected %q", status.UDPSelected, "direct")
+	}
+
+	unreachableStatus, directStatus := status.Members[0], status.Members[1]
+	if unreachableStatus.UDPRTT != 0 {
+		t.Errorf("Unreachable member UDPRTT = %v, expected 0", unreachableStatus.UDPRTT.Value())
+	}
+	if unreachableStatus.UDPLoss == nil || *unreachableStatus.UDPLoss != 1 {
+		t.Errorf("Unreachable member UDPLoss = %v, expected 1", unreachableStatus.UDPLoss)
+	}
+	if directStatus.UDPRTT <= 0 {
+		t.Errorf("Direct member UDPRTT = %v, expected positive", directStatus.UDPRTT.Value())
+	}
+	if directStatus.UDPLoss == nil || *directStatus.UDPLoss != 0 {
+		t.Errorf("Direct member UDPLoss = %v, expected 0", directStatus.UDPLoss)
+	}
+	if !directStatus.Up || directStatus.Latency <= 0 {
+		t.Errorf("Direct member Up = %v, Latency = %v, expected up with positive latency", directStatus.Up, directStatus.Latency.Value())
+	}
+}
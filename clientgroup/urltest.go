@@ -0,0 +1,454 @@
+// Package clientgroup implements clients that dispatch to one of several member clients.
+package clientgroup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultURLTestURL is the default URL to probe members with.
+	DefaultURLTestURL = "https://www.gstatic.com/generate_204"
+
+	// DefaultURLTestInterval is the default interval between probes.
+	DefaultURLTestInterval = 5 * time.Minute
+
+	// DefaultURLTestTimeout is the default timeout of a probe.
+	DefaultURLTestTimeout = 5 * time.Second
+
+	// DefaultURLTestTolerance is the default latency improvement required to switch members.
+	DefaultURLTestTolerance = 50 * time.Millisecond
+)
+
+var errNoMembers = errors.New("no members")
+
+// Member is a member client of a group.
+type Member struct {
+	// Name is the name of the member client.
+	Name string
+
+	// TCPClient is the member's TCP client. It is required for probing.
+	TCPClient zerocopy.TCPClient
+
+	// UDPClient is the member's UDP client, or nil if the member does not support UDP.
+	UDPClient zerocopy.UDPClient
+}
+
+// URLTestConfig is the configuration of a [URLTest] group.
+type URLTestConfig struct {
+	// URL is the HTTP or HTTPS URL to probe members with.
+	URL string
+
+	// Interval is the time between probes.
+	Interval time.Duration
+
+	// Timeout is how long to wait for a probe response.
+	Timeout time.Duration
+
+	// Tolerance is how much lower the latency of another member must be
+	// to replace a healthy selected member. It prevents the selection from flapping
+	// between members with similar latencies.
+	Tolerance time.Duration
+
+	// UDPProbeAddress is the address of a DNS server to measure the UDP round-trip time and packet loss
+	// of members with. If not set, members are selected for UDP by the URL test latency.
+	UDPProbeAddress conn.Addr
+
+	// UDPProbeCount is the number of DNS queries sent in each UDP probe.
+	UDPProbeCount int
+}
+
+// urlTestMember is a member with its latest probe result.
+type urlTestMember struct {
+	Member
+
+	// latency is the latest measured latency, or -1 if the latest probe failed or has not been done.
+	latency atomic.Int64
+
+	// udpRTT is the latest measured UDP round-trip time, or -1 if the latest UDP probe failed or has not been done.
+	udpRTT atomic.Int64
+
+	// udpLoss is the bits of the latest measured UDP packet loss ratio.
+	udpLoss atomic.Uint64
+}
+
+// udpScore returns the member's score for UDP selection, or -1 if the member is unhealthy.
+func (m *urlTestMember) udpScore() time.Duration {
+	rtt := time.Duration(m.udpRTT.Load())
+	if rtt < 0 {
+		return -1
+	}
+	return udpProbeResult{rtt: rtt, loss: math.Float64frombits(m.udpLoss.Load())}.score()
+}
+
+// URLTest is a client group that periodically probes its members by sending an HTTP(S) request
+// through each member, and dispatches to the healthy member with the lowest latency.
+//
+// If a UDP probe address is configured, members are also probed by sending a burst of DNS queries
+// through each member's UDP client, and UDP is dispatched to the member with the lowest round-trip time
+// adjusted for packet loss.
+//
+// Before the first probe finishes, the first member is used.
+// If all members are unhealthy, the current selection is kept.
+//
+// URLTest implements [zerocopy.TCPClient], and [URLTest.UDPClient] returns it as a [zerocopy.UDPClient].
+// It also has the String, Start and Stop methods of a service, which run the probes.
+type URLTest struct {
+	name    string
+	config  URLTestConfig
+	members []urlTestMember
+	prober  httpProber
+	logger  *zap.Logger
+
+	// udpProber is the UDP prober, or nil if UDP probing is disabled.
+	udpProber *udpProber
+
+	// udpMembers is the indices of members with a UDP client.
+	udpMembers []int
+
+	// udpPackerHeadroom is the maximum packer headroom of members' UDP clients.
+	udpPackerHeadroom zerocopy.Headroom
+
+	// tcpSelected and udpSelected are the indices of the selected members.
+	tcpSelected atomic.Int64
+	udpSelected atomic.Int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewURLTest returns a new URLTest group with the given name, configuration and members.
+func NewURLTest(name string, config URLTestConfig, members []Member, logger *zap.Logger) (*URLTest, error) {
+	if len(members) == 0 {
+		return nil, errNoMembers
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("non-positive interval: %s", config.Interval)
+	}
+	if config.Timeout <= 0 {
+		return nil, fmt.Errorf("non-positive timeout: %s", config.Timeout)
+	}
+	if config.Tolerance < 0 {
+		return nil, fmt.Errorf("negative tolerance: %s", config.Tolerance)
+	}
+
+	prober, err := newHTTPProber(config.URL, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	g := URLTest{
+		name:    name,
+		config:  config,
+		members: make([]urlTestMember, len(members)),
+		prober:  prober,
+		logger:  logger,
+	}
+
+	if config.UDPProbeAddress.IsValid() {
+		udpProber, err := newUDPProber(config.UDPProbeAddress, config.UDPProbeCount, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		g.udpProber = &udpProber
+	}
+
+	for i, m := range members {
+		if m.TCPClient == nil {
+			return nil, fmt.Errorf("member %q does not support TCP", m.Name)
+		}
+		g.members[i].Member = m
+		g.members[i].latency.Store(-1)
+		g.members[i].udpRTT.Store(-1)
+		g.members[i].udpLoss.Store(math.Float64bits(1))
+		if m.UDPClient != nil {
+			g.udpMembers = append(g.udpMembers, i)
+			g.udpPackerHeadroom = zerocopy.MaxHeadroom(g.udpPackerHeadroom, m.UDPClient.Info().PackerHeadroom)
+		}
+	}
+
+	if len(g.udpMembers) > 0 {
+		g.udpSelected.Store(int64(g.udpMembers[0]))
+	}
+
+	return &g, nil
+}
+
+// HasUDP returns whether any member supports UDP.
+func (g *URLTest) HasUDP() bool {
+	return len(g.udpMembers) > 0
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+// It returns the info of the selected member, so the member's name shows up in logs and statistics.
+func (g *URLTest) Info() zerocopy.TCPClientInfo {
+	return g.members[g.tcpSelected.Load()].TCPClient.Info()
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (g *URLTest) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	return g.members[g.tcpSelected.Load()].TCPClient.Dial(ctx, targetAddr, payload)
+}
+
+// UDPClient returns the group as a [zerocopy.UDPClient].
+// It must only be used if [URLTest.HasUDP] returns true.
+func (g *URLTest) UDPClient() zerocopy.UDPClient {
+	return (*urlTestUDPClient)(g)
+}
+
+// urlTestUDPClient is a [URLTest] group as a [zerocopy.UDPClient].
+// It is needed because the Info methods of the two interfaces have different signatures.
+type urlTestUDPClient URLTest
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *urlTestUDPClient) Info() zerocopy.UDPClientInfo {
+	g := (*URLTest)(c)
+	info := g.members[g.udpSelected.Load()].UDPClient.Info()
+	// Members may be switched after the relay's buffers have been allocated.
+	info.PackerHeadroom = g.udpPackerHeadroom
+	return info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *urlTestUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	g := (*URLTest)(c)
+	return g.members[g.udpSelected.Load()].UDPClient.NewSession(ctx)
+}
+
+// String returns the name of the probe service.
+func (g *URLTest) String() string {
+	return "URL test for client group " + g.name
+}
+
+// Start starts probing members in a new goroutine.
+func (g *URLTest) Start(ctx context.Context) error {
+	ctx, g.cancel = context.WithCancel(ctx)
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+
+		ticker := time.NewTicker(g.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			g.probeAll(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	g.logger.Info("Started URL test",
+		zap.String("group", g.name),
+		zap.String("url", g.config.URL),
+		zap.Duration("interval", g.config.Interval),
+	)
+	return nil
+}
+
+// Stop stops probing members and waits for ongoing probes to finish.
+func (g *URLTest) Stop() error {
+	g.cancel()
+	g.wg.Wait()
+	return nil
+}
+
+// probeAll probes all members concurrently and updates the selection.
+func (g *URLTest) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i := range g.members {
+		m := &g.members[i]
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			latency, err := g.prober.probe(ctx, m.TCPClient)
+			if err != nil {
+				m.latency.Store(-1)
+				if ctx.Err() == nil {
+					g.logger.Warn("URL test failed",
+						zap.String("group", g.name),
+						zap.String("member", m.Name),
+						zap.Error(err),
+					)
+				}
+				return
+			}
+			m.latency.Store(int64(latency))
+
+			if ce := g.logger.Check(zap.DebugLevel, "URL test succeeded"); ce != nil {
+				ce.Write(
+					zap.String("group", g.name),
+					zap.String("member", m.Name),
+					zap.Duration("latency", latency),
+				)
+			}
+		}()
+
+		if g.udpProber != nil && m.UDPClient != nil {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				g.probeUDP(ctx, m)
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	latencies := make([]time.Duration, len(g.members))
+	for i := range g.members {
+		latencies[i] = time.Duration(g.members[i].latency.Load())
+	}
+
+	g.updateSelection(&g.tcpSelected, "tcp", latencies, func(yield func(int) bool) {
+		for i := range g.members {
+			if !yield(i) {
+				return
+			}
+		}
+	})
+
+	if len(g.udpMembers) > 0 {
+		if g.udpProber != nil {
+			latencies = make([]time.Duration, len(g.members))
+			for i := range g.members {
+				latencies[i] = g.members[i].udpScore()
+			}
+		}
+
+		g.updateSelection(&g.udpSelected, "udp", latencies, func(yield func(int) bool) {
+			for _, i := range g.udpMembers {
+				if !yield(i) {
+					return
+				}
+			}
+		})
+	}
+}
+
+// probeUDP measures the UDP round-trip time and packet loss of the member.
+func (g *URLTest) probeUDP(ctx context.Context, m *urlTestMember) {
+	result, err := g.udpProber.probe(ctx, m.UDPClient)
+	m.udpLoss.Store(math.Float64bits(result.loss))
+	if err != nil {
+		m.udpRTT.Store(-1)
+		if ctx.Err() == nil {
+			g.logger.Warn("UDP probe failed",
+				zap.String("group", g.name),
+				zap.String("member", m.Name),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+	m.udpRTT.Store(int64(result.rtt))
+
+	if ce := g.logger.Check(zap.DebugLevel, "UDP probe succeeded"); ce != nil {
+		ce.Write(
+			zap.String("group", g.name),
+			zap.String("member", m.Name),
+			zap.Duration("rtt", result.rtt),
+			zap.Float64("loss", result.loss),
+		)
+	}
+}
+
+// updateSelection selects the best of the candidates by latencies, with hysteresis.
+func (g *URLTest) updateSelection(selected *atomic.Int64, network string, latencies []time.Duration, candidates func(yield func(int) bool)) {
+	current := int(selected.Load())
+	next := selectMember(current, latencies, candidates, g.config.Tolerance)
+	if next == current {
+		return
+	}
+	selected.Store(int64(next))
+
+	g.logger.Info("Switched selected member",
+		zap.String("group", g.name),
+		zap.String("network", network),
+		zap.String("from", g.members[current].Name),
+		zap.String("to", g.members[next].Name),
+		zap.Duration("latency", latencies[next]),
+	)
+}
+
+// selectMember returns the index of the candidate with the lowest non-negative latency.
+//
+// The current member is kept if it is healthy and the best candidate is not faster by more than tolerance,
+// or if no candidate is healthy.
+func selectMember(current int, latencies []time.Duration, candidates func(yield func(int) bool), tolerance time.Duration) int {
+	best := -1
+	for i := range candidates {
+		if latencies[i] < 0 {
+			continue
+		}
+		if best == -1 || latencies[i] < latencies[best] {
+			best = i
+		}
+	}
+
+	switch {
+	case best == -1:
+		return current
+	case latencies[current] >= 0 && latencies[best]+tolerance >= latencies[current]:
+		return current
+	default:
+		return best
+	}
+}
+
+// Status returns the selected members and the latest probe results of all members.
+func (g *URLTest) Status() Status {
+	s := Status{
+		Name:        g.name,
+		Type:        "urltest",
+		TCPSelected: g.members[g.tcpSelected.Load()].Name,
+		Members:     make([]MemberStatus, len(g.members)),
+	}
+
+	if len(g.udpMembers) > 0 {
+		s.UDPSelected = g.members[g.udpSelected.Load()].Name
+	}
+
+	for i := range g.members {
+		m := &g.members[i]
+		ms := MemberStatus{
+			Name: m.Name,
+		}
+		if latency := m.latency.Load(); latency >= 0 {
+			ms.Up = true
+			ms.Latency = jsonhelper.Duration(latency)
+		}
+		if g.udpProber != nil && m.UDPClient != nil {
+			if rtt := m.udpRTT.Load(); rtt >= 0 {
+				ms.UDPRTT = jsonhelper.Duration(rtt)
+			}
+			loss := math.Float64frombits(m.udpLoss.Load())
+			ms.UDPLoss = &loss
+		}
+		s.Members[i] = ms
+	}
+
+	return s
+}
@@ -0,0 +1,145 @@
+package clientgroup
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"go.uber.org/zap"
+)
+
+func allCandidates(n int) func(yield func(int) bool) {
+	return func(yield func(int) bool) {
+		for i := range n {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+func TestSelectMember(t *testing.T) {
+	const tolerance = 50 * time.Millisecond
+
+	for _, c := range []struct {
+		name      string
+		current   int
+		latencies []time.Duration
+		expected  int
+	}{
+		{"LowestLatency", 0, []time.Duration{-1, 200 * time.Millisecond, 100 * time.Millisecond}, 2},
+		{"WithinTolerance", 1, []time.Duration{80 * time.Millisecond, 120 * time.Millisecond}, 1},
+		{"AtTolerance", 1, []time.Duration{70 * time.Millisecond, 120 * time.Millisecond}, 1},
+		{"BeyondTolerance", 1, []time.Duration{60 * time.Millisecond, 120 * time.Millisecond}, 0},
+		{"CurrentUnhealthy", 1, []time.Duration{120 * time.Millisecond, -1, 100 * time.Millisecond}, 2},
+		{"AllUnhealthy", 1, []time.Duration{-1, -1, -1}, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := selectMember(c.current, c.latencies, allCandidates(len(c.latencies)), tolerance); got != c.expected {
+				t.Errorf("selectMember(%d, %v) = %d, expected %d", c.current, c.latencies, got, c.expected)
+			}
+		})
+	}
+}
+
+func TestSelectMemberCandidates(t *testing.T) {
+	latencies := []time.Duration{10 * time.Millisecond, 200 * time.Millisecond, 100 * time.Millisecond}
+	candidates := func(yield func(int) bool) {
+		_ = yield(1) && yield(2)
+	}
+	if got := selectMember(1, latencies, candidates, 0); got != 2 {
+		t.Errorf("selectMember() = %d, expected 2", got)
+	}
+}
+
+func testURLTest(t *testing.T, server *httptest.Server, url string) {
+	t.Helper()
+
+	logger := zap.NewNop()
+	members := []Member{
+		{
+			Name:      "echo",
+			TCPClient: direct.NewEchoTCPClient("echo"),
+		},
+		{
+			Name:      "direct",
+			TCPClient: direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer, 0),
+		},
+	}
+
+	g, err := NewURLTest("auto", URLTestConfig{
+		URL:       url,
+		Interval:  time.Hour,
+		Timeout:   time.Second,
+		Tolerance: DefaultURLTestTolerance,
+	}, members, logger)
+	if err != nil {
+		t.Fatalf("NewURLTest failed: %v", err)
+	}
+	if g.HasUDP() {
+		t.Error("g.HasUDP() = true, expected false")
+	}
+
+	if server.TLS != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(server.Certificate())
+		g.prober.tlsConfig.RootCAs = pool
+	}
+
+	if got := g.Info().Name; got != "echo" {
+		t.Errorf("Selected member before probing = %q, expected %q", got, "echo")
+	}
+
+	g.probeAll(context.Background())
+
+	if latency := g.members[0].latency.Load(); latency != -1 {
+		t.Errorf("Echo member latency = %d, expected -1", latency)
+	}
+	if latency := g.members[1].latency.Load(); latency < 0 {
+		t.Errorf("Direct member latency = %d, expected non-negative", latency)
+	}
+	if got := g.Info().Name; got != "direct" {
+		t.Errorf("Selected member after probing = %q, expected %q", got, "direct")
+	}
+}
+
+func TestURLTestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	testURLTest(t, server, server.URL+"/generate_204")
+}
+
+func TestURLTestHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	testURLTest(t, server, server.URL+"/generate_204")
+}
+
+func TestURLTestStartStop(t *testing.T) {
+	g, err := NewURLTest("auto", URLTestConfig{
+		URL:      "http://127.0.0.1:1/",
+		Interval: time.Hour,
+		Timeout:  time.Second,
+	}, []Member{{Name: "echo", TCPClient: direct.NewEchoTCPClient("echo")}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewURLTest failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = g.Start(ctx); err != nil {
+		t.Fatalf("g.Start failed: %v", err)
+	}
+	cancel()
+	if err = g.Stop(); err != nil {
+		t.Errorf("g.Stop failed: %v", err)
+	}
+}
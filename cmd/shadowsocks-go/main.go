@@ -2,35 +2,72 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/jsonhelper"
 	"github.com/database64128/shadowsocks-go/logging"
 	"github.com/database64128/shadowsocks-go/service"
+	"github.com/database64128/shadowsocks-go/sip002"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 var (
 	testConf bool
+	selfTest bool
 	confPath string
 	zapConf  string
 	logLevel zapcore.Level
+
+	benchClients     string
+	benchDownloadURL string
+	benchUploadURL   string
+	benchUploadSize  int64
+	benchTimeout     time.Duration
+
+	urlHost string
 )
 
 func init() {
 	flag.BoolVar(&testConf, "testConf", false, "Test the configuration file and exit without starting the services")
+	flag.BoolVar(&selfTest, "selfTest", false, "Test the datapath of each server with a loopback client and exit")
 	flag.StringVar(&confPath, "confPath", "config.json", "Path to the JSON configuration file")
-	flag.StringVar(&zapConf, "zapConf", "console", "Preset name or path to the JSON configuration file for building the zap logger.\nAvailable presets: console, console-nocolor, console-notime, systemd, production, development")
-	flag.TextVar(&logLevel, "logLevel", zapcore.InfoLevel, "Log level for the console and systemd presets.\nAvailable levels: debug, info, warn, error, dpanic, panic, fatal")
+	flag.StringVar(&zapConf, "zapConf", "console", "Preset name or path to the JSON configuration file for building the zap logger.\nAvailable presets: console, console-nocolor, console-notime, systemd, production, development\nIgnored if the configuration file has log sinks.")
+	flag.TextVar(&logLevel, "logLevel", zapcore.InfoLevel, "Log level for the console and systemd presets.\nAvailable levels: debug, info, warn, error, dpanic, panic, fatal\nIgnored if the configuration file has log sinks.")
+	flag.StringVar(&benchClients, "benchClients", "", "Comma-separated names of the clients to benchmark.\nIf empty, all clients with TCP enabled are benchmarked, except client groups and internal clients.")
+	flag.StringVar(&benchDownloadURL, "benchDownloadURL", service.DefaultBenchDownloadURL, "URL to download through each client when benchmarking. Empty to skip downloads.")
+	flag.StringVar(&benchUploadURL, "benchUploadURL", service.DefaultBenchUploadURL, "URL to upload to through each client when benchmarking. Empty to skip uploads.")
+	flag.Int64Var(&benchUploadSize, "benchUploadSize", service.DefaultBenchUploadSize, "Number of bytes to upload through each client when benchmarking")
+	flag.DurationVar(&benchTimeout, "benchTimeout", service.DefaultBenchTimeout, "Timeout of each benchmark transfer")
+	flag.StringVar(&urlHost, "urlHost", "", "Host to connect to in exported ss:// URLs.\nIf empty, the listen address of each server is used.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [check|bench|url] [flags] [ss://...]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "The check subcommand validates the configuration file, reports all errors, and exits without binding any sockets.")
+		fmt.Fprintln(flag.CommandLine.Output(), "The bench subcommand measures the latency and throughput of each client, prints a comparison table, and exits.")
+		fmt.Fprintln(flag.CommandLine.Output(), "The url subcommand prints the client config of each ss:// URL argument, or prints ss:// URLs for the configured servers if there are no arguments.")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
-	flag.Parse()
+	args := os.Args[1:]
+	var subcommand string
+	if len(args) > 0 && (args[0] == "check" || args[0] == "bench" || args[0] == "url") {
+		subcommand = args[0]
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
 
 	logger, err := logging.NewZapLogger(zapConf, logLevel)
 	if err != nil {
@@ -39,14 +76,49 @@ func main() {
 	}
 	defer logger.Sync()
 
+	if subcommand == "url" && flag.NArg() > 0 {
+		runURLImport(flag.Args(), logger)
+		return
+	}
+
 	var sc service.Config
-	if err = jsonhelper.OpenAndDecodeDisallowUnknownFields(confPath, &sc); err != nil {
+	if err = jsonhelper.OpenAndDecodeConfig(confPath, &sc); err != nil {
 		logger.Fatal("Failed to load config",
 			zap.String("confPath", confPath),
 			zap.Error(err),
 		)
 	}
 
+	switch subcommand {
+	case "check":
+		runCheck(&sc, logger)
+		return
+	case "bench":
+		runBench(&sc, logger)
+		return
+	case "url":
+		runURLExport(&sc, logger)
+		return
+	}
+
+	if len(sc.Log.Sinks) > 0 {
+		configLogger, err := sc.Log.NewZapLogger()
+		if err != nil {
+			logger.Fatal("Failed to build logger from config",
+				zap.String("confPath", confPath),
+				zap.Error(err),
+			)
+		}
+		_ = logger.Sync()
+		logger = configLogger
+		defer logger.Sync()
+	}
+
+	if selfTest {
+		runSelfTest(&sc, logger)
+		return
+	}
+
 	m, err := sc.Manager(logger)
 	if err != nil {
 		logger.Fatal("Failed to create service manager",
@@ -61,14 +133,35 @@ func main() {
 		return
 	}
 
+	reload := func() error {
+		var sc service.Config
+		if err := jsonhelper.OpenAndDecodeConfig(confPath, &sc); err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		return m.Reload(&sc)
+	}
+	m.SetReloadFunc(reload)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
 		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-		sig := <-sigCh
-		logger.Info("Received exit signal", zap.Stringer("signal", sig))
-		cancel()
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				logger.Info("Received reload signal", zap.String("confPath", confPath))
+				if err := reload(); err != nil {
+					logger.Warn("Failed to reload config",
+						zap.String("confPath", confPath),
+						zap.Error(err),
+					)
+				}
+				continue
+			}
+			logger.Info("Received exit signal", zap.Stringer("signal", sig))
+			cancel()
+			return
+		}
 	}()
 
 	if err = m.Start(ctx); err != nil {
@@ -81,3 +174,208 @@ func main() {
 	<-ctx.Done()
 	m.Stop()
 }
+
+func runCheck(sc *service.Config, logger *zap.Logger) {
+	errs := sc.Check(logger)
+
+	for _, err := range errs {
+		logger.Error("Config check error",
+			zap.String("path", err.Path),
+			zap.Error(err.Err),
+		)
+	}
+
+	if len(errs) > 0 {
+		logger.Fatal("Config check failed",
+			zap.String("confPath", confPath),
+			zap.Int("errors", len(errs)),
+		)
+	}
+
+	logger.Info("Config check OK", zap.String("confPath", confPath))
+}
+
+func runBench(sc *service.Config, logger *zap.Logger) {
+	bc := service.BenchConfig{
+		DownloadURL: benchDownloadURL,
+		UploadURL:   benchUploadURL,
+		UploadSize:  benchUploadSize,
+		Timeout:     benchTimeout,
+	}
+	if benchClients != "" {
+		bc.Clients = strings.Split(benchClients, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	results, err := sc.Bench(ctx, bc, logger)
+	if len(results) > 0 {
+		printBenchResults(os.Stdout, results)
+	}
+	if err != nil {
+		logger.Fatal("Failed to run benchmark",
+			zap.String("confPath", confPath),
+			zap.Error(err),
+		)
+	}
+}
+
+func printBenchResults(w io.Writer, results []service.BenchResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT\tPROTOCOL\tLATENCY\tDOWNLOAD\tUPLOAD\tERROR")
+
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t%v\n", r.Client, r.Protocol, r.Err)
+			continue
+		}
+
+		latency := "-"
+		if r.Latency > 0 {
+			latency = r.Latency.Round(time.Millisecond).String()
+		}
+
+		var errs []string
+		if r.Download.Err != nil {
+			errs = append(errs, "download: "+r.Download.Err.Error())
+		}
+		if r.Upload.Err != nil {
+			errs = append(errs, "upload: "+r.Upload.Err.Error())
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Client,
+			r.Protocol,
+			latency,
+			formatBenchTransfer(r.Download),
+			formatBenchTransfer(r.Upload),
+			strings.Join(errs, "; "),
+		)
+	}
+
+	_ = tw.Flush()
+}
+
+func formatBenchTransfer(t service.BenchTransfer) string {
+	if t.Err != nil || t.Duration <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f Mbps", t.BitsPerSecond()/1e6)
+}
+
+// urlClientConfig is the subset of [service.ClientConfig] that ss:// URLs can express,
+// for printing imported clients without the zero values of other fields.
+type urlClientConfig struct {
+	Name       string    `json:"name"`
+	Protocol   string    `json:"protocol"`
+	Endpoint   conn.Addr `json:"endpoint"`
+	EnableTCP  bool      `json:"enableTCP"`
+	EnableUDP  bool      `json:"enableUDP"`
+	MTU        int       `json:"mtu"`
+	PSK        []byte    `json:"psk,omitempty"`
+	IPSKs      [][]byte  `json:"iPSKs,omitempty"`
+	Password   string    `json:"password,omitempty"`
+	Plugin     string    `json:"plugin,omitempty"`
+	PluginOpts string    `json:"pluginOpts,omitempty"`
+}
+
+func runURLImport(urls []string, logger *zap.Logger) {
+	clients := make([]urlClientConfig, len(urls))
+
+	for i, s := range urls {
+		u, err := sip002.Parse(s)
+		if err != nil {
+			logger.Fatal("Failed to parse URL", zap.String("url", s), zap.Error(err))
+		}
+		cc, err := service.ClientConfigFromSIP002(u)
+		if err != nil {
+			logger.Fatal("Failed to convert URL to client config", zap.String("url", s), zap.Error(err))
+		}
+		clients[i] = urlClientConfig{
+			Name:       cc.Name,
+			Protocol:   cc.Protocol,
+			Endpoint:   cc.Endpoint,
+			EnableTCP:  cc.EnableTCP,
+			EnableUDP:  cc.EnableUDP,
+			MTU:        cc.MTU,
+			PSK:        cc.PSK,
+			IPSKs:      cc.IPSKs,
+			Password:   cc.Password,
+			Plugin:     cc.Plugin,
+			PluginOpts: cc.PluginOpts,
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(clients); err != nil {
+		logger.Fatal("Failed to print client configs", zap.Error(err))
+	}
+}
+
+func runURLExport(sc *service.Config, logger *zap.Logger) {
+	urls, err := sc.SIP002URLs(urlHost)
+	if err != nil {
+		logger.Fatal("Failed to export URLs",
+			zap.String("confPath", confPath),
+			zap.Error(err),
+		)
+	}
+
+	for _, u := range urls {
+		fmt.Println(u)
+	}
+}
+
+func runSelfTest(sc *service.Config, logger *zap.Logger) {
+	results, err := sc.SelfTest(context.Background(), logger)
+	if err != nil {
+		logger.Fatal("Failed to run self-test",
+			zap.String("confPath", confPath),
+			zap.Error(err),
+		)
+	}
+
+	var failed int
+
+	for _, r := range results {
+		logSelfTestCheck(logger, r.Server, "tcp", r.TCP)
+		logSelfTestCheck(logger, r.Server, "udp", r.UDP)
+		if r.Failed() {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		logger.Fatal("Self-test failed",
+			zap.Int("failedServers", failed),
+			zap.Int("servers", len(results)),
+		)
+	}
+
+	logger.Info("Self-test OK", zap.Int("servers", len(results)))
+}
+
+func logSelfTestCheck(logger *zap.Logger, server, network string, c service.SelfTestCheck) {
+	switch {
+	case c.SkipReason != "":
+		logger.Info("Skipped self-test check",
+			zap.String("server", server),
+			zap.String("network", network),
+			zap.String("reason", c.SkipReason),
+		)
+	case c.Err != nil:
+		logger.Error("Self-test check failed",
+			zap.String("server", server),
+			zap.String("network", network),
+			zap.Error(c.Err),
+		)
+	default:
+		logger.Info("Self-test check passed",
+			zap.String("server", server),
+			zap.String("network", network),
+			zap.Duration("rtt", c.RTT),
+		)
+	}
+}
@@ -0,0 +1,130 @@
+// Package compression implements an optional stream compression layer
+// for TCP relays between shadowsocks-go clients and servers.
+//
+// The client sends a single mode byte at the beginning of each stream, before the compressed data.
+// The server uses the same mode for both directions of the stream.
+// This allows the client to turn off compression per connection,
+// for example when the initial payload indicates already-compressed or encrypted traffic.
+//
+// Zstandard is the only supported algorithm.
+//
+// Compressing before encryption makes the length of the encrypted stream depend on the plaintext.
+// Attackers able to inject chosen plaintext into a stream that also carries a secret
+// can recover the secret from length changes, as in CRIME and BREACH.
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm is a stream compression algorithm.
+type Algorithm string
+
+// Supported compression algorithms.
+const (
+	AlgorithmNone Algorithm = ""
+	AlgorithmZstd Algorithm = "zstd"
+)
+
+// ParseAlgorithm parses the string representation of a compression algorithm.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch s {
+	case "", "none":
+		return AlgorithmNone, nil
+	case "zstd":
+		return AlgorithmZstd, nil
+	default:
+		return AlgorithmNone, fmt.Errorf("unknown compression algorithm: %q", s)
+	}
+}
+
+// Per-connection stream modes.
+const (
+	modeUncompressed = 0
+	modeZstd         = 1
+)
+
+var errUnknownMode = errors.New("unknown stream compression mode")
+
+// streamReadWriter compresses writes and decompresses reads on top of an inner [zerocopy.ReadWriter].
+//
+// streamReadWriter implements the zerocopy ReadWriter interface.
+type streamReadWriter struct {
+	inner zerocopy.ReadWriter
+	enc   *zstd.Encoder
+	dec   *zstd.Decoder
+}
+
+// switchWriter forwards writes to w. It allows the encoder to buffer
+// the initial payload before the underlying connection is established.
+type switchWriter struct {
+	w io.Writer
+}
+
+// Write implements the io.Writer Write method.
+func (sw *switchWriter) Write(b []byte) (int, error) {
+	return sw.w.Write(b)
+}
+
+func newZstdEncoder(w io.Writer) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w,
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithLowerEncoderMem(true),
+		zstd.WithWindowSize(1<<20),
+	)
+}
+
+func newZstdDecoder(r io.Reader) (*zstd.Decoder, error) {
+	return zstd.NewReader(r,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderLowmem(true),
+		zstd.WithDecoderMaxWindow(1<<20),
+	)
+}
+
+// ReaderInfo implements the zerocopy.Reader ReaderInfo method.
+func (rw *streamReadWriter) ReaderInfo() zerocopy.ReaderInfo {
+	return zerocopy.ReaderInfo{}
+}
+
+// ReadZeroCopy implements the zerocopy.Reader ReadZeroCopy method.
+func (rw *streamReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	return rw.dec.Read(b[payloadBufStart : payloadBufStart+payloadBufLen])
+}
+
+// WriterInfo implements the zerocopy.Writer WriterInfo method.
+func (rw *streamReadWriter) WriterInfo() zerocopy.WriterInfo {
+	return zerocopy.WriterInfo{}
+}
+
+// WriteZeroCopy implements the zerocopy.Writer WriteZeroCopy method.
+func (rw *streamReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	payloadWritten, err = rw.enc.Write(b[payloadStart : payloadStart+payloadLen])
+	if err != nil {
+		return
+	}
+	// Flush after every write, so interactive traffic is not held back by the encoder.
+	return payloadWritten, rw.enc.Flush()
+}
+
+// CloseRead implements the zerocopy.ReadWriter CloseRead method.
+func (rw *streamReadWriter) CloseRead() error {
+	return rw.inner.CloseRead()
+}
+
+// CloseWrite implements the zerocopy.ReadWriter CloseWrite method.
+func (rw *streamReadWriter) CloseWrite() error {
+	return errors.Join(rw.enc.Close(), rw.inner.CloseWrite())
+}
+
+// Close implements the zerocopy.ReadWriter Close method.
+func (rw *streamReadWriter) Close() error {
+	rw.dec.Close()
+	return rw.inner.Close()
+}
@@ -0,0 +1,203 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+const initialPayloadBufferSize = 1440
+
+// incompressiblePorts are well-known ports of protocols whose traffic is encrypted or already compressed.
+var incompressiblePorts = [...]uint16{
+	22,   // SSH
+	443,  // HTTPS
+	465,  // SMTPS
+	853,  // DNS over TLS
+	993,  // IMAPS
+	995,  // POP3S
+	8443, // HTTPS alt
+}
+
+// ShouldCompress sniffs the initial payload and the target port,
+// and reports whether a stream to the target is likely to benefit from compression.
+func ShouldCompress(targetAddr conn.Addr, payload []byte) bool {
+	switch {
+	case len(payload) >= 3 && payload[0] == 0x16 && payload[1] == 0x03:
+		// TLS handshake record.
+		return false
+	case bytes.HasPrefix(payload, []byte("SSH-")):
+		return false
+	case len(payload) > 0:
+		return true
+	}
+
+	port := targetAddr.Port()
+	for _, p := range incompressiblePorts {
+		if port == p {
+			return false
+		}
+	}
+	return true
+}
+
+// TCPClient wraps a TCP client and compresses streams to the server.
+//
+// TCPClient implements the zerocopy TCPClient interface.
+type TCPClient struct {
+	inner     zerocopy.TCPClient
+	algorithm Algorithm
+}
+
+// NewTCPClient returns a new compressing TCP client.
+func NewTCPClient(inner zerocopy.TCPClient, algorithm Algorithm) *TCPClient {
+	return &TCPClient{
+		inner:     inner,
+		algorithm: algorithm,
+	}
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+func (c *TCPClient) Info() zerocopy.TCPClientInfo {
+	return c.inner.Info()
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	if c.algorithm == AlgorithmNone || !ShouldCompress(targetAddr, payload) {
+		b := make([]byte, 1+len(payload))
+		b[0] = modeUncompressed
+		copy(b[1:], payload)
+		return c.inner.Dial(ctx, targetAddr, b)
+	}
+
+	// Compress the initial payload into the buffer, then switch the encoder
+	// over to the established connection.
+	buf := bytes.NewBuffer(make([]byte, 0, 1+len(payload)))
+	buf.WriteByte(modeZstd)
+	sw := &switchWriter{w: buf}
+
+	enc, err := newZstdEncoder(sw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(payload) > 0 {
+		if _, err = enc.Write(payload); err != nil {
+			return nil, nil, err
+		}
+		if err = enc.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rawRW, innerRW, err := c.inner.Dial(ctx, targetAddr, buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crw := zerocopy.NewCopyReadWriter(innerRW)
+	sw.w = crw
+
+	dec, err := newZstdDecoder(crw)
+	if err != nil {
+		innerRW.Close()
+		return nil, nil, err
+	}
+
+	return rawRW, &streamReadWriter{
+		inner: innerRW,
+		enc:   enc,
+		dec:   dec,
+	}, nil
+}
+
+// TCPServer wraps a TCP server and decompresses streams from the client.
+//
+// TCPServer implements the zerocopy TCPServer interface.
+type TCPServer struct {
+	inner zerocopy.TCPServer
+}
+
+// NewTCPServer returns a new decompressing TCP server.
+func NewTCPServer(inner zerocopy.TCPServer) *TCPServer {
+	return &TCPServer{
+		inner: inner,
+	}
+}
+
+// Info implements the zerocopy.TCPServer Info method.
+//
+// NativeInitialPayload is always true, because the initial payload of a compressed stream
+// is consumed by the decoder and cannot be read with a deadline.
+func (s *TCPServer) Info() zerocopy.TCPServerInfo {
+	info := s.inner.Info()
+	info.NativeInitialPayload = true
+	return info
+}
+
+// Accept implements the zerocopy.TCPServer Accept method.
+func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
+	rw, targetAddr, payload, username, err = s.inner.Accept(rawRW)
+	if err != nil {
+		return
+	}
+
+	if len(payload) == 0 {
+		if payload, err = readInitialPayload(rw); err != nil {
+			return nil, conn.Addr{}, nil, username, fmt.Errorf("failed to read compression mode: %w", err)
+		}
+	}
+
+	mode, rest := payload[0], payload[1:]
+
+	switch mode {
+	case modeUncompressed:
+		return rw, targetAddr, rest, username, nil
+	case modeZstd:
+	default:
+		return nil, conn.Addr{}, payload, username, fmt.Errorf("%w: %d", errUnknownMode, mode)
+	}
+
+	crw := zerocopy.NewCopyReadWriter(rw)
+
+	enc, err := newZstdEncoder(crw)
+	if err != nil {
+		return nil, conn.Addr{}, nil, username, err
+	}
+
+	dec, err := newZstdDecoder(io.MultiReader(bytes.NewReader(rest), crw))
+	if err != nil {
+		return nil, conn.Addr{}, nil, username, err
+	}
+
+	return &streamReadWriter{
+		inner: rw,
+		enc:   enc,
+		dec:   dec,
+	}, targetAddr, nil, username, nil
+}
+
+// readInitialPayload reads at least one byte from rw.
+func readInitialPayload(rw zerocopy.ReadWriter) ([]byte, error) {
+	ri := rw.ReaderInfo()
+	payloadBufSize := max(ri.MinPayloadBufferSizePerRead, initialPayloadBufferSize)
+	b := make([]byte, ri.Headroom.Front+payloadBufSize+ri.Headroom.Rear)
+
+	for {
+		payloadLen, err := rw.ReadZeroCopy(b, ri.Headroom.Front, payloadBufSize)
+		if payloadLen > 0 {
+			return b[ri.Headroom.Front : ri.Headroom.Front+payloadLen], nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
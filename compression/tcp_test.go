@@ -0,0 +1,103 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/pipe"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// pipeTCPClient writes the initial payload to one end of a duplex pipe.
+type pipeTCPClient struct {
+	pe *pipe.DuplexPipeEnd
+}
+
+func (c *pipeTCPClient) Info() zerocopy.TCPClientInfo {
+	return zerocopy.TCPClientInfo{Name: "pipe", NativeInitialPayload: true}
+}
+
+func (c *pipeTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (zerocopy.DirectReadWriteCloser, zerocopy.ReadWriter, error) {
+	if _, err := c.pe.Write(payload); err != nil {
+		return nil, nil, err
+	}
+	return c.pe, direct.NewDirectStreamReadWriter(c.pe), nil
+}
+
+// pipeTCPServer accepts the other end of the duplex pipe without reading anything.
+type pipeTCPServer struct{}
+
+func (pipeTCPServer) Info() zerocopy.TCPServerInfo {
+	return zerocopy.TCPServerInfo{}
+}
+
+func (pipeTCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (zerocopy.ReadWriter, conn.Addr, []byte, string, error) {
+	return direct.NewDirectStreamReadWriter(rawRW), conn.Addr{}, nil, "", nil
+}
+
+func testTCPClientServer(t *testing.T, targetAddr conn.Addr, clientInitialPayload []byte, expectCompressed bool) {
+	t.Helper()
+
+	pl, pr := pipe.NewDuplexPipe()
+	client := NewTCPClient(&pipeTCPClient{pe: pl}, AlgorithmZstd)
+	server := NewTCPServer(pipeTCPServer{})
+
+	var (
+		crw, srw         zerocopy.ReadWriter
+		serverPayload    []byte
+		cerr, serr       error
+		serverCompressed bool
+		wg               sync.WaitGroup
+	)
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		_, crw, cerr = client.Dial(context.Background(), targetAddr, clientInitialPayload)
+	}()
+
+	go func() {
+		defer wg.Done()
+		srw, _, serverPayload, _, serr = server.Accept(pr)
+		if serr != nil {
+			return
+		}
+		_, serverCompressed = srw.(*streamReadWriter)
+		if serverCompressed && len(clientInitialPayload) > 0 {
+			serverPayload = make([]byte, len(clientInitialPayload))
+			_, serr = srw.ReadZeroCopy(serverPayload, 0, len(serverPayload))
+		}
+	}()
+
+	wg.Wait()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+
+	if serverCompressed != expectCompressed {
+		t.Errorf("serverCompressed = %t, expected %t", serverCompressed, expectCompressed)
+	}
+	if !bytes.Equal(serverPayload, clientInitialPayload) {
+		t.Errorf("serverPayload = %q, expected %q", serverPayload, clientInitialPayload)
+	}
+
+	zerocopy.ReadWriterTestFunc(t, crw, srw)
+}
+
+func TestTCPClientServer(t *testing.T) {
+	httpAddr := conn.MustAddrFromDomainPort("example.com", 80)
+	httpsAddr := conn.MustAddrFromDomainPort("example.com", 443)
+
+	testTCPClientServer(t, httpAddr, nil, true)
+	testTCPClientServer(t, httpAddr, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), true)
+	testTCPClientServer(t, httpsAddr, nil, false)
+	testTCPClientServer(t, httpsAddr, []byte{0x16, 0x03, 0x01, 0x02, 0x00}, false)
+}
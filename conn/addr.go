@@ -225,7 +225,12 @@ func (a Addr) MarshalText() ([]byte, error) {
 }
 
 // UnmarshalText implements the encoding.TextUnmarshaler UnmarshalText method.
+// Empty text yields the zero value, as returned by [Addr.MarshalText] for it.
 func (a *Addr) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*a = Addr{}
+		return nil
+	}
 	addr, err := ParseAddr(text)
 	if err != nil {
 		return err
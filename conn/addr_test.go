@@ -293,6 +293,14 @@ func TestAddrMarshalAndUnmarshalText(t *testing.T) {
 	if !addrUnmarshaled.Equals(addrDomain) {
 		t.Errorf("addrDomain.UnmarshalText() returned %s, expected %s.", addrUnmarshaled, addrDomain)
 	}
+
+	err = addrUnmarshaled.UnmarshalText(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrUnmarshaled.IsValid() {
+		t.Errorf("UnmarshalText(nil) returned %s, expected the zero value.", addrUnmarshaled)
+	}
 }
 
 func TestAddrFromDomainPort(t *testing.T) {
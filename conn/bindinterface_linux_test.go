@@ -0,0 +1,50 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenUDPBindInterface(t *testing.T) {
+	lc := ListenerSocketOptions{BindInterface: "lo"}.ListenConfig()
+	uc, _, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("SO_BINDTODEVICE requires CAP_NET_RAW on this kernel")
+		}
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	rawConn, err := uc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if cerr := rawConn.Control(func(fd uintptr) {
+		name, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "lo" {
+		t.Errorf("SO_BINDTODEVICE = %q, want %q", name, "lo")
+	}
+}
+
+func TestDialerBindInterfaceNoSuchDevice(t *testing.T) {
+	d := DialerSocketOptions{BindInterface: "nonexistent0"}.Dialer()
+	c, err := d.DialUDP(context.Background(), "udp4", "127.0.0.1:9")
+	if err == nil {
+		c.Close()
+		t.Fatal("DialUDP succeeded with a nonexistent interface")
+	}
+	if !errors.Is(err, unix.ENODEV) && !errors.Is(err, unix.EPERM) {
+		t.Errorf("DialUDP error = %v, want ENODEV", err)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build darwin || linux || windows
+
+package conn
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSocketControlMessagePktinfoRoundTrip(t *testing.T) {
+	for _, m := range []SocketControlMessage{
+		{PktinfoAddr: netip.MustParseAddr("192.0.2.1"), PktinfoIfindex: 2},
+		{PktinfoAddr: netip.MustParseAddr("2001:db8::1"), PktinfoIfindex: 3},
+	} {
+		b := m.AppendTo(nil)
+		if len(b) > SocketControlMessageBufferSize {
+			t.Errorf("len(m.AppendTo(nil)) = %d, larger than SocketControlMessageBufferSize %d", len(b), SocketControlMessageBufferSize)
+		}
+
+		got, err := ParseSocketControlMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != m {
+			t.Errorf("ParseSocketControlMessage(m.AppendTo(nil)) = %+v, expected %+v", got, m)
+		}
+	}
+}
@@ -55,7 +55,7 @@ func parseSocketControlMessage(cmsg []byte) (m SocketControlMessage, err error)
 
 		switch {
 		case cmsghdr.Level == windows.IPPROTO_IP && cmsghdr.Type == windows.IP_PKTINFO:
-			if len(cmsg) < sizeofCmsghdr+sizeofInet4Pktinfo {
+			if msgLen < sizeofCmsghdr+sizeofInet4Pktinfo {
 				return m, fmt.Errorf("invalid IP_PKTINFO control message length %d", cmsghdr.Len)
 			}
 			var pktinfo Inet4Pktinfo
@@ -64,7 +64,7 @@ func parseSocketControlMessage(cmsg []byte) (m SocketControlMessage, err error)
 			m.PktinfoIfindex = pktinfo.Ifindex
 
 		case cmsghdr.Level == windows.IPPROTO_IPV6 && cmsghdr.Type == windows.IPV6_PKTINFO:
-			if len(cmsg) < sizeofCmsghdr+sizeofInet6Pktinfo {
+			if msgLen < sizeofCmsghdr+sizeofInet6Pktinfo {
 				return m, fmt.Errorf("invalid IPV6_PKTINFO control message length %d", cmsghdr.Len)
 			}
 			var pktinfo Inet6Pktinfo
@@ -73,7 +73,7 @@ func parseSocketControlMessage(cmsg []byte) (m SocketControlMessage, err error)
 			m.PktinfoIfindex = pktinfo.Ifindex
 
 		case cmsghdr.Level == windows.IPPROTO_UDP && cmsghdr.Type == windows.UDP_COALESCED_INFO:
-			if len(cmsg) < sizeofCmsghdr+sizeofCoalescedInfo {
+			if msgLen < sizeofCmsghdr+sizeofCoalescedInfo {
 				return m, fmt.Errorf("invalid UDP_COALESCED_INFO control message length %d", cmsghdr.Len)
 			}
 			_ = copy(unsafe.Slice((*byte)(unsafe.Pointer(&m.SegmentSize)), sizeofCoalescedInfo), cmsg[sizeofCmsghdr:])
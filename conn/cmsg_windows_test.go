@@ -0,0 +1,61 @@
+package conn
+
+import (
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"github.com/database64128/shadowsocks-go/slicehelper"
+	"golang.org/x/sys/windows"
+)
+
+func appendTestCmsg(b []byte, level, typ int32, data []byte) []byte {
+	var msgBuf []byte
+	b, msgBuf = slicehelper.Extend(b, sizeofCmsghdr+cmsgAlign(len(data)))
+	*(*Cmsghdr)(unsafe.Pointer(unsafe.SliceData(msgBuf))) = Cmsghdr{
+		Len:   uintptr(sizeofCmsghdr + len(data)),
+		Level: level,
+		Type:  typ,
+	}
+	_ = copy(msgBuf[sizeofCmsghdr:], data)
+	return b
+}
+
+func TestParseSocketControlMessageReceived(t *testing.T) {
+	// IPv4 packet received on a dual-stack socket with URO enabled.
+	pktinfo := Inet4Pktinfo{Addr: [4]byte{192, 0, 2, 1}, Ifindex: 7}
+	segmentSize := uint32(1200)
+	cmsg := appendTestCmsg(nil, windows.IPPROTO_IP, windows.IP_PKTINFO, unsafe.Slice((*byte)(unsafe.Pointer(&pktinfo)), sizeofInet4Pktinfo))
+	cmsg = appendTestCmsg(cmsg, windows.IPPROTO_UDP, windows.UDP_COALESCED_INFO, unsafe.Slice((*byte)(unsafe.Pointer(&segmentSize)), sizeofCoalescedInfo))
+	if len(cmsg) > SocketControlMessageBufferSize {
+		t.Errorf("len(cmsg) = %d, larger than SocketControlMessageBufferSize %d", len(cmsg), SocketControlMessageBufferSize)
+	}
+
+	m, err := ParseSocketControlMessage(cmsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SocketControlMessage{
+		PktinfoAddr:    netip.MustParseAddr("192.0.2.1"),
+		PktinfoIfindex: 7,
+		SegmentSize:    1200,
+	}
+	if m != want {
+		t.Errorf("ParseSocketControlMessage(cmsg) = %+v, expected %+v", m, want)
+	}
+
+	// The reply only carries pktinfo, so that it is sent from the address the packet was received on.
+	m.SegmentSize = 0
+	if got, err := ParseSocketControlMessage(m.AppendTo(nil)); err != nil || got != m {
+		t.Errorf("ParseSocketControlMessage(m.AppendTo(nil)) = %+v, %v, expected %+v, nil", got, err, m)
+	}
+}
+
+func TestParseSocketControlMessageShort(t *testing.T) {
+	// An IPV6_PKTINFO message too short for its payload, followed by enough bytes to cover it.
+	cmsg := appendTestCmsg(nil, windows.IPPROTO_IPV6, windows.IPV6_PKTINFO, make([]byte, 4))
+	cmsg = appendTestCmsg(cmsg, windows.IPPROTO_UDP, windows.UDP_COALESCED_INFO, make([]byte, sizeofCoalescedInfo))
+	if _, err := ParseSocketControlMessage(cmsg); err == nil {
+		t.Error("ParseSocketControlMessage succeeded on a truncated IPV6_PKTINFO message, expected error")
+	}
+}
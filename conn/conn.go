@@ -3,6 +3,7 @@ package conn
 import (
 	"context"
 	"net"
+	"net/netip"
 	"syscall"
 
 	"github.com/database64128/tfo-go/v2"
@@ -68,6 +69,52 @@ func (fns setFuncSlice) controlFunc(info *SocketInfo) func(network, address stri
 type ListenConfig struct {
 	tlc tfo.ListenConfig
 	fns setFuncSlice
+
+	// sourceAddrs, if not nil, is the pool of source addresses for [ListenConfig.WithSourceAddrFor].
+	sourceAddrs *SourceAddrPool
+
+	// sourceAddr, if valid, is the local address of UDP sockets opened without an address.
+	sourceAddr netip.Addr
+}
+
+// WithSourceAddrPool returns a copy of lc that selects the local address of UDP sockets from sourceAddrs
+// when [ListenConfig.WithSourceAddrFor] is called.
+func (lc ListenConfig) WithSourceAddrPool(sourceAddrs *SourceAddrPool) ListenConfig {
+	lc.sourceAddrs = sourceAddrs
+	return lc
+}
+
+// HasSourceAddrPool returns whether lc has a source address pool.
+func (lc *ListenConfig) HasSourceAddrPool() bool {
+	return lc.sourceAddrs != nil
+}
+
+// WithSourceAddrFor returns a copy of lc that binds UDP sockets opened without an address
+// to a source address selected for peer from the source address pool.
+//
+// If lc has no source address pool, or the pool has no addresses for peer, lc is returned as is.
+func (lc ListenConfig) WithSourceAddrFor(ctx context.Context, peer netip.Addr) ListenConfig {
+	if lc.sourceAddrs == nil {
+		return lc
+	}
+	if src, ok := lc.sourceAddrs.Select(ctx, peer); ok {
+		lc.sourceAddr = src
+	}
+	return lc
+}
+
+// udpNetworkAddress returns the network and address to open a UDP socket on,
+// with the source address applied if address is empty.
+func (lc *ListenConfig) udpNetworkAddress(network, address string) (string, string) {
+	if address != "" || !lc.sourceAddr.IsValid() {
+		return network, address
+	}
+	if lc.sourceAddr.Is4() {
+		network = "udp4"
+	} else {
+		network = "udp6"
+	}
+	return network, netip.AddrPortFrom(lc.sourceAddr, 0).String()
 }
 
 // ListenTCP wraps [tfo.ListenConfig.Listen] and returns a [*net.TCPListener] directly.
@@ -82,10 +129,14 @@ func (lc *ListenConfig) ListenTCP(ctx context.Context, network, address string)
 }
 
 // ListenUDP wraps [net.ListenConfig.ListenPacket] and returns a [*net.UDPConn] directly.
+//
+// If address is empty and a source address was selected by [ListenConfig.WithSourceAddrFor],
+// the socket is bound to the source address instead.
 func (lc *ListenConfig) ListenUDP(ctx context.Context, network, address string) (uc *net.UDPConn, info SocketInfo, err error) {
 	info.MaxUDPGSOSegments = 1
 	nlc := lc.tlc.ListenConfig
 	nlc.Control = lc.fns.controlFunc(&info)
+	network, address = lc.udpNetworkAddress(network, address)
 	pc, err := nlc.ListenPacket(ctx, network, address)
 	if err != nil {
 		return nil, info, err
@@ -110,6 +161,12 @@ type ListenerSocketOptions struct {
 	// Available on Linux and FreeBSD.
 	Fwmark int
 
+	// BindInterface binds the listener to the network interface with the given name,
+	// so that it only sends and receives packets through that interface.
+	//
+	// Available on Linux.
+	BindInterface string
+
 	// TrafficClass sets the traffic class of the listener.
 	//
 	// Available on most platforms except Windows.
@@ -133,14 +190,34 @@ type ListenerSocketOptions struct {
 	// Available on Linux.
 	TCPUserTimeoutMsecs int
 
+	// TCPUrgentInline sets SO_OOBINLINE on the listener,
+	// so that TCP urgent data is received in the normal data stream.
+	//
+	// Available on Linux.
+	TCPUrgentInline bool
+
 	// ReusePort enables SO_REUSEPORT on the listener.
 	//
 	// Available on Linux and the BSDs.
 	ReusePort bool
 
+	// SetIncomingCPU sets SO_INCOMING_CPU on the listener to IncomingCPU.
+	//
+	// With SO_REUSEPORT, the kernel prefers the socket whose incoming CPU matches
+	// the CPU that processed the packet, instead of hashing the 4-tuple.
+	//
+	// Available on Linux.
+	SetIncomingCPU bool
+
+	// IncomingCPU is the CPU to set SO_INCOMING_CPU to when SetIncomingCPU is true.
+	IncomingCPU int
+
 	// Transparent enables transparent proxy on the listener.
 	//
-	// Only available on Linux.
+	// On Linux, this sets IP_TRANSPARENT/IPV6_TRANSPARENT.
+	// On FreeBSD, this sets IP_BINDANY/IPV6_BINDANY.
+	//
+	// Available on Linux and FreeBSD.
 	Transparent bool
 
 	// PathMTUDiscovery enables Path MTU Discovery on the listener.
@@ -190,8 +267,15 @@ type ListenerSocketOptions struct {
 
 	// ReceiveOriginalDestAddr enables the reception of original destination address control messages on the listener.
 	//
-	// Only available on Linux.
+	// Available on Linux and FreeBSD.
 	ReceiveOriginalDestAddr bool
+
+	// ReceiveErrors enables IP_RECVERR and IPV6_RECVERR on the UDP listener,
+	// so that ICMP errors, like fragmentation needed, are queued on the socket,
+	// and can be read with [ReadPathMTU].
+	//
+	// Available on Linux.
+	ReceiveErrors bool
 }
 
 // ListenConfig returns a [ListenConfig] that sets the socket options.
@@ -246,20 +330,92 @@ var (
 )
 
 // Dialer is [tfo.Dialer] but provides a subjectively nicer API.
-type Dialer tfo.Dialer
+type Dialer struct {
+	tfo.Dialer
+
+	// sourceAddrs, if not nil, selects the local address of each connection.
+	sourceAddrs *SourceAddrPool
+}
+
+// WithSourceAddrPool returns a copy of the dialer that selects the local address
+// of each connection from sourceAddrs.
+func (d Dialer) WithSourceAddrPool(sourceAddrs *SourceAddrPool) Dialer {
+	d.sourceAddrs = sourceAddrs
+	return d
+}
 
 // DialTCP wraps [tfo.Dialer.DialContext] and returns a [*net.TCPConn] directly.
+//
+// When network is "tcp" and the host is a domain name, connection attempts to its IPv6 and IPv4 addresses
+// are raced with RFC 8305 Happy Eyeballs, unless FallbackDelay is negative.
+//
+// When TFO is enabled and b is not empty, a destination that appears to drop SYN data
+// is dialed again without TFO, and TFO stays disabled for it for a while.
 func (d *Dialer) DialTCP(ctx context.Context, network, address string, b []byte) (*net.TCPConn, error) {
-	c, err := (*tfo.Dialer)(d).DialContext(ctx, network, address, b)
-	if err != nil {
-		return nil, err
+	var peer netip.Addr
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if peer, err = netip.ParseAddr(host); err != nil && network == "tcp" && d.FallbackDelay >= 0 {
+			return d.dialTCPHappyEyeballs(ctx, host, port, b, true)
+		}
+	}
+
+	if !peer.IsValid() {
+		switch network {
+		case "tcp4":
+			peer = netip.IPv4Unspecified()
+		case "tcp6":
+			peer = netip.IPv6Unspecified()
+		}
+	}
+
+	return d.dialTFO(ctx, network, address, peer, b)
+}
+
+// DialTCPWithIPFamilyPolicy is like [Dialer.DialTCP], but connects to a domain name host
+// with addresses chosen by policy.
+//
+// The IPv4-only and IPv6-only policies restrict network to "tcp4" and "tcp6" respectively.
+// The prefer policies start Happy Eyeballs with the preferred address family,
+// or dial the preferred address if Happy Eyeballs is disabled.
+func (d *Dialer) DialTCPWithIPFamilyPolicy(ctx context.Context, network, address string, b []byte, policy IPFamilyPolicy) (*net.TCPConn, error) {
+	network = policy.TCPNetwork(network)
+
+	if policy == IPFamilyPolicyPreferIPv4 || policy == IPFamilyPolicyPreferIPv6 {
+		if host, port, err := net.SplitHostPort(address); err == nil && network == "tcp" {
+			if _, err = netip.ParseAddr(host); err != nil {
+				if d.FallbackDelay >= 0 {
+					return d.dialTCPHappyEyeballs(ctx, host, port, b, policy == IPFamilyPolicyPreferIPv6)
+				}
+				ip, err := policy.ResolveIP(ctx, "ip", host)
+				if err != nil {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+				}
+				address = net.JoinHostPort(ip.Unmap().String(), port)
+			}
+		}
 	}
-	return c.(*net.TCPConn), nil
+
+	return d.DialTCP(ctx, network, address, b)
+}
+
+// tfoDialer returns the [tfo.Dialer] for a connection to peer, with the local address selected from the source address pool.
+// If peer is not valid, the address family is chosen by the pool.
+func (d *Dialer) tfoDialer(ctx context.Context, peer netip.Addr) *tfo.Dialer {
+	if d.sourceAddrs == nil {
+		return &d.Dialer
+	}
+	src, ok := d.sourceAddrs.Select(ctx, peer)
+	if !ok {
+		return &d.Dialer
+	}
+	td := d.Dialer
+	td.LocalAddr = &net.TCPAddr{IP: src.AsSlice()}
+	return &td
 }
 
 // DialUDP wraps [net.Dialer.DialContext] and returns a [*net.UDPConn] directly.
 func (d *Dialer) DialUDP(ctx context.Context, network, address string) (*net.UDPConn, error) {
-	c, err := d.Dialer.DialContext(ctx, network, address)
+	c, err := d.Dialer.Dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -273,6 +429,12 @@ type DialerSocketOptions struct {
 	// Available on Linux and FreeBSD.
 	Fwmark int
 
+	// BindInterface binds the dialer's sockets to the network interface with the given name,
+	// so that connections go through that interface regardless of the routing table.
+	//
+	// Available on Linux.
+	BindInterface string
+
 	// TrafficClass sets the traffic class of the dialer.
 	//
 	// Available on most platforms except Windows.
@@ -306,11 +468,13 @@ type DialerSocketOptions struct {
 // Dialer returns a [Dialer] with a control function that sets the socket options.
 func (dso DialerSocketOptions) Dialer() Dialer {
 	d := Dialer{
-		Dialer: net.Dialer{
-			ControlContext: dso.buildSetFns().controlContextFunc(nil),
+		Dialer: tfo.Dialer{
+			Dialer: net.Dialer{
+				ControlContext: dso.buildSetFns().controlContextFunc(nil),
+			},
+			DisableTFO: !dso.TCPFastOpen,
+			Fallback:   dso.TCPFastOpenFallback,
 		},
-		DisableTFO: !dso.TCPFastOpen,
-		Fallback:   dso.TCPFastOpenFallback,
 	}
 	d.SetMultipathTCP(dso.MultipathTCP)
 	return d
@@ -4,6 +4,8 @@ package conn
 
 import (
 	"errors"
+	"net"
+	"slices"
 
 	"golang.org/x/sys/unix"
 )
@@ -15,10 +17,8 @@ var (
 
 // ParseFlagsForError parses the message flags returned by
 // the ReadMsgUDPAddrPort method and returns an error if MSG_TRUNC
-// is set, indicating that the returned packet was truncated.
-//
-// The check is skipped on Windows, because an error (WSAEMSGSIZE)
-// is also returned when MSG_PARTIAL is set.
+// is set, indicating that the returned packet was truncated,
+// or if MSG_CTRUNC is set, indicating that the control messages were truncated.
 func ParseFlagsForError(flags int) error {
 	if flags&unix.MSG_TRUNC != 0 {
 		return ErrMessageTruncated
@@ -39,3 +39,30 @@ func (fns setFuncSlice) appendSetTrafficClassFunc(trafficClass int) setFuncSlice
 	}
 	return fns
 }
+
+// WithTrafficClass returns a copy of lc that also sets the traffic class of the socket,
+// overriding the traffic class in the listener socket options.
+func (lc ListenConfig) WithTrafficClass(trafficClass int) ListenConfig {
+	lc.fns = slices.Clip(lc.fns).appendSetTrafficClassFunc(trafficClass)
+	return lc
+}
+
+// SetTCPConnTrafficClass sets the traffic class of the connected socket c.
+func SetTCPConnTrafficClass(c *net.TCPConn, trafficClass int) error {
+	network := "tcp6"
+	if c.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Is4() {
+		network = "tcp4"
+	}
+
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	if cerr := rawConn.Control(func(fd uintptr) {
+		err = setTrafficClass(int(fd), network, trafficClass)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package conn
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	ErrMessageTruncated        = errors.New("the packet is larger than the supplied buffer")
+	ErrControlMessageTruncated = errors.New("the control message is larger than the supplied buffer")
+)
+
+// ParseFlagsForError parses the message flags returned by
+// the ReadMsgUDPAddrPort method and returns an error if MSG_CTRUNC
+// is set, indicating that the control messages were truncated.
+//
+// MSG_TRUNC is not checked, because WSARecvMsg already fails with
+// WSAEMSGSIZE when the packet is truncated.
+func ParseFlagsForError(flags int) error {
+	if flags&windows.MSG_CTRUNC != 0 {
+		return ErrControlMessageTruncated
+	}
+	return nil
+}
@@ -1,11 +1,19 @@
 package conn
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
+// TransparentSocketControlMessageBufferSize specifies the buffer size for receiving IPV6_ORIGDSTADDR socket control messages.
+//
+// Control message data on FreeBSD is aligned to 8 bytes on some architectures, so we align to 8 bytes unconditionally.
+const TransparentSocketControlMessageBufferSize = (unix.SizeofCmsghdr+7)&^7 + (unix.SizeofSockaddrInet6+7)&^7
+
 func setFwmark(fd, fwmark int) error {
 	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_USER_COOKIE, fwmark); err != nil {
 		return fmt.Errorf("failed to set socket option SO_MARK: %w", err)
@@ -13,6 +21,41 @@ func setFwmark(fd, fwmark int) error {
 	return nil
 }
 
+func setTransparent(fd int, network string) error {
+	switch network {
+	case "tcp4", "udp4":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_BINDANY, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IP_BINDANY: %w", err)
+		}
+	case "tcp6", "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_BINDANY, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_BINDANY: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+	return nil
+}
+
+func setRecvOrigDstAddr(fd int, network string) error {
+	switch network {
+	case "udp4":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IP_RECVORIGDSTADDR: %w", err)
+		}
+	case "udp6":
+		// IPv4 packets received by dual-stack sockets carry IPv4 control messages.
+		// Ignore the error, as the socket may be IPv6-only.
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVORIGDSTADDR, 1)
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_RECVORIGDSTADDR: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+	return nil
+}
+
 func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 	return setFuncSlice{}.
 		appendGetIPv6Only().
@@ -21,5 +64,38 @@ func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 		appendSetFwmarkFunc(lso.Fwmark).
 		appendSetTrafficClassFunc(lso.TrafficClass).
 		appendSetReusePortFunc(lso.ReusePort).
-		appendSetPMTUDFunc(lso.PathMTUDiscovery)
+		appendSetTransparentFunc(lso.Transparent).
+		appendSetPMTUDFunc(lso.PathMTUDiscovery).
+		appendSetRecvOrigDstAddrFunc(lso.ReceiveOriginalDestAddr)
+}
+
+func (dso DialerSocketOptions) buildSetFns() setFuncSlice {
+	return setFuncSlice{}.
+		appendSetFwmarkFunc(dso.Fwmark).
+		appendSetTrafficClassFunc(dso.TrafficClass)
+}
+
+var errNoOrigDstAddrCmsg = errors.New("no original destination address control message")
+
+// ParseOrigDstAddrCmsg parses the original destination address from the
+// IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message in cmsg.
+func ParseOrigDstAddrCmsg(cmsg []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(cmsg)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.IPPROTO_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= unix.SizeofSockaddrInet4:
+			sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(unsafe.SliceData(msg.Data)))
+			return SockaddrInet4ToAddrPort(sa), nil
+
+		case msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= unix.SizeofSockaddrInet6:
+			sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(unsafe.SliceData(msg.Data)))
+			return SockaddrInet6ToAddrPort(sa), nil
+		}
+	}
+
+	return netip.AddrPort{}, errNoOrigDstAddrCmsg
 }
@@ -11,8 +11,20 @@ func (fns setFuncSlice) appendSetFwmarkFunc(fwmark int) setFuncSlice {
 	return fns
 }
 
-func (dso DialerSocketOptions) buildSetFns() setFuncSlice {
-	return setFuncSlice{}.
-		appendSetFwmarkFunc(dso.Fwmark).
-		appendSetTrafficClassFunc(dso.TrafficClass)
+func (fns setFuncSlice) appendSetTransparentFunc(transparent bool) setFuncSlice {
+	if transparent {
+		return append(fns, func(fd int, network string, _ *SocketInfo) error {
+			return setTransparent(fd, network)
+		})
+	}
+	return fns
+}
+
+func (fns setFuncSlice) appendSetRecvOrigDstAddrFunc(recvOrigDstAddr bool) setFuncSlice {
+	if recvOrigDstAddr {
+		return append(fns, func(fd int, network string, _ *SocketInfo) error {
+			return setRecvOrigDstAddr(fd, network)
+		})
+	}
+	return fns
 }
@@ -34,6 +34,13 @@ func setFwmark(fd, fwmark int) error {
 	return nil
 }
 
+func setBindInterface(fd int, name string) error {
+	if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, name); err != nil {
+		return fmt.Errorf("failed to set socket option SO_BINDTODEVICE: %w", err)
+	}
+	return nil
+}
+
 func setTrafficClass(fd int, network string, trafficClass int) error {
 	// Set IP_TOS for both v4 and v6.
 	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, trafficClass); err != nil {
@@ -152,37 +159,28 @@ func setRecvOrigDstAddr(fd int, network string) error {
 	return nil
 }
 
-func (fns setFuncSlice) appendSetTCPDeferAcceptFunc(deferAcceptSecs int) setFuncSlice {
-	if deferAcceptSecs > 0 {
+func (fns setFuncSlice) appendSetBindInterfaceFunc(name string) setFuncSlice {
+	if name != "" {
 		return append(fns, func(fd int, network string, _ *SocketInfo) error {
-			return setTCPDeferAccept(fd, deferAcceptSecs)
+			return setBindInterface(fd, name)
 		})
 	}
 	return fns
 }
 
-func (fns setFuncSlice) appendSetTCPUserTimeoutFunc(userTimeoutMsecs int) setFuncSlice {
-	if userTimeoutMsecs > 0 {
-		return append(fns, func(fd int, network string, _ *SocketInfo) error {
-			return setTCPUserTimeout(fd, userTimeoutMsecs)
-		})
-	}
-	return fns
-}
-
-func (fns setFuncSlice) appendSetTransparentFunc(transparent bool) setFuncSlice {
-	if transparent {
+func (fns setFuncSlice) appendSetTCPDeferAcceptFunc(deferAcceptSecs int) setFuncSlice {
+	if deferAcceptSecs > 0 {
 		return append(fns, func(fd int, network string, _ *SocketInfo) error {
-			return setTransparent(fd, network)
+			return setTCPDeferAccept(fd, deferAcceptSecs)
 		})
 	}
 	return fns
 }
 
-func (fns setFuncSlice) appendSetRecvOrigDstAddrFunc(recvOrigDstAddr bool) setFuncSlice {
-	if recvOrigDstAddr {
+func (fns setFuncSlice) appendSetTCPUserTimeoutFunc(userTimeoutMsecs int) setFuncSlice {
+	if userTimeoutMsecs > 0 {
 		return append(fns, func(fd int, network string, _ *SocketInfo) error {
-			return setRecvOrigDstAddr(fd, network)
+			return setTCPUserTimeout(fd, userTimeoutMsecs)
 		})
 	}
 	return fns
@@ -194,16 +192,27 @@ func (lso ListenerSocketOptions) buildSetFns() setFuncSlice {
 		appendSetSendBufferSize(lso.SendBufferSize).
 		appendSetRecvBufferSize(lso.ReceiveBufferSize).
 		appendSetFwmarkFunc(lso.Fwmark).
+		appendSetBindInterfaceFunc(lso.BindInterface).
 		appendSetTrafficClassFunc(lso.TrafficClass).
 		appendSetTCPDeferAcceptFunc(lso.TCPDeferAcceptSecs).
 		appendSetTCPUserTimeoutFunc(lso.TCPUserTimeoutMsecs).
+		appendSetTCPUrgentInlineFunc(lso.TCPUrgentInline).
 		appendSetReusePortFunc(lso.ReusePort).
+		appendSetIncomingCPUFunc(lso.SetIncomingCPU, lso.IncomingCPU).
 		appendSetTransparentFunc(lso.Transparent).
 		appendSetPMTUDFunc(lso.PathMTUDiscovery).
 		appendProbeUDPGSOSupportFunc(lso.ProbeUDPGSOSupport).
 		appendSetUDPGenericReceiveOffloadFunc(lso.UDPGenericReceiveOffload).
 		appendSetRecvPktinfoFunc(lso.ReceivePacketInfo).
-		appendSetRecvOrigDstAddrFunc(lso.ReceiveOriginalDestAddr)
+		appendSetRecvOrigDstAddrFunc(lso.ReceiveOriginalDestAddr).
+		appendSetRecvErrFunc(lso.ReceiveErrors)
+}
+
+func (dso DialerSocketOptions) buildSetFns() setFuncSlice {
+	return setFuncSlice{}.
+		appendSetFwmarkFunc(dso.Fwmark).
+		appendSetBindInterfaceFunc(dso.BindInterface).
+		appendSetTrafficClassFunc(dso.TrafficClass)
 }
 
 func ParseOrigDstAddrCmsg(cmsg []byte) (netip.AddrPort, error) {
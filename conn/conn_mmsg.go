@@ -13,6 +13,7 @@ func (lc *ListenConfig) ListenUDPMmsgConn(ctx context.Context, network, address
 	info.MaxUDPGSOSegments = 1
 	nlc := lc.tlc.ListenConfig
 	nlc.Control = lc.fns.controlFunc(&info)
+	network, address = lc.udpNetworkAddress(network, address)
 	pc, err := nlc.ListenPacket(ctx, network, address)
 	if err != nil {
 		return MmsgConn{}, info, err
@@ -1,4 +1,4 @@
-//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !zos
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows && !zos
 
 package conn
 
@@ -6,8 +6,7 @@ package conn
 // the ReadMsgUDPAddrPort method and returns an error if MSG_TRUNC
 // is set, indicating that the returned packet was truncated.
 //
-// The check is skipped on Windows, because an error (WSAEMSGSIZE)
-// is also returned when MSG_PARTIAL is set.
+// The check is skipped on this platform.
 func ParseFlagsForError(flags int) error {
 	return nil
 }
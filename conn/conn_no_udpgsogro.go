@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package conn
+
+func (fns setFuncSlice) appendProbeUDPGSOSupportFunc(_ bool) setFuncSlice {
+	return fns
+}
+
+func (fns setFuncSlice) appendSetUDPGenericReceiveOffloadFunc(_ bool) setFuncSlice {
+	return fns
+}
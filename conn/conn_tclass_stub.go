@@ -0,0 +1,15 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !zos
+
+package conn
+
+import "net"
+
+// WithTrafficClass returns lc as is, because setting the traffic class is not supported on this platform.
+func (lc ListenConfig) WithTrafficClass(trafficClass int) ListenConfig {
+	return lc
+}
+
+// SetTCPConnTrafficClass does nothing, because setting the traffic class is not supported on this platform.
+func SetTCPConnTrafficClass(c *net.TCPConn, trafficClass int) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+package conn
+
+import "context"
+
+type targetAddrContextKey struct{}
+
+// NewTargetAddrContext returns a copy of ctx with the target address of the relayed connection or session.
+func NewTargetAddrContext(ctx context.Context, targetAddr Addr) context.Context {
+	return context.WithValue(ctx, targetAddrContextKey{}, targetAddr)
+}
+
+// TargetAddrFromContext returns the target address stored in ctx by [NewTargetAddrContext].
+func TargetAddrFromContext(ctx context.Context) (Addr, bool) {
+	targetAddr, ok := ctx.Value(targetAddrContextKey{}).(Addr)
+	return targetAddr, ok
+}
+
+type usernameContextKey struct{}
+
+// NewUsernameContext returns a copy of ctx with the username of the relayed connection or session.
+func NewUsernameContext(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameContextKey{}, username)
+}
+
+// UsernameFromContext returns the username stored in ctx by [NewUsernameContext],
+// or an empty string if there is none.
+func UsernameFromContext(ctx context.Context) string {
+	username, _ := ctx.Value(usernameContextKey{}).(string)
+	return username
+}
+
+type ipFamilyPolicyContextKey struct{}
+
+// NewIPFamilyPolicyContext returns a copy of ctx with the IP family policy for resolving the target address.
+func NewIPFamilyPolicyContext(ctx context.Context, policy IPFamilyPolicy) context.Context {
+	return context.WithValue(ctx, ipFamilyPolicyContextKey{}, policy)
+}
+
+// IPFamilyPolicyFromContext returns the IP family policy stored in ctx by [NewIPFamilyPolicyContext],
+// or [IPFamilyPolicyDefault] if there is none.
+func IPFamilyPolicyFromContext(ctx context.Context) IPFamilyPolicy {
+	policy, _ := ctx.Value(ipFamilyPolicyContextKey{}).(IPFamilyPolicy)
+	return policy
+}
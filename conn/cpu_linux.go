@@ -0,0 +1,40 @@
+package conn
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+func setIncomingCPU(fd, cpu int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU, cpu); err != nil {
+		return fmt.Errorf("failed to set socket option SO_INCOMING_CPU: %w", err)
+	}
+	return nil
+}
+
+func (fns setFuncSlice) appendSetIncomingCPUFunc(set bool, cpu int) setFuncSlice {
+	if set {
+		return append(fns, func(fd int, network string, _ *SocketInfo) error {
+			return setIncomingCPU(fd, cpu)
+		})
+	}
+	return fns
+}
+
+// PinThreadToCPU locks the calling goroutine to its current OS thread,
+// and restricts the thread to run only on the given CPU.
+//
+// The goroutine must not unlock the thread. When the goroutine exits,
+// the thread is terminated instead of running other goroutines with the affinity.
+func PinThreadToCPU(cpu int) error {
+	runtime.LockOSThread()
+
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return fmt.Errorf("failed to set CPU affinity to CPU %d: %w", cpu, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package conn
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// firstAllowedCPU returns the first CPU the test process is allowed to run on.
+func firstAllowedCPU(t *testing.T) int {
+	t.Helper()
+
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		t.Fatal(err)
+	}
+	for cpu := range 1024 {
+		if set.IsSet(cpu) {
+			return cpu
+		}
+	}
+	t.Fatal("no allowed CPU")
+	return 0
+}
+
+func TestListenUDPIncomingCPU(t *testing.T) {
+	cpu := firstAllowedCPU(t)
+
+	lc := ListenerSocketOptions{
+		ReusePort:      true,
+		SetIncomingCPU: true,
+		IncomingCPU:    cpu,
+	}.ListenConfig()
+
+	uc, _, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	rawConn, err := uc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got int
+	if cerr := rawConn.Control(func(fd uintptr) {
+		got, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_INCOMING_CPU)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != cpu {
+		t.Errorf("SO_INCOMING_CPU = %d, expected %d", got, cpu)
+	}
+}
+
+func TestPinThreadToCPU(t *testing.T) {
+	cpu := firstAllowedCPU(t)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if err := PinThreadToCPU(cpu); err != nil {
+			t.Error(err)
+			return
+		}
+
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			t.Error(err)
+			return
+		}
+		if set.Count() != 1 || !set.IsSet(cpu) {
+			t.Errorf("CPU affinity has %d CPUs, expected only CPU %d", set.Count(), cpu)
+		}
+	}()
+
+	<-done
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package conn
+
+import "errors"
+
+// PinThreadToCPU always returns an error on this platform.
+func PinThreadToCPU(cpu int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,15 @@
+package conn
+
+import "fmt"
+
+// MaxDSCP is the maximum value of a Differentiated Services Code Point.
+const MaxDSCP = 63
+
+// TrafficClassFromDSCP returns the traffic class (IP_TOS or IPV6_TCLASS) that marks packets with dscp.
+// The ECN bits are left as zero.
+func TrafficClassFromDSCP(dscp int) (int, error) {
+	if dscp < 0 || dscp > MaxDSCP {
+		return 0, fmt.Errorf("DSCP out of range [0, %d]: %d", MaxDSCP, dscp)
+	}
+	return dscp << 2, nil
+}
@@ -0,0 +1,62 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func getsockoptTOS(t *testing.T, c syscall.Conn) int {
+	t.Helper()
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tos int
+	if cerr := rawConn.Control(func(fd uintptr) {
+		tos, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tos
+}
+
+func TestListenConfigWithTrafficClass(t *testing.T) {
+	lc := ListenerSocketOptions{TrafficClass: 0x20}.ListenConfig().WithTrafficClass(0xb8)
+	uc, _, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	if tos := getsockoptTOS(t, uc); tos != 0xb8 {
+		t.Errorf("IP_TOS = %#x, want %#x", tos, 0xb8)
+	}
+}
+
+func TestSetTCPConnTrafficClass(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := net.DialTCP("tcp4", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = SetTCPConnTrafficClass(c, 0x28); err != nil {
+		t.Fatal(err)
+	}
+	if tos := getsockoptTOS(t, c); tos != 0x28 {
+		t.Errorf("IP_TOS = %#x, want %#x", tos, 0x28)
+	}
+}
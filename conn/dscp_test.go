@@ -0,0 +1,29 @@
+package conn
+
+import "testing"
+
+func TestTrafficClassFromDSCP(t *testing.T) {
+	for _, c := range []struct {
+		dscp int
+		want int
+	}{
+		{0, 0},
+		{10, 0x28}, // AF11
+		{46, 0xb8}, // EF
+		{MaxDSCP, 0xfc},
+	} {
+		got, err := TrafficClassFromDSCP(c.dscp)
+		if err != nil {
+			t.Fatalf("TrafficClassFromDSCP(%d) failed: %v", c.dscp, err)
+		}
+		if got != c.want {
+			t.Errorf("TrafficClassFromDSCP(%d) = %#x, want %#x", c.dscp, got, c.want)
+		}
+	}
+
+	for _, dscp := range []int{-1, MaxDSCP + 1} {
+		if _, err := TrafficClassFromDSCP(dscp); err == nil {
+			t.Errorf("TrafficClassFromDSCP(%d) succeeded", dscp)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// IPFamilyPolicy controls the address family of IP addresses resolved from domain names.
+type IPFamilyPolicy string
+
+const (
+	// IPFamilyPolicyDefault follows the network of the caller, which is usually the client's network.
+	IPFamilyPolicyDefault IPFamilyPolicy = ""
+
+	// IPFamilyPolicyPreferIPv4 prefers IPv4 addresses, and falls back to IPv6 addresses.
+	IPFamilyPolicyPreferIPv4 IPFamilyPolicy = "preferIPv4"
+
+	// IPFamilyPolicyPreferIPv6 prefers IPv6 addresses, and falls back to IPv4 addresses.
+	IPFamilyPolicyPreferIPv6 IPFamilyPolicy = "preferIPv6"
+
+	// IPFamilyPolicyIPv4Only only uses IPv4 addresses.
+	IPFamilyPolicyIPv4Only IPFamilyPolicy = "ipv4Only"
+
+	// IPFamilyPolicyIPv6Only only uses IPv6 addresses.
+	IPFamilyPolicyIPv6Only IPFamilyPolicy = "ipv6Only"
+)
+
+// Validate returns an error if the policy is unknown.
+func (p IPFamilyPolicy) Validate() error {
+	switch p {
+	case IPFamilyPolicyDefault, IPFamilyPolicyPreferIPv4, IPFamilyPolicyPreferIPv6, IPFamilyPolicyIPv4Only, IPFamilyPolicyIPv6Only:
+		return nil
+	default:
+		return fmt.Errorf("unknown IP family policy: %q", p)
+	}
+}
+
+// IPNetwork returns the network for resolving domain names by the policy,
+// which is network, "ip4" or "ip6". The network must be one of "ip", "ip4" or "ip6".
+//
+// The IPv4-only and IPv6-only policies override network. The prefer policies do not.
+func (p IPFamilyPolicy) IPNetwork(network string) string {
+	switch p {
+	case IPFamilyPolicyIPv4Only:
+		return "ip4"
+	case IPFamilyPolicyIPv6Only:
+		return "ip6"
+	default:
+		return network
+	}
+}
+
+// TCPNetwork is like IPNetwork, but for TCP networks "tcp", "tcp4" and "tcp6".
+func (p IPFamilyPolicy) TCPNetwork(network string) string {
+	switch p {
+	case IPFamilyPolicyIPv4Only:
+		return "tcp4"
+	case IPFamilyPolicyIPv6Only:
+		return "tcp6"
+	default:
+		return network
+	}
+}
+
+// ResolveIP is like [ResolveIP], but resolves host by the policy.
+func (p IPFamilyPolicy) ResolveIP(ctx context.Context, network, host string) (netip.Addr, error) {
+	network = p.IPNetwork(network)
+
+	var prefer4 bool
+	switch p {
+	case IPFamilyPolicyPreferIPv4:
+		prefer4 = true
+	case IPFamilyPolicyPreferIPv6:
+	default:
+		return ResolveIP(ctx, network, host)
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, ip := range ips {
+		if ip.Unmap().Is4() == prefer4 {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// ResolveAddr is like [Addr.ResolveIP], but resolves domain names by the policy.
+func (p IPFamilyPolicy) ResolveAddr(ctx context.Context, network string, addr Addr) (netip.Addr, error) {
+	if addr.IsIP() {
+		return addr.IP(), nil
+	}
+	return p.ResolveIP(ctx, network, addr.Domain())
+}
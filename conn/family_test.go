@@ -0,0 +1,114 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIPFamilyPolicyValidate(t *testing.T) {
+	for _, p := range []IPFamilyPolicy{
+		IPFamilyPolicyDefault,
+		IPFamilyPolicyPreferIPv4,
+		IPFamilyPolicyPreferIPv6,
+		IPFamilyPolicyIPv4Only,
+		IPFamilyPolicyIPv6Only,
+	} {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%q.Validate() = %v, want nil", p, err)
+		}
+	}
+	if err := IPFamilyPolicy("ipv5Only").Validate(); err == nil {
+		t.Error("Validate() succeeded on unknown policy, expected error")
+	}
+}
+
+func TestIPFamilyPolicyNetwork(t *testing.T) {
+	for _, c := range []struct {
+		policy     IPFamilyPolicy
+		network    string
+		wantIP     string
+		wantTCP    string
+		tcpNetwork string
+	}{
+		{IPFamilyPolicyDefault, "ip", "ip", "tcp", "tcp"},
+		{IPFamilyPolicyDefault, "ip6", "ip6", "tcp6", "tcp6"},
+		{IPFamilyPolicyPreferIPv4, "ip", "ip", "tcp", "tcp"},
+		{IPFamilyPolicyPreferIPv6, "ip4", "ip4", "tcp4", "tcp4"},
+		{IPFamilyPolicyIPv4Only, "ip", "ip4", "tcp4", "tcp"},
+		{IPFamilyPolicyIPv4Only, "ip6", "ip4", "tcp4", "tcp6"},
+		{IPFamilyPolicyIPv6Only, "ip", "ip6", "tcp6", "tcp"},
+	} {
+		if got := c.policy.IPNetwork(c.network); got != c.wantIP {
+			t.Errorf("%q.IPNetwork(%q) = %q, want %q", c.policy, c.network, got, c.wantIP)
+		}
+		if got := c.policy.TCPNetwork(c.tcpNetwork); got != c.wantTCP {
+			t.Errorf("%q.TCPNetwork(%q) = %q, want %q", c.policy, c.tcpNetwork, got, c.wantTCP)
+		}
+	}
+}
+
+func TestIPFamilyPolicyResolveIP(t *testing.T) {
+	ctx := context.Background()
+
+	for _, p := range []IPFamilyPolicy{IPFamilyPolicyDefault, IPFamilyPolicyPreferIPv6, IPFamilyPolicyIPv4Only} {
+		ip, err := p.ResolveIP(ctx, "ip", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("%q.ResolveIP failed: %v", p, err)
+		}
+		if want := netip.MustParseAddr("127.0.0.1"); ip.Unmap() != want {
+			t.Errorf("%q.ResolveIP = %v, want %v", p, ip, want)
+		}
+	}
+
+	if _, err := IPFamilyPolicyIPv6Only.ResolveIP(ctx, "ip", "127.0.0.1"); err == nil {
+		t.Error("ipv6Only ResolveIP succeeded on an IPv4 address, expected error")
+	}
+}
+
+func TestIPFamilyPolicyContext(t *testing.T) {
+	ctx := context.Background()
+	if p := IPFamilyPolicyFromContext(ctx); p != IPFamilyPolicyDefault {
+		t.Errorf("IPFamilyPolicyFromContext = %q, want default", p)
+	}
+	ctx = NewIPFamilyPolicyContext(ctx, IPFamilyPolicyIPv6Only)
+	if p := IPFamilyPolicyFromContext(ctx); p != IPFamilyPolicyIPv6Only {
+		t.Errorf("IPFamilyPolicyFromContext = %q, want %q", p, IPFamilyPolicyIPv6Only)
+	}
+}
+
+func TestDialTCPWithIPFamilyPolicy(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx := context.Background()
+	d := DialerSocketOptions{}.Dialer()
+	address := ln.Addr().String()
+
+	for _, p := range []IPFamilyPolicy{IPFamilyPolicyDefault, IPFamilyPolicyPreferIPv4, IPFamilyPolicyPreferIPv6, IPFamilyPolicyIPv4Only} {
+		c, err := d.DialTCPWithIPFamilyPolicy(ctx, "tcp", address, nil, p)
+		if err != nil {
+			t.Fatalf("DialTCPWithIPFamilyPolicy(%q) failed: %v", p, err)
+		}
+		c.Close()
+	}
+
+	if c, err := d.DialTCPWithIPFamilyPolicy(ctx, "tcp", address, nil, IPFamilyPolicyIPv6Only); err == nil {
+		c.Close()
+		t.Error("DialTCPWithIPFamilyPolicy(ipv6Only) succeeded on an IPv4 address, expected error")
+	}
+}
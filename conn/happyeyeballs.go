@@ -0,0 +1,236 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// happyEyeballsResolutionDelay is how long to wait for AAAA records after A records arrive,
+	// as recommended by RFC 8305 Section 3.
+	happyEyeballsResolutionDelay = 50 * time.Millisecond
+
+	// happyEyeballsConnectionAttemptDelay is how long to wait for a connection attempt
+	// before starting the next one, as recommended by RFC 8305 Section 5.
+	happyEyeballsConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+var errNoAddresses = errors.New("no addresses to dial")
+
+// dialTCPHappyEyeballs dials the domain name host with RFC 8305 Happy Eyeballs,
+// preferring IPv6 addresses if prefer6 is true, or IPv4 addresses otherwise.
+//
+// When TFO is enabled, each connection attempt carries b in its SYN, like [tfo.Dialer] does.
+// Otherwise b is only written to the established connection.
+func (d *Dialer) dialTCPHappyEyeballs(ctx context.Context, host, port string, b []byte, prefer6 bool) (*net.TCPConn, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	attemptPayload := b
+	if d.DisableTFO {
+		attemptPayload = nil
+	}
+
+	c, err := dialHappyEyeballs(ctx, prefer6,
+		func(ctx context.Context, network string) ([]netip.Addr, error) {
+			return resolver.LookupNetIP(ctx, network, host)
+		},
+		func(ctx context.Context, ip netip.Addr) (*net.TCPConn, error) {
+			network := "tcp6"
+			if ip.Is4() || ip.Is4In6() {
+				network = "tcp4"
+			}
+			return d.dialTFO(ctx, network, net.JoinHostPort(ip.Unmap().String(), port), ip, attemptPayload)
+		},
+	)
+	if err != nil {
+		if _, ok := err.(*net.OpError); !ok {
+			err = &net.OpError{Op: "dial", Net: "tcp", Err: err}
+		}
+		return nil, err
+	}
+
+	if d.DisableTFO && len(b) > 0 {
+		if _, err = c.Write(b); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// lookupResult is the result of resolving the domain name for one address family.
+type lookupResult struct {
+	is6 bool
+	ips []netip.Addr
+	err error
+}
+
+// dialResult is the result of a connection attempt.
+type dialResult struct {
+	c   *net.TCPConn
+	err error
+}
+
+// dialHappyEyeballs resolves IPv6 and IPv4 addresses with lookup in parallel, and races connection attempts
+// to the resolved addresses with dial, as described in RFC 8305.
+//
+// The preferred address family is IPv6 if prefer6 is true, or IPv4 otherwise.
+// Connection attempts start once records of the preferred family arrive,
+// or [happyEyeballsResolutionDelay] after records of the other family arrive.
+// Addresses are tried alternating between address families, starting with the preferred family.
+// A new attempt starts when the previous attempt fails, or after [happyEyeballsConnectionAttemptDelay].
+// The first established connection is returned, and the other attempts are canceled.
+// If all attempts fail, the first connection error is returned, or the first lookup error if no attempts were made.
+func dialHappyEyeballs(
+	ctx context.Context,
+	prefer6 bool,
+	lookup func(ctx context.Context, network string) ([]netip.Addr, error),
+	dial func(ctx context.Context, ip netip.Addr) (*net.TCPConn, error),
+) (*net.TCPConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lookupCh := make(chan lookupResult, 2)
+	for _, is6 := range [2]bool{true, false} {
+		go func() {
+			network := "ip4"
+			if is6 {
+				network = "ip6"
+			}
+			ips, err := lookup(ctx, network)
+			lookupCh <- lookupResult{is6: is6, ips: ips, err: err}
+		}()
+	}
+
+	var (
+		ip6s, ip4s  []netip.Addr
+		next6       = prefer6
+		lookupsLeft = 2
+		lookupErr   error
+		dialErr     error
+	)
+
+	addLookupResult := func(r lookupResult) {
+		lookupsLeft--
+		switch {
+		case r.err != nil:
+			if lookupErr == nil {
+				lookupErr = r.err
+			}
+		case r.is6:
+			ip6s = append(ip6s, r.ips...)
+		default:
+			ip4s = append(ip4s, r.ips...)
+		}
+	}
+
+	// Wait for the first lookup, and give records of the preferred family a head start.
+	select {
+	case r := <-lookupCh:
+		addLookupResult(r)
+		if r.is6 != prefer6 {
+			timer := time.NewTimer(happyEyeballsResolutionDelay)
+			select {
+			case r := <-lookupCh:
+				addLookupResult(r)
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// Attempts that lose the race may still finish after we return. Close their connections.
+	done := make(chan struct{})
+	defer close(done)
+	dialCh := make(chan dialResult)
+
+	var (
+		pending    int
+		attemptDue bool
+	)
+
+	attemptTimer := time.NewTimer(happyEyeballsConnectionAttemptDelay)
+	defer attemptTimer.Stop()
+
+	// startAttempt starts a connection attempt to the next address, alternating between address families.
+	// It returns false if there are no addresses left to try.
+	startAttempt := func() bool {
+		var ip netip.Addr
+		switch {
+		case len(ip6s) > 0 && (next6 || len(ip4s) == 0):
+			ip, ip6s = ip6s[0], ip6s[1:]
+			next6 = false
+		case len(ip4s) > 0:
+			ip, ip4s = ip4s[0], ip4s[1:]
+			next6 = true
+		default:
+			return false
+		}
+
+		pending++
+		attemptDue = false
+		attemptTimer.Reset(happyEyeballsConnectionAttemptDelay)
+
+		go func() {
+			c, err := dial(ctx, ip)
+			select {
+			case dialCh <- dialResult{c, err}:
+			case <-done:
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+		return true
+	}
+
+	startAttempt()
+
+	for {
+		if pending == 0 && len(ip6s) == 0 && len(ip4s) == 0 && lookupsLeft == 0 {
+			switch {
+			case dialErr != nil:
+				return nil, dialErr
+			case lookupErr != nil:
+				return nil, lookupErr
+			default:
+				return nil, errNoAddresses
+			}
+		}
+
+		select {
+		case r := <-lookupCh:
+			addLookupResult(r)
+			if pending == 0 || attemptDue {
+				startAttempt()
+			}
+
+		case r := <-dialCh:
+			pending--
+			if r.err == nil {
+				return r.c, nil
+			}
+			if dialErr == nil {
+				dialErr = r.err
+			}
+			startAttempt()
+
+		case <-attemptTimer.C:
+			if !startAttempt() {
+				attemptDue = true
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testHappyEyeballsIPv6 = netip.MustParseAddr("2001:db8::1")
+	testHappyEyeballsIPv4 = netip.MustParseAddr("192.0.2.1")
+)
+
+// happyEyeballsTest fakes DNS lookups and connection attempts for dialHappyEyeballs.
+type happyEyeballsTest struct {
+	t        *testing.T
+	ln       *net.TCPListener
+	mu       sync.Mutex
+	attempts []netip.Addr
+
+	// lookupDelay6 and lookupDelay4 delay the AAAA and A lookups.
+	lookupDelay6, lookupDelay4 time.Duration
+
+	// preferIPv4 makes IPv4 the preferred address family.
+	preferIPv4 bool
+
+	// broken is the set of addresses whose connection attempts hang until canceled.
+	broken map[netip.Addr]bool
+
+	// refused is the set of addresses whose connection attempts fail immediately.
+	refused map[netip.Addr]bool
+}
+
+func newHappyEyeballsTest(t *testing.T) *happyEyeballsTest {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &happyEyeballsTest{
+		t:       t,
+		ln:      ln,
+		broken:  make(map[netip.Addr]bool),
+		refused: make(map[netip.Addr]bool),
+	}
+}
+
+func (h *happyEyeballsTest) lookup(ctx context.Context, network string) ([]netip.Addr, error) {
+	ip, delay := testHappyEyeballsIPv4, h.lookupDelay4
+	if network == "ip6" {
+		ip, delay = testHappyEyeballsIPv6, h.lookupDelay6
+	}
+	select {
+	case <-time.After(delay):
+		return []netip.Addr{ip}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial connects to the local listener in place of ip, unless ip is broken or refused.
+func (h *happyEyeballsTest) dial(ctx context.Context, ip netip.Addr) (*net.TCPConn, error) {
+	h.mu.Lock()
+	h.attempts = append(h.attempts, ip)
+	h.mu.Unlock()
+
+	switch {
+	case h.broken[ip]:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case h.refused[ip]:
+		return nil, errors.New("connection refused")
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp4", h.ln.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.TCPConn), nil
+}
+
+func (h *happyEyeballsTest) run() (*net.TCPConn, time.Duration, error) {
+	start := time.Now()
+	c, err := dialHappyEyeballs(context.Background(), !h.preferIPv4, h.lookup, h.dial)
+	return c, time.Since(start), err
+}
+
+func (h *happyEyeballsTest) checkAttempts(want ...netip.Addr) {
+	h.t.Helper()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.attempts) != len(want) {
+		h.t.Fatalf("attempts = %v, want %v", h.attempts, want)
+	}
+	for i := range want {
+		if h.attempts[i] != want[i] {
+			h.t.Fatalf("attempts = %v, want %v", h.attempts, want)
+		}
+	}
+}
+
+func TestDialHappyEyeballsPrefersIPv6(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.lookupDelay4 = 0
+	h.lookupDelay6 = happyEyeballsResolutionDelay / 5
+
+	c, _, err := h.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	h.checkAttempts(testHappyEyeballsIPv6)
+}
+
+func TestDialHappyEyeballsPrefersIPv4(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.preferIPv4 = true
+	h.lookupDelay4 = happyEyeballsResolutionDelay / 5
+	h.lookupDelay6 = 0
+
+	c, _, err := h.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	h.checkAttempts(testHappyEyeballsIPv4)
+}
+
+func TestDialHappyEyeballsRefusedIPv4Preferred(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.preferIPv4 = true
+	h.refused[testHappyEyeballsIPv4] = true
+
+	c, _, err := h.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	h.checkAttempts(testHappyEyeballsIPv4, testHappyEyeballsIPv6)
+}
+
+func TestDialHappyEyeballsBrokenIPv6(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.broken[testHappyEyeballsIPv6] = true
+
+	c, elapsed, err := h.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	h.checkAttempts(testHappyEyeballsIPv6, testHappyEyeballsIPv4)
+	if elapsed < happyEyeballsConnectionAttemptDelay {
+		t.Errorf("elapsed = %v, want at least %v", elapsed, happyEyeballsConnectionAttemptDelay)
+	}
+}
+
+func TestDialHappyEyeballsRefusedIPv6(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.refused[testHappyEyeballsIPv6] = true
+
+	c, elapsed, err := h.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	h.checkAttempts(testHappyEyeballsIPv6, testHappyEyeballsIPv4)
+	if elapsed >= happyEyeballsConnectionAttemptDelay {
+		t.Errorf("elapsed = %v, want less than %v", elapsed, happyEyeballsConnectionAttemptDelay)
+	}
+}
+
+func TestDialHappyEyeballsSlowAAAA(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.lookupDelay6 = time.Second
+
+	c, elapsed, err := h.run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	h.checkAttempts(testHappyEyeballsIPv4)
+	if elapsed >= h.lookupDelay6 {
+		t.Errorf("elapsed = %v, want less than %v", elapsed, h.lookupDelay6)
+	}
+}
+
+func TestDialHappyEyeballsAllFail(t *testing.T) {
+	h := newHappyEyeballsTest(t)
+	h.refused[testHappyEyeballsIPv6] = true
+	h.refused[testHappyEyeballsIPv4] = true
+
+	if _, _, err := h.run(); err == nil || err.Error() != "connection refused" {
+		t.Errorf("err = %v, want connection refused", err)
+	}
+	h.checkAttempts(testHappyEyeballsIPv6, testHappyEyeballsIPv4)
+}
+
+func TestDialTCPHappyEyeballsLocalhost(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan []byte, 1)
+	go func() {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 5)
+		n, _ := c.Read(b)
+		accepted <- b[:n]
+	}()
+
+	d := DialerSocketOptions{}.Dialer()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	c, err := d.DialTCP(context.Background(), "tcp", net.JoinHostPort("localhost", port), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if b := <-accepted; string(b) != "hello" {
+		t.Errorf("received %q, want %q", b, "hello")
+	}
+}
@@ -0,0 +1,116 @@
+package conn
+
+import (
+	"fmt"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func setRecvErr(fd int, network string) error {
+	// Set IP_RECVERR for both v4 and v6.
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1); err != nil {
+		return fmt.Errorf("failed to set socket option IP_RECVERR: %w", err)
+	}
+
+	switch network {
+	case "udp4":
+	case "udp6":
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1); err != nil {
+			return fmt.Errorf("failed to set socket option IPV6_RECVERR: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+
+	return nil
+}
+
+func (fns setFuncSlice) appendSetRecvErrFunc(recvErr bool) setFuncSlice {
+	if recvErr {
+		return append(fns, func(fd int, network string, _ *SocketInfo) error {
+			return setRecvErr(fd, network)
+		})
+	}
+	return fns
+}
+
+// sockExtendedErrCmsgSpace is the buffer size for receiving one IP_RECVERR or IPV6_RECVERR control message,
+// which contains a sock_extended_err followed by the offender's socket address.
+var sockExtendedErrCmsgSpace = unix.CmsgSpace(int(unsafe.Sizeof(unix.SockExtendedErr{})) + unix.SizeofSockaddrInet6)
+
+// ReadPathMTU reads all errors queued on the UDP socket's error queue, and returns the smallest path MTU
+// reported by "message too long" errors, or 0 if none of them reported a path MTU.
+// The number of errors read is returned in n.
+//
+// Errors are only queued when the socket has [ListenerSocketOptions.ReceiveErrors] enabled.
+// Such errors include locally generated ones for packets exceeding the known path MTU,
+// ICMP fragmentation needed and ICMPv6 packet too big messages, and other ICMP errors like port unreachable.
+// Once an ICMP error is queued, the next read from the socket fails with its error,
+// so callers should call this function after a read fails, to keep the error queue from growing.
+//
+// Available on Linux. On other platforms, it always returns 0.
+func ReadPathMTU(rawConn syscall.RawConn) (mtu, n int, err error) {
+	var (
+		buf [1]byte
+		oob = make([]byte, sockExtendedErrCmsgSpace)
+	)
+
+	// Use Control instead of Read, which would wait for a concurrent blocking read to finish.
+	if cerr := rawConn.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, _, rerr := unix.Recvmsg(int(fd), buf[:], oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if rerr != nil {
+				if rerr != unix.EAGAIN {
+					err = fmt.Errorf("failed to read error queue: %w", rerr)
+				}
+				return
+			}
+			n++
+
+			if m := parsePathMTUCmsg(oob[:oobn]); m > 0 && (mtu == 0 || m < mtu) {
+				mtu = m
+			}
+		}
+	}); cerr != nil {
+		return mtu, n, cerr
+	}
+
+	return mtu, n, err
+}
+
+// parsePathMTUCmsg returns the path MTU reported by an EMSGSIZE extended error in the control messages,
+// or 0 if there is none.
+func parsePathMTUCmsg(cmsg []byte) int {
+	for len(cmsg) >= unix.SizeofCmsghdr {
+		cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+		msgLen := int(cmsghdr.Len)
+		msgSize := unix.CmsgSpace(msgLen - unix.SizeofCmsghdr)
+		if msgLen < unix.SizeofCmsghdr || msgLen > len(cmsg) {
+			return 0
+		}
+
+		if (cmsghdr.Level == unix.IPPROTO_IP && cmsghdr.Type == unix.IP_RECVERR ||
+			cmsghdr.Level == unix.IPPROTO_IPV6 && cmsghdr.Type == unix.IPV6_RECVERR) &&
+			msgLen >= unix.SizeofCmsghdr+int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&cmsg[unix.SizeofCmsghdr]))
+			if syscall.Errno(ee.Errno) == unix.EMSGSIZE {
+				return int(ee.Info)
+			}
+		}
+
+		if msgSize > len(cmsg) {
+			return 0
+		}
+		cmsg = cmsg[msgSize:]
+	}
+	return 0
+}
+
+// WithReceiveErrors returns a copy of lc that enables [ListenerSocketOptions.ReceiveErrors] on UDP sockets.
+func (lc ListenConfig) WithReceiveErrors() ListenConfig {
+	lc.fns = slices.Clip(lc.fns).appendSetRecvErrFunc(true)
+	return lc
+}
@@ -0,0 +1,104 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadPathMTUPortUnreachable(t *testing.T) {
+	lc := ListenerSocketOptions{
+		PathMTUDiscovery: true,
+		ReceiveErrors:    true,
+	}.ListenConfig()
+
+	uc, _, err := lc.ListenUDP(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	// Find a closed port by opening and closing a socket.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddrPort := closed.LocalAddr().(*net.UDPAddr).AddrPort()
+	closed.Close()
+
+	if _, err = uc.WriteToUDPAddrPort([]byte("hello"), closedAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued ICMP error fails the next read.
+	if err = uc.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	if _, _, err = uc.ReadFromUDPAddrPort(b); !errors.Is(err, unix.ECONNREFUSED) {
+		t.Fatalf("ReadFromUDPAddrPort() error = %v, expected ECONNREFUSED", err)
+	}
+
+	rawConn, err := uc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtu, n, err := ReadPathMTU(rawConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != 0 || n != 1 {
+		t.Errorf("ReadPathMTU() = %d, %d, expected 0, 1", mtu, n)
+	}
+
+	mtu, n, err = ReadPathMTU(rawConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != 0 || n != 0 {
+		t.Errorf("ReadPathMTU() on empty queue = %d, %d, expected 0, 0", mtu, n)
+	}
+}
+
+func TestParsePathMTUCmsg(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		level   int32
+		typ     int32
+		errno   unix.Errno
+		info    uint32
+		wantMTU int
+	}{
+		{"IPv4FragNeeded", unix.IPPROTO_IP, unix.IP_RECVERR, unix.EMSGSIZE, 1400, 1400},
+		{"IPv6PacketTooBig", unix.IPPROTO_IPV6, unix.IPV6_RECVERR, unix.EMSGSIZE, 1280, 1280},
+		{"PortUnreachable", unix.IPPROTO_IP, unix.IP_RECVERR, unix.ECONNREFUSED, 0, 0},
+		{"OtherCmsg", unix.IPPROTO_IP, unix.IP_PKTINFO, unix.EMSGSIZE, 1400, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			eeLen := int(unsafe.Sizeof(unix.SockExtendedErr{}))
+			cmsg := make([]byte, unix.CmsgSpace(eeLen))
+			cmsghdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+			cmsghdr.Level = c.level
+			cmsghdr.Type = c.typ
+			cmsghdr.SetLen(unix.CmsgLen(eeLen))
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&cmsg[unix.SizeofCmsghdr]))
+			ee.Errno = uint32(c.errno)
+			ee.Origin = unix.SO_EE_ORIGIN_ICMP
+			ee.Info = c.info
+
+			if mtu := parsePathMTUCmsg(cmsg); mtu != c.wantMTU {
+				t.Errorf("parsePathMTUCmsg() = %d, expected %d", mtu, c.wantMTU)
+			}
+		})
+	}
+
+	if mtu := parsePathMTUCmsg([]byte{1, 2, 3}); mtu != 0 {
+		t.Errorf("parsePathMTUCmsg() on short message = %d, expected 0", mtu)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package conn
+
+import "syscall"
+
+// WithReceiveErrors returns lc as is, because the error queue is not supported on this platform.
+func (lc ListenConfig) WithReceiveErrors() ListenConfig {
+	return lc
+}
+
+// ReadPathMTU always returns 0 on this platform.
+func ReadPathMTU(rawConn syscall.RawConn) (mtu, n int, err error) {
+	return 0, 0, nil
+}
@@ -0,0 +1,460 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// eBPF helper function IDs from include/uapi/linux/bpf.h.
+const (
+	bpfFuncGetSocketCookie = 46
+	bpfFuncSkRedirectHash  = 72
+)
+
+// skDrop is SK_DROP from include/uapi/linux/bpf.h.
+const skDrop = 0
+
+// bpfInsn is struct bpf_insn from include/uapi/linux/bpf.h.
+type bpfInsn struct {
+	Code uint8
+	Regs uint8
+	Off  int16
+	Imm  int32
+}
+
+// newBPFInsn returns an instruction with the register bit fields laid out in native byte order.
+func newBPFInsn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	regs := dst | src<<4
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		regs = dst<<4 | src
+	}
+	return bpfInsn{Code: code, Regs: regs, Off: off, Imm: imm}
+}
+
+// sockmapVerdictProgram returns the stream verdict program for the sockhash mapFD.
+//
+// The program looks up the peer of the receiving socket by the socket's cookie,
+// and redirects the received data to the peer's egress:
+//
+//	if (skb->len == 0)
+//		return SK_DROP;
+//	__u64 cookie = bpf_get_socket_cookie(skb);
+//	return bpf_sk_redirect_hash(skb, &sockhash, &cookie, 0);
+//
+// The FIN is passed to the program as an empty skb. Redirecting it would fail to send,
+// which breaks the peer's pipe, so it is dropped. The FIN has been processed by then.
+//
+// Data received by a socket without a peer is dropped.
+func sockmapVerdictProgram(mapFD int) []bpfInsn {
+	return []bpfInsn{
+		newBPFInsn(unix.BPF_LDX|unix.BPF_MEM|unix.BPF_W, 2, 1, 0, 0),
+		newBPFInsn(unix.BPF_JMP|unix.BPF_JNE|unix.BPF_K, 2, 0, 2, 0),
+		newBPFInsn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_K, 0, 0, 0, skDrop),
+		newBPFInsn(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0),
+		newBPFInsn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, 6, 1, 0, 0),
+		newBPFInsn(unix.BPF_JMP|unix.BPF_CALL, 0, 0, 0, bpfFuncGetSocketCookie),
+		newBPFInsn(unix.BPF_STX|unix.BPF_MEM|unix.BPF_DW, 10, 0, -8, 0),
+		newBPFInsn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, 1, 6, 0, 0),
+		newBPFInsn(unix.BPF_LD|unix.BPF_DW|unix.BPF_IMM, 2, unix.BPF_PSEUDO_MAP_FD, 0, int32(mapFD)),
+		{},
+		newBPFInsn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, 3, 10, 0, 0),
+		newBPFInsn(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 3, 0, 0, -8),
+		newBPFInsn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_K, 4, 0, 0, 0),
+		newBPFInsn(unix.BPF_JMP|unix.BPF_CALL, 0, 0, 0, bpfFuncSkRedirectHash),
+		newBPFInsn(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0),
+	}
+}
+
+// bpfMapCreateAttr is the BPF_MAP_CREATE variant of union bpf_attr.
+type bpfMapCreateAttr struct {
+	MapType    uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	MapFlags   uint32
+}
+
+// bpfMapElemAttr is the BPF_MAP_*_ELEM variant of union bpf_attr.
+type bpfMapElemAttr struct {
+	MapFD uint32
+	_     uint32
+	Key   uint64
+	Value uint64
+	Flags uint64
+}
+
+// bpfProgLoadAttr is the BPF_PROG_LOAD variant of union bpf_attr.
+type bpfProgLoadAttr struct {
+	ProgType    uint32
+	InsnCnt     uint32
+	Insns       uint64
+	License     uint64
+	LogLevel    uint32
+	LogSize     uint32
+	LogBuf      uint64
+	KernVersion uint32
+	ProgFlags   uint32
+}
+
+// bpfProgAttachAttr is the BPF_PROG_ATTACH variant of union bpf_attr.
+type bpfProgAttachAttr struct {
+	TargetFD    uint32
+	AttachBPFFD uint32
+	AttachType  uint32
+	AttachFlags uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// ErrSockmapUnsupported is returned when the kernel does not support sockmap redirection,
+// or the process lacks the privileges to use it.
+var ErrSockmapUnsupported = errors.New("sockmap is not supported by the kernel or not permitted")
+
+// Sockmap redirects data between pairs of TCP sockets in the kernel with an eBPF sockhash
+// and a stream verdict program, so that payload never reaches userspace.
+//
+// Sockmap is safe for concurrent use.
+type Sockmap struct {
+	mapFD  int
+	progFD int
+}
+
+// NewSockmap creates a sockhash for up to size socket pairs, and attaches the verdict program to it.
+func NewSockmap(size int) (*Sockmap, error) {
+	mapAttr := bpfMapCreateAttr{
+		MapType:    unix.BPF_MAP_TYPE_SOCKHASH,
+		KeySize:    8,
+		ValueSize:  4,
+		MaxEntries: uint32(2 * size),
+	}
+	mapFD, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr))
+	if err != nil {
+		if err == unix.EPERM || err == unix.EINVAL || err == unix.ENOSYS {
+			return nil, ErrSockmapUnsupported
+		}
+		return nil, os.NewSyscallError("bpf(BPF_MAP_CREATE)", err)
+	}
+	m := Sockmap{
+		mapFD:  int(mapFD),
+		progFD: -1,
+	}
+
+	insns := sockmapVerdictProgram(m.mapFD)
+	license := []byte("AGPL-3.0\x00")
+	logBuf := make([]byte, 4096)
+	progAttr := bpfProgLoadAttr{
+		ProgType: unix.BPF_PROG_TYPE_SK_SKB,
+		InsnCnt:  uint32(len(insns)),
+		Insns:    uint64(uintptr(unsafe.Pointer(unsafe.SliceData(insns)))),
+		License:  uint64(uintptr(unsafe.Pointer(unsafe.SliceData(license)))),
+		LogLevel: 1,
+		LogSize:  uint32(len(logBuf)),
+		LogBuf:   uint64(uintptr(unsafe.Pointer(unsafe.SliceData(logBuf)))),
+	}
+	progFD, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&progAttr), unsafe.Sizeof(progAttr))
+	if err != nil {
+		m.Close()
+		if err == unix.EPERM {
+			return nil, ErrSockmapUnsupported
+		}
+		return nil, fmt.Errorf("failed to load verdict program: %w: %s", os.NewSyscallError("bpf(BPF_PROG_LOAD)", err), unix.ByteSliceToString(logBuf))
+	}
+	m.progFD = int(progFD)
+
+	attachAttr := bpfProgAttachAttr{
+		TargetFD:    uint32(m.mapFD),
+		AttachBPFFD: uint32(m.progFD),
+		AttachType:  unix.BPF_SK_SKB_STREAM_VERDICT,
+	}
+	if _, err = bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attachAttr), unsafe.Sizeof(attachAttr)); err != nil {
+		m.Close()
+		return nil, os.NewSyscallError("bpf(BPF_PROG_ATTACH)", err)
+	}
+
+	return &m, nil
+}
+
+// SharedSockmap returns the process-wide sockmap, creating it on first use.
+// The sockmap holds up to 65536 socket pairs and lives until the process exits.
+var SharedSockmap = sync.OnceValues(func() (*Sockmap, error) {
+	return NewSockmap(65536)
+})
+
+// Close releases the sockmap's resources. Sockets still in the sockmap are removed from it.
+func (m *Sockmap) Close() error {
+	if m.progFD >= 0 {
+		_ = unix.Close(m.progFD)
+	}
+	return os.NewSyscallError("close", unix.Close(m.mapFD))
+}
+
+func (m *Sockmap) update(cookie uint64, fd int) error {
+	value := uint32(fd)
+	attr := bpfMapElemAttr{
+		MapFD: uint32(m.mapFD),
+		Key:   uint64(uintptr(unsafe.Pointer(&cookie))),
+		Value: uint64(uintptr(unsafe.Pointer(&value))),
+		Flags: unix.BPF_ANY,
+	}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func (m *Sockmap) delete(cookie uint64) {
+	attr := bpfMapElemAttr{
+		MapFD: uint32(m.mapFD),
+		Key:   uint64(uintptr(unsafe.Pointer(&cookie))),
+	}
+	_, _ = bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// sockmapSocket is one side of a [SockmapPair].
+type sockmapSocket struct {
+	conn      *net.TCPConn
+	cookie    uint64
+	fd        int
+	received0 uint64
+	written0  uint64
+}
+
+// tcpCounters returns the number of bytes received, and the number of bytes written to the socket,
+// which includes bytes not yet sent or acknowledged.
+func tcpCounters(fd int) (received, written uint64, err error) {
+	// Read the acknowledged bytes before the send queue length,
+	// so that an ACK in between can only lead to an underestimate.
+	info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return 0, 0, os.NewSyscallError("getsockopt(TCP_INFO)", err)
+	}
+	outq, err := unix.IoctlGetInt(fd, unix.SIOCOUTQ)
+	if err != nil {
+		return 0, 0, os.NewSyscallError("ioctl(SIOCOUTQ)", err)
+	}
+	return info.Bytes_received, info.Bytes_acked + uint64(outq), nil
+}
+
+// consumedTCPCounters is like tcpCounters, but excludes bytes in the receive queue from the received count.
+// It must not be called when the receive queue is being consumed.
+func consumedTCPCounters(fd int) (received, written uint64, err error) {
+	// Nothing consumes the receive queue, so an unchanged queue length means no data arrived in between.
+	for {
+		inq, err := unix.IoctlGetInt(fd, unix.SIOCINQ)
+		if err != nil {
+			return 0, 0, os.NewSyscallError("ioctl(SIOCINQ)", err)
+		}
+		if received, written, err = tcpCounters(fd); err != nil {
+			return 0, 0, err
+		}
+		inq2, err := unix.IoctlGetInt(fd, unix.SIOCINQ)
+		if err != nil {
+			return 0, 0, os.NewSyscallError("ioctl(SIOCINQ)", err)
+		}
+		if inq == inq2 {
+			return received - uint64(inq), written, nil
+		}
+	}
+}
+
+// SockmapPair is a pair of TCP connections whose payload is redirected to each other by a [Sockmap].
+type SockmapPair struct {
+	m           *Sockmap
+	left, right sockmapSocket
+}
+
+// Attach adds left and right to the sockmap, so that data received by one is sent by the other.
+// Both connections must be established, and must not have any unsent data buffered in userspace.
+//
+// Data already in the receive queues is redirected as well.
+// Call [SockmapPair.Relay] to wait for the relay to finish.
+func (m *Sockmap) Attach(left, right *net.TCPConn) (*SockmapPair, error) {
+	p := SockmapPair{
+		m:     m,
+		left:  sockmapSocket{conn: left},
+		right: sockmapSocket{conn: right},
+	}
+
+	for _, s := range [...]*sockmapSocket{&p.left, &p.right} {
+		rawConn, err := s.conn.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		if cerr := rawConn.Control(func(fd uintptr) {
+			s.fd = int(fd)
+			if s.cookie, err = unix.GetsockoptUint64(s.fd, unix.SOL_SOCKET, unix.SO_COOKIE); err != nil {
+				err = os.NewSyscallError("getsockopt(SO_COOKIE)", err)
+				return
+			}
+			s.received0, s.written0, err = consumedTCPCounters(s.fd)
+		}); cerr != nil {
+			return nil, cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each socket is stored under its peer's cookie,
+	// so that the verdict program finds the peer by the receiving socket's cookie.
+	if err := m.update(p.left.cookie, p.right.fd); err != nil {
+		return nil, os.NewSyscallError("bpf(BPF_MAP_UPDATE_ELEM)", err)
+	}
+	if err := m.update(p.right.cookie, p.left.fd); err != nil {
+		m.delete(p.left.cookie)
+		return nil, os.NewSyscallError("bpf(BPF_MAP_UPDATE_ELEM)", err)
+	}
+
+	// Data received before the sockets were added is not seen by the verdict program until more data arrives.
+	// Setting SO_RCVLOWAT signals readiness, which runs the verdict program on the queued data right away.
+	for _, s := range [...]*sockmapSocket{&p.left, &p.right} {
+		if err := unix.SetsockoptInt(s.fd, unix.SOL_SOCKET, unix.SO_RCVLOWAT, 1); err != nil {
+			p.detach()
+			return nil, os.NewSyscallError("setsockopt(SO_RCVLOWAT)", err)
+		}
+	}
+
+	return &p, nil
+}
+
+func (p *SockmapPair) detach() {
+	p.m.delete(p.left.cookie)
+	p.m.delete(p.right.cookie)
+}
+
+// Relay waits until both directions reach EOF, or an error occurs, such as a deadline being exceeded.
+// On EOF, the write side of the other connection is shut down after all received data is sent to it.
+// It returns the number of bytes sent from left to right, from right to left,
+// and any error occurred during transfer.
+//
+// The connections are removed from the sockmap before Relay returns.
+func (p *SockmapPair) Relay() (nl2r, nr2l int64, err error) {
+	defer p.detach()
+
+	var (
+		wg     sync.WaitGroup
+		l2rErr error
+	)
+
+	wg.Add(1)
+	go func() {
+		nl2r, l2rErr = relaySockmapOneWay(&p.right, &p.left)
+		_ = p.right.conn.CloseWrite()
+		wg.Done()
+	}()
+
+	nr2l, err = relaySockmapOneWay(&p.left, &p.right)
+	_ = p.left.conn.CloseWrite()
+	wg.Wait()
+
+	return nl2r, nr2l, errors.Join(l2rErr, err)
+}
+
+const (
+	sockmapDrainMinInterval = time.Millisecond
+	sockmapDrainMaxInterval = 64 * time.Millisecond
+)
+
+// relaySockmapOneWay waits for EOF on src, and for all data received by src to be written to dst.
+// It returns the number of bytes received by src.
+func relaySockmapOneWay(dst, src *sockmapSocket) (n int64, err error) {
+	// The verdict program redirects all data, so reads only return on EOF or error.
+	// If data does reach userspace, forward it by hand.
+	var buf [512]byte
+	for {
+		nr, rerr := src.conn.Read(buf[:])
+		if nr > 0 {
+			if _, err = dst.conn.Write(buf[:nr]); err != nil {
+				break
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+
+	rawConn, rerr := dst.conn.SyscallConn()
+	if rerr != nil {
+		return 0, errors.Join(err, rerr)
+	}
+
+	// The kernel sends redirected data asynchronously.
+	// Shutting down the write side early would discard data not yet written to dst.
+	var (
+		lastPending uint64
+		interval    = sockmapDrainMinInterval
+	)
+	for {
+		var (
+			received, written uint64
+			state             uint8
+			cerr              error
+		)
+		// Write fails without calling the function if the write deadline has been exceeded,
+		// which is how the relay is interrupted.
+		if werr := rawConn.Write(func(fd uintptr) bool {
+			if received, _, cerr = tcpCounters(src.fd); cerr != nil {
+				return true
+			}
+			if _, written, cerr = tcpCounters(int(fd)); cerr != nil {
+				return true
+			}
+			info, ierr := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+			if ierr != nil {
+				cerr = os.NewSyscallError("getsockopt(TCP_INFO)", ierr)
+				return true
+			}
+			state = info.State
+			return true
+		}); werr != nil {
+			return n, errors.Join(err, werr)
+		}
+		if cerr != nil {
+			return n, errors.Join(err, cerr)
+		}
+
+		received -= src.received0
+		if err != nil {
+			return int64(received), err
+		}
+		// The FIN takes up one sequence number.
+		received--
+		written -= dst.written0
+		n = int64(received)
+		if written >= received {
+			return n, nil
+		}
+
+		pending := received - written
+		switch state {
+		case unix.BPF_TCP_ESTABLISHED, unix.BPF_TCP_CLOSE_WAIT:
+		default:
+			return n, fmt.Errorf("connection closed with %d bytes not relayed", pending)
+		}
+
+		// Poll quickly again while data is moving, and back off while dst is not accepting more.
+		if pending < lastPending {
+			interval = sockmapDrainMinInterval
+		} else {
+			interval = min(interval*2, sockmapDrainMaxInterval)
+		}
+		lastPending = pending
+		time.Sleep(interval)
+	}
+}
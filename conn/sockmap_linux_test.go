@@ -0,0 +1,154 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newSockmapForTest(t *testing.T) *Sockmap {
+	t.Helper()
+	m, err := NewSockmap(16)
+	if err != nil {
+		if errors.Is(err, ErrSockmapUnsupported) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return m
+}
+
+// tcpConnPair returns both ends of a loopback TCP connection.
+func tcpConnPair(t *testing.T) (dialed, accepted *net.TCPConn) {
+	t.Helper()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed, err = net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialed.Close() })
+
+	accepted, err = ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accepted.Close() })
+	return dialed, accepted
+}
+
+func TestSockmapRelay(t *testing.T) {
+	m := newSockmapForTest(t)
+
+	// client <-> left | relay | right <-> server
+	client, left := tcpConnPair(t)
+	right, server := tcpConnPair(t)
+
+	// Data sent before attaching is relayed as well.
+	early := []byte("early bird")
+	if _, err := client.Write(early); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	p, err := m.Attach(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		nl2r, nr2l int64
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		nl2r, nr2l, err := p.Relay()
+		done <- result{nl2r, nr2l, err}
+	}()
+
+	uplink := make([]byte, 1<<20)
+	downlink := make([]byte, 1<<19)
+	rand.Read(uplink)
+	rand.Read(downlink)
+
+	go func() {
+		_, _ = client.Write(uplink)
+		_ = client.CloseWrite()
+	}()
+	go func() {
+		_, _ = server.Write(downlink)
+		_ = server.CloseWrite()
+	}()
+
+	gotUplink, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("server ReadAll failed: %v", err)
+	}
+	if want := append(early, uplink...); !bytes.Equal(gotUplink, want) {
+		t.Errorf("server received %d bytes, want %d bytes", len(gotUplink), len(want))
+	}
+
+	gotDownlink, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(gotDownlink, downlink) {
+		t.Errorf("client received %d bytes, want %d bytes", len(gotDownlink), len(downlink))
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Relay failed: %v", r.err)
+	}
+	if want := int64(len(early) + len(uplink)); r.nl2r != want {
+		t.Errorf("nl2r = %d, want %d", r.nl2r, want)
+	}
+	if want := int64(len(downlink)); r.nr2l != want {
+		t.Errorf("nr2l = %d, want %d", r.nr2l, want)
+	}
+}
+
+func TestSockmapRelayInterrupt(t *testing.T) {
+	m := newSockmapForTest(t)
+
+	_, left := tcpConnPair(t)
+	right, _ := tcpConnPair(t)
+
+	p, err := m.Attach(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := p.Relay()
+		done <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	_ = left.SetDeadline(ALongTimeAgo)
+	_ = right.SetDeadline(ALongTimeAgo)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Relay() = %v, want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not return after deadline")
+	}
+}
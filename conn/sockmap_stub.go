@@ -0,0 +1,44 @@
+//go:build !linux
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrSockmapUnsupported is returned when the kernel does not support sockmap redirection,
+// or the process lacks the privileges to use it.
+var ErrSockmapUnsupported = errors.New("sockmap is only supported on Linux")
+
+// Sockmap redirects data between pairs of TCP sockets in the kernel. It is not available on this platform.
+type Sockmap struct{}
+
+// NewSockmap returns [ErrSockmapUnsupported].
+func NewSockmap(size int) (*Sockmap, error) {
+	return nil, ErrSockmapUnsupported
+}
+
+// SharedSockmap returns [ErrSockmapUnsupported].
+func SharedSockmap() (*Sockmap, error) {
+	return nil, ErrSockmapUnsupported
+}
+
+// Close is a no-op.
+func (m *Sockmap) Close() error {
+	return nil
+}
+
+// Attach returns [ErrSockmapUnsupported].
+func (m *Sockmap) Attach(left, right *net.TCPConn) (*SockmapPair, error) {
+	return nil, ErrSockmapUnsupported
+}
+
+// SockmapPair is a pair of TCP connections redirected to each other by a [Sockmap].
+// It is not available on this platform.
+type SockmapPair struct{}
+
+// Relay returns [ErrSockmapUnsupported].
+func (p *SockmapPair) Relay() (nl2r, nr2l int64, err error) {
+	return 0, 0, ErrSockmapUnsupported
+}
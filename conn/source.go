@@ -0,0 +1,149 @@
+package conn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+)
+
+// SourceAddrPolicy is the policy of a [SourceAddrPool] for selecting source addresses.
+type SourceAddrPolicy string
+
+const (
+	// SourceAddrPolicyRandom selects a random source address for each connection or session.
+	SourceAddrPolicyRandom SourceAddrPolicy = "random"
+
+	// SourceAddrPolicyTarget selects the source address by the target address,
+	// so that connections and sessions to the same target use the same source address.
+	SourceAddrPolicyTarget SourceAddrPolicy = "target"
+
+	// SourceAddrPolicyUser selects the source address by the username,
+	// so that each user has a stable source address.
+	SourceAddrPolicyUser SourceAddrPolicy = "user"
+)
+
+// SourceAddrPool is a pool of local source addresses for outgoing connections and sessions.
+type SourceAddrPool struct {
+	prefixes4 []netip.Prefix
+	prefixes6 []netip.Prefix
+	policy    SourceAddrPolicy
+}
+
+// NewSourceAddrPool returns a new pool of the addresses in prefixes, selected by policy.
+//
+// A prefix can be a single address, like 203.0.113.1/32, or a whole subnet, like 2001:db8::/64.
+// The default policy is [SourceAddrPolicyRandom].
+func NewSourceAddrPool(prefixes []netip.Prefix, policy SourceAddrPolicy) (*SourceAddrPool, error) {
+	if len(prefixes) == 0 {
+		return nil, errors.New("no source prefixes")
+	}
+
+	switch policy {
+	case "":
+		policy = SourceAddrPolicyRandom
+	case SourceAddrPolicyRandom, SourceAddrPolicyTarget, SourceAddrPolicyUser:
+	default:
+		return nil, fmt.Errorf("unknown source address policy: %q", policy)
+	}
+
+	p := SourceAddrPool{
+		policy: policy,
+	}
+
+	for _, prefix := range prefixes {
+		switch addr := prefix.Addr(); {
+		case !prefix.IsValid():
+			return nil, fmt.Errorf("invalid source prefix: %s", prefix)
+		case addr.Is4In6():
+			return nil, fmt.Errorf("IPv4-mapped IPv6 source prefix: %s", prefix)
+		case addr.Is4():
+			p.prefixes4 = append(p.prefixes4, prefix.Masked())
+		default:
+			p.prefixes6 = append(p.prefixes6, prefix.Masked())
+		}
+	}
+
+	return &p, nil
+}
+
+// Policy returns the policy of the pool.
+func (p *SourceAddrPool) Policy() SourceAddrPolicy {
+	return p.policy
+}
+
+// Select returns a source address for a connection or session to peer, and whether an address is selected.
+//
+// Only the address family of peer matters. If peer is not valid, IPv6 addresses are preferred.
+// No address is selected if the pool has no addresses of the peer's address family.
+//
+// The target address and the username are taken from ctx, as stored by [NewTargetAddrContext]
+// and [NewUsernameContext]. If the one required by the policy is not in ctx, a random address is selected.
+func (p *SourceAddrPool) Select(ctx context.Context, peer netip.Addr) (netip.Addr, bool) {
+	prefixes := p.prefixes6
+	if peer.Is4() || peer.Is4In6() || !peer.IsValid() && len(prefixes) == 0 {
+		prefixes = p.prefixes4
+	}
+	if len(prefixes) == 0 {
+		return netip.Addr{}, false
+	}
+
+	// The first 8 bytes select the prefix, and the remaining 16 bytes fill the host bits.
+	var seed [24]byte
+	if key := p.key(ctx); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		copy(seed[:], sum[:])
+	} else {
+		binary.LittleEndian.PutUint64(seed[:8], rand.Uint64())
+		binary.LittleEndian.PutUint64(seed[8:16], rand.Uint64())
+		binary.LittleEndian.PutUint64(seed[16:], rand.Uint64())
+	}
+
+	prefix := prefixes[binary.BigEndian.Uint64(seed[:8])%uint64(len(prefixes))]
+	return addrInPrefix(prefix, seed[8:]), true
+}
+
+// key returns the selection key in ctx for the policy, or an empty string if addresses are selected randomly.
+func (p *SourceAddrPool) key(ctx context.Context) string {
+	switch p.policy {
+	case SourceAddrPolicyTarget:
+		if targetAddr, ok := TargetAddrFromContext(ctx); ok && targetAddr.IsValid() {
+			return targetAddr.String()
+		}
+	case SourceAddrPolicyUser:
+		return UsernameFromContext(ctx)
+	}
+	return ""
+}
+
+// addrInPrefix returns the address in prefix whose host bits are taken from hostBits.
+// hostBits must be at least as long as the address.
+func addrInPrefix(prefix netip.Prefix, hostBits []byte) netip.Addr {
+	if prefix.Addr().Is4() {
+		b := prefix.Addr().As4()
+		fillHostBits(b[:], prefix.Bits(), hostBits)
+		return netip.AddrFrom4(b)
+	}
+	b := prefix.Addr().As16()
+	fillHostBits(b[:], prefix.Bits(), hostBits)
+	return netip.AddrFrom16(b)
+}
+
+// fillHostBits copies the bits after the first prefixLen bits of hostBits into b.
+func fillHostBits(b []byte, prefixLen int, hostBits []byte) {
+	for i := range b {
+		switch {
+		case prefixLen >= 8:
+			prefixLen -= 8
+		case prefixLen > 0:
+			mask := byte(0xff) >> prefixLen
+			b[i] = b[i]&^mask | hostBits[i]&mask
+			prefixLen = 0
+		default:
+			b[i] = hostBits[i]
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+var (
+	testSourcePrefix6 = netip.MustParsePrefix("2001:db8:1234::/64")
+	testSourcePrefix4 = netip.MustParsePrefix("203.0.113.0/30")
+	testSourcePeer6   = netip.MustParseAddr("2001:db8::1")
+	testSourcePeer4   = netip.MustParseAddr("192.0.2.1")
+)
+
+func TestNewSourceAddrPoolErrors(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		prefixes []netip.Prefix
+		policy   SourceAddrPolicy
+	}{
+		{"NoPrefixes", nil, ""},
+		{"InvalidPrefix", []netip.Prefix{{}}, ""},
+		{"MappedPrefix", []netip.Prefix{netip.MustParsePrefix("::ffff:203.0.113.0/120")}, ""},
+		{"UnknownPolicy", []netip.Prefix{testSourcePrefix6}, "round-robin"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewSourceAddrPool(c.prefixes, c.policy); err == nil {
+				t.Error("NewSourceAddrPool succeeded, expected error")
+			}
+		})
+	}
+}
+
+func TestSourceAddrPoolSelectFamily(t *testing.T) {
+	p, err := NewSourceAddrPool([]netip.Prefix{testSourcePrefix6, testSourcePrefix4}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy := p.Policy(); policy != SourceAddrPolicyRandom {
+		t.Errorf("p.Policy() = %q, want %q", policy, SourceAddrPolicyRandom)
+	}
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		peer   netip.Addr
+		prefix netip.Prefix
+	}{
+		{testSourcePeer6, testSourcePrefix6},
+		{testSourcePeer4, testSourcePrefix4},
+		{netip.AddrFrom16(testSourcePeer4.As16()), testSourcePrefix4},
+		{netip.Addr{}, testSourcePrefix6},
+	} {
+		for range 64 {
+			src, ok := p.Select(ctx, c.peer)
+			if !ok {
+				t.Fatalf("p.Select(%s) selected no address", c.peer)
+			}
+			if !c.prefix.Contains(src) {
+				t.Fatalf("p.Select(%s) = %s, want address in %s", c.peer, src, c.prefix)
+			}
+		}
+	}
+
+	p6, err := NewSourceAddrPool([]netip.Prefix{testSourcePrefix6}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, ok := p6.Select(ctx, testSourcePeer4); ok {
+		t.Errorf("p6.Select(%s) = %s, want no address", testSourcePeer4, src)
+	}
+}
+
+func TestSourceAddrPoolSelectRandom(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("203.0.113.1/32"),
+		netip.MustParsePrefix("203.0.113.2/32"),
+		netip.MustParsePrefix("203.0.113.3/32"),
+	}
+	p, err := NewSourceAddrPool(prefixes, SourceAddrPolicyRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[netip.Addr]bool)
+	for range 256 {
+		src, ok := p.Select(context.Background(), testSourcePeer4)
+		if !ok {
+			t.Fatal("p.Select selected no address")
+		}
+		seen[src] = true
+	}
+	for _, prefix := range prefixes {
+		if !seen[prefix.Addr()] {
+			t.Errorf("%s was never selected", prefix.Addr())
+		}
+	}
+}
+
+func TestSourceAddrPoolSelectByKey(t *testing.T) {
+	for _, c := range []struct {
+		policy SourceAddrPolicy
+		newCtx func(i int) context.Context
+	}{
+		{
+			policy: SourceAddrPolicyTarget,
+			newCtx: func(i int) context.Context {
+				return NewTargetAddrContext(context.Background(), AddrFromIPPort(netip.AddrPortFrom(testSourcePeer6, uint16(443+i))))
+			},
+		},
+		{
+			policy: SourceAddrPolicyUser,
+			newCtx: func(i int) context.Context {
+				return NewUsernameContext(context.Background(), string(rune('a'+i)))
+			},
+		},
+	} {
+		t.Run(string(c.policy), func(t *testing.T) {
+			p, err := NewSourceAddrPool([]netip.Prefix{testSourcePrefix6}, c.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src0, _ := p.Select(c.newCtx(0), testSourcePeer6)
+			if src, _ := p.Select(c.newCtx(0), testSourcePeer6); src != src0 {
+				t.Errorf("same key selected %s and %s, want the same address", src0, src)
+			}
+			if src1, _ := p.Select(c.newCtx(1), testSourcePeer6); src1 == src0 {
+				t.Errorf("different keys selected the same address %s", src0)
+			}
+			if !testSourcePrefix6.Contains(src0) {
+				t.Errorf("selected %s, want address in %s", src0, testSourcePrefix6)
+			}
+		})
+	}
+}
+
+func TestFillHostBits(t *testing.T) {
+	hostBits := []byte{0xff, 0xff, 0xff, 0xff}
+	for _, c := range []struct {
+		prefix netip.Prefix
+		want   netip.Addr
+	}{
+		{netip.MustParsePrefix("203.0.113.7/32"), netip.MustParseAddr("203.0.113.7")},
+		{netip.MustParsePrefix("203.0.113.0/24"), netip.MustParseAddr("203.0.113.255")},
+		{netip.MustParsePrefix("203.0.113.0/28"), netip.MustParseAddr("203.0.113.15")},
+		{netip.MustParsePrefix("10.0.0.0/9"), netip.MustParseAddr("10.127.255.255")},
+		{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParseAddr("255.255.255.255")},
+	} {
+		if got := addrInPrefix(c.prefix, hostBits); got != c.want {
+			t.Errorf("addrInPrefix(%s) = %s, want %s", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestDialerSourceAddrPool(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	p, err := NewSourceAddrPool([]netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := DialerSocketOptions{}.Dialer().WithSourceAddrPool(p)
+	c, err := d.DialTCP(context.Background(), "tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if localAddr := c.LocalAddr().(*net.TCPAddr).AddrPort().Addr(); localAddr != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("c.LocalAddr() = %s, want 127.0.0.1", localAddr)
+	}
+}
+
+func TestListenConfigSourceAddrPool(t *testing.T) {
+	p, err := NewSourceAddrPool([]netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lc := DefaultUDPClientListenConfig.WithSourceAddrPool(p)
+	if !lc.HasSourceAddrPool() {
+		t.Error("lc.HasSourceAddrPool() = false, want true")
+	}
+
+	// No IPv6 addresses in the pool. The socket is not bound.
+	lc6 := lc.WithSourceAddrFor(context.Background(), testSourcePeer6)
+	uc, _, err := lc6.ListenUDP(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localAddr := uc.LocalAddr().(*net.UDPAddr).AddrPort().Addr(); !localAddr.IsUnspecified() {
+		t.Errorf("uc.LocalAddr() = %s, want unspecified address", localAddr)
+	}
+	uc.Close()
+
+	lc4 := lc.WithSourceAddrFor(context.Background(), testSourcePeer4)
+	uc, _, err = lc4.ListenUDP(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if localAddr := uc.LocalAddr().(*net.UDPAddr).AddrPort().Addr(); localAddr != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("uc.LocalAddr() = %s, want 127.0.0.1", localAddr)
+	}
+}
@@ -0,0 +1,136 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// tfoBlackholeDialTimeout is how long a connection attempt with SYN data can take
+	// before the destination is suspected of dropping SYN data.
+	//
+	// Linux retransmits a lost SYN without data after an initial RTO of 1 second,
+	// so a connection attempt taking longer than this has likely lost more than the data.
+	tfoBlackholeDialTimeout = 2 * time.Second
+
+	// tfoBlackholeTTL is how long TFO stays disabled for a destination after it is found to drop SYN data.
+	tfoBlackholeTTL = 10 * time.Minute
+
+	// tfoBlackholeSweepSize is the number of remembered destinations
+	// above which expired entries are removed on insertion.
+	tfoBlackholeSweepSize = 1024
+)
+
+// tfoBlackholeCache remembers destinations that appear to drop TFO SYN data,
+// so that connections to them are dialed without TFO for a while.
+//
+// The zero value is ready for use.
+type tfoBlackholeCache struct {
+	mu      sync.Mutex
+	expires map[netip.Addr]time.Time
+
+	// dialTimeout and ttl override [tfoBlackholeDialTimeout] and [tfoBlackholeTTL] if non-zero.
+	dialTimeout time.Duration
+	ttl         time.Duration
+}
+
+// tfoBlackholes is the process-wide TFO blackhole cache shared by all dialers.
+var tfoBlackholes tfoBlackholeCache
+
+// contains returns whether ip is a remembered TFO blackhole.
+func (c *tfoBlackholeCache) contains(ip netip.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.expires[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.expires, ip)
+		return false
+	}
+	return true
+}
+
+// add remembers ip as a TFO blackhole.
+func (c *tfoBlackholeCache) add(ip netip.Addr) {
+	ttl := c.ttl
+	if ttl == 0 {
+		ttl = tfoBlackholeTTL
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expires == nil {
+		c.expires = make(map[netip.Addr]time.Time)
+	}
+	if len(c.expires) >= tfoBlackholeSweepSize {
+		for ip, expires := range c.expires {
+			if now.After(expires) {
+				delete(c.expires, ip)
+			}
+		}
+	}
+	c.expires[ip] = now.Add(ttl)
+}
+
+// dial connects to peer with dial, with TFO unless peer is a remembered TFO blackhole.
+//
+// If the TFO attempt does not complete within the dial timeout, it is canceled and retried without TFO.
+// If the retry succeeds, peer is remembered as a TFO blackhole.
+func (c *tfoBlackholeCache) dial(ctx context.Context, peer netip.Addr, dial func(ctx context.Context, tfo bool) (*net.TCPConn, error)) (*net.TCPConn, error) {
+	if c.contains(peer) {
+		return dial(ctx, false)
+	}
+
+	dialTimeout := c.dialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = tfoBlackholeDialTimeout
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	tc, err := dial(attemptCtx, true)
+	timedOut := attemptCtx.Err() == context.DeadlineExceeded
+	cancel()
+	if err == nil || !timedOut || ctx.Err() != nil {
+		return tc, err
+	}
+
+	if tc, err = dial(ctx, false); err != nil {
+		// The destination is not reachable at all. Blame the network, not TFO.
+		return nil, err
+	}
+	c.add(peer)
+	return tc, nil
+}
+
+// dialTFO dials address with b as SYN data, falling back to a regular dial
+// followed by writing b when peer appears to drop SYN data. See [tfoBlackholeCache.dial].
+//
+// Detection only applies when TFO is enabled, b is not empty, and peer is a specific address.
+func (d *Dialer) dialTFO(ctx context.Context, network, address string, peer netip.Addr, b []byte) (*net.TCPConn, error) {
+	td := d.tfoDialer(ctx, peer)
+	if td.DisableTFO || len(b) == 0 || !peer.IsValid() || peer.IsUnspecified() {
+		c, err := td.DialContext(ctx, network, address, b)
+		if err != nil {
+			return nil, err
+		}
+		return c.(*net.TCPConn), nil
+	}
+
+	return tfoBlackholes.dial(ctx, peer.Unmap(), func(ctx context.Context, tfo bool) (*net.TCPConn, error) {
+		td := *td
+		td.DisableTFO = !tfo
+		c, err := td.DialContext(ctx, network, address, b)
+		if err != nil {
+			return nil, err
+		}
+		return c.(*net.TCPConn), nil
+	})
+}
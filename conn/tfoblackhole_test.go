@@ -0,0 +1,123 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var errTestDial = errors.New("test dial error")
+
+func TestTFOBlackholeCacheExpiry(t *testing.T) {
+	c := tfoBlackholeCache{ttl: 50 * time.Millisecond}
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	if c.contains(ip) {
+		t.Fatal("contains() = true on empty cache")
+	}
+	c.add(ip)
+	if !c.contains(ip) {
+		t.Fatal("contains() = false after add()")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if c.contains(ip) {
+		t.Error("contains() = true after expiry")
+	}
+	if len(c.expires) != 0 {
+		t.Errorf("len(c.expires) = %d after expiry, want 0", len(c.expires))
+	}
+}
+
+// blackholeDial returns a dial function that blocks TFO attempts until ctx is done,
+// and returns a non-nil connection or errTestDial for regular attempts.
+func blackholeDial(regularErr error, tfoAttempts, regularAttempts *int) func(ctx context.Context, tfo bool) (*net.TCPConn, error) {
+	return func(ctx context.Context, tfo bool) (*net.TCPConn, error) {
+		if tfo {
+			*tfoAttempts++
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		*regularAttempts++
+		if regularErr != nil {
+			return nil, regularErr
+		}
+		return &net.TCPConn{}, nil
+	}
+}
+
+func TestTFOBlackholeCacheDialFallback(t *testing.T) {
+	c := tfoBlackholeCache{dialTimeout: 10 * time.Millisecond}
+	ip := netip.MustParseAddr("192.0.2.1")
+	ctx := context.Background()
+	var tfoAttempts, regularAttempts int
+	dial := blackholeDial(nil, &tfoAttempts, &regularAttempts)
+
+	if _, err := c.dial(ctx, ip, dial); err != nil {
+		t.Fatalf("dial() failed: %v", err)
+	}
+	if tfoAttempts != 1 || regularAttempts != 1 {
+		t.Errorf("tfoAttempts = %d, regularAttempts = %d, want 1, 1", tfoAttempts, regularAttempts)
+	}
+	if !c.contains(ip) {
+		t.Fatal("destination not remembered after successful fallback")
+	}
+
+	if _, err := c.dial(ctx, ip, dial); err != nil {
+		t.Fatalf("dial() failed: %v", err)
+	}
+	if tfoAttempts != 1 || regularAttempts != 2 {
+		t.Errorf("tfoAttempts = %d, regularAttempts = %d, want 1, 2", tfoAttempts, regularAttempts)
+	}
+}
+
+func TestTFOBlackholeCacheDialUnreachable(t *testing.T) {
+	c := tfoBlackholeCache{dialTimeout: 10 * time.Millisecond}
+	ip := netip.MustParseAddr("192.0.2.1")
+	var tfoAttempts, regularAttempts int
+
+	if _, err := c.dial(context.Background(), ip, blackholeDial(errTestDial, &tfoAttempts, &regularAttempts)); err != errTestDial {
+		t.Fatalf("dial() = %v, want %v", err, errTestDial)
+	}
+	if c.contains(ip) {
+		t.Error("destination remembered after failed fallback")
+	}
+}
+
+func TestTFOBlackholeCacheDialCanceled(t *testing.T) {
+	c := tfoBlackholeCache{dialTimeout: time.Minute}
+	ip := netip.MustParseAddr("192.0.2.1")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var tfoAttempts, regularAttempts int
+
+	if _, err := c.dial(ctx, ip, blackholeDial(nil, &tfoAttempts, &regularAttempts)); err != context.DeadlineExceeded {
+		t.Fatalf("dial() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if regularAttempts != 0 {
+		t.Errorf("regularAttempts = %d, want 0", regularAttempts)
+	}
+	if c.contains(ip) {
+		t.Error("destination remembered after parent context expired")
+	}
+}
+
+func TestTFOBlackholeCacheDialError(t *testing.T) {
+	c := tfoBlackholeCache{}
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	_, err := c.dial(context.Background(), ip, func(ctx context.Context, tfo bool) (*net.TCPConn, error) {
+		if !tfo {
+			t.Error("unexpected regular attempt")
+		}
+		return nil, errTestDial
+	})
+	if err != errTestDial {
+		t.Fatalf("dial() = %v, want %v", err, errTestDial)
+	}
+	if c.contains(ip) {
+		t.Error("destination remembered after TFO attempt failed without timing out")
+	}
+}
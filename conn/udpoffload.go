@@ -0,0 +1,208 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// maxUDPOffloadBufferSize is the size of the buffers used for UDP GRO and GSO.
+// It is the maximum UDP payload size over IPv4.
+const maxUDPOffloadBufferSize = 65507
+
+// ErrSegmentTruncated is returned when a GRO segment is larger than the supplied buffer.
+var ErrSegmentTruncated = errors.New("the segment is larger than the supplied buffer")
+
+// WithUDPOffload returns a copy of lc that also probes UDP GSO support
+// and enables UDP GRO on the socket, where supported by the platform.
+func (lc ListenConfig) WithUDPOffload() ListenConfig {
+	lc.fns = slices.Clip(lc.fns).
+		appendProbeUDPGSOSupportFunc(true).
+		appendSetUDPGenericReceiveOffloadFunc(true)
+	return lc
+}
+
+// UDPGROReader reads from a UDP socket with UDP GRO enabled,
+// and returns coalesced datagrams one segment at a time.
+//
+// The returned control messages never contain the GRO segment size,
+// so they can be passed back to the socket for sending replies.
+type UDPGROReader struct {
+	conn      *net.UDPConn
+	buf       []byte
+	cmsgBuf   []byte
+	cmsg      []byte
+	remaining []byte
+	segSize   int
+	flags     int
+	addrPort  netip.AddrPort
+}
+
+// NewUDPGROReader returns a new UDP GRO reader for c.
+func NewUDPGROReader(c *net.UDPConn) *UDPGROReader {
+	return &UDPGROReader{
+		conn:    c,
+		buf:     make([]byte, maxUDPOffloadBufferSize),
+		cmsgBuf: make([]byte, SocketControlMessageBufferSize),
+	}
+}
+
+// Buffered returns the number of bytes of segments that can be read without a system call.
+func (r *UDPGROReader) Buffered() int {
+	return len(r.remaining)
+}
+
+// ReadMsgUDPAddrPort is like [net.UDPConn.ReadMsgUDPAddrPort], but returns one segment at a time.
+//
+// If the segment does not fit in b, it is truncated, and [ErrSegmentTruncated] is returned.
+func (r *UDPGROReader) ReadMsgUDPAddrPort(b, oob []byte) (n, oobn, flags int, addrPort netip.AddrPort, err error) {
+	if len(r.remaining) == 0 {
+		var cmsgn int
+		n, cmsgn, flags, addrPort, err = r.conn.ReadMsgUDPAddrPort(r.buf, r.cmsgBuf)
+		if err != nil {
+			return 0, 0, flags, addrPort, err
+		}
+
+		m, err := ParseSocketControlMessage(r.cmsgBuf[:cmsgn])
+		if err != nil {
+			return 0, 0, flags, addrPort, err
+		}
+
+		r.segSize = int(m.SegmentSize)
+		if r.segSize == 0 || r.segSize > n {
+			r.segSize = n
+		}
+		m.SegmentSize = 0
+		r.cmsg = m.AppendTo(r.cmsg[:0])
+		r.remaining = r.buf[:n]
+		r.flags = flags
+		r.addrPort = addrPort
+
+		if n == 0 {
+			// Zero-length datagram.
+			return 0, copy(oob, r.cmsg), r.flags, r.addrPort, nil
+		}
+	}
+
+	segment := r.remaining[:min(r.segSize, len(r.remaining))]
+	r.remaining = r.remaining[len(segment):]
+
+	n = copy(b, segment)
+	oobn = copy(oob, r.cmsg)
+	if n < len(segment) {
+		err = ErrSegmentTruncated
+	}
+	return n, oobn, r.flags, r.addrPort, err
+}
+
+// UDPGSOWriter writes to a UDP socket, coalescing consecutive datagrams
+// of the same size to the same destination into a single UDP GSO send.
+//
+// Datagrams are queued until a datagram of a different size or destination is written,
+// the maximum number of segments is reached, or Flush is called.
+// If the socket does not support UDP GSO, every datagram is sent immediately.
+type UDPGSOWriter struct {
+	conn        *net.UDPConn
+	maxSegments int
+	buf         []byte
+	segSize     int
+	segments    int
+	addrPort    netip.AddrPort
+	cmsg        []byte
+	oobBuf      []byte
+}
+
+// NewUDPGSOWriter returns a new UDP GSO writer for c.
+// maxSegments is usually the MaxUDPGSOSegments field of the socket's [SocketInfo].
+func NewUDPGSOWriter(c *net.UDPConn, maxSegments uint32) *UDPGSOWriter {
+	w := UDPGSOWriter{
+		conn:        c,
+		maxSegments: int(maxSegments),
+	}
+	if w.maxSegments > 1 {
+		w.buf = make([]byte, 0, maxUDPOffloadBufferSize)
+	}
+	return &w
+}
+
+// WriteMsgUDPAddrPort queues b for sending to addrPort with the socket control message oob.
+//
+// The returned error may be the result of sending previously queued datagrams.
+func (w *UDPGSOWriter) WriteMsgUDPAddrPort(b, oob []byte, addrPort netip.AddrPort) error {
+	if w.maxSegments <= 1 {
+		_, _, err := w.conn.WriteMsgUDPAddrPort(b, oob, addrPort)
+		return err
+	}
+
+	// Zero-length datagrams cannot be segments.
+	if len(b) == 0 {
+		ferr := w.Flush()
+		_, _, err := w.conn.WriteMsgUDPAddrPort(b, oob, addrPort)
+		return errors.Join(ferr, err)
+	}
+
+	var err error
+	if w.segments > 0 && (addrPort != w.addrPort || len(b) > w.segSize || len(w.buf)+len(b) > cap(w.buf) || !bytes.Equal(oob, w.cmsg)) {
+		err = w.Flush()
+	}
+
+	if w.segments == 0 {
+		w.segSize = len(b)
+		w.addrPort = addrPort
+		w.cmsg = append(w.cmsg[:0], oob...)
+	}
+
+	w.buf = append(w.buf, b...)
+	w.segments++
+
+	// A shorter datagram can only be the last segment.
+	if len(b) < w.segSize || w.segments == w.maxSegments {
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// Flush sends all queued datagrams.
+//
+// If the GSO send fails, the datagrams are sent one by one,
+// and UDP GSO is disabled on the writer.
+func (w *UDPGSOWriter) Flush() error {
+	if w.segments == 0 {
+		return nil
+	}
+	defer func() {
+		w.buf = w.buf[:0]
+		w.segments = 0
+	}()
+
+	if w.segments == 1 {
+		_, _, err := w.conn.WriteMsgUDPAddrPort(w.buf, w.cmsg, w.addrPort)
+		return err
+	}
+
+	m, err := ParseSocketControlMessage(w.cmsg)
+	if err != nil {
+		return err
+	}
+	m.SegmentSize = uint32(w.segSize)
+	w.oobBuf = m.AppendTo(w.oobBuf[:0])
+
+	if _, _, err = w.conn.WriteMsgUDPAddrPort(w.buf, w.oobBuf, w.addrPort); err == nil {
+		return nil
+	}
+
+	// The path may not support segmentation offload, e.g. when TX checksumming is disabled.
+	w.maxSegments = 1
+	for b := w.buf; len(b) > 0; {
+		segment := b[:min(w.segSize, len(b))]
+		b = b[len(segment):]
+		if _, _, err = w.conn.WriteMsgUDPAddrPort(segment, w.cmsg, w.addrPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
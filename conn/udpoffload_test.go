@@ -0,0 +1,71 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestUDPGSOWriterGROReader(t *testing.T) {
+	lc := DefaultUDPServerListenConfig.WithUDPOffload()
+	ctx := context.Background()
+
+	rc, rinfo, err := lc.ListenUDP(ctx, "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	wc, winfo, err := lc.ListenUDP(ctx, "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wc.Close()
+
+	t.Logf("MaxUDPGSOSegments: %d, UDPGenericReceiveOffload: %t", winfo.MaxUDPGSOSegments, rinfo.UDPGenericReceiveOffload)
+
+	if err = rc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	raddr := rc.LocalAddr().(interface{ AddrPort() netip.AddrPort }).AddrPort()
+
+	// 3 full-sized segments and a shorter last segment, followed by a different size.
+	packets := [][]byte{
+		bytes.Repeat([]byte{'a'}, 1000),
+		bytes.Repeat([]byte{'b'}, 1000),
+		bytes.Repeat([]byte{'c'}, 1000),
+		bytes.Repeat([]byte{'d'}, 500),
+		bytes.Repeat([]byte{'e'}, 1200),
+		{},
+		bytes.Repeat([]byte{'f'}, 1200),
+	}
+
+	w := NewUDPGSOWriter(wc, winfo.MaxUDPGSOSegments)
+	for _, p := range packets {
+		if err = w.WriteMsgUDPAddrPort(p, nil, raddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewUDPGROReader(rc)
+	b := make([]byte, 1500)
+	for i, p := range packets {
+		n, _, _, _, err := r.ReadMsgUDPAddrPort(b, nil)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(b[:n], p) {
+			t.Errorf("packet %d: got %d bytes, expected %d bytes", i, n, len(p))
+		}
+	}
+
+	if n := r.Buffered(); n != 0 {
+		t.Errorf("r.Buffered() = %d, expected 0", n)
+	}
+}
@@ -0,0 +1,41 @@
+package conn
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setTCPUrgentInline(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_OOBINLINE, 1); err != nil {
+		return fmt.Errorf("failed to set socket option SO_OOBINLINE: %w", err)
+	}
+	return nil
+}
+
+func (fns setFuncSlice) appendSetTCPUrgentInlineFunc(urgentInline bool) setFuncSlice {
+	if urgentInline {
+		return append(fns, func(fd int, network string, _ *SocketInfo) error {
+			return setTCPUrgentInline(fd)
+		})
+	}
+	return fns
+}
+
+// TCPAtUrgentMark reports whether the next byte to be read from the TCP socket is urgent data.
+//
+// Without SO_OOBINLINE, reads stop at the urgent mark, and the next read skips the urgent byte.
+// Calling this function before each read reveals every urgent byte removed from the stream.
+func TCPAtUrgentMark(rawConn syscall.RawConn) (atMark bool, err error) {
+	var v int
+	if cerr := rawConn.Control(func(fd uintptr) {
+		v, err = unix.IoctlGetInt(int(fd), unix.SIOCATMARK)
+	}); cerr != nil {
+		return false, cerr
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get SIOCATMARK: %w", err)
+	}
+	return v != 0, nil
+}
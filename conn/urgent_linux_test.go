@@ -0,0 +1,123 @@
+package conn
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestTCPConnPair(t *testing.T, lso ListenerSocketOptions) (clientConn, serverConn *net.TCPConn) {
+	t.Helper()
+
+	lc := lso.ListenConfig()
+	ln, _, err := lc.ListenTCP(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientConn, err = net.DialTCP("tcp4", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	serverConn, err = ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverConn.Close() })
+
+	return clientConn, serverConn
+}
+
+func writeTestUrgentStream(t *testing.T, c *net.TCPConn) {
+	t.Helper()
+
+	if _, err := c.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cerr := rawConn.Control(func(fd uintptr) {
+		err = unix.Send(int(fd), []byte("!"), unix.MSG_OOB)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Write([]byte("cd")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPAtUrgentMark(t *testing.T) {
+	clientConn, serverConn := newTestTCPConnPair(t, ListenerSocketOptions{})
+	writeTestUrgentStream(t, clientConn)
+
+	rawConn, err := serverConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the urgent data to arrive, so that the first read stops at the mark.
+	time.Sleep(50 * time.Millisecond)
+
+	b := make([]byte, 16)
+	n, err := serverConn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "ab" {
+		t.Fatalf("First read got %q, expected %q", b[:n], "ab")
+	}
+
+	atMark, err := TCPAtUrgentMark(rawConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !atMark {
+		t.Error("TCPAtUrgentMark() = false, expected true")
+	}
+
+	rest, err := io.ReadAll(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "cd" {
+		t.Errorf("Remaining data %q, expected %q", rest, "cd")
+	}
+
+	atMark, err = TCPAtUrgentMark(rawConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atMark {
+		t.Error("TCPAtUrgentMark() = true after skipping urgent byte, expected false")
+	}
+}
+
+func TestTCPUrgentInline(t *testing.T) {
+	clientConn, serverConn := newTestTCPConnPair(t, ListenerSocketOptions{TCPUrgentInline: true})
+	writeTestUrgentStream(t, clientConn)
+
+	b, err := io.ReadAll(serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ab!cd" {
+		t.Errorf("Received data %q, expected %q", b, "ab!cd")
+	}
+}
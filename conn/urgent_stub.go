@@ -0,0 +1,10 @@
+//go:build !linux
+
+package conn
+
+import "syscall"
+
+// TCPAtUrgentMark always returns false on this platform.
+func TCPAtUrgentMark(rawConn syscall.RawConn) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,284 @@
+// Package conntrack tracks live TCP connections and UDP sessions of a server,
+// and allows terminating them on demand.
+package conntrack
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+)
+
+// Conn contains information about a live TCP connection or UDP session.
+type Conn struct {
+	// ID uniquely identifies the connection or session within the server.
+	ID uint64 `json:"id"`
+
+	// Network is "tcp" or "udp".
+	Network string `json:"network"`
+
+	// ClientAddress is the address of the client when the connection or session was established.
+	ClientAddress netip.AddrPort `json:"clientAddress"`
+
+	// Username is the authenticated user, if any.
+	Username string `json:"username,omitempty"`
+
+	// TargetAddress is the requested target address.
+	// For UDP sessions, this is the target of the first packet.
+	TargetAddress conn.Addr `json:"targetAddress"`
+
+	// Client is the name of the client (outbound) chosen by the router.
+	Client string `json:"client"`
+
+	// UplinkBytes is the number of payload bytes sent from the client to the target so far.
+	UplinkBytes uint64 `json:"uplinkBytes"`
+
+	// DownlinkBytes is the number of payload bytes sent from the target to the client so far.
+	DownlinkBytes uint64 `json:"downlinkBytes"`
+
+	// PathMTU is the path MTU to the target discovered from ICMP errors, if any.
+	// Only set for UDP sessions.
+	PathMTU int `json:"pathMTU,omitempty"`
+
+	// StartTime is when the connection or session was established.
+	StartTime time.Time `json:"startTime"`
+
+	// Age is how long the connection or session has been alive.
+	Age jsonhelper.Duration `json:"age"`
+}
+
+// Entry is a tracked connection or session.
+//
+// All methods are safe to call on a nil *Entry, which does nothing.
+type Entry struct {
+	id             uint64
+	network        string
+	clientAddrPort netip.AddrPort
+	username       string
+	targetAddr     conn.Addr
+	client         string
+	startTime      time.Time
+	uplinkBytes    atomic.Uint64
+	downlinkBytes  atomic.Uint64
+	pathMTU        atomic.Int32
+	reportedBytes  atomic.Uint64
+	removed        atomic.Bool
+	close          func()
+	table          *Table
+}
+
+// AddUplinkBytes adds n to the number of bytes sent from the client to the target.
+func (e *Entry) AddUplinkBytes(n uint64) {
+	if e != nil {
+		e.uplinkBytes.Add(n)
+		e.reportLateUsage()
+	}
+}
+
+// AddDownlinkBytes adds n to the number of bytes sent from the target to the client.
+func (e *Entry) AddDownlinkBytes(n uint64) {
+	if e != nil {
+		e.downlinkBytes.Add(n)
+		e.reportLateUsage()
+	}
+}
+
+// reportLateUsage reports traffic relayed after the entry has been removed,
+// such as packets still queued on the other direction of a UDP session.
+func (e *Entry) reportLateUsage() {
+	if e.removed.Load() {
+		e.reportUsage()
+	}
+}
+
+// reportUsage reports the entry's traffic not yet reported to the table's usage function.
+func (e *Entry) reportUsage() {
+	if e.table.usage == nil || e.username == "" {
+		return
+	}
+	if n := e.takeUnreportedBytes(); n > 0 {
+		e.table.usage(e.username, n)
+	}
+}
+
+// takeUnreportedBytes returns the number of bytes relayed since the last call, in both directions.
+// It is safe for concurrent use, and never returns the same bytes twice.
+func (e *Entry) takeUnreportedBytes() uint64 {
+	total := e.uplinkBytes.Load() + e.downlinkBytes.Load()
+	for {
+		reported := e.reportedBytes.Load()
+		if total <= reported {
+			return 0
+		}
+		if e.reportedBytes.CompareAndSwap(reported, total) {
+			return total - reported
+		}
+	}
+}
+
+// SetPathMTU sets the discovered path MTU of the UDP session.
+func (e *Entry) SetPathMTU(mtu int) {
+	if e != nil {
+		e.pathMTU.Store(int32(mtu))
+	}
+}
+
+// Remove removes the entry from its table.
+// It must be called when the connection or session ends.
+func (e *Entry) Remove() {
+	if e == nil {
+		return
+	}
+	e.table.mu.Lock()
+	delete(e.table.entries, e.id)
+	e.table.mu.Unlock()
+	e.removed.Store(true)
+	e.reportUsage()
+}
+
+func (e *Entry) snapshot(now time.Time) Conn {
+	return Conn{
+		ID:            e.id,
+		Network:       e.network,
+		ClientAddress: e.clientAddrPort,
+		Username:      e.username,
+		TargetAddress: e.targetAddr,
+		Client:        e.client,
+		UplinkBytes:   e.uplinkBytes.Load(),
+		DownlinkBytes: e.downlinkBytes.Load(),
+		PathMTU:       int(e.pathMTU.Load()),
+		StartTime:     e.startTime,
+		Age:           jsonhelper.Duration(now.Sub(e.startTime)),
+	}
+}
+
+// Table is a concurrency-safe table of live connections and sessions.
+//
+// The zero value is ready for use.
+// A nil *Table does not track anything, and [Table.Add] returns a nil *Entry.
+type Table struct {
+	mu      sync.Mutex
+	lastID  uint64
+	entries map[uint64]*Entry
+	usage   func(username string, n uint64)
+}
+
+// SetUsageFunc sets the function that users' traffic is reported to.
+//
+// Traffic of live connections and sessions is reported by [Table.ReportUsage],
+// and the rest when they are removed. Traffic of connections and sessions without a username is not reported.
+// SetUsageFunc must be called before any entry is added.
+func (t *Table) SetUsageFunc(f func(username string, n uint64)) {
+	t.usage = f
+}
+
+// ReportUsage reports the traffic of live connections and sessions relayed since the last report
+// to the function set by [Table.SetUsageFunc], summed by username.
+func (t *Table) ReportUsage() {
+	if t == nil || t.usage == nil {
+		return
+	}
+
+	usage := make(map[string]uint64)
+	t.mu.Lock()
+	for _, e := range t.entries {
+		if e.username == "" {
+			continue
+		}
+		if n := e.takeUnreportedBytes(); n > 0 {
+			usage[e.username] += n
+		}
+	}
+	t.mu.Unlock()
+
+	for username, n := range usage {
+		t.usage(username, n)
+	}
+}
+
+// Add adds a new connection or session to the table.
+//
+// close is called to terminate the connection or session.
+// It must cause the relay to finish and call [Entry.Remove] soon after.
+func (t *Table) Add(network string, clientAddrPort netip.AddrPort, username string, targetAddr conn.Addr, client string, close func()) *Entry {
+	if t == nil {
+		return nil
+	}
+
+	e := &Entry{
+		network:        network,
+		clientAddrPort: clientAddrPort,
+		username:       username,
+		targetAddr:     targetAddr,
+		client:         client,
+		startTime:      time.Now(),
+		close:          close,
+		table:          t,
+	}
+
+	t.mu.Lock()
+	if t.entries == nil {
+		t.entries = make(map[uint64]*Entry)
+	}
+	t.lastID++
+	e.id = t.lastID
+	t.entries[e.id] = e
+	t.mu.Unlock()
+
+	return e
+}
+
+// Snapshot returns all live connections and sessions sorted by ID.
+func (t *Table) Snapshot() []Conn {
+	now := time.Now()
+
+	t.mu.Lock()
+	conns := make([]Conn, 0, len(t.entries))
+	for _, e := range t.entries {
+		conns = append(conns, e.snapshot(now))
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(conns, func(a, b Conn) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return conns
+}
+
+// Close terminates the connection or session with the given ID.
+// It returns false if no such connection or session exists.
+func (t *Table) Close(id uint64) bool {
+	t.mu.Lock()
+	e := t.entries[id]
+	t.mu.Unlock()
+
+	if e == nil {
+		return false
+	}
+	e.close()
+	return true
+}
+
+// CloseUser terminates all connections and sessions of the user,
+// and returns the number of terminated connections and sessions.
+func (t *Table) CloseUser(username string) int {
+	var closers []func()
+
+	t.mu.Lock()
+	for _, e := range t.entries {
+		if e.username == username {
+			closers = append(closers, e.close)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, close := range closers {
+		close()
+	}
+	return len(closers)
+}
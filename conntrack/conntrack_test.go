@@ -0,0 +1,167 @@
+package conntrack
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+func TestTable(t *testing.T) {
+	var table Table
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+
+	var closed []uint64
+	add := func(network, username string) *Entry {
+		var e *Entry
+		e = table.Add(network, clientAddrPort, username, targetAddr, "direct", func() {
+			closed = append(closed, e.id)
+			e.Remove()
+		})
+		return e
+	}
+
+	steveTCP := add("tcp", "Steve")
+	alexUDP := add("udp", "Alex")
+	steveUDP := add("udp", "Steve")
+
+	alexUDP.AddUplinkBytes(100)
+	alexUDP.AddDownlinkBytes(200)
+	alexUDP.SetPathMTU(1400)
+
+	conns := table.Snapshot()
+	if len(conns) != 3 {
+		t.Fatalf("len(conns) = %d, expected 3", len(conns))
+	}
+	for i, e := range []*Entry{steveTCP, alexUDP, steveUDP} {
+		if conns[i].ID != e.id {
+			t.Errorf("conns[%d].ID = %d, expected %d", i, conns[i].ID, e.id)
+		}
+	}
+	if c := conns[1]; c.Username != "Alex" || c.Network != "udp" || c.UplinkBytes != 100 || c.DownlinkBytes != 200 || c.PathMTU != 1400 {
+		t.Errorf("conns[1] = %+v, expected Alex's UDP session with 100 uplink and 200 downlink bytes and path MTU 1400", c)
+	}
+
+	if n := table.CloseUser("Steve"); n != 2 {
+		t.Errorf("table.CloseUser(\"Steve\") = %d, expected 2", n)
+	}
+	if len(closed) != 2 {
+		t.Errorf("closed = %v, expected 2 entries", closed)
+	}
+
+	if !table.Close(alexUDP.id) {
+		t.Error("table.Close(alexUDP.id) = false, expected true")
+	}
+	if table.Close(alexUDP.id) {
+		t.Error("table.Close(alexUDP.id) = true after removal, expected false")
+	}
+	if conns := table.Snapshot(); len(conns) != 0 {
+		t.Errorf("conns = %+v, expected empty", conns)
+	}
+}
+
+func TestTableUsage(t *testing.T) {
+	var table Table
+	usage := make(map[string]uint64)
+	table.SetUsageFunc(func(username string, n uint64) {
+		usage[username] += n
+	})
+
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	alexTCP := table.Add("tcp", clientAddrPort, "Alex", targetAddr, "direct", nil)
+	alexUDP := table.Add("udp", clientAddrPort, "Alex", targetAddr, "direct", nil)
+	anonTCP := table.Add("tcp", clientAddrPort, "", targetAddr, "direct", nil)
+
+	alexTCP.AddUplinkBytes(100)
+	alexTCP.AddDownlinkBytes(200)
+	alexUDP.AddUplinkBytes(10)
+	anonTCP.AddUplinkBytes(1000)
+
+	table.ReportUsage()
+	if len(usage) != 1 || usage["Alex"] != 310 {
+		t.Errorf("usage = %v, expected 310 bytes for Alex", usage)
+	}
+
+	// Reported traffic is not reported again.
+	table.ReportUsage()
+	if usage["Alex"] != 310 {
+		t.Errorf("usage[\"Alex\"] = %d after reporting twice, expected 310", usage["Alex"])
+	}
+
+	// The rest is reported on removal.
+	alexTCP.AddDownlinkBytes(1)
+	alexTCP.Remove()
+	if usage["Alex"] != 311 {
+		t.Errorf("usage[\"Alex\"] = %d after removal, expected 311", usage["Alex"])
+	}
+
+	// Late traffic of removed entries is reported as it is relayed.
+	alexUDP.Remove()
+	alexUDP.AddDownlinkBytes(5)
+	if usage["Alex"] != 316 {
+		t.Errorf("usage[\"Alex\"] = %d after late traffic, expected 316", usage["Alex"])
+	}
+
+	table.ReportUsage()
+	anonTCP.Remove()
+	if len(usage) != 1 || usage["Alex"] != 316 {
+		t.Errorf("usage = %v, expected 316 bytes for Alex", usage)
+	}
+}
+
+func TestTableUsageConcurrent(t *testing.T) {
+	var (
+		table Table
+		total atomic.Uint64
+	)
+	table.SetUsageFunc(func(_ string, n uint64) {
+		total.Add(n)
+	})
+
+	e := table.Add("udp", netip.AddrPort{}, "Alex", conn.Addr{}, "direct", nil)
+
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for range n {
+			e.AddUplinkBytes(1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range n {
+			e.AddDownlinkBytes(1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range n / 10 {
+			table.ReportUsage()
+		}
+		e.Remove()
+	}()
+	wg.Wait()
+
+	if got := total.Load(); got != 2*n {
+		t.Errorf("total = %d, expected %d", got, 2*n)
+	}
+}
+
+func TestNilTable(t *testing.T) {
+	var table *Table
+	e := table.Add("tcp", netip.AddrPort{}, "", conn.Addr{}, "", nil)
+	if e != nil {
+		t.Fatalf("table.Add() = %p, expected nil", e)
+	}
+	e.AddUplinkBytes(1)
+	e.AddDownlinkBytes(1)
+	e.SetPathMTU(1)
+	e.Remove()
+	table.ReportUsage()
+}
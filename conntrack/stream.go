@@ -0,0 +1,35 @@
+package conntrack
+
+import "github.com/database64128/shadowsocks-go/zerocopy"
+
+// StreamReadWriter wraps a client-side [zerocopy.ReadWriter] and counts its traffic into a tracked entry.
+//
+// Reads are counted as uplink, and writes as downlink.
+// StreamReadWriter deliberately does not implement [zerocopy.DirectReader] or [zerocopy.DirectWriter],
+// so that relays always go through the counting methods.
+type StreamReadWriter struct {
+	zerocopy.ReadWriter
+	entry *Entry
+}
+
+// NewStreamReadWriter returns rw with its traffic counted into e.
+func NewStreamReadWriter(rw zerocopy.ReadWriter, e *Entry) *StreamReadWriter {
+	return &StreamReadWriter{
+		ReadWriter: rw,
+		entry:      e,
+	}
+}
+
+// ReadZeroCopy implements the Reader ReadZeroCopy method.
+func (rw *StreamReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	payloadLen, err = rw.ReadWriter.ReadZeroCopy(b, payloadBufStart, payloadBufLen)
+	rw.entry.AddUplinkBytes(uint64(payloadLen))
+	return
+}
+
+// WriteZeroCopy implements the Writer WriteZeroCopy method.
+func (rw *StreamReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	payloadWritten, err = rw.ReadWriter.WriteZeroCopy(b, payloadStart, payloadLen)
+	rw.entry.AddDownlinkBytes(uint64(payloadWritten))
+	return
+}
@@ -0,0 +1,239 @@
+package cred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/portset"
+	"go4.org/netipx"
+)
+
+// ErrDestinationDenied is returned when a user's ACL denies the destination.
+var ErrDestinationDenied = errors.New("destination denied by user ACL")
+
+// ACL restricts the destinations a user can connect or send packets to.
+//
+// A destination is denied if it matches Deny, or if Allow is not empty and the destination does not match it.
+// The zero value allows all destinations.
+//
+// Domain destinations are resolved to match prefix rules, like the router's IP rules do.
+// A domain matches Deny.Prefixes if any of its addresses is in them,
+// and matches Allow.Prefixes only if all of its addresses are in them.
+// Domains that fail to resolve when a prefix rule needs them are denied.
+type ACL struct {
+	Allow ACLRule `json:"allow"`
+	Deny  ACLRule `json:"deny"`
+}
+
+// IsZero returns whether the ACL allows all destinations.
+func (a ACL) IsZero() bool {
+	return a.Allow.IsZero() && a.Deny.IsZero()
+}
+
+// ACLRule matches destinations. A destination matches the rule if it matches any of the lists.
+type ACLRule struct {
+	// Domains matches domain destinations that are any of the domains or their subdomains.
+	// IP destinations never match.
+	Domains []string `json:"domains,omitempty"`
+
+	// Prefixes matches IP destinations in any of the prefixes,
+	// and domain destinations by their resolved addresses. See [ACL].
+	Prefixes []netip.Prefix `json:"prefixes,omitempty"`
+
+	// Ports matches destinations with any of the ports, like "25,465,587" or "80,443,8000-8999".
+	Ports string `json:"ports,omitempty"`
+}
+
+// IsZero returns whether the rule is empty.
+func (r ACLRule) IsZero() bool {
+	return len(r.Domains) == 0 && len(r.Prefixes) == 0 && r.Ports == ""
+}
+
+// matcher returns a matcher for the ACL, or nil if the ACL allows all destinations.
+func (a ACL) matcher() (*aclMatcher, error) {
+	if a.IsZero() {
+		return nil, nil
+	}
+
+	allow, err := a.Allow.matcher()
+	if err != nil {
+		return nil, fmt.Errorf("bad allow rule: %w", err)
+	}
+	deny, err := a.Deny.matcher()
+	if err != nil {
+		return nil, fmt.Errorf("bad deny rule: %w", err)
+	}
+	return &aclMatcher{allow: allow, deny: deny}, nil
+}
+
+// aclMatcher is a compiled [ACL].
+//
+// A nil *aclMatcher allows all destinations.
+type aclMatcher struct {
+	allow *aclRuleMatcher
+	deny  *aclRuleMatcher
+}
+
+// Resolver resolves domain destinations to match them against ACL prefix rules.
+//
+// The router and DNS resolvers implement Resolver.
+type Resolver interface {
+	LookupIPs(ctx context.Context, name string) ([]netip.Addr, error)
+}
+
+// Allowed returns whether the destination is allowed.
+// Domain destinations are resolved with r when a prefix rule needs them.
+// If r is nil, such destinations are denied.
+func (m *aclMatcher) Allowed(ctx context.Context, r Resolver, addr conn.Addr) bool {
+	if m == nil {
+		return true
+	}
+
+	var (
+		resolved bool
+		addrs    []netip.Addr
+	)
+
+	// resolve returns the addresses of the domain destination, or nil if it cannot be resolved.
+	resolve := func() []netip.Addr {
+		if !resolved {
+			resolved = true
+			if r != nil {
+				addrs, _ = r.LookupIPs(ctx, addr.Domain())
+			}
+		}
+		return addrs
+	}
+
+	if m.deny != nil {
+		if m.deny.match(addr) {
+			return false
+		}
+		if m.deny.prefixes != nil && addr.IsDomain() {
+			addrs := resolve()
+			if len(addrs) == 0 || slices.ContainsFunc(addrs, m.deny.containsAddr) {
+				return false
+			}
+		}
+	}
+
+	if m.allow == nil || m.allow.match(addr) {
+		return true
+	}
+	if m.allow.prefixes != nil && addr.IsDomain() {
+		addrs := resolve()
+		return len(addrs) > 0 && !slices.ContainsFunc(addrs, func(ip netip.Addr) bool {
+			return !m.allow.containsAddr(ip)
+		})
+	}
+	return false
+}
+
+// aclRuleMatcher is a compiled [ACLRule].
+type aclRuleMatcher struct {
+	domains  []string
+	prefixes *netipx.IPSet
+	ports    portset.PortRangeSet
+}
+
+// matcher returns a matcher for the rule, or nil if the rule is empty.
+func (r ACLRule) matcher() (*aclRuleMatcher, error) {
+	if r.IsZero() {
+		return nil, nil
+	}
+
+	var m aclRuleMatcher
+
+	if len(r.Domains) > 0 {
+		m.domains = make([]string, len(r.Domains))
+		for i, domain := range r.Domains {
+			domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+			if domain == "" {
+				return nil, errors.New("empty domain")
+			}
+			m.domains[i] = domain
+		}
+	}
+
+	if len(r.Prefixes) > 0 {
+		var sb netipx.IPSetBuilder
+		for _, prefix := range r.Prefixes {
+			sb.AddPrefix(prefix)
+		}
+		s, err := sb.IPSet()
+		if err != nil {
+			return nil, err
+		}
+		m.prefixes = s
+	}
+
+	if r.Ports != "" {
+		var ps portset.PortSet
+		if err := ps.Parse(r.Ports); err != nil {
+			return nil, err
+		}
+		m.ports = ps.RangeSet()
+	}
+
+	return &m, nil
+}
+
+// containsAddr returns whether ip is in the rule's prefixes.
+func (m *aclRuleMatcher) containsAddr(ip netip.Addr) bool {
+	return m.prefixes != nil && m.prefixes.Contains(ip.Unmap())
+}
+
+// match returns whether the destination matches the rule without resolving domain destinations.
+func (m *aclRuleMatcher) match(addr conn.Addr) bool {
+	if m.ports.Contains(addr.Port()) {
+		return true
+	}
+
+	if addr.IsIP() {
+		return m.containsAddr(addr.IP())
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(addr.Domain(), "."))
+	for _, d := range m.domains {
+		if domain == d || strings.HasSuffix(domain, d) && domain[len(domain)-len(d)-1] == '.' {
+			return true
+		}
+	}
+	return false
+}
+
+// ACLChecker checks destinations against the ACLs of users in a managed server.
+// It is created with the relays, before the managed server.
+//
+// A nil *ACLChecker allows all destinations.
+type ACLChecker struct {
+	server   *ManagedServer
+	resolver Resolver
+}
+
+// NewACLChecker returns a new ACL checker that resolves domain destinations with resolver.
+func NewACLChecker(resolver Resolver) *ACLChecker {
+	return &ACLChecker{resolver: resolver}
+}
+
+// SetServer sets the managed server whose users' ACLs are checked.
+// It must be called before the relays start.
+func (c *ACLChecker) SetServer(s *ManagedServer) {
+	c.server = s
+}
+
+// Allowed returns whether the user's ACL allows the destination.
+// Requests without a username are always allowed.
+//
+// Domain destinations may be resolved, so Allowed may block.
+func (c *ACLChecker) Allowed(ctx context.Context, username string, targetAddr conn.Addr) bool {
+	if c == nil || c.server == nil || username == "" {
+		return true
+	}
+	return c.server.DestinationAllowed(ctx, c.resolver, username, targetAddr)
+}
@@ -0,0 +1,251 @@
+package cred
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap/zaptest"
+)
+
+// testResolver resolves domains from a map.
+type testResolver map[string][]netip.Addr
+
+func (r testResolver) LookupIPs(_ context.Context, name string) ([]netip.Addr, error) {
+	addrs, ok := r[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+var aclTestResolver = testResolver{
+	"example.org":          {netip.MustParseAddr("192.0.2.1")},
+	"notexample.com":       {netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("2001:db8::2")},
+	"www.example.com":      {netip.MustParseAddr("192.0.2.3")},
+	"smtp.example.com":     {netip.MustParseAddr("192.0.2.4")},
+	"internal.example.org": {netip.MustParseAddr("192.0.2.5"), netip.MustParseAddr("::ffff:10.0.0.1")},
+}
+
+func TestACLAllowed(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		acl     ACL
+		allowed []conn.Addr
+		denied  []conn.Addr
+	}{
+		{
+			name: "Zero",
+			allowed: []conn.Addr{
+				conn.MustAddrFromDomainPort("smtp.example.com", 25),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:443")),
+			},
+		},
+		{
+			name: "DenyPorts",
+			acl:  ACL{Deny: ACLRule{Ports: "25,465,587"}},
+			allowed: []conn.Addr{
+				conn.MustAddrFromDomainPort("www.example.com", 443),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:2525")),
+			},
+			denied: []conn.Addr{
+				conn.MustAddrFromDomainPort("smtp.example.com", 25),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::1]:587")),
+			},
+		},
+		{
+			name: "AllowPorts",
+			acl:  ACL{Allow: ACLRule{Ports: "80,443"}},
+			allowed: []conn.Addr{
+				conn.MustAddrFromDomainPort("www.example.com", 443),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:80")),
+			},
+			denied: []conn.Addr{
+				conn.MustAddrFromDomainPort("www.example.com", 22),
+			},
+		},
+		{
+			name: "AllowPortsDenyDomainsAndPrefixes",
+			acl: ACL{
+				Allow: ACLRule{Ports: "443"},
+				Deny: ACLRule{
+					Domains:  []string{"Example.com", ".example.net"},
+					Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+				},
+			},
+			allowed: []conn.Addr{
+				conn.MustAddrFromDomainPort("example.org", 443),
+				conn.MustAddrFromDomainPort("notexample.com", 443),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:443")),
+			},
+			denied: []conn.Addr{
+				conn.MustAddrFromDomainPort("example.com", 443),
+				conn.MustAddrFromDomainPort("www.EXAMPLE.com.", 443),
+				conn.MustAddrFromDomainPort("a.b.example.net", 443),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("10.1.2.3:443")),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("[::ffff:10.1.2.3]:443")),
+				conn.MustAddrFromDomainPort("example.org", 80),
+				conn.MustAddrFromDomainPort("internal.example.org", 443),
+				conn.MustAddrFromDomainPort("unresolvable.example.org", 443),
+			},
+		},
+		{
+			name: "AllowPrefixes",
+			acl:  ACL{Allow: ACLRule{Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}},
+			allowed: []conn.Addr{
+				conn.MustAddrFromDomainPort("example.org", 443),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:443")),
+			},
+			denied: []conn.Addr{
+				conn.MustAddrFromDomainPort("notexample.com", 443),
+				conn.MustAddrFromDomainPort("internal.example.org", 443),
+				conn.MustAddrFromDomainPort("unresolvable.example.org", 443),
+				conn.AddrFromIPPort(netip.MustParseAddrPort("10.0.0.1:443")),
+			},
+		},
+		{
+			name: "AllowDomainsAndPrefixes",
+			acl: ACL{Allow: ACLRule{
+				Domains:  []string{"example.org"},
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			}},
+			allowed: []conn.Addr{
+				// Matched by domain without resolving.
+				conn.MustAddrFromDomainPort("unresolvable.example.org", 443),
+				conn.MustAddrFromDomainPort("www.example.com", 443),
+			},
+			denied: []conn.Addr{
+				conn.MustAddrFromDomainPort("notexample.com", 443),
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := c.acl.matcher()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, addr := range c.allowed {
+				if !m.Allowed(context.Background(), aclTestResolver, addr) {
+					t.Errorf("%s denied, want allowed", addr)
+				}
+			}
+			for _, addr := range c.denied {
+				if m.Allowed(context.Background(), aclTestResolver, addr) {
+					t.Errorf("%s allowed, want denied", addr)
+				}
+			}
+		})
+	}
+
+	for _, acl := range []ACL{
+		{Allow: ACLRule{Ports: "0"}},
+		{Deny: ACLRule{Ports: "443-80"}},
+		{Deny: ACLRule{Domains: []string{""}}},
+	} {
+		if _, err := acl.matcher(); err == nil {
+			t.Errorf("%+v: matcher succeeded, want error", acl)
+		}
+	}
+}
+
+func TestManagedServerACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":{"uPSK":"MDEyMzQ1Njc4OWFiY2RlZg==","acl":{"allow":{"ports":"80,443"}}},"Sam":"YWJjZGVmMDEyMzQ1Njc4OQ=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp ss2022.CredStore
+	m := NewManager(nil, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker := NewACLChecker(aclTestResolver)
+	ctx := context.Background()
+	checker.SetServer(s)
+
+	web := conn.MustAddrFromDomainPort("www.example.com", 443)
+	smtp := conn.MustAddrFromDomainPort("smtp.example.com", 25)
+
+	for _, c := range []struct {
+		username string
+		addr     conn.Addr
+		want     bool
+	}{
+		{"Alex", web, true},
+		{"Alex", smtp, false},
+		{"Sam", smtp, true},
+		{"", smtp, true},
+	} {
+		if got := checker.Allowed(ctx, c.username, c.addr); got != c.want {
+			t.Errorf("Allowed(%q, %s) = %t, want %t", c.username, c.addr, got, c.want)
+		}
+	}
+
+	if err = s.SetACL("Sam", ACL{Deny: ACLRule{Ports: "25"}}); err != nil {
+		t.Fatal(err)
+	}
+	if checker.Allowed(ctx, "Sam", smtp) {
+		t.Error("Sam allowed to SMTP after setting ACL")
+	}
+	if err = s.SetACL("Alex", ACL{}); err != nil {
+		t.Fatal(err)
+	}
+	if !checker.Allowed(ctx, "Alex", smtp) {
+		t.Error("Alex denied SMTP after clearing ACL")
+	}
+	if err = s.SetACL("Nobody", ACL{}); err == nil {
+		t.Error("SetACL succeeded for nonexistent user")
+	}
+	if err = s.SetACL("Sam", ACL{Deny: ACLRule{Ports: "bogus"}}); err == nil {
+		t.Error("SetACL succeeded with invalid ports")
+	}
+
+	uc, ok := s.GetCredential("Sam")
+	if !ok {
+		t.Fatal("user not found")
+	}
+	if uc.ACL == nil || uc.ACL.Deny.Ports != "25" {
+		t.Errorf("credential = %+v, want ACL denying port 25", uc)
+	}
+	if uc, _ = s.GetCredential("Alex"); uc.ACL != nil {
+		t.Errorf("credential = %+v, want no ACL", uc)
+	}
+
+	// ACLs survive saving and loading the file.
+	s.mu.Lock()
+	err = s.saveToFile()
+	s.cachedContent = ""
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if checker.Allowed(ctx, "Sam", smtp) {
+		t.Error("Sam allowed to SMTP after reloading")
+	}
+	if !checker.Allowed(ctx, "Alex", smtp) {
+		t.Error("Alex denied SMTP after reloading")
+	}
+}
+
+func TestACLAllowedWithoutResolver(t *testing.T) {
+	m, err := ACL{Deny: ACLRule{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}}.matcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Allowed(context.Background(), nil, conn.MustAddrFromDomainPort("example.org", 443)) {
+		t.Error("domain allowed without resolver, want denied")
+	}
+	if !m.Allowed(context.Background(), nil, conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:443"))) {
+		t.Error("IP address denied without resolver, want allowed")
+	}
+}
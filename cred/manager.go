@@ -15,6 +15,9 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
 	"github.com/database64128/shadowsocks-go/mmap"
 	"github.com/database64128/shadowsocks-go/ss2022"
 	"go.uber.org/zap"
@@ -27,23 +30,45 @@ var (
 
 // ManagedServer stores information about a server whose credentials are managed by the credential manager.
 type ManagedServer struct {
-	pskLength           int
-	tcp                 *ss2022.CredStore
-	udp                 *ss2022.CredStore
-	path                string
-	cachedContent       string
-	cachedCredMap       map[string]*cachedUserCredential
-	cachedUserLookupMap ss2022.UserLookupMap
-	mu                  sync.RWMutex
-	wg                  sync.WaitGroup
-	saveQueue           chan struct{}
-	logger              *zap.Logger
+	name                  string
+	method                string
+	iPSK                  []byte
+	pskLength             int
+	identityPSKs          []ss2022.ScheduledPSK
+	identityCipherConfigs []ss2022.ServerIdentityCipherConfig
+	activeIdentityPSKs    []int
+	tcp                   *ss2022.CredStore
+	udp                   *ss2022.CredStore
+	path                  string
+	cachedContent         string
+	cachedCredMap         map[string]*cachedUserCredential
+	cachedUserLookupMap   ss2022.UserLookupMap
+	mu                    sync.RWMutex
+	wg                    sync.WaitGroup
+	cancel                context.CancelFunc
+	saveQueue             chan struct{}
+	watchFile             bool
+	connTable             *conntrack.Table
+	events                *event.Bus
+	logger                *zap.Logger
 }
 
 // UserCredential stores a user's credential.
 type UserCredential struct {
 	Name string `json:"username"`
 	UPSK []byte `json:"uPSK"`
+
+	// Quota is the user's traffic quota. Nil means unlimited.
+	Quota *Quota `json:"quota,omitempty"`
+
+	// Usage is the user's traffic counted against the quota.
+	Usage *Usage `json:"usage,omitempty"`
+
+	// QuotaExceeded is whether the user is suspended for exceeding the quota.
+	QuotaExceeded bool `json:"quotaExceeded,omitempty"`
+
+	// ACL restricts the user's destinations. Nil means all destinations are allowed.
+	ACL *ACL `json:"acl,omitempty"`
 }
 
 // Compare is useful for sorting user credentials by username.
@@ -52,8 +77,61 @@ func (uc UserCredential) Compare(other UserCredential) int {
 }
 
 type cachedUserCredential struct {
-	uPSK     []byte
-	uPSKHash [ss2022.IdentityHeaderLength]byte
+	uPSK      []byte
+	uPSKHash  [ss2022.IdentityHeaderLength]byte
+	quota     Quota
+	usage     Usage
+	suspended bool
+	acl       ACL
+	aclm      *aclMatcher
+}
+
+func (uc *cachedUserCredential) userCredential(username string) UserCredential {
+	c := UserCredential{
+		Name:          username,
+		UPSK:          uc.uPSK,
+		QuotaExceeded: uc.suspended,
+	}
+	if !uc.quota.IsUnlimited() {
+		quota := uc.quota
+		c.Quota = &quota
+	}
+	if !uc.usage.IsZero() {
+		usage := uc.usage
+		c.Usage = &usage
+	}
+	if !uc.acl.IsZero() {
+		acl := uc.acl
+		c.ACL = &acl
+	}
+	return c
+}
+
+func (uc *cachedUserCredential) setACL(acl ACL) error {
+	m, err := acl.matcher()
+	if err != nil {
+		return err
+	}
+	uc.acl = acl
+	uc.aclm = m
+	return nil
+}
+
+func (uc *cachedUserCredential) fileEntry() userFileEntry {
+	e := userFileEntry{UPSK: uc.uPSK}
+	if !uc.quota.IsUnlimited() {
+		quota := uc.quota
+		e.Quota = &quota
+	}
+	if !uc.usage.IsZero() {
+		usage := uc.usage
+		e.Usage = &usage
+	}
+	if !uc.acl.IsZero() {
+		acl := uc.acl
+		e.ACL = &acl
+	}
+	return e
 }
 
 // Credentials returns the server credentials.
@@ -61,10 +139,7 @@ func (s *ManagedServer) Credentials() []UserCredential {
 	s.mu.RLock()
 	ucs := make([]UserCredential, 0, len(s.cachedCredMap))
 	for username, cachedCred := range s.cachedCredMap {
-		ucs = append(ucs, UserCredential{
-			Name: username,
-			UPSK: cachedCred.uPSK,
-		})
+		ucs = append(ucs, cachedCred.userCredential(username))
 	}
 	s.mu.RUnlock()
 	slices.SortFunc(ucs, UserCredential.Compare)
@@ -74,24 +149,21 @@ func (s *ManagedServer) Credentials() []UserCredential {
 // GetCredential returns the user credential.
 func (s *ManagedServer) GetCredential(username string) (UserCredential, bool) {
 	s.mu.RLock()
+	defer s.mu.RUnlock()
 	cachedCred := s.cachedCredMap[username]
-	s.mu.RUnlock()
 	if cachedCred == nil {
 		return UserCredential{}, false
 	}
-	return UserCredential{
-		Name: username,
-		UPSK: cachedCred.uPSK,
-	}, true
+	return cachedCred.userCredential(username), true
 }
 
 func (s *ManagedServer) saveToFile() error {
-	uPSKMap := make(map[string][]byte, len(s.cachedCredMap))
+	userMap := make(map[string]userFileEntry, len(s.cachedCredMap))
 	for username, uc := range s.cachedCredMap {
-		uPSKMap[username] = uc.uPSK
+		userMap[username] = uc.fileEntry()
 	}
 
-	b, err := json.MarshalIndent(uPSKMap, "", "    ")
+	b, err := json.MarshalIndent(userMap, "", "    ")
 	if err != nil {
 		return err
 	}
@@ -125,30 +197,99 @@ func (s *ManagedServer) dequeueSave(ctx context.Context) {
 		default:
 		}
 
-		// The save operation only reads cachedCredMap and writes cachedContent.
-		// It is without doubt that taking the read lock is enough for cachedCredMap.
-		// As for cachedContent, the only other place that reads and writes it is LoadFromFile,
-		// which takes the write lock. So it is safe to take just the read lock here.
-		s.mu.RLock()
-		if err := s.saveToFile(); err != nil {
-			s.logger.Warn("Failed to save credentials", zap.Error(err))
+		s.save()
+	}
+}
+
+// save saves the credentials to the file, and logs the error if any.
+func (s *ManagedServer) save() {
+	// Traffic accounting writes usage in cachedCredMap under the write lock,
+	// so the save operation must take the write lock too.
+	s.mu.Lock()
+	if err := s.saveToFile(); err != nil {
+		s.logger.Warn("Failed to save credentials", zap.Error(err))
+	}
+	s.mu.Unlock()
+}
+
+const (
+	// quotaCheckInterval is the interval between checks for monthly quota resets.
+	quotaCheckInterval = time.Minute
+
+	// usageReportInterval is the interval between counting the traffic of live connections
+	// and sessions against quotas.
+	usageReportInterval = 5 * time.Second
+)
+
+func (s *ManagedServer) checkQuotas(ctx context.Context) {
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+
+	usageTicker := time.NewTicker(usageReportInterval)
+	defer usageTicker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.resetMonthlyUsage(now)
+		case <-usageTicker.C:
+			s.connTable.ReportUsage()
+		case <-ctx.Done():
+			return
 		}
-		s.mu.RUnlock()
 	}
 }
 
 // Start starts the managed server.
-func (s *ManagedServer) Start(ctx context.Context) {
-	s.wg.Add(1)
+func (s *ManagedServer) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	if s.watchFile {
+		w, err := s.newWatcher()
+		if err != nil {
+			return fmt.Errorf("failed to watch credential file: %w", err)
+		}
+		s.wg.Add(1)
+		go func() {
+			s.watch(ctx, w)
+			s.wg.Done()
+		}()
+	}
+
+	if len(s.identityPSKs) > 0 {
+		s.wg.Add(1)
+		go func() {
+			s.rotateIdentityPSKs(ctx)
+			s.wg.Done()
+		}()
+	}
+
+	s.wg.Add(2)
 	go func() {
 		s.dequeueSave(ctx)
 		s.wg.Done()
 	}()
+	go func() {
+		s.checkQuotas(ctx)
+		s.wg.Done()
+	}()
+	return nil
 }
 
-// Stop stops the managed server.
+// Stop stops the managed server, saving pending changes to the credential file.
 func (s *ManagedServer) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
 	s.wg.Wait()
+
+	// Save changes queued after the save goroutine exited,
+	// such as traffic of connections drained after the context is canceled.
+	select {
+	case <-s.saveQueue:
+		s.save()
+	default:
+	}
 }
 
 func (s *ManagedServer) enqueueSave() {
@@ -222,13 +363,17 @@ func (s *ManagedServer) UpdateCredential(username string, uPSK []byte) error {
 	oldUPSKHash := uc.uPSKHash
 	uc.uPSK = uPSK
 	uc.uPSKHash = ss2022.PSKHash(uPSK)
+	uPSKHash := uc.uPSKHash
+	suspended := uc.suspended
 	delete(s.cachedUserLookupMap, oldUPSKHash)
-	s.cachedUserLookupMap[uc.uPSKHash] = c
+	s.cachedUserLookupMap[uPSKHash] = c
 	s.mu.Unlock()
 	s.enqueueSave()
 	s.updateProdULM(func(ulm ss2022.UserLookupMap) {
 		delete(ulm, oldUPSKHash)
-		ulm[uc.uPSKHash] = c
+		if !suspended {
+			ulm[uPSKHash] = c
+		}
 	})
 	return nil
 }
@@ -251,6 +396,320 @@ func (s *ManagedServer) DeleteCredential(username string) error {
 	return nil
 }
 
+// ImportCredentials adds the user credentials atomically.
+// If any user is invalid, already exists, or has a duplicate uPSK, no user is added.
+// Quotas and usages in the credentials are preserved.
+func (s *ManagedServer) ImportCredentials(ucs []UserCredential) error {
+	month := monthOf(time.Now())
+	credMap := make(map[string]*cachedUserCredential, len(ucs))
+	userLookupMap := make(ss2022.UserLookupMap, len(ucs))
+	prodUserLookupMap := make(ss2022.UserLookupMap, len(ucs))
+
+	for _, uc := range ucs {
+		if uc.Name == "" {
+			return ErrEmptyUsername
+		}
+		if len(uc.UPSK) != s.pskLength {
+			return &ss2022.PSKLengthError{PSK: uc.UPSK, ExpectedLength: s.pskLength}
+		}
+		if credMap[uc.Name] != nil {
+			return fmt.Errorf("duplicate user %s", uc.Name)
+		}
+
+		uPSKHash := ss2022.PSKHash(uc.UPSK)
+		if c := userLookupMap[uPSKHash]; c != nil {
+			return fmt.Errorf("duplicate uPSK for user %s and %s", c.Name, uc.Name)
+		}
+		c, err := ss2022.NewServerUserCipherConfig(uc.Name, uc.UPSK, s.udp != nil)
+		if err != nil {
+			return err
+		}
+
+		cachedCred := &cachedUserCredential{
+			uPSK:     uc.UPSK,
+			uPSKHash: uPSKHash,
+		}
+		if uc.Quota != nil {
+			cachedCred.quota = *uc.Quota
+		}
+		if uc.Usage != nil {
+			cachedCred.usage = *uc.Usage
+		}
+		if uc.ACL != nil {
+			if err = cachedCred.setACL(*uc.ACL); err != nil {
+				return fmt.Errorf("user %s: %w", uc.Name, err)
+			}
+		}
+		cachedCred.suspended = cachedCred.quota.exceeded(cachedCred.usage, month)
+
+		credMap[uc.Name] = cachedCred
+		userLookupMap[uPSKHash] = c
+		if !cachedCred.suspended {
+			prodUserLookupMap[uPSKHash] = c
+		}
+	}
+
+	s.mu.Lock()
+	for username := range credMap {
+		if s.cachedCredMap[username] != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("user %s already exists", username)
+		}
+	}
+	for uPSKHash, c := range userLookupMap {
+		if existing := s.cachedUserLookupMap[uPSKHash]; existing != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("duplicate uPSK for user %s and %s", existing.Name, c.Name)
+		}
+	}
+	maps.Copy(s.cachedCredMap, credMap)
+	maps.Copy(s.cachedUserLookupMap, userLookupMap)
+	s.mu.Unlock()
+	s.enqueueSave()
+	s.updateProdULM(func(ulm ss2022.UserLookupMap) {
+		maps.Copy(ulm, prodUserLookupMap)
+	})
+	return nil
+}
+
+// SetQuota sets a user's traffic quota.
+// The user is suspended or restored immediately if the new quota requires it.
+func (s *ManagedServer) SetQuota(username string, quota Quota) error {
+	s.mu.Lock()
+	uc := s.cachedCredMap[username]
+	if uc == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNonexistentUser, username)
+	}
+	uc.quota = quota
+	s.updateSuspension(username, uc, monthOf(time.Now()))
+	s.enqueueSave()
+	return nil
+}
+
+// SetACL sets a user's destination ACL. The zero ACL allows all destinations.
+// New connections and packets are checked against the new ACL.
+func (s *ManagedServer) SetACL(username string, acl ACL) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uc := s.cachedCredMap[username]
+	if uc == nil {
+		return fmt.Errorf("%w: %s", ErrNonexistentUser, username)
+	}
+	if err := uc.setACL(acl); err != nil {
+		return err
+	}
+	s.enqueueSave()
+	return nil
+}
+
+// UserUpdate is a set of changes to a user credential.
+type UserUpdate struct {
+	// UPSK is the new uPSK, or nil to keep the current one.
+	UPSK []byte
+
+	// Quota is the new traffic quota, or nil to keep the current one.
+	Quota *Quota
+
+	// ResetUsage resets the traffic usage.
+	ResetUsage bool
+
+	// ACL is the new destination ACL, or nil to keep the current one.
+	ACL *ACL
+}
+
+// UpdateUser applies the update to a user atomically.
+// The update is validated before any change is made, so on error the user is left unchanged.
+// The user is suspended or restored immediately if the new quota or usage requires it.
+func (s *ManagedServer) UpdateUser(username string, update UserUpdate) error {
+	var c *ss2022.ServerUserCipherConfig
+	if update.UPSK != nil {
+		if len(update.UPSK) != s.pskLength {
+			return &ss2022.PSKLengthError{PSK: update.UPSK, ExpectedLength: s.pskLength}
+		}
+		var err error
+		c, err = ss2022.NewServerUserCipherConfig(username, update.UPSK, s.udp != nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	var aclm *aclMatcher
+	if update.ACL != nil {
+		var err error
+		aclm, err = update.ACL.matcher()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	uc := s.cachedCredMap[username]
+	if uc == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNonexistentUser, username)
+	}
+	if c != nil && bytes.Equal(uc.uPSK, update.UPSK) {
+		s.mu.Unlock()
+		return fmt.Errorf("user %s already has the same uPSK", username)
+	}
+
+	if c != nil {
+		oldUPSKHash := uc.uPSKHash
+		uc.uPSK = update.UPSK
+		uc.uPSKHash = ss2022.PSKHash(update.UPSK)
+		uPSKHash := uc.uPSKHash
+		suspended := uc.suspended
+		delete(s.cachedUserLookupMap, oldUPSKHash)
+		s.cachedUserLookupMap[uPSKHash] = c
+		s.updateProdULM(func(ulm ss2022.UserLookupMap) {
+			delete(ulm, oldUPSKHash)
+			if !suspended {
+				ulm[uPSKHash] = c
+			}
+		})
+	}
+	if update.Quota != nil {
+		uc.quota = *update.Quota
+	}
+	if update.ResetUsage {
+		uc.usage = Usage{}
+	}
+	if update.ACL != nil {
+		uc.acl = *update.ACL
+		uc.aclm = aclm
+	}
+
+	s.updateSuspension(username, uc, monthOf(time.Now()))
+	s.enqueueSave()
+	return nil
+}
+
+// DestinationAllowed returns whether the user's ACL allows the destination.
+// Domain destinations are resolved with r when the ACL has prefix rules.
+// Unknown users are allowed, as they are rejected by the credential stores.
+func (s *ManagedServer) DestinationAllowed(ctx context.Context, r Resolver, username string, targetAddr conn.Addr) bool {
+	s.mu.RLock()
+	uc := s.cachedCredMap[username]
+	var aclm *aclMatcher
+	if uc != nil {
+		aclm = uc.aclm
+	}
+	s.mu.RUnlock()
+	return aclm.Allowed(ctx, r, targetAddr)
+}
+
+// ResetUsage resets a user's traffic usage, restoring the user if suspended.
+func (s *ManagedServer) ResetUsage(username string) error {
+	s.mu.Lock()
+	uc := s.cachedCredMap[username]
+	if uc == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNonexistentUser, username)
+	}
+	uc.usage = Usage{}
+	s.updateSuspension(username, uc, monthOf(time.Now()))
+	s.enqueueSave()
+	return nil
+}
+
+// addTraffic counts n bytes of traffic against the user's quota.
+func (s *ManagedServer) addTraffic(username string, n uint64, now time.Time) {
+	s.mu.Lock()
+	uc := s.cachedCredMap[username]
+	if uc == nil || uc.quota.IsUnlimited() {
+		s.mu.Unlock()
+		return
+	}
+	month := monthOf(now)
+	uc.usage.add(n, month)
+	s.updateSuspension(username, uc, month)
+	s.enqueueSave()
+}
+
+// resetMonthlyUsage resets the monthly usage of all users when a new month starts,
+// and restores users that no longer exceed their quotas.
+func (s *ManagedServer) resetMonthlyUsage(now time.Time) {
+	month := monthOf(now)
+	restored := make(ss2022.UserLookupMap)
+	var changed bool
+
+	s.mu.Lock()
+	for username, uc := range s.cachedCredMap {
+		if uc.usage.Month == "" || !uc.usage.rollover(month) {
+			continue
+		}
+		changed = true
+		if uc.suspended && !uc.quota.exceeded(uc.usage, month) {
+			uc.suspended = false
+			restored[uc.uPSKHash] = s.cachedUserLookupMap[uc.uPSKHash]
+			s.logger.Info("Restored user after monthly quota reset",
+				zap.String("server", s.name),
+				zap.String("username", username),
+			)
+		}
+	}
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	s.enqueueSave()
+	if len(restored) == 0 {
+		return
+	}
+	s.updateProdULM(func(ulm ss2022.UserLookupMap) {
+		maps.Copy(ulm, restored)
+	})
+}
+
+// updateSuspension suspends or restores the user according to its quota and usage.
+// It must be called with s.mu held, and unlocks s.mu before updating the production user lookup maps.
+func (s *ManagedServer) updateSuspension(username string, uc *cachedUserCredential, month string) {
+	exceeded := uc.quota.exceeded(uc.usage, month)
+	if exceeded == uc.suspended {
+		s.mu.Unlock()
+		return
+	}
+	uc.suspended = exceeded
+	uPSKHash := uc.uPSKHash
+	c := s.cachedUserLookupMap[uPSKHash]
+	s.mu.Unlock()
+
+	if exceeded {
+		s.updateProdULM(func(ulm ss2022.UserLookupMap) {
+			delete(ulm, uPSKHash)
+		})
+		s.events.Publish(event.Event{
+			Kind:     event.KindQuotaExceeded,
+			Server:   s.name,
+			Username: username,
+		})
+		s.logger.Info("Suspended user for exceeding traffic quota",
+			zap.String("server", s.name),
+			zap.String("username", username),
+		)
+		if s.connTable != nil {
+			if n := s.connTable.CloseUser(username); n > 0 {
+				s.logger.Info("Terminated connections and sessions of user exceeding traffic quota",
+					zap.String("server", s.name),
+					zap.String("username", username),
+					zap.Int("count", n),
+				)
+			}
+		}
+		return
+	}
+
+	s.updateProdULM(func(ulm ss2022.UserLookupMap) {
+		ulm[uPSKHash] = c
+	})
+	s.logger.Info("Restored user within traffic quota",
+		zap.String("server", s.name),
+		zap.String("username", username),
+	)
+}
+
 // LoadFromFile loads credentials from the configured credential file
 // and applies the changes to the associated credential stores.
 func (s *ManagedServer) LoadFromFile() error {
@@ -270,15 +729,18 @@ func (s *ManagedServer) LoadFromFile() error {
 	r := strings.NewReader(content)
 	d := json.NewDecoder(r)
 	d.DisallowUnknownFields()
-	var uPSKMap map[string][]byte
-	if err = d.Decode(&uPSKMap); err != nil {
+	var userMap map[string]userFileEntry
+	if err = d.Decode(&userMap); err != nil {
 		s.mu.Unlock()
 		return err
 	}
 
-	userLookupMap := make(ss2022.UserLookupMap, len(uPSKMap))
-	credMap := make(map[string]*cachedUserCredential, len(uPSKMap))
-	for username, uPSK := range uPSKMap {
+	month := monthOf(time.Now())
+	userLookupMap := make(ss2022.UserLookupMap, len(userMap))
+	prodUserLookupMap := make(ss2022.UserLookupMap, len(userMap))
+	credMap := make(map[string]*cachedUserCredential, len(userMap))
+	for username, entry := range userMap {
+		uPSK := entry.UPSK
 		if len(uPSK) != s.pskLength {
 			s.mu.Unlock()
 			return &ss2022.PSKLengthError{PSK: uPSK, ExpectedLength: s.pskLength}
@@ -296,8 +758,29 @@ func (s *ManagedServer) LoadFromFile() error {
 			return err
 		}
 
+		uc := &cachedUserCredential{
+			uPSK:     uPSK,
+			uPSKHash: uPSKHash,
+		}
+		if entry.Quota != nil {
+			uc.quota = *entry.Quota
+		}
+		if entry.Usage != nil {
+			uc.usage = *entry.Usage
+		}
+		if entry.ACL != nil {
+			if err = uc.setACL(*entry.ACL); err != nil {
+				s.mu.Unlock()
+				return fmt.Errorf("user %s: %w", username, err)
+			}
+		}
+		uc.suspended = uc.quota.exceeded(uc.usage, month)
+
 		userLookupMap[uPSKHash] = c
-		credMap[username] = &cachedUserCredential{uPSK, uPSKHash}
+		if !uc.suspended {
+			prodUserLookupMap[uPSKHash] = c
+		}
+		credMap[username] = uc
 	}
 
 	s.cachedContent = strings.Clone(content)
@@ -306,10 +789,10 @@ func (s *ManagedServer) LoadFromFile() error {
 	s.mu.Unlock()
 
 	if s.tcp != nil {
-		s.tcp.ReplaceUserLookupMap(maps.Clone(s.cachedUserLookupMap))
+		s.tcp.ReplaceUserLookupMap(maps.Clone(prodUserLookupMap))
 	}
 	if s.udp != nil {
-		s.udp.ReplaceUserLookupMap(maps.Clone(s.cachedUserLookupMap))
+		s.udp.ReplaceUserLookupMap(prodUserLookupMap)
 	}
 
 	return nil
@@ -317,13 +800,17 @@ func (s *ManagedServer) LoadFromFile() error {
 
 // Manager manages credentials for servers of supported protocols.
 type Manager struct {
+	events  *event.Bus
 	logger  *zap.Logger
+	mu      sync.Mutex
 	servers map[string]*ManagedServer
 }
 
 // NewManager returns a new credential manager.
-func NewManager(logger *zap.Logger) *Manager {
+// Managed servers publish quota events to events, which may be nil.
+func NewManager(events *event.Bus, logger *zap.Logger) *Manager {
 	return &Manager{
+		events:  events,
 		logger:  logger,
 		servers: make(map[string]*ManagedServer),
 	}
@@ -331,6 +818,9 @@ func NewManager(logger *zap.Logger) *Manager {
 
 // ReloadAll asks all managed servers to reload credentials from files.
 func (m *Manager) ReloadAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for name, s := range m.servers {
 		if err := s.LoadFromFile(); err != nil {
 			m.logger.Warn("Failed to reload credentials", zap.String("server", name), zap.Error(err))
@@ -342,6 +832,9 @@ func (m *Manager) ReloadAll() {
 
 // LoadAll loads credentials for all managed servers.
 func (m *Manager) LoadAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for name, s := range m.servers {
 		if err := s.LoadFromFile(); err != nil {
 			return fmt.Errorf("failed to load credentials for server %s: %w", name, err)
@@ -358,8 +851,13 @@ func (m *Manager) String() string {
 
 // Start starts all managed servers and registers to reload on SIGUSR1.
 func (m *Manager) Start(ctx context.Context) error {
-	for _, s := range m.servers {
-		s.Start(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, s := range m.servers {
+		if err := s.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start managed server %s: %w", name, err)
+		}
 	}
 	m.registerSIGUSR1()
 	return nil
@@ -367,6 +865,9 @@ func (m *Manager) Start(ctx context.Context) error {
 
 // Stop gracefully stops all managed servers.
 func (m *Manager) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for _, s := range m.servers {
 		s.Stop()
 	}
@@ -374,17 +875,27 @@ func (m *Manager) Stop() error {
 }
 
 // RegisterServer registers a server to the manager.
-func (m *Manager) RegisterServer(name, path string, pskLength int, tcpCredStore, udpCredStore *ss2022.CredStore) (*ManagedServer, error) {
+// method and iPSK are the server's method and identity PSK, whose length is also the required length of user PSKs.
+//
+// Servers registered after [Manager.Start] must be started by the caller.
+func (m *Manager) RegisterServer(name, method, path string, iPSK []byte, tcpCredStore, udpCredStore *ss2022.CredStore) (*ManagedServer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	s := m.servers[name]
 	if s != nil {
 		return nil, fmt.Errorf("server already registered: %s", name)
 	}
 	s = &ManagedServer{
-		pskLength: pskLength,
+		name:      name,
+		method:    method,
+		iPSK:      iPSK,
+		pskLength: len(iPSK),
 		tcp:       tcpCredStore,
 		udp:       udpCredStore,
 		path:      path,
 		saveQueue: make(chan struct{}, 1),
+		events:    m.events,
 		logger:    m.logger,
 	}
 	if err := s.LoadFromFile(); err != nil {
@@ -394,3 +905,17 @@ func (m *Manager) RegisterServer(name, path string, pskLength int, tcpCredStore,
 	m.logger.Debug("Registered server", zap.String("server", name))
 	return s, nil
 }
+
+// UnregisterServer stops the server and removes it from the manager.
+// It is a no-op if the server is not registered.
+func (m *Manager) UnregisterServer(name string) {
+	m.mu.Lock()
+	s := m.servers[name]
+	delete(m.servers, name)
+	m.mu.Unlock()
+
+	if s != nil {
+		s.Stop()
+		m.logger.Debug("Unregistered server", zap.String("server", name))
+	}
+}
@@ -0,0 +1,109 @@
+package cred
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestManagerUnregisterServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp ss2022.CredStore
+	m := NewManager(nil, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.AddCredential("Sam", []byte("abcdef0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unregistering stops the server, which saves the pending change without waiting for the cooldown.
+	m.UnregisterServer("ss-2022")
+	m.UnregisterServer("ss-2022")
+
+	s, err = m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatalf("RegisterServer() after UnregisterServer() failed: %v", err)
+	}
+	if _, ok := s.GetCredential("Sam"); !ok {
+		t.Error("Credential added before UnregisterServer() not saved")
+	}
+}
+
+func TestManagedServerUpdateUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp ss2022.CredStore
+	m := NewManager(nil, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldUPSK := []byte("0123456789abcdef")
+	newUPSK := []byte("abcdef0123456789")
+	quota := Quota{TotalBytes: 1 << 30}
+
+	// An invalid field rejects the whole update.
+	for _, update := range []UserUpdate{
+		{UPSK: newUPSK, Quota: &quota, ACL: &ACL{Deny: ACLRule{Ports: "bogus"}}},
+		{UPSK: newUPSK, Quota: &quota, ACL: &ACL{Allow: ACLRule{Domains: []string{""}}}},
+		{UPSK: []byte("short"), Quota: &quota},
+		{UPSK: oldUPSK, Quota: &quota},
+	} {
+		if err = s.UpdateUser("Alex", update); err == nil {
+			t.Errorf("UpdateUser(%+v) succeeded", update)
+		}
+		uc, ok := s.GetCredential("Alex")
+		if !ok {
+			t.Fatal("user not found")
+		}
+		if !bytes.Equal(uc.UPSK, oldUPSK) || uc.Quota != nil || uc.ACL != nil {
+			t.Errorf("credential after failed UpdateUser(%+v) = %+v, expected unchanged", update, uc)
+		}
+	}
+
+	if err = s.UpdateUser("Nobody", UserUpdate{Quota: &quota}); err == nil {
+		t.Error("UpdateUser succeeded for nonexistent user")
+	}
+
+	if err = s.UpdateUser("Alex", UserUpdate{
+		UPSK:  newUPSK,
+		Quota: &quota,
+		ACL:   &ACL{Deny: ACLRule{Ports: "25"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	uc, ok := s.GetCredential("Alex")
+	if !ok {
+		t.Fatal("user not found")
+	}
+	if !bytes.Equal(uc.UPSK, newUPSK) || uc.Quota == nil || *uc.Quota != quota || uc.ACL == nil || uc.ACL.Deny.Ports != "25" {
+		t.Errorf("credential = %+v, expected the new uPSK, quota and ACL", uc)
+	}
+	tcp.UpdateUserLookupMap(func(ulm ss2022.UserLookupMap) {
+		if _, ok := ulm[ss2022.PSKHash(oldUPSK)]; ok {
+			t.Error("old uPSK still in the credential store")
+		}
+		if _, ok := ulm[ss2022.PSKHash(newUPSK)]; !ok {
+			t.Error("new uPSK not in the credential store")
+		}
+	})
+}
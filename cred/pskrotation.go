@@ -0,0 +1,126 @@
+package cred
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap"
+)
+
+// RotateIdentityPSKs makes the server accept the identity PSKs within their validity periods,
+// instead of the identity PSK it was registered with. The PSKs must have been checked
+// with [ss2022.CheckScheduledPSKs].
+//
+// The PSKs valid now are applied immediately. The rest are applied when their validity periods
+// start or end, after the server is started.
+// It must be called before the server is started.
+func (s *ManagedServer) RotateIdentityPSKs(psks []ss2022.ScheduledPSK) error {
+	iccs := make([]ss2022.ServerIdentityCipherConfig, len(psks))
+	for i, p := range psks {
+		var err error
+		iccs[i], err = ss2022.NewServerIdentityCipherConfig(p.PSK, s.udp != nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.identityPSKs = psks
+	s.identityCipherConfigs = iccs
+	s.updateIdentityPSKs(time.Now())
+	return nil
+}
+
+// updateIdentityPSKs applies the identity PSKs valid at now to the credential stores,
+// and returns when the next identity PSK becomes valid or expires, or the zero time if none will.
+func (s *ManagedServer) updateIdentityPSKs(now time.Time) (next time.Time) {
+	var (
+		active        []int
+		iccs          []ss2022.ServerIdentityCipherConfig
+		preferred     ss2022.ScheduledPSK
+		havePreferred bool
+	)
+
+	for i, p := range s.identityPSKs {
+		if p.ValidAt(now) {
+			active = append(active, i)
+			iccs = append(iccs, s.identityCipherConfigs[i])
+
+			// Prefer the newest PSK for clients, which lasts the longest.
+			if !havePreferred || p.NotBefore.After(preferred.NotBefore) {
+				preferred = p
+				havePreferred = true
+			}
+		}
+
+		for _, t := range [2]time.Time{p.NotBefore, p.NotAfter} {
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+	}
+
+	if s.activeIdentityPSKs != nil && slices.Equal(active, s.activeIdentityPSKs) {
+		return next
+	}
+
+	for _, i := range active {
+		if !slices.Contains(s.activeIdentityPSKs, i) {
+			s.logger.Info("Activated identity PSK",
+				zap.String("server", s.name),
+				zap.Int("index", i),
+			)
+		}
+	}
+	for _, i := range s.activeIdentityPSKs {
+		if !slices.Contains(active, i) {
+			s.logger.Info("Expired identity PSK",
+				zap.String("server", s.name),
+				zap.Int("index", i),
+			)
+		}
+	}
+	if len(active) == 0 {
+		s.logger.Warn("No valid identity PSKs, rejecting all requests", zap.String("server", s.name))
+	}
+
+	if active == nil {
+		active = []int{}
+	}
+	s.activeIdentityPSKs = active
+
+	if havePreferred {
+		s.mu.Lock()
+		s.iPSK = preferred.PSK
+		s.mu.Unlock()
+	}
+
+	if s.tcp != nil {
+		s.tcp.ReplaceIdentityCipherConfigs(iccs)
+	}
+	if s.udp != nil {
+		s.udp.ReplaceIdentityCipherConfigs(iccs)
+	}
+
+	return next
+}
+
+// rotateIdentityPSKs applies the identity PSKs as their validity periods start and end.
+func (s *ManagedServer) rotateIdentityPSKs(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case now := <-timer.C:
+			next := s.updateIdentityPSKs(now)
+			if next.IsZero() {
+				return
+			}
+			timer.Reset(time.Until(next))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
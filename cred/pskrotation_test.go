@@ -0,0 +1,83 @@
+package cred
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestManagedServerRotateIdentityPSKs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPSK := bytes.Repeat([]byte{1}, 16)
+	newPSK := bytes.Repeat([]byte{2}, 16)
+	start := time.Now()
+	overlapStart := start.Add(time.Hour)
+	overlapEnd := start.Add(2 * time.Hour)
+	psks := []ss2022.ScheduledPSK{
+		{PSK: oldPSK, NotAfter: overlapEnd},
+		{PSK: newPSK, NotBefore: overlapStart},
+	}
+
+	var tcp, udp ss2022.CredStore
+	m := NewManager(nil, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, oldPSK, &tcp, &udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RotateIdentityPSKs(psks); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name       string
+		now        time.Time
+		wantActive []int
+		wantIPSK   []byte
+		wantNext   time.Time
+	}{
+		{"BeforeOverlap", start, []int{0}, oldPSK, overlapStart},
+		{"Overlap", overlapStart, []int{0, 1}, newPSK, overlapEnd},
+		{"AfterOverlap", overlapEnd, []int{1}, newPSK, time.Time{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			next := s.updateIdentityPSKs(c.now)
+			if !next.Equal(c.wantNext) {
+				t.Errorf("next = %v, want %v", next, c.wantNext)
+			}
+			if !slices.Equal(s.activeIdentityPSKs, c.wantActive) {
+				t.Errorf("activeIdentityPSKs = %v, want %v", s.activeIdentityPSKs, c.wantActive)
+			}
+
+			// Clients get the newest identity PSK.
+			sip008 := s.ExportSIP008("example.com", 443)
+			if len(sip008.Servers) != 1 {
+				t.Fatalf("len(sip008.Servers) = %d, want 1", len(sip008.Servers))
+			}
+			wantPassword := base64.StdEncoding.EncodeToString(c.wantIPSK) + ":MDEyMzQ1Njc4OWFiY2RlZg=="
+			if sip008.Servers[0].Password != wantPassword {
+				t.Errorf("Password = %q, want %q", sip008.Servers[0].Password, wantPassword)
+			}
+		})
+	}
+
+	// After all PSKs expire, no PSK is active.
+	s.identityPSKs[1].NotAfter = overlapEnd.Add(time.Hour)
+	next := s.updateIdentityPSKs(s.identityPSKs[1].NotAfter)
+	if !next.IsZero() {
+		t.Errorf("next = %v, want zero", next)
+	}
+	if len(s.activeIdentityPSKs) != 0 {
+		t.Errorf("activeIdentityPSKs = %v, want empty", s.activeIdentityPSKs)
+	}
+}
@@ -0,0 +1,114 @@
+package cred
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conntrack"
+)
+
+// Quota stores a user's traffic quotas.
+// Traffic in both directions is counted. Zero values mean unlimited.
+type Quota struct {
+	// TotalBytes is the maximum number of bytes the user may transfer in total.
+	TotalBytes uint64 `json:"totalBytes,omitempty"`
+
+	// MonthlyBytes is the maximum number of bytes the user may transfer in each calendar month (UTC).
+	MonthlyBytes uint64 `json:"monthlyBytes,omitempty"`
+}
+
+// IsUnlimited returns whether the quota imposes no limit.
+func (q Quota) IsUnlimited() bool {
+	return q.TotalBytes == 0 && q.MonthlyBytes == 0
+}
+
+// exceeded returns whether the usage has reached the quota in the given month.
+func (q Quota) exceeded(u Usage, month string) bool {
+	return q.TotalBytes != 0 && u.TotalBytes >= q.TotalBytes ||
+		q.MonthlyBytes != 0 && u.Month == month && u.MonthlyBytes >= q.MonthlyBytes
+}
+
+// Usage stores a user's traffic usage counted against its quota.
+type Usage struct {
+	// TotalBytes is the number of bytes transferred in total.
+	TotalBytes uint64 `json:"totalBytes"`
+
+	// MonthlyBytes is the number of bytes transferred in Month.
+	MonthlyBytes uint64 `json:"monthlyBytes"`
+
+	// Month is the calendar month (UTC) of MonthlyBytes in the format "2006-01".
+	Month string `json:"month,omitempty"`
+}
+
+// IsZero returns whether no traffic has been counted.
+func (u Usage) IsZero() bool {
+	return u.TotalBytes == 0 && u.MonthlyBytes == 0
+}
+
+// add adds n bytes to the usage, resetting the monthly usage if month has changed.
+func (u *Usage) add(n uint64, month string) {
+	u.rollover(month)
+	u.TotalBytes += n
+	u.MonthlyBytes += n
+}
+
+// rollover resets the monthly usage if month has changed.
+// It returns whether the usage has been modified.
+func (u *Usage) rollover(month string) bool {
+	if u.Month == month {
+		return false
+	}
+	u.MonthlyBytes = 0
+	u.Month = month
+	return true
+}
+
+// monthOf returns the calendar month (UTC) of t in the format "2006-01".
+func monthOf(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// userFileEntry is a user's entry in the credential file.
+//
+// For compatibility with existing files, users without quota, usage or ACL
+// are stored as just the base64-encoded uPSK.
+type userFileEntry struct {
+	UPSK  []byte `json:"uPSK"`
+	Quota *Quota `json:"quota,omitempty"`
+	Usage *Usage `json:"usage,omitempty"`
+	ACL   *ACL   `json:"acl,omitempty"`
+}
+
+// userFileEntryObject has the same fields as userFileEntry, without the custom JSON methods.
+type userFileEntryObject userFileEntry
+
+// MarshalJSON implements the json.Marshaler MarshalJSON method.
+func (e userFileEntry) MarshalJSON() ([]byte, error) {
+	if e.Quota == nil && e.Usage == nil && e.ACL == nil {
+		return json.Marshal(e.UPSK)
+	}
+	return json.Marshal(userFileEntryObject(e))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler UnmarshalJSON method.
+func (e *userFileEntry) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &e.UPSK)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode((*userFileEntryObject)(e))
+}
+
+// SetConnTable sets the table of the server's live connections and sessions.
+//
+// Users' traffic is counted against their quotas from the table as it is relayed,
+// and the live connections and sessions of users who reach their quotas are terminated.
+// It must be called before the relays start.
+func (s *ManagedServer) SetConnTable(t *conntrack.Table) {
+	s.connTable = t
+	t.SetUsageFunc(func(username string, n uint64) {
+		s.addTraffic(username, n, time.Now())
+	})
+}
@@ -0,0 +1,260 @@
+package cred
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUserFileEntryJSON(t *testing.T) {
+	uPSK := []byte("0123456789abcdef")
+
+	b, err := json.Marshal(userFileEntry{UPSK: uPSK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"MDEyMzQ1Njc4OWFiY2RlZg=="`; string(b) != want {
+		t.Errorf("marshaled entry without quota = %s, want %s", b, want)
+	}
+
+	var e userFileEntry
+	if err = json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(e.UPSK, uPSK) || e.Quota != nil || e.Usage != nil {
+		t.Errorf("unmarshaled entry = %+v, want uPSK only", e)
+	}
+
+	b, err = json.Marshal(userFileEntry{
+		UPSK:  uPSK,
+		Quota: &Quota{MonthlyBytes: 100},
+		Usage: &Usage{TotalBytes: 10, MonthlyBytes: 10, Month: "2026-10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e = userFileEntry{}
+	if err = json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(e.UPSK, uPSK) || e.Quota == nil || *e.Quota != (Quota{MonthlyBytes: 100}) || e.Usage == nil || *e.Usage != (Usage{10, 10, "2026-10"}) {
+		t.Errorf("unmarshaled entry = %+v, want uPSK, quota and usage", e)
+	}
+
+	if err = json.Unmarshal([]byte(`{"uPSK":"MDEyMzQ1Njc4OWFiY2RlZg==","bogus":1}`), &e); err == nil {
+		t.Error("unmarshaling entry with unknown field succeeded")
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		quota Quota
+		usage Usage
+		want  bool
+	}{
+		{"Unlimited", Quota{}, Usage{TotalBytes: 1 << 40, MonthlyBytes: 1 << 40, Month: "2026-10"}, false},
+		{"TotalBelow", Quota{TotalBytes: 100}, Usage{TotalBytes: 99}, false},
+		{"TotalReached", Quota{TotalBytes: 100}, Usage{TotalBytes: 100}, true},
+		{"MonthlyBelow", Quota{MonthlyBytes: 100}, Usage{MonthlyBytes: 99, Month: "2026-10"}, false},
+		{"MonthlyReached", Quota{MonthlyBytes: 100}, Usage{MonthlyBytes: 100, Month: "2026-10"}, true},
+		{"MonthlyReachedLastMonth", Quota{MonthlyBytes: 100}, Usage{MonthlyBytes: 100, Month: "2026-09"}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.quota.exceeded(c.usage, "2026-10"); got != c.want {
+				t.Errorf("exceeded = %t, want %t", got, c.want)
+			}
+		})
+	}
+}
+
+func TestManagedServerQuota(t *testing.T) {
+	const (
+		username = "Alex"
+		quota    = 1000
+	)
+	uPSK := []byte("0123456789abcdef")
+	uPSKHash := ss2022.PSKHash(uPSK)
+
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":{"uPSK":"MDEyMzQ1Njc4OWFiY2RlZg==","quota":{"monthlyBytes":1000}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := event.NewBus(0, 0)
+	sub := bus.Subscribe(1, event.KindQuotaExceeded)
+	defer sub.Close()
+
+	var tcp ss2022.CredStore
+	m := NewManager(bus, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, len(uPSK)), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inProd := func() (ok bool) {
+		tcp.UpdateUserLookupMap(func(ulm ss2022.UserLookupMap) {
+			_, ok = ulm[uPSKHash]
+		})
+		return
+	}
+
+	if !inProd() {
+		t.Fatal("user not in production user lookup map")
+	}
+
+	now := time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+	s.addTraffic(username, quota-1, now)
+	if !inProd() {
+		t.Fatal("user suspended before reaching quota")
+	}
+
+	s.addTraffic(username, 1, now)
+	if inProd() {
+		t.Fatal("user not suspended after reaching quota")
+	}
+
+	select {
+	case e := <-sub.Events():
+		if e.Kind != event.KindQuotaExceeded || e.Server != "ss-2022" || e.Username != username {
+			t.Errorf("event = %+v, want quota exceeded for %s", e, username)
+		}
+	default:
+		t.Error("no quota exceeded event published")
+	}
+
+	uc, ok := s.GetCredential(username)
+	if !ok {
+		t.Fatal("user not found")
+	}
+	if !uc.QuotaExceeded || uc.Usage == nil || uc.Usage.MonthlyBytes != quota {
+		t.Errorf("credential = %+v, want quota exceeded with monthly usage %d", uc, quota)
+	}
+
+	// Same month: still suspended.
+	s.resetMonthlyUsage(now.Add(time.Hour))
+	if inProd() {
+		t.Fatal("user restored before monthly quota reset")
+	}
+
+	// Next month: restored.
+	s.resetMonthlyUsage(now.AddDate(0, 1, 0))
+	if !inProd() {
+		t.Fatal("user not restored after monthly quota reset")
+	}
+
+	// Raising the quota of a suspended user restores the user.
+	s.addTraffic(username, quota, now.AddDate(0, 1, 0))
+	if inProd() {
+		t.Fatal("user not suspended after reaching quota")
+	}
+	if err = s.SetQuota(username, Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	if !inProd() {
+		t.Fatal("user not restored after removing quota")
+	}
+
+	// Suspension survives a reload.
+	if err = s.SetQuota(username, Quota{TotalBytes: quota}); err != nil {
+		t.Fatal(err)
+	}
+	if inProd() {
+		t.Fatal("user not suspended after lowering quota")
+	}
+	s.mu.Lock()
+	if err = s.saveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	s.cachedContent = ""
+	s.mu.Unlock()
+	if err = s.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if inProd() {
+		t.Fatal("user restored after reload")
+	}
+
+	if err = s.ResetUsage(username); err != nil {
+		t.Fatal(err)
+	}
+	if !inProd() {
+		t.Fatal("user not restored after resetting usage")
+	}
+}
+
+func TestManagedServerQuotaConnTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":{"uPSK":"MDEyMzQ1Njc4OWFiY2RlZg==","quota":{"totalBytes":1000}},"Sam":"YWJjZGVmMDEyMzQ1Njc4OQ=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp ss2022.CredStore
+	m := NewManager(nil, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var table conntrack.Table
+	s.SetConnTable(&table)
+
+	var closed []string
+	add := func(username string) *conntrack.Entry {
+		var e *conntrack.Entry
+		e = table.Add("tcp", netip.AddrPort{}, username, conn.Addr{}, "direct", func() {
+			closed = append(closed, username)
+			e.Remove()
+		})
+		return e
+	}
+
+	alex1 := add("Alex")
+	alex2 := add("Alex")
+	sam := add("Sam")
+
+	// Traffic of live connections counts against the quota.
+	alex1.AddUplinkBytes(600)
+	sam.AddUplinkBytes(5000)
+	table.ReportUsage()
+
+	uc, _ := s.GetCredential("Alex")
+	if uc.Usage == nil || uc.Usage.TotalBytes != 600 || uc.QuotaExceeded {
+		t.Fatalf("credential = %+v, want 600 bytes used within quota", uc)
+	}
+	if len(closed) != 0 {
+		t.Fatalf("closed = %v, want none", closed)
+	}
+
+	// Reaching the quota terminates all of the user's connections.
+	alex2.AddDownlinkBytes(400)
+	table.ReportUsage()
+
+	uc, _ = s.GetCredential("Alex")
+	if uc.Usage == nil || uc.Usage.TotalBytes != 1000 || !uc.QuotaExceeded {
+		t.Errorf("credential = %+v, want quota exceeded with 1000 bytes used", uc)
+	}
+	if len(closed) != 2 || closed[0] != "Alex" || closed[1] != "Alex" {
+		t.Errorf("closed = %v, want both of Alex's connections", closed)
+	}
+	if conns := table.Snapshot(); len(conns) != 1 || conns[0].Username != "Sam" {
+		t.Errorf("conns = %+v, want only Sam's connection", conns)
+	}
+
+	// Users without a quota are not affected.
+	sam.Remove()
+	if uc, _ = s.GetCredential("Sam"); uc.Usage != nil || uc.QuotaExceeded {
+		t.Errorf("credential = %+v, want no usage", uc)
+	}
+}
@@ -0,0 +1,222 @@
+package cred
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/database64128/shadowsocks-go/sip002"
+	"lukechampine.com/blake3"
+)
+
+// SIP008Config is a SIP008 online configuration delivery document.
+type SIP008Config struct {
+	Version int            `json:"version"`
+	Servers []SIP008Server `json:"servers"`
+}
+
+// SIP008Server is a server entry in a SIP008 document.
+type SIP008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort uint16 `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+
+	// Plugin is the name of the SIP003 plugin, if any.
+	Plugin string `json:"plugin,omitempty"`
+
+	// PluginOpts is the options of the SIP003 plugin.
+	PluginOpts string `json:"plugin_opts,omitempty"`
+
+	// URL is the SIP002 ss:// URL of the server entry.
+	// It is not part of SIP008, and is ignored by clients that do not recognize it.
+	URL string `json:"url,omitempty"`
+}
+
+// maxSIP008DocumentSize is the maximum size of a fetched SIP008 document.
+const maxSIP008DocumentSize = 4 << 20
+
+// FetchSIP008 fetches the SIP008 document at url with client.
+func FetchSIP008(ctx context.Context, client *http.Client, url string) (*SIP008Config, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxSIP008DocumentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxSIP008DocumentSize {
+		return nil, fmt.Errorf("document exceeds %d bytes", maxSIP008DocumentSize)
+	}
+
+	var cfg SIP008Config
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode document: %w", err)
+	}
+	if cfg.Version != 1 {
+		return nil, fmt.Errorf("unsupported SIP008 version: %d", cfg.Version)
+	}
+	return &cfg, nil
+}
+
+// sip008ID returns a stable UUID for the user's server entry.
+func sip008ID(serverName, username string) string {
+	h := blake3.New(16, nil)
+	h.Write([]byte(serverName))
+	h.Write([]byte{0})
+	h.Write([]byte(username))
+	var id [16]byte
+	h.Sum(id[:0])
+	id[6] = id[6]&0x0f | 0x80 // version 8
+	id[8] = id[8]&0x3f | 0x80 // variant 10
+
+	var b [36]byte
+	hex.Encode(b[0:8], id[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], id[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], id[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], id[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], id[10:])
+	return string(b[:])
+}
+
+// sip008Server returns the server entry of the user at host and port, named remarks.
+func (s *ManagedServer) sip008Server(b64iPSK, username string, uPSK []byte, remarks, host string, port uint16) SIP008Server {
+	password := b64iPSK + ":" + base64.StdEncoding.EncodeToString(uPSK)
+	u := sip002.URL{
+		Method:   s.method,
+		Password: password,
+		Host:     host,
+		Port:     port,
+		Name:     remarks,
+	}
+	return SIP008Server{
+		ID:         sip008ID(s.name, username),
+		Remarks:    remarks,
+		Server:     host,
+		ServerPort: port,
+		Password:   password,
+		Method:     s.method,
+		URL:        u.String(),
+	}
+}
+
+// ExportSIP008 returns all users of the server as a SIP008 document,
+// with each user as a server entry at host and port named after the username.
+func (s *ManagedServer) ExportSIP008(host string, port uint16) SIP008Config {
+	ucs := s.Credentials()
+	s.mu.RLock()
+	iPSK := base64.StdEncoding.EncodeToString(s.iPSK)
+	s.mu.RUnlock()
+
+	servers := make([]SIP008Server, len(ucs))
+	for i, uc := range ucs {
+		servers[i] = s.sip008Server(iPSK, uc.Name, uc.UPSK, uc.Name, host, port)
+	}
+
+	return SIP008Config{
+		Version: 1,
+		Servers: servers,
+	}
+}
+
+// UserSIP008Server returns the user's server entry at host and port named after the server,
+// for the user's own SIP008 document, and whether the user exists.
+//
+// The entry has the same ID as in [ManagedServer.ExportSIP008], and always has the current
+// identity PSK and uPSK, so that clients pick up rotated PSKs on their next update.
+func (s *ManagedServer) UserSIP008Server(username, host string, port uint16) (SIP008Server, bool) {
+	s.mu.RLock()
+	cachedCred := s.cachedCredMap[username]
+	if cachedCred == nil {
+		s.mu.RUnlock()
+		return SIP008Server{}, false
+	}
+	uPSK := cachedCred.uPSK
+	iPSK := base64.StdEncoding.EncodeToString(s.iPSK)
+	s.mu.RUnlock()
+	return s.sip008Server(iPSK, username, uPSK, s.name, host, port), true
+}
+
+// UsersFromSIP008 returns the users in the SIP008 document.
+//
+// Each server entry becomes a user named after its remarks, or its ID if remarks is empty.
+// The uPSK is the last PSK in the password, so that entries of both
+// single-user and multi-user Shadowsocks 2022 servers can be imported.
+func UsersFromSIP008(cfg *SIP008Config) ([]UserCredential, error) {
+	if cfg.Version != 1 {
+		return nil, fmt.Errorf("unsupported SIP008 version: %d", cfg.Version)
+	}
+
+	ucs := make([]UserCredential, len(cfg.Servers))
+	for i, server := range cfg.Servers {
+		username := server.Remarks
+		if username == "" {
+			username = server.ID
+		}
+
+		password := server.Password
+		if j := strings.LastIndexByte(password, ':'); j != -1 {
+			password = password[j+1:]
+		}
+		uPSK, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode uPSK of user %s: %w", username, err)
+		}
+
+		ucs[i] = UserCredential{
+			Name: username,
+			UPSK: uPSK,
+		}
+	}
+	return ucs, nil
+}
+
+// UsersFromUPSKMap returns the users in b, which is in the format of the uPSK store file.
+func UsersFromUPSKMap(b []byte) ([]UserCredential, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	var userMap map[string]userFileEntry
+	if err := d.Decode(&userMap); err != nil {
+		return nil, err
+	}
+	if userMap == nil {
+		return nil, errors.New("uPSK map is null")
+	}
+
+	ucs := make([]UserCredential, 0, len(userMap))
+	for username, entry := range userMap {
+		ucs = append(ucs, UserCredential{
+			Name:  username,
+			UPSK:  entry.UPSK,
+			Quota: entry.Quota,
+			Usage: entry.Usage,
+			ACL:   entry.ACL,
+		})
+	}
+	return ucs, nil
+}
@@ -0,0 +1,131 @@
+package cred
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSIP008ExportImport(t *testing.T) {
+	const method = "2022-blake3-aes-128-gcm"
+	iPSK := []byte("fedcba9876543210")
+	m := NewManager(nil, zaptest.NewLogger(t))
+
+	newServer := func(name, content string) (*ManagedServer, *ss2022.CredStore) {
+		path := filepath.Join(t.TempDir(), "upsks.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var tcp ss2022.CredStore
+		s, err := m.RegisterServer(name, method, path, iPSK, &tcp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, &tcp
+	}
+
+	src, _ := newServer("src", `{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg==","Sam":"YWJjZGVmMDEyMzQ1Njc4OQ=="}`)
+	dst, dstTCP := newServer("dst", `{"Alex":"MTIzNDU2Nzg5YWJjZGVmMA=="}`)
+
+	cfg := src.ExportSIP008("example.com", 20220)
+	if cfg.Version != 1 || len(cfg.Servers) != 2 {
+		t.Fatalf("exported config = %+v, want 2 servers", cfg)
+	}
+	server := cfg.Servers[0]
+	if server.Remarks != "Alex" || server.Server != "example.com" || server.ServerPort != 20220 || server.Method != method {
+		t.Errorf("server = %+v, want Alex at example.com:20220", server)
+	}
+	if want := "ZmVkY2JhOTg3NjU0MzIxMA==:MDEyMzQ1Njc4OWFiY2RlZg=="; server.Password != want {
+		t.Errorf("password = %q, want %q", server.Password, want)
+	}
+	if want := "ss://2022-blake3-aes-128-gcm:ZmVkY2JhOTg3NjU0MzIxMA==%3AMDEyMzQ1Njc4OWFiY2RlZg==@example.com:20220#Alex"; server.URL != want {
+		t.Errorf("URL = %q, want %q", server.URL, want)
+	}
+	if server.ID != src.ExportSIP008("example.com", 20220).Servers[0].ID {
+		t.Error("server ID is not stable")
+	}
+
+	ucs, err := UsersFromSIP008(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alex already exists on dst, so nothing is imported.
+	if err = dst.ImportCredentials(ucs); err == nil {
+		t.Fatal("import with existing user succeeded")
+	}
+	if _, ok := dst.GetCredential("Sam"); ok {
+		t.Fatal("import with existing user was partially applied")
+	}
+
+	if err = dst.DeleteCredential("Alex"); err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.ImportCredentials(ucs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range src.Credentials() {
+		got, ok := dst.GetCredential(want.Name)
+		if !ok || !bytes.Equal(got.UPSK, want.UPSK) {
+			t.Errorf("imported credential = %+v, want %+v", got, want)
+		}
+		var inProd bool
+		dstTCP.UpdateUserLookupMap(func(ulm ss2022.UserLookupMap) {
+			_, inProd = ulm[ss2022.PSKHash(want.UPSK)]
+		})
+		if !inProd {
+			t.Errorf("user %s not in production user lookup map", want.Name)
+		}
+	}
+}
+
+func TestUsersFromUPSKMap(t *testing.T) {
+	ucs, err := UsersFromUPSKMap([]byte(`{"Alex":{"uPSK":"MDEyMzQ1Njc4OWFiY2RlZg==","quota":{"totalBytes":1000}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ucs) != 1 || ucs[0].Name != "Alex" || ucs[0].Quota == nil || ucs[0].Quota.TotalBytes != 1000 {
+		t.Errorf("users = %+v, want Alex with quota", ucs)
+	}
+
+	if _, err = UsersFromUPSKMap([]byte(`null`)); err == nil {
+		t.Error("parsing null uPSK map succeeded")
+	}
+}
+
+func TestFetchSIP008(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"version":1,"servers":[{"id":"1","remarks":"Tokyo","server":"example.com","server_port":20220,"password":"MDEyMzQ1Njc4OWFiY2RlZg==","method":"2022-blake3-aes-128-gcm","plugin":"v2ray-plugin","plugin_opts":"tls"}]}`)
+	})
+	mux.HandleFunc("/v2", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"version":2,"servers":[]}`)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, maxSIP008DocumentSize+1))
+	})
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	cfg, err := FetchSIP008(context.Background(), srv.Client(), srv.URL+"/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Servers) != 1 || cfg.Servers[0].Remarks != "Tokyo" || cfg.Servers[0].ServerPort != 20220 || cfg.Servers[0].Plugin != "v2ray-plugin" || cfg.Servers[0].PluginOpts != "tls" {
+		t.Errorf("servers = %+v, want Tokyo with v2ray-plugin", cfg.Servers)
+	}
+
+	for _, path := range []string{"/v2", "/large", "/missing"} {
+		if _, err := FetchSIP008(context.Background(), srv.Client(), srv.URL+path); err == nil {
+			t.Errorf("fetching %s succeeded, want error", path)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cred
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// watchDebounceDelay is the time to wait after the last change to the credential file
+// before reloading it. Editors and tools often write a file in multiple steps.
+const watchDebounceDelay = 500 * time.Millisecond
+
+// WatchFile makes the managed server watch its credential file for changes
+// when started, and reload credentials automatically.
+//
+// Writes made by the managed server itself do not trigger reloads,
+// as [ManagedServer.LoadFromFile] skips unchanged file content.
+func (s *ManagedServer) WatchFile() {
+	s.watchFile = true
+}
+
+// newWatcher returns a watcher of the directory of the credential file.
+// The directory is watched instead of the file, so that the file can be replaced by renaming.
+func (s *ManagedServer) newWatcher() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = w.Add(filepath.Dir(s.path)); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// watch reloads credentials when the credential file changes, until ctx is canceled.
+func (s *ManagedServer) watch(ctx context.Context, w *fsnotify.Watcher) {
+	defer w.Close()
+
+	path := filepath.Clean(s.path)
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			timer.Reset(watchDebounceDelay)
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			s.logger.Warn("Failed to watch credential file",
+				zap.String("server", s.name),
+				zap.String("path", s.path),
+				zap.Error(err),
+			)
+
+		case <-timer.C:
+			if err := s.LoadFromFile(); err != nil {
+				s.logger.Warn("Failed to reload credentials after file change",
+					zap.String("server", s.name),
+					zap.Error(err),
+				)
+				continue
+			}
+			s.logger.Debug("Reloaded credentials after file change", zap.String("server", s.name))
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
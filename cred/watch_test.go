@@ -0,0 +1,56 @@
+package cred
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestManagedServerWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upsks.json")
+	if err := os.WriteFile(path, []byte(`{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tcp ss2022.CredStore
+	m := NewManager(nil, zaptest.NewLogger(t))
+	s, err := m.RegisterServer("ss-2022", "2022-blake3-aes-128-gcm", path, make([]byte, 16), &tcp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WatchFile()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		s.Stop()
+	}()
+
+	// Replace the file by renaming, like most editors do.
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, []byte(`{"Alex":"MDEyMzQ1Njc4OWFiY2RlZg==","Sam":"YWJjZGVmMDEyMzQ1Njc4OQ=="}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.GetCredential("Sam"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("credential file change not applied")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,70 @@
+package direct
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/socks5"
+)
+
+// ErrUpstreamAuthFailed is returned when an upstream proxy rejects the credential.
+var ErrUpstreamAuthFailed = errors.New("upstream proxy authentication failed")
+
+// isUpstreamAuthError returns whether err indicates that the upstream proxy rejected the credential.
+func isUpstreamAuthError(err error) bool {
+	return errors.Is(err, ErrUpstreamAuthFailed) || errors.Is(err, socks5.ErrAuthenticationFailed)
+}
+
+// UpstreamCredential is a username and password for authenticating to an upstream proxy.
+type UpstreamCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// UpstreamCredentialList is a list of credentials for an upstream proxy.
+//
+// The current credential is used until the upstream proxy rejects it.
+// Then the next credential in the list is tried, and the first one accepted
+// becomes the current credential. This allows credentials rotated by the upstream
+// to be configured ahead of time.
+//
+// The zero value and a nil list use no credential.
+type UpstreamCredentialList struct {
+	credentials []UpstreamCredential
+	current     atomic.Uint32
+}
+
+// NewUpstreamCredentialList returns a new credential list.
+func NewUpstreamCredentialList(credentials []UpstreamCredential) *UpstreamCredentialList {
+	return &UpstreamCredentialList{
+		credentials: credentials,
+	}
+}
+
+// Do calls f with the current credential, failing over to the next credential
+// and calling f again whenever f returns an authentication error.
+// f should establish a new connection each time it is called.
+//
+// It returns the error from the last call to f.
+func (l *UpstreamCredentialList) Do(f func(UpstreamCredential) error) error {
+	if l == nil || len(l.credentials) == 0 {
+		return f(UpstreamCredential{})
+	}
+
+	n := uint32(len(l.credentials))
+	start := l.current.Load()
+	var err error
+
+	for i := range n {
+		index := (start + i) % n
+		err = f(l.credentials[index])
+		if !isUpstreamAuthError(err) {
+			if i > 0 {
+				l.current.CompareAndSwap(start, index)
+			}
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,74 @@
+package direct
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestUpstreamCredentialListDo(t *testing.T) {
+	l := NewUpstreamCredentialList([]UpstreamCredential{
+		{Username: "old", Password: "old"},
+		{Username: "new", Password: "new"},
+	})
+
+	var tried []string
+	accept := func(username string) func(UpstreamCredential) error {
+		return func(c UpstreamCredential) error {
+			tried = append(tried, c.Username)
+			if c.Username != username {
+				return fmt.Errorf("dial: %w", ErrUpstreamAuthFailed)
+			}
+			return nil
+		}
+	}
+
+	if err := l.Do(accept("new")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[old new]"; fmt.Sprint(tried) != want {
+		t.Errorf("tried = %v, want %s", tried, want)
+	}
+
+	// The accepted credential is tried first from now on.
+	tried = nil
+	if err := l.Do(accept("new")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[new]"; fmt.Sprint(tried) != want {
+		t.Errorf("tried = %v, want %s", tried, want)
+	}
+
+	// Non-authentication errors do not cause failover.
+	tried = nil
+	errDial := errors.New("connection refused")
+	if err := l.Do(func(c UpstreamCredential) error {
+		tried = append(tried, c.Username)
+		return errDial
+	}); err != errDial {
+		t.Errorf("err = %v, want %v", err, errDial)
+	}
+	if want := "[new]"; fmt.Sprint(tried) != want {
+		t.Errorf("tried = %v, want %s", tried, want)
+	}
+
+	// All credentials rejected.
+	tried = nil
+	if err := l.Do(accept("none")); !errors.Is(err, ErrUpstreamAuthFailed) {
+		t.Errorf("err = %v, want %v", err, ErrUpstreamAuthFailed)
+	}
+	if want := "[new old]"; fmt.Sprint(tried) != want {
+		t.Errorf("tried = %v, want %s", tried, want)
+	}
+
+	// A nil list uses no credential.
+	var nl *UpstreamCredentialList
+	if err := nl.Do(func(c UpstreamCredential) error {
+		if c != (UpstreamCredential{}) {
+			return fmt.Errorf("credential = %+v, want zero value", c)
+		}
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
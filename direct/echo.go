@@ -0,0 +1,191 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// EchoTCPClient is a client that echoes everything sent to it back to the sender,
+// regardless of the target address. It is useful for testing without external hosts.
+//
+// EchoTCPClient implements the zerocopy TCPClient interface.
+type EchoTCPClient struct {
+	name string
+}
+
+// NewEchoTCPClient returns a new echo TCP client.
+func NewEchoTCPClient(name string) *EchoTCPClient {
+	return &EchoTCPClient{
+		name: name,
+	}
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+func (c *EchoTCPClient) Info() zerocopy.TCPClientInfo {
+	return zerocopy.TCPClientInfo{
+		Name:                 c.name,
+		NativeInitialPayload: true,
+	}
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *EchoTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	pr, pw := io.Pipe()
+	rawRW = &echoStream{
+		r:       pr,
+		w:       pw,
+		payload: payload,
+	}
+	rw = &DirectStreamReadWriter{rw: rawRW}
+	return
+}
+
+// echoStream is a stream whose reads return what has been written to it.
+// The initial payload is returned by the first reads.
+type echoStream struct {
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	payload []byte
+}
+
+// Read implements [io.Reader.Read].
+func (s *echoStream) Read(b []byte) (int, error) {
+	if len(s.payload) > 0 {
+		n := copy(b, s.payload)
+		s.payload = s.payload[n:]
+		return n, nil
+	}
+	return s.r.Read(b)
+}
+
+// Write implements [io.Writer.Write].
+func (s *echoStream) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+// CloseRead implements the zerocopy.CloseRead CloseRead method.
+func (s *echoStream) CloseRead() error {
+	return s.r.Close()
+}
+
+// CloseWrite implements the zerocopy.CloseWrite CloseWrite method.
+func (s *echoStream) CloseWrite() error {
+	return s.w.Close()
+}
+
+// Close implements [io.Closer.Close].
+func (s *echoStream) Close() error {
+	_ = s.r.Close() // always returns nil
+	_ = s.w.Close() // always returns nil
+	return nil
+}
+
+// EchoUDPClient is a client that echoes every packet back to the sender,
+// as if it were sent back by the target. It is useful for testing without external hosts.
+//
+// Each session is served by its own echo socket on the IPv4 loopback address.
+// Packets are framed with their target addresses in the Shadowsocks none format,
+// so that the echoed packets carry their own source addresses. Packets to domain
+// targets are echoed from the unspecified IPv4 address and the target port.
+//
+// EchoUDPClient implements the zerocopy UDPClient interface.
+type EchoUDPClient struct {
+	info zerocopy.UDPClientInfo
+}
+
+// NewEchoUDPClient returns a new echo UDP client.
+func NewEchoUDPClient(name string, mtu int, listenConfig conn.ListenConfig) *EchoUDPClient {
+	return &EchoUDPClient{
+		info: zerocopy.UDPClientInfo{
+			Name:           name,
+			PackerHeadroom: ShadowsocksNonePacketClientMessageHeadroom,
+			MTU:            mtu,
+			ListenConfig:   listenConfig,
+		},
+	}
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *EchoUDPClient) Info() zerocopy.UDPClientInfo {
+	return c.info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *EchoUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	echoConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to listen for echo socket: %w", err)
+	}
+	go serveUDPEcho(echoConn)
+
+	echoAddrPort := echoConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	maxPacketSize := zerocopy.MaxPacketSizeForAddr(c.info.MTU, echoAddrPort.Addr())
+
+	return c.info, zerocopy.UDPClientSession{
+		MaxPacketSize: maxPacketSize,
+		Packer:        NewShadowsocksNonePacketClientPacker(echoAddrPort, maxPacketSize),
+		Unpacker:      &EchoPacketClientUnpacker{echoAddrPort: echoAddrPort},
+		Close:         echoConn.Close,
+	}, nil
+}
+
+// serveUDPEcho sends every packet received on echoConn back to its sender,
+// until echoConn is closed.
+func serveUDPEcho(echoConn *net.UDPConn) {
+	b := make([]byte, 65535)
+	for {
+		n, addrPort, err := echoConn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		_, _ = echoConn.WriteToUDPAddrPort(b[:n], addrPort)
+	}
+}
+
+// EchoPacketClientUnpacker unpacks packets echoed by an echo socket.
+//
+// EchoPacketClientUnpacker implements the zerocopy ClientUnpacker interface.
+type EchoPacketClientUnpacker struct {
+	echoAddrPort netip.AddrPort
+}
+
+// ClientUnpackerInfo implements the zerocopy.ClientUnpacker ClientUnpackerInfo method.
+//
+// The stripped target address can be shorter than the source address the server packer writes back,
+// as with short domain targets, so no headroom is reported, and relays reserve the packer's full headroom.
+func (EchoPacketClientUnpacker) ClientUnpackerInfo() zerocopy.ClientUnpackerInfo {
+	return zerocopy.ClientUnpackerInfo{}
+}
+
+// UnpackInPlace implements the zerocopy.ClientUnpacker UnpackInPlace method.
+func (p *EchoPacketClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	if !conn.AddrPortMappedEqual(packetSourceAddrPort, p.echoAddrPort) {
+		err = fmt.Errorf("dropped packet from non-echo source %s", packetSourceAddrPort)
+		return
+	}
+
+	targetAddr, targetAddrLen, err := socks5.ConnAddrFromSlice(b[packetStart : packetStart+packetLen])
+	if err != nil {
+		return
+	}
+
+	if targetAddr.IsIP() {
+		payloadSourceAddrPort = targetAddr.IPPort()
+	} else {
+		payloadSourceAddrPort = netip.AddrPortFrom(netip.IPv4Unspecified(), targetAddr.Port())
+	}
+	payloadStart = packetStart + targetAddrLen
+	payloadLen = packetLen - targetAddrLen
+	return
+}
@@ -0,0 +1,109 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+func TestEchoTCPClient(t *testing.T) {
+	c := NewEchoTCPClient("echo")
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+	payload := []byte("initial payload")
+
+	rawRW, _, err := c.Dial(context.Background(), targetAddr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawRW.Close()
+
+	b := make([]byte, len(payload))
+	if _, err = io.ReadFull(rawRW, b); err != nil {
+		t.Fatalf("failed to read initial payload: %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Errorf("echoed initial payload = %q, want %q", b, payload)
+	}
+
+	data := []byte("hello, echo")
+	go func() {
+		_, _ = rawRW.Write(data)
+		_ = rawRW.CloseWrite()
+	}()
+
+	b, err = io.ReadAll(rawRW)
+	if err != nil {
+		t.Fatalf("failed to read echoed data: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("echoed data = %q, want %q", b, data)
+	}
+}
+
+func testEchoUDPClient(t *testing.T, targetAddr conn.Addr, wantSourceAddrPort netip.AddrPort) {
+	c := NewEchoUDPClient("echo", 1500, conn.DefaultUDPClientListenConfig)
+	_, session, err := c.NewSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	payload := []byte("hello, echo")
+	headroom := session.Packer.ClientPackerInfo().Headroom
+	b := make([]byte, headroom.Front+session.MaxPacketSize+headroom.Rear)
+	copy(b[headroom.Front:], payload)
+
+	destAddrPort, packetStart, packetLen, err := session.Packer.PackInPlace(context.Background(), b, targetAddr, headroom.Front, len(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = uc.WriteToUDPAddrPort(b[packetStart:packetStart+packetLen], destAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = uc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, packetSourceAddrPort, err := uc.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloadSourceAddrPort, payloadStart, payloadLen, err := session.Unpacker.UnpackInPlace(b, packetSourceAddrPort, 0, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payloadSourceAddrPort != wantSourceAddrPort {
+		t.Errorf("payloadSourceAddrPort = %v, want %v", payloadSourceAddrPort, wantSourceAddrPort)
+	}
+	if echoed := b[payloadStart : payloadStart+payloadLen]; !bytes.Equal(echoed, payload) {
+		t.Errorf("echoed payload = %q, want %q", echoed, payload)
+	}
+
+	// Packets from other sources are dropped.
+	if _, _, _, err = session.Unpacker.UnpackInPlace(b, netip.MustParseAddrPort("127.0.0.1:1"), 0, n); err == nil {
+		t.Error("UnpackInPlace accepted packet from non-echo source")
+	}
+}
+
+func TestEchoUDPClient(t *testing.T) {
+	t.Run("IP", func(t *testing.T) {
+		targetAddrPort := netip.MustParseAddrPort("[2001:db8::1]:53")
+		testEchoUDPClient(t, conn.AddrFromIPPort(targetAddrPort), targetAddrPort)
+	})
+	t.Run("Domain", func(t *testing.T) {
+		testEchoUDPClient(t, conn.MustAddrFromDomainPort("example.com", 53), netip.AddrPortFrom(netip.IPv4Unspecified(), 53))
+	})
+}
@@ -23,6 +23,9 @@ type DirectPacketClientPacker struct {
 	// network controls the address family of a domain target's resolved IP address.
 	network string
 
+	// policy further controls the address family of a domain target's resolved IP address.
+	policy conn.IPFamilyPolicy
+
 	// mtu is used in the PackInPlace method to determine whether the payload is too big.
 	mtu int
 }
@@ -35,6 +38,15 @@ func NewDirectPacketClientPacker(network string, mtu int) *DirectPacketClientPac
 	}
 }
 
+// WithIPFamilyPolicy returns a new packer like p, but resolves domain targets by policy.
+func (p *DirectPacketClientPacker) WithIPFamilyPolicy(policy conn.IPFamilyPolicy) *DirectPacketClientPacker {
+	return &DirectPacketClientPacker{
+		network: p.network,
+		policy:  policy,
+		mtu:     p.mtu,
+	}
+}
+
 // ClientPackerInfo implements the zerocopy.ClientPacker ClientPackerInfo method.
 func (DirectPacketClientPacker) ClientPackerInfo() zerocopy.ClientPackerInfo {
 	return zerocopy.ClientPackerInfo{}
@@ -42,7 +54,7 @@ func (DirectPacketClientPacker) ClientPackerInfo() zerocopy.ClientPackerInfo {
 
 func (p *DirectPacketClientPacker) updateDomainIPCache(ctx context.Context, targetAddr conn.Addr) error {
 	if p.cachedDomain != targetAddr.Domain() {
-		ip, err := targetAddr.ResolveIP(ctx, p.network)
+		ip, err := p.policy.ResolveIP(ctx, p.network, targetAddr.Domain())
 		if err != nil {
 			return err
 		}
@@ -1,6 +1,7 @@
 package direct
 
 import (
+	"context"
 	"net/netip"
 	"testing"
 
@@ -36,3 +37,22 @@ func TestSocks5PacketPackUnpacker(t *testing.T) {
 	clientUnpacker := NewSocks5PacketClientUnpacker(serverAddrPort)
 	zerocopy.ClientServerPackerUnpackerTestFunc(t, clientPacker, clientUnpacker, Socks5PacketServerPacker{}, &Socks5PacketServerUnpacker{})
 }
+
+func TestDirectPacketClientPackerIPFamilyPolicy(t *testing.T) {
+	localhost := conn.MustAddrFromDomainPort("localhost", 53)
+	b := make([]byte, 64)
+
+	p := NewDirectPacketClientPacker("ip", mtu).WithIPFamilyPolicy(conn.IPFamilyPolicyIPv4Only)
+	destAddrPort, _, _, err := p.PackInPlace(context.Background(), b, localhost, 0, len(b))
+	if err != nil {
+		t.Fatalf("PackInPlace failed: %v", err)
+	}
+	if !destAddrPort.Addr().Unmap().Is4() {
+		t.Errorf("destAddrPort = %v, want IPv4 address", destAddrPort)
+	}
+
+	p = p.WithIPFamilyPolicy(conn.IPFamilyPolicyIPv6Only)
+	if destAddrPort, _, _, err = p.PackInPlace(context.Background(), b, targetAddr, 0, len(b)); err != nil || destAddrPort != targetAddrPort {
+		t.Errorf("PackInPlace(%v) = %v, %v, want %v, nil", targetAddr, destAddrPort, err, targetAddrPort)
+	}
+}
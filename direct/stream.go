@@ -3,6 +3,7 @@ package direct
 import (
 	"context"
 	"io"
+	"sync"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/socks5"
@@ -97,20 +98,41 @@ func NewShadowsocksNoneStreamServerReadWriter(rw zerocopy.DirectReadWriteCloser)
 }
 
 // NewSocks5StreamClientReadWriter writes a SOCKS5 CONNECT request to rw and wraps rw into a ReadWriter ready for use.
-func NewSocks5StreamClientReadWriter(rw zerocopy.DirectReadWriteCloser, targetAddr conn.Addr) (*DirectStreamReadWriter, error) {
-	if err := socks5.ClientConnect(rw, targetAddr); err != nil {
+// If username is not empty, username/password authentication is offered.
+func NewSocks5StreamClientReadWriter(rw zerocopy.DirectReadWriteCloser, targetAddr conn.Addr, username, password string) (*DirectStreamReadWriter, error) {
+	if err := socks5.ClientConnect(rw, targetAddr, username, password); err != nil {
 		return nil, err
 	}
 	return &DirectStreamReadWriter{rw: rw}, nil
 }
 
+// Socks5StreamServerReadWriter is a [DirectStreamReadWriter] for an accepted SOCKS5 CONNECT request.
+//
+// Socks5StreamServerReadWriter implements the zerocopy TCPServerReplier interface.
+type Socks5StreamServerReadWriter struct {
+	DirectStreamReadWriter
+	replyOnce sync.Once
+}
+
+// Reply implements the zerocopy.TCPServerReplier Reply method.
+func (rw *Socks5StreamServerReadWriter) Reply(status zerocopy.TCPReplyStatus) (err error) {
+	rw.replyOnce.Do(func() {
+		err = socks5.ServerReply(rw.rw, status)
+	})
+	return
+}
+
 // NewSocks5StreamServerReadWriter handles a SOCKS5 request from rw and wraps rw into a ReadWriter ready for use.
+// The request must be replied to with [Socks5StreamServerReadWriter.Reply].
 // conn must be provided when UDP is enabled.
-func NewSocks5StreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, enableTCP, enableUDP bool) (dsrw *DirectStreamReadWriter, addr conn.Addr, err error) {
-	addr, err = socks5.ServerAccept(rw, enableTCP, enableUDP)
+// If maxDomainLength is positive, requests with longer domain names are rejected.
+func NewSocks5StreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, enableTCP, enableUDP bool, maxDomainLength int) (ssrw *Socks5StreamServerReadWriter, addr conn.Addr, err error) {
+	addr, err = socks5.ServerAccept(rw, enableTCP, enableUDP, maxDomainLength)
 	if err == nil {
-		dsrw = &DirectStreamReadWriter{
-			rw: rw,
+		ssrw = &Socks5StreamServerReadWriter{
+			DirectStreamReadWriter: DirectStreamReadWriter{
+				rw: rw,
+			},
 		}
 	}
 	return
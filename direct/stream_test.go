@@ -97,7 +97,7 @@ func TestSocks5StreamReadWriter(t *testing.T) {
 
 	var (
 		c                *DirectStreamReadWriter
-		s                *DirectStreamReadWriter
+		s                *Socks5StreamServerReadWriter
 		serverTargetAddr conn.Addr
 		cerr, serr       error
 	)
@@ -106,12 +106,15 @@ func TestSocks5StreamReadWriter(t *testing.T) {
 	wg.Add(2)
 
 	go func() {
-		c, cerr = NewSocks5StreamClientReadWriter(pl, clientTargetAddr)
+		c, cerr = NewSocks5StreamClientReadWriter(pl, clientTargetAddr, "", "")
 		wg.Done()
 	}()
 
 	go func() {
-		s, serverTargetAddr, serr = NewSocks5StreamServerReadWriter(pr, true, false)
+		s, serverTargetAddr, serr = NewSocks5StreamServerReadWriter(pr, true, false, 0)
+		if serr == nil {
+			serr = s.Reply(zerocopy.TCPReplySucceeded)
+		}
 		wg.Done()
 	}()
 
@@ -129,3 +132,25 @@ func TestSocks5StreamReadWriter(t *testing.T) {
 
 	zerocopy.ReadWriterTestFunc(t, c, s)
 }
+
+func TestSocks5StreamServerReadWriterReplyFailure(t *testing.T) {
+	pl, pr := pipe.NewDuplexPipe()
+	defer pl.Close()
+
+	go func() {
+		s, _, err := NewSocks5StreamServerReadWriter(pr, true, false, 0)
+		if err != nil {
+			pr.Close()
+			return
+		}
+		_ = s.Reply(zerocopy.TCPReplyNotAllowed)
+		// Only the first reply is sent.
+		_ = s.Reply(zerocopy.TCPReplySucceeded)
+		s.Close()
+	}()
+
+	_, err := NewSocks5StreamClientReadWriter(pl, conn.MustAddrFromDomainPort("example.com", 443), "", "")
+	if err == nil || err.Error() != "SOCKS error: 2" {
+		t.Errorf("NewSocks5StreamClientReadWriter() error = %v, expected SOCKS error 2", err)
+	}
+}
@@ -4,22 +4,29 @@ import (
 	"context"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/proxyproto"
 	"github.com/database64128/shadowsocks-go/socks5"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 )
 
 // TCPClient implements the zerocopy TCPClient interface.
 type TCPClient struct {
-	name    string
-	network string
-	dialer  conn.Dialer
+	name                 string
+	network              string
+	dialer               conn.Dialer
+	proxyProtocolVersion int
 }
 
-func NewTCPClient(name, network string, dialer conn.Dialer) *TCPClient {
+// NewTCPClient returns a new direct TCP client.
+//
+// If proxyProtocolVersion is 1 or 2, a PROXY protocol header of that version is sent
+// at the beginning of each connection, using the header carried by the dial context.
+func NewTCPClient(name, network string, dialer conn.Dialer, proxyProtocolVersion int) *TCPClient {
 	return &TCPClient{
-		name:    name,
-		network: network,
-		dialer:  dialer,
+		name:                 name,
+		network:              network,
+		dialer:               dialer,
+		proxyProtocolVersion: proxyProtocolVersion,
 	}
 }
 
@@ -33,7 +40,14 @@ func (c *TCPClient) Info() zerocopy.TCPClientInfo {
 
 // Dial implements the zerocopy.TCPClient Dial method.
 func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
-	rawRW, err = c.dialer.DialTCP(ctx, c.network, targetAddr.String(), payload)
+	if c.proxyProtocolVersion != 0 {
+		h, _ := proxyproto.FromContext(ctx)
+		b := make([]byte, 0, proxyproto.V1MaxHeaderLen+len(payload))
+		b = proxyproto.AppendHeader(b, c.proxyProtocolVersion, h)
+		payload = append(b, payload...)
+	}
+
+	rawRW, err = c.dialer.DialTCPWithIPFamilyPolicy(ctx, c.network, targetAddr.String(), payload, conn.IPFamilyPolicyFromContext(ctx))
 	if err != nil {
 		return
 	}
@@ -70,13 +84,14 @@ func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.Re
 // ShadowsocksNoneTCPClient implements the zerocopy TCPClient interface.
 type ShadowsocksNoneTCPClient struct {
 	name string
-	tco  *zerocopy.TCPConnOpener
+	rwo  zerocopy.DirectReadWriteCloserOpener
 }
 
-func NewShadowsocksNoneTCPClient(name, network, address string, dialer conn.Dialer) *ShadowsocksNoneTCPClient {
+// NewShadowsocksNoneTCPClient returns a new Shadowsocks "none" TCP client that opens connections to the server with rwo.
+func NewShadowsocksNoneTCPClient(name string, rwo zerocopy.DirectReadWriteCloserOpener) *ShadowsocksNoneTCPClient {
 	return &ShadowsocksNoneTCPClient{
 		name: name,
-		tco:  zerocopy.NewTCPConnOpener(dialer, network, address),
+		rwo:  rwo,
 	}
 }
 
@@ -90,7 +105,7 @@ func (c *ShadowsocksNoneTCPClient) Info() zerocopy.TCPClientInfo {
 
 // Dial implements the zerocopy.TCPClient Dial method.
 func (c *ShadowsocksNoneTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
-	rw, rawRW, err = NewShadowsocksNoneStreamClientReadWriter(ctx, c.tco, targetAddr, payload)
+	rw, rawRW, err = NewShadowsocksNoneStreamClientReadWriter(ctx, c.rwo, targetAddr, payload)
 	return
 }
 
@@ -117,18 +132,22 @@ func (ShadowsocksNoneTCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw
 
 // Socks5TCPClient implements the zerocopy TCPClient interface.
 type Socks5TCPClient struct {
-	name    string
-	network string
-	address string
-	dialer  conn.Dialer
+	name        string
+	network     string
+	address     string
+	dialer      conn.Dialer
+	credentials *UpstreamCredentialList
 }
 
-func NewSocks5TCPClient(name, network, address string, dialer conn.Dialer) *Socks5TCPClient {
+// NewSocks5TCPClient returns a new SOCKS5 TCP client.
+// credentials may be nil if the server does not require authentication.
+func NewSocks5TCPClient(name, network, address string, dialer conn.Dialer, credentials *UpstreamCredentialList) *Socks5TCPClient {
 	return &Socks5TCPClient{
-		name:    name,
-		network: network,
-		address: address,
-		dialer:  dialer,
+		name:        name,
+		network:     network,
+		address:     address,
+		dialer:      dialer,
+		credentials: credentials,
 	}
 }
 
@@ -142,15 +161,22 @@ func (c *Socks5TCPClient) Info() zerocopy.TCPClientInfo {
 
 // Dial implements the zerocopy.TCPClient Dial method.
 func (c *Socks5TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
-	rawRW, err = c.dialer.DialTCP(ctx, c.network, c.address, nil)
-	if err != nil {
-		return
-	}
+	err = c.credentials.Do(func(cred UpstreamCredential) error {
+		var err error
+		rawRW, err = c.dialer.DialTCP(ctx, c.network, c.address, nil)
+		if err != nil {
+			return err
+		}
 
-	rw, err = NewSocks5StreamClientReadWriter(rawRW, targetAddr)
+		rw, err = NewSocks5StreamClientReadWriter(rawRW, targetAddr, cred.Username, cred.Password)
+		if err != nil {
+			rawRW.Close()
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		rawRW.Close()
-		return
+		return nil, nil, err
 	}
 
 	if len(payload) > 0 {
@@ -163,14 +189,18 @@ func (c *Socks5TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payloa
 
 // Socks5TCPServer implements the zerocopy TCPServer interface.
 type Socks5TCPServer struct {
-	enableTCP bool
-	enableUDP bool
+	enableTCP       bool
+	enableUDP       bool
+	maxDomainLength int
 }
 
-func NewSocks5TCPServer(enableTCP, enableUDP bool) *Socks5TCPServer {
+// NewSocks5TCPServer returns a new SOCKS5 TCP server.
+// If maxDomainLength is positive, requests with longer domain names are rejected.
+func NewSocks5TCPServer(enableTCP, enableUDP bool, maxDomainLength int) *Socks5TCPServer {
 	return &Socks5TCPServer{
-		enableTCP: enableTCP,
-		enableUDP: enableUDP,
+		enableTCP:       enableTCP,
+		enableUDP:       enableUDP,
+		maxDomainLength: maxDomainLength,
 	}
 }
 
@@ -184,7 +214,7 @@ func (s *Socks5TCPServer) Info() zerocopy.TCPServerInfo {
 
 // Accept implements the zerocopy.TCPServer Accept method.
 func (s *Socks5TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
-	rw, targetAddr, err = NewSocks5StreamServerReadWriter(rawRW, s.enableTCP, s.enableUDP)
+	rw, targetAddr, err = NewSocks5StreamServerReadWriter(rawRW, s.enableTCP, s.enableUDP, s.maxDomainLength)
 	if err == socks5.ErrUDPAssociateDone {
 		err = zerocopy.ErrAcceptDoneNoRelay
 	}
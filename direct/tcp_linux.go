@@ -2,6 +2,7 @@ package direct
 
 import (
 	"net"
+	"net/netip"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -9,6 +10,9 @@ import (
 
 // TCPTransparentServer is a transparent proxy server.
 //
+// The listener must have IP_TRANSPARENT set, so that connections redirected by
+// TPROXY rules are accepted with their original destination as the local address.
+//
 // TCPTransparentServer implements the zerocopy TCPServer interface.
 type TCPTransparentServer struct{}
 
@@ -30,5 +34,8 @@ func (TCPTransparentServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zer
 	if !ok {
 		return nil, conn.Addr{}, nil, "", zerocopy.ErrAcceptRequiresTCPConn
 	}
-	return &DirectStreamReadWriter{rw: rawRW}, conn.AddrFromIPPort(tc.LocalAddr().(*net.TCPAddr).AddrPort()), nil, "", nil
+	// Connections to IPv4 destinations accepted by dual-stack listeners have v4-mapped local addresses.
+	localAddrPort := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+	targetAddrPort := netip.AddrPortFrom(localAddrPort.Addr().Unmap(), localAddrPort.Port())
+	return &DirectStreamReadWriter{rw: rawRW}, conn.AddrFromIPPort(targetAddrPort), nil, "", nil
 }
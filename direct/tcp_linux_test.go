@@ -0,0 +1,74 @@
+package direct
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestTCPTransparentServerAcceptUnmapsTargetAddr(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	port := ln.Addr().(*net.TCPAddr).AddrPort().Port()
+	dialAddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port)
+
+	c, err := net.DialTCP("tcp4", nil, net.TCPAddrFromAddrPort(dialAddrPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sc, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	server, err := NewTCPTransparentServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, targetAddr, _, _, err := server.Accept(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targetAddrPort := targetAddr.IPPort(); targetAddrPort != dialAddrPort {
+		t.Errorf("targetAddr = %s, expected %s", targetAddrPort, dialAddrPort)
+	}
+}
+
+func TestTCPRedirectServerAcceptRejectsDirectConn(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	c, err := net.DialTCP("tcp4", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sc, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	server, err := NewTCPRedirectServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without conntrack, SO_ORIGINAL_DST fails with ENOENT.
+	// With conntrack, the original destination is the listener itself.
+	if _, _, _, _, err = server.Accept(sc); err == nil {
+		t.Error("Accept() succeeded on a connection that was not redirected")
+	}
+}
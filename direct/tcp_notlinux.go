@@ -11,3 +11,7 @@ import (
 func NewTCPTransparentServer() (zerocopy.TCPServer, error) {
 	return nil, errors.New("transparent proxy is not implemented for this platform")
 }
+
+func NewTCPRedirectServer() (zerocopy.TCPServer, error) {
+	return nil, errors.New("redirect inbound is not implemented for this platform")
+}
@@ -0,0 +1,91 @@
+package direct
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"unsafe"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotRedirected is returned by [TCPRedirectServer] when the original destination
+// of a connection is the listener itself, which means the connection was not redirected.
+var ErrNotRedirected = errors.New("connection was not redirected")
+
+// TCPRedirectServer is a transparent proxy server for connections redirected
+// by iptables/nftables REDIRECT or DNAT rules.
+//
+// The original destination is retrieved from conntrack with SO_ORIGINAL_DST.
+// Unlike [TCPTransparentServer], it requires neither IP_TRANSPARENT nor policy routing.
+//
+// TCPRedirectServer implements the zerocopy TCPServer interface.
+type TCPRedirectServer struct{}
+
+func NewTCPRedirectServer() (zerocopy.TCPServer, error) {
+	return TCPRedirectServer{}, nil
+}
+
+// Info implements the zerocopy.TCPServer Info method.
+func (TCPRedirectServer) Info() zerocopy.TCPServerInfo {
+	return zerocopy.TCPServerInfo{
+		NativeInitialPayload: false,
+		DefaultTCPConnCloser: zerocopy.ReplyWithGibberish,
+	}
+}
+
+// Accept implements the zerocopy.TCPServer Accept method.
+func (TCPRedirectServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
+	tc, ok := rawRW.(*net.TCPConn)
+	if !ok {
+		return nil, conn.Addr{}, nil, "", zerocopy.ErrAcceptRequiresTCPConn
+	}
+
+	rawConn, err := tc.SyscallConn()
+	if err != nil {
+		return nil, conn.Addr{}, nil, "", err
+	}
+
+	// IPv4 connections accepted by dual-stack listeners are tracked by IPv4 conntrack.
+	localAddrPort := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+	is4 := localAddrPort.Addr().Unmap().Is4()
+
+	var targetAddrPort netip.AddrPort
+	if cerr := rawConn.Control(func(fd uintptr) {
+		targetAddrPort, err = getOriginalDst(int(fd), is4)
+	}); cerr != nil {
+		return nil, conn.Addr{}, nil, "", cerr
+	}
+	if err != nil {
+		return nil, conn.Addr{}, nil, "", err
+	}
+
+	if targetAddrPort == netip.AddrPortFrom(localAddrPort.Addr().Unmap(), localAddrPort.Port()) {
+		return nil, conn.Addr{}, nil, "", ErrNotRedirected
+	}
+
+	return &DirectStreamReadWriter{rw: rawRW}, conn.AddrFromIPPort(targetAddrPort), nil, "", nil
+}
+
+// getOriginalDst returns the original destination address of the redirected connection.
+func getOriginalDst(fd int, is4 bool) (netip.AddrPort, error) {
+	// The kernel accepts any buffer no smaller than the sockaddr.
+	// IPv6MTUInfo starts with a sockaddr_in6, which is large enough for both families.
+	if is4 {
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("failed to get socket option SO_ORIGINAL_DST: %w", err)
+		}
+		return conn.SockaddrInet4ToAddrPort((*unix.RawSockaddrInet4)(unsafe.Pointer(&info.Addr))), nil
+	}
+
+	// IP6T_SO_ORIGINAL_DST has the same value as SO_ORIGINAL_DST.
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to get socket option IP6T_SO_ORIGINAL_DST: %w", err)
+	}
+	return conn.SockaddrInet6ToAddrPort(&info.Addr), nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/netip"
 	"os"
 
@@ -16,21 +17,26 @@ import (
 
 // DirectUDPClient implements the zerocopy UDPClient interface.
 type DirectUDPClient struct {
+	network string
 	info    zerocopy.UDPClientInfo
+	packer  *DirectPacketClientPacker
 	session zerocopy.UDPClientSession
 }
 
 // NewDirectUDPClient creates a new UDP client that sends packets directly.
 func NewDirectUDPClient(name, network string, mtu int, listenConfig conn.ListenConfig) *DirectUDPClient {
+	packer := NewDirectPacketClientPacker(network, mtu)
 	return &DirectUDPClient{
+		network: network,
 		info: zerocopy.UDPClientInfo{
 			Name:         name,
 			MTU:          mtu,
 			ListenConfig: listenConfig,
 		},
+		packer: packer,
 		session: zerocopy.UDPClientSession{
 			MaxPacketSize: zerocopy.MaxPacketSizeForAddr(mtu, netip.IPv4Unspecified()),
-			Packer:        NewDirectPacketClientPacker(network, mtu),
+			Packer:        packer,
 			Unpacker:      DirectPacketClientUnpacker{},
 			Close:         zerocopy.NoopClose,
 		},
@@ -43,8 +49,31 @@ func (c *DirectUDPClient) Info() zerocopy.UDPClientInfo {
 }
 
 // NewSession implements the zerocopy.UDPClient NewSession method.
+//
+// If ctx has an IP family policy, domain targets of the session are resolved by the policy.
+//
+// If the listen config has a source address pool, the source address of the session is selected
+// for the resolved target address of the session's first packet.
 func (c *DirectUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
-	return c.info, c.session, nil
+	session := c.session
+	policy := conn.IPFamilyPolicyFromContext(ctx)
+	if policy != conn.IPFamilyPolicyDefault {
+		session.Packer = c.packer.WithIPFamilyPolicy(policy)
+	}
+
+	targetAddr, ok := zerocopy.UDPSessionTargetAddrFromContext(ctx)
+	if !ok || !c.info.ListenConfig.HasSourceAddrPool() {
+		return c.info, session, nil
+	}
+
+	targetIP, err := policy.ResolveAddr(ctx, c.network, targetAddr)
+	if err != nil {
+		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to resolve target address: %w", err)
+	}
+
+	info := c.info
+	info.ListenConfig = info.ListenConfig.WithSourceAddrFor(ctx, targetIP)
+	return info, session, nil
 }
 
 // ShadowsocksNoneUDPClient implements the zerocopy UDPClient interface.
@@ -91,22 +120,25 @@ func (c *ShadowsocksNoneUDPClient) NewSession(ctx context.Context) (zerocopy.UDP
 
 // Socks5UDPClient implements the zerocopy UDPClient interface.
 type Socks5UDPClient struct {
-	logger     *zap.Logger
-	networkTCP string
-	networkIP  string
-	address    string
-	dialer     conn.Dialer
-	info       zerocopy.UDPClientInfo
+	logger      *zap.Logger
+	networkTCP  string
+	networkIP   string
+	address     string
+	dialer      conn.Dialer
+	credentials *UpstreamCredentialList
+	info        zerocopy.UDPClientInfo
 }
 
 // NewSocks5UDPClient creates a new SOCKS5 UDP client.
-func NewSocks5UDPClient(logger *zap.Logger, name, networkTCP, networkIP, address string, dialer conn.Dialer, mtu int, listenConfig conn.ListenConfig) *Socks5UDPClient {
+// credentials may be nil if the server does not require authentication.
+func NewSocks5UDPClient(logger *zap.Logger, name, networkTCP, networkIP, address string, dialer conn.Dialer, credentials *UpstreamCredentialList, mtu int, listenConfig conn.ListenConfig) *Socks5UDPClient {
 	return &Socks5UDPClient{
-		logger:     logger,
-		networkTCP: networkTCP,
-		networkIP:  networkIP,
-		address:    address,
-		dialer:     dialer,
+		logger:      logger,
+		networkTCP:  networkTCP,
+		networkIP:   networkIP,
+		address:     address,
+		dialer:      dialer,
+		credentials: credentials,
 		info: zerocopy.UDPClientInfo{
 			Name:           name,
 			PackerHeadroom: Socks5PacketClientMessageHeadroom,
@@ -123,15 +155,26 @@ func (c *Socks5UDPClient) Info() zerocopy.UDPClientInfo {
 
 // NewSession implements the zerocopy.UDPClient NewSession method.
 func (c *Socks5UDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
-	tc, err := c.dialer.DialTCP(ctx, c.networkTCP, c.address, nil)
-	if err != nil {
-		return c.info, zerocopy.UDPClientSession{}, err
-	}
+	var (
+		tc   *net.TCPConn
+		addr conn.Addr
+	)
 
-	addr, err := socks5.ClientUDPAssociate(tc, conn.Addr{})
-	if err != nil {
-		tc.Close()
-		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to request UDP association: %w", err)
+	if err := c.credentials.Do(func(cred UpstreamCredential) error {
+		var err error
+		tc, err = c.dialer.DialTCP(ctx, c.networkTCP, c.address, nil)
+		if err != nil {
+			return err
+		}
+
+		addr, err = socks5.ClientUDPAssociate(tc, conn.Addr{}, cred.Username, cred.Password)
+		if err != nil {
+			tc.Close()
+			return fmt.Errorf("failed to request UDP association: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return c.info, zerocopy.UDPClientSession{}, err
 	}
 
 	addrPort, err := addr.ResolveIPPort(ctx, c.networkIP)
@@ -139,6 +182,12 @@ func (c *Socks5UDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInf
 		tc.Close()
 		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to resolve endpoint address: %w", err)
 	}
+
+	// Many SOCKS5 servers reply with an unspecified BND.ADDR,
+	// meaning the relay is reachable at the same address as the control connection.
+	if addrPort.Addr().IsUnspecified() {
+		addrPort = netip.AddrPortFrom(tc.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(), addrPort.Port())
+	}
 	maxPacketSize := zerocopy.MaxPacketSizeForAddr(c.info.MTU, addrPort.Addr())
 
 	go func() {
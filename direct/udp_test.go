@@ -0,0 +1,163 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
+	"go.uber.org/zap/zaptest"
+)
+
+// serveSocks5UDPAssociateUnspecified accepts a single UDP ASSOCIATE request on ln
+// and replies with an unspecified BND.ADDR and the given port.
+func serveSocks5UDPAssociateUnspecified(t *testing.T, ln *net.TCPListener, port uint16) {
+	tc, err := ln.AcceptTCP()
+	if err != nil {
+		t.Errorf("failed to accept: %v", err)
+		return
+	}
+	defer tc.Close()
+
+	// VER, NMETHODS, METHODS.
+	b := make([]byte, 2+255)
+	if _, err = io.ReadFull(tc, b[:2]); err != nil {
+		t.Errorf("failed to read VER, NMETHODS: %v", err)
+		return
+	}
+	if _, err = io.ReadFull(tc, b[:b[1]]); err != nil {
+		t.Errorf("failed to read METHODS: %v", err)
+		return
+	}
+	if _, err = tc.Write([]byte{socks5.Version, socks5.MethodNoAuthenticationRequired}); err != nil {
+		t.Errorf("failed to write method selection: %v", err)
+		return
+	}
+
+	// VER, CMD, RSV, DST.ADDR, DST.PORT.
+	if _, err = io.ReadFull(tc, b[:3]); err != nil {
+		t.Errorf("failed to read request: %v", err)
+		return
+	}
+	if b[1] != socks5.CmdUDPAssociate {
+		t.Errorf("CMD = %d, want %d", b[1], socks5.CmdUDPAssociate)
+		return
+	}
+	if _, err = socks5.ConnAddrFromReader(tc); err != nil {
+		t.Errorf("failed to read DST.ADDR: %v", err)
+		return
+	}
+
+	reply := []byte{socks5.Version, socks5.Succeeded, 0}
+	reply = socks5.AppendAddrFromAddrPort(reply, netip.AddrPortFrom(netip.IPv4Unspecified(), port))
+	if _, err = tc.Write(reply); err != nil {
+		t.Errorf("failed to write reply: %v", err)
+		return
+	}
+
+	// Keep the association alive until the client closes the connection.
+	_, _ = io.Copy(io.Discard, tc)
+}
+
+func TestSocks5UDPClientUnspecifiedBoundAddr(t *testing.T) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relayAddrPort := relay.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveSocks5UDPAssociateUnspecified(t, ln, relayAddrPort.Port())
+	}()
+
+	c := NewSocks5UDPClient(zaptest.NewLogger(t), "socks5", "tcp4", "ip4", ln.Addr().String(), conn.DefaultTCPDialer, nil, 1500, conn.DefaultUDPClientListenConfig)
+	_, session, err := c.NewSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = session.Close()
+		<-done
+	}()
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	targetAddrPort := netip.MustParseAddrPort("192.0.2.1:53")
+	payload := []byte("hello, socks5")
+	headroom := session.Packer.ClientPackerInfo().Headroom
+	b := make([]byte, headroom.Front+session.MaxPacketSize+headroom.Rear)
+	copy(b[headroom.Front:], payload)
+
+	destAddrPort, packetStart, packetLen, err := session.Packer.PackInPlace(context.Background(), b, conn.AddrFromIPPort(targetAddrPort), headroom.Front, len(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destAddrPort != relayAddrPort {
+		t.Fatalf("destAddrPort = %v, want %v", destAddrPort, relayAddrPort)
+	}
+	if _, err = uc.WriteToUDPAddrPort(b[packetStart:packetStart+packetLen], destAddrPort); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = relay.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	rb := make([]byte, len(b))
+	n, clientAddrPort, err := relay.ReadFromUDPAddrPort(rb)
+	if err != nil {
+		t.Fatalf("relay did not receive the packet: %v", err)
+	}
+	if err = socks5.ValidatePacketHeader(rb[:n]); err != nil {
+		t.Fatal(err)
+	}
+	packetTargetAddrPort, addrLen, err := socks5.AddrPortFromSlice(rb[3:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetTargetAddrPort != targetAddrPort {
+		t.Errorf("packet target = %v, want %v", packetTargetAddrPort, targetAddrPort)
+	}
+	if got := rb[3+addrLen : n]; !bytes.Equal(got, payload) {
+		t.Errorf("relayed payload = %q, want %q", got, payload)
+	}
+
+	// Replies from the relay are accepted.
+	if _, err = relay.WriteToUDPAddrPort(rb[:n], clientAddrPort); err != nil {
+		t.Fatal(err)
+	}
+	if err = uc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, packetSourceAddrPort, err := uc.ReadFromUDPAddrPort(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadSourceAddrPort, payloadStart, payloadLen, err := session.Unpacker.UnpackInPlace(b, packetSourceAddrPort, 0, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payloadSourceAddrPort != targetAddrPort {
+		t.Errorf("payloadSourceAddrPort = %v, want %v", payloadSourceAddrPort, targetAddrPort)
+	}
+	if got := b[payloadStart : payloadStart+payloadLen]; !bytes.Equal(got, payload) {
+		t.Errorf("unpacked payload = %q, want %q", got, payload)
+	}
+}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"go.uber.org/zap"
+)
+
+// DefaultCacheSaveInterval is the default interval between saves of a resolver's cache.
+const DefaultCacheSaveInterval = 5 * time.Minute
+
+// cacheFile is the on-disk format of a resolver's cache.
+type cacheFile struct {
+	Entries map[string]cacheEntry `json:"entries"`
+}
+
+// cacheEntry is a cached result in a cache file.
+type cacheEntry struct {
+	IPv4 []netip.Addr `json:"ipv4,omitempty"`
+	IPv6 []netip.Addr `json:"ipv6,omitempty"`
+	TTL  time.Time    `json:"ttl"`
+}
+
+// isUsable returns whether the cached result may still be returned, either fresh or stale.
+func (r *Resolver) isUsable(ttl time.Time, now time.Time) bool {
+	return now.Sub(ttl) < r.serveStale || now.Before(ttl)
+}
+
+// saveCache returns the resolver's usable positive results.
+func (r *Resolver) saveCache() cacheFile {
+	now := time.Now()
+	f := cacheFile{
+		Entries: make(map[string]cacheEntry),
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for name, result := range r.cache {
+		if result.negative || !r.isUsable(result.TTL, now) {
+			continue
+		}
+		f.Entries[name] = cacheEntry{
+			IPv4: result.IPv4,
+			IPv6: result.IPv6,
+			TTL:  result.TTL,
+		}
+	}
+
+	return f
+}
+
+// loadCache adds the usable results in f to the resolver's cache, and returns the number of results added.
+// Results already in the cache are not replaced.
+func (r *Resolver) loadCache(f cacheFile) (n int) {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, entry := range f.Entries {
+		if !r.isUsable(entry.TTL, now) {
+			continue
+		}
+		if _, ok := r.cache[name]; ok {
+			continue
+		}
+		r.cache[name] = Result{
+			IPv4:   entry.IPv4,
+			IPv6:   entry.IPv6,
+			TTL:    entry.TTL,
+			v4done: true,
+			v6done: true,
+		}
+		n++
+	}
+
+	return n
+}
+
+// CacheSaver periodically saves a resolver's cache to a file,
+// so that cached results survive restarts.
+//
+// CacheSaver implements the service.Relay interface.
+type CacheSaver struct {
+	resolver *Resolver
+	path     string
+	interval time.Duration
+	logger   *zap.Logger
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// CacheSaver returns a new cache saver for the resolver created from the config.
+// It returns nil if cache persistence is not enabled.
+//
+// Results saved by a previous cache saver of the resolver are loaded into the resolver's cache.
+func (rc *ResolverConfig) CacheSaver(resolver SimpleResolver, logger *zap.Logger) (*CacheSaver, error) {
+	if rc.CachePath == "" {
+		return nil, nil
+	}
+
+	r, ok := resolver.(*Resolver)
+	if !ok {
+		return nil, fmt.Errorf("resolver %s does not have a cache", rc.Name)
+	}
+
+	interval := rc.CacheSaveInterval.Value()
+	switch {
+	case interval == 0:
+		interval = DefaultCacheSaveInterval
+	case interval < 0:
+		return nil, fmt.Errorf("negative cache save interval: %s", interval)
+	}
+
+	return NewCacheSaver(r, rc.CachePath, interval, logger)
+}
+
+// NewCacheSaver returns a new cache saver that saves the resolver's cache to path every interval.
+// Results saved in the file are loaded into the resolver's cache.
+func NewCacheSaver(r *Resolver, path string, interval time.Duration, logger *zap.Logger) (*CacheSaver, error) {
+	cs := &CacheSaver{
+		resolver: r,
+		path:     path,
+		interval: interval,
+		logger:   logger,
+	}
+
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// load loads the saved results into the resolver's cache.
+// A missing cache file is not an error.
+func (cs *CacheSaver) load() error {
+	var f cacheFile
+	if err := jsonhelper.OpenAndDecodeDisallowUnknownFields(cs.path, &f); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to load DNS cache: %w", err)
+	}
+	n := cs.resolver.loadCache(f)
+
+	cs.logger.Info("Loaded DNS cache",
+		zap.String("resolver", cs.resolver.name),
+		zap.String("path", cs.path),
+		zap.Int("saved", len(f.Entries)),
+		zap.Int("loaded", n),
+	)
+	return nil
+}
+
+// save writes the resolver's cache to the cache file.
+// The file is replaced atomically, so a crash during the save leaves the previous cache file intact.
+func (cs *CacheSaver) save() error {
+	b, err := json.Marshal(cs.resolver.saveCache())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(cs.path), filepath.Base(cs.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, cs.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// String implements the service.Relay String method.
+func (cs *CacheSaver) String() string {
+	return "DNS cache saver for " + cs.resolver.name
+}
+
+// Start implements the service.Relay Start method.
+func (cs *CacheSaver) Start(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(cs.path), 0755); err != nil {
+		return err
+	}
+
+	ctx, cs.cancel = context.WithCancel(ctx)
+	cs.wg.Add(1)
+	go func() {
+		cs.run(ctx)
+		cs.wg.Done()
+	}()
+	return nil
+}
+
+func (cs *CacheSaver) run(ctx context.Context) {
+	ticker := time.NewTicker(cs.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := cs.save(); err != nil {
+				cs.logger.Warn("Failed to save DNS cache",
+					zap.String("resolver", cs.resolver.name),
+					zap.String("path", cs.path),
+					zap.Error(err),
+				)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop implements the service.Relay Stop method.
+// It saves the cache a final time after the periodic saves stop.
+func (cs *CacheSaver) Stop() error {
+	cs.cancel()
+	cs.wg.Wait()
+	return cs.save()
+}
@@ -0,0 +1,166 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestCacheResolver(t *testing.T, s *testTLSServer, policy CachePolicy) *Resolver {
+	t.Helper()
+	return NewTLSResolver("cache", s.ln.Addr().(*net.TCPAddr).AddrPort(), &tls.Config{
+		ServerName: "127.0.0.1",
+		RootCAs:    s.rootCAs,
+	}, direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer, 0), policy, zaptest.NewLogger(t))
+}
+
+// expire moves the TTL of the cached result for name into the past.
+func (r *Resolver) expire(name string, ago time.Duration) {
+	r.mu.Lock()
+	result := r.cache[name]
+	result.TTL = time.Now().Add(-ago)
+	r.cache[name] = result
+	r.mu.Unlock()
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	s := newTestTLSServer(t)
+	r := newTestCacheResolver(t, s, CachePolicy{NegativeTTL: time.Minute})
+	ctx := context.Background()
+
+	for _, rcode := range []dnsmessage.RCode{dnsmessage.RCodeNameError, dnsmessage.RCodeServerFailure} {
+		t.Run(rcode.String(), func(t *testing.T) {
+			s.rcode.Store(uint32(rcode))
+			name := rcode.String() + ".example.com"
+
+			for range 3 {
+				if _, err := r.Lookup(ctx, name); err != ErrLookup {
+					t.Errorf("Lookup() error = %v, expected %v", err, ErrLookup)
+				}
+			}
+			s.queries.Store(0)
+
+			// After the negative TTL expires, queries are sent again.
+			r.expire(name, time.Second)
+			s.rcode.Store(uint32(dnsmessage.RCodeSuccess))
+			if _, err := r.Lookup(ctx, name); err != nil {
+				t.Errorf("Lookup() failed: %v", err)
+			}
+			if n := s.queries.Load(); n != 2 {
+				t.Errorf("Server received %d queries, expected 2", n)
+			}
+		})
+	}
+
+	if stats := r.Stats(); stats.NegativeHits != 4 {
+		t.Errorf("stats.NegativeHits = %d, expected 4", stats.NegativeHits)
+	}
+}
+
+func TestResolverServeStale(t *testing.T) {
+	s := newTestTLSServer(t)
+	r := newTestCacheResolver(t, s, CachePolicy{ServeStale: time.Hour})
+	ctx := context.Background()
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		if _, err := r.Lookup(ctx, name); err != nil {
+			t.Fatalf("Lookup(%q) failed: %v", name, err)
+		}
+	}
+	r.expire("a.example.com", time.Minute)
+	r.expire("b.example.com", time.Minute)
+	r.expire("c.example.com", 2*time.Hour)
+
+	// Stale results are served when the server fails.
+	s.rcode.Store(uint32(dnsmessage.RCodeServerFailure))
+	result, err := r.Lookup(ctx, "a.example.com")
+	if err != nil {
+		t.Fatalf("Lookup() failed: %v", err)
+	}
+	if len(result.IPv4) != 1 || result.IPv4[0] != testTLSServerIPv4 {
+		t.Errorf("result.IPv4 = %v, expected [%s]", result.IPv4, testTLSServerIPv4)
+	}
+
+	// Results that have been stale for too long are not served.
+	if _, err = r.Lookup(ctx, "c.example.com"); err != ErrLookup {
+		t.Errorf("Lookup() error = %v, expected %v", err, ErrLookup)
+	}
+
+	// NXDOMAIN is not overridden.
+	s.rcode.Store(uint32(dnsmessage.RCodeNameError))
+	if _, err = r.Lookup(ctx, "b.example.com"); err != ErrLookup {
+		t.Errorf("Lookup() error = %v, expected %v", err, ErrLookup)
+	}
+
+	if stats := r.Stats(); stats.StaleServed != 1 {
+		t.Errorf("stats.StaleServed = %d, expected 1", stats.StaleServed)
+	}
+}
+
+func TestCacheSaver(t *testing.T) {
+	s := newTestTLSServer(t)
+	policy := CachePolicy{NegativeTTL: time.Minute, ServeStale: time.Hour}
+	path := filepath.Join(t.TempDir(), "dns", "cache.json")
+	ctx := context.Background()
+
+	r := newTestCacheResolver(t, s, policy)
+	cs, err := NewCacheSaver(r, path, time.Hour, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("NewCacheSaver failed: %v", err)
+	}
+	if err = cs.Start(ctx); err != nil {
+		t.Fatalf("cs.Start() failed: %v", err)
+	}
+
+	for _, name := range []string{"fresh.example.com", "stale.example.com", "expired.example.com"} {
+		if _, err = r.Lookup(ctx, name); err != nil {
+			t.Fatalf("Lookup(%q) failed: %v", name, err)
+		}
+	}
+	r.expire("stale.example.com", time.Minute)
+	r.expire("expired.example.com", 2*time.Hour)
+
+	s.rcode.Store(uint32(dnsmessage.RCodeNameError))
+	if _, err = r.Lookup(ctx, "negative.example.com"); err != ErrLookup {
+		t.Fatalf("Lookup() error = %v, expected %v", err, ErrLookup)
+	}
+
+	if err = cs.Stop(); err != nil {
+		t.Fatalf("cs.Stop() failed: %v", err)
+	}
+
+	// A new resolver loads the fresh and stale results, and answers from them without querying the server.
+	s.queries.Store(0)
+	s.rcode.Store(uint32(dnsmessage.RCodeServerFailure))
+	r2 := newTestCacheResolver(t, s, policy)
+	if _, err = NewCacheSaver(r2, path, time.Hour, zaptest.NewLogger(t)); err != nil {
+		t.Fatalf("NewCacheSaver failed: %v", err)
+	}
+
+	if n := len(r2.cache); n != 2 {
+		t.Errorf("Loaded %d results, expected 2", n)
+	}
+
+	result, err := r2.Lookup(ctx, "fresh.example.com")
+	if err != nil {
+		t.Fatalf("Lookup() failed: %v", err)
+	}
+	if len(result.IPv6) != 1 || result.IPv6[0] != testTLSServerIPv6 {
+		t.Errorf("result.IPv6 = %v, expected [%s]", result.IPv6, testTLSServerIPv6)
+	}
+	if n := s.queries.Load(); n != 0 {
+		t.Errorf("Server received %d queries, expected 0", n)
+	}
+
+	if _, err = r2.Lookup(ctx, "stale.example.com"); err != nil {
+		t.Errorf("Lookup() failed: %v", err)
+	}
+}
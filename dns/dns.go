@@ -1,7 +1,12 @@
+// Package dns implements DNS resolvers for the router.
+//
+// Resolvers only depend on the [zerocopy.TCPClient] and [zerocopy.UDPClient] interfaces,
+// so they can be used standalone with the clients in package direct.
 package dns
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,10 +15,13 @@ import (
 	"net/netip"
 	"os"
 	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 	"golang.org/x/net/dns/dnsmessage"
@@ -43,7 +51,11 @@ type ResolverConfig struct {
 	//
 	// Available values:
 	// - "plain": Resolve names by sending cleartext DNS queries to the configured upstream server.
+	// - "tls": Resolve names by sending DNS queries over TLS (RFC 7858) to the configured upstream server,
+	//   through the TCP client. Connections are kept open for reuse.
 	// - "system": Use the system resolver. This does not support custom server addresses or clients.
+	// - "split": Send lookups to other resolvers by domain suffix, as configured by Rules and DefaultResolver.
+	//   This does not support custom server addresses, clients or caching options.
 	//
 	// The default value is "plain".
 	Type string `json:"type"`
@@ -58,17 +70,130 @@ type ResolverConfig struct {
 	// UDPClientName is the name of the UDPClient to use.
 	// Leave empty to disable UDP.
 	UDPClientName string `json:"udpClientName"`
+
+	// ServerName is the name to verify the upstream server's certificate against.
+	//
+	// If empty, the certificate is verified against the IP address of AddrPort.
+	//
+	// Only applicable to the "tls" type.
+	ServerName string `json:"serverName"`
+
+	// MinTTL is the minimum time to cache a result for.
+	// Answers with lower TTLs, such as 0-TTL responses from CDNs, are cached for MinTTL.
+	//
+	// The default value is 0, which uses the TTLs as is.
+	MinTTL jsonhelper.Duration `json:"minTTL"`
+
+	// MaxTTL is the maximum time to cache a result for.
+	// Answers with higher TTLs are cached for MaxTTL.
+	//
+	// The default value is 0, which means no limit.
+	MaxTTL jsonhelper.Duration `json:"maxTTL"`
+
+	// NegativeTTL is how long to cache NXDOMAIN and SERVFAIL responses for.
+	// Until it expires, lookups of the name fail without querying the upstream server.
+	//
+	// The default value is 0, which disables negative caching.
+	NegativeTTL jsonhelper.Duration `json:"negativeTTL"`
+
+	// ServeStale is how long after their TTLs expire cached results may still be returned,
+	// when the upstream server fails to answer (RFC 8767). NXDOMAIN responses are not overridden.
+	//
+	// The default value is 0, which disables serving stale results.
+	ServeStale jsonhelper.Duration `json:"serveStale"`
+
+	// CachePath is the path to the file to save the cache to, periodically and on shutdown.
+	// The cache is loaded from the file on startup, so that it survives restarts.
+	//
+	// The default value is empty, which disables cache persistence.
+	CachePath string `json:"cachePath"`
+
+	// CacheSaveInterval is the interval between saves of the cache to CachePath.
+	//
+	// The default value is 5 minutes.
+	CacheSaveInterval jsonhelper.Duration `json:"cacheSaveInterval"`
+
+	// Rules routes lookups of names in domain suffixes to other resolvers.
+	// When multiple suffixes match a name, the longest one wins.
+	// Referenced resolvers must be defined before this resolver.
+	//
+	// Only applicable to the "split" type.
+	Rules []SplitRuleConfig `json:"rules"`
+
+	// DefaultResolver is the name of the resolver to send lookups of names without a matching rule to.
+	//
+	// Only applicable to the "split" type, where it is required.
+	DefaultResolver string `json:"defaultResolver"`
+}
+
+// hasUpstreamOptions returns whether any option for resolvers with their own upstream servers is set.
+func (rc *ResolverConfig) hasUpstreamOptions() bool {
+	return rc.AddrPort.IsValid() || rc.TCPClientName != "" || rc.UDPClientName != "" || rc.ServerName != ""
+}
+
+// hasCacheOptions returns whether any caching option is set.
+func (rc *ResolverConfig) hasCacheOptions() bool {
+	return rc.MinTTL != 0 || rc.MaxTTL != 0 || rc.NegativeTTL != 0 || rc.ServeStale != 0 || rc.CachePath != ""
+}
+
+// splitResolver creates a new [SplitResolver] from the config.
+func (rc *ResolverConfig) splitResolver(resolverMap map[string]SimpleResolver, logger *zap.Logger) (*SplitResolver, error) {
+	if rc.hasUpstreamOptions() {
+		return nil, errors.New("split resolver does not support custom server addresses or clients")
+	}
+	if rc.hasCacheOptions() {
+		return nil, errors.New("split resolver does not support caching options")
+	}
+	if rc.DefaultResolver == "" {
+		return nil, errors.New("split resolver requires a default resolver")
+	}
+
+	suffixes := make(map[string]string)
+	for _, rule := range rc.Rules {
+		if len(rule.Domains) == 0 {
+			return nil, fmt.Errorf("rule for resolver %s has no domains", rule.Resolver)
+		}
+		for _, domain := range rule.Domains {
+			suffix := strings.ToLower(strings.TrimSuffix(domain, "."))
+			if suffix == "" {
+				return nil, fmt.Errorf("empty domain in rule for resolver %s", rule.Resolver)
+			}
+			if _, ok := suffixes[suffix]; ok {
+				return nil, fmt.Errorf("duplicate domain: %s", domain)
+			}
+			suffixes[suffix] = rule.Resolver
+		}
+	}
+
+	return NewSplitResolver(rc.Name, suffixes, rc.DefaultResolver, resolverMap, logger)
 }
 
 // SimpleResolver creates a new [SimpleResolver] from the config.
-func (rc *ResolverConfig) SimpleResolver(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient, logger *zap.Logger) (SimpleResolver, error) {
+// resolverMap contains the previously created resolvers, for split resolvers to reference.
+func (rc *ResolverConfig) SimpleResolver(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient, resolverMap map[string]SimpleResolver, logger *zap.Logger) (SimpleResolver, error) {
+	if rc.Type != "split" && (len(rc.Rules) != 0 || rc.DefaultResolver != "") {
+		return nil, errors.New("rules and defaultResolver are only supported by split resolvers")
+	}
+
 	switch rc.Type {
 	case "plain", "":
+	case "tls":
+		if rc.TCPClientName == "" {
+			return nil, errors.New("tls resolver requires a TCP client")
+		}
+		if rc.UDPClientName != "" {
+			return nil, errors.New("tls resolver does not support UDP")
+		}
 	case "system":
-		if rc.AddrPort.IsValid() || rc.TCPClientName != "" || rc.UDPClientName != "" {
+		if rc.hasUpstreamOptions() {
 			return nil, errors.New("system resolver does not support custom server addresses or clients")
 		}
+		if rc.hasCacheOptions() {
+			return nil, errors.New("system resolver does not support caching options")
+		}
 		return NewSystemResolver(rc.Name, logger), nil
+	case "split":
+		return rc.splitResolver(resolverMap, logger)
 	default:
 		return nil, fmt.Errorf("unknown resolver type: %s", rc.Type)
 	}
@@ -77,6 +202,25 @@ func (rc *ResolverConfig) SimpleResolver(tcpClientMap map[string]zerocopy.TCPCli
 		return nil, errors.New("missing resolver address")
 	}
 
+	policy := CachePolicy{
+		MinTTL:      rc.MinTTL.Value(),
+		MaxTTL:      rc.MaxTTL.Value(),
+		NegativeTTL: rc.NegativeTTL.Value(),
+		ServeStale:  rc.ServeStale.Value(),
+	}
+	if policy.MinTTL < 0 || policy.MaxTTL < 0 {
+		return nil, errors.New("negative minTTL or maxTTL")
+	}
+	if policy.MaxTTL != 0 && policy.MinTTL > policy.MaxTTL {
+		return nil, fmt.Errorf("minTTL %s is greater than maxTTL %s", policy.MinTTL, policy.MaxTTL)
+	}
+	if policy.NegativeTTL < 0 {
+		return nil, fmt.Errorf("negative negativeTTL: %s", policy.NegativeTTL)
+	}
+	if policy.ServeStale < 0 {
+		return nil, fmt.Errorf("negative serveStale: %s", policy.ServeStale)
+	}
+
 	var (
 		tcpClient zerocopy.TCPClient
 		udpClient zerocopy.UDPClient
@@ -96,7 +240,31 @@ func (rc *ResolverConfig) SimpleResolver(tcpClientMap map[string]zerocopy.TCPCli
 		}
 	}
 
-	return NewResolver(rc.Name, rc.AddrPort, tcpClient, udpClient, logger), nil
+	if rc.Type == "tls" {
+		serverName := rc.ServerName
+		if serverName == "" {
+			serverName = rc.AddrPort.Addr().Unmap().String()
+		}
+		return NewTLSResolver(rc.Name, rc.AddrPort, &tls.Config{ServerName: serverName}, tcpClient, policy, logger), nil
+	}
+
+	return NewResolver(rc.Name, rc.AddrPort, tcpClient, udpClient, policy, logger), nil
+}
+
+// CachePolicy controls how a [Resolver] caches results.
+type CachePolicy struct {
+	// MinTTL is the minimum time to cache a result for. 0 means no minimum.
+	MinTTL time.Duration
+
+	// MaxTTL is the maximum time to cache a result for. 0 means no limit.
+	MaxTTL time.Duration
+
+	// NegativeTTL is how long to cache NXDOMAIN and SERVFAIL responses for. 0 disables negative caching.
+	NegativeTTL time.Duration
+
+	// ServeStale is how long after their TTLs expire cached results may be returned
+	// when the upstream server fails to answer. 0 disables serving stale results.
+	ServeStale time.Duration
 }
 
 // Result represents the result of name resolution.
@@ -109,6 +277,12 @@ type Result struct {
 
 	v4done bool
 	v6done bool
+
+	// rcode is the RCode of the latest failed response.
+	rcode dnsmessage.RCode
+
+	// negative is true if the result caches a failed lookup.
+	negative bool
 }
 
 type Resolver struct {
@@ -133,11 +307,40 @@ type Resolver struct {
 	// udpClient is the UDPClient to use for sending queries and receiving replies.
 	udpClient zerocopy.UDPClient
 
+	// tls is the pool of DNS-over-TLS connections, or nil if queries are sent in cleartext.
+	tls *tlsConnPool
+
+	// minTTL is the minimum time to cache a result for. 0 means no minimum.
+	minTTL time.Duration
+
+	// maxTTL is the maximum time to cache a result for. 0 means no limit.
+	maxTTL time.Duration
+
+	// negativeTTL is how long to cache NXDOMAIN and SERVFAIL responses for. 0 disables negative caching.
+	negativeTTL time.Duration
+
+	// serveStale is how long after expiry cached results may be served on upstream failure. 0 disables it.
+	serveStale time.Duration
+
+	// minTTLClamped counts results whose TTLs have been raised to minTTL.
+	minTTLClamped atomic.Uint64
+
+	// maxTTLClamped counts results whose TTLs have been lowered to maxTTL.
+	maxTTLClamped atomic.Uint64
+
+	// negativeHits counts lookups failed by cached negative results.
+	negativeHits atomic.Uint64
+
+	// staleServed counts stale results served on upstream failure.
+	staleServed atomic.Uint64
+
 	// logger is the shared logger instance.
 	logger *zap.Logger
 }
 
-func NewResolver(name string, serverAddrPort netip.AddrPort, tcpClient zerocopy.TCPClient, udpClient zerocopy.UDPClient, logger *zap.Logger) *Resolver {
+// NewResolver returns a new resolver that sends queries to serverAddrPort,
+// and caches results according to the cache policy.
+func NewResolver(name string, serverAddrPort netip.AddrPort, tcpClient zerocopy.TCPClient, udpClient zerocopy.UDPClient, policy CachePolicy, logger *zap.Logger) *Resolver {
 	return &Resolver{
 		name:           name,
 		cache:          make(map[string]Result),
@@ -145,10 +348,68 @@ func NewResolver(name string, serverAddrPort netip.AddrPort, tcpClient zerocopy.
 		serverAddrPort: serverAddrPort,
 		tcpClient:      tcpClient,
 		udpClient:      udpClient,
+		minTTL:         policy.MinTTL,
+		maxTTL:         policy.MaxTTL,
+		negativeTTL:    policy.NegativeTTL,
+		serveStale:     policy.ServeStale,
 		logger:         logger,
 	}
 }
 
+// ResolverStats contains counters of a resolver.
+type ResolverStats struct {
+	// MinTTLClamped is the number of results whose TTLs have been raised to the minimum TTL.
+	MinTTLClamped uint64 `json:"minTTLClamped"`
+
+	// MaxTTLClamped is the number of results whose TTLs have been lowered to the maximum TTL.
+	MaxTTLClamped uint64 `json:"maxTTLClamped"`
+
+	// NegativeHits is the number of lookups failed by cached NXDOMAIN or SERVFAIL responses.
+	NegativeHits uint64 `json:"negativeHits"`
+
+	// StaleServed is the number of expired results returned because the upstream server failed to answer.
+	StaleServed uint64 `json:"staleServed"`
+}
+
+// Stats returns the resolver's counters.
+func (r *Resolver) Stats() ResolverStats {
+	return ResolverStats{
+		MinTTLClamped: r.minTTLClamped.Load(),
+		MaxTTLClamped: r.maxTTLClamped.Load(),
+		NegativeHits:  r.negativeHits.Load(),
+		StaleServed:   r.staleServed.Load(),
+	}
+}
+
+// clampTTL clamps the result's TTL to the resolver's TTL range.
+// Results without answers are left as is, so that they are not cached.
+func (r *Resolver) clampTTL(nameString string, result *Result, now time.Time) {
+	if result.TTL.IsZero() {
+		return
+	}
+
+	ttl := result.TTL.Sub(now)
+	switch {
+	case ttl < r.minTTL:
+		result.TTL = now.Add(r.minTTL)
+		r.minTTLClamped.Add(1)
+	case r.maxTTL != 0 && ttl > r.maxTTL:
+		result.TTL = now.Add(r.maxTTL)
+		r.maxTTLClamped.Add(1)
+	default:
+		return
+	}
+
+	if ce := r.logger.Check(zap.DebugLevel, "DNS lookup clamped result TTL"); ce != nil {
+		ce.Write(
+			zap.String("resolver", r.name),
+			zap.String("name", nameString),
+			zap.Duration("originalTTL", ttl),
+			zap.Time("ttl", result.TTL),
+		)
+	}
+}
+
 func (r *Resolver) lookup(ctx context.Context, name string) (Result, error) {
 	// Lookup cache first.
 	r.mu.RLock()
@@ -156,6 +417,17 @@ func (r *Resolver) lookup(ctx context.Context, name string) (Result, error) {
 	r.mu.RUnlock()
 
 	if ok && !result.HasExpired() {
+		if result.negative {
+			r.negativeHits.Add(1)
+			if ce := r.logger.Check(zap.DebugLevel, "DNS lookup got negative result from cache"); ce != nil {
+				ce.Write(
+					zap.String("resolver", r.name),
+					zap.String("name", name),
+					zap.Time("ttl", result.TTL),
+				)
+			}
+			return Result{}, ErrLookup
+		}
 		if ce := r.logger.Check(zap.DebugLevel, "DNS lookup got result from cache"); ce != nil {
 			ce.Write(
 				zap.String("resolver", r.name),
@@ -169,7 +441,42 @@ func (r *Resolver) lookup(ctx context.Context, name string) (Result, error) {
 	}
 
 	// Send queries to upstream server.
-	return r.sendQueries(ctx, name)
+	fresh, err := r.sendQueries(ctx, name)
+	if err == nil {
+		return fresh, nil
+	}
+
+	// Serve the stale result, unless the name does not exist.
+	if ok && !result.negative && fresh.rcode != dnsmessage.RCodeNameError &&
+		r.serveStale > 0 && time.Since(result.TTL) < r.serveStale {
+		r.staleServed.Add(1)
+		if ce := r.logger.Check(zap.DebugLevel, "DNS lookup served stale result from cache"); ce != nil {
+			ce.Write(
+				zap.String("resolver", r.name),
+				zap.String("name", name),
+				zap.Time("ttl", result.TTL),
+				zap.Stringers("v4", result.IPv4),
+				zap.Stringers("v6", result.IPv6),
+			)
+		}
+		return result, nil
+	}
+
+	// Cache the failure.
+	switch fresh.rcode {
+	case dnsmessage.RCodeNameError, dnsmessage.RCodeServerFailure:
+		if r.negativeTTL > 0 {
+			r.mu.Lock()
+			r.cache[name] = Result{
+				TTL:      time.Now().Add(r.negativeTTL),
+				rcode:    fresh.rcode,
+				negative: true,
+			}
+			r.mu.Unlock()
+		}
+	}
+
+	return Result{}, err
 }
 
 func (r *Resolver) sendQueries(ctx context.Context, nameString string) (result Result, err error) {
@@ -243,6 +550,12 @@ func (r *Resolver) sendQueries(ctx context.Context, nameString string) (result R
 	}
 	q6PktEnd := q6PktStart + len(q6Pkt)
 
+	// Write length fields for TCP and TLS.
+	q4LenBuf := qBuf[:2]
+	q6LenBuf := qBuf[q4PktEnd:q6PktStart]
+	binary.BigEndian.PutUint16(q4LenBuf, uint16(len(q4Pkt)))
+	binary.BigEndian.PutUint16(q6LenBuf, uint16(len(q6Pkt)))
+
 	// Try UDP first if available.
 	if r.udpClient != nil {
 		result = r.sendQueriesUDP(ctx, nameString, q4Pkt, q6Pkt)
@@ -261,12 +574,6 @@ func (r *Resolver) sendQueries(ctx context.Context, nameString string) (result R
 
 	// Fallback to TCP if UDP failed or is unavailable.
 	if !result.isDone() && r.tcpClient != nil {
-		// Write length fields.
-		q4LenBuf := qBuf[:2]
-		q6LenBuf := qBuf[q4PktEnd:q6PktStart]
-		binary.BigEndian.PutUint16(q4LenBuf, uint16(len(q4Pkt)))
-		binary.BigEndian.PutUint16(q6LenBuf, uint16(len(q6Pkt)))
-
 		result = r.sendQueriesTCP(ctx, nameString, qBuf[:q6PktEnd])
 
 		if ce := r.logger.Check(zap.DebugLevel, "DNS lookup sent queries via TCP"); ce != nil {
@@ -281,11 +588,28 @@ func (r *Resolver) sendQueries(ctx context.Context, nameString string) (result R
 		}
 	}
 
+	if r.tls != nil {
+		result = r.sendQueriesTLS(ctx, nameString, qBuf[:q6PktEnd])
+
+		if ce := r.logger.Check(zap.DebugLevel, "DNS lookup sent queries via TLS"); ce != nil {
+			ce.Write(
+				zap.String("resolver", r.name),
+				zap.String("name", nameString),
+				zap.Bool("handled", result.isDone()),
+				zap.Stringers("v4", result.IPv4),
+				zap.Stringers("v6", result.IPv6),
+				zap.Time("ttl", result.TTL),
+			)
+		}
+	}
+
 	if !result.isDone() {
 		err = ErrLookup
 		return
 	}
 
+	r.clampTTL(nameString, &result, time.Now())
+
 	// Add result to cache if TTL hasn't expired.
 	if !result.HasExpired() {
 		r.mu.Lock()
@@ -601,6 +925,7 @@ func (r *Result) parseMsg(msg []byte) (dnsmessage.Header, error) {
 
 	// Check RCode.
 	if header.RCode != dnsmessage.RCodeSuccess {
+		r.rcode = header.RCode
 		return dnsmessage.Header{}, fmt.Errorf("DNS failure: %s", header.RCode)
 	}
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/direct"
@@ -13,7 +14,7 @@ import (
 )
 
 func testResolver(t *testing.T, ctx context.Context, name string, serverAddrPort netip.AddrPort, tcpClient zerocopy.TCPClient, udpClient zerocopy.UDPClient, logger *zap.Logger) {
-	r := NewResolver(name, serverAddrPort, tcpClient, udpClient, logger)
+	r := NewResolver(name, serverAddrPort, tcpClient, udpClient, CachePolicy{}, logger)
 
 	// Uncached lookup.
 	uncachedResult, err := r.Lookup(ctx, "example.com")
@@ -44,7 +45,7 @@ func TestResolver(t *testing.T) {
 
 	ctx := context.Background()
 	serverAddrPort := netip.AddrPortFrom(netip.AddrFrom4([4]byte{1, 1, 1, 1}), 53)
-	tcpClient := direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer)
+	tcpClient := direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer, 0)
 	udpClient := direct.NewDirectUDPClient("direct", "ip", 1500, conn.DefaultUDPClientListenConfig)
 
 	t.Run("UDP", func(t *testing.T) {
@@ -55,3 +56,31 @@ func TestResolver(t *testing.T) {
 		testResolver(t, ctx, "TCP", serverAddrPort, tcpClient, nil, logger)
 	})
 }
+
+func TestResolverClampTTL(t *testing.T) {
+	r := NewResolver("clamp", netip.AddrPortFrom(netip.IPv6Loopback(), 53), nil, nil, CachePolicy{MinTTL: time.Minute, MaxTTL: time.Hour}, zaptest.NewLogger(t))
+	now := time.Now()
+
+	for _, c := range []struct {
+		name    string
+		ttl     time.Time
+		wantTTL time.Time
+	}{
+		{"NoAnswers", time.Time{}, time.Time{}},
+		{"ZeroTTL", now, now.Add(time.Minute)},
+		{"InRange", now.Add(10 * time.Minute), now.Add(10 * time.Minute)},
+		{"TooLong", now.Add(24 * time.Hour), now.Add(time.Hour)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			result := Result{TTL: c.ttl}
+			r.clampTTL("example.com", &result, now)
+			if !result.TTL.Equal(c.wantTTL) {
+				t.Errorf("TTL = %v, want %v", result.TTL, c.wantTTL)
+			}
+		})
+	}
+
+	if stats := r.Stats(); stats != (ResolverStats{MinTTLClamped: 1, MaxTTLClamped: 1}) {
+		t.Errorf("stats = %+v, want 1 min and 1 max clamped", stats)
+	}
+}
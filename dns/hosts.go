@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// HostsConfig maps domain names to IP addresses, like /etc/hosts.
+//
+// A key is either a domain name, which matches only itself, or a wildcard like "*.example.com",
+// which matches all subdomains of example.com, but not example.com itself.
+// When multiple wildcards match a name, the longest one wins. Keys are case-insensitive.
+type HostsConfig map[string][]netip.Addr
+
+// Hosts creates a new [Hosts] from the config.
+// It returns nil if the config is empty.
+func (hc HostsConfig) Hosts(logger *zap.Logger) (*Hosts, error) {
+	if len(hc) == 0 {
+		return nil, nil
+	}
+
+	h := Hosts{
+		exact:    make(map[string][]netip.Addr),
+		wildcard: make(map[string][]netip.Addr),
+		logger:   logger,
+	}
+
+	for key, addrs := range hc {
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", key)
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(key, "."))
+		m := h.exact
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			name = suffix
+			m = h.wildcard
+		}
+		if name == "" || strings.Contains(name, "*") {
+			return nil, fmt.Errorf("bad hosts entry: %q", key)
+		}
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("duplicate hosts entry: %q", key)
+		}
+
+		ips := make([]netip.Addr, len(addrs))
+		for i, addr := range addrs {
+			if !addr.IsValid() {
+				return nil, fmt.Errorf("bad address for %s", key)
+			}
+			ips[i] = addr.Unmap()
+		}
+		m[name] = ips
+	}
+
+	return &h, nil
+}
+
+// Hosts answers lookups from static mappings of domain names to IP addresses.
+// It implements [SimpleResolver], and fails lookups of names that are not mapped.
+type Hosts struct {
+	exact    map[string][]netip.Addr
+	wildcard map[string][]netip.Addr
+	logger   *zap.Logger
+}
+
+// errNotInHosts is returned when the name is not mapped.
+var errNotInHosts = errors.New("name not in hosts")
+
+// lookup returns the IP addresses mapped to name.
+func (h *Hosts) lookup(name string) ([]netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if ips, ok := h.exact[name]; ok {
+		return ips, true
+	}
+
+	for {
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return nil, false
+		}
+		if ips, ok := h.wildcard[parent]; ok {
+			return ips, true
+		}
+		name = parent
+	}
+}
+
+// LookupIP implements [SimpleResolver.LookupIP].
+// Like [Resolver], it prefers IPv6 addresses.
+func (h *Hosts) LookupIP(ctx context.Context, name string) (netip.Addr, error) {
+	ips, err := h.LookupIPs(ctx, name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, ip := range ips {
+		if ip.Is6() {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// LookupIPs implements [SimpleResolver.LookupIPs].
+func (h *Hosts) LookupIPs(_ context.Context, name string) ([]netip.Addr, error) {
+	ips, ok := h.lookup(name)
+	if !ok {
+		return nil, errNotInHosts
+	}
+
+	if ce := h.logger.Check(zap.DebugLevel, "DNS lookup got result from hosts"); ce != nil {
+		ce.Write(
+			zap.String("name", name),
+			zap.Stringers("ips", ips),
+		)
+	}
+
+	return append([]netip.Addr(nil), ips...), nil
+}
+
+// Wrap returns a resolver that answers mapped names from the hosts,
+// and sends lookups of other names to r.
+func (h *Hosts) Wrap(r SimpleResolver) SimpleResolver {
+	return &hostsResolver{
+		hosts:    h,
+		resolver: r,
+	}
+}
+
+// hostsResolver is a [SimpleResolver] that consults the hosts before its resolver.
+type hostsResolver struct {
+	hosts    *Hosts
+	resolver SimpleResolver
+}
+
+// LookupIP implements [SimpleResolver.LookupIP].
+func (r *hostsResolver) LookupIP(ctx context.Context, name string) (netip.Addr, error) {
+	if ip, err := r.hosts.LookupIP(ctx, name); err == nil {
+		return ip, nil
+	}
+	return r.resolver.LookupIP(ctx, name)
+}
+
+// LookupIPs implements [SimpleResolver.LookupIPs].
+func (r *hostsResolver) LookupIPs(ctx context.Context, name string) ([]netip.Addr, error) {
+	if ips, err := r.hosts.LookupIPs(ctx, name); err == nil {
+		return ips, nil
+	}
+	return r.resolver.LookupIPs(ctx, name)
+}
@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// fixedResolver answers every lookup with ip.
+type fixedResolver netip.Addr
+
+func (r fixedResolver) LookupIP(_ context.Context, _ string) (netip.Addr, error) {
+	return netip.Addr(r), nil
+}
+
+func (r fixedResolver) LookupIPs(_ context.Context, _ string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.Addr(r)}, nil
+}
+
+func TestHosts(t *testing.T) {
+	var (
+		nasIP      = netip.MustParseAddr("192.168.1.2")
+		corpIPv4   = netip.MustParseAddr("10.0.0.1")
+		corpIPv6   = netip.MustParseAddr("fd00::1")
+		apiIP      = netip.MustParseAddr("10.0.0.2")
+		upstreamIP = netip.MustParseAddr("203.0.113.1")
+	)
+
+	h, err := HostsConfig{
+		"nas.lan":                {nasIP},
+		"*.corp.example.com":     {corpIPv4, corpIPv6},
+		"*.api.corp.example.com": {apiIP},
+	}.Hosts(zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Hosts() failed: %v", err)
+	}
+
+	r := h.Wrap(fixedResolver(upstreamIP))
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		name    string
+		wantIPs []netip.Addr
+		wantIP  netip.Addr
+	}{
+		{"nas.lan", []netip.Addr{nasIP}, nasIP},
+		{"NAS.lan.", []netip.Addr{nasIP}, nasIP},
+		{"sub.nas.lan", []netip.Addr{upstreamIP}, upstreamIP},
+		{"corp.example.com", []netip.Addr{upstreamIP}, upstreamIP},
+		{"git.corp.example.com", []netip.Addr{corpIPv4, corpIPv6}, corpIPv6},
+		{"a.b.corp.example.com", []netip.Addr{corpIPv4, corpIPv6}, corpIPv6},
+		{"v1.api.corp.example.com", []netip.Addr{apiIP}, apiIP},
+		{"example.com", []netip.Addr{upstreamIP}, upstreamIP},
+	} {
+		ips, err := r.LookupIPs(ctx, c.name)
+		if err != nil {
+			t.Errorf("LookupIPs(%q) failed: %v", c.name, err)
+		} else if !slices.Equal(ips, c.wantIPs) {
+			t.Errorf("LookupIPs(%q) = %v, expected %v", c.name, ips, c.wantIPs)
+		}
+
+		ip, err := r.LookupIP(ctx, c.name)
+		if err != nil {
+			t.Errorf("LookupIP(%q) failed: %v", c.name, err)
+		} else if ip != c.wantIP {
+			t.Errorf("LookupIP(%q) = %s, expected %s", c.name, ip, c.wantIP)
+		}
+	}
+
+	if _, err = h.LookupIP(ctx, "example.com"); err != errNotInHosts {
+		t.Errorf("h.LookupIP() error = %v, expected %v", err, errNotInHosts)
+	}
+}
+
+func TestHostsConfigError(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	for _, hc := range []HostsConfig{
+		{"example.com": nil},
+		{"example.com": {{}}},
+		{"*": {ip}},
+		{"*.": {ip}},
+		{"a.*.example.com": {ip}},
+		{"example.com": {ip}, "Example.com.": {ip}},
+	} {
+		if _, err := hc.Hosts(zaptest.NewLogger(t)); err == nil {
+			t.Errorf("%v.Hosts() succeeded, expected error", hc)
+		}
+	}
+
+	if h, err := HostsConfig(nil).Hosts(zaptest.NewLogger(t)); h != nil || err != nil {
+		t.Errorf("HostsConfig(nil).Hosts() = %v, %v, expected nil, nil", h, err)
+	}
+}
@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MaxUDPResponseSize is the maximum size of DNS responses over UDP without EDNS(0).
+	MaxUDPResponseSize = 512
+
+	// respondTTL is the TTL of answers in responses built by [Respond].
+	// Resolvers do not expose the TTLs of their results, so a short TTL is used
+	// to keep clients from caching answers for much longer than the resolver does.
+	respondTTL = 60
+)
+
+// Respond answers the DNS query message in query with the addresses looked up by resolver,
+// and returns the response message.
+//
+// A and AAAA questions are answered with the resolver's addresses of the matching family.
+// Other questions of a standard query are answered with no records, and other opcodes with NOTIMP.
+// If the lookup fails, the response has SERVFAIL.
+//
+// If maxSize is positive and the response is larger, the answers are removed,
+// and the TC bit is set, so that the client retries the query over TCP.
+//
+// An error is returned if query is not a valid DNS query.
+func Respond(ctx context.Context, resolver SimpleResolver, query []byte, maxSize int) ([]byte, error) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("message is not a query")
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Response = true
+	header.Authoritative = false
+	header.Truncated = false
+	header.RecursionAvailable = true
+	header.AuthenticData = false
+	header.RCode = dnsmessage.RCodeSuccess
+
+	var answers []dnsmessage.Resource
+
+	switch {
+	case header.OpCode != 0:
+		header.RCode = dnsmessage.RCodeNotImplemented
+	case len(questions) != 1:
+		header.RCode = dnsmessage.RCodeFormatError
+	default:
+		q := questions[0]
+		if q.Class != dnsmessage.ClassINET || q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+			break
+		}
+
+		ips, err := resolver.LookupIPs(ctx, strings.TrimSuffix(q.Name.String(), "."))
+		if err != nil {
+			if err != ErrDomainNoAssociatedIPs {
+				header.RCode = dnsmessage.RCodeServerFailure
+			}
+			break
+		}
+
+		rh := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Type:  q.Type,
+			Class: q.Class,
+			TTL:   respondTTL,
+		}
+
+		for _, ip := range ips {
+			ip = ip.Unmap()
+			switch {
+			case q.Type == dnsmessage.TypeA && ip.Is4():
+				answers = append(answers, dnsmessage.Resource{
+					Header: rh,
+					Body:   &dnsmessage.AResource{A: ip.As4()},
+				})
+			case q.Type == dnsmessage.TypeAAAA && ip.Is6():
+				answers = append(answers, dnsmessage.Resource{
+					Header: rh,
+					Body:   &dnsmessage.AAAAResource{AAAA: ip.As16()},
+				})
+			}
+		}
+	}
+
+	msg := dnsmessage.Message{
+		Header:    header,
+		Questions: questions,
+		Answers:   answers,
+	}
+
+	b, err := msg.AppendPack(make([]byte, 0, MaxUDPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize > 0 && len(b) > maxSize {
+		return TruncateResponse(b)
+	}
+	return b, nil
+}
@@ -0,0 +1,153 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func packTestQuery(t *testing.T, id uint16, opCode dnsmessage.OpCode, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               id,
+			OpCode:           opCode,
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{
+			{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRespond(t *testing.T) {
+	var (
+		ip4 = netip.MustParseAddr("192.0.2.1")
+		ip6 = netip.MustParseAddr("2001:db8::1")
+	)
+
+	h, err := HostsConfig{
+		"both.example.com": {ip4, ip6},
+		"v4.example.com":   {ip4},
+	}.Hosts(zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Hosts() failed: %v", err)
+	}
+
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		name        string
+		opCode      dnsmessage.OpCode
+		qname       string
+		qtype       dnsmessage.Type
+		wantRCode   dnsmessage.RCode
+		wantAnswers []netip.Addr
+	}{
+		{"A", 0, "both.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []netip.Addr{ip4}},
+		{"AAAA", 0, "both.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []netip.Addr{ip6}},
+		{"NoData", 0, "v4.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil},
+		{"OtherType", 0, "both.example.com.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil},
+		{"LookupError", 0, "missing.example.com.", dnsmessage.TypeA, dnsmessage.RCodeServerFailure, nil},
+		{"OtherOpCode", 2, "both.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNotImplemented, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := Respond(ctx, h, packTestQuery(t, 0x1234, c.opCode, c.qname, c.qtype), MaxUDPResponseSize)
+			if err != nil {
+				t.Fatalf("Respond failed: %v", err)
+			}
+
+			var msg dnsmessage.Message
+			if err = msg.Unpack(b); err != nil {
+				t.Fatalf("Failed to unpack response: %v", err)
+			}
+			if msg.ID != 0x1234 || !msg.Response || !msg.RecursionDesired {
+				t.Errorf("Unexpected header: %+v", msg.Header)
+			}
+			if msg.RCode != c.wantRCode {
+				t.Errorf("RCode = %v, want %v", msg.RCode, c.wantRCode)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != c.qname {
+				t.Errorf("Questions = %v, want the query's question", msg.Questions)
+			}
+			if len(msg.Answers) != len(c.wantAnswers) {
+				t.Fatalf("len(Answers) = %d, want %d", len(msg.Answers), len(c.wantAnswers))
+			}
+			for i, answer := range msg.Answers {
+				var got netip.Addr
+				switch body := answer.Body.(type) {
+				case *dnsmessage.AResource:
+					got = netip.AddrFrom4(body.A)
+				case *dnsmessage.AAAAResource:
+					got = netip.AddrFrom16(body.AAAA)
+				}
+				if got != c.wantAnswers[i] {
+					t.Errorf("Answers[%d] = %v, want %v", i, got, c.wantAnswers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRespondTruncate(t *testing.T) {
+	ips := make([]netip.Addr, 64)
+	for i := range ips {
+		ips[i] = netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)})
+	}
+
+	h, err := HostsConfig{"many.example.com": ips}.Hosts(zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("Hosts() failed: %v", err)
+	}
+
+	query := packTestQuery(t, 1, 0, "many.example.com.", dnsmessage.TypeAAAA)
+
+	b, err := Respond(context.Background(), h, query, MaxUDPResponseSize)
+	if err != nil {
+		t.Fatalf("Respond failed: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err = msg.Unpack(b); err != nil {
+		t.Fatalf("Failed to unpack response: %v", err)
+	}
+	if !msg.Truncated || len(msg.Answers) != 0 {
+		t.Errorf("Truncated = %t, len(Answers) = %d, want truncated response without answers", msg.Truncated, len(msg.Answers))
+	}
+
+	b, err = Respond(context.Background(), h, query, 0)
+	if err != nil {
+		t.Fatalf("Respond failed: %v", err)
+	}
+	if err = msg.Unpack(b); err != nil {
+		t.Fatalf("Failed to unpack response: %v", err)
+	}
+	if msg.Truncated || len(msg.Answers) != len(ips) {
+		t.Errorf("Truncated = %t, len(Answers) = %d, want %d answers", msg.Truncated, len(msg.Answers), len(ips))
+	}
+}
+
+func TestRespondInvalidQuery(t *testing.T) {
+	if _, err := Respond(context.Background(), fixedResolver{}, []byte{1, 2, 3}, 0); err == nil {
+		t.Error("Respond succeeded on a malformed message, expected error")
+	}
+
+	resp, err := Respond(context.Background(), fixedResolver{}, packTestQuery(t, 1, 0, "example.com.", dnsmessage.TypeA), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Respond(context.Background(), fixedResolver{}, resp, 0); err == nil {
+		t.Error("Respond succeeded on a response, expected error")
+	}
+}
@@ -0,0 +1,111 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SplitRuleConfig routes lookups of names in the domains to a resolver.
+type SplitRuleConfig struct {
+	// Domains is the list of domain suffixes to match.
+	// A suffix matches the domain itself and all its subdomains.
+	Domains []string `json:"domains"`
+
+	// Resolver is the name of the resolver to send matched lookups to.
+	Resolver string `json:"resolver"`
+}
+
+// SplitResolver sends lookups to upstream resolvers by the longest matching domain suffix,
+// and lookups of names without a match to the default resolver.
+//
+// Each upstream resolver keeps its own cache, so results from different upstreams never mix.
+// It implements [SimpleResolver].
+type SplitResolver struct {
+	name            string
+	suffixes        map[string]splitUpstream
+	defaultResolver splitUpstream
+	logger          *zap.Logger
+}
+
+// splitUpstream is an upstream resolver of a [SplitResolver].
+type splitUpstream struct {
+	name     string
+	resolver SimpleResolver
+}
+
+// NewSplitResolver returns a new [SplitResolver].
+//
+// suffixes maps lowercase domain suffixes to the names of their resolvers,
+// which are looked up in resolverMap, along with defaultResolverName.
+func NewSplitResolver(name string, suffixes map[string]string, defaultResolverName string, resolverMap map[string]SimpleResolver, logger *zap.Logger) (*SplitResolver, error) {
+	upstream := func(name string) (splitUpstream, error) {
+		resolver, ok := resolverMap[name]
+		if !ok {
+			return splitUpstream{}, fmt.Errorf("unknown resolver: %s", name)
+		}
+		return splitUpstream{name, resolver}, nil
+	}
+
+	defaultResolver, err := upstream(defaultResolverName)
+	if err != nil {
+		return nil, err
+	}
+
+	r := SplitResolver{
+		name:            name,
+		suffixes:        make(map[string]splitUpstream, len(suffixes)),
+		defaultResolver: defaultResolver,
+		logger:          logger,
+	}
+
+	for suffix, resolverName := range suffixes {
+		if r.suffixes[suffix], err = upstream(resolverName); err != nil {
+			return nil, err
+		}
+	}
+
+	return &r, nil
+}
+
+// upstream returns the upstream resolver for name.
+func (r *SplitResolver) upstream(name string) splitUpstream {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for {
+		if u, ok := r.suffixes[name]; ok {
+			return u
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return r.defaultResolver
+		}
+		name = parent
+	}
+}
+
+// selectUpstream returns the upstream resolver for name, and logs the selection.
+func (r *SplitResolver) selectUpstream(name string) SimpleResolver {
+	u := r.upstream(name)
+	if ce := r.logger.Check(zap.DebugLevel, "DNS lookup selected upstream resolver"); ce != nil {
+		ce.Write(
+			zap.String("resolver", r.name),
+			zap.String("name", name),
+			zap.String("upstream", u.name),
+		)
+	}
+	return u.resolver
+}
+
+// LookupIP implements [SimpleResolver.LookupIP].
+func (r *SplitResolver) LookupIP(ctx context.Context, name string) (netip.Addr, error) {
+	return r.selectUpstream(name).LookupIP(ctx, name)
+}
+
+// LookupIPs implements [SimpleResolver.LookupIPs].
+func (r *SplitResolver) LookupIPs(ctx context.Context, name string) ([]netip.Addr, error) {
+	return r.selectUpstream(name).LookupIPs(ctx, name)
+}
@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSplitResolver(t *testing.T) {
+	var (
+		corpIP    = netip.MustParseAddr("10.0.0.1")
+		labIP     = netip.MustParseAddr("10.1.0.1")
+		defaultIP = netip.MustParseAddr("203.0.113.1")
+	)
+
+	resolverMap := map[string]SimpleResolver{
+		"corp":    fixedResolver(corpIP),
+		"lab":     fixedResolver(labIP),
+		"default": fixedResolver(defaultIP),
+	}
+
+	rc := ResolverConfig{
+		Name: "split",
+		Type: "split",
+		Rules: []SplitRuleConfig{
+			{Domains: []string{"corp.example.com", "Internal."}, Resolver: "corp"},
+			{Domains: []string{"lab.corp.example.com"}, Resolver: "lab"},
+		},
+		DefaultResolver: "default",
+	}
+
+	r, err := rc.SimpleResolver(nil, nil, resolverMap, zaptest.NewLogger(t))
+	if err != nil {
+		t.Fatalf("SimpleResolver() failed: %v", err)
+	}
+
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		name string
+		want netip.Addr
+	}{
+		{"corp.example.com", corpIP},
+		{"git.corp.example.com", corpIP},
+		{"GIT.CORP.EXAMPLE.COM.", corpIP},
+		{"lab.corp.example.com", labIP},
+		{"a.lab.corp.example.com", labIP},
+		{"wiki.internal", corpIP},
+		{"notcorp.example.com", defaultIP},
+		{"example.com", defaultIP},
+		{"internal.example.com", defaultIP},
+	} {
+		ip, err := r.LookupIP(ctx, c.name)
+		if err != nil {
+			t.Errorf("LookupIP(%q) failed: %v", c.name, err)
+		} else if ip != c.want {
+			t.Errorf("LookupIP(%q) = %s, expected %s", c.name, ip, c.want)
+		}
+	}
+}
+
+func TestSplitResolverConfigError(t *testing.T) {
+	resolverMap := map[string]SimpleResolver{
+		"default": fixedResolver(netip.MustParseAddr("203.0.113.1")),
+	}
+
+	for _, rc := range []ResolverConfig{
+		{Name: "no-default", Type: "split"},
+		{Name: "unknown-default", Type: "split", DefaultResolver: "unknown"},
+		{Name: "unknown-rule", Type: "split", DefaultResolver: "default", Rules: []SplitRuleConfig{{Domains: []string{"example.com"}, Resolver: "unknown"}}},
+		{Name: "no-domains", Type: "split", DefaultResolver: "default", Rules: []SplitRuleConfig{{Resolver: "default"}}},
+		{Name: "duplicate", Type: "split", DefaultResolver: "default", Rules: []SplitRuleConfig{{Domains: []string{"example.com", "Example.com."}, Resolver: "default"}}},
+		{Name: "addr", Type: "split", DefaultResolver: "default", AddrPort: netip.MustParseAddrPort("[::1]:53")},
+		{Name: "cache", Type: "split", DefaultResolver: "default", CachePath: "cache.json"},
+		{Name: "plain-rules", AddrPort: netip.MustParseAddrPort("[::1]:53"), DefaultResolver: "default"},
+	} {
+		if _, err := rc.SimpleResolver(nil, nil, resolverMap, zaptest.NewLogger(t)); err == nil {
+			t.Errorf("%s: SimpleResolver() succeeded, expected error", rc.Name)
+		}
+	}
+}
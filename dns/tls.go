@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxIdleTLSConns is the maximum number of idle DNS-over-TLS connections to keep for reuse.
+	maxIdleTLSConns = 4
+
+	// tlsConnIdleTimeout is how long an idle DNS-over-TLS connection is kept for reuse.
+	// Servers usually close idle connections after tens of seconds.
+	tlsConnIdleTimeout = 30 * time.Second
+)
+
+// NewTLSResolver returns a new resolver that sends queries over TLS (RFC 7858) to serverAddrPort
+// through tcpClient. Connections are kept open for reuse, and are reestablished when the server closes them.
+func NewTLSResolver(name string, serverAddrPort netip.AddrPort, tlsConfig *tls.Config, tcpClient zerocopy.TCPClient, policy CachePolicy, logger *zap.Logger) *Resolver {
+	r := NewResolver(name, serverAddrPort, nil, nil, policy, logger)
+	r.tls = &tlsConnPool{
+		tcpClient:  tcpClient,
+		serverAddr: r.serverAddr,
+		tlsConfig:  tlsConfig,
+	}
+	return r
+}
+
+// tlsConn is a DNS-over-TLS connection.
+type tlsConn struct {
+	*tls.Conn
+
+	// idleSince is when the connection was returned to the pool.
+	idleSince time.Time
+}
+
+// tlsConnPool keeps idle DNS-over-TLS connections to an upstream server for reuse.
+// Each connection is used by one lookup at a time.
+type tlsConnPool struct {
+	tcpClient  zerocopy.TCPClient
+	serverAddr conn.Addr
+	tlsConfig  *tls.Config
+
+	mu   sync.Mutex
+	idle []*tlsConn
+}
+
+// get returns an idle connection, or a new connection if there is none.
+// reused is true if the connection has been used before.
+func (p *tlsConnPool) get(ctx context.Context) (c *tlsConn, reused bool, err error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(c.idleSince) < tlsConnIdleTimeout {
+			p.mu.Unlock()
+			return c, true, nil
+		}
+		_ = c.Close()
+	}
+	p.mu.Unlock()
+
+	rawRW, rw, err := p.tcpClient.Dial(ctx, p.serverAddr, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tc := tls.Client(zerocopy.NewStreamConn(rawRW, rw), p.tlsConfig)
+	if err = tc.HandshakeContext(ctx); err != nil {
+		_ = rawRW.Close()
+		return nil, false, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	return &tlsConn{Conn: tc}, false, nil
+}
+
+// put returns the connection to the pool, or closes it if the pool is full.
+func (p *tlsConnPool) put(c *tlsConn) {
+	c.idleSince = time.Now()
+
+	p.mu.Lock()
+	if len(p.idle) < maxIdleTLSConns {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mu.Unlock()
+
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// exchange writes the length-prefixed queries to the connection and reads both responses.
+// read reports whether any response data has been read, so that failures on stale connections can be retried.
+func (c *tlsConn) exchange(queries []byte) (result Result, read bool, err error) {
+	if _, err = c.Write(queries); err != nil {
+		return result, false, err
+	}
+
+	lengthBuf := make([]byte, 2)
+
+	for range 2 {
+		if _, err = io.ReadFull(c, lengthBuf); err != nil {
+			return result, read, fmt.Errorf("failed to read response length: %w", err)
+		}
+		read = true
+
+		msgLen := binary.BigEndian.Uint16(lengthBuf)
+		if msgLen == 0 {
+			return result, read, errors.New("response length is zero")
+		}
+
+		msg := make([]byte, msgLen)
+		if _, err = io.ReadFull(c, msg); err != nil {
+			return result, read, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		// Like TCP, use truncated responses as is.
+		if _, err = result.parseMsg(msg); err != nil {
+			return result, read, err
+		}
+	}
+
+	return result, read, nil
+}
+
+// sendQueriesTLS sends the length-prefixed queries over a DNS-over-TLS connection and returns the result.
+// If a reused connection fails before any response is read, the queries are sent again over a new connection.
+func (r *Resolver) sendQueriesTLS(ctx context.Context, nameString string, queries []byte) (result Result) {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	for {
+		c, reused, err := r.tls.get(ctx)
+		if err != nil {
+			r.logger.Warn("Failed to connect to TLS DNS server",
+				zap.String("resolver", r.name),
+				zap.String("name", nameString),
+				zap.Stringer("serverAddrPort", r.serverAddrPort),
+				zap.Error(err),
+			)
+			return Result{}
+		}
+
+		// Unblock reads when the lookup times out.
+		stop := context.AfterFunc(ctx, func() {
+			_ = c.Close()
+		})
+
+		var read bool
+		result, read, err = c.exchange(queries)
+		if !stop() {
+			return Result{}
+		}
+		if err == nil {
+			r.tls.put(c)
+			return result
+		}
+		_ = c.Close()
+
+		if reused && !read {
+			if ce := r.logger.Check(zap.DebugLevel, "Reconnecting to TLS DNS server"); ce != nil {
+				ce.Write(
+					zap.String("resolver", r.name),
+					zap.String("name", nameString),
+					zap.Stringer("serverAddrPort", r.serverAddrPort),
+					zap.Error(err),
+				)
+			}
+			continue
+		}
+
+		r.logger.Warn("Failed to exchange TLS DNS messages",
+			zap.String("resolver", r.name),
+			zap.String("name", nameString),
+			zap.Stringer("serverAddrPort", r.serverAddrPort),
+			zap.Error(err),
+		)
+		// Keep the result for its RCode.
+		return result
+	}
+}
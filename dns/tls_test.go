@@ -0,0 +1,205 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	testTLSServerIPv4 = netip.MustParseAddr("192.0.2.1")
+	testTLSServerIPv6 = netip.MustParseAddr("2001:db8::1")
+)
+
+// testTLSServer is a DNS-over-TLS server that answers every query with fixed addresses,
+// or with rcode when it is set.
+type testTLSServer struct {
+	ln      net.Listener
+	rootCAs *x509.CertPool
+	accepts atomic.Int64
+	queries atomic.Int64
+	rcode   atomic.Uint32
+
+	mu    sync.Mutex
+	conns []net.Conn
+	wg    sync.WaitGroup
+}
+
+func newTestTLSServer(t *testing.T) *testTLSServer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testTLSServer{
+		ln:      ln,
+		rootCAs: x509.NewCertPool(),
+	}
+	s.rootCAs.AddCert(cert)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepts.Add(1)
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(t, c)
+			}()
+		}
+	}()
+
+	t.Cleanup(func() {
+		ln.Close()
+		s.closeConns()
+		s.wg.Wait()
+	})
+
+	return &s
+}
+
+// closeConns closes all accepted connections, like a server closing idle connections.
+func (s *testTLSServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testTLSServer) serve(t *testing.T, c net.Conn) {
+	lengthBuf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c, lengthBuf); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+
+		var m dnsmessage.Message
+		if err := m.Unpack(msg); err != nil {
+			t.Errorf("Failed to unpack query: %v", err)
+			return
+		}
+		s.queries.Add(1)
+		q := m.Questions[0]
+		m.Response = true
+		m.Additionals = nil
+		m.RCode = dnsmessage.RCode(s.rcode.Load())
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+		switch {
+		case m.RCode != dnsmessage.RCodeSuccess:
+		case q.Type == dnsmessage.TypeA:
+			m.Answers = []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.AResource{A: testTLSServerIPv4.As4()}}}
+		case q.Type == dnsmessage.TypeAAAA:
+			m.Answers = []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: testTLSServerIPv6.As16()}}}
+		}
+
+		b, err := m.AppendPack(make([]byte, 2, 512))
+		if err != nil {
+			t.Errorf("Failed to pack response: %v", err)
+			return
+		}
+		binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+		if _, err = c.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func TestTLSResolver(t *testing.T) {
+	s := newTestTLSServer(t)
+	serverAddrPort := s.ln.Addr().(*net.TCPAddr).AddrPort()
+	tcpClient := direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer, 0)
+	r := NewTLSResolver("DoT", serverAddrPort, &tls.Config{
+		ServerName: "127.0.0.1",
+		RootCAs:    s.rootCAs,
+	}, tcpClient, CachePolicy{}, zaptest.NewLogger(t))
+
+	ctx := context.Background()
+
+	lookup := func(name string) {
+		t.Helper()
+		result, err := r.Lookup(ctx, name)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed: %v", name, err)
+		}
+		if len(result.IPv4) != 1 || result.IPv4[0] != testTLSServerIPv4 || len(result.IPv6) != 1 || result.IPv6[0] != testTLSServerIPv6 {
+			t.Errorf("Lookup(%q) = %v %v, expected [%s] [%s]", name, result.IPv4, result.IPv6, testTLSServerIPv4, testTLSServerIPv6)
+		}
+	}
+
+	// Lookups reuse the connection.
+	lookup("a.example.com")
+	lookup("b.example.com")
+	if n := s.accepts.Load(); n != 1 {
+		t.Errorf("Server accepted %d connections, expected 1", n)
+	}
+
+	// The resolver reconnects after the server closes the connection.
+	s.closeConns()
+	lookup("c.example.com")
+	if n := s.accepts.Load(); n != 2 {
+		t.Errorf("Server accepted %d connections, expected 2", n)
+	}
+
+	// Certificates for other names are rejected.
+	bad := NewTLSResolver("DoT", serverAddrPort, &tls.Config{
+		ServerName: "dns.example.com",
+		RootCAs:    s.rootCAs,
+	}, tcpClient, CachePolicy{}, zaptest.NewLogger(t))
+	if _, err := bad.Lookup(ctx, "d.example.com"); err != ErrLookup {
+		t.Errorf("Lookup() error = %v, expected %v", err, ErrLookup)
+	}
+}
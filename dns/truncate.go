@@ -0,0 +1,39 @@
+package dns
+
+import "golang.org/x/net/dns/dnsmessage"
+
+// TruncateResponse truncates the DNS response in msg in place to its header and question section,
+// and sets the TC bit, so that the client retries the query over TCP.
+//
+// It returns the truncated message, which shares the underlying array with msg,
+// or an error if msg is not a valid DNS response.
+func TruncateResponse(msg []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !header.Response {
+		return nil, ErrMessageNotResponse
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	header.Truncated = true
+
+	// The questions have been copied out of msg, so it is safe to overwrite msg.
+	builder := dnsmessage.NewBuilder(msg[:0], header)
+	if err = builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		if err = builder.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTruncateResponse(t *testing.T) {
+	name := dnsmessage.MustNewName("example.com.")
+	question := dnsmessage.Question{
+		Name:  name,
+		Type:  dnsmessage.TypeAAAA,
+		Class: dnsmessage.ClassINET,
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               0x1234,
+			Response:         true,
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	for i := range 64 {
+		addr := netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: byte(i)})
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  name,
+				Type:  dnsmessage.TypeAAAA,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			},
+			Body: &dnsmessage.AAAAResource{AAAA: addr.As16()},
+		})
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncated, err := TruncateResponse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(truncated) >= len(b) {
+		t.Fatalf("len(truncated) = %d, expected less than %d", len(truncated), len(b))
+	}
+	if &truncated[0] != &b[0] {
+		t.Error("Truncated message does not share the underlying array")
+	}
+
+	var parsed dnsmessage.Message
+	if err = parsed.Unpack(truncated); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.ID != 0x1234 || !parsed.Header.Response || !parsed.Header.Truncated || !parsed.Header.RecursionDesired {
+		t.Errorf("parsed.Header = %+v, expected truncated response with ID 0x1234", parsed.Header)
+	}
+	if len(parsed.Questions) != 1 || parsed.Questions[0] != question {
+		t.Errorf("parsed.Questions = %v, expected [%v]", parsed.Questions, question)
+	}
+	if len(parsed.Answers) != 0 {
+		t.Errorf("len(parsed.Answers) = %d, expected 0", len(parsed.Answers))
+	}
+}
+
+func TestTruncateResponseQuery(t *testing.T) {
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("example.com."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = TruncateResponse(b); err != ErrMessageNotResponse {
+		t.Errorf("TruncateResponse(query) error = %v, expected %v", err, ErrMessageNotResponse)
+	}
+}
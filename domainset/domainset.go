@@ -2,16 +2,21 @@ package domainset
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"unsafe"
 
 	"github.com/database64128/shadowsocks-go/bytestrings"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
 	"github.com/database64128/shadowsocks-go/mmap"
 )
 
@@ -43,43 +48,122 @@ type Config struct {
 	//
 	//	- "text": text format (default)
 	//	- "gob": gob format
+	//	- "geosite": v2fly geosite.dat format, with the category selected by GeositeCode
+	//	- "suffixes": plain text list of domain suffixes, one per line
 	Type string `json:"type"`
 
 	// Path is the path to the domain set file.
+	//
+	// If URL is set, the downloaded file is saved to this path.
 	Path string `json:"path"`
+
+	// GeositeCode is the code of the category to load from a geosite file, such as "google".
+	// An attribute can be appended after an '@', such as "geolocation-!cn@cn".
+	GeositeCode string `json:"geositeCode"`
+
+	// URL is the optional HTTPS URL to download the domain set file from.
+	//
+	// If the file does not exist at Path, it is downloaded before the domain set is loaded.
+	URL string `json:"url"`
+
+	// UpdateInterval is the interval between downloads of the domain set file from URL.
+	// The domain set is replaced in place after each successful download.
+	//
+	// If zero, the file is only downloaded when it does not exist.
+	UpdateInterval jsonhelper.Duration `json:"updateInterval"`
 }
 
 // DomainSet creates a [DomainSet] from the configuration.
 func (dsc Config) DomainSet() (DomainSet, error) {
+	return dsc.domainSet(&http.Client{Timeout: downloadTimeout})
+}
+
+func (dsc Config) domainSet(client *http.Client) (DomainSet, error) {
+	if err := dsc.validate(); err != nil {
+		return nil, err
+	}
+
+	if dsc.URL != "" {
+		if _, err := os.Stat(dsc.Path); errors.Is(err, fs.ErrNotExist) {
+			ds, err := dsc.download(context.Background(), client)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download domain set file: %w", err)
+			}
+			return ds, nil
+		}
+	}
+
+	return dsc.load(dsc.Path)
+}
+
+func (dsc Config) validate() error {
+	if dsc.URL != "" {
+		u, err := url.Parse(dsc.URL)
+		if err != nil {
+			return fmt.Errorf("bad domain set URL: %w", err)
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("domain set URL must use HTTPS: %q", dsc.URL)
+		}
+		if dsc.Path == "" {
+			return errors.New("domain set with URL must have a path to save the downloaded file")
+		}
+	}
+
+	switch {
+	case dsc.UpdateInterval < 0:
+		return fmt.Errorf("negative update interval: %s", dsc.UpdateInterval.Value())
+	case dsc.UpdateInterval > 0 && dsc.URL == "":
+		return errors.New("update interval requires a URL")
+	}
+
+	return nil
+}
+
+// load loads the domain set from the file at path.
+func (dsc Config) load(path string) (DomainSet, error) {
 	var (
 		dsb Builder
 		err error
 	)
 
 	switch dsc.Type {
-	case "text", "":
+	case "text", "", "suffixes":
 		// Benchmarking shows that reading the whole file and then parsing it is faster than
 		// mmapping and cloning strings, with a slight increase in memory usage.
 
 		var data []byte
-		data, err = os.ReadFile(dsc.Path)
+		data, err = os.ReadFile(path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read domain set file: %w", err)
 		}
-		dsb, err = BuilderFromText(unsafe.String(unsafe.SliceData(data), len(data)))
+		text := unsafe.String(unsafe.SliceData(data), len(data))
+		if dsc.Type == "suffixes" {
+			dsb, err = BuilderFromSuffixes(text)
+		} else {
+			dsb, err = BuilderFromText(text)
+		}
 
 	case "gob":
 		var (
 			data  string
 			close func() error
 		)
-		data, close, err = mmap.ReadFile[string](dsc.Path)
+		data, close, err = mmap.ReadFile[string](path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read domain set file: %w", err)
 		}
 		dsb, err = BuilderFromGobString(data)
 		_ = close()
 
+	case "geosite":
+		var data []byte
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read domain set file: %w", err)
+		}
+		dsb, err = BuilderFromGeosite(data, dsc.GeositeCode)
+
 	default:
 		return nil, fmt.Errorf("invalid domain set type: %q", dsc.Type)
 	}
@@ -280,6 +364,45 @@ func BuilderFromText(text string) (Builder, error) {
 	return dsb, nil
 }
 
+// BuilderFromSuffixes parses the text as a list of domain suffixes, one per line,
+// inserts them into a suffix matcher builder, and returns the resulting domain set builder.
+//
+// Lines starting with '#' are comments. A leading "." or "+." on a suffix is ignored,
+// so that lists written for other software can be used as-is.
+//
+// The rule strings are not cloned. They reference the same memory as the input text.
+func BuilderFromSuffixes(text string) (Builder, error) {
+	dsb := Builder{
+		NewDomainMapMatcher(0),
+		NewDomainSuffixTrieMatcherBuilder(0),
+		NewKeywordLinearMatcher(0),
+		NewRegexpMatcherBuilder(0),
+	}
+
+	var count int
+
+	for line := range bytestrings.NonEmptyLines(text) {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		suffix := strings.TrimPrefix(strings.TrimPrefix(line, "+"), ".")
+		if suffix == "" || strings.ContainsAny(suffix, " \t") {
+			return dsb, fmt.Errorf("invalid line: %q", line)
+		}
+
+		dsb.SuffixMatcherBuilder().Insert(suffix)
+		count++
+	}
+
+	if count == 0 {
+		return dsb, errEmptySet
+	}
+
+	return dsb, nil
+}
+
 // ParseCapacityHint parses the capacity hint from the line.
 func ParseCapacityHint(line string) (dskr [4]int, found bool, err error) {
 	found = len(line) > capacityHintPrefixLen && line[:capacityHintPrefixLen] == capacityHintPrefix
@@ -112,3 +112,35 @@ func TestBuilderWriteText(t *testing.T) {
 	}
 	testDomainSet(t, ds)
 }
+
+func TestDomainSetFromSuffixes(t *testing.T) {
+	const text = `# Suffixes in different styles.
+example.com
+.github.com
++.cube64128.xyz
+
+  archlinux.org  
+`
+	dsb, err := BuilderFromSuffixes(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := dsb.DomainSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMatch(t, ds, "example.com", true)
+	testMatch(t, ds, "www.example.com", true)
+	testMatch(t, ds, "gobyexample.com", false)
+	testMatch(t, ds, "api.github.com", true)
+	testMatch(t, ds, "cube64128.xyz", true)
+	testMatch(t, ds, "aur.archlinux.org", true)
+	testMatch(t, ds, "wikipedia.org", false)
+
+	if _, err = BuilderFromSuffixes("# nothing here\n"); err != errEmptySet {
+		t.Errorf("BuilderFromSuffixes() on a comment-only list returned %v, expected %v", err, errEmptySet)
+	}
+	if _, err = BuilderFromSuffixes("example.com bad\n"); err == nil {
+		t.Error("BuilderFromSuffixes() on an invalid line returned nil error")
+	}
+}
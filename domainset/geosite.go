@@ -0,0 +1,215 @@
+package domainset
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Field numbers and domain types in v2fly's geosite.dat protobuf schema.
+const (
+	geositeListEntryField = 1
+
+	geositeCountryCodeField = 1
+	geositeDomainField      = 2
+
+	geositeDomainTypeField      = 1
+	geositeDomainValueField     = 2
+	geositeDomainAttributeField = 3
+
+	geositeAttributeKeyField = 1
+
+	geositeDomainTypePlain  = 0
+	geositeDomainTypeRegex  = 1
+	geositeDomainTypeDomain = 2
+	geositeDomainTypeFull   = 3
+)
+
+// Protobuf wire types.
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// protoField is a field in a protobuf message.
+type protoField struct {
+	num      uint64
+	wireType uint64
+
+	// varint is the value of a varint field.
+	varint uint64
+
+	// bytes is the payload of a length-delimited field.
+	bytes []byte
+}
+
+// nextProtoField parses the first field in b and returns it with the remaining bytes.
+func nextProtoField(b []byte) (f protoField, rest []byte, err error) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return f, nil, errProtoTruncated
+	}
+	b = b[n:]
+	f.num, f.wireType = tag>>3, tag&7
+
+	switch f.wireType {
+	case protoWireVarint:
+		f.varint, n = binary.Uvarint(b)
+		if n <= 0 {
+			return f, nil, errProtoTruncated
+		}
+		return f, b[n:], nil
+
+	case protoWireFixed64:
+		if len(b) < 8 {
+			return f, nil, errProtoTruncated
+		}
+		return f, b[8:], nil
+
+	case protoWireBytes:
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return f, nil, errProtoTruncated
+		}
+		b = b[n:]
+		f.bytes = b[:length]
+		return f, b[length:], nil
+
+	case protoWireFixed32:
+		if len(b) < 4 {
+			return f, nil, errProtoTruncated
+		}
+		return f, b[4:], nil
+
+	default:
+		return f, nil, fmt.Errorf("unsupported protobuf wire type %d", f.wireType)
+	}
+}
+
+// rangeProtoFields calls fn for each field in the protobuf message b.
+func rangeProtoFields(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		f, rest, err := nextProtoField(b)
+		if err != nil {
+			return err
+		}
+		if err = fn(f); err != nil {
+			return err
+		}
+		b = rest
+	}
+	return nil
+}
+
+// BuilderFromGeosite parses a geosite.dat file in v2fly's protobuf format, inserts the rules
+// of the category with the given code into appropriate matcher builders, and returns the
+// resulting domain set builder.
+//
+// Codes are matched case-insensitively. An attribute can be appended to the code after an '@',
+// like "google@cn", to select only rules with that attribute.
+//
+// Unlike [BuilderFromText], the rule strings are cloned, so that the rest of the file can be freed.
+func BuilderFromGeosite(data []byte, code string) (Builder, error) {
+	code, attr, _ := strings.Cut(code, "@")
+	if code == "" {
+		return Builder{}, errors.New("empty geosite code")
+	}
+
+	var (
+		site  []byte
+		found bool
+	)
+
+	if err := rangeProtoFields(data, func(f protoField) error {
+		if found || f.num != geositeListEntryField || f.wireType != protoWireBytes {
+			return nil
+		}
+		return rangeProtoFields(f.bytes, func(sf protoField) error {
+			if sf.num == geositeCountryCodeField && sf.wireType == protoWireBytes && strings.EqualFold(string(sf.bytes), code) {
+				site, found = f.bytes, true
+			}
+			return nil
+		})
+	}); err != nil {
+		return Builder{}, err
+	}
+
+	if !found {
+		return Builder{}, fmt.Errorf("geosite code %q not found", code)
+	}
+
+	dsb := Builder{
+		NewDomainMapMatcher(0),
+		NewDomainSuffixTrieMatcherBuilder(0),
+		NewKeywordLinearMatcher(0),
+		NewRegexpMatcherBuilder(0),
+	}
+
+	var count int
+
+	if err := rangeProtoFields(site, func(f protoField) error {
+		if f.num != geositeDomainField || f.wireType != protoWireBytes {
+			return nil
+		}
+
+		var (
+			domainType  uint64
+			value       []byte
+			attrMatched bool
+		)
+
+		if err := rangeProtoFields(f.bytes, func(df protoField) error {
+			switch {
+			case df.num == geositeDomainTypeField && df.wireType == protoWireVarint:
+				domainType = df.varint
+			case df.num == geositeDomainValueField && df.wireType == protoWireBytes:
+				value = df.bytes
+			case df.num == geositeDomainAttributeField && df.wireType == protoWireBytes && attr != "" && !attrMatched:
+				return rangeProtoFields(df.bytes, func(af protoField) error {
+					if af.num == geositeAttributeKeyField && af.wireType == protoWireBytes && string(af.bytes) == attr {
+						attrMatched = true
+					}
+					return nil
+				})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if attr != "" && !attrMatched {
+			return nil
+		}
+		if len(value) == 0 {
+			return fmt.Errorf("empty rule value in geosite code %q", code)
+		}
+
+		switch domainType {
+		case geositeDomainTypePlain:
+			dsb.KeywordMatcherBuilder().Insert(string(value))
+		case geositeDomainTypeRegex:
+			dsb.RegexpMatcherBuilder().Insert(string(value))
+		case geositeDomainTypeDomain:
+			dsb.SuffixMatcherBuilder().Insert(string(value))
+		case geositeDomainTypeFull:
+			dsb.DomainMatcherBuilder().Insert(string(value))
+		default:
+			return fmt.Errorf("unknown domain type %d in geosite code %q", domainType, code)
+		}
+		count++
+		return nil
+	}); err != nil {
+		return dsb, err
+	}
+
+	if count == 0 {
+		return dsb, errEmptySet
+	}
+
+	return dsb, nil
+}
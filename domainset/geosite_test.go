@@ -0,0 +1,94 @@
+package domainset
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func appendProtoBytes(b []byte, num uint64, payload []byte) []byte {
+	b = binary.AppendUvarint(b, num<<3|protoWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+func appendProtoVarint(b []byte, num, v uint64) []byte {
+	b = binary.AppendUvarint(b, num<<3|protoWireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendGeositeDomain(b []byte, domainType uint64, value string, attrs ...string) []byte {
+	var d []byte
+	d = appendProtoVarint(d, geositeDomainTypeField, domainType)
+	d = appendProtoBytes(d, geositeDomainValueField, []byte(value))
+	for _, attr := range attrs {
+		var a []byte
+		a = appendProtoBytes(a, geositeAttributeKeyField, []byte(attr))
+		a = appendProtoVarint(a, 2, 1) // bool_value
+		d = appendProtoBytes(d, geositeDomainAttributeField, a)
+	}
+	return appendProtoBytes(b, geositeDomainField, d)
+}
+
+func appendGeositeEntry(b []byte, code string, domains []byte) []byte {
+	var site []byte
+	site = appendProtoBytes(site, geositeCountryCodeField, []byte(code))
+	site = append(site, domains...)
+	return appendProtoBytes(b, geositeListEntryField, site)
+}
+
+var testGeositeData = func() []byte {
+	var other []byte
+	other = appendGeositeDomain(other, geositeDomainTypeDomain, "example.org")
+	other = appendGeositeDomain(other, geositeDomainTypeDomain, "wikipedia.org", "cn")
+
+	var test []byte
+	test = appendGeositeDomain(test, geositeDomainTypeFull, "www.example.net")
+	for _, suffix := range []string{"example.com", "github.com", "cube64128.xyz", "api.ipify.org", "api6.ipify.org", "archlinux.org"} {
+		test = appendGeositeDomain(test, geositeDomainTypeDomain, suffix)
+	}
+	test = appendGeositeDomain(test, geositeDomainTypePlain, "dev")
+	test = appendGeositeDomain(test, geositeDomainTypeRegex, `^adservice\.google\.([a-z]{2}|com?)(\.[a-z]{2})?$`)
+
+	var data []byte
+	data = appendGeositeEntry(data, "OTHER", other)
+	data = appendGeositeEntry(data, "TEST", test)
+	return data
+}()
+
+func TestDomainSetFromGeosite(t *testing.T) {
+	dsb, err := BuilderFromGeosite(testGeositeData, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := dsb.DomainSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDomainSet(t, ds)
+}
+
+func TestDomainSetFromGeositeAttribute(t *testing.T) {
+	dsb, err := BuilderFromGeosite(testGeositeData, "other@cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := dsb.DomainSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMatch(t, ds, "wikipedia.org", true)
+	testMatch(t, ds, "example.org", false)
+
+	if _, err = BuilderFromGeosite(testGeositeData, "other@ir"); err != errEmptySet {
+		t.Errorf("BuilderFromGeosite() with unused attribute returned %v, expected %v", err, errEmptySet)
+	}
+}
+
+func TestBuilderFromGeositeErrors(t *testing.T) {
+	if _, err := BuilderFromGeosite(testGeositeData, "missing"); err == nil {
+		t.Error("BuilderFromGeosite() with missing code returned nil error")
+	}
+	if _, err := BuilderFromGeosite(testGeositeData[:len(testGeositeData)-1], "test"); err != errProtoTruncated {
+		t.Errorf("BuilderFromGeosite() on truncated data returned %v, expected %v", err, errProtoTruncated)
+	}
+}
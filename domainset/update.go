@@ -0,0 +1,174 @@
+package domainset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// downloadTimeout is the timeout for downloading a domain set file.
+	downloadTimeout = 2 * time.Minute
+
+	// maxDownloadSize is the maximum size of a downloaded domain set file.
+	maxDownloadSize = 256 * 1024 * 1024
+)
+
+var errDownloadTooLarge = errors.New("downloaded file is too large")
+
+// download downloads the domain set file from the URL and loads it.
+// The file at Path is only replaced if the downloaded file is loaded successfully.
+func (dsc Config) download(ctx context.Context, client *http.Client) (DomainSet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dsc.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response status: %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dsc.Path), "."+filepath.Base(dsc.Path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := f.Name()
+
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxDownloadSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > maxDownloadSize {
+		err = errDownloadTooLarge
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+
+	ds, err := dsc.load(tmpPath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+
+	if err = os.Rename(tmpPath, dsc.Path); err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// Updater periodically downloads a domain set file from its URL,
+// and replaces the domain set in place.
+//
+// Updater implements [Matcher] by matching against the latest domain set.
+type Updater struct {
+	config    Config
+	client    *http.Client
+	logger    *zap.Logger
+	domainSet atomic.Pointer[DomainSet]
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// NewUpdater returns a new updater for ds, which was loaded from the configuration.
+func (dsc Config) NewUpdater(ds DomainSet, logger *zap.Logger) *Updater {
+	u := Updater{
+		config: dsc,
+		client: &http.Client{Timeout: downloadTimeout},
+		logger: logger,
+	}
+	u.domainSet.Store(&ds)
+	return &u
+}
+
+// DomainSet returns a domain set that always matches against the latest content.
+func (u *Updater) DomainSet() DomainSet {
+	return DomainSet{u}
+}
+
+// Match implements [Matcher.Match].
+func (u *Updater) Match(domain string) bool {
+	return u.domainSet.Load().Match(domain)
+}
+
+// Start starts the update loop in a new goroutine.
+func (u *Updater) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	u.cancel = cancel
+	u.done = make(chan struct{})
+
+	go func() {
+		defer close(u.done)
+		u.run(ctx)
+	}()
+
+	u.logger.Info("Started domain set updater",
+		zap.String("name", u.config.Name),
+		zap.String("url", u.config.URL),
+		zap.Duration("updateInterval", u.config.UpdateInterval.Value()),
+	)
+}
+
+// Stop stops the update loop and waits for it to exit.
+func (u *Updater) Stop() {
+	u.cancel()
+	<-u.done
+	u.logger.Info("Stopped domain set updater", zap.String("name", u.config.Name))
+}
+
+func (u *Updater) run(ctx context.Context) {
+	interval := u.config.UpdateInterval.Value()
+
+	// Schedule the first update relative to the file's modification time,
+	// so that restarts do not cause unnecessary downloads.
+	delay := interval
+	if fi, err := os.Stat(u.config.Path); err == nil {
+		delay = max(time.Until(fi.ModTime().Add(interval)), 0)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		u.update(ctx)
+		timer.Reset(interval)
+	}
+}
+
+// update downloads the domain set file and replaces the domain set on success.
+// On failure, the current domain set is kept.
+func (u *Updater) update(ctx context.Context) {
+	ds, err := u.config.download(ctx, u.client)
+	if err != nil {
+		u.logger.Warn("Failed to update domain set",
+			zap.String("name", u.config.Name),
+			zap.String("url", u.config.URL),
+			zap.Error(err),
+		)
+		return
+	}
+	u.domainSet.Store(&ds)
+	u.logger.Info("Updated domain set", zap.String("name", u.config.Name))
+}
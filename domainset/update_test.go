@@ -0,0 +1,102 @@
+package domainset
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUpdater(t *testing.T) {
+	var (
+		content atomic.Pointer[string]
+		fail    atomic.Bool
+	)
+	initial := "example.com\n"
+	content.Store(&initial)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(*content.Load()))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "suffixes.txt")
+	dsc := Config{
+		Name:           "test",
+		Type:           "suffixes",
+		Path:           path,
+		URL:            srv.URL + "/suffixes.txt",
+		UpdateInterval: jsonhelper.Duration(time.Second),
+	}
+
+	// The file does not exist, so it is downloaded.
+	ds, err := dsc.domainSet(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatalf("os.Stat() after download failed: %v", err)
+	}
+	testMatch(t, ds, "www.example.com", true)
+
+	u := dsc.NewUpdater(ds, zaptest.NewLogger(t))
+	u.client = srv.Client()
+	uds := u.DomainSet()
+
+	updated := "github.com\n"
+	content.Store(&updated)
+	u.update(context.Background())
+	testMatch(t, uds, "www.example.com", false)
+	testMatch(t, uds, "api.github.com", true)
+
+	// A failed update keeps the current domain set and file.
+	fail.Store(true)
+	u.update(context.Background())
+	testMatch(t, uds, "api.github.com", true)
+
+	// An invalid file is not saved.
+	fail.Store(false)
+	invalid := "# empty\n"
+	content.Store(&invalid)
+	u.update(context.Background())
+	testMatch(t, uds, "api.github.com", true)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != updated {
+		t.Errorf("file content = %q, expected %q", data, updated)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("len(entries) = %d, expected 1, temporary files should be removed", len(entries))
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, dsc := range []Config{
+		{Path: "x", URL: "http://example.com/x"},
+		{URL: "https://example.com/x"},
+		{Path: "x", UpdateInterval: jsonhelper.Duration(time.Second)},
+		{Path: "x", URL: "https://example.com/x", UpdateInterval: -1},
+	} {
+		if err := dsc.validate(); err == nil {
+			t.Errorf("%+v: validate() returned nil error", dsc)
+		}
+	}
+}
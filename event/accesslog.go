@@ -0,0 +1,243 @@
+package event
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultAccessLogMaxSize    = 100 << 20
+	defaultAccessLogMaxBackups = 5
+	defaultAccessLogBufferSize = 4096
+)
+
+// AccessLogConfig is the configuration for the access log.
+type AccessLogConfig struct {
+	// Path is the path to the access log file.
+	// If empty, the access log is disabled.
+	Path string `json:"path"`
+
+	// MaxSize is the size in bytes after which the access log file is rotated.
+	//
+	// The default value is 100 MiB.
+	MaxSize int64 `json:"maxSize"`
+
+	// MaxBackups is the number of rotated files to keep.
+	// The newest rotated file has the ".1" suffix.
+	//
+	// The default value is 5.
+	MaxBackups int `json:"maxBackups"`
+
+	// BufferSize is the number of events buffered before new events are dropped.
+	// The access log is not subject to the event rate limit, so the buffer
+	// must absorb bursts of closed connections and expired sessions.
+	// Dropped events are counted in the event bus stats.
+	//
+	// The default value is 4096.
+	BufferSize int `json:"bufferSize"`
+}
+
+// AccessLog returns a new access log that subscribes to the bus when started,
+// or nil if the access log is disabled.
+func (c *AccessLogConfig) AccessLog(bus *Bus, logger *zap.Logger) (*AccessLog, error) {
+	if c.Path == "" {
+		return nil, nil
+	}
+	if bus == nil {
+		return nil, errors.New("access log requires events to be enabled")
+	}
+	if c.MaxSize < 0 {
+		return nil, fmt.Errorf("negative access log max size: %d", c.MaxSize)
+	}
+	if c.MaxBackups < 0 {
+		return nil, fmt.Errorf("negative access log max backups: %d", c.MaxBackups)
+	}
+
+	maxSize := c.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultAccessLogMaxSize
+	}
+	maxBackups := c.MaxBackups
+	if maxBackups == 0 {
+		maxBackups = defaultAccessLogMaxBackups
+	}
+	bufferSize := c.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultAccessLogBufferSize
+	}
+
+	return &AccessLog{
+		path:       c.Path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		bufferSize: bufferSize,
+		bus:        bus,
+		logger:     logger.With(zap.String("accessLog", c.Path)),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// AccessLog writes one JSON line per closed TCP connection and expired UDP session to a file.
+//
+// The file is rotated when it grows beyond the configured size.
+type AccessLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	bufferSize int
+	bus        *Bus
+	sub        *Subscription
+	logger     *zap.Logger
+	done       chan struct{}
+
+	// reportedDropped is the number of dropped events already logged.
+	reportedDropped uint64
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// String implements the Service String method.
+func (l *AccessLog) String() string {
+	return "access log " + l.path
+}
+
+// Start implements the Service Start method.
+func (l *AccessLog) Start(_ context.Context) error {
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.sub = l.bus.SubscribeUnlimited(l.bufferSize, KindConnClosed, KindSessionExpired)
+	go l.run()
+	l.logger.Info("Started access log")
+	return nil
+}
+
+// open opens the access log file for appending.
+func (l *AccessLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat access log file: %w", err)
+	}
+
+	l.file = f
+	l.size = fi.Size()
+	if l.w == nil {
+		l.w = bufio.NewWriter(f)
+	} else {
+		l.w.Reset(f)
+	}
+	return nil
+}
+
+func (l *AccessLog) run() {
+	defer close(l.done)
+
+	events := l.sub.Events()
+
+	for e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			l.logger.Warn("Failed to marshal access log entry", zap.Error(err))
+			continue
+		}
+		b = append(b, '\n')
+
+		if _, err = l.w.Write(b); err != nil {
+			l.logger.Warn("Failed to write access log entry", zap.Error(err))
+		}
+		l.size += int64(len(b))
+
+		// Flush when there are no more buffered events.
+		if len(events) == 0 {
+			if err := l.w.Flush(); err != nil {
+				l.logger.Warn("Failed to flush access log", zap.Error(err))
+			}
+			l.reportDropped()
+		}
+
+		if l.size >= l.maxSize {
+			if err := l.rotate(); err != nil {
+				l.logger.Warn("Failed to rotate access log", zap.Error(err))
+			}
+		}
+	}
+
+	if err := l.w.Flush(); err != nil {
+		l.logger.Warn("Failed to flush access log", zap.Error(err))
+	}
+	if err := l.file.Close(); err != nil {
+		l.logger.Warn("Failed to close access log file", zap.Error(err))
+	}
+}
+
+// rotate renames the access log file and its backups, replacing the oldest backup,
+// and opens a new access log file.
+//
+// If renaming fails, the current file is reopened and written to.
+func (l *AccessLog) rotate() error {
+	err := l.w.Flush()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = l.renameBackups()
+	}
+
+	if openErr := l.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// renameBackups shifts the backups and the access log file up by one suffix.
+func (l *AccessLog) renameBackups() error {
+	for i := l.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(l.backupPath(i), l.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.path, l.backupPath(1))
+}
+
+// backupPath returns the path of the i-th newest rotated file.
+func (l *AccessLog) backupPath(i int) string {
+	return l.path + "." + strconv.Itoa(i)
+}
+
+// Stop implements the Service Stop method.
+// Buffered events are written before Stop returns.
+func (l *AccessLog) Stop() error {
+	l.sub.Close()
+	<-l.done
+	l.reportDropped()
+	return nil
+}
+
+// reportDropped logs the number of events dropped since the last report.
+func (l *AccessLog) reportDropped() {
+	dropped := l.sub.Dropped()
+	if dropped == l.reportedDropped {
+		return
+	}
+	l.logger.Warn("Dropped events due to full access log buffer",
+		zap.Uint64("dropped", dropped-l.reportedDropped),
+		zap.Uint64("totalDropped", dropped),
+	)
+	l.reportedDropped = dropped
+}
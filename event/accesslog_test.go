@@ -0,0 +1,182 @@
+package event
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"go.uber.org/zap"
+)
+
+// testEvent returns an event of the kind from the server with valid addresses.
+func testEvent(kind Kind, server string) Event {
+	return Event{
+		Kind:          kind,
+		Server:        server,
+		ClientAddress: netip.MustParseAddrPort("[2001:db8::1]:12345"),
+		TargetAddress: conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::2]:443")),
+	}
+}
+
+// readAccessLog returns the events in the access log file.
+func readAccessLog(t *testing.T, path string) []Event {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Failed to unmarshal access log line %q: %v", scanner.Bytes(), err)
+		}
+		events = append(events, e)
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	bus := NewBus(0, 0)
+
+	c := AccessLogConfig{Path: path}
+	l, err := c.AccessLog(bus, zap.NewNop())
+	if err != nil {
+		t.Fatalf("c.AccessLog failed: %v", err)
+	}
+	if err = l.Start(context.Background()); err != nil {
+		t.Fatalf("l.Start failed: %v", err)
+	}
+
+	bus.Publish(Event{Kind: KindConnOpened, Server: "a"})
+	closedEvent := testEvent(KindConnClosed, "a")
+	closedEvent.Network = "tcp"
+	closedEvent.Username = "Alex"
+	closedEvent.Client = "direct"
+	closedEvent.UplinkBytes = 1
+	closedEvent.DownlinkBytes = 2
+	closedEvent.Duration = jsonhelper.Duration(time.Second)
+	closedEvent.CloseReason = CloseReasonEOF
+	bus.Publish(closedEvent)
+	bus.Publish(testEvent(KindSessionCreated, "b"))
+	expiredEvent := testEvent(KindSessionExpired, "b")
+	expiredEvent.Network = "udp"
+	expiredEvent.CloseReason = CloseReasonIdleTimeout
+	bus.Publish(expiredEvent)
+
+	if err = l.Stop(); err != nil {
+		t.Fatalf("l.Stop failed: %v", err)
+	}
+
+	events := readAccessLog(t, path)
+	if len(events) != 2 {
+		t.Fatalf("len(events) = %d, expected 2", len(events))
+	}
+
+	closed, expired := events[0], events[1]
+	if closed.Kind != KindConnClosed || closed.Username != "Alex" || closed.Client != "direct" ||
+		closed.UplinkBytes != 1 || closed.DownlinkBytes != 2 ||
+		closed.Duration != jsonhelper.Duration(time.Second) || closed.CloseReason != CloseReasonEOF {
+		t.Errorf("events[0] = %+v, expected closed TCP connection", closed)
+	}
+	if expired.Kind != KindSessionExpired || expired.Server != "b" || expired.CloseReason != CloseReasonIdleTimeout {
+		t.Errorf("events[1] = %+v, expected expired UDP session", expired)
+	}
+}
+
+func TestAccessLogIgnoresRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	bus := NewBus(1, 1)
+
+	c := AccessLogConfig{Path: path}
+	l, err := c.AccessLog(bus, zap.NewNop())
+	if err != nil {
+		t.Fatalf("c.AccessLog failed: %v", err)
+	}
+	if err = l.Start(context.Background()); err != nil {
+		t.Fatalf("l.Start failed: %v", err)
+	}
+
+	for range 10 {
+		bus.Publish(testEvent(KindConnClosed, "a"))
+	}
+
+	if err = l.Stop(); err != nil {
+		t.Fatalf("l.Stop failed: %v", err)
+	}
+
+	if events := readAccessLog(t, path); len(events) != 10 {
+		t.Errorf("len(events) = %d, expected 10", len(events))
+	}
+	if stats := bus.Stats(); stats.RateLimited != 9 || stats.Dropped != 0 {
+		t.Errorf("bus.Stats() = %+v, expected 9 rate limited and none dropped", stats)
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	bus := NewBus(0, 0)
+
+	// Every entry is larger than 1 byte, so each entry is rotated out.
+	c := AccessLogConfig{Path: path, MaxSize: 1, MaxBackups: 2}
+	l, err := c.AccessLog(bus, zap.NewNop())
+	if err != nil {
+		t.Fatalf("c.AccessLog failed: %v", err)
+	}
+	if err = l.Start(context.Background()); err != nil {
+		t.Fatalf("l.Start failed: %v", err)
+	}
+
+	for _, server := range []string{"a", "b", "c"} {
+		bus.Publish(testEvent(KindConnClosed, server))
+	}
+
+	if err = l.Stop(); err != nil {
+		t.Fatalf("l.Stop failed: %v", err)
+	}
+
+	if events := readAccessLog(t, path); len(events) != 0 {
+		t.Errorf("len(events) = %d, expected 0", len(events))
+	}
+	for i, server := range []string{"c", "b"} {
+		events := readAccessLog(t, l.backupPath(i+1))
+		if len(events) != 1 || events[0].Server != server {
+			t.Errorf("Backup %d events = %+v, expected one event from server %s", i+1, events, server)
+		}
+	}
+	if _, err = os.Stat(l.backupPath(3)); !os.IsNotExist(err) {
+		t.Errorf("Backup 3 exists: %v", err)
+	}
+}
+
+func TestAccessLogConfig(t *testing.T) {
+	var c AccessLogConfig
+	if l, err := c.AccessLog(nil, zap.NewNop()); l != nil || err != nil {
+		t.Errorf("c.AccessLog() with empty path = %v, %v, expected nil, nil", l, err)
+	}
+
+	c.Path = filepath.Join(t.TempDir(), "access.log")
+	if _, err := c.AccessLog(nil, zap.NewNop()); err == nil {
+		t.Error("c.AccessLog() without event bus succeeded")
+	}
+
+	c.MaxSize = -1
+	if _, err := c.AccessLog(NewBus(0, 0), zap.NewNop()); err == nil {
+		t.Error("c.AccessLog() with negative max size succeeded")
+	}
+}
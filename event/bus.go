@@ -0,0 +1,212 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bus delivers published events to subscribers.
+//
+// Publishing never blocks. Events exceeding the per-kind rate limit are dropped
+// before delivery, except to subscriptions created by [Bus.SubscribeUnlimited].
+// Events that do not fit in a subscriber's buffer are dropped for that subscriber only.
+//
+// A nil *Bus discards all events. Bus is safe for concurrent use.
+type Bus struct {
+	limiters    [kindCount]rateLimiter
+	published   atomic.Uint64
+	rateLimited atomic.Uint64
+	dropped     atomic.Uint64
+
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// NewBus returns a new event bus.
+//
+// If rateLimit is positive, at most rateLimit events of each kind are published per second,
+// with bursts of up to burst events. If burst is not positive, it defaults to rateLimit.
+func NewBus(rateLimit, burst int) *Bus {
+	if burst <= 0 {
+		burst = rateLimit
+	}
+	b := Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+	if rateLimit > 0 {
+		now := time.Now()
+		for i := range b.limiters {
+			b.limiters[i] = rateLimiter{
+				rate:   float64(rateLimit),
+				burst:  float64(burst),
+				tokens: float64(burst),
+				last:   now,
+			}
+		}
+	}
+	return &b
+}
+
+// Publish publishes the event to all subscribers of its kind.
+// If the event's time is not set, it is set to the current time.
+func (b *Bus) Publish(e Event) {
+	if b == nil || e.Kind >= kindCount {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	allowed := b.limiters[e.Kind].allow(e.Time)
+	if allowed {
+		b.published.Add(1)
+	} else {
+		b.rateLimited.Add(1)
+	}
+
+	b.mu.RLock()
+	for s := range b.subs {
+		if allowed || s.unlimited {
+			s.deliver(e)
+		}
+	}
+	b.mu.RUnlock()
+}
+
+// Subscribe returns a new subscription that buffers up to capacity events.
+// If kinds is empty, the subscription receives events of all kinds.
+//
+// The caller must call [Subscription.Close] when done.
+func (b *Bus) Subscribe(capacity int, kinds ...Kind) *Subscription {
+	return b.subscribe(capacity, false, kinds)
+}
+
+// SubscribeUnlimited is like [Bus.Subscribe], but the subscription also receives
+// events dropped by the bus's rate limit. It is for consumers that must see every event,
+// like the access log, and that keep up with the event rate.
+func (b *Bus) SubscribeUnlimited(capacity int, kinds ...Kind) *Subscription {
+	return b.subscribe(capacity, true, kinds)
+}
+
+func (b *Bus) subscribe(capacity int, unlimited bool, kinds []Kind) *Subscription {
+	s := Subscription{
+		bus:       b,
+		ch:        make(chan Event, capacity),
+		unlimited: unlimited,
+	}
+	if len(kinds) == 0 {
+		s.kinds = 1<<kindCount - 1
+	}
+	for _, k := range kinds {
+		s.kinds |= 1 << k
+	}
+
+	if b != nil {
+		b.mu.Lock()
+		b.subs[&s] = struct{}{}
+		b.mu.Unlock()
+	}
+	return &s
+}
+
+// Stats contains counters of the event bus.
+type Stats struct {
+	// Published is the number of events that passed the rate limit.
+	Published uint64 `json:"published"`
+
+	// RateLimited is the number of events dropped by the rate limit.
+	// They are still delivered to unlimited subscribers.
+	RateLimited uint64 `json:"rateLimited"`
+
+	// Dropped is the number of events dropped because a subscriber's buffer was full,
+	// summed over all subscribers.
+	Dropped uint64 `json:"dropped"`
+
+	Subscribers int `json:"subscribers"`
+}
+
+// Stats returns the bus's counters.
+func (b *Bus) Stats() Stats {
+	if b == nil {
+		return Stats{}
+	}
+	b.mu.RLock()
+	subscribers := len(b.subs)
+	b.mu.RUnlock()
+	return Stats{
+		Published:   b.published.Load(),
+		RateLimited: b.rateLimited.Load(),
+		Dropped:     b.dropped.Load(),
+		Subscribers: subscribers,
+	}
+}
+
+// Subscription receives events from a [Bus].
+type Subscription struct {
+	bus       *Bus
+	ch        chan Event
+	kinds     uint32
+	unlimited bool
+	dropped   atomic.Uint64
+}
+
+func (s *Subscription) deliver(e Event) {
+	if s.kinds&(1<<e.Kind) == 0 {
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+		s.bus.dropped.Add(1)
+	}
+}
+
+// Events returns the channel of received events.
+// The channel is closed when the subscription is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes from the bus and closes the events channel.
+func (s *Subscription) Close() {
+	if s.bus != nil {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+	}
+	close(s.ch)
+}
+
+// rateLimiter is a token bucket. The zero value allows all events.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.rate == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
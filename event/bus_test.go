@@ -0,0 +1,145 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusPublishSubscribe(t *testing.T) {
+	bus := NewBus(0, 0)
+	all := bus.Subscribe(8)
+	defer all.Close()
+	closed := bus.Subscribe(8, KindConnClosed)
+	defer closed.Close()
+
+	bus.Publish(Event{Kind: KindConnOpened, Server: "a"})
+	bus.Publish(Event{Kind: KindConnClosed, Server: "b"})
+
+	if len(all.Events()) != 2 {
+		t.Fatalf("len(all.Events()) = %d, expected 2", len(all.Events()))
+	}
+	if len(closed.Events()) != 1 {
+		t.Fatalf("len(closed.Events()) = %d, expected 1", len(closed.Events()))
+	}
+
+	e := <-closed.Events()
+	if e.Kind != KindConnClosed || e.Server != "b" {
+		t.Errorf("e = %+v, expected conn_closed event from server b", e)
+	}
+	if e.Time.IsZero() {
+		t.Error("e.Time is not set")
+	}
+
+	if stats := bus.Stats(); stats.Published != 2 || stats.Subscribers != 2 {
+		t.Errorf("bus.Stats() = %+v", stats)
+	}
+}
+
+func TestBusDropsWhenFull(t *testing.T) {
+	bus := NewBus(0, 0)
+	sub := bus.Subscribe(1)
+	defer sub.Close()
+
+	for range 3 {
+		bus.Publish(Event{Kind: KindAuthFailed})
+	}
+
+	if dropped := sub.Dropped(); dropped != 2 {
+		t.Errorf("sub.Dropped() = %d, expected 2", dropped)
+	}
+	if stats := bus.Stats(); stats.Dropped != 2 {
+		t.Errorf("stats.Dropped = %d, expected 2", stats.Dropped)
+	}
+}
+
+func TestBusRateLimit(t *testing.T) {
+	bus := NewBus(1, 2)
+	sub := bus.Subscribe(16)
+	defer sub.Close()
+
+	now := time.Now()
+	for range 5 {
+		bus.Publish(Event{Time: now, Kind: KindAuthFailed})
+	}
+	// Other kinds have their own buckets.
+	bus.Publish(Event{Time: now, Kind: KindConnOpened})
+	// One more token after a second.
+	bus.Publish(Event{Time: now.Add(time.Second), Kind: KindAuthFailed})
+
+	if n := len(sub.Events()); n != 4 {
+		t.Errorf("received %d events, expected 4", n)
+	}
+	if stats := bus.Stats(); stats.RateLimited != 3 {
+		t.Errorf("stats.RateLimited = %d, expected 3", stats.RateLimited)
+	}
+}
+
+func TestBusSubscribeUnlimited(t *testing.T) {
+	bus := NewBus(1, 1)
+	limited := bus.Subscribe(16)
+	defer limited.Close()
+	unlimited := bus.SubscribeUnlimited(16, KindConnClosed)
+	defer unlimited.Close()
+
+	now := time.Now()
+	for range 5 {
+		bus.Publish(Event{Time: now, Kind: KindConnClosed})
+	}
+	bus.Publish(Event{Time: now, Kind: KindConnOpened})
+
+	if n := len(limited.Events()); n != 2 {
+		t.Errorf("limited subscription received %d events, expected 2", n)
+	}
+	if n := len(unlimited.Events()); n != 5 {
+		t.Errorf("unlimited subscription received %d events, expected 5", n)
+	}
+	if stats := bus.Stats(); stats.Published != 2 || stats.RateLimited != 4 {
+		t.Errorf("bus.Stats() = %+v, expected 2 published and 4 rate limited", stats)
+	}
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	bus := NewBus(0, 0)
+	sub := bus.Subscribe(1)
+	sub.Close()
+
+	bus.Publish(Event{Kind: KindConnOpened})
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("received event after Close")
+	}
+	if stats := bus.Stats(); stats.Subscribers != 0 {
+		t.Errorf("stats.Subscribers = %d, expected 0", stats.Subscribers)
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	bus.Publish(Event{Kind: KindConnOpened})
+	sub := bus.Subscribe(1)
+	sub.Close()
+	if stats := bus.Stats(); stats != (Stats{}) {
+		t.Errorf("bus.Stats() = %+v, expected zero value", stats)
+	}
+}
+
+func TestKindText(t *testing.T) {
+	for k := range kindCount {
+		text, err := k.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Kind
+		if err = got.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if got != k {
+			t.Errorf("got %v, expected %v", got, k)
+		}
+	}
+
+	var k Kind
+	if err := k.UnmarshalText([]byte("bogus")); err == nil {
+		t.Error("UnmarshalText(bogus) succeeded")
+	}
+}
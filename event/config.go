@@ -0,0 +1,55 @@
+package event
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// Config is the configuration for the event bus.
+type Config struct {
+	// Enabled controls whether relays publish events.
+	Enabled bool `json:"enabled"`
+
+	// RateLimit is the maximum number of events of each kind published per second.
+	// Excess events are dropped.
+	//
+	// If unspecified or 0, events are not rate-limited.
+	RateLimit int `json:"rateLimit"`
+
+	// RateLimitBurst is the maximum number of events of each kind published in a burst.
+	//
+	// The default value is RateLimit.
+	RateLimitBurst int `json:"rateLimitBurst"`
+
+	// Webhooks is the list of webhooks that receive events.
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// AccessLog is the configuration for the access log of closed TCP connections and expired UDP sessions.
+	AccessLog AccessLogConfig `json:"accessLog"`
+}
+
+// Bus returns a new event bus and its webhooks from the config.
+// If the event bus is disabled, it returns nil, nil, nil.
+func (c *Config) Bus(logger *zap.Logger) (*Bus, []*Webhook, error) {
+	if !c.Enabled {
+		return nil, nil, nil
+	}
+
+	if c.RateLimit < 0 {
+		return nil, nil, fmt.Errorf("negative rate limit: %d", c.RateLimit)
+	}
+
+	bus := NewBus(c.RateLimit, c.RateLimitBurst)
+
+	webhooks := make([]*Webhook, len(c.Webhooks))
+	for i := range c.Webhooks {
+		w, err := c.Webhooks[i].Webhook(bus, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		webhooks[i] = w
+	}
+
+	return bus, webhooks, nil
+}
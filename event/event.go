@@ -0,0 +1,150 @@
+// Package event implements an in-process bus for structured relay events.
+//
+// Relays publish events like connection opened/closed and session created/expired
+// to a single [Bus]. The event stream API, the live stream API, webhooks and
+// the access log subscribe to the bus. Traffic statistics, connection tracking,
+// captures and resource accounting are not built on the bus, and are still
+// updated directly by the relays.
+package event
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+)
+
+// Kind is the type of an event.
+type Kind uint8
+
+const (
+	// KindConnOpened is a TCP connection that completed the handshake and has been routed.
+	KindConnOpened Kind = iota
+
+	// KindConnClosed is a TCP connection that has been closed after relaying.
+	KindConnClosed
+
+	// KindSessionCreated is a new UDP session (or NAT mapping).
+	KindSessionCreated
+
+	// KindSessionExpired is a UDP session (or NAT mapping) that has been removed.
+	KindSessionExpired
+
+	// KindAuthFailed is a TCP handshake or UDP packet that failed authentication or validation.
+	KindAuthFailed
+
+	// KindQuotaExceeded is a user that has exceeded its traffic quota.
+	KindQuotaExceeded
+
+	kindCount
+)
+
+// String returns the string representation of the event kind.
+func (k Kind) String() string {
+	switch k {
+	case KindConnOpened:
+		return "conn_opened"
+	case KindConnClosed:
+		return "conn_closed"
+	case KindSessionCreated:
+		return "session_created"
+	case KindSessionExpired:
+		return "session_expired"
+	case KindAuthFailed:
+		return "auth_failed"
+	case KindQuotaExceeded:
+		return "quota_exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler MarshalText method.
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler UnmarshalText method.
+func (k *Kind) UnmarshalText(text []byte) error {
+	for i := range kindCount {
+		if i.String() == string(text) {
+			*k = i
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event kind: %q", text)
+}
+
+// Close reasons of [KindConnClosed] and [KindSessionExpired] events.
+const (
+	// CloseReasonEOF is a TCP connection where both directions finished without errors,
+	// or a UDP-over-TCP session whose client ended the stream.
+	CloseReasonEOF = "eof"
+
+	// CloseReasonError is a TCP connection that failed with an error.
+	CloseReasonError = "error"
+
+	// CloseReasonIdleTimeout is a UDP session that received no packets for the NAT timeout.
+	CloseReasonIdleTimeout = "idle_timeout"
+
+	// CloseReasonEvicted is a UDP session evicted to make room for a new session.
+	CloseReasonEvicted = "evicted"
+
+	// CloseReasonClosed is a connection or session closed through the API.
+	CloseReasonClosed = "closed"
+
+	// CloseReasonShutdown is a connection or session closed because its server was stopped.
+	CloseReasonShutdown = "shutdown"
+)
+
+// Event is a structured relay event.
+//
+// Fields that do not apply to the event kind are left as zero values.
+type Event struct {
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+
+	// Kind is the type of the event.
+	Kind Kind `json:"kind"`
+
+	// Server is the name of the server that generated the event.
+	Server string `json:"server"`
+
+	// Network is "tcp" or "udp".
+	Network string `json:"network"`
+
+	// ClientAddress is the address of the client (inbound peer).
+	ClientAddress netip.AddrPort `json:"clientAddress"`
+
+	// Username is the authenticated user, if any.
+	Username string `json:"username,omitempty"`
+
+	// TargetAddress is the requested target address, if known.
+	TargetAddress conn.Addr `json:"targetAddress"`
+
+	// Client is the name of the client (outbound) chosen by the router, if any.
+	Client string `json:"client,omitempty"`
+
+	// UplinkBytes is the number of bytes sent from the client to the target.
+	UplinkBytes uint64 `json:"uplinkBytes,omitempty"`
+
+	// DownlinkBytes is the number of bytes sent from the target to the client.
+	DownlinkBytes uint64 `json:"downlinkBytes,omitempty"`
+
+	// UplinkPackets is the number of packets sent from the client to the target.
+	UplinkPackets uint64 `json:"uplinkPackets,omitempty"`
+
+	// DownlinkPackets is the number of packets sent from the target to the client.
+	DownlinkPackets uint64 `json:"downlinkPackets,omitempty"`
+
+	// Duration is how long the connection or session lasted.
+	Duration jsonhelper.Duration `json:"duration,omitempty"`
+
+	// CloseReason is why the connection or session ended.
+	CloseReason string `json:"closeReason,omitempty"`
+
+	// Error is the error message, if any.
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,200 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWebhookBufferSize    = 1024
+	defaultWebhookBatchSize     = 64
+	defaultWebhookFlushInterval = time.Second
+	defaultWebhookTimeout       = 10 * time.Second
+)
+
+// WebhookConfig is the configuration for a webhook that receives events.
+type WebhookConfig struct {
+	// URL is the HTTP(S) URL to POST events to.
+	// Each request body is a JSON array of events.
+	URL string `json:"url"`
+
+	// Kinds is the list of event kinds to send.
+	// If empty, events of all kinds are sent.
+	Kinds []Kind `json:"kinds"`
+
+	// BufferSize is the number of events buffered before new events are dropped.
+	//
+	// The default value is 1024.
+	BufferSize int `json:"bufferSize"`
+
+	// BatchSize is the maximum number of events in a single request.
+	//
+	// The default value is 64.
+	BatchSize int `json:"batchSize"`
+
+	// FlushInterval is the maximum time an event waits before being sent.
+	//
+	// The default value is 1s.
+	FlushInterval jsonhelper.Duration `json:"flushInterval"`
+
+	// Timeout is the timeout of each request.
+	//
+	// The default value is 10s.
+	Timeout jsonhelper.Duration `json:"timeout"`
+}
+
+// Webhook returns a new webhook that subscribes to the bus when started.
+func (c *WebhookConfig) Webhook(bus *Bus, logger *zap.Logger) (*Webhook, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("bad webhook URL %q: %w", c.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook URL scheme: %q", u.Scheme)
+	}
+
+	bufferSize := c.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultWebhookBufferSize
+	}
+	batchSize := c.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultWebhookBatchSize
+	}
+	flushInterval := c.FlushInterval.Value()
+	if flushInterval <= 0 {
+		flushInterval = defaultWebhookFlushInterval
+	}
+	timeout := c.Timeout.Value()
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	return &Webhook{
+		url:           c.URL,
+		redactedURL:   u.Redacted(),
+		kinds:         c.Kinds,
+		bufferSize:    bufferSize,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		client:        http.Client{Timeout: timeout},
+		bus:           bus,
+		logger:        logger.With(zap.String("webhook", u.Redacted())),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// Webhook POSTs batches of events to an HTTP endpoint.
+type Webhook struct {
+	url           string
+	redactedURL   string
+	kinds         []Kind
+	bufferSize    int
+	batchSize     int
+	flushInterval time.Duration
+	client        http.Client
+	bus           *Bus
+	sub           *Subscription
+	logger        *zap.Logger
+	done          chan struct{}
+}
+
+// String implements the Service String method.
+func (w *Webhook) String() string {
+	return "event webhook " + w.redactedURL
+}
+
+// Start implements the Service Start method.
+func (w *Webhook) Start(ctx context.Context) error {
+	w.sub = w.bus.Subscribe(w.bufferSize, w.kinds...)
+	go w.run(ctx)
+	w.logger.Info("Started event webhook")
+	return nil
+}
+
+func (w *Webhook) run(ctx context.Context) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, w.batchSize)
+	events := w.sub.Events()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				w.send(context.WithoutCancel(ctx), batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.send(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+func (w *Webhook) send(ctx context.Context, batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := w.post(ctx, batch); err != nil {
+		w.logger.Warn("Failed to send events to webhook",
+			zap.Int("events", len(batch)),
+			zap.Error(err),
+		)
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, batch []Event) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected status: " + resp.Status)
+	}
+	return nil
+}
+
+// Stop implements the Service Stop method.
+// Buffered events are sent before Stop returns.
+func (w *Webhook) Stop() error {
+	w.sub.Close()
+	<-w.done
+	if dropped := w.sub.Dropped(); dropped > 0 {
+		w.logger.Warn("Dropped events due to full webhook buffer", zap.Uint64("dropped", dropped))
+	}
+	return nil
+}
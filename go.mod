@@ -5,11 +5,14 @@ go 1.23.0
 require (
 	github.com/database64128/netx-go v0.0.0-20241005022450-a32a14a3f736
 	github.com/database64128/tfo-go/v2 v2.2.2
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/gofiber/contrib/fiberzap/v2 v2.1.4
 	github.com/gofiber/fiber/v2 v2.52.5
+	github.com/klauspost/compress v1.17.9
 	github.com/oschwald/geoip2-golang v1.11.0
 	go.uber.org/zap v1.27.0
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba
+	golang.org/x/crypto v0.28.0
 	golang.org/x/net v0.30.0
 	golang.org/x/sys v0.26.0
 	lukechampine.com/blake3 v1.3.0
@@ -18,7 +21,6 @@ require (
 require (
 	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/klauspost/compress v1.17.9 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bufio"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
@@ -14,11 +15,19 @@ import (
 var ErrServerSpokeFirst = errors.New("server-speaks-first protocols are not supported by this HTTP proxy client implementation")
 
 // NewHttpStreamClientReadWriter writes a HTTP/1.1 CONNECT request to rw and wraps rw into a ReadWriter ready for use.
-func NewHttpStreamClientReadWriter(rw zerocopy.DirectReadWriteCloser, targetAddr conn.Addr) (*direct.DirectStreamReadWriter, error) {
+//
+// If username is not empty, the request carries a Proxy-Authorization header with basic authentication.
+// If the server responds with 407 Proxy Authentication Required, [direct.ErrUpstreamAuthFailed] is returned.
+func NewHttpStreamClientReadWriter(rw zerocopy.DirectReadWriteCloser, targetAddr conn.Addr, username, password string) (*direct.DirectStreamReadWriter, error) {
 	targetAddress := targetAddr.String()
 
+	var proxyAuthorization string
+	if username != "" {
+		proxyAuthorization = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)) + "\r\n"
+	}
+
 	// Write CONNECT.
-	_, err := fmt.Fprintf(rw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: shadowsocks-go/0.0.0\r\nProxy-Connection: Keep-Alive\r\n\r\n", targetAddress, targetAddress)
+	_, err := fmt.Fprintf(rw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: shadowsocks-go/0.0.0\r\nProxy-Connection: Keep-Alive\r\n%s\r\n", targetAddress, targetAddress, proxyAuthorization)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +38,11 @@ func NewHttpStreamClientReadWriter(rw zerocopy.DirectReadWriteCloser, targetAddr
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		return nil, fmt.Errorf("%w: HTTP %s", direct.ErrUpstreamAuthFailed, resp.Status)
+	default:
 		return nil, fmt.Errorf("HTTP %s", resp.Status)
 	}
 
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
@@ -17,11 +19,51 @@ import (
 	"go.uber.org/zap"
 )
 
+// ServerReadWriter is a [direct.DirectStreamReadWriter] for an accepted HTTP proxy request.
+//
+// ServerReadWriter implements the zerocopy TCPServerReplier interface.
+type ServerReadWriter struct {
+	*direct.DirectStreamReadWriter
+	replyOnce sync.Once
+	reply     func(status zerocopy.TCPReplyStatus) error
+}
+
+// Reply implements the zerocopy.TCPServerReplier Reply method.
+//
+// For a CONNECT request, a successful reply is a 200 response. For other requests,
+// a successful reply lets the request be forwarded to the target. A failure is reported
+// with an error response.
+func (rw *ServerReadWriter) Reply(status zerocopy.TCPReplyStatus) (err error) {
+	rw.replyOnce.Do(func() {
+		err = rw.reply(status)
+	})
+	return
+}
+
+// Close implements the zerocopy.ReadWriter Close method.
+// If the request has not been replied to, it is failed with a 502 response.
+func (rw *ServerReadWriter) Close() error {
+	_ = rw.Reply(zerocopy.TCPReplyGeneralFailure)
+	return rw.DirectStreamReadWriter.Close()
+}
+
 // NewHttpStreamServerReadWriter handles a HTTP request from rw and wraps rw into a ReadWriter ready for use.
-func NewHttpStreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, logger *zap.Logger) (*direct.DirectStreamReadWriter, conn.Addr, error) {
-	rwbr := bufio.NewReader(rw)
-	req, err := http.ReadRequest(rwbr)
+// The request must be replied to with [ServerReadWriter.Reply].
+//
+// maxHeaderBytes limits the size of the request line and header fields of each request.
+// If maxHeaderBytes is not positive, [http.DefaultMaxHeaderBytes] is used.
+func NewHttpStreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, maxHeaderBytes int, logger *zap.Logger) (*ServerReadWriter, conn.Addr, error) {
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	rwlr := newHeaderLimitReader(rw, maxHeaderBytes)
+	rwbr := bufio.NewReader(rwlr)
+	req, err := rwlr.readRequest(rwbr)
 	if err != nil {
+		if errors.Is(err, errHeaderTooLarge) {
+			_ = send431(rw)
+		}
 		return nil, conn.Addr{}, err
 	}
 
@@ -45,18 +87,34 @@ func NewHttpStreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, logger *za
 
 	// Fast-track CONNECT.
 	if req.Method == http.MethodConnect {
-		if _, err = fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\nDate: %s\r\n\r\n", time.Now().UTC().Format(http.TimeFormat)); err != nil {
-			return nil, conn.Addr{}, err
-		}
-		return direct.NewDirectStreamReadWriter(rw), targetAddr, nil
+		return &ServerReadWriter{
+			DirectStreamReadWriter: direct.NewDirectStreamReadWriter(rw),
+			reply: func(status zerocopy.TCPReplyStatus) error {
+				if status != zerocopy.TCPReplySucceeded {
+					return sendReplyStatus(rw, status)
+				}
+				_, err := fmt.Fprintf(rw, "HTTP/1.1 200 OK\r\nDate: %s\r\n\r\n", time.Now().UTC().Format(http.TimeFormat))
+				return err
+			},
+		}, targetAddr, nil
 	}
 
 	// Set up pipes.
 	pl, pr := pipe.NewDuplexPipe()
 
+	// The goroutine waits for the reply before forwarding the first request.
+	replyCh := make(chan zerocopy.TCPReplyStatus, 1)
+
 	// Spin up a goroutine to write processed requests to pl
 	// and read responses from pl.
 	go func() {
+		if status := <-replyCh; status != zerocopy.TCPReplySucceeded {
+			_ = sendReplyStatus(rw, status)
+			pl.Close()
+			rw.Close()
+			return
+		}
+
 		var err error
 
 		plbr := bufio.NewReader(pl)
@@ -175,8 +233,11 @@ func NewHttpStreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, logger *za
 			}
 
 			// Read request.
-			req, err = http.ReadRequest(rwbr)
+			req, err = rwlr.readRequest(rwbr)
 			if err != nil {
+				if errors.Is(err, errHeaderTooLarge) {
+					_ = send431(rw)
+				}
 				if err != io.EOF {
 					err = fmt.Errorf("failed to read HTTP request: %w", err)
 				}
@@ -207,7 +268,13 @@ func NewHttpStreamServerReadWriter(rw zerocopy.DirectReadWriteCloser, logger *za
 	}()
 
 	// Wrap pr into a direct stream ReadWriter.
-	return direct.NewDirectStreamReadWriter(pr), targetAddr, nil
+	return &ServerReadWriter{
+		DirectStreamReadWriter: direct.NewDirectStreamReadWriter(pr),
+		reply: func(status zerocopy.TCPReplyStatus) error {
+			replyCh <- status
+			return nil
+		},
+	}, targetAddr, nil
 }
 
 var errEmptyHostHeader = errors.New("empty host header")
@@ -239,11 +306,79 @@ func send400(w io.Writer) error {
 	return err
 }
 
+func send431(w io.Writer) error {
+	_, err := w.Write([]byte("HTTP/1.1 431 Request Header Fields Too Large\r\nConnection: close\r\n\r\n"))
+	return err
+}
+
 func send502(w io.Writer) error {
 	_, err := w.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
 	return err
 }
 
+// sendReplyStatus sends an error response for a failed request.
+func sendReplyStatus(w io.Writer, status zerocopy.TCPReplyStatus) error {
+	var code int
+	switch status {
+	case zerocopy.TCPReplyNotAllowed:
+		code = http.StatusForbidden
+	case zerocopy.TCPReplyTimedOut:
+		code = http.StatusGatewayTimeout
+	case zerocopy.TCPReplyShuttingDown:
+		code = http.StatusServiceUnavailable
+	default:
+		code = http.StatusBadGateway
+	}
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
+
+var errHeaderTooLarge = errors.New("request header too large")
+
+// headerLimitReader limits the number of bytes read from the underlying [io.Reader]
+// while a request line and its header fields are being parsed.
+type headerLimitReader struct {
+	r io.Reader
+
+	// n is the number of bytes that can still be read.
+	// It is reset for each request and lifted once the header has been parsed.
+	n int
+
+	// limit is the maximum number of bytes read for each request header.
+	// It includes room for one full buffer of read-ahead, like net/http.
+	limit int
+}
+
+// newHeaderLimitReader returns a new [headerLimitReader] that allows maxHeaderBytes of header per request.
+func newHeaderLimitReader(r io.Reader, maxHeaderBytes int) *headerLimitReader {
+	return &headerLimitReader{
+		r:     r,
+		limit: maxHeaderBytes + 4096,
+	}
+}
+
+// Read implements [io.Reader.Read].
+func (r *headerLimitReader) Read(b []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if len(b) > r.n {
+		b = b[:r.n]
+	}
+	n, err := r.r.Read(b)
+	r.n -= n
+	return n, err
+}
+
+// readRequest reads a request from br, which must read from r,
+// and fails with [errHeaderTooLarge] if the request header exceeds the limit.
+func (r *headerLimitReader) readRequest(br *bufio.Reader) (*http.Request, error) {
+	r.n = r.limit
+	req, err := http.ReadRequest(br)
+	r.n = math.MaxInt
+	return req, err
+}
+
 // pipeClosingWriter passes writes to the underlying [io.Writer] and closes the [*pipe.DuplexPipeEnd] on error.
 type pipeClosingWriter struct {
 	w io.Writer
@@ -1,6 +1,10 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
 	"net/netip"
 	"sync"
 	"testing"
@@ -22,7 +26,7 @@ func TestHttpStreamReadWriter(t *testing.T) {
 
 	var (
 		c                *direct.DirectStreamReadWriter
-		s                *direct.DirectStreamReadWriter
+		s                *ServerReadWriter
 		serverTargetAddr conn.Addr
 		cerr, serr       error
 	)
@@ -31,12 +35,15 @@ func TestHttpStreamReadWriter(t *testing.T) {
 	wg.Add(2)
 
 	go func() {
-		c, cerr = NewHttpStreamClientReadWriter(pl, clientTargetAddr)
+		c, cerr = NewHttpStreamClientReadWriter(pl, clientTargetAddr, "", "")
 		wg.Done()
 	}()
 
 	go func() {
-		s, serverTargetAddr, serr = NewHttpStreamServerReadWriter(pr, logger)
+		s, serverTargetAddr, serr = NewHttpStreamServerReadWriter(pr, 0, logger)
+		if serr == nil {
+			serr = s.Reply(zerocopy.TCPReplySucceeded)
+		}
 		wg.Done()
 	}()
 
@@ -55,6 +62,83 @@ func TestHttpStreamReadWriter(t *testing.T) {
 	zerocopy.ReadWriterTestFunc(t, c, s)
 }
 
+func TestHttpStreamServerReadWriterHeaderTooLarge(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	defer logger.Sync()
+
+	pl, pr := pipe.NewDuplexPipe()
+	defer pl.Close()
+
+	const maxHeaderBytes = 1024
+
+	go func() {
+		_, _ = pl.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Padding: "))
+		_, _ = pl.Write(bytes.Repeat([]byte{'a'}, 2*(maxHeaderBytes+4096)))
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := NewHttpStreamServerReadWriter(pr, maxHeaderBytes, logger)
+		errCh <- err
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(pl), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("resp.StatusCode = %d, expected %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+
+	if err = <-errCh; !errors.Is(err, errHeaderTooLarge) {
+		t.Errorf("NewHttpStreamServerReadWriter() error = %v, expected %v", err, errHeaderTooLarge)
+	}
+}
+
+func TestHttpStreamServerReadWriterReplyFailure(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	defer logger.Sync()
+
+	for _, c := range []struct {
+		name         string
+		request      string
+		status       zerocopy.TCPReplyStatus
+		expectedCode int
+	}{
+		{"ConnectNotAllowed", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", zerocopy.TCPReplyNotAllowed, http.StatusForbidden},
+		{"ConnectTimedOut", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", zerocopy.TCPReplyTimedOut, http.StatusGatewayTimeout},
+		{"GetShuttingDown", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", zerocopy.TCPReplyShuttingDown, http.StatusServiceUnavailable},
+		{"GetConnectionRefused", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", zerocopy.TCPReplyConnectionRefused, http.StatusBadGateway},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pl, pr := pipe.NewDuplexPipe()
+			defer pl.Close()
+
+			go func() {
+				_, _ = pl.Write([]byte(c.request))
+			}()
+
+			go func() {
+				s, _, err := NewHttpStreamServerReadWriter(pr, 0, logger)
+				if err != nil {
+					pr.Close()
+					return
+				}
+				_ = s.Reply(c.status)
+				s.Close()
+			}()
+
+			resp, err := http.ReadResponse(bufio.NewReader(pl), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != c.expectedCode {
+				t.Errorf("resp.StatusCode = %d, expected %d", resp.StatusCode, c.expectedCode)
+			}
+		})
+	}
+}
+
 func testHostHeaderToDomainPort(t *testing.T, host, expectedDomain string, expectedPort uint16) {
 	addr, err := hostHeaderToAddr(host)
 	if err != nil {
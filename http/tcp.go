@@ -4,24 +4,29 @@ import (
 	"context"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
 
 // ProxyClient implements the zerocopy TCPClient interface.
 type ProxyClient struct {
-	name    string
-	network string
-	address string
-	dialer  conn.Dialer
+	name        string
+	network     string
+	address     string
+	dialer      conn.Dialer
+	credentials *direct.UpstreamCredentialList
 }
 
-func NewProxyClient(name, network, address string, dialer conn.Dialer) *ProxyClient {
+// NewProxyClient returns a new HTTP proxy client.
+// credentials may be nil if the proxy does not require authentication.
+func NewProxyClient(name, network, address string, dialer conn.Dialer, credentials *direct.UpstreamCredentialList) *ProxyClient {
 	return &ProxyClient{
-		name:    name,
-		network: network,
-		address: address,
-		dialer:  dialer,
+		name:        name,
+		network:     network,
+		address:     address,
+		dialer:      dialer,
+		credentials: credentials,
 	}
 }
 
@@ -35,15 +40,22 @@ func (c *ProxyClient) Info() zerocopy.TCPClientInfo {
 
 // Dial implements the zerocopy.TCPClient Dial method.
 func (c *ProxyClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
-	rawRW, err = c.dialer.DialTCP(ctx, c.network, c.address, nil)
-	if err != nil {
-		return
-	}
+	err = c.credentials.Do(func(cred direct.UpstreamCredential) error {
+		var err error
+		rawRW, err = c.dialer.DialTCP(ctx, c.network, c.address, nil)
+		if err != nil {
+			return err
+		}
 
-	rw, err = NewHttpStreamClientReadWriter(rawRW, targetAddr)
+		rw, err = NewHttpStreamClientReadWriter(rawRW, targetAddr, cred.Username, cred.Password)
+		if err != nil {
+			rawRW.Close()
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		rawRW.Close()
-		return
+		return nil, nil, err
 	}
 
 	if len(payload) > 0 {
@@ -56,11 +68,17 @@ func (c *ProxyClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []
 
 // ProxyServer implements the zerocopy TCPServer interface.
 type ProxyServer struct {
-	logger *zap.Logger
+	maxHeaderBytes int
+	logger         *zap.Logger
 }
 
-func NewProxyServer(logger *zap.Logger) *ProxyServer {
-	return &ProxyServer{logger}
+// NewProxyServer returns a new HTTP proxy server.
+// If maxHeaderBytes is not positive, [http.DefaultMaxHeaderBytes] is used.
+func NewProxyServer(maxHeaderBytes int, logger *zap.Logger) *ProxyServer {
+	return &ProxyServer{
+		maxHeaderBytes: maxHeaderBytes,
+		logger:         logger,
+	}
 }
 
 // Info implements the zerocopy.TCPServer Info method.
@@ -73,6 +91,6 @@ func (s *ProxyServer) Info() zerocopy.TCPServerInfo {
 
 // Accept implements the zerocopy.TCPServer Accept method.
 func (s *ProxyServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
-	rw, targetAddr, err = NewHttpStreamServerReadWriter(rawRW, s.logger)
+	rw, targetAddr, err = NewHttpStreamServerReadWriter(rawRW, s.maxHeaderBytes, s.logger)
 	return
 }
@@ -0,0 +1,287 @@
+package jsonhelper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IncludeKey is the top-level key of a configuration file that lists the fragments to include.
+const IncludeKey = "include"
+
+// OpenAndDecodeConfig opens the configuration file at path and decodes it into v, disallowing unknown fields.
+//
+// Before decoding, "${NAME}" in JSON strings is replaced by the value of the environment variable NAME,
+// and "$${" is replaced by a literal "${". Referencing an unset variable is an error.
+//
+// The optional top-level "include" key is a string or an array of strings, each being the path to,
+// or a glob pattern of, additional configuration fragments. Relative paths are resolved against the
+// directory of the including file. Fragments may include other fragments.
+// They are merged into the including file in order: objects are merged recursively,
+// arrays are concatenated, and other values are replaced.
+func OpenAndDecodeConfig(path string, v any) error {
+	tree, err := loadConfigTree(path, nil)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// loadConfigTree loads the configuration file at path as a generic JSON value,
+// with environment variables expanded and includes merged.
+//
+// stack is the list of files being loaded, used to detect include cycles.
+func loadConfigTree(path string, stack []string) (any, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stack {
+		if p == absPath {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, absPath), " -> "))
+		}
+	}
+	stack = append(stack, absPath)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var tree any
+	if err = d.Decode(&tree); err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			line, column := lineColumn(b, serr.Offset)
+			return nil, fmt.Errorf("failed to parse %s at line %d, column %d: %w", path, line, column, err)
+		}
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("failed to parse %s: unexpected data after top-level value", path)
+	}
+
+	if tree, err = expandEnv(tree); err != nil {
+		return nil, fmt.Errorf("failed to expand environment variables in %s: %w", path, err)
+	}
+
+	obj, ok := tree.(map[string]any)
+	if !ok {
+		return tree, nil
+	}
+
+	includeValue, ok := obj[IncludeKey]
+	if !ok {
+		return tree, nil
+	}
+	delete(obj, IncludeKey)
+
+	patterns, err := parseIncludeValue(includeValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %q in %s: %w", IncludeKey, path, err)
+	}
+
+	dir := filepath.Dir(path)
+
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		paths := []string{pattern}
+		if strings.ContainsAny(pattern, `*?[`) {
+			if paths, err = filepath.Glob(pattern); err != nil {
+				return nil, fmt.Errorf("invalid include pattern %q in %s: %w", pattern, path, err)
+			}
+		}
+
+		for _, p := range paths {
+			fragment, err := loadConfigTree(p, stack)
+			if err != nil {
+				return nil, fmt.Errorf("failed to include %s from %s: %w", p, path, err)
+			}
+			if tree, err = mergeConfigTree(tree, fragment); err != nil {
+				return nil, fmt.Errorf("failed to merge %s into %s: %w", p, path, err)
+			}
+		}
+	}
+
+	return tree, nil
+}
+
+// lineColumn returns the 1-based line and column of the byte before offset in b,
+// which is where [json.SyntaxError.Offset] points to.
+func lineColumn(b []byte, offset int64) (line, column int) {
+	b = b[:min(max(offset-1, 0), int64(len(b)))]
+	line = 1 + bytes.Count(b, []byte{'\n'})
+	column = 1 + len(b) - (bytes.LastIndexByte(b, '\n') + 1)
+	return line, column
+}
+
+// parseIncludeValue returns the include patterns in the value of the include key.
+func parseIncludeValue(v any) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []any:
+		patterns := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("element %d is not a string", i)
+			}
+			patterns[i] = s
+		}
+		return patterns, nil
+	default:
+		return nil, errors.New("expected a string or an array of strings")
+	}
+}
+
+// mergeConfigTree merges src into dst and returns the result.
+func mergeConfigTree(dst, src any) (any, error) {
+	switch d := dst.(type) {
+	case map[string]any:
+		s, ok := src.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot merge %s into object", jsonTypeName(src))
+		}
+		for k, sv := range s {
+			dv, ok := d[k]
+			if !ok {
+				d[k] = sv
+				continue
+			}
+			mv, err := mergeConfigTree(dv, sv)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", k, err)
+			}
+			d[k] = mv
+		}
+		return d, nil
+
+	case []any:
+		s, ok := src.([]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot merge %s into array", jsonTypeName(src))
+		}
+		return append(d, s...), nil
+
+	default:
+		return src, nil
+	}
+}
+
+// jsonTypeName returns the JSON type name of the generic JSON value.
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// expandEnv expands environment variables in all strings of the generic JSON value.
+// Object keys are left as is.
+func expandEnv(v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			ee, err := expandEnv(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = ee
+		}
+		return v, nil
+
+	case []any:
+		for i, e := range v {
+			ee, err := expandEnv(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = ee
+		}
+		return v, nil
+
+	case string:
+		return expandEnvString(v)
+
+	default:
+		return v, nil
+	}
+}
+
+// expandEnvString replaces "${NAME}" in s by the value of the environment variable NAME,
+// and "$${" by a literal "${". Other uses of "$" are left as is.
+//
+// It returns an error if a referenced variable is not set, or if a reference is not terminated.
+func expandEnvString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(s))
+
+	for {
+		i := strings.Index(s, "${")
+		if i == -1 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+
+		if i > 0 && s[i-1] == '$' {
+			sb.WriteString(s[:i-1])
+			sb.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+
+		sb.WriteString(s[:i])
+		s = s[i+2:]
+
+		end := strings.IndexByte(s, '}')
+		if end == -1 {
+			return "", errors.New("unterminated variable reference")
+		}
+
+		name := s[:end]
+		if name == "" {
+			return "", errors.New("empty variable name")
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		sb.WriteString(value)
+		s = s[end+1:]
+	}
+}
@@ -0,0 +1,148 @@
+package jsonhelper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Servers []testServerConfig `json:"servers"`
+	API     struct {
+		Enabled bool   `json:"enabled"`
+		Listen  string `json:"listen"`
+	} `json:"api"`
+	MaxSize int64 `json:"maxSize"`
+}
+
+type testServerConfig struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// writeFiles writes the files to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenAndDecodeConfig(t *testing.T) {
+	t.Setenv("SSGO_TEST_LISTEN", ":20221")
+	t.Setenv("SSGO_TEST_PSK", "oE/s2z9Q8EWORAB8B3UCxw==")
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"config.json": `{
+			"include": ["base.json", "customers/*.json"],
+			"servers": [{"name": "main", "password": "$${not-a-variable}"}],
+			"api": {"enabled": true},
+			"maxSize": 9007199254740993
+		}`,
+		"base.json": `{
+			"api": {"listen": "${SSGO_TEST_LISTEN}"}
+		}`,
+		"customers/a.json": `{
+			"servers": [{"name": "a", "password": "${SSGO_TEST_PSK}"}]
+		}`,
+		"customers/b.json": `{
+			"include": "../nested/c.json",
+			"servers": [{"name": "b", "password": "p$b"}]
+		}`,
+		"nested/c.json": `{
+			"servers": [{"name": "c"}]
+		}`,
+	})
+
+	var c testConfig
+	if err := OpenAndDecodeConfig(filepath.Join(dir, "config.json"), &c); err != nil {
+		t.Fatalf("OpenAndDecodeConfig failed: %v", err)
+	}
+
+	wantServers := []testServerConfig{
+		{Name: "main", Password: "${not-a-variable}"},
+		{Name: "a", Password: "oE/s2z9Q8EWORAB8B3UCxw=="},
+		{Name: "b", Password: "p$b"},
+		{Name: "c"},
+	}
+	if !reflect.DeepEqual(c.Servers, wantServers) {
+		t.Errorf("c.Servers = %+v, expected %+v", c.Servers, wantServers)
+	}
+	if !c.API.Enabled || c.API.Listen != ":20221" {
+		t.Errorf("c.API = %+v, expected enabled with listen :20221", c.API)
+	}
+	if c.MaxSize != 9007199254740993 {
+		t.Errorf("c.MaxSize = %d, expected 9007199254740993", c.MaxSize)
+	}
+}
+
+func TestOpenAndDecodeConfigErrors(t *testing.T) {
+	os.Unsetenv("SSGO_TEST_UNSET")
+
+	for _, c := range []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "UnsetVariable",
+			files:   map[string]string{"config.json": `{"api": {"listen": "${SSGO_TEST_UNSET}"}}`},
+			wantErr: "SSGO_TEST_UNSET is not set",
+		},
+		{
+			name:    "UnterminatedReference",
+			files:   map[string]string{"config.json": `{"api": {"listen": "${SSGO_TEST_UNSET"}}`},
+			wantErr: "unterminated",
+		},
+		{
+			name:    "SyntaxError",
+			files:   map[string]string{"config.json": "{\n\t\"api\": {\n\t\t\"listen\": \":20221\",\n\t}\n}"},
+			wantErr: "line 4, column 2",
+		},
+		{
+			name:    "UnknownField",
+			files:   map[string]string{"config.json": `{"include": "a.json"}`, "a.json": `{"unknown": true}`},
+			wantErr: "unknown field",
+		},
+		{
+			name:    "MissingInclude",
+			files:   map[string]string{"config.json": `{"include": "missing.json"}`},
+			wantErr: "missing.json",
+		},
+		{
+			name:    "InvalidInclude",
+			files:   map[string]string{"config.json": `{"include": 1}`},
+			wantErr: "expected a string or an array of strings",
+		},
+		{
+			name:    "IncludeCycle",
+			files:   map[string]string{"config.json": `{"include": "a.json"}`, "a.json": `{"include": "config.json"}`},
+			wantErr: "include cycle",
+		},
+		{
+			name:    "TypeMismatch",
+			files:   map[string]string{"config.json": `{"include": "a.json", "servers": []}`, "a.json": `{"servers": {}}`},
+			wantErr: "cannot merge object into array",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, c.files)
+
+			var cfg testConfig
+			err := OpenAndDecodeConfig(filepath.Join(dir, "config.json"), &cfg)
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("OpenAndDecodeConfig error = %v, expected error containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
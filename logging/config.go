@@ -0,0 +1,231 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Sink types.
+const (
+	SinkTypeStderr   = "stderr"
+	SinkTypeStdout   = "stdout"
+	SinkTypeFile     = "file"
+	SinkTypeSyslog   = "syslog"
+	SinkTypeJournald = "journald"
+)
+
+const (
+	defaultSinkMaxBackups = 5
+	defaultSinkTag        = "shadowsocks-go"
+)
+
+// Config is the configuration of log sinks.
+type Config struct {
+	// Sinks is the list of sinks that logs are written to.
+	// Each log entry is written to every sink whose level enables it.
+	//
+	// If empty, the logger is built from the command line flags.
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// SinkConfig is the configuration of a log sink.
+type SinkConfig struct {
+	// Type is the type of the sink.
+	//
+	//   - "stderr": Standard error.
+	//   - "stdout": Standard output.
+	//   - "file": A file with optional size and time based rotation.
+	//   - "syslog": The local or a remote syslog daemon. Not available on Windows.
+	//   - "journald": The systemd journal. Only available on Linux.
+	Type string `json:"type"`
+
+	// Level is the minimum level of log entries written to the sink.
+	//
+	// The default value is "info".
+	Level zapcore.Level `json:"level"`
+
+	// Encoding is "console" (default) for human-readable lines, or "json" for JSON objects.
+	Encoding string `json:"encoding"`
+
+	// NoColor disables colored levels in the console encoding.
+	// Colors are always disabled for sinks other than stderr and stdout.
+	NoColor bool `json:"noColor"`
+
+	// NoTime omits timestamps.
+	// Timestamps are always omitted for syslog and journald, which record their own.
+	NoTime bool `json:"noTime"`
+
+	// Path is the path to the log file of a file sink.
+	Path string `json:"path"`
+
+	// MaxSize is the size in bytes after which the log file is rotated.
+	// If zero, the file is not rotated by size.
+	MaxSize int64 `json:"maxSize"`
+
+	// RotateInterval is how long the log file is written to before it is rotated.
+	// If zero, the file is not rotated by time.
+	RotateInterval jsonhelper.Duration `json:"rotateInterval"`
+
+	// MaxBackups is the number of rotated log files to keep.
+	// The newest rotated file has the ".1" suffix.
+	//
+	// The default value is 5.
+	MaxBackups int `json:"maxBackups"`
+
+	// Network and Address are the network and address of a remote syslog daemon, like "udp" and "192.0.2.1:514".
+	// If both are empty, the local syslog daemon is used.
+	Network string `json:"network"`
+	Address string `json:"address"`
+
+	// Tag is the syslog tag or journald syslog identifier.
+	//
+	// The default value is "shadowsocks-go".
+	Tag string `json:"tag"`
+}
+
+// NewZapLogger returns a new [*zap.Logger] that writes to all sinks.
+func (c *Config) NewZapLogger() (*zap.Logger, error) {
+	if len(c.Sinks) == 0 {
+		return nil, errors.New("no log sinks configured")
+	}
+
+	cores := make([]zapcore.Core, 0, len(c.Sinks))
+	var files []*RotatingFile
+
+	for i := range c.Sinks {
+		core, file, err := c.Sinks[i].newCore()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("failed to create log sink %d (%s): %w", i, c.Sinks[i].Type, err)
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+		cores = append(cores, core)
+	}
+
+	return zap.New(zapcore.NewTee(cores...)), nil
+}
+
+// Validate checks the configuration without opening any sinks.
+func (c *Config) Validate() error {
+	for i := range c.Sinks {
+		if err := c.Sinks[i].validate(); err != nil {
+			return fmt.Errorf("invalid log sink %d (%s): %w", i, c.Sinks[i].Type, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the sink configuration without opening the sink.
+func (sc *SinkConfig) validate() error {
+	switch sc.Type {
+	case SinkTypeStderr, SinkTypeStdout, SinkTypeSyslog, SinkTypeJournald:
+	case SinkTypeFile:
+		if sc.Path == "" {
+			return errors.New("missing path")
+		}
+		if sc.MaxSize < 0 {
+			return fmt.Errorf("negative max size: %d", sc.MaxSize)
+		}
+		if sc.RotateInterval < 0 {
+			return fmt.Errorf("negative rotate interval: %s", sc.RotateInterval.Value())
+		}
+		if sc.MaxBackups < 0 {
+			return fmt.Errorf("negative max backups: %d", sc.MaxBackups)
+		}
+	default:
+		return fmt.Errorf("unknown sink type: %q", sc.Type)
+	}
+
+	switch sc.Encoding {
+	case "", "console", "json":
+		return nil
+	default:
+		return fmt.Errorf("unknown encoding: %q", sc.Encoding)
+	}
+}
+
+// newCore returns a new core that writes to the sink.
+// If the sink is a file, the opened file is also returned.
+func (sc *SinkConfig) newCore() (zapcore.Core, *RotatingFile, error) {
+	if err := sc.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	noColor, noTime := sc.NoColor, sc.NoTime
+	switch sc.Type {
+	case SinkTypeFile:
+		noColor = true
+	case SinkTypeSyslog, SinkTypeJournald:
+		noColor, noTime = true, true
+	}
+
+	enc, err := sc.newEncoder(noColor, noTime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tag := sc.Tag
+	if tag == "" {
+		tag = defaultSinkTag
+	}
+
+	switch sc.Type {
+	case SinkTypeStderr:
+		return zapcore.NewCore(enc, zapcore.Lock(os.Stderr), sc.Level), nil, nil
+
+	case SinkTypeStdout:
+		return zapcore.NewCore(enc, zapcore.Lock(os.Stdout), sc.Level), nil, nil
+
+	case SinkTypeFile:
+		maxBackups := sc.MaxBackups
+		if maxBackups == 0 {
+			maxBackups = defaultSinkMaxBackups
+		}
+		f, err := OpenRotatingFile(sc.Path, sc.MaxSize, sc.RotateInterval.Value(), maxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zapcore.NewCore(enc, f, sc.Level), f, nil
+
+	case SinkTypeSyslog:
+		w, err := newSyslogWriter(sc.Network, sc.Address, tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newLevelCore(enc, w, sc.Level), nil, nil
+
+	default: // SinkTypeJournald
+		w, err := newJournaldWriter(tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newLevelCore(enc, w, sc.Level), nil, nil
+	}
+}
+
+// newEncoder returns a new encoder for the sink's encoding.
+func (sc *SinkConfig) newEncoder(noColor, noTime bool) (zapcore.Encoder, error) {
+	switch sc.Encoding {
+	case "", "console":
+		return zapcore.NewConsoleEncoder(NewProductionConsoleEncoderConfig(noColor, noTime)), nil
+	case "json":
+		ec := zap.NewProductionEncoderConfig()
+		ec.EncodeTime = zapcore.ISO8601TimeEncoder
+		ec.EncodeDuration = zapcore.StringDurationEncoder
+		if noTime {
+			ec.TimeKey = zapcore.OmitKey
+		}
+		return zapcore.NewJSONEncoder(ec), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding: %q", sc.Encoding)
+	}
+}
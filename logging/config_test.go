@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestConfigNewZapLogger(t *testing.T) {
+	dir := t.TempDir()
+	debugPath := filepath.Join(dir, "debug.log")
+	warnPath := filepath.Join(dir, "warn.log")
+
+	var c Config
+	if err := json.Unmarshal([]byte(`{
+		"sinks": [
+			{"type": "file", "level": "debug", "encoding": "json", "path": `+jsonString(debugPath)+`},
+			{"type": "file", "level": "warn", "path": `+jsonString(warnPath)+`, "maxSize": 1048576, "rotateInterval": "24h"}
+		]
+	}`), &c); err != nil {
+		t.Fatalf("Failed to unmarshal config: %v", err)
+	}
+	if c.Sinks[0].Level != zapcore.DebugLevel || c.Sinks[1].Level != zapcore.WarnLevel {
+		t.Fatalf("Sink levels = %s, %s, expected debug, warn", c.Sinks[0].Level, c.Sinks[1].Level)
+	}
+
+	logger, err := c.NewZapLogger()
+	if err != nil {
+		t.Fatalf("c.NewZapLogger failed: %v", err)
+	}
+
+	logger.Debug("debug message", zap.Int("n", 1))
+	logger.With(zap.String("server", "ss-2022")).Warn("warn message")
+	if err = logger.Sync(); err != nil {
+		t.Fatalf("logger.Sync failed: %v", err)
+	}
+
+	debugLog := readFile(t, debugPath)
+	lines := strings.Split(strings.TrimSuffix(debugLog, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Debug log has %d lines, expected 2: %q", len(lines), debugLog)
+	}
+	var entry struct {
+		Level   string `json:"level"`
+		Message string `json:"msg"`
+		N       int    `json:"n"`
+	}
+	if err = json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Failed to unmarshal debug log entry %q: %v", lines[0], err)
+	}
+	if entry.Level != "debug" || entry.Message != "debug message" || entry.N != 1 {
+		t.Errorf("Debug log entry = %+v, expected debug message with n = 1", entry)
+	}
+
+	warnLog := readFile(t, warnPath)
+	if strings.Contains(warnLog, "debug message") {
+		t.Errorf("Warn log %q contains debug entry", warnLog)
+	}
+	// File sinks do not use colors.
+	if !strings.Contains(warnLog, "WARN warn message") || !strings.Contains(warnLog, `"server": "ss-2022"`) || strings.Contains(warnLog, "\x1b[") {
+		t.Errorf("Warn log = %q, expected uncolored warn entry with server field", warnLog)
+	}
+}
+
+func TestConfigNewZapLoggerInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	for _, c := range []struct {
+		name string
+		sink SinkConfig
+	}{
+		{"UnknownType", SinkConfig{Type: "carrier-pigeon"}},
+		{"UnknownEncoding", SinkConfig{Type: SinkTypeStderr, Encoding: "xml"}},
+		{"MissingPath", SinkConfig{Type: SinkTypeFile}},
+		{"NegativeMaxSize", SinkConfig{Type: SinkTypeFile, Path: path, MaxSize: -1}},
+		{"NegativeMaxBackups", SinkConfig{Type: SinkTypeFile, Path: path, MaxBackups: -1}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Config{Sinks: []SinkConfig{{Type: SinkTypeStderr}, c.sink}}
+			if _, err := cfg.NewZapLogger(); err == nil {
+				t.Error("cfg.NewZapLogger succeeded")
+			}
+		})
+	}
+
+	var cfg Config
+	if _, err := cfg.NewZapLogger(); err == nil {
+		t.Error("NewZapLogger without sinks succeeded")
+	}
+}
+
+// testLevelWriter records the levels and messages written to it.
+type testLevelWriter struct {
+	levels   []zapcore.Level
+	messages []string
+}
+
+func (w *testLevelWriter) WriteLevel(level zapcore.Level, b []byte) error {
+	w.levels = append(w.levels, level)
+	w.messages = append(w.messages, string(b))
+	return nil
+}
+
+func (w *testLevelWriter) Sync() error {
+	return nil
+}
+
+func TestLevelCore(t *testing.T) {
+	var w testLevelWriter
+	enc := zapcore.NewConsoleEncoder(NewProductionConsoleEncoderConfig(true, true))
+	logger := zap.New(newLevelCore(enc, &w, zapcore.InfoLevel)).With(zap.String("server", "ss-2022"))
+
+	logger.Debug("debug message")
+	logger.Info("info message")
+	logger.Error("error message")
+
+	if len(w.levels) != 2 || w.levels[0] != zapcore.InfoLevel || w.levels[1] != zapcore.ErrorLevel {
+		t.Fatalf("Levels = %v, expected [info error]", w.levels)
+	}
+	if want := "INFO info message {\"server\": \"ss-2022\"}\n"; w.messages[0] != want {
+		t.Errorf("Message = %q, expected %q", w.messages[0], want)
+	}
+}
+
+// jsonString returns s as a JSON string literal.
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
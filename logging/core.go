@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// levelWriter writes encoded log entries along with their levels,
+// for sinks that record the severity separately from the message.
+type levelWriter interface {
+	// WriteLevel writes an encoded entry of the level.
+	WriteLevel(level zapcore.Level, b []byte) error
+
+	// Sync flushes buffered entries.
+	Sync() error
+}
+
+// levelCore is like the core returned by [zapcore.NewCore],
+// but passes the level of each entry to the writer.
+type levelCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   levelWriter
+}
+
+// newLevelCore returns a new core that writes entries enabled by enab to w.
+func newLevelCore(enc zapcore.Encoder, w levelWriter, enab zapcore.LevelEnabler) zapcore.Core {
+	return &levelCore{
+		LevelEnabler: enab,
+		enc:          enc,
+		w:            w,
+	}
+}
+
+// With implements [zapcore.Core.With].
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for i := range fields {
+		fields[i].AddTo(enc)
+	}
+	return &levelCore{
+		LevelEnabler: c.LevelEnabler,
+		enc:          enc,
+		w:            c.w,
+	}
+}
+
+// Check implements [zapcore.Core.Check].
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write implements [zapcore.Core.Write].
+func (c *levelCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	err = c.w.WriteLevel(ent.Level, buf.Bytes())
+	buf.Free()
+	if err != nil {
+		return err
+	}
+	if ent.Level > zapcore.ErrorLevel {
+		// Entries above error level may crash the program, so flush them immediately.
+		_ = c.Sync()
+	}
+	return nil
+}
+
+// Sync implements [zapcore.Core.Sync].
+func (c *levelCore) Sync() error {
+	return c.w.Sync()
+}
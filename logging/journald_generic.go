@@ -0,0 +1,9 @@
+//go:build !linux
+
+package logging
+
+import "errors"
+
+func newJournaldWriter(tag string) (levelWriter, error) {
+	return nil, errors.New("journald is only supported on Linux")
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// journaldSocketPath is the path to the socket of the systemd journal's native protocol.
+const journaldSocketPath = "/run/systemd/journal/socket"
+
+// journaldWriter writes log entries to the systemd journal using its native protocol,
+// with priorities mapped from their levels.
+type journaldWriter struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+// newJournaldWriter connects to the systemd journal.
+// Entries are recorded with tag as their syslog identifier.
+func newJournaldWriter(tag string) (levelWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn: conn, tag: tag}, nil
+}
+
+// journaldPriority returns the syslog priority of the level.
+func journaldPriority(level zapcore.Level) int {
+	switch level {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// WriteLevel implements [levelWriter.WriteLevel].
+func (w *journaldWriter) WriteLevel(level zapcore.Level, b []byte) error {
+	msg := bytes.TrimSuffix(b, []byte{'\n'})
+
+	buf := make([]byte, 0, 64+len(w.tag)+len(msg))
+	buf = append(buf, "PRIORITY="...)
+	buf = strconv.AppendInt(buf, int64(journaldPriority(level)), 10)
+	buf = append(buf, "\nSYSLOG_IDENTIFIER="...)
+	buf = append(buf, w.tag...)
+	// The message may contain newlines, so use the binary format.
+	buf = append(buf, "\nMESSAGE\n"...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(msg)))
+	buf = append(buf, msg...)
+	buf = append(buf, '\n')
+
+	_, err := w.conn.Write(buf)
+	return err
+}
+
+// Sync implements [levelWriter.Sync].
+func (w *journaldWriter) Sync() error {
+	return nil
+}
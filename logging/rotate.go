@@ -0,0 +1,155 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file that is rotated when it grows beyond a size,
+// or when it has been written to for longer than an interval.
+//
+// Rotated files are renamed with a numeric suffix, with ".1" being the newest.
+// Rotation happens between writes, so a single write is never split across files.
+//
+// RotatingFile implements [zapcore.WriteSyncer] and is safe for concurrent use.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openTime time.Time
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it if it does not exist.
+//
+// If maxSize is positive, the file is rotated before a write that would grow it beyond maxSize bytes.
+// If interval is positive, the file is rotated before the first write after it has been open for interval.
+// maxBackups is the number of rotated files to keep.
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file for appending.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = fi.Size()
+	f.openTime = time.Now()
+	return nil
+}
+
+// Write implements [io.Writer.Write].
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.shouldRotate(len(b)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to rotate log file:", err)
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// shouldRotate returns whether the file should be rotated before writing n bytes.
+func (f *RotatingFile) shouldRotate(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(n) > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.openTime) >= f.interval
+}
+
+// rotate renames the file and its backups, replacing the oldest backup, and opens a new file.
+//
+// If renaming fails, the current file is reopened and written to.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		err = f.renameBackups()
+	}
+
+	if openErr := f.open(); openErr != nil {
+		f.file = nil
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// renameBackups shifts the backups and the file up by one suffix.
+func (f *RotatingFile) renameBackups() error {
+	if f.maxBackups <= 0 {
+		return os.Remove(f.path)
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(f.backupPath(i), f.backupPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.backupPath(1))
+}
+
+// backupPath returns the path of the i-th newest rotated file.
+func (f *RotatingFile) backupPath(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// Sync implements [zapcore.WriteSyncer.Sync].
+func (f *RotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.file.Sync()
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
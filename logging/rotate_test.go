@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readFile returns the contents of the file, or "" if it does not exist.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFileMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	f, err := OpenRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+
+	// The second line fits, the third does not, and lines are never split.
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddddddddddd\n", "eeee\n"} {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatalf("f.Write failed: %v", err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("f.Close failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		path string
+		want string
+	}{
+		{path, "eeee\n"},
+		{f.backupPath(1), "dddddddddddd\n"},
+		{f.backupPath(2), "cccc\n"},
+		{f.backupPath(3), ""},
+	} {
+		if got := readFile(t, c.path); got != c.want {
+			t.Errorf("%s = %q, expected %q", filepath.Base(c.path), got, c.want)
+		}
+	}
+
+	if _, err = f.Write([]byte("ffff\n")); err == nil {
+		t.Error("f.Write after Close succeeded")
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+
+	f, err := OpenRotatingFile(path, 0, time.Nanosecond, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		time.Sleep(time.Millisecond)
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatalf("f.Write failed: %v", err)
+		}
+	}
+
+	if got := readFile(t, path); got != "cccc\n" {
+		t.Errorf("Current file = %q, expected %q", got, "cccc\n")
+	}
+	if got := readFile(t, f.backupPath(1)); got != "bbbb\n" {
+		t.Errorf("Backup 1 = %q, expected %q", got, "bbbb\n")
+	}
+	if got := readFile(t, f.backupPath(2)); got != "" {
+		t.Errorf("Backup 2 = %q, expected none", got)
+	}
+}
+
+func TestRotatingFileAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	if err := os.WriteFile(path, []byte("existing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenRotatingFile(path, 20, 0, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer f.Close()
+
+	// The existing content counts towards the size limit.
+	for _, line := range []string{"aaaa\n", "bbbbbbbb\n"} {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatalf("f.Write failed: %v", err)
+		}
+	}
+
+	if got := readFile(t, f.backupPath(1)); got != "existing\naaaa\n" {
+		t.Errorf("Backup 1 = %q, expected %q", got, "existing\naaaa\n")
+	}
+	if got := readFile(t, path); got != "bbbbbbbb\n" {
+		t.Errorf("Current file = %q, expected %q", got, "bbbbbbbb\n")
+	}
+}
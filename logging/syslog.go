@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"bytes"
+	"log/syslog"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogWriter writes log entries to syslog with severities mapped from their levels.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// newSyslogWriter connects to the syslog daemon at address over network,
+// or the local syslog daemon if both are empty.
+func newSyslogWriter(network, address, tag string) (levelWriter, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+// WriteLevel implements [levelWriter.WriteLevel].
+func (w *syslogWriter) WriteLevel(level zapcore.Level, b []byte) error {
+	msg := string(bytes.TrimSuffix(b, []byte{'\n'}))
+	switch level {
+	case zapcore.DebugLevel:
+		return w.w.Debug(msg)
+	case zapcore.InfoLevel:
+		return w.w.Info(msg)
+	case zapcore.WarnLevel:
+		return w.w.Warning(msg)
+	case zapcore.ErrorLevel:
+		return w.w.Err(msg)
+	default:
+		return w.w.Crit(msg)
+	}
+}
+
+// Sync implements [levelWriter.Sync].
+func (w *syslogWriter) Sync() error {
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package logging
+
+import "errors"
+
+func newSyslogWriter(network, address, tag string) (levelWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
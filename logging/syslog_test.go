@@ -0,0 +1,56 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSink(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	c := Config{Sinks: []SinkConfig{{
+		Type:    SinkTypeSyslog,
+		Level:   -1, // debug
+		Network: "udp",
+		Address: pc.LocalAddr().String(),
+		Tag:     "ssgo-test",
+	}}}
+	logger, err := c.NewZapLogger()
+	if err != nil {
+		t.Fatalf("c.NewZapLogger failed: %v", err)
+	}
+
+	logger.Debug("debug message")
+	logger.Warn("warn message")
+
+	if err = pc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The daemon facility is 3, so the priority is 24 plus the severity.
+	for _, want := range []struct {
+		priority string
+		message  string
+	}{
+		{"<31>", "DEBUG debug message"},
+		{"<28>", "WARN warn message"},
+	} {
+		b := make([]byte, 1024)
+		n, err := pc.Read(b)
+		if err != nil {
+			t.Fatalf("Failed to read syslog message: %v", err)
+		}
+		msg := string(b[:n])
+		if !strings.HasPrefix(msg, want.priority) || !strings.Contains(msg, "ssgo-test") || !strings.HasSuffix(strings.TrimSuffix(msg, "\n"), want.message) {
+			t.Errorf("Syslog message = %q, expected priority %s, tag ssgo-test and message %q", msg, want.priority, want.message)
+		}
+	}
+}
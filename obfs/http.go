@@ -0,0 +1,168 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+const (
+	// maxHTTPHeaderSize is the maximum size of an HTTP request or response header.
+	maxHTTPHeaderSize = 4096
+
+	// webSocketGUID is appended to the Sec-WebSocket-Key to compute the Sec-WebSocket-Accept.
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	errHTTPHeaderTooLarge  = errors.New("HTTP header too large")
+	errNotWebSocketUpgrade = errors.New("not a WebSocket upgrade")
+)
+
+// appendHTTPRequest appends a WebSocket upgrade request to b, with payload as the body.
+func appendHTTPRequest(b []byte, host string, payload []byte) []byte {
+	var key [16]byte
+	fillRandom(key[:])
+
+	b = append(b, "GET / HTTP/1.1\r\nHost: "...)
+	b = append(b, host...)
+	b = append(b, "\r\nUser-Agent: curl/7."...)
+	b = strconv.AppendUint(b, uint64(mrand.IntN(51)+50), 10)
+	b = append(b, '.')
+	b = strconv.AppendUint(b, uint64(mrand.IntN(2)), 10)
+	b = append(b, "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: "...)
+	b = base64.StdEncoding.AppendEncode(b, key[:])
+	b = append(b, "\r\nContent-Length: "...)
+	b = strconv.AppendInt(b, int64(len(payload)), 10)
+	b = append(b, "\r\n\r\n"...)
+	return append(b, payload...)
+}
+
+// appendHTTPResponse appends a WebSocket upgrade response to b, for the request with key.
+func appendHTTPResponse(b []byte, key []byte) []byte {
+	h := sha1.New()
+	h.Write(key)
+	h.Write([]byte(webSocketGUID))
+
+	b = append(b, "HTTP/1.1 101 Switching Protocols\r\nServer: nginx/1."...)
+	b = strconv.AppendUint(b, uint64(mrand.IntN(11)+18), 10)
+	b = append(b, '.')
+	b = strconv.AppendUint(b, uint64(mrand.IntN(10)), 10)
+	b = append(b, "\r\nDate: "...)
+	b = time.Now().UTC().AppendFormat(b, "Mon, 02 Jan 2006 15:04:05 GMT")
+	b = append(b, "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "...)
+	b = base64.StdEncoding.AppendEncode(b, h.Sum(nil))
+	return append(b, "\r\n\r\n"...)
+}
+
+// readHTTPHeader reads from r until the end of an HTTP header.
+// It returns the header without the final empty line, and the data read after it.
+// On error, it returns the data read so far as rest.
+func readHTTPHeader(r zerocopy.DirectReadWriteCloser) (header, rest []byte, err error) {
+	buf := make([]byte, maxHTTPHeaderSize)
+	var n int
+
+	for {
+		if n == len(buf) {
+			return nil, buf[:n], errHTTPHeaderTooLarge
+		}
+
+		nr, err := r.Read(buf[n:])
+		searchStart := max(0, n-3)
+		n += nr
+		if i := bytes.Index(buf[searchStart:n], []byte("\r\n\r\n")); i >= 0 {
+			end := searchStart + i
+			return buf[:end], buf[end+4 : n], nil
+		}
+		if err != nil {
+			return nil, buf[:n], err
+		}
+	}
+}
+
+// httpHeaderValue returns the value of the first header field named name, case-insensitively.
+func httpHeaderValue(header []byte, name string) ([]byte, bool) {
+	for len(header) > 0 {
+		var line []byte
+		line, header, _ = bytes.Cut(header, []byte("\r\n"))
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(bytes.TrimSpace(key), []byte(name)) {
+			return bytes.TrimSpace(value), true
+		}
+	}
+	return nil, false
+}
+
+// acceptHTTP reads the WebSocket upgrade request from rawRW,
+// and returns a stream that sends the response on the first write.
+func acceptHTTP(rawRW zerocopy.DirectReadWriteCloser) (*httpServerConn, []byte, error) {
+	header, rest, err := readHTTPHeader(rawRW)
+	if err != nil {
+		return nil, rest, err
+	}
+
+	requestLine, _, _ := bytes.Cut(header, []byte("\r\n"))
+	if !bytes.HasSuffix(requestLine, []byte(" HTTP/1.1")) {
+		return nil, append(header, rest...), fmt.Errorf("bad HTTP request line: %q", requestLine)
+	}
+	if upgrade, _ := httpHeaderValue(header, "Upgrade"); !bytes.EqualFold(upgrade, []byte("websocket")) {
+		return nil, append(header, rest...), errNotWebSocketUpgrade
+	}
+	key, _ := httpHeaderValue(header, "Sec-WebSocket-Key")
+
+	return &httpServerConn{
+		pendingReader: pendingReader{
+			DirectReadWriteCloser: rawRW,
+			pending:               rest,
+		},
+		response: appendHTTPResponse(nil, key),
+	}, nil, nil
+}
+
+// httpClientConn skips the server's WebSocket upgrade response before the first read.
+type httpClientConn struct {
+	pendingReader
+	headerRead bool
+}
+
+// Read implements the io.Reader Read method.
+func (c *httpClientConn) Read(b []byte) (int, error) {
+	if !c.headerRead {
+		_, rest, err := readHTTPHeader(c.DirectReadWriteCloser)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read HTTP response header: %w", err)
+		}
+		c.pending = rest
+		c.headerRead = true
+	}
+	if n, ok := c.readPending(b); ok {
+		return n, nil
+	}
+	return c.DirectReadWriteCloser.Read(b)
+}
+
+// httpServerConn sends the WebSocket upgrade response before the first write.
+type httpServerConn struct {
+	pendingReader
+	response []byte
+}
+
+// Write implements the io.Writer Write method.
+func (c *httpServerConn) Write(b []byte) (int, error) {
+	if c.response != nil {
+		response := append(c.response, b...)
+		c.response = nil
+		if _, err := c.DirectReadWriteCloser.Write(response); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return c.DirectReadWriteCloser.Write(b)
+}
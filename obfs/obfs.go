@@ -0,0 +1,162 @@
+// Package obfs implements packet obfuscation for UDP relays,
+// and simple-obfs style HTTP and TLS stream obfuscation for TCP relays.
+//
+// Obfuscation is applied to packets after they are packed by the proxy protocol,
+// and removed before they are unpacked. It does not provide any security on its own.
+// It only makes packets look like random bytes to middleboxes that fingerprint
+// or throttle recognizable proxy traffic.
+//
+// Stream obfuscation wraps connections between clients and servers, below the proxy protocol.
+// It makes the start of each stream look like a WebSocket upgrade or a TLS handshake,
+// the way simple-obfs does, without running a plugin process.
+package obfs
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"lukechampine.com/blake3"
+)
+
+// Supported obfuscation modes.
+const (
+	ModeNone      = ""
+	ModeXOR       = "xor"
+	ModeSaltedXOR = "salted-xor"
+)
+
+const (
+	keyDeriveCtx   = "shadowsocks-go UDP obfuscation key"
+	saltedSaltSize = 8
+)
+
+var errEmptyPSK = errors.New("obfuscation PSK is empty")
+
+// Obfuscator obfuscates and deobfuscates packets in place.
+//
+// Implementations must be safe for concurrent use.
+type Obfuscator interface {
+	// Overhead returns the number of bytes the obfuscator prepends to each packet.
+	Overhead() int
+
+	// Obfuscate obfuscates the packet b[Overhead():] in place,
+	// and fills the first Overhead() bytes of b.
+	Obfuscate(b []byte) error
+
+	// Deobfuscate deobfuscates b in place. The packet is then b[Overhead():].
+	Deobfuscate(b []byte) error
+}
+
+// New returns a new obfuscator for the given mode and pre-shared key.
+// It returns nil if mode is [ModeNone].
+func New(mode string, psk []byte) (Obfuscator, error) {
+	switch mode {
+	case ModeNone:
+		return nil, nil
+	case ModeXOR, ModeSaltedXOR:
+	default:
+		return nil, fmt.Errorf("unknown obfuscation mode: %q", mode)
+	}
+
+	if len(psk) == 0 {
+		return nil, errEmptyPSK
+	}
+
+	var key [32]byte
+	blake3.DeriveKey(key[:], keyDeriveCtx, psk)
+
+	if mode == ModeXOR {
+		return &xorObfuscator{key: key}, nil
+	}
+	return newSaltedXORObfuscator(key), nil
+}
+
+// xorObfuscator XORs packets with a fixed key derived from the PSK.
+//
+// It has no overhead, but the same plaintext bytes at the same offset
+// always produce the same obfuscated bytes.
+type xorObfuscator struct {
+	key [32]byte
+}
+
+// Overhead implements the Obfuscator Overhead method.
+func (o *xorObfuscator) Overhead() int {
+	return 0
+}
+
+// Obfuscate implements the Obfuscator Obfuscate method.
+func (o *xorObfuscator) Obfuscate(b []byte) error {
+	for len(b) > 0 {
+		n := subtle.XORBytes(b, b, o.key[:])
+		b = b[n:]
+	}
+	return nil
+}
+
+// Deobfuscate implements the Obfuscator Deobfuscate method.
+func (o *xorObfuscator) Deobfuscate(b []byte) error {
+	return o.Obfuscate(b)
+}
+
+// saltedXORObfuscator prepends a random salt to each packet,
+// and XORs the packet with a BLAKE3 keystream derived from the key and the salt.
+type saltedXORObfuscator struct {
+	hasherPool sync.Pool
+}
+
+func newSaltedXORObfuscator(key [32]byte) *saltedXORObfuscator {
+	return &saltedXORObfuscator{
+		hasherPool: sync.Pool{
+			New: func() any {
+				return blake3.New(32, key[:])
+			},
+		},
+	}
+}
+
+// Overhead implements the Obfuscator Overhead method.
+func (o *saltedXORObfuscator) Overhead() int {
+	return saltedSaltSize
+}
+
+// Obfuscate implements the Obfuscator Obfuscate method.
+func (o *saltedXORObfuscator) Obfuscate(b []byte) error {
+	if len(b) < saltedSaltSize {
+		return zerocopy.ErrPacketTooSmall
+	}
+	if _, err := rand.Read(b[:saltedSaltSize]); err != nil {
+		return err
+	}
+	o.xorKeystream(b)
+	return nil
+}
+
+// Deobfuscate implements the Obfuscator Deobfuscate method.
+func (o *saltedXORObfuscator) Deobfuscate(b []byte) error {
+	if len(b) < saltedSaltSize {
+		return zerocopy.ErrPacketTooSmall
+	}
+	o.xorKeystream(b)
+	return nil
+}
+
+// xorKeystream XORs b[saltedSaltSize:] with the keystream for the salt b[:saltedSaltSize].
+func (o *saltedXORObfuscator) xorKeystream(b []byte) {
+	h := o.hasherPool.Get().(*blake3.Hasher)
+	defer o.hasherPool.Put(h)
+
+	h.Reset()
+	_, _ = h.Write(b[:saltedSaltSize])
+	xof := h.XOF()
+
+	var ks [64]byte
+	for p := b[saltedSaltSize:]; len(p) > 0; {
+		_, _ = xof.Read(ks[:])
+		n := subtle.XORBytes(p, p, ks[:])
+		p = p[n:]
+	}
+}
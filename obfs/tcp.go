@@ -0,0 +1,152 @@
+package obfs
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand/v2"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// Supported stream obfuscation modes.
+const (
+	StreamModeNone = ""
+	StreamModeHTTP = "http"
+	StreamModeTLS  = "tls"
+)
+
+// CheckStreamMode returns an error if mode is not a supported stream obfuscation mode.
+func CheckStreamMode(mode string) error {
+	switch mode {
+	case StreamModeNone, StreamModeHTTP, StreamModeTLS:
+		return nil
+	default:
+		return fmt.Errorf("unknown stream obfuscation mode: %q", mode)
+	}
+}
+
+// fillRandom fills b with random bytes.
+// Stream obfuscation only needs them to look random, not to be secret.
+func fillRandom(b []byte) {
+	var buf [8]byte
+	for len(b) > 0 {
+		binary.LittleEndian.PutUint64(buf[:], mrand.Uint64())
+		n := copy(b, buf[:])
+		b = b[n:]
+	}
+}
+
+// pendingReader returns pending data before reading from the inner stream.
+type pendingReader struct {
+	zerocopy.DirectReadWriteCloser
+	pending []byte
+}
+
+// readPending copies pending data to b, and reports whether there was any.
+func (r *pendingReader) readPending(b []byte) (int, bool) {
+	if len(r.pending) == 0 {
+		return 0, false
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, true
+}
+
+// Read implements the io.Reader Read method.
+func (r *pendingReader) Read(b []byte) (int, error) {
+	if n, ok := r.readPending(b); ok {
+		return n, nil
+	}
+	return r.DirectReadWriteCloser.Read(b)
+}
+
+// TCPConnOpener obfuscates connections opened by an inner opener.
+//
+// TCPConnOpener implements the zerocopy DirectReadWriteCloserOpener interface.
+type TCPConnOpener struct {
+	inner zerocopy.DirectReadWriteCloserOpener
+	mode  string
+	host  string
+}
+
+// NewTCPConnOpener returns a new opener that obfuscates connections opened by inner with mode.
+// host is the server name in the HTTP Host header or the TLS SNI extension.
+func NewTCPConnOpener(inner zerocopy.DirectReadWriteCloserOpener, mode, host string) *TCPConnOpener {
+	return &TCPConnOpener{
+		inner: inner,
+		mode:  mode,
+		host:  host,
+	}
+}
+
+// Open implements the zerocopy.DirectReadWriteCloserOpener Open method.
+//
+// The initial payload is sent in the HTTP request body or the TLS session ticket extension.
+func (o *TCPConnOpener) Open(ctx context.Context, b []byte) (zerocopy.DirectReadWriteCloser, error) {
+	switch o.mode {
+	case StreamModeHTTP:
+		rw, err := o.inner.Open(ctx, appendHTTPRequest(nil, o.host, b))
+		if err != nil {
+			return nil, err
+		}
+		return &httpClientConn{pendingReader: pendingReader{DirectReadWriteCloser: rw}}, nil
+
+	case StreamModeTLS:
+		rw, err := o.inner.Open(ctx, appendTLSClientHello(nil, o.host, b))
+		if err != nil {
+			return nil, err
+		}
+		return &tlsConn{pendingReader: pendingReader{DirectReadWriteCloser: rw}, isClient: true}, nil
+
+	default:
+		return o.inner.Open(ctx, b)
+	}
+}
+
+// TCPServer wraps a TCP server and deobfuscates streams from clients.
+//
+// TCPServer implements the zerocopy TCPServer interface.
+type TCPServer struct {
+	inner zerocopy.TCPServer
+	mode  string
+}
+
+// NewTCPServer returns a new TCP server that deobfuscates streams with mode before passing them to inner.
+func NewTCPServer(inner zerocopy.TCPServer, mode string) *TCPServer {
+	return &TCPServer{
+		inner: inner,
+		mode:  mode,
+	}
+}
+
+// Info implements the zerocopy.TCPServer Info method.
+func (s *TCPServer) Info() zerocopy.TCPServerInfo {
+	return s.inner.Info()
+}
+
+// Accept implements the zerocopy.TCPServer Accept method.
+func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
+	var obfsRW zerocopy.DirectReadWriteCloser
+
+	switch s.mode {
+	case StreamModeHTTP:
+		obfsRW, payload, err = acceptHTTP(rawRW)
+	case StreamModeTLS:
+		obfsRW, payload, err = acceptTLS(rawRW)
+	default:
+		return s.inner.Accept(rawRW)
+	}
+	if err != nil {
+		return nil, conn.Addr{}, payload, "", err
+	}
+
+	rw, targetAddr, payload, username, err = s.inner.Accept(obfsRW)
+	if err != nil {
+		// The payload read by the inner server has been deobfuscated,
+		// so it is not the data read from the connection.
+		payload = nil
+	}
+	return rw, targetAddr, payload, username, err
+}
@@ -0,0 +1,140 @@
+package obfs
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/pipe"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+func testStreamObfs(t *testing.T, mode string, clientInitialPayload []byte) {
+	pl, pr := pipe.NewDuplexPipe()
+	clientTargetAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53))
+	c := direct.NewShadowsocksNoneTCPClient("test", NewTCPConnOpener(&zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl}, mode, "example.com"))
+	s := NewTCPServer(direct.NewShadowsocksNoneTCPServer(), mode)
+
+	var (
+		crw                  zerocopy.ReadWriter
+		srw                  zerocopy.ReadWriter
+		serverTargetAddr     conn.Addr
+		serverInitialPayload []byte
+		cerr, serr           error
+	)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		_, crw, cerr = c.Dial(context.Background(), clientTargetAddr, clientInitialPayload)
+		wg.Done()
+	}()
+
+	go func() {
+		srw, serverTargetAddr, _, _, serr = s.Accept(pr)
+		if serr == nil {
+			// The Shadowsocks "none" server does not return the initial payload from Accept.
+			serverInitialPayload = make([]byte, len(clientInitialPayload))
+			_, serr = io.ReadFull(zerocopy.NewCopyReadWriter(srw), serverInitialPayload)
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+
+	if !clientTargetAddr.Equals(serverTargetAddr) {
+		t.Errorf("Target address mismatch: c: %s, s: %s", clientTargetAddr, serverTargetAddr)
+	}
+
+	if !bytes.Equal(clientInitialPayload, serverInitialPayload) {
+		t.Error("Initial payload mismatch")
+	}
+
+	zerocopy.ReadWriterTestFunc(t, crw, srw)
+}
+
+func TestStreamObfs(t *testing.T) {
+	smallInitialPayload := make([]byte, 1024)
+	largeInitialPayload := make([]byte, 128*1024)
+
+	if _, err := rand.Read(smallInitialPayload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(largeInitialPayload); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{StreamModeNone, StreamModeHTTP, StreamModeTLS} {
+		t.Run(cmp.Or(mode, "none"), func(t *testing.T) {
+			t.Run("SmallInitialPayload", func(t *testing.T) {
+				testStreamObfs(t, mode, smallInitialPayload)
+			})
+			t.Run("LargeInitialPayload", func(t *testing.T) {
+				testStreamObfs(t, mode, largeInitialPayload)
+			})
+		})
+	}
+}
+
+func TestStreamObfsRejectPlainStream(t *testing.T) {
+	for _, mode := range []string{StreamModeHTTP, StreamModeTLS} {
+		t.Run(mode, func(t *testing.T) {
+			pl, pr := pipe.NewDuplexPipe()
+			defer pl.Close()
+			defer pr.Close()
+
+			// Not a WebSocket upgrade request, and not a TLS handshake record.
+			request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			go pl.Write(request)
+
+			s := NewTCPServer(direct.NewShadowsocksNoneTCPServer(), mode)
+			_, _, payload, _, err := s.Accept(pr)
+			if err == nil {
+				t.Fatal("Accept() succeeded with a plain stream")
+			}
+			if !bytes.HasPrefix(request, payload) || len(payload) == 0 {
+				t.Errorf("Accept() returned payload %q, expected the data read from %q", payload, request)
+			}
+		})
+	}
+}
+
+func TestTLSClientHelloSize(t *testing.T) {
+	const host = "example.com"
+
+	b := appendTLSClientHello(nil, host, nil)
+	if recordLen := int(binary.BigEndian.Uint16(b[3:])); recordLen != clientHelloOverhead+len(host) {
+		t.Errorf("ClientHello record length = %d, expected %d", recordLen, clientHelloOverhead+len(host))
+	}
+
+	b = appendTLSClientHello(nil, host, make([]byte, 2*maxRecordPayloadSize))
+	if recordLen := int(binary.BigEndian.Uint16(b[3:])); recordLen != maxRecordPayloadSize {
+		t.Errorf("ClientHello record length = %d, expected %d", recordLen, maxRecordPayloadSize)
+	}
+
+	sessionID, ticket, err := parseClientHello(b[recordHeaderSize : recordHeaderSize+maxRecordPayloadSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessionID) != 32 {
+		t.Errorf("len(sessionID) = %d, expected 32", len(sessionID))
+	}
+	if len(ticket) != maxRecordPayloadSize-clientHelloOverhead-len(host) {
+		t.Errorf("len(ticket) = %d, expected %d", len(ticket), maxRecordPayloadSize-clientHelloOverhead-len(host))
+	}
+}
@@ -0,0 +1,306 @@
+package obfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeChangeCipherSpec = 0x14
+	recordTypeHandshake        = 0x16
+	recordTypeApplicationData  = 0x17
+
+	handshakeTypeClientHello = 1
+	handshakeTypeServerHello = 2
+
+	extensionServerName    = 0x0000
+	extensionSessionTicket = 0x0023
+
+	recordHeaderSize = 5
+
+	// maxRecordPayloadSize is the maximum size of a TLS record's payload.
+	maxRecordPayloadSize = 16384
+
+	// clientHelloOverhead is the size of a ClientHello record's payload
+	// without the session ticket and the server name.
+	clientHelloOverhead = 212
+)
+
+var (
+	errNotClientHello   = errors.New("not a TLS ClientHello")
+	errNoSessionTicket  = errors.New("no session ticket in TLS ClientHello")
+	errNotServerHello   = errors.New("not a TLS ServerHello")
+	errBadTLSRecordType = errors.New("unexpected TLS record type")
+)
+
+// clientHelloCipherSuites is the list of cipher suites in the ClientHello, as sent by simple-obfs.
+var clientHelloCipherSuites = [...]byte{
+	0xc0, 0x2c, 0xc0, 0x30, 0x00, 0x9f, 0xcc, 0xa9, 0xcc, 0xa8, 0xcc, 0xaa, 0xc0, 0x2b, 0xc0, 0x2f,
+	0x00, 0x9e, 0xc0, 0x24, 0xc0, 0x28, 0x00, 0x6b, 0xc0, 0x23, 0xc0, 0x27, 0x00, 0x67, 0xc0, 0x0a,
+	0xc0, 0x14, 0x00, 0x39, 0xc0, 0x09, 0xc0, 0x13, 0x00, 0x33, 0x00, 0x9d, 0x00, 0x9c, 0x00, 0x3d,
+	0x00, 0x3c, 0x00, 0x35, 0x00, 0x2f, 0x00, 0xff,
+}
+
+// clientHelloExtensions are the ClientHello extensions after the session ticket and the server name:
+// ec_point_formats, supported_groups, signature_algorithms, encrypt_then_mac, and extended_master_secret.
+var clientHelloExtensions = [...]byte{
+	0x00, 0x0b, 0x00, 0x04, 0x03, 0x00, 0x01, 0x02,
+	0x00, 0x0a, 0x00, 0x0a, 0x00, 0x08, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x19, 0x00, 0x18,
+	0x00, 0x0d, 0x00, 0x20, 0x00, 0x1e, 0x06, 0x01, 0x06, 0x02, 0x06, 0x03, 0x05, 0x01, 0x05, 0x02,
+	0x05, 0x03, 0x04, 0x01, 0x04, 0x02, 0x04, 0x03, 0x03, 0x01, 0x03, 0x02, 0x03, 0x03, 0x02, 0x01,
+	0x02, 0x02, 0x02, 0x03,
+	0x00, 0x16, 0x00, 0x00,
+	0x00, 0x17, 0x00, 0x00,
+}
+
+// serverHelloExtensions are the ServerHello extensions:
+// renegotiation_info, extended_master_secret, and ec_point_formats.
+var serverHelloExtensions = [...]byte{
+	0xff, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x17, 0x00, 0x00,
+	0x00, 0x0b, 0x00, 0x02, 0x01, 0x00,
+}
+
+// helloRandom returns the random field of a ClientHello or ServerHello,
+// which starts with the current Unix time.
+func helloRandom() (random [32]byte) {
+	binary.BigEndian.PutUint32(random[:], uint32(time.Now().Unix()))
+	fillRandom(random[4:])
+	return
+}
+
+// appendTLSRecord appends a TLS record of type typ with payload to b.
+func appendTLSRecord(b []byte, typ byte, payload []byte) []byte {
+	b = append(b, typ, 0x03, 0x03)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// appendTLSApplicationData appends payload to b in application data records.
+func appendTLSApplicationData(b []byte, payload []byte) []byte {
+	for len(payload) > 0 {
+		n := min(len(payload), maxRecordPayloadSize)
+		b = appendTLSRecord(b, recordTypeApplicationData, payload[:n])
+		payload = payload[n:]
+	}
+	return b
+}
+
+// appendTLSClientHello appends a ClientHello record to b, with payload in the session ticket extension.
+// The part of payload that does not fit in the record follows in application data records.
+func appendTLSClientHello(b []byte, host string, payload []byte) []byte {
+	random := helloRandom()
+	var sessionID [32]byte
+	fillRandom(sessionID[:])
+	ticket := payload[:min(len(payload), maxRecordPayloadSize-clientHelloOverhead-len(host))]
+
+	bb := cryptobyte.NewBuilder(b)
+	bb.AddUint8(recordTypeHandshake)
+	bb.AddUint16(0x0301)
+	bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+		bb.AddUint8(handshakeTypeClientHello)
+		bb.AddUint24LengthPrefixed(func(bb *cryptobyte.Builder) {
+			bb.AddUint16(0x0303)
+			bb.AddBytes(random[:])
+			bb.AddUint8LengthPrefixed(func(bb *cryptobyte.Builder) {
+				bb.AddBytes(sessionID[:])
+			})
+			bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+				bb.AddBytes(clientHelloCipherSuites[:])
+			})
+			bb.AddUint8LengthPrefixed(func(bb *cryptobyte.Builder) {
+				bb.AddUint8(0) // null compression
+			})
+			bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+				bb.AddUint16(extensionSessionTicket)
+				bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+					bb.AddBytes(ticket)
+				})
+				bb.AddUint16(extensionServerName)
+				bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+					bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+						bb.AddUint8(0) // host_name
+						bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+							bb.AddBytes([]byte(host))
+						})
+					})
+				})
+				bb.AddBytes(clientHelloExtensions[:])
+			})
+		})
+	})
+
+	return appendTLSApplicationData(bb.BytesOrPanic(), payload[len(ticket):])
+}
+
+// appendTLSServerHello appends a ServerHello record, a ChangeCipherSpec record,
+// and payload in an encrypted handshake record to b.
+// The part of payload that does not fit in the record follows in application data records.
+func appendTLSServerHello(b []byte, sessionID []byte, payload []byte) []byte {
+	random := helloRandom()
+
+	bb := cryptobyte.NewBuilder(b)
+	bb.AddUint8(recordTypeHandshake)
+	bb.AddUint16(0x0303)
+	bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+		bb.AddUint8(handshakeTypeServerHello)
+		bb.AddUint24LengthPrefixed(func(bb *cryptobyte.Builder) {
+			bb.AddUint16(0x0303)
+			bb.AddBytes(random[:])
+			bb.AddUint8LengthPrefixed(func(bb *cryptobyte.Builder) {
+				bb.AddBytes(sessionID)
+			})
+			bb.AddUint16(0xcca8) // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+			bb.AddUint8(0)       // null compression
+			bb.AddUint16LengthPrefixed(func(bb *cryptobyte.Builder) {
+				bb.AddBytes(serverHelloExtensions[:])
+			})
+		})
+	})
+	b = bb.BytesOrPanic()
+
+	b = appendTLSRecord(b, recordTypeChangeCipherSpec, []byte{1})
+	n := min(len(payload), maxRecordPayloadSize)
+	b = appendTLSRecord(b, recordTypeHandshake, payload[:n])
+	return appendTLSApplicationData(b, payload[n:])
+}
+
+// parseClientHello returns the session ID and the session ticket of the ClientHello message in record.
+func parseClientHello(record []byte) (sessionID, ticket []byte, err error) {
+	s := cryptobyte.String(record)
+
+	var (
+		msgType uint8
+		body    cryptobyte.String
+	)
+	if !s.ReadUint8(&msgType) || msgType != handshakeTypeClientHello || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, nil, errNotClientHello
+	}
+
+	var id, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !body.Skip(2+32) ||
+		!body.ReadUint8LengthPrefixed(&id) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, nil, errNotClientHello
+	}
+
+	for !extensions.Empty() {
+		var (
+			extType uint16
+			extData cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, nil, errNotClientHello
+		}
+		if extType == extensionSessionTicket {
+			return id, extData, nil
+		}
+	}
+
+	return nil, nil, errNoSessionTicket
+}
+
+// acceptTLS reads the ClientHello from rawRW, and returns a stream that sends the ServerHello on the first write.
+func acceptTLS(rawRW zerocopy.DirectReadWriteCloser) (*tlsConn, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if n, err := io.ReadFull(rawRW, header); err != nil {
+		return nil, header[:n], err
+	}
+	if header[0] != recordTypeHandshake {
+		return nil, header, errNotClientHello
+	}
+
+	record := make([]byte, recordHeaderSize+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if n, err := io.ReadFull(rawRW, record[recordHeaderSize:]); err != nil {
+		return nil, record[:recordHeaderSize+n], err
+	}
+
+	sessionID, ticket, err := parseClientHello(record[recordHeaderSize:])
+	if err != nil {
+		return nil, record, err
+	}
+
+	return &tlsConn{
+		pendingReader: pendingReader{
+			DirectReadWriteCloser: rawRW,
+			pending:               ticket,
+		},
+		sessionID: sessionID,
+	}, nil, nil
+}
+
+// tlsConn carries a stream in TLS records after the ClientHello.
+//
+// Reads skip the ServerHello on the client, and ChangeCipherSpec records on both sides.
+// The first write on the server sends the ServerHello. Other writes send application data records.
+type tlsConn struct {
+	pendingReader
+	isClient        bool
+	serverHelloRead bool
+	serverHelloSent bool
+	sessionID       []byte
+	readRemaining   int
+	writeBuf        []byte
+}
+
+// Read implements the io.Reader Read method.
+func (c *tlsConn) Read(b []byte) (int, error) {
+	if n, ok := c.readPending(b); ok {
+		return n, nil
+	}
+
+	for c.readRemaining == 0 {
+		var header [recordHeaderSize]byte
+		if _, err := io.ReadFull(c.DirectReadWriteCloser, header[:]); err != nil {
+			return 0, err
+		}
+		length := int64(binary.BigEndian.Uint16(header[3:]))
+
+		switch {
+		case c.isClient && !c.serverHelloRead:
+			if header[0] != recordTypeHandshake {
+				return 0, errNotServerHello
+			}
+			if _, err := io.CopyN(io.Discard, c.DirectReadWriteCloser, length); err != nil {
+				return 0, err
+			}
+			c.serverHelloRead = true
+		case header[0] == recordTypeChangeCipherSpec:
+			if _, err := io.CopyN(io.Discard, c.DirectReadWriteCloser, length); err != nil {
+				return 0, err
+			}
+		case header[0] == recordTypeHandshake, header[0] == recordTypeApplicationData:
+			c.readRemaining = int(length)
+		default:
+			return 0, fmt.Errorf("%w: %d", errBadTLSRecordType, header[0])
+		}
+	}
+
+	n, err := c.DirectReadWriteCloser.Read(b[:min(len(b), c.readRemaining)])
+	c.readRemaining -= n
+	return n, err
+}
+
+// Write implements the io.Writer Write method.
+func (c *tlsConn) Write(b []byte) (int, error) {
+	if !c.isClient && !c.serverHelloSent {
+		c.writeBuf = appendTLSServerHello(c.writeBuf[:0], c.sessionID, b)
+		c.serverHelloSent = true
+	} else {
+		c.writeBuf = appendTLSApplicationData(c.writeBuf[:0], b)
+	}
+
+	if _, err := c.DirectReadWriteCloser.Write(c.writeBuf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,255 @@
+package obfs
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+func addFrontHeadroom(headroom zerocopy.Headroom, n int) zerocopy.Headroom {
+	headroom.Front += n
+	return headroom
+}
+
+// UDPClient wraps a UDP client and obfuscates its packets.
+//
+// UDPClient implements the zerocopy UDPClient interface.
+type UDPClient struct {
+	inner zerocopy.UDPClient
+	obfs  Obfuscator
+}
+
+// NewUDPClient returns a new UDP client that obfuscates packets of inner with o.
+//
+// The inner client's MTU should be reduced by o.Overhead(),
+// so that obfuscated packets still fit in the path MTU.
+func NewUDPClient(inner zerocopy.UDPClient, o Obfuscator) *UDPClient {
+	return &UDPClient{
+		inner: inner,
+		obfs:  o,
+	}
+}
+
+func (c *UDPClient) wrapInfo(info zerocopy.UDPClientInfo) zerocopy.UDPClientInfo {
+	info.PackerHeadroom = addFrontHeadroom(info.PackerHeadroom, c.obfs.Overhead())
+	return info
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *UDPClient) Info() zerocopy.UDPClientInfo {
+	return c.wrapInfo(c.inner.Info())
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *UDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	info, session, err := c.inner.NewSession(ctx)
+	info = c.wrapInfo(info)
+	if err != nil {
+		return info, session, err
+	}
+	session.MaxPacketSize += c.obfs.Overhead()
+	session.Packer = &ClientPacker{inner: session.Packer, obfs: c.obfs}
+	session.Unpacker = &ClientUnpacker{inner: session.Unpacker, obfs: c.obfs}
+	return info, session, nil
+}
+
+// ClientPacker obfuscates packets packed by the inner packer.
+//
+// ClientPacker implements the zerocopy ClientPacker interface.
+type ClientPacker struct {
+	inner zerocopy.ClientPacker
+	obfs  Obfuscator
+}
+
+// ClientPackerInfo implements the zerocopy.ClientPacker ClientPackerInfo method.
+func (p *ClientPacker) ClientPackerInfo() zerocopy.ClientPackerInfo {
+	info := p.inner.ClientPackerInfo()
+	info.Headroom = addFrontHeadroom(info.Headroom, p.obfs.Overhead())
+	return info
+}
+
+// PackInPlace implements the zerocopy.ClientPacker PackInPlace method.
+func (p *ClientPacker) PackInPlace(ctx context.Context, b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	destAddrPort, packetStart, packetLen, err = p.inner.PackInPlace(ctx, b, targetAddr, payloadStart, payloadLen)
+	if err != nil {
+		return
+	}
+	overhead := p.obfs.Overhead()
+	packetStart -= overhead
+	packetLen += overhead
+	err = p.obfs.Obfuscate(b[packetStart : packetStart+packetLen])
+	return
+}
+
+// ClientUnpacker deobfuscates packets before passing them to the inner unpacker.
+//
+// ClientUnpacker implements the zerocopy ClientUnpacker interface.
+type ClientUnpacker struct {
+	inner zerocopy.ClientUnpacker
+	obfs  Obfuscator
+}
+
+// ClientUnpackerInfo implements the zerocopy.ClientUnpacker ClientUnpackerInfo method.
+func (p *ClientUnpacker) ClientUnpackerInfo() zerocopy.ClientUnpackerInfo {
+	info := p.inner.ClientUnpackerInfo()
+	info.Headroom = addFrontHeadroom(info.Headroom, p.obfs.Overhead())
+	return info
+}
+
+// UnpackInPlace implements the zerocopy.ClientUnpacker UnpackInPlace method.
+func (p *ClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	if err = p.obfs.Deobfuscate(b[packetStart : packetStart+packetLen]); err != nil {
+		return
+	}
+	overhead := p.obfs.Overhead()
+	return p.inner.UnpackInPlace(b, packetSourceAddrPort, packetStart+overhead, packetLen-overhead)
+}
+
+// ServerPacker obfuscates packets packed by the inner packer.
+//
+// ServerPacker implements the zerocopy ServerPacker interface.
+type ServerPacker struct {
+	inner zerocopy.ServerPacker
+	obfs  Obfuscator
+}
+
+// ServerPackerInfo implements the zerocopy.ServerPacker ServerPackerInfo method.
+func (p *ServerPacker) ServerPackerInfo() zerocopy.ServerPackerInfo {
+	info := p.inner.ServerPackerInfo()
+	info.Headroom = addFrontHeadroom(info.Headroom, p.obfs.Overhead())
+	return info
+}
+
+// PackInPlace implements the zerocopy.ServerPacker PackInPlace method.
+func (p *ServerPacker) PackInPlace(b []byte, sourceAddrPort netip.AddrPort, payloadStart, payloadLen, maxPacketLen int) (packetStart, packetLen int, err error) {
+	overhead := p.obfs.Overhead()
+	packetStart, packetLen, err = p.inner.PackInPlace(b, sourceAddrPort, payloadStart, payloadLen, maxPacketLen-overhead)
+	if err != nil {
+		return
+	}
+	packetStart -= overhead
+	packetLen += overhead
+	err = p.obfs.Obfuscate(b[packetStart : packetStart+packetLen])
+	return
+}
+
+// ServerUnpacker deobfuscates packets before passing them to the inner unpacker.
+//
+// ServerUnpacker implements the zerocopy ServerUnpacker interface.
+type ServerUnpacker struct {
+	inner zerocopy.ServerUnpacker
+	obfs  Obfuscator
+
+	// deobfuscated is true when packets have already been deobfuscated
+	// by the session server's SessionInfo method.
+	deobfuscated bool
+}
+
+// ServerUnpackerInfo implements the zerocopy.ServerUnpacker ServerUnpackerInfo method.
+func (p *ServerUnpacker) ServerUnpackerInfo() zerocopy.ServerUnpackerInfo {
+	info := p.inner.ServerUnpackerInfo()
+	info.Headroom = addFrontHeadroom(info.Headroom, p.obfs.Overhead())
+	return info
+}
+
+// UnpackInPlace implements the zerocopy.ServerUnpacker UnpackInPlace method.
+func (p *ServerUnpacker) UnpackInPlace(b []byte, sourceAddrPort netip.AddrPort, packetStart, packetLen int) (targetAddr conn.Addr, payloadStart, payloadLen int, err error) {
+	overhead := p.obfs.Overhead()
+	if !p.deobfuscated {
+		if err = p.obfs.Deobfuscate(b[packetStart : packetStart+packetLen]); err != nil {
+			return
+		}
+	} else if packetLen < overhead {
+		err = zerocopy.ErrPacketTooSmall
+		return
+	}
+	return p.inner.UnpackInPlace(b, sourceAddrPort, packetStart+overhead, packetLen-overhead)
+}
+
+// NewPacker implements the zerocopy.ServerUnpacker NewPacker method.
+func (p *ServerUnpacker) NewPacker() (zerocopy.ServerPacker, error) {
+	packer, err := p.inner.NewPacker()
+	if err != nil {
+		return nil, err
+	}
+	return &ServerPacker{inner: packer, obfs: p.obfs}, nil
+}
+
+// UDPNATServer wraps a UDP NAT server and obfuscates its packets.
+//
+// UDPNATServer implements the zerocopy UDPNATServer interface.
+type UDPNATServer struct {
+	inner zerocopy.UDPNATServer
+	obfs  Obfuscator
+}
+
+// NewUDPNATServer returns a new UDP NAT server that obfuscates packets of inner with o.
+func NewUDPNATServer(inner zerocopy.UDPNATServer, o Obfuscator) *UDPNATServer {
+	return &UDPNATServer{
+		inner: inner,
+		obfs:  o,
+	}
+}
+
+// Info implements the zerocopy.UDPNATServer Info method.
+func (s *UDPNATServer) Info() zerocopy.UDPNATServerInfo {
+	info := s.inner.Info()
+	info.UnpackerHeadroom = addFrontHeadroom(info.UnpackerHeadroom, s.obfs.Overhead())
+	return info
+}
+
+// NewUnpacker implements the zerocopy.UDPNATServer NewUnpacker method.
+func (s *UDPNATServer) NewUnpacker() (zerocopy.ServerUnpacker, error) {
+	unpacker, err := s.inner.NewUnpacker()
+	if err != nil {
+		return nil, err
+	}
+	return &ServerUnpacker{inner: unpacker, obfs: s.obfs}, nil
+}
+
+// UDPSessionServer wraps a UDP session server and obfuscates its packets.
+//
+// Because the session ID is extracted before the unpacker is looked up,
+// SessionInfo deobfuscates each received packet in place,
+// and the returned unpackers expect deobfuscated packets.
+// The caller must call SessionInfo exactly once on each received packet.
+//
+// UDPSessionServer implements the zerocopy UDPSessionServer interface.
+type UDPSessionServer struct {
+	zerocopy.UDPSessionServer
+	obfs Obfuscator
+}
+
+// NewUDPSessionServer returns a new UDP session server that obfuscates packets of inner with o.
+func NewUDPSessionServer(inner zerocopy.UDPSessionServer, o Obfuscator) *UDPSessionServer {
+	return &UDPSessionServer{
+		UDPSessionServer: inner,
+		obfs:             o,
+	}
+}
+
+// Info implements the zerocopy.UDPSessionServer Info method.
+func (s *UDPSessionServer) Info() zerocopy.UDPSessionServerInfo {
+	info := s.UDPSessionServer.Info()
+	info.UnpackerHeadroom = addFrontHeadroom(info.UnpackerHeadroom, s.obfs.Overhead())
+	return info
+}
+
+// SessionInfo implements the zerocopy.UDPSessionServer SessionInfo method.
+func (s *UDPSessionServer) SessionInfo(b []byte) (csid uint64, err error) {
+	if err = s.obfs.Deobfuscate(b); err != nil {
+		return
+	}
+	return s.UDPSessionServer.SessionInfo(b[s.obfs.Overhead():])
+}
+
+// NewUnpacker implements the zerocopy.UDPSessionServer NewUnpacker method.
+func (s *UDPSessionServer) NewUnpacker(b []byte, csid uint64) (zerocopy.ServerUnpacker, string, error) {
+	unpacker, username, err := s.UDPSessionServer.NewUnpacker(b[s.obfs.Overhead():], csid)
+	if err != nil {
+		return nil, username, err
+	}
+	return &ServerUnpacker{inner: unpacker, obfs: s.obfs, deobfuscated: true}, username, nil
+}
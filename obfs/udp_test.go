@@ -0,0 +1,46 @@
+package obfs
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+func testPackUnpacker(t *testing.T, mode string) {
+	o, err := New(mode, []byte("test psk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverAddrPort := netip.AddrPortFrom(netip.IPv6Unspecified(), 1080)
+	clientPacker := &ClientPacker{inner: direct.NewShadowsocksNonePacketClientPacker(serverAddrPort, 1452), obfs: o}
+	clientUnpacker := &ClientUnpacker{inner: direct.NewShadowsocksNonePacketClientUnpacker(serverAddrPort), obfs: o}
+	serverPacker := &ServerPacker{inner: direct.ShadowsocksNonePacketServerPacker{}, obfs: o}
+	serverUnpacker, err := NewUDPNATServer(direct.ShadowsocksNoneUDPNATServer{}, o).NewUnpacker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zerocopy.ClientServerPackerUnpackerTestFunc(t, clientPacker, clientUnpacker, serverPacker, serverUnpacker)
+}
+
+func TestPackUnpackerXOR(t *testing.T) {
+	testPackUnpacker(t, ModeXOR)
+}
+
+func TestPackUnpackerSaltedXOR(t *testing.T) {
+	testPackUnpacker(t, ModeSaltedXOR)
+}
+
+func TestNew(t *testing.T) {
+	if o, err := New(ModeNone, nil); o != nil || err != nil {
+		t.Errorf("New(ModeNone) = %v, %v, expected nil, nil", o, err)
+	}
+	if _, err := New(ModeXOR, nil); err == nil {
+		t.Error("New(ModeXOR) with empty PSK succeeded")
+	}
+	if _, err := New("rot13", []byte("test psk")); err == nil {
+		t.Error("New with unknown mode succeeded")
+	}
+}
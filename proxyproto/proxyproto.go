@@ -0,0 +1,385 @@
+// Package proxyproto implements the HAProxy PROXY protocol, versions 1 and 2.
+//
+// Specification: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Version 1 header constants.
+const (
+	// V1MaxHeaderLen is the maximum length of a version 1 header, including the CRLF.
+	V1MaxHeaderLen = 107
+
+	// v1MinHeaderLen is the length of the shortest version 1 header, "PROXY UNKNOWN\r\n".
+	v1MinHeaderLen = 15
+
+	v1Prefix = "PROXY "
+
+	// v1MinAddrLen4 and v1MinAddrLen6 are the lengths of the shortest
+	// textual IPv4 and IPv6 addresses, "0.0.0.0" and "::".
+	v1MinAddrLen4 = 7
+	v1MinAddrLen6 = 2
+)
+
+// Version 2 header constants.
+const (
+	// V2SignatureLen is the length of the version 2 signature.
+	V2SignatureLen = 12
+
+	// V2FixedHeaderLen is the length of the version 2 header before the address block.
+	V2FixedHeaderLen = V2SignatureLen + 4
+
+	v2VersionCommandLocal = 0x20
+	v2VersionCommandProxy = 0x21
+
+	v2FamilyUnspec    = 0x00
+	v2FamilyTCPOverV4 = 0x11
+	v2FamilyTCPOverV6 = 0x21
+
+	v2AddrLenIPv4 = 4 + 4 + 2 + 2
+	v2AddrLenIPv6 = 16 + 16 + 2 + 2
+)
+
+// V2Signature is the fixed signature at the beginning of every version 2 header.
+var V2Signature = [V2SignatureLen]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+var (
+	ErrBadHeader          = errors.New("bad PROXY protocol header")
+	ErrUnsupportedVersion = errors.New("unsupported PROXY protocol version")
+)
+
+// Header is a parsed PROXY protocol header.
+//
+// If the header does not convey address information (v1 UNKNOWN, v2 LOCAL, or an unsupported address family),
+// both addresses are zero values.
+type Header struct {
+	SourceAddrPort netip.AddrPort
+	DestAddrPort   netip.AddrPort
+}
+
+// IsValid reports whether the header carries address information.
+func (h Header) IsValid() bool {
+	return h.SourceAddrPort.IsValid()
+}
+
+// ReadHeader reads a version 1 or version 2 header from r.
+//
+// ReadHeader never reads past the end of the header,
+// so r can be used for reading the proxied stream afterwards.
+func ReadHeader(r io.Reader) (Header, error) {
+	b := make([]byte, V2FixedHeaderLen+v2AddrLenIPv6)
+
+	// The shortest v1 header is one byte shorter than the v2 fixed header,
+	// so it is safe to read that many bytes before telling the versions apart.
+	if _, err := io.ReadFull(r, b[:v1MinHeaderLen]); err != nil {
+		return Header{}, err
+	}
+
+	if string(b[:len(v1Prefix)]) == v1Prefix {
+		return readV1Header(r, b[len(v1Prefix):v1MinHeaderLen])
+	}
+
+	if _, err := io.ReadFull(r, b[v1MinHeaderLen:V2FixedHeaderLen]); err != nil {
+		return Header{}, err
+	}
+
+	if [V2SignatureLen]byte(b) != V2Signature {
+		return Header{}, fmt.Errorf("%w: bad signature", ErrBadHeader)
+	}
+
+	return readV2Header(r, b)
+}
+
+// readV1Header reads the rest of a version 1 header.
+// initial is the part of the header already read after the prefix.
+//
+// To avoid reading past the end of the header without reading one byte at a time,
+// each read is limited to the length of the shortest valid remainder of the header.
+func readV1Header(r io.Reader, initial []byte) (Header, error) {
+	b := make([]byte, 0, V1MaxHeaderLen-len(v1Prefix))
+	b = append(b, initial...)
+
+	for {
+		if i := bytes.IndexByte(b, '\n'); i != -1 {
+			if i != len(b)-1 {
+				return Header{}, fmt.Errorf("%w: unexpected LF in v1 header", ErrBadHeader)
+			}
+			b = b[:i]
+			break
+		}
+
+		free := cap(b) - len(b)
+		if free == 0 {
+			return Header{}, fmt.Errorf("%w: v1 header too long", ErrBadHeader)
+		}
+
+		n, err := r.Read(b[len(b) : len(b)+min(v1MinRemainingLen(b), free)])
+		b = b[:len(b)+n]
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Header{}, err
+		}
+	}
+
+	line, ok := bytes.CutSuffix(b, []byte{'\r'})
+	if !ok {
+		return Header{}, fmt.Errorf("%w: v1 header missing CR", ErrBadHeader)
+	}
+
+	return ParseV1Line(string(line))
+}
+
+// v1MinRemainingLen returns the length of the shortest valid remainder of
+// a version 1 header, given the incomplete header content b after the prefix.
+//
+// The returned length never overestimates, but may underestimate for malformed headers.
+func v1MinRemainingLen(b []byte) int {
+	if b[len(b)-1] == '\r' {
+		return 1
+	}
+
+	var addrLen int
+	switch {
+	case bytes.HasPrefix(b, []byte("TCP4 ")):
+		addrLen = v1MinAddrLen4
+	case bytes.HasPrefix(b, []byte("TCP6 ")):
+		addrLen = v1MinAddrLen6
+	default:
+		// UNKNOWN can be followed by anything. Just wait for the CRLF.
+		return 2
+	}
+
+	// Protocol, source address, destination address, source port, destination port.
+	fieldMinLens := [...]int{4, addrLen, addrLen, 1, 1}
+
+	field := bytes.Count(b, []byte{' '})
+	if field >= len(fieldMinLens) {
+		return 2
+	}
+
+	fieldLen := len(b) - bytes.LastIndexByte(b, ' ') - 1
+	n := max(fieldMinLens[field]-fieldLen, 0)
+	for _, l := range fieldMinLens[field+1:] {
+		n += 1 + l
+	}
+	return n + 2
+}
+
+// ParseV1Line parses the content of a version 1 header line,
+// excluding the "PROXY " prefix and the trailing CRLF.
+func ParseV1Line(line string) (Header, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Header{}, fmt.Errorf("%w: empty v1 header", ErrBadHeader)
+	}
+
+	switch fields[0] {
+	case "UNKNOWN":
+		return Header{}, nil
+	case "TCP4", "TCP6":
+	default:
+		return Header{}, fmt.Errorf("%w: unknown v1 protocol %q", ErrBadHeader, fields[0])
+	}
+
+	if len(fields) != 5 {
+		return Header{}, fmt.Errorf("%w: expected 5 v1 fields, got %d", ErrBadHeader, len(fields))
+	}
+
+	srcAddr, err := netip.ParseAddr(fields[1])
+	if err != nil {
+		return Header{}, fmt.Errorf("%w: bad v1 source address: %w", ErrBadHeader, err)
+	}
+
+	dstAddr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return Header{}, fmt.Errorf("%w: bad v1 destination address: %w", ErrBadHeader, err)
+	}
+
+	if srcAddr.Is4() != (fields[0] == "TCP4") || dstAddr.Is4() != srcAddr.Is4() {
+		return Header{}, fmt.Errorf("%w: v1 address family mismatch", ErrBadHeader)
+	}
+
+	srcPort, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return Header{}, fmt.Errorf("%w: bad v1 source port: %w", ErrBadHeader, err)
+	}
+
+	dstPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return Header{}, fmt.Errorf("%w: bad v1 destination port: %w", ErrBadHeader, err)
+	}
+
+	return Header{
+		SourceAddrPort: netip.AddrPortFrom(srcAddr, uint16(srcPort)),
+		DestAddrPort:   netip.AddrPortFrom(dstAddr, uint16(dstPort)),
+	}, nil
+}
+
+// readV2Header reads the rest of a version 2 header.
+// b must contain the fixed header and have enough capacity for an IPv6 address block.
+func readV2Header(r io.Reader, b []byte) (Header, error) {
+	versionCommand := b[12]
+	family := b[13]
+	length := int(binary.BigEndian.Uint16(b[14:]))
+
+	if versionCommand>>4 != 2 {
+		return Header{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, versionCommand>>4)
+	}
+
+	switch versionCommand {
+	case v2VersionCommandLocal:
+		// The connection was established by the proxy itself. Discard the address block.
+		if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+			return Header{}, err
+		}
+		return Header{}, nil
+	case v2VersionCommandProxy:
+	default:
+		return Header{}, fmt.Errorf("%w: unknown v2 command %#x", ErrBadHeader, versionCommand&0x0F)
+	}
+
+	var addrLen int
+	switch family {
+	case v2FamilyTCPOverV4:
+		addrLen = v2AddrLenIPv4
+	case v2FamilyTCPOverV6:
+		addrLen = v2AddrLenIPv6
+	}
+
+	if length < addrLen {
+		return Header{}, fmt.Errorf("%w: v2 address block length %d too short for family %#x", ErrBadHeader, length, family)
+	}
+
+	addrBlock := b[V2FixedHeaderLen : V2FixedHeaderLen+addrLen]
+	if _, err := io.ReadFull(r, addrBlock); err != nil {
+		return Header{}, err
+	}
+
+	// Discard any TLVs, and address blocks of unsupported families.
+	if rest := int64(length - addrLen); rest > 0 {
+		if _, err := io.CopyN(io.Discard, r, rest); err != nil {
+			return Header{}, err
+		}
+	}
+
+	switch family {
+	case v2FamilyTCPOverV4:
+		return Header{
+			SourceAddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrBlock)), binary.BigEndian.Uint16(addrBlock[8:])),
+			DestAddrPort:   netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrBlock[4:])), binary.BigEndian.Uint16(addrBlock[10:])),
+		}, nil
+	case v2FamilyTCPOverV6:
+		return Header{
+			SourceAddrPort: netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrBlock)), binary.BigEndian.Uint16(addrBlock[32:])),
+			DestAddrPort:   netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrBlock[16:])), binary.BigEndian.Uint16(addrBlock[34:])),
+		}, nil
+	default:
+		return Header{}, nil
+	}
+}
+
+// AppendV1Header appends a version 1 header for the given addresses to b.
+//
+// If h is not valid, or the addresses are of different families, an UNKNOWN header is appended.
+func AppendV1Header(b []byte, h Header) []byte {
+	src := h.SourceAddrPort.Addr().Unmap()
+	dst := h.DestAddrPort.Addr().Unmap()
+
+	b = append(b, v1Prefix...)
+
+	switch {
+	case !h.IsValid() || src.Is4() != dst.Is4():
+		return append(b, "UNKNOWN\r\n"...)
+	case src.Is4():
+		b = append(b, "TCP4 "...)
+	default:
+		b = append(b, "TCP6 "...)
+	}
+
+	b = src.AppendTo(b)
+	b = append(b, ' ')
+	b = dst.AppendTo(b)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(h.SourceAddrPort.Port()), 10)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(h.DestAddrPort.Port()), 10)
+	return append(b, "\r\n"...)
+}
+
+// AppendV2Header appends a version 2 header for the given addresses to b.
+//
+// If h is not valid, a LOCAL header is appended.
+// If the addresses are of different families, IPv4 addresses are mapped to IPv6.
+func AppendV2Header(b []byte, h Header) []byte {
+	b = append(b, V2Signature[:]...)
+
+	if !h.IsValid() {
+		return append(b, v2VersionCommandLocal, v2FamilyUnspec, 0, 0)
+	}
+
+	src := h.SourceAddrPort.Addr().Unmap()
+	dst := h.DestAddrPort.Addr().Unmap()
+
+	if src.Is4() && dst.Is4() {
+		b = append(b, v2VersionCommandProxy, v2FamilyTCPOverV4, 0, v2AddrLenIPv4)
+		b = append(b, src.AsSlice()...)
+		b = append(b, dst.AsSlice()...)
+	} else {
+		b = append(b, v2VersionCommandProxy, v2FamilyTCPOverV6, 0, v2AddrLenIPv6)
+		src16, dst16 := src.As16(), dst.As16()
+		b = append(b, src16[:]...)
+		b = append(b, dst16[:]...)
+	}
+
+	b = binary.BigEndian.AppendUint16(b, h.SourceAddrPort.Port())
+	return binary.BigEndian.AppendUint16(b, h.DestAddrPort.Port())
+}
+
+// AppendHeader appends a header of the given version to b.
+func AppendHeader(b []byte, version int, h Header) []byte {
+	switch version {
+	case 1:
+		return AppendV1Header(b, h)
+	case 2:
+		return AppendV2Header(b, h)
+	default:
+		panic("unsupported PROXY protocol version: " + strconv.Itoa(version))
+	}
+}
+
+// CheckVersion returns an error if version is not a supported version for emitting headers.
+// Version 0 means disabled and is always accepted.
+func CheckVersion(version int) error {
+	switch version {
+	case 0, 1, 2:
+		return nil
+	default:
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+}
+
+type headerContextKey struct{}
+
+// NewContext returns a new context that carries the header,
+// so that outbounds can emit it when establishing connections.
+func NewContext(ctx context.Context, h Header) context.Context {
+	return context.WithValue(ctx, headerContextKey{}, h)
+}
+
+// FromContext returns the header carried by ctx, if any.
+func FromContext(ctx context.Context) (Header, bool) {
+	h, ok := ctx.Value(headerContextKey{}).(Header)
+	return h, ok
+}
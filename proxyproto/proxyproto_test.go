@@ -0,0 +1,153 @@
+package proxyproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+)
+
+var (
+	header4 = Header{
+		SourceAddrPort: netip.MustParseAddrPort("192.0.2.1:56324"),
+		DestAddrPort:   netip.MustParseAddrPort("198.51.100.1:443"),
+	}
+	header6 = Header{
+		SourceAddrPort: netip.MustParseAddrPort("[2001:db8::1]:56324"),
+		DestAddrPort:   netip.MustParseAddrPort("[2001:db8::2]:443"),
+	}
+	headerMixed = Header{
+		SourceAddrPort: netip.MustParseAddrPort("192.0.2.1:56324"),
+		DestAddrPort:   netip.MustParseAddrPort("[2001:db8::2]:443"),
+	}
+)
+
+const trailingPayload = "GET / HTTP/1.1\r\n"
+
+func testRoundTrip(t *testing.T, version int, h, expected Header) {
+	t.Helper()
+
+	b := AppendHeader(nil, version, h)
+	b = append(b, trailingPayload...)
+	r := bytes.NewReader(b)
+
+	parsed, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if parsed != expected {
+		t.Errorf("parsed = %+v, expected %+v", parsed, expected)
+	}
+
+	rest := make([]byte, r.Len())
+	_, _ = r.Read(rest)
+	if string(rest) != trailingPayload {
+		t.Errorf("rest = %q, expected %q", rest, trailingPayload)
+	}
+}
+
+func TestV1RoundTrip(t *testing.T) {
+	testRoundTrip(t, 1, header4, header4)
+	testRoundTrip(t, 1, header6, header6)
+	testRoundTrip(t, 1, headerMixed, Header{})
+	testRoundTrip(t, 1, Header{}, Header{})
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	testRoundTrip(t, 2, header4, header4)
+	testRoundTrip(t, 2, header6, header6)
+	testRoundTrip(t, 2, headerMixed, Header{
+		SourceAddrPort: netip.AddrPortFrom(netip.AddrFrom16(headerMixed.SourceAddrPort.Addr().As16()), headerMixed.SourceAddrPort.Port()),
+		DestAddrPort:   headerMixed.DestAddrPort,
+	})
+	testRoundTrip(t, 2, Header{}, Header{})
+}
+
+// headerReader fails the test when a read goes past the end of the header,
+// and limits each read to maxRead bytes if positive.
+type headerReader struct {
+	t         *testing.T
+	b         []byte
+	headerLen int
+	maxRead   int
+	off       int
+	reads     int
+}
+
+func (r *headerReader) Read(p []byte) (int, error) {
+	if r.off+len(p) > r.headerLen {
+		r.t.Errorf("read of %d bytes at offset %d goes past the end of the %d-byte header", len(p), r.off, r.headerLen)
+	}
+	if r.maxRead > 0 && len(p) > r.maxRead {
+		p = p[:r.maxRead]
+	}
+	if r.off == len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.off:])
+	r.off += n
+	r.reads++
+	return n, nil
+}
+
+func TestV1ReadBounded(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		h        Header
+		maxRead  int
+		maxReads int
+	}{
+		{"TCP4", header4, 0, 6},
+		{"TCP6", header6, 0, 12},
+		{"UNKNOWN", Header{}, 0, 1},
+		{"TCP4ShortReads", header4, 1, V1MaxHeaderLen},
+		{"TCP6ShortReads", header6, 3, V1MaxHeaderLen},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b := AppendV1Header(nil, c.h)
+			r := headerReader{
+				t:         t,
+				b:         append(b, trailingPayload...),
+				headerLen: len(b),
+				maxRead:   c.maxRead,
+			}
+
+			parsed, err := ReadHeader(&r)
+			if err != nil {
+				t.Fatalf("ReadHeader failed: %v", err)
+			}
+			if parsed != c.h {
+				t.Errorf("parsed = %+v, expected %+v", parsed, c.h)
+			}
+			if r.off != r.headerLen {
+				t.Errorf("read %d bytes, expected %d", r.off, r.headerLen)
+			}
+			if r.reads > c.maxReads {
+				t.Errorf("reads = %d, expected at most %d", r.reads, c.maxReads)
+			}
+		})
+	}
+}
+
+func TestV1Format(t *testing.T) {
+	const expected = "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+	if b := AppendV1Header(nil, header4); string(b) != expected {
+		t.Errorf("AppendV1Header = %q, expected %q", b, expected)
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	for _, c := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		"PROXY " + string(bytes.Repeat([]byte{' '}, V1MaxHeaderLen)) + "\r\n",
+	} {
+		if _, err := ReadHeader(bytes.NewReader([]byte(c))); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("ReadHeader(%q) error = %v, expected %v", c, err, ErrBadHeader)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+)
+
+// RampUpConfig is the configuration of a [RampUp].
+type RampUpConfig struct {
+	// Duration is how long the ramp-up lasts after the server starts.
+	// New connections and sessions are no longer paced afterwards.
+	Duration jsonhelper.Duration `json:"duration"`
+
+	// InitialRate is the number of new connections and sessions allowed per second when the server starts.
+	InitialRate uint64 `json:"initialRate"`
+
+	// FinalRate is the number of new connections and sessions allowed per second at the end of the ramp-up.
+	// The rate increases linearly from InitialRate to FinalRate.
+	FinalRate uint64 `json:"finalRate"`
+}
+
+// RampUp returns a new ramp-up from the config, starting now.
+func (c *RampUpConfig) RampUp() (*RampUp, error) {
+	if c.Duration <= 0 {
+		return nil, errors.New("ramp-up duration must be positive")
+	}
+	if c.InitialRate == 0 {
+		return nil, errors.New("ramp-up initial rate must be positive")
+	}
+	if c.FinalRate < c.InitialRate {
+		return nil, errors.New("ramp-up final rate must not be less than initial rate")
+	}
+	return newRampUp(c.Duration.Value(), float64(c.InitialRate), float64(c.FinalRate), time.Now()), nil
+}
+
+// RampUp paces new connections and sessions at a rate that increases linearly over time,
+// like slow start. It stops pacing when the ramp-up is over.
+//
+// A nil *RampUp imposes no limit. RampUp is safe for concurrent use.
+type RampUp struct {
+	start       time.Time
+	duration    time.Duration
+	initialRate float64
+	finalRate   float64
+	over        atomic.Bool
+	mu          sync.Mutex
+	tokens      float64
+	last        time.Time
+}
+
+func newRampUp(duration time.Duration, initialRate, finalRate float64, start time.Time) *RampUp {
+	return &RampUp{
+		start:       start,
+		duration:    duration,
+		initialRate: initialRate,
+		finalRate:   finalRate,
+		tokens:      initialRate,
+		last:        start,
+	}
+}
+
+// rateAt returns the allowed rate at the given time since the start.
+func (r *RampUp) rateAt(elapsed time.Duration) float64 {
+	return r.initialRate + (r.finalRate-r.initialRate)*elapsed.Seconds()/r.duration.Seconds()
+}
+
+// refill adds tokens for the time elapsed since the last refill, and returns the current rate.
+// The bucket holds up to one second worth of tokens at the current rate.
+// It must be called with r.mu held.
+func (r *RampUp) refill(elapsed time.Duration) float64 {
+	rate := r.rateAt(elapsed)
+	if lastElapsed := r.last.Sub(r.start); elapsed > lastElapsed {
+		// The rate is linear in time, so the average rate over the interval
+		// is the average of the rates at both ends.
+		lastRate := r.rateAt(lastElapsed)
+		r.tokens = min(rate, r.tokens+(lastRate+rate)/2*(elapsed-lastElapsed).Seconds())
+		r.last = r.start.Add(elapsed)
+	}
+	return rate
+}
+
+// elapsed returns the time since the start, or false if the ramp-up is over.
+func (r *RampUp) elapsed(now time.Time) (time.Duration, bool) {
+	if r == nil || r.over.Load() {
+		return 0, false
+	}
+	elapsed := now.Sub(r.start)
+	if elapsed >= r.duration {
+		r.over.Store(true)
+		return 0, false
+	}
+	return elapsed, true
+}
+
+// Allow returns whether a new connection or session is allowed now, and takes a token if it is.
+func (r *RampUp) Allow() bool {
+	return r.allowAt(time.Now())
+}
+
+func (r *RampUp) allowAt(now time.Time) bool {
+	elapsed, ok := r.elapsed(now)
+	if !ok {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refill(elapsed)
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Wait takes a token, blocking until it is available or the ramp-up is over.
+// It returns whether it had to block.
+func (r *RampUp) Wait() bool {
+	delay := r.reserveAt(time.Now())
+	if delay <= 0 {
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// reserveAt takes a token, going into debt if necessary, and returns how long to wait for it.
+func (r *RampUp) reserveAt(now time.Time) time.Duration {
+	elapsed, ok := r.elapsed(now)
+	if !ok {
+		return 0
+	}
+
+	r.mu.Lock()
+	rate := r.refill(elapsed)
+	r.tokens--
+	tokens := r.tokens
+	r.mu.Unlock()
+
+	if tokens >= 0 {
+		return 0
+	}
+	return min(time.Duration(-tokens/rate*float64(time.Second)), r.duration-elapsed)
+}
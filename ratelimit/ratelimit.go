@@ -0,0 +1,437 @@
+// Package ratelimit implements hierarchical token bucket bandwidth limits for each server,
+// user or client IP address, and connection, and the pacing of new connections and sessions
+// after a server starts.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes.
+//
+// Bucket is safe for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a new full bucket that refills at rate bytes per second, up to burst bytes.
+func NewBucket(rate, burst uint64) *Bucket {
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds tokens for the time elapsed since the last refill.
+// It must be called with b.mu held.
+func (b *Bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// Wait takes n tokens from the bucket, blocking until the tokens are available or ctx is done.
+// It returns whether it had to block, and ctx.Err() if ctx is done before the tokens are available.
+//
+// n may exceed the burst size. The bucket goes into debt, and later callers wait
+// for the debt to be paid off, so the average rate is maintained.
+// Tokens taken by a canceled wait are not given back.
+func (b *Bucket) Wait(ctx context.Context, n int) (bool, error) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	tokens := b.tokens
+	rate := b.rate
+	b.mu.Unlock()
+
+	if tokens >= 0 {
+		return false, nil
+	}
+
+	timer := time.NewTimer(time.Duration(-tokens / rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// Allow takes n tokens from the bucket if they are available, and returns whether it did.
+func (b *Bucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// take takes n tokens from the bucket without waiting, going into debt if necessary.
+func (b *Bucket) take(n int) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	b.mu.Unlock()
+}
+
+// put returns n tokens to the bucket.
+func (b *Bucket) put(n int) {
+	b.mu.Lock()
+	b.tokens = min(b.burst, b.tokens+float64(n))
+	b.mu.Unlock()
+}
+
+// setRate changes the refill rate and burst size of the bucket.
+func (b *Bucket) setRate(rate, burst float64) {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = burst
+	b.tokens = min(burst, b.tokens)
+	b.mu.Unlock()
+}
+
+// Limit is a pair of bandwidth limits.
+type Limit struct {
+	// UplinkBytesPerSecond is the rate limit of traffic from the client.
+	// 0 means unlimited.
+	UplinkBytesPerSecond uint64 `json:"uplinkBytesPerSecond"`
+
+	// DownlinkBytesPerSecond is the rate limit of traffic to the client.
+	// 0 means unlimited.
+	DownlinkBytesPerSecond uint64 `json:"downlinkBytesPerSecond"`
+
+	// BurstBytes is the maximum number of bytes that can be sent in a burst in each direction.
+	//
+	// The default value is one second worth of traffic at the rate limit.
+	BurstBytes uint64 `json:"burstBytes"`
+}
+
+// IsUnlimited returns whether the limit imposes no limit.
+func (l Limit) IsUnlimited() bool {
+	return l.UplinkBytesPerSecond == 0 && l.DownlinkBytesPerSecond == 0
+}
+
+func (l Limit) newBucket(rate uint64) *Bucket {
+	if rate == 0 {
+		return nil
+	}
+	burst := l.BurstBytes
+	if burst == 0 {
+		burst = rate
+	}
+	return NewBucket(rate, burst)
+}
+
+// Config is the configuration of a [Limiter].
+//
+// Limits form a hierarchy: traffic of each connection is limited by Conn, then by the limit
+// of its user or client IP address, then by Server. When Server limits a direction, each active user
+// or client IP address is guaranteed an equal share of the server's bandwidth, and may borrow
+// the bandwidth that other users leave unused, up to its own limit.
+type Config struct {
+	// Key selects how traffic is grouped for rate limiting.
+	//
+	// - "username": Traffic of each user is limited together. Traffic without a username,
+	//   such as traffic from servers without user management, is grouped by client IP address.
+	// - "ip": Traffic from each client IP address is limited together.
+	//
+	// The default value is "username".
+	Key string `json:"key"`
+
+	// Limit is the default limit.
+	Limit
+
+	// Users maps usernames to their limits, which override the default limit.
+	//
+	// Only applicable to "username".
+	Users map[string]Limit `json:"users"`
+
+	// Server is the limit of all traffic of the server.
+	Server Limit `json:"server"`
+
+	// Conn is the limit of each TCP connection and UDP session.
+	Conn Limit `json:"conn"`
+}
+
+// Limiter returns a new limiter from the config.
+func (c *Config) Limiter() (*Limiter, error) {
+	var byIP bool
+
+	switch c.Key {
+	case "", "username":
+	case "ip":
+		if len(c.Users) > 0 {
+			return nil, errors.New("per-user limits require key \"username\"")
+		}
+		byIP = true
+	default:
+		return nil, fmt.Errorf("unknown rate limit key: %q", c.Key)
+	}
+
+	return &Limiter{
+		byIP:           byIP,
+		limit:          c.Limit,
+		users:          c.Users,
+		connLimit:      c.Conn,
+		serverUplink:   c.Server.newBucket(c.Server.UplinkBytesPerSecond),
+		serverDownlink: c.Server.newBucket(c.Server.DownlinkBytesPerSecond),
+		entries:        make(map[string]*entry),
+	}, nil
+}
+
+// Limiter hands out shared token buckets for each user or client IP address,
+// which draw from the shared token buckets of the server.
+//
+// A nil *Limiter imposes no limit. Limiter is safe for concurrent use.
+type Limiter struct {
+	byIP           bool
+	limit          Limit
+	users          map[string]Limit
+	connLimit      Limit
+	serverUplink   *Bucket
+	serverDownlink *Bucket
+	mu             sync.Mutex
+	entries        map[string]*entry
+}
+
+type entry struct {
+	uplink   *Bucket
+	downlink *Bucket
+
+	// assuredUplink and assuredDownlink hold the guaranteed share of the server's bandwidth.
+	// They are nil if the server does not limit the direction.
+	assuredUplink   *Bucket
+	assuredDownlink *Bucket
+
+	refs int
+}
+
+// Acquire returns a handle to the buckets of a new connection of the user, or the client IP address.
+// It returns nil if the traffic is not limited.
+//
+// The caller must call [Handle.Release] when done with the handle.
+func (l *Limiter) Acquire(username string, clientAddr netip.Addr) *Handle {
+	if l == nil {
+		return nil
+	}
+
+	limit := l.limit
+	var key string
+	if l.byIP || username == "" {
+		key = "ip:" + clientAddr.Unmap().String()
+	} else {
+		key = "user:" + username
+		if userLimit, ok := l.users[username]; ok {
+			limit = userLimit
+		}
+	}
+
+	h := Handle{
+		limiter: l,
+		uplink: path{
+			conn:   l.connLimit.newBucket(l.connLimit.UplinkBytesPerSecond),
+			server: l.serverUplink,
+		},
+		downlink: path{
+			conn:   l.connLimit.newBucket(l.connLimit.DownlinkBytesPerSecond),
+			server: l.serverDownlink,
+		},
+	}
+
+	if limit.IsUnlimited() && l.serverUplink == nil && l.serverDownlink == nil {
+		if h.uplink.conn == nil && h.downlink.conn == nil {
+			return nil
+		}
+		return &h
+	}
+
+	l.mu.Lock()
+	e := l.entries[key]
+	if e == nil {
+		e = &entry{
+			uplink:   limit.newBucket(limit.UplinkBytesPerSecond),
+			downlink: limit.newBucket(limit.DownlinkBytesPerSecond),
+		}
+		if l.serverUplink != nil {
+			e.assuredUplink = NewBucket(0, 0)
+		}
+		if l.serverDownlink != nil {
+			e.assuredDownlink = NewBucket(0, 0)
+		}
+		l.entries[key] = e
+		l.rebalance()
+	}
+	e.refs++
+	l.mu.Unlock()
+
+	h.key = key
+	h.entry = e
+	h.uplink.user = e.uplink
+	h.uplink.assured = e.assuredUplink
+	h.downlink.user = e.downlink
+	h.downlink.assured = e.assuredDownlink
+	return &h
+}
+
+// rebalance splits the server's bandwidth equally among all entries.
+// It must be called with l.mu held.
+func (l *Limiter) rebalance() {
+	n := float64(len(l.entries))
+	if n == 0 {
+		return
+	}
+	for _, e := range l.entries {
+		if e.assuredUplink != nil {
+			e.assuredUplink.setRate(l.serverUplink.rate/n, l.serverUplink.burst/n)
+		}
+		if e.assuredDownlink != nil {
+			e.assuredDownlink.setRate(l.serverDownlink.rate/n, l.serverDownlink.burst/n)
+		}
+	}
+}
+
+// Handle provides access to the buckets of a connection.
+//
+// A nil *Handle imposes no limit.
+type Handle struct {
+	limiter  *Limiter
+	key      string
+	entry    *entry
+	uplink   path
+	downlink path
+}
+
+// Release releases the handle. The buckets of the user or client IP address are discarded
+// when all handles are released.
+func (h *Handle) Release() {
+	if h == nil || h.entry == nil {
+		return
+	}
+	l := h.limiter
+	l.mu.Lock()
+	h.entry.refs--
+	if h.entry.refs == 0 {
+		delete(l.entries, h.key)
+		l.rebalance()
+	}
+	l.mu.Unlock()
+}
+
+// WaitUplink waits for n bytes of uplink traffic to be allowed, and returns whether it had to wait.
+// It returns ctx.Err() if ctx is done before the traffic is allowed.
+func (h *Handle) WaitUplink(ctx context.Context, n int) (bool, error) {
+	if h == nil {
+		return false, nil
+	}
+	return h.uplink.wait(ctx, n)
+}
+
+// WaitDownlink waits for n bytes of downlink traffic to be allowed, and returns whether it had to wait.
+// It returns ctx.Err() if ctx is done before the traffic is allowed.
+func (h *Handle) WaitDownlink(ctx context.Context, n int) (bool, error) {
+	if h == nil {
+		return false, nil
+	}
+	return h.downlink.wait(ctx, n)
+}
+
+// AllowUplink returns whether n bytes of uplink traffic are allowed now.
+func (h *Handle) AllowUplink(n int) bool {
+	if h == nil {
+		return true
+	}
+	return h.uplink.allow(n)
+}
+
+// AllowDownlink returns whether n bytes of downlink traffic are allowed now.
+func (h *Handle) AllowDownlink(n int) bool {
+	if h == nil {
+		return true
+	}
+	return h.downlink.allow(n)
+}
+
+// path is the chain of buckets traffic of a connection in one direction draws from.
+// Any of the buckets may be nil. assured is nil if and only if server is nil.
+type path struct {
+	conn    *Bucket
+	user    *Bucket
+	assured *Bucket
+	server  *Bucket
+}
+
+// wait takes n tokens from all buckets on the path, blocking until they are available or ctx is done.
+// It returns whether it had to block, and ctx.Err() if ctx is done first.
+//
+// Traffic within the guaranteed share takes server tokens without waiting.
+// Traffic beyond it borrows from the server bucket, and waits when the server is at its limit.
+func (p *path) wait(ctx context.Context, n int) (waited bool, err error) {
+	for _, b := range [...]*Bucket{p.conn, p.user} {
+		if b == nil {
+			continue
+		}
+		w, err := b.Wait(ctx, n)
+		waited = waited || w
+		if err != nil {
+			return waited, err
+		}
+	}
+	if p.server != nil {
+		if p.assured.Allow(n) {
+			p.server.take(n)
+		} else {
+			w, err := p.server.Wait(ctx, n)
+			waited = waited || w
+			if err != nil {
+				return waited, err
+			}
+		}
+	}
+	return waited, nil
+}
+
+// allow takes n tokens from all buckets on the path if they are all available, and returns whether it did.
+func (p *path) allow(n int) bool {
+	if p.conn != nil && !p.conn.Allow(n) {
+		return false
+	}
+	if p.user != nil && !p.user.Allow(n) {
+		if p.conn != nil {
+			p.conn.put(n)
+		}
+		return false
+	}
+	if p.server != nil {
+		switch {
+		case p.assured.Allow(n):
+			p.server.take(n)
+		case !p.server.Allow(n):
+			if p.conn != nil {
+				p.conn.put(n)
+			}
+			if p.user != nil {
+				p.user.put(n)
+			}
+			return false
+		}
+	}
+	return true
+}
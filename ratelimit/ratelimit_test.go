@@ -0,0 +1,391 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(1000, 1500)
+	if !b.Allow(1000) {
+		t.Error("b.Allow(1000) = false, want true")
+	}
+	if !b.Allow(500) {
+		t.Error("b.Allow(500) = false, want true")
+	}
+	if b.Allow(500) {
+		t.Error("b.Allow(500) on empty bucket = true, want false")
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if !b.Allow(500) {
+		t.Error("b.Allow(500) after refill = false, want true")
+	}
+}
+
+func TestBucketWait(t *testing.T) {
+	ctx := context.Background()
+	b := NewBucket(10000, 1000)
+	if waited, err := b.Wait(ctx, 1000); waited || err != nil {
+		t.Errorf("b.Wait(1000) on full bucket = %v, %v, want false, nil", waited, err)
+	}
+
+	start := time.Now()
+	if waited, err := b.Wait(ctx, 1000); !waited || err != nil {
+		t.Errorf("b.Wait(1000) on empty bucket = %v, %v, want true, nil", waited, err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("b.Wait(1000) returned after %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestBucketWaitCanceled(t *testing.T) {
+	b := NewBucket(100, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	waited, err := b.Wait(ctx, 1000)
+	if !waited || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("b.Wait(1000) = %v, %v, want true, %v", waited, err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("b.Wait(1000) returned after %v, want shortly after cancellation", elapsed)
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	addr1 := netip.MustParseAddr("192.0.2.1")
+	addr2 := netip.MustParseAddr("::ffff:192.0.2.1")
+	addr3 := netip.MustParseAddr("2001:db8::1")
+
+	c := Config{
+		Limit: Limit{
+			UplinkBytesPerSecond: 1000,
+		},
+		Users: map[string]Limit{
+			"Alex": {},
+		},
+	}
+	l, err := c.Limiter()
+	if err != nil {
+		t.Fatalf("c.Limiter() failed: %v", err)
+	}
+
+	if h := l.Acquire("Alex", addr1); h != nil {
+		t.Error("l.Acquire(\"Alex\") returned non-nil handle for unlimited user")
+	}
+
+	steve1 := l.Acquire("Steve", addr1)
+	steve2 := l.Acquire("Steve", addr3)
+	if steve1.entry != steve2.entry {
+		t.Error("handles of the same user do not share buckets")
+	}
+	if steve1.entry.downlink != nil {
+		t.Error("downlink bucket created for unlimited direction")
+	}
+	if !steve1.AllowDownlink(1 << 20) {
+		t.Error("steve1.AllowDownlink returned false for unlimited direction")
+	}
+
+	anon1 := l.Acquire("", addr1)
+	anon2 := l.Acquire("", addr2)
+	anon3 := l.Acquire("", addr3)
+	if anon1.entry != anon2.entry {
+		t.Error("handles of the same IPv4 and IPv4-mapped IPv6 address do not share buckets")
+	}
+	if anon1.entry == anon3.entry {
+		t.Error("handles of different addresses share buckets")
+	}
+	if anon1.entry == steve1.entry {
+		t.Error("handles of user and address share buckets")
+	}
+
+	for _, h := range []*Handle{steve1, steve2, anon1, anon2, anon3} {
+		h.Release()
+	}
+	if n := len(l.entries); n != 0 {
+		t.Errorf("len(l.entries) = %d after releasing all handles, want 0", n)
+	}
+}
+
+func TestLimiterAcquireByIP(t *testing.T) {
+	c := Config{
+		Key: "ip",
+		Limit: Limit{
+			DownlinkBytesPerSecond: 1000,
+		},
+	}
+	l, err := c.Limiter()
+	if err != nil {
+		t.Fatalf("c.Limiter() failed: %v", err)
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	h1 := l.Acquire("Steve", addr)
+	h2 := l.Acquire("Alex", addr)
+	defer h1.Release()
+	defer h2.Release()
+	if h1.entry != h2.entry {
+		t.Error("handles of the same address do not share buckets")
+	}
+}
+
+func TestLimiterConnLimit(t *testing.T) {
+	c := Config{
+		Conn: Limit{
+			UplinkBytesPerSecond: 1000,
+		},
+	}
+	l, err := c.Limiter()
+	if err != nil {
+		t.Fatalf("c.Limiter() failed: %v", err)
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	h1 := l.Acquire("Steve", addr)
+	h2 := l.Acquire("Steve", addr)
+	defer h1.Release()
+	defer h2.Release()
+	if h1 == nil || h2 == nil {
+		t.Fatal("l.Acquire returned nil handle with per-connection limit")
+	}
+	if h1.entry != nil {
+		t.Error("user entry created without user or server limits")
+	}
+
+	if !h1.AllowUplink(1000) {
+		t.Error("h1.AllowUplink(1000) = false, want true")
+	}
+	if h1.AllowUplink(1000) {
+		t.Error("h1.AllowUplink(1000) on empty bucket = true, want false")
+	}
+	if !h2.AllowUplink(1000) {
+		t.Error("h2.AllowUplink(1000) = false, want true, connections must not share buckets")
+	}
+	if !h1.AllowDownlink(1 << 20) {
+		t.Error("h1.AllowDownlink returned false for unlimited direction")
+	}
+}
+
+func TestLimiterServerLimit(t *testing.T) {
+	c := Config{
+		Limit: Limit{
+			DownlinkBytesPerSecond: 8000,
+		},
+		Server: Limit{
+			DownlinkBytesPerSecond: 10000,
+		},
+	}
+	l, err := c.Limiter()
+	if err != nil {
+		t.Fatalf("c.Limiter() failed: %v", err)
+	}
+
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	// Alex has 4 connections, and Steve has 1.
+	var alex []*Handle
+	for range 4 {
+		alex = append(alex, l.Acquire("Alex", addr))
+	}
+	steve := l.Acquire("Steve", addr)
+
+	if rate := steve.downlink.assured.rate; rate != 5000 {
+		t.Errorf("steve.downlink.assured.rate = %v, want 5000", rate)
+	}
+	if steve.uplink.server != nil {
+		t.Error("server uplink bucket created for unlimited direction")
+	}
+
+	// Both users send as much as they can. Alex always goes first,
+	// but Steve still gets his share of the server's bandwidth.
+	var alexBytes, steveBytes int
+	start := time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		for _, h := range alex {
+			if h.AllowDownlink(100) {
+				alexBytes += 100
+			}
+		}
+		if steve.AllowDownlink(100) {
+			steveBytes += 100
+		}
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Since(start).Seconds()
+
+	// Alex is limited to 8000 B/s with a burst of 8000 bytes.
+	if want := 8000 + int(8000*elapsed) + 100; alexBytes > want {
+		t.Errorf("alexBytes = %d, want at most %d", alexBytes, want)
+	}
+	// Steve is guaranteed 5000 B/s after joining, with the assured bucket starting empty.
+	if want := int(5000*elapsed) * 3 / 4; steveBytes < want {
+		t.Errorf("steveBytes = %d, want at least %d", steveBytes, want)
+	}
+	// The server never exceeds its limit, plus its burst and the assured bursts.
+	if want := 10000 + int(10000*elapsed) + 10000 + 200; alexBytes+steveBytes > want {
+		t.Errorf("alexBytes + steveBytes = %d, want at most %d", alexBytes+steveBytes, want)
+	}
+
+	steve.Release()
+	if rate := alex[0].downlink.assured.rate; rate != 10000 {
+		t.Errorf("alex[0].downlink.assured.rate = %v after Steve left, want 10000", rate)
+	}
+
+	for _, h := range alex {
+		h.Release()
+	}
+	if n := len(l.entries); n != 0 {
+		t.Errorf("len(l.entries) = %d after releasing all handles, want 0", n)
+	}
+}
+
+func TestConfigLimiterInvalid(t *testing.T) {
+	for _, c := range []Config{
+		{Key: "port"},
+		{Key: "ip", Users: map[string]Limit{"Steve": {}}},
+	} {
+		if _, err := c.Limiter(); err == nil {
+			t.Errorf("Config{Key: %q}.Limiter() succeeded, want error", c.Key)
+		}
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	h := l.Acquire("Steve", netip.MustParseAddr("192.0.2.1"))
+	if h != nil {
+		t.Fatal("nil limiter returned non-nil handle")
+	}
+	if waited, err := h.WaitUplink(context.Background(), 1<<20); waited || err != nil {
+		t.Errorf("h.WaitUplink = %v, %v, want false, nil", waited, err)
+	}
+	if waited, err := h.WaitDownlink(context.Background(), 1<<20); waited || err != nil {
+		t.Errorf("h.WaitDownlink = %v, %v, want false, nil", waited, err)
+	}
+	if !h.AllowUplink(1<<20) || !h.AllowDownlink(1<<20) {
+		t.Error("nil handle disallowed traffic")
+	}
+	h.Release()
+}
+
+func TestRampUpAllow(t *testing.T) {
+	start := time.Now()
+	r := newRampUp(10*time.Second, 10, 110, start)
+
+	// The bucket starts with one second worth of tokens at the initial rate.
+	for i := range 10 {
+		if !r.allowAt(start) {
+			t.Fatalf("r.allowAt(start) #%d = false, want true", i)
+		}
+	}
+	if r.allowAt(start) {
+		t.Error("r.allowAt(start) on empty bucket = true, want false")
+	}
+
+	// At 1s, the rate is 20/s. The average rate over the first second is 15/s.
+	now := start.Add(time.Second)
+	var allowed int
+	for r.allowAt(now) {
+		allowed++
+	}
+	if allowed != 15 {
+		t.Errorf("allowed %d after 1s, want 15", allowed)
+	}
+
+	// Pacing stops when the ramp-up is over.
+	now = start.Add(10 * time.Second)
+	for i := range 1000 {
+		if !r.allowAt(now) {
+			t.Fatalf("r.allowAt(end) #%d = false, want true", i)
+		}
+	}
+}
+
+func TestRampUpReserve(t *testing.T) {
+	start := time.Now()
+	r := newRampUp(time.Minute, 10, 10, start)
+
+	for range 10 {
+		if d := r.reserveAt(start); d != 0 {
+			t.Fatalf("r.reserveAt(start) = %v on full bucket, want 0", d)
+		}
+	}
+	if d := r.reserveAt(start); d != 100*time.Millisecond {
+		t.Errorf("r.reserveAt(start) = %v, want 100ms", d)
+	}
+	if d := r.reserveAt(start); d != 200*time.Millisecond {
+		t.Errorf("r.reserveAt(start) = %v, want 200ms", d)
+	}
+
+	// The wait never extends past the end of the ramp-up.
+	for range 1000 {
+		r.reserveAt(start)
+	}
+	if d := r.reserveAt(start); d != time.Minute {
+		t.Errorf("r.reserveAt(start) = %v, want 1m", d)
+	}
+}
+
+func TestRampUpNil(t *testing.T) {
+	var r *RampUp
+	if !r.Allow() {
+		t.Error("r.Allow() = false, want true")
+	}
+	if r.Wait() {
+		t.Error("r.Wait() = true, want false")
+	}
+}
+
+func TestRampUpConfig(t *testing.T) {
+	for _, c := range []RampUpConfig{
+		{InitialRate: 10, FinalRate: 100},
+		{Duration: jsonhelper.Duration(time.Minute), FinalRate: 100},
+		{Duration: jsonhelper.Duration(time.Minute), InitialRate: 100, FinalRate: 10},
+	} {
+		if _, err := c.RampUp(); err == nil {
+			t.Errorf("c.RampUp() with %+v succeeded, want error", c)
+		}
+	}
+
+	c := RampUpConfig{Duration: jsonhelper.Duration(time.Minute), InitialRate: 10, FinalRate: 100}
+	if _, err := c.RampUp(); err != nil {
+		t.Errorf("c.RampUp() failed: %v", err)
+	}
+}
+
+func TestStreamReadWriterCanceled(t *testing.T) {
+	c := Config{
+		Conn: Limit{
+			DownlinkBytesPerSecond: 100,
+		},
+	}
+	l, err := c.Limiter()
+	if err != nil {
+		t.Fatalf("c.Limiter() failed: %v", err)
+	}
+	h := l.Acquire("Steve", netip.MustParseAddr("192.0.2.1"))
+	defer h.Release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rw := NewStreamReadWriter(ctx, nil, h)
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	b := make([]byte, 1<<20)
+	if n, err := rw.WriteZeroCopy(b, 0, len(b)); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("rw.WriteZeroCopy() = %d, %v, want 0, %v", n, err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("rw.WriteZeroCopy() returned after %v, want shortly after cancellation", elapsed)
+	}
+	if rw.DelayedBytes() != uint64(len(b)) {
+		t.Errorf("rw.DelayedBytes() = %d, want %d", rw.DelayedBytes(), len(b))
+	}
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// StreamReadWriter wraps a client-side [zerocopy.ReadWriter] and limits its bandwidth.
+//
+// Reads are limited by the uplink bucket, and writes by the downlink bucket.
+// StreamReadWriter deliberately does not implement [zerocopy.DirectReader] or [zerocopy.DirectWriter],
+// so that relays always go through the limited methods.
+type StreamReadWriter struct {
+	zerocopy.ReadWriter
+	ctx          context.Context
+	handle       *Handle
+	delayedBytes atomic.Uint64
+}
+
+// NewStreamReadWriter returns rw with its bandwidth limited by h.
+//
+// Pending waits return when ctx is canceled, so that tearing down the relay
+// does not wait for the buckets to refill.
+func NewStreamReadWriter(ctx context.Context, rw zerocopy.ReadWriter, h *Handle) *StreamReadWriter {
+	return &StreamReadWriter{
+		ReadWriter: rw,
+		ctx:        ctx,
+		handle:     h,
+	}
+}
+
+// ReadZeroCopy implements the Reader ReadZeroCopy method.
+func (rw *StreamReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	payloadLen, err = rw.ReadWriter.ReadZeroCopy(b, payloadBufStart, payloadBufLen)
+	if payloadLen > 0 {
+		waited, waitErr := rw.handle.WaitUplink(rw.ctx, payloadLen)
+		if waited {
+			rw.delayedBytes.Add(uint64(payloadLen))
+		}
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return
+}
+
+// WriteZeroCopy implements the Writer WriteZeroCopy method.
+func (rw *StreamReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	if payloadLen > 0 {
+		waited, err := rw.handle.WaitDownlink(rw.ctx, payloadLen)
+		if waited {
+			rw.delayedBytes.Add(uint64(payloadLen))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return rw.ReadWriter.WriteZeroCopy(b, payloadStart, payloadLen)
+}
+
+// DelayedBytes returns the number of bytes delayed by rate limiting.
+func (rw *StreamReadWriter) DelayedBytes() uint64 {
+	return rw.delayedBytes.Load()
+}
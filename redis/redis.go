@@ -0,0 +1,305 @@
+// Package redis implements a minimal Redis client for the few commands used by shadowsocks-go.
+//
+// The client speaks RESP2 over TCP, optionally with TLS, and keeps a small pool of idle connections.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the default Redis port.
+const DefaultPort = "6379"
+
+// maxIdleConns is the maximum number of idle connections kept by a client.
+const maxIdleConns = 8
+
+// maxBulkStringLength is the maximum length of bulk string replies.
+const maxBulkStringLength = 1 << 20
+
+var (
+	ErrScheme       = errors.New("scheme is not redis or rediss")
+	ErrNil          = errors.New("nil reply")
+	ErrUnknownReply = errors.New("unknown reply type")
+)
+
+// Error is an error reply from the server.
+type Error string
+
+// Error implements [error.Error].
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Client is a Redis client.
+//
+// Client is safe for concurrent use.
+type Client struct {
+	address   string
+	username  string
+	password  string
+	db        int
+	tlsConfig *tls.Config
+	dialer    net.Dialer
+
+	mu   sync.Mutex
+	idle []*clientConn
+}
+
+// ParseURL returns a client for the server in the URL, like "redis://:password@localhost:6379/0".
+// The "rediss" scheme connects with TLS. The optional path is the database number.
+func ParseURL(s string) (*Client, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Client
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, ErrScheme
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = DefaultPort
+	}
+	c.address = net.JoinHostPort(u.Hostname(), port)
+
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil || c.db < 0 {
+			return nil, fmt.Errorf("bad database number: %q", db)
+		}
+	}
+
+	return &c, nil
+}
+
+// String returns the address of the server.
+func (c *Client) String() string {
+	return c.address
+}
+
+// Ping checks the connection to the server.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "PING")
+	return err
+}
+
+// SetNX sets the key to value with the TTL if the key does not exist,
+// and returns whether the key was set.
+func (c *Client) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	_, err := c.do(ctx, "SET", key, value, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNil:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Close closes idle connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+
+	var errs []error
+	for _, cc := range idle {
+		errs = append(errs, cc.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// do sends the command and returns the reply.
+// Error replies are returned as [Error], and nil replies as [ErrNil].
+func (c *Client) do(ctx context.Context, args ...string) (string, error) {
+	cc, err := c.getConn(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := cc.do(ctx, args...)
+
+	// The connection is still usable after a reply, including error and nil replies.
+	if _, ok := err.(Error); err == nil || ok || err == ErrNil {
+		c.putConn(cc)
+	} else {
+		cc.Close()
+	}
+	return reply, err
+}
+
+// getConn returns an idle connection, or a new connection if there are none.
+func (c *Client) getConn(ctx context.Context) (*clientConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cc := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cc, nil
+	}
+	c.mu.Unlock()
+
+	return c.dial(ctx)
+}
+
+// putConn returns the connection to the idle pool, or closes it if the pool is full.
+func (c *Client) putConn(cc *clientConn) {
+	c.mu.Lock()
+	if len(c.idle) < maxIdleConns {
+		c.idle = append(c.idle, cc)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	cc.Close()
+}
+
+// dial opens a new connection, and authenticates and selects the database if configured.
+func (c *Client) dial(ctx context.Context) (*clientConn, error) {
+	var (
+		nc  net.Conn
+		err error
+	)
+	if c.tlsConfig != nil {
+		d := tls.Dialer{NetDialer: &c.dialer, Config: c.tlsConfig}
+		nc, err = d.DialContext(ctx, "tcp", c.address)
+	} else {
+		nc, err = c.dialer.DialContext(ctx, "tcp", c.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &clientConn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+	}
+
+	if c.password != "" {
+		if c.username != "" {
+			_, err = cc.do(ctx, "AUTH", c.username, c.password)
+		} else {
+			_, err = cc.do(ctx, "AUTH", c.password)
+		}
+		if err != nil {
+			cc.Close()
+			return nil, fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if c.db != 0 {
+		if _, err = cc.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			cc.Close()
+			return nil, fmt.Errorf("failed to select database %d: %w", c.db, err)
+		}
+	}
+
+	return cc, nil
+}
+
+// clientConn is a connection to the server.
+type clientConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends the command and reads the reply, with the context's deadline if any.
+func (cc *clientConn) do(ctx context.Context, args ...string) (string, error) {
+	deadline, _ := ctx.Deadline()
+	if err := cc.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	b := appendCommand(nil, args...)
+	if _, err := cc.Write(b); err != nil {
+		return "", err
+	}
+	return readReply(cc.r)
+}
+
+// appendCommand appends the command as an array of bulk strings to b.
+func appendCommand(b []byte, args ...string) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, arg...)
+		b = append(b, '\r', '\n')
+	}
+	return b
+}
+
+// readReply reads a simple string, error, integer or bulk string reply.
+// Integers are returned in decimal.
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 {
+		return "", ErrUnknownReply
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", Error(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		switch {
+		case err != nil:
+			return "", fmt.Errorf("bad bulk string length: %q", line[1:])
+		case n == -1:
+			return "", ErrNil
+		case n < 0 || n > maxBulkStringLength:
+			return "", fmt.Errorf("bulk string length out of range: %d", n)
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return string(b[:n]), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownReply, line[0])
+	}
+}
+
+// readLine reads a line terminated by CRLF, and returns it without the terminator.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("line not terminated by CRLF")
+	}
+	return string(line[:len(line)-2]), nil
+}
@@ -0,0 +1,228 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a fake Redis server that supports AUTH, SELECT, PING and SET with NX.
+type fakeServer struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	keys     map[string]string
+	commands []string
+	conns    int
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		ln:       ln,
+		password: password,
+		keys:     make(map[string]string),
+	}
+	go s.serve()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authenticated := s.password == ""
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if args[len(args)-1] == s.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "SET":
+			if _, ok := s.keys[args[1]]; ok {
+				reply = "$-1\r\n"
+			} else {
+				s.keys[args[1]] = args[2]
+				reply = "+OK\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+
+		if _, err = io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(line, "*"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("bad command")
+	}
+	args := make([]string, n)
+	for i := range args {
+		if args[i], err = readReply(r); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func TestParseURL(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		address  string
+		username string
+		password string
+		db       int
+		tls      bool
+	}{
+		{"redis://localhost", "localhost:6379", "", "", 0, false},
+		{"redis://:secret@10.0.0.1:6380/2", "10.0.0.1:6380", "", "secret", 2, false},
+		{"rediss://ssgo:secret@[2001:db8::1]/", "[2001:db8::1]:6379", "ssgo", "secret", 0, true},
+	} {
+		client, err := ParseURL(c.s)
+		if err != nil {
+			t.Errorf("ParseURL(%q) failed: %v", c.s, err)
+			continue
+		}
+		if client.address != c.address || client.username != c.username || client.password != c.password || client.db != c.db || (client.tlsConfig != nil) != c.tls {
+			t.Errorf("ParseURL(%q) = %+v", c.s, client)
+		}
+	}
+
+	for _, s := range []string{
+		"http://localhost",
+		"redis://localhost/abc",
+		"redis://localhost/-1",
+	} {
+		if _, err := ParseURL(s); err == nil {
+			t.Errorf("ParseURL(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestClientSetNX(t *testing.T) {
+	s := newFakeServer(t, "secret")
+	client, err := ParseURL("redis://:secret@" + s.ln.Addr().String() + "/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = client.Ping(ctx); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		key  string
+		want bool
+	}{
+		{"salt:a", true},
+		{"salt:b", true},
+		{"salt:a", false},
+	} {
+		ok, err := client.SetNX(ctx, c.key, "1", time.Minute)
+		if err != nil {
+			t.Fatalf("SetNX(%q) failed: %v", c.key, err)
+		}
+		if ok != c.want {
+			t.Errorf("SetNX(%q) = %v, want %v", c.key, ok, c.want)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Connections are reused, including after nil replies.
+	if s.conns != 1 {
+		t.Errorf("conns = %d, want 1", s.conns)
+	}
+	want := []string{
+		"AUTH secret",
+		"SELECT 3",
+		"PING",
+		"SET salt:a 1 NX PX 60000",
+		"SET salt:b 1 NX PX 60000",
+		"SET salt:a 1 NX PX 60000",
+	}
+	if strings.Join(s.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", s.commands, want)
+	}
+}
+
+func TestClientErrorReply(t *testing.T) {
+	s := newFakeServer(t, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := ParseURL("redis://:wrong@" + s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rerr Error
+	if err = client.Ping(ctx); !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "WRONGPASS") {
+		t.Errorf("Ping with wrong password = %v, want WRONGPASS error", err)
+	}
+
+	client, err = ParseURL("redis://" + s.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.SetNX(ctx, "salt:a", "1", time.Minute); !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "NOAUTH") {
+		t.Errorf("SetNX without password = %v, want NOAUTH error", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Package resource counts goroutines, sockets, buffers, and channels used by relay services,
+// so that resource usage can be inspected per server.
+package resource
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Usage is a snapshot of the resources used by a relay service.
+type Usage struct {
+	// Goroutines is the number of running goroutines.
+	Goroutines int64 `json:"goroutines"`
+
+	// OpenFDs is the number of open sockets, including listeners.
+	OpenFDs int64 `json:"openFDs"`
+
+	// BuffersInUse is the number of packet buffers taken from the buffer pool and not yet returned.
+	BuffersInUse int64 `json:"buffersInUse"`
+
+	// BufferBytesInUse is the total size of BuffersInUse in bytes.
+	BufferBytesInUse int64 `json:"bufferBytesInUse"`
+
+	// BuffersAllocated is the number of packet buffers allocated by the buffer pool so far.
+	// Buffers freed by the garbage collector are not subtracted.
+	BuffersAllocated uint64 `json:"buffersAllocated"`
+
+	// Channels is the number of open send channels.
+	Channels int `json:"channels"`
+
+	// ChannelLength is the total number of packets queued in send channels.
+	ChannelLength int `json:"channelLength"`
+
+	// ChannelCapacity is the total capacity of send channels.
+	ChannelCapacity int `json:"channelCapacity"`
+}
+
+// Counter counts the resources used by a relay service.
+//
+// The zero value is ready for use.
+// All methods are safe to call on a nil *Counter, which does not count anything.
+type Counter struct {
+	goroutines       atomic.Int64
+	openFDs          atomic.Int64
+	buffersInUse     atomic.Int64
+	bufferBytesInUse atomic.Int64
+	buffersAllocated atomic.Uint64
+
+	mu            sync.Mutex
+	lastChannelID uint64
+	channels      map[uint64]func() (length, capacity int)
+}
+
+// Go runs f in a new goroutine, counting it until f returns.
+func (c *Counter) Go(f func()) {
+	if c == nil {
+		go f()
+		return
+	}
+	c.goroutines.Add(1)
+	go func() {
+		defer c.goroutines.Add(-1)
+		f()
+	}()
+}
+
+// AddGoroutines adds delta to the goroutine count.
+// It is for goroutines not started by [Counter.Go], like those started by other packages.
+func (c *Counter) AddGoroutines(delta int64) {
+	if c != nil {
+		c.goroutines.Add(delta)
+	}
+}
+
+// AddFDs adds delta to the open socket count.
+func (c *Counter) AddFDs(delta int64) {
+	if c != nil {
+		c.openFDs.Add(delta)
+	}
+}
+
+// AllocBuffer records that the buffer pool allocated a new buffer.
+func (c *Counter) AllocBuffer() {
+	if c != nil {
+		c.buffersAllocated.Add(1)
+	}
+}
+
+// GetBuffer records that a buffer of size bytes was taken from the buffer pool.
+func (c *Counter) GetBuffer(size int) {
+	if c != nil {
+		c.buffersInUse.Add(1)
+		c.bufferBytesInUse.Add(int64(size))
+	}
+}
+
+// PutBuffer records that a buffer of size bytes was returned to the buffer pool.
+func (c *Counter) PutBuffer(size int) {
+	if c != nil {
+		c.buffersInUse.Add(-1)
+		c.bufferBytesInUse.Add(-int64(size))
+	}
+}
+
+// AddChannel adds ch to the channels whose occupancy is reported by c.
+// The returned function removes it, and must be called before ch is closed.
+func AddChannel[T any](c *Counter, ch chan T) (remove func()) {
+	if c == nil {
+		return func() {}
+	}
+
+	c.mu.Lock()
+	if c.channels == nil {
+		c.channels = make(map[uint64]func() (int, int))
+	}
+	c.lastChannelID++
+	id := c.lastChannelID
+	c.channels[id] = func() (int, int) {
+		return len(ch), cap(ch)
+	}
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.channels, id)
+		c.mu.Unlock()
+	}
+}
+
+// Snapshot returns the current resource usage.
+func (c *Counter) Snapshot() Usage {
+	if c == nil {
+		return Usage{}
+	}
+
+	u := Usage{
+		Goroutines:       c.goroutines.Load(),
+		OpenFDs:          c.openFDs.Load(),
+		BuffersInUse:     c.buffersInUse.Load(),
+		BufferBytesInUse: c.bufferBytesInUse.Load(),
+		BuffersAllocated: c.buffersAllocated.Load(),
+	}
+
+	c.mu.Lock()
+	u.Channels = len(c.channels)
+	for _, lenCap := range c.channels {
+		length, capacity := lenCap()
+		u.ChannelLength += length
+		u.ChannelCapacity += capacity
+	}
+	c.mu.Unlock()
+
+	return u
+}
+
+// Server holds the resource counters of a server's relay services.
+type Server struct {
+	TCP Counter
+	UDP Counter
+}
+
+// ServerUsage is a snapshot of the resources used by a server's relay services.
+type ServerUsage struct {
+	TCP Usage `json:"tcp"`
+	UDP Usage `json:"udp"`
+}
+
+// Snapshot returns the current resource usage of the server.
+func (s *Server) Snapshot() ServerUsage {
+	return ServerUsage{
+		TCP: s.TCP.Snapshot(),
+		UDP: s.UDP.Snapshot(),
+	}
+}
@@ -0,0 +1,89 @@
+package resource
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	var c Counter
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	c.Go(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	c.AddFDs(2)
+	c.AllocBuffer()
+	c.AllocBuffer()
+	c.GetBuffer(1500)
+	c.GetBuffer(1500)
+	c.PutBuffer(1500)
+
+	ch := make(chan int, 8)
+	ch <- 1
+	ch <- 2
+	removeCh := AddChannel(&c, ch)
+	removeOther := AddChannel(&c, make(chan int, 4))
+
+	u := c.Snapshot()
+	expected := Usage{
+		Goroutines:       1,
+		OpenFDs:          2,
+		BuffersInUse:     1,
+		BufferBytesInUse: 1500,
+		BuffersAllocated: 2,
+		Channels:         2,
+		ChannelLength:    2,
+		ChannelCapacity:  12,
+	}
+	if u != expected {
+		t.Errorf("c.Snapshot() = %+v, expected %+v", u, expected)
+	}
+
+	c.Go(func() {
+		close(done)
+	})
+	close(release)
+	<-done
+	c.AddFDs(-2)
+	c.PutBuffer(1500)
+	removeCh()
+	removeOther()
+
+	// Wait for the goroutines to be uncounted.
+	for c.goroutines.Load() != 0 {
+		runtime.Gosched()
+	}
+
+	u = c.Snapshot()
+	expected = Usage{BuffersAllocated: 2}
+	if u != expected {
+		t.Errorf("c.Snapshot() = %+v, expected %+v", u, expected)
+	}
+}
+
+func TestNilCounter(t *testing.T) {
+	var c *Counter
+
+	done := make(chan struct{})
+	c.Go(func() {
+		close(done)
+	})
+	<-done
+
+	c.AddGoroutines(1)
+	c.AddFDs(1)
+	c.AllocBuffer()
+	c.GetBuffer(1500)
+	c.PutBuffer(1500)
+	AddChannel(c, make(chan int, 1))()
+
+	if u := c.Snapshot(); u != (Usage{}) {
+		t.Errorf("c.Snapshot() = %+v, expected zero value", u)
+	}
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"context"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// IPFamilyTCPClient wraps a TCP client and resolves domain targets of its connections by an IP family policy.
+//
+// Only direct clients resolve targets. Proxy clients leave them to the proxy server.
+type IPFamilyTCPClient struct {
+	zerocopy.TCPClient
+	policy conn.IPFamilyPolicy
+}
+
+// NewIPFamilyTCPClient returns a new TCP client that resolves domain targets by policy.
+func NewIPFamilyTCPClient(client zerocopy.TCPClient, policy conn.IPFamilyPolicy) *IPFamilyTCPClient {
+	return &IPFamilyTCPClient{
+		TCPClient: client,
+		policy:    policy,
+	}
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *IPFamilyTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	return c.TCPClient.Dial(conn.NewIPFamilyPolicyContext(ctx, c.policy), targetAddr, payload)
+}
+
+// IPFamilyUDPClient wraps a UDP client and resolves domain targets of its sessions by an IP family policy.
+//
+// Only direct clients resolve targets. Proxy clients leave them to the proxy server.
+type IPFamilyUDPClient struct {
+	zerocopy.UDPClient
+	policy conn.IPFamilyPolicy
+}
+
+// NewIPFamilyUDPClient returns a new UDP client that resolves domain targets by policy.
+func NewIPFamilyUDPClient(client zerocopy.UDPClient, policy conn.IPFamilyPolicy) *IPFamilyUDPClient {
+	return &IPFamilyUDPClient{
+		UDPClient: client,
+		policy:    policy,
+	}
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *IPFamilyUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	return c.UDPClient.NewSession(conn.NewIPFamilyPolicyContext(ctx, c.policy))
+}
@@ -0,0 +1,37 @@
+package router
+
+import (
+	"context"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// NATTimeoutUDPClient wraps a UDP client and sets the NAT timeout in the info of its sessions,
+// so that relays expire them after the given duration of inactivity.
+type NATTimeoutUDPClient struct {
+	zerocopy.UDPClient
+	natTimeout time.Duration
+}
+
+// NewNATTimeoutUDPClient returns a new UDP client that sets the NAT timeout of its sessions to natTimeout.
+func NewNATTimeoutUDPClient(client zerocopy.UDPClient, natTimeout time.Duration) *NATTimeoutUDPClient {
+	return &NATTimeoutUDPClient{
+		UDPClient:  client,
+		natTimeout: natTimeout,
+	}
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *NATTimeoutUDPClient) Info() zerocopy.UDPClientInfo {
+	info := c.UDPClient.Info()
+	info.NATTimeout = c.natTimeout
+	return info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *NATTimeoutUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	info, session, err := c.UDPClient.NewSession(ctx)
+	info.NATTimeout = c.natTimeout
+	return info, session, err
+}
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// PinnedTargetUDPClient wraps a UDP client and sends all packets of its sessions
+// to a fixed target address, regardless of the per-packet target address.
+type PinnedTargetUDPClient struct {
+	client     zerocopy.UDPClient
+	targetAddr conn.Addr
+}
+
+// NewPinnedTargetUDPClient returns a new UDP client that pins all packets to targetAddr.
+func NewPinnedTargetUDPClient(client zerocopy.UDPClient, targetAddr conn.Addr) *PinnedTargetUDPClient {
+	return &PinnedTargetUDPClient{
+		client:     client,
+		targetAddr: targetAddr,
+	}
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *PinnedTargetUDPClient) Info() zerocopy.UDPClientInfo {
+	return c.client.Info()
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *PinnedTargetUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	info, session, err := c.client.NewSession(ctx)
+	if err != nil {
+		return info, session, err
+	}
+	session.Packer = &pinnedTargetClientPacker{
+		ClientPacker: session.Packer,
+		targetAddr:   c.targetAddr,
+	}
+	return info, session, nil
+}
+
+// pinnedTargetClientPacker replaces the target address of every packet with a fixed address.
+type pinnedTargetClientPacker struct {
+	zerocopy.ClientPacker
+	targetAddr conn.Addr
+}
+
+// PackInPlace implements the zerocopy.ClientPacker PackInPlace method.
+func (p *pinnedTargetClientPacker) PackInPlace(ctx context.Context, b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	return p.ClientPacker.PackInPlace(ctx, b, p.targetAddr, payloadStart, payloadLen)
+}
@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"net/netip"
 	"slices"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/bitset"
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/dns"
 	"github.com/database64128/shadowsocks-go/domainset"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
 	"github.com/database64128/shadowsocks-go/portset"
+	"github.com/database64128/shadowsocks-go/routescript"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"github.com/oschwald/geoip2-golang"
 	"go.uber.org/zap"
@@ -21,6 +24,65 @@ import (
 // ErrRejected is a special error that indicates the request is rejected.
 var ErrRejected = errors.New("rejected")
 
+// RejectMode controls how requests rejected by a route are handled by servers.
+type RejectMode string
+
+const (
+	// RejectModeDefault replies with a failure when the proxy protocol supports it, and closes the connection.
+	// Packets of rejected UDP sessions are dropped.
+	RejectModeDefault RejectMode = ""
+
+	// RejectModeDrop drops requests silently. TCP connections are held open without a reply,
+	// and everything the client sends is discarded, until the client closes the connection.
+	// Packets of rejected UDP sessions are dropped.
+	RejectModeDrop RejectMode = "drop"
+
+	// RejectModeReset resets TCP connections, and responds to packets of rejected UDP sessions
+	// with ICMP port unreachable, as if the target port were closed.
+	RejectModeReset RejectMode = "reset"
+)
+
+// RejectedError is the error returned by [Router.GetTCPClient] and [Router.GetUDPClient]
+// for requests rejected with a [RejectMode] other than [RejectModeDefault].
+//
+// It matches [ErrRejected] with [errors.Is].
+type RejectedError struct {
+	Mode RejectMode
+}
+
+var (
+	errRejectedDrop  = &RejectedError{Mode: RejectModeDrop}
+	errRejectedReset = &RejectedError{Mode: RejectModeReset}
+)
+
+// Error implements [error.Error].
+func (e *RejectedError) Error() string {
+	return "rejected (" + string(e.Mode) + ")"
+}
+
+// Is reports whether target is [ErrRejected].
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// RejectModeOf returns the reject mode of err returned by the router,
+// and whether err is a rejection.
+func RejectModeOf(err error) (RejectMode, bool) {
+	var rerr *RejectedError
+	if errors.As(err, &rerr) {
+		return rerr.Mode, true
+	}
+	return RejectModeDefault, errors.Is(err, ErrRejected)
+}
+
+// isRejectClientName returns whether the client name is one of the built-in clients that reject requests.
+func isRejectClientName(name string) bool {
+	return name == "reject" || name == "blackhole"
+}
+
+// defaultScriptTimeout is the default time limit of route scripts.
+const defaultScriptTimeout = 10 * time.Millisecond
+
 var (
 	errNoAvailableResolvers  = errors.New("no available resolvers")
 	errPointlessPortCriteria = errors.New("matching all ports is equivalent to not having any port filtering rules")
@@ -35,8 +97,47 @@ type RouteConfig struct {
 	Network string `json:"network"`
 
 	// Route matched requests to this client. Must not be empty.
+	//
+	// The built-in "reject" client rejects matched requests as specified by RejectMode,
+	// and the built-in "blackhole" client drops them silently, like "reject" with the "drop" mode.
 	Client string `json:"client"`
 
+	// RejectMode controls how requests rejected by the "reject" client are handled.
+	//
+	//   - "" (default): Reply with a failure when the proxy protocol supports it, like SOCKS5 and HTTP CONNECT,
+	//     and close the connection. Drop UDP packets.
+	//   - "drop": Hold TCP connections open without a reply, discarding what the client sends. Drop UDP packets.
+	//   - "reset": Reset TCP connections. Respond to UDP packets with ICMP port unreachable.
+	//     ICMP messages are only sent by "direct" and "tproxy" servers, and require CAP_NET_RAW on Linux.
+	RejectMode RejectMode `json:"rejectMode"`
+
+	// Send all packets of matched UDP sessions to this target address,
+	// ignoring the target addresses of individual packets.
+	// If unspecified, packets are sent to their own target addresses.
+	//
+	// Only applicable to UDP. Cannot be used with the "reject" client.
+	UDPPinnedTargetAddress conn.Addr `json:"udpPinnedTargetAddress"`
+
+	// Expire matched UDP sessions after they have been inactive for this duration,
+	// like "30s" for DNS, or "10m" for WireGuard. Overrides the NAT timeout of the client and the listener.
+	// Servers with a minimum NAT timeout raise it to their minimum.
+	// If unspecified, the NAT timeout of the client or the listener is used.
+	//
+	// Only applicable to UDP. Cannot be used with the "reject" client.
+	UDPNATTimeout jsonhelper.Duration `json:"udpNATTimeout"`
+
+	// Resolve domain targets of matched requests to addresses of this family.
+	//
+	//   - "" (default): Follow the network of the client.
+	//   - "preferIPv4": Prefer IPv4 addresses. For TCP, connection attempts start with IPv4 addresses.
+	//   - "preferIPv6": Prefer IPv6 addresses. For TCP, connection attempts start with IPv6 addresses.
+	//   - "ipv4Only": Only use IPv4 addresses.
+	//   - "ipv6Only": Only use IPv6 addresses.
+	//
+	// Only direct clients resolve domain targets. Proxy clients are not affected.
+	// Cannot be used with the "reject" client.
+	IPFamily conn.IPFamilyPolicy `json:"ipFamily"`
+
 	// When matching a domain target to IP prefixes, use this resolver to resolve the domain name.
 	// If unspecified, use all resolvers by order.
 	Resolver string `json:"resolver"`
@@ -53,6 +154,12 @@ type RouteConfig struct {
 	// Match requests from these ports and port ranges. If empty, match all requests.
 	FromPortRanges string `json:"fromPortRanges"`
 
+	// Match requests received on server listeners with these ports. If empty, match all requests.
+	FromListenPorts []uint16 `json:"fromListenPorts"`
+
+	// Match requests received on server listeners with these ports and port ranges. If empty, match all requests.
+	FromListenPortRanges string `json:"fromListenPortRanges"`
+
 	// Match requests from IP addresses in these prefixes. If empty, match all requests.
 	FromPrefixes []netip.Prefix `json:"fromPrefixes"`
 
@@ -62,6 +169,9 @@ type RouteConfig struct {
 	// Match requests from IP addresses in these countries. If empty, match all requests.
 	FromGeoIPCountries []string `json:"fromGeoIPCountries"`
 
+	// Match requests from IP addresses in these autonomous systems. If empty, match all requests.
+	FromASNs []uint `json:"fromASNs"`
+
 	// Match requests to these ports. If empty, match all requests.
 	ToPorts []uint16 `json:"toPorts"`
 
@@ -92,6 +202,18 @@ type RouteConfig struct {
 	// Match requests to IP addresses in these countries. If empty, match all requests.
 	ToGeoIPCountries []string `json:"toGeoIPCountries"`
 
+	// Match requests to IP addresses in these autonomous systems. If empty, match all requests.
+	ToASNs []uint `json:"toASNs"`
+
+	// Match requests for which this script evaluates to true. If empty, match all requests.
+	// The script is evaluated after all other criteria are met.
+	// See package routescript for the syntax, variables and functions.
+	Script string `json:"script"`
+
+	// Abort script evaluation after this duration, and fail the request.
+	// The default value is 10ms.
+	ScriptTimeout jsonhelper.Duration `json:"scriptTimeout"`
+
 	// Do not resolve destination domains to match IP rules.
 	DisableNameResolutionForIPRules bool `json:"disableNameResolutionForIPRules"`
 
@@ -107,9 +229,15 @@ type RouteConfig struct {
 	// Invert source GeoIP country matching logic. Match requests from all countries except those in FromGeoIPCountries.
 	InvertFromGeoIPCountries bool `json:"invertFromGeoIPCountries"`
 
+	// Invert source ASN matching logic. Match requests from all autonomous systems except those in FromASNs.
+	InvertFromASNs bool `json:"invertFromASNs"`
+
 	// Invert source port matching logic. Match requests from all ports except those in FromPorts.
 	InvertFromPorts bool `json:"invertFromPorts"`
 
+	// Invert listen port matching logic. Match requests received on all ports except those in FromListenPorts.
+	InvertFromListenPorts bool `json:"invertFromListenPorts"`
+
 	// Invert destination domain matching logic. Match requests to all domains except those in ToDomains or ToDomainSets.
 	InvertToDomains bool `json:"invertToDomains"`
 
@@ -125,30 +253,45 @@ type RouteConfig struct {
 	// Invert destination GeoIP country matching logic. Match requests to all countries except those in ToGeoIPCountries.
 	InvertToGeoIPCountries bool `json:"invertToGeoIPCountries"`
 
+	// Invert destination ASN matching logic. Match requests to all autonomous systems except those in ToASNs.
+	InvertToASNs bool `json:"invertToASNs"`
+
 	// Invert destination port matching logic. Match requests to all ports except those in ToPorts.
 	InvertToPorts bool `json:"invertToPorts"`
 }
 
 // Route creates a route from the RouteConfig.
-func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers []dns.SimpleResolver, resolverMap map[string]dns.SimpleResolver, tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient, serverIndexByName map[string]int, domainSetMap map[string]domainset.DomainSet, prefixSetMap map[string]*netipx.IPSet) (Route, error) {
+//
+// The route refers to its client by name. Clients are bound to the route by [Router.BindClients].
+func (rc *RouteConfig) Route(geoip, asn *geoip2.Reader, logger *zap.Logger, resolvers []dns.SimpleResolver, resolverMap map[string]dns.SimpleResolver, serverIndexByName map[string]int, domainSetMap map[string]domainset.DomainSet, prefixSetMap map[string]*netipx.IPSet) (Route, error) {
 	// Bad name.
 	switch rc.Name {
 	case "", "default":
 		return Route{}, errors.New("route name cannot be empty or 'default'")
 	}
 
+	// Bad client.
+	if rc.Client == "" {
+		return Route{}, errors.New("route client cannot be empty")
+	}
+
 	// Has GeoIP criteria but no GeoIP database.
 	if geoip == nil && (len(rc.FromGeoIPCountries) > 0 || len(rc.ToGeoIPCountries) > 0 || len(rc.ToMatchedDomainExpectedGeoIPCountries) > 0) {
 		return Route{}, errors.New("missing GeoLite2 country database path")
 	}
 
+	// Has ASN criteria but no ASN database.
+	if asn == nil && (len(rc.FromASNs) > 0 || len(rc.ToASNs) > 0) {
+		return Route{}, errors.New("missing GeoLite2 ASN database path")
+	}
+
 	// Needs to resolve domain names but has no resolvers.
 	if len(resolvers) == 0 &&
 		(len(rc.ToMatchedDomainExpectedPrefixes) > 0 ||
 			len(rc.ToMatchedDomainExpectedPrefixSets) > 0 ||
 			len(rc.ToMatchedDomainExpectedGeoIPCountries) > 0 ||
 			!rc.DisableNameResolutionForIPRules &&
-				(len(rc.ToPrefixes) > 0 || len(rc.ToPrefixSets) > 0 || len(rc.ToGeoIPCountries) > 0)) {
+				(len(rc.ToPrefixes) > 0 || len(rc.ToPrefixSets) > 0 || len(rc.ToGeoIPCountries) > 0 || len(rc.ToASNs) > 0)) {
 		return Route{}, errors.New("missing resolvers for one or more criteria")
 	}
 
@@ -168,7 +311,35 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 		resolvers = []dns.SimpleResolver{resolver}
 	}
 
-	route := Route{name: rc.Name}
+	switch rc.RejectMode {
+	case RejectModeDefault:
+	case RejectModeDrop, RejectModeReset:
+		if rc.Client != "reject" {
+			return Route{}, errors.New("rejectMode requires the reject client")
+		}
+	default:
+		return Route{}, fmt.Errorf("unknown reject mode: %q", rc.RejectMode)
+	}
+
+	if rc.UDPPinnedTargetAddress.IsValid() && (isRejectClientName(rc.Client) || rc.Network == "tcp") {
+		return Route{}, errors.New("udpPinnedTargetAddress requires a UDP client")
+	}
+
+	if rc.UDPNATTimeout != 0 && (isRejectClientName(rc.Client) || rc.Network == "tcp") {
+		return Route{}, errors.New("udpNATTimeout requires a UDP client")
+	}
+	if rc.UDPNATTimeout < 0 {
+		return Route{}, fmt.Errorf("negative UDP NAT timeout: %s", rc.UDPNATTimeout.Value())
+	}
+
+	if err := rc.IPFamily.Validate(); err != nil {
+		return Route{}, err
+	}
+	if rc.IPFamily != conn.IPFamilyPolicyDefault && isRejectClientName(rc.Client) {
+		return Route{}, errors.New("ipFamily cannot be used with the reject client")
+	}
+
+	route := Route{name: rc.Name, rejectMode: rc.RejectMode, ipFamily: rc.IPFamily}
 
 	switch rc.Network {
 	case "":
@@ -180,22 +351,16 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 		return Route{}, fmt.Errorf("invalid network: %s", rc.Network)
 	}
 
-	if rc.Client != "reject" {
-		switch rc.Network {
-		case "", "tcp":
-			route.tcpClient = tcpClientMap[rc.Client]
-			if route.tcpClient == nil {
-				return Route{}, fmt.Errorf("TCP client not found: %s", rc.Client)
-			}
-		}
+	switch rc.Network {
+	case "", "tcp":
+		route.tcpClientName = rc.Client
+	}
 
-		switch rc.Network {
-		case "", "udp":
-			route.udpClient = udpClientMap[rc.Client]
-			if route.udpClient == nil {
-				return Route{}, fmt.Errorf("UDP client not found: %s", rc.Client)
-			}
-		}
+	switch rc.Network {
+	case "", "udp":
+		route.udpClientName = rc.Client
+		route.udpPinnedTargetAddr = rc.UDPPinnedTargetAddress
+		route.udpNATTimeout = rc.UDPNATTimeout.Value()
 	}
 
 	if len(rc.FromServers) > 0 {
@@ -249,7 +414,40 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 		}
 	}
 
-	if len(rc.FromPrefixes) > 0 || len(rc.FromPrefixSets) > 0 || len(rc.FromGeoIPCountries) > 0 {
+	if len(rc.FromListenPorts) > 0 || rc.FromListenPortRanges != "" {
+		var portSet portset.PortSet
+
+		for _, port := range rc.FromListenPorts {
+			if port == 0 {
+				return Route{}, fmt.Errorf("bad fromListenPorts: %w", portset.ErrZeroPort)
+			}
+			portSet.Add(port)
+		}
+
+		if err := portSet.Parse(rc.FromListenPortRanges); err != nil {
+			return Route{}, fmt.Errorf("failed to parse listen port ranges: %w", err)
+		}
+
+		portCount := portSet.Count()
+		switch portCount {
+		case 0:
+			panic("unreachable")
+		case 1:
+			route.AddCriterion(ListenPortCriterion(portSet.First()), rc.InvertFromListenPorts)
+		case 65535:
+			return Route{}, fmt.Errorf("bad listen port criteria: %w", errPointlessPortCriteria)
+		default:
+			portRangeCount := portSet.RangeCount()
+			if portRangeCount <= 16 {
+				route.AddCriterion(ListenPortRangeSetCriterion(portSet.RangeSet()), rc.InvertFromListenPorts)
+			} else {
+				listenPortSetCriterion := ListenPortSetCriterion(portSet)
+				route.AddCriterion(&listenPortSetCriterion, rc.InvertFromListenPorts)
+			}
+		}
+	}
+
+	if len(rc.FromPrefixes) > 0 || len(rc.FromPrefixSets) > 0 || len(rc.FromGeoIPCountries) > 0 || len(rc.FromASNs) > 0 {
 		var group CriterionGroupOR
 
 		if len(rc.FromPrefixes) > 0 || len(rc.FromPrefixSets) > 0 {
@@ -283,6 +481,14 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 			}, rc.InvertFromGeoIPCountries)
 		}
 
+		if len(rc.FromASNs) > 0 {
+			group.AddCriterion(SourceASNCriterion{
+				asns:   rc.FromASNs,
+				asn:    asn,
+				logger: logger,
+			}, rc.InvertFromASNs)
+		}
+
 		route.criteria = group.AppendTo(route.criteria)
 	}
 
@@ -319,7 +525,7 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 		}
 	}
 
-	if len(rc.ToDomains) > 0 || len(rc.ToDomainSets) > 0 || len(rc.ToPrefixes) > 0 || len(rc.ToPrefixSets) > 0 || len(rc.ToGeoIPCountries) > 0 {
+	if len(rc.ToDomains) > 0 || len(rc.ToDomainSets) > 0 || len(rc.ToPrefixes) > 0 || len(rc.ToPrefixSets) > 0 || len(rc.ToGeoIPCountries) > 0 || len(rc.ToASNs) > 0 {
 		var group CriterionGroupOR
 
 		if len(rc.ToDomains) > 0 || len(rc.ToDomainSets) > 0 {
@@ -433,18 +639,65 @@ func (rc *RouteConfig) Route(geoip *geoip2.Reader, logger *zap.Logger, resolvers
 			}
 		}
 
+		if len(rc.ToASNs) > 0 {
+			if rc.DisableNameResolutionForIPRules {
+				group.AddCriterion(DestASNCriterion{
+					asns:   rc.ToASNs,
+					asn:    asn,
+					logger: logger,
+				}, rc.InvertToASNs)
+			} else {
+				group.AddCriterion(DestResolvedASNCriterion{
+					asns:      rc.ToASNs,
+					asn:       asn,
+					logger:    logger,
+					resolvers: resolvers,
+				}, rc.InvertToASNs)
+			}
+		}
+
 		route.criteria = group.AppendTo(route.criteria)
 	}
 
+	if rc.Script != "" {
+		program, err := routescript.Compile(rc.Script)
+		if err != nil {
+			return Route{}, fmt.Errorf("failed to compile script: %w", err)
+		}
+
+		timeout := rc.ScriptTimeout.Value()
+		switch {
+		case timeout == 0:
+			timeout = defaultScriptTimeout
+		case timeout < 0:
+			return Route{}, fmt.Errorf("negative script timeout: %s", timeout)
+		}
+
+		serverNames := make([]string, len(serverIndexByName))
+		for name, index := range serverIndexByName {
+			serverNames[index] = name
+		}
+
+		route.AddCriterion(&ScriptCriterion{
+			program:     program,
+			timeout:     timeout,
+			serverNames: serverNames,
+		}, false)
+	}
+
 	return route, nil
 }
 
 // Route controls which client a request is routed to.
 type Route struct {
-	name      string
-	criteria  []Criterion
-	tcpClient zerocopy.TCPClient
-	udpClient zerocopy.UDPClient
+	name                string
+	criteria            []Criterion
+	tcpClientName       string
+	udpClientName       string
+	udpPinnedTargetAddr conn.Addr
+	udpNATTimeout       time.Duration
+	rejectMode          RejectMode
+	ipFamily            conn.IPFamilyPolicy
 }
 
 // String returns the name of the route.
@@ -461,7 +714,7 @@ func (r *Route) AddCriterion(criterion Criterion, invert bool) {
 }
 
 // Match returns whether the request matches the route.
-func (r *Route) Match(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (r *Route) Match(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	for _, criterion := range r.criteria {
 		met, err := criterion.Meet(ctx, network, requestInfo)
 		if !met {
@@ -471,26 +724,80 @@ func (r *Route) Match(ctx context.Context, network protocol, requestInfo Request
 	return true, nil
 }
 
-// TCPClient returns the TCP client to use for the request.
-func (r *Route) TCPClient() (zerocopy.TCPClient, error) {
-	if r.tcpClient == nil {
-		return nil, ErrRejected
+// TCPClientName returns the name of the TCP client of the route.
+// It is "reject" or "blackhole" if the route rejects TCP requests.
+func (r *Route) TCPClientName() string {
+	return r.tcpClientName
+}
+
+// UDPClientName returns the name of the UDP client of the route.
+// It is "reject" or "blackhole" if the route rejects UDP sessions.
+func (r *Route) UDPClientName() string {
+	return r.udpClientName
+}
+
+// rejectError returns the error for a request rejected by the route's client clientName.
+func (r *Route) rejectError(clientName string) error {
+	mode := r.rejectMode
+	if clientName == "blackhole" {
+		mode = RejectModeDrop
+	}
+	switch mode {
+	case RejectModeDrop:
+		return errRejectedDrop
+	case RejectModeReset:
+		return errRejectedReset
+	default:
+		return ErrRejected
 	}
-	return r.tcpClient, nil
 }
 
-// UDPClient returns the UDP client to use for the request.
-func (r *Route) UDPClient() (zerocopy.UDPClient, error) {
-	if r.udpClient == nil {
-		return nil, ErrRejected
+// bindClients looks up the route's clients in the client maps.
+// Empty client names are left unbound.
+func (r *Route) bindClients(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient) (c routeClients, err error) {
+	switch r.tcpClientName {
+	case "", "reject", "blackhole":
+	default:
+		c.tcp = tcpClientMap[r.tcpClientName]
+		if c.tcp == nil {
+			return routeClients{}, fmt.Errorf("TCP client not found: %s", r.tcpClientName)
+		}
+		if r.ipFamily != conn.IPFamilyPolicyDefault {
+			c.tcp = NewIPFamilyTCPClient(c.tcp, r.ipFamily)
+		}
 	}
-	return r.udpClient, nil
+
+	switch r.udpClientName {
+	case "", "reject", "blackhole":
+	default:
+		c.udp = udpClientMap[r.udpClientName]
+		if c.udp == nil {
+			return routeClients{}, fmt.Errorf("UDP client not found: %s", r.udpClientName)
+		}
+		if r.udpPinnedTargetAddr.IsValid() {
+			c.udp = NewPinnedTargetUDPClient(c.udp, r.udpPinnedTargetAddr)
+		}
+		if r.udpNATTimeout != 0 {
+			c.udp = NewNATTimeoutUDPClient(c.udp, r.udpNATTimeout)
+		}
+		if r.ipFamily != conn.IPFamilyPolicyDefault {
+			c.udp = NewIPFamilyUDPClient(c.udp, r.ipFamily)
+		}
+	}
+
+	return c, nil
+}
+
+// routeClients contains the clients bound to a route.
+type routeClients struct {
+	tcp zerocopy.TCPClient
+	udp zerocopy.UDPClient
 }
 
 // Criterion is used by [Route] to determine whether a request matches the route.
 type Criterion interface {
 	// Meet returns whether the request meets the criterion.
-	Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error)
+	Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error)
 }
 
 // InvertedCriterion is like the inner criterion, but inverted.
@@ -499,7 +806,7 @@ type InvertedCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c InvertedCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c InvertedCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	met, err := c.Inner.Meet(ctx, network, requestInfo)
 	if err != nil {
 		return false, err
@@ -521,7 +828,7 @@ func (g *CriterionGroupOR) AddCriterion(criterion Criterion, invert bool) {
 }
 
 // Meet returns whether the request meets any of the criteria.
-func (g CriterionGroupOR) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (g CriterionGroupOR) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	for _, criterion := range g.Criteria {
 		met, err := criterion.Meet(ctx, network, requestInfo)
 		if err != nil {
@@ -561,17 +868,35 @@ func (g CriterionGroupOR) AppendTo(criteria []Criterion) []Criterion {
 	}
 }
 
-type protocol byte
+// Protocol is the transport protocol of a request.
+type Protocol byte
 
 const (
-	protocolTCP protocol = iota
-	protocolUDP
+	ProtocolTCP Protocol = iota
+	ProtocolUDP
 )
 
+// String returns the string representation of the protocol.
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolUDP:
+		return "udp"
+	default:
+		return "unknown"
+	}
+}
+
 // RequestInfo contains information about a request that can be met by one or more criteria.
 type RequestInfo struct {
-	ServerIndex    int
-	Username       string
+	ServerIndex int
+	Username    string
+
+	// ListenAddrPort is the local address of the server listener that received the request.
+	// It is invalid if the request was not received on a listener.
+	ListenAddrPort netip.AddrPort
+
 	SourceAddrPort netip.AddrPort
 	TargetAddr     conn.Addr
 }
@@ -580,23 +905,23 @@ type RequestInfo struct {
 type NetworkTCPCriterion struct{}
 
 // Meet implements the Criterion Meet method.
-func (NetworkTCPCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
-	return network == protocolTCP, nil
+func (NetworkTCPCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	return network == ProtocolTCP, nil
 }
 
 // NetworkUDPCriterion restricts the network to UDP.
 type NetworkUDPCriterion struct{}
 
 // Meet implements the Criterion Meet method.
-func (NetworkUDPCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
-	return network == protocolUDP, nil
+func (NetworkUDPCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	return network == ProtocolUDP, nil
 }
 
 // SourceServerCriterion restricts the source server.
 type SourceServerCriterion bitset.BitSet
 
 // Meet implements the Criterion Meet method.
-func (c SourceServerCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c SourceServerCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return bitset.BitSet(c).IsSet(uint(requestInfo.ServerIndex)), nil
 }
 
@@ -604,7 +929,7 @@ func (c SourceServerCriterion) Meet(ctx context.Context, network protocol, reque
 type SourceUserCriterion []string
 
 // Meet implements the Criterion Meet method.
-func (c SourceUserCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c SourceUserCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return slices.Contains(c, requestInfo.Username), nil
 }
 
@@ -612,7 +937,7 @@ func (c SourceUserCriterion) Meet(ctx context.Context, network protocol, request
 type SourcePortCriterion uint16
 
 // Meet implements the Criterion Meet method.
-func (c SourcePortCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c SourcePortCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return uint16(c) == requestInfo.SourceAddrPort.Port(), nil
 }
 
@@ -620,7 +945,7 @@ func (c SourcePortCriterion) Meet(ctx context.Context, network protocol, request
 type SourcePortRangeSetCriterion portset.PortRangeSet
 
 // Meet implements the Criterion Meet method.
-func (c SourcePortRangeSetCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c SourcePortRangeSetCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return portset.PortRangeSet(c).Contains(requestInfo.SourceAddrPort.Port()), nil
 }
 
@@ -628,15 +953,39 @@ func (c SourcePortRangeSetCriterion) Meet(ctx context.Context, network protocol,
 type SourcePortSetCriterion portset.PortSet
 
 // Meet implements the Criterion Meet method.
-func (c *SourcePortSetCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c *SourcePortSetCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return (*portset.PortSet)(c).Contains(requestInfo.SourceAddrPort.Port()), nil
 }
 
+// ListenPortCriterion restricts the port of the server listener.
+type ListenPortCriterion uint16
+
+// Meet implements the Criterion Meet method.
+func (c ListenPortCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	return uint16(c) == requestInfo.ListenAddrPort.Port(), nil
+}
+
+// ListenPortRangeSetCriterion restricts the port of the server listener to ports in a port range set.
+type ListenPortRangeSetCriterion portset.PortRangeSet
+
+// Meet implements the Criterion Meet method.
+func (c ListenPortRangeSetCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	return portset.PortRangeSet(c).Contains(requestInfo.ListenAddrPort.Port()), nil
+}
+
+// ListenPortSetCriterion restricts the port of the server listener to ports in a port set.
+type ListenPortSetCriterion portset.PortSet
+
+// Meet implements the Criterion Meet method.
+func (c *ListenPortSetCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	return (*portset.PortSet)(c).Contains(requestInfo.ListenAddrPort.Port()), nil
+}
+
 // SourceIPCriterion restricts the source IP address.
 type SourceIPCriterion netipx.IPSet
 
 // Meet implements the Criterion Meet method.
-func (c *SourceIPCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c *SourceIPCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return (*netipx.IPSet)(c).Contains(requestInfo.SourceAddrPort.Addr().Unmap()), nil
 }
 
@@ -648,15 +997,27 @@ type SourceGeoIPCountryCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c SourceGeoIPCountryCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c SourceGeoIPCountryCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return matchAddrToGeoIPCountries(c.countries, requestInfo.SourceAddrPort.Addr(), c.geoip, c.logger)
 }
 
+// SourceASNCriterion restricts the source IP address by autonomous system number.
+type SourceASNCriterion struct {
+	asns   []uint
+	asn    *geoip2.Reader
+	logger *zap.Logger
+}
+
+// Meet implements the Criterion Meet method.
+func (c SourceASNCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	return matchAddrToASNs(c.asns, requestInfo.SourceAddrPort.Addr(), c.asn, c.logger)
+}
+
 // DestPortCriterion restricts the destination port.
 type DestPortCriterion uint16
 
 // Meet implements the Criterion Meet method.
-func (c DestPortCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestPortCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return uint16(c) == requestInfo.TargetAddr.Port(), nil
 }
 
@@ -664,7 +1025,7 @@ func (c DestPortCriterion) Meet(ctx context.Context, network protocol, requestIn
 type DestPortRangeSetCriterion portset.PortRangeSet
 
 // Meet implements the Criterion Meet method.
-func (c DestPortRangeSetCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestPortRangeSetCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return portset.PortRangeSet(c).Contains(requestInfo.TargetAddr.Port()), nil
 }
 
@@ -672,7 +1033,7 @@ func (c DestPortRangeSetCriterion) Meet(ctx context.Context, network protocol, r
 type DestPortSetCriterion portset.PortSet
 
 // Meet implements the Criterion Meet method.
-func (c *DestPortSetCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c *DestPortSetCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	return (*portset.PortSet)(c).Contains(requestInfo.TargetAddr.Port()), nil
 }
 
@@ -680,7 +1041,7 @@ func (c *DestPortSetCriterion) Meet(ctx context.Context, network protocol, reque
 type DestDomainCriterion []domainset.DomainSet
 
 // Meet implements the Criterion Meet method.
-func (c DestDomainCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestDomainCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	if requestInfo.TargetAddr.IsIP() {
 		return false, nil
 	}
@@ -694,7 +1055,7 @@ type DestDomainExpectedIPCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c DestDomainExpectedIPCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestDomainExpectedIPCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	met, err := c.destDomainCriterion.Meet(ctx, network, requestInfo)
 	if !met {
 		return false, err
@@ -706,7 +1067,7 @@ func (c DestDomainExpectedIPCriterion) Meet(ctx context.Context, network protoco
 type DestIPCriterion netipx.IPSet
 
 // Meet implements the Criterion Meet method.
-func (c *DestIPCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c *DestIPCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	if !requestInfo.TargetAddr.IsIP() {
 		return false, nil
 	}
@@ -720,7 +1081,7 @@ type DestResolvedIPCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c DestResolvedIPCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestResolvedIPCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	if requestInfo.TargetAddr.IsIP() {
 		return c.ipSet.Contains(requestInfo.TargetAddr.IP().Unmap()), nil
 	}
@@ -735,7 +1096,7 @@ type DestGeoIPCountryCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c DestGeoIPCountryCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestGeoIPCountryCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	if !requestInfo.TargetAddr.IsIP() {
 		return false, nil
 	}
@@ -751,13 +1112,63 @@ type DestResolvedGeoIPCountryCriterion struct {
 }
 
 // Meet implements the Criterion Meet method.
-func (c DestResolvedGeoIPCountryCriterion) Meet(ctx context.Context, network protocol, requestInfo RequestInfo) (bool, error) {
+func (c DestResolvedGeoIPCountryCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
 	if requestInfo.TargetAddr.IsIP() {
 		return matchAddrToGeoIPCountries(c.countries, requestInfo.TargetAddr.IP(), c.geoip, c.logger)
 	}
 	return matchDomainToGeoIPCountries(ctx, c.resolvers, requestInfo.TargetAddr.Domain(), c.countries, c.geoip, c.logger)
 }
 
+// DestASNCriterion restricts the destination IP address by autonomous system number.
+type DestASNCriterion struct {
+	asns   []uint
+	asn    *geoip2.Reader
+	logger *zap.Logger
+}
+
+// Meet implements the Criterion Meet method.
+func (c DestASNCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	if !requestInfo.TargetAddr.IsIP() {
+		return false, nil
+	}
+	return matchAddrToASNs(c.asns, requestInfo.TargetAddr.IP(), c.asn, c.logger)
+}
+
+// DestResolvedASNCriterion restricts the destination IP address or the destination domain's resolved IP address by autonomous system number.
+type DestResolvedASNCriterion struct {
+	asns      []uint
+	asn       *geoip2.Reader
+	logger    *zap.Logger
+	resolvers []dns.SimpleResolver
+}
+
+// Meet implements the Criterion Meet method.
+func (c DestResolvedASNCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	if requestInfo.TargetAddr.IsIP() {
+		return matchAddrToASNs(c.asns, requestInfo.TargetAddr.IP(), c.asn, c.logger)
+	}
+	ip, err := lookup(ctx, c.resolvers, requestInfo.TargetAddr.Domain())
+	if err != nil {
+		return false, err
+	}
+	return matchAddrToASNs(c.asns, ip, c.asn, c.logger)
+}
+
+func matchAddrToASNs(asns []uint, addr netip.Addr, asn *geoip2.Reader, logger *zap.Logger) (bool, error) {
+	record, err := asn.ASN(addr.AsSlice())
+	if err != nil {
+		return false, err
+	}
+	if ce := logger.Check(zap.DebugLevel, "Matched ASN"); ce != nil {
+		ce.Write(
+			zap.Stringer("ip", addr),
+			zap.Uint("asn", record.AutonomousSystemNumber),
+			zap.String("organization", record.AutonomousSystemOrganization),
+		)
+	}
+	return slices.Contains(asns, record.AutonomousSystemNumber), nil
+}
+
 func matchAddrToGeoIPCountries(countries []string, addr netip.Addr, geoip *geoip2.Reader, logger *zap.Logger) (bool, error) {
 	country, err := geoip.Country(addr.AsSlice())
 	if err != nil {
@@ -807,3 +1218,36 @@ func matchDomainToIPSet(ctx context.Context, resolvers []dns.SimpleResolver, dom
 	}
 	return ipSet.Contains(ip.Unmap()), nil
 }
+
+// ScriptCriterion restricts the request to those for which a script evaluates to true.
+type ScriptCriterion struct {
+	program     *routescript.Program
+	timeout     time.Duration
+	serverNames []string
+}
+
+// Meet implements the Criterion Meet method.
+func (c *ScriptCriterion) Meet(ctx context.Context, network Protocol, requestInfo RequestInfo) (bool, error) {
+	env := routescript.Env{
+		Network:        network.String(),
+		User:           requestInfo.Username,
+		ListenPort:     requestInfo.ListenAddrPort.Port(),
+		SourceAddrPort: requestInfo.SourceAddrPort,
+		TargetPort:     requestInfo.TargetAddr.Port(),
+		Time:           time.Now(),
+	}
+	if uint(requestInfo.ServerIndex) < uint(len(c.serverNames)) {
+		env.Server = c.serverNames[requestInfo.ServerIndex]
+	}
+	if requestInfo.TargetAddr.IsIP() {
+		env.TargetIP = requestInfo.TargetAddr.IP()
+	} else {
+		env.TargetDomain = requestInfo.TargetAddr.Domain()
+	}
+
+	met, err := c.program.Eval(&env, c.timeout)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate script: %w", err)
+	}
+	return met, nil
+}
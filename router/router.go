@@ -1,8 +1,19 @@
+// Package router implements the rule-based routing engine.
+//
+// The router can be used standalone as a library, without any relay services:
+// create it with [Config.StandaloneRouter], and evaluate requests with [Router.Match].
+// Clients can be bound later with [Router.BindClients].
 package router
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/dns"
 	"github.com/database64128/shadowsocks-go/domainset"
@@ -18,43 +29,38 @@ type Config struct {
 	DefaultTCPClientName  string             `json:"defaultTCPClientName"`
 	DefaultUDPClientName  string             `json:"defaultUDPClientName"`
 	GeoLite2CountryDbPath string             `json:"geoLite2CountryDbPath"`
+	GeoLite2ASNDbPath     string             `json:"geoLite2ASNDbPath"`
 	DomainSets            []domainset.Config `json:"domainSets"`
 	PrefixSets            []prefixset.Config `json:"prefixSets"`
 	Routes                []RouteConfig      `json:"routes"`
 }
 
-// Router creates a router from the RouterConfig.
-func (rc *Config) Router(logger *zap.Logger, resolvers []dns.SimpleResolver, resolverMap map[string]dns.SimpleResolver, tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient, serverIndexByName map[string]int) (r *Router, err error) {
-	defaultRoute := Route{name: "default"}
-
-	switch rc.DefaultTCPClientName {
-	case "reject":
-	case "":
-		if len(tcpClientMap) == 1 {
-			for _, tcpClient := range tcpClientMap {
-				defaultRoute.tcpClient = tcpClient
-			}
-		}
-	default:
-		defaultRoute.tcpClient = tcpClientMap[rc.DefaultTCPClientName]
-		if defaultRoute.tcpClient == nil {
-			return nil, fmt.Errorf("default TCP client not found: %q", rc.DefaultTCPClientName)
-		}
+// Router creates a router from the RouterConfig and binds it to the clients.
+func (rc *Config) Router(logger *zap.Logger, resolvers []dns.SimpleResolver, resolverMap map[string]dns.SimpleResolver, tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient, serverIndexByName map[string]int) (*Router, error) {
+	r, err := rc.StandaloneRouter(logger, resolvers, resolverMap, serverIndexByName)
+	if err != nil {
+		return nil, err
 	}
+	if err = r.BindClients(tcpClientMap, udpClientMap); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	return r, nil
+}
 
-	switch rc.DefaultUDPClientName {
-	case "reject":
-	case "":
-		if len(udpClientMap) == 1 {
-			for _, udpClient := range udpClientMap {
-				defaultRoute.udpClient = udpClient
-			}
-		}
-	default:
-		defaultRoute.udpClient = udpClientMap[rc.DefaultUDPClientName]
-		if defaultRoute.udpClient == nil {
-			return nil, fmt.Errorf("default UDP client not found: %q", rc.DefaultUDPClientName)
-		}
+// StandaloneRouter creates a router from the RouterConfig without binding it to any clients.
+//
+// The returned router can evaluate routing rules with [Router.Match], which makes it possible
+// to reuse the routing engine without any relay services. To get clients from the router,
+// call [Router.BindClients] first.
+//
+// serverIndexByName maps server names in route configs to [RequestInfo.ServerIndex].
+// It may be nil if no route matches on source servers.
+func (rc *Config) StandaloneRouter(logger *zap.Logger, resolvers []dns.SimpleResolver, resolverMap map[string]dns.SimpleResolver, serverIndexByName map[string]int) (r *Router, err error) {
+	defaultRoute := Route{
+		name:          "default",
+		tcpClientName: rc.DefaultTCPClientName,
+		udpClientName: rc.DefaultUDPClientName,
 	}
 
 	var geoip *geoip2.Reader
@@ -71,13 +77,33 @@ func (rc *Config) Router(logger *zap.Logger, resolvers []dns.SimpleResolver, res
 		}()
 	}
 
+	var asn *geoip2.Reader
+
+	if rc.GeoLite2ASNDbPath != "" {
+		asn, err = geoip2.Open(rc.GeoLite2ASNDbPath)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				_ = asn.Close()
+			}
+		}()
+	}
+
 	domainSetMap := make(map[string]domainset.DomainSet, len(rc.DomainSets))
+	var domainSetUpdaters []*domainset.Updater
 
 	for _, dsc := range rc.DomainSets {
 		domainSet, err := dsc.DomainSet()
 		if err != nil {
 			return nil, fmt.Errorf("failed to load domain set %q: %w", dsc.Name, err)
 		}
+		if dsc.UpdateInterval > 0 {
+			u := dsc.NewUpdater(domainSet, logger)
+			domainSet = u.DomainSet()
+			domainSetUpdaters = append(domainSetUpdaters, u)
+		}
 		domainSetMap[dsc.Name] = domainSet
 	}
 
@@ -94,7 +120,7 @@ func (rc *Config) Router(logger *zap.Logger, resolvers []dns.SimpleResolver, res
 	routes := make([]Route, len(rc.Routes)+1)
 
 	for i := range rc.Routes {
-		route, err := rc.Routes[i].Route(geoip, logger, resolvers, resolverMap, tcpClientMap, udpClientMap, serverIndexByName, domainSetMap, prefixSetMap)
+		route, err := rc.Routes[i].Route(geoip, asn, logger, resolvers, resolverMap, serverIndexByName, domainSetMap, prefixSetMap)
 		if err != nil {
 			return nil, err
 		}
@@ -103,37 +129,512 @@ func (rc *Config) Router(logger *zap.Logger, resolvers []dns.SimpleResolver, res
 
 	routes[len(rc.Routes)] = defaultRoute
 
-	return &Router{
-		geoip:  geoip,
-		logger: logger,
-		routes: routes,
-	}, nil
+	for _, u := range domainSetUpdaters {
+		u.Start()
+	}
+
+	r = &Router{}
+	r.state.Store(&routerState{
+		resources: &routeResources{
+			geoip:             geoip,
+			asn:               asn,
+			serverIndexByName: serverIndexByName,
+			domainSetMap:      domainSetMap,
+			prefixSetMap:      prefixSetMap,
+			domainSetUpdaters: domainSetUpdaters,
+		},
+		logger:       logger,
+		routes:       routes,
+		routeConfigs: slices.Clone(rc.Routes),
+		hits:         make([]routeHits, len(routes)),
+		resolvers:    resolvers,
+		resolverMap:  resolverMap,
+	})
+	return r, nil
 }
 
+// ErrClientsNotBound is returned when getting clients from a router without bound clients.
+var ErrClientsNotBound = errors.New("router is not bound to any clients")
+
 // Router looks up the destination client for requests received by servers.
+//
+// Router is safe for concurrent use.
 type Router struct {
-	geoip  *geoip2.Reader
-	logger *zap.Logger
-	routes []Route
+	state atomic.Pointer[routerState]
+
+	// mu serializes replacements of the state, and protects the fields below.
+	mu sync.Mutex
+
+	// override is the changes made with [Router.ReplaceRoutes] and [Router.PatchRoutes],
+	// which [Router.Replace] applies again to the new routes. Nil if there are none.
+	override *routesOverride
+
+	// routesChanged is called after the routes are changed with
+	// [Router.ReplaceRoutes] or [Router.PatchRoutes].
+	routesChanged func()
 }
 
-// Close closes the router.
-func (r *Router) Close() error {
-	if r.geoip != nil {
-		return r.geoip.Close()
+// routesOverride is the changes made to the routes at runtime.
+type routesOverride struct {
+	// replaced is whether routes replaces the routes from the configuration.
+	replaced bool
+
+	// routes is the replacement routes, if replaced is true.
+	routes []RouteConfig
+
+	// patches are applied to the routes from the configuration, if replaced is false.
+	patches []RoutesPatch
+}
+
+// apply applies the changes to the routes from the configuration.
+// Deleting a route that no longer exists is not an error.
+func (o *routesOverride) apply(configs []RouteConfig) ([]RouteConfig, error) {
+	if o.replaced {
+		return slices.Clone(o.routes), nil
+	}
+	routes := slices.Clone(configs)
+	for _, patch := range o.patches {
+		var err error
+		if routes, err = patch.apply(routes, false); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+// routerState is the routes of a router and the resources they use.
+// It is replaced as a whole by [Router.Replace], and with the same resources
+// by [Router.ReplaceRoutes] and [Router.PatchRoutes].
+type routerState struct {
+	resources    *routeResources
+	logger       *zap.Logger
+	routes       []Route
+	routeConfigs []RouteConfig
+	hits         []routeHits
+	clients      atomic.Pointer[boundClients]
+	resolvers    []dns.SimpleResolver
+	resolverMap  map[string]dns.SimpleResolver
+}
+
+// routeResources is what routes are created with, other than DNS resolvers.
+type routeResources struct {
+	geoip             *geoip2.Reader
+	asn               *geoip2.Reader
+	serverIndexByName map[string]int
+	domainSetMap      map[string]domainset.DomainSet
+	prefixSetMap      map[string]*netipx.IPSet
+	domainSetUpdaters []*domainset.Updater
+}
+
+// boundClients is the clients bound to the routes, and the client maps they were bound from.
+type boundClients struct {
+	clients      []routeClients
+	tcpClientMap map[string]zerocopy.TCPClient
+	udpClientMap map[string]zerocopy.UDPClient
+}
+
+// replacedStateCloseDelay is how long a replaced router state is kept open
+// for lookups that started before the replacement.
+const replacedStateCloseDelay = time.Minute
+
+// Replace replaces the routes and bound clients of the router with those of src,
+// which must not be used afterwards. Requests that started before the replacement
+// finish with the old routes, which are closed after a delay.
+//
+// Changes made with [Router.ReplaceRoutes] and [Router.PatchRoutes] are applied again
+// to the routes of src. If they no longer apply, for example because a route refers to
+// a client that was removed, they are dropped with a warning, and the routes of src are used.
+//
+// Hit counters of the new routes start from zero.
+func (r *Router) Replace(src *Router) {
+	r.mu.Lock()
+	old := r.state.Load()
+	s := src.state.Load()
+	if r.override == nil {
+		r.state.Store(s)
+	} else {
+		routes, err := r.override.apply(s.routeConfigs)
+		if err == nil {
+			err = r.replaceRoutes(s, routes)
+		}
+		if err != nil {
+			s.logger.Warn("Dropped routes changed at runtime", zap.Error(err))
+			r.override = nil
+			r.state.Store(s)
+		}
+	}
+	r.mu.Unlock()
+	time.AfterFunc(replacedStateCloseDelay, func() {
+		if err := old.close(); err != nil {
+			old.logger.Warn("Failed to close replaced router state", zap.Error(err))
+		}
+	})
+}
+
+// SetRoutesChangedFunc sets the function to call after the routes are changed
+// with [Router.ReplaceRoutes] or [Router.PatchRoutes].
+func (r *Router) SetRoutesChangedFunc(f func()) {
+	r.mu.Lock()
+	r.routesChanged = f
+	r.mu.Unlock()
+}
+
+// Routes returns the configs of the routes, in the order of evaluation.
+// The default route is not included.
+func (r *Router) Routes() []RouteConfig {
+	return slices.Clone(r.state.Load().routeConfigs)
+}
+
+// ReplaceRoutes replaces the routes of the router with routes, without changing
+// the default route, GeoLite2 databases, domain sets, prefix sets, resolvers or bound clients.
+// Requests that started before the replacement finish with the old routes.
+// Existing connections and sessions are not affected.
+//
+// The new routes are validated, and bound to the clients if the router has bound clients,
+// before they replace the old ones. On error, the router is left unchanged.
+//
+// Hit counters are carried over to new routes with the same names.
+//
+// The new routes also replace the routes from the configuration on later calls to [Router.Replace].
+func (r *Router) ReplaceRoutes(routes []RouteConfig) error {
+	r.mu.Lock()
+	routes = slices.Clone(routes)
+	err := r.replaceRoutes(r.state.Load(), routes)
+	if err == nil {
+		r.override = &routesOverride{
+			replaced: true,
+			routes:   routes,
+		}
+	}
+	routesChanged := r.routesChanged
+	r.mu.Unlock()
+
+	if err == nil && routesChanged != nil {
+		routesChanged()
+	}
+	return err
+}
+
+// RoutesPatch is a set of changes to the routes of a router.
+//
+// Routes are identified by name. Every route in the patch must have a non-empty name,
+// and a route it changes must be the only one with that name.
+type RoutesPatch struct {
+	// Delete removes the routes with these names.
+	Delete []string `json:"delete"`
+
+	// Upsert replaces routes with the same names in place,
+	// and appends the others after the existing routes, before the default route.
+	Upsert []RouteConfig `json:"upsert"`
+}
+
+// apply returns routes with the patch applied. Deletions are applied before upserts.
+// If strict is true, deleting a route that does not exist is an error.
+func (p RoutesPatch) apply(routes []RouteConfig, strict bool) ([]RouteConfig, error) {
+	for _, name := range p.Delete {
+		i, err := routeIndex(routes, name)
+		if err != nil {
+			return nil, err
+		}
+		if i == -1 {
+			if strict {
+				return nil, fmt.Errorf("route not found: %s", name)
+			}
+			continue
+		}
+		routes = slices.Delete(routes, i, i+1)
+	}
+
+	for j, rc := range p.Upsert {
+		if slices.ContainsFunc(p.Upsert[:j], func(prev RouteConfig) bool { return prev.Name == rc.Name }) {
+			return nil, fmt.Errorf("duplicate route in upsert: %s", rc.Name)
+		}
+		i, err := routeIndex(routes, rc.Name)
+		if err != nil {
+			return nil, err
+		}
+		if i != -1 {
+			routes[i] = rc
+		} else {
+			routes = append(routes, rc)
+		}
+	}
+
+	return routes, nil
+}
+
+// routeIndex returns the index of the route named name in routes, or -1 if there is none.
+// It returns an error if name is empty, or if more than one route is named name.
+func routeIndex(routes []RouteConfig, name string) (int, error) {
+	if name == "" {
+		return -1, errors.New("route name must not be empty")
+	}
+	index := -1
+	for i := range routes {
+		if routes[i].Name != name {
+			continue
+		}
+		if index != -1 {
+			return -1, fmt.Errorf("route name is not unique: %s", name)
+		}
+		index = i
+	}
+	return index, nil
+}
+
+// PatchRoutes applies the patch to the routes of the router, like [Router.ReplaceRoutes].
+// Deletions are applied before upserts. Deleting a route that does not exist is an error.
+//
+// The patch is also applied to the routes from the configuration on later calls to [Router.Replace],
+// where deleting a route that no longer exists is not an error.
+func (r *Router) PatchRoutes(patch RoutesPatch) error {
+	r.mu.Lock()
+	s := r.state.Load()
+	routes, err := patch.apply(slices.Clone(s.routeConfigs), true)
+	if err == nil {
+		err = r.replaceRoutes(s, routes)
+	}
+	if err == nil {
+		switch {
+		case r.override == nil:
+			r.override = &routesOverride{patches: []RoutesPatch{patch}}
+		case r.override.replaced:
+			r.override.routes = slices.Clone(routes)
+		default:
+			r.override.patches = append(r.override.patches, patch)
+		}
 	}
+	routesChanged := r.routesChanged
+	r.mu.Unlock()
+
+	if err == nil && routesChanged != nil {
+		routesChanged()
+	}
+	return err
+}
+
+// replaceRoutes creates routes from configs with the resources of s,
+// and replaces s with a state with the new routes. It must be called with r.mu held.
+func (r *Router) replaceRoutes(s *routerState, configs []RouteConfig) error {
+	res := s.resources
+	routes := make([]Route, len(configs)+1)
+
+	for i := range configs {
+		route, err := configs[i].Route(res.geoip, res.asn, s.logger, s.resolvers, s.resolverMap, res.serverIndexByName, res.domainSetMap, res.prefixSetMap)
+		if err != nil {
+			return fmt.Errorf("failed to create route %s: %w", configs[i].Name, err)
+		}
+		routes[i] = route
+	}
+
+	routes[len(configs)] = s.routes[len(s.routes)-1]
+
+	ns := &routerState{
+		resources:    res,
+		logger:       s.logger,
+		routes:       routes,
+		routeConfigs: configs,
+		hits:         make([]routeHits, len(routes)),
+		resolvers:    s.resolvers,
+		resolverMap:  s.resolverMap,
+	}
+
+	if bc := s.clients.Load(); bc != nil {
+		nbc, err := ns.bindClients(bc.tcpClientMap, bc.udpClientMap)
+		if err != nil {
+			return err
+		}
+		ns.clients.Store(nbc)
+	}
+
+	oldIndexByName := make(map[string]int, len(s.routes))
+	for i := range s.routes {
+		if _, ok := oldIndexByName[s.routes[i].name]; !ok {
+			oldIndexByName[s.routes[i].name] = i
+		}
+	}
+	for i := range ns.routes {
+		if j, ok := oldIndexByName[ns.routes[i].name]; ok {
+			ns.hits[i].tcp.Store(s.hits[j].tcp.Load())
+			ns.hits[i].udp.Store(s.hits[j].udp.Load())
+		}
+	}
+
+	r.state.Store(ns)
+
+	s.logger.Info("Replaced routes", zap.Int("routes", len(configs)))
+	return nil
+}
+
+// Resolver returns the resolver named name. If name is empty, the returned resolver
+// tries the router's resolvers in order, like routes without a resolver do.
+//
+// The resolver is looked up in the current routes, so hold on to it only for a single lookup.
+func (r *Router) Resolver(name string) (dns.SimpleResolver, error) {
+	s := r.state.Load()
+	if name == "" {
+		if len(s.resolvers) == 0 {
+			return nil, errNoAvailableResolvers
+		}
+		return resolverChain(s.resolvers), nil
+	}
+	resolver, ok := s.resolverMap[name]
+	if !ok {
+		return nil, fmt.Errorf("resolver not found: %s", name)
+	}
+	return resolver, nil
+}
+
+// LookupIPs looks up name with the router's resolvers in order, and returns all associated IP addresses.
+// It follows router reloads.
+func (r *Router) LookupIPs(ctx context.Context, name string) ([]netip.Addr, error) {
+	return resolverChain(r.state.Load().resolvers).LookupIPs(ctx, name)
+}
+
+// resolverChain is a list of resolvers tried in order.
+// It implements [dns.SimpleResolver].
+type resolverChain []dns.SimpleResolver
+
+// LookupIP implements [dns.SimpleResolver.LookupIP].
+func (c resolverChain) LookupIP(ctx context.Context, name string) (netip.Addr, error) {
+	return lookup(ctx, c, name)
+}
+
+// LookupIPs implements [dns.SimpleResolver.LookupIPs].
+func (c resolverChain) LookupIPs(ctx context.Context, name string) ([]netip.Addr, error) {
+	for _, resolver := range c {
+		ips, err := resolver.LookupIPs(ctx, name)
+		if err == dns.ErrLookup {
+			continue
+		}
+		return ips, err
+	}
+	return nil, errNoAvailableResolvers
+}
+
+// routeHits counts the requests matched by a route.
+type routeHits struct {
+	tcp atomic.Uint64
+	udp atomic.Uint64
+}
+
+// RouteStats contains the number of requests matched by a route.
+type RouteStats struct {
+	Name    string `json:"name"`
+	TCPHits uint64 `json:"tcpHits"`
+	UDPHits uint64 `json:"udpHits"`
+}
+
+// Stats returns the number of TCP connections and UDP sessions routed by each route,
+// in the order of evaluation. The last route is the default route.
+//
+// Requests evaluated by [Router.Match] are not counted.
+func (r *Router) Stats() []RouteStats {
+	s := r.state.Load()
+	stats := make([]RouteStats, len(s.routes))
+	for i := range s.routes {
+		stats[i] = RouteStats{
+			Name:    s.routes[i].name,
+			TCPHits: s.hits[i].tcp.Load(),
+			UDPHits: s.hits[i].udp.Load(),
+		}
+	}
+	return stats
+}
+
+// BindClients binds the router's routes to clients in the client maps.
+// It may be called again to replace the bound clients while the router is in use.
+//
+// If the default route does not specify a client, and the client map has exactly one client,
+// that client is used as the default client.
+func (r *Router) BindClients(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.state.Load()
+	bc, err := s.bindClients(tcpClientMap, udpClientMap)
+	if err != nil {
+		return err
+	}
+	s.clients.Store(bc)
 	return nil
 }
 
+// bindClients returns the clients in the client maps bound to the routes.
+func (s *routerState) bindClients(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient) (*boundClients, error) {
+	clients := make([]routeClients, len(s.routes))
+
+	for i := range s.routes {
+		route := &s.routes[i]
+		c, err := route.bindClients(tcpClientMap, udpClientMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind clients for route %s: %w", route.name, err)
+		}
+		clients[i] = c
+	}
+
+	defaultRoute := &s.routes[len(s.routes)-1]
+	defaultClients := &clients[len(clients)-1]
+
+	if defaultRoute.tcpClientName == "" && len(tcpClientMap) == 1 {
+		for _, tcpClient := range tcpClientMap {
+			defaultClients.tcp = tcpClient
+		}
+	}
+
+	if defaultRoute.udpClientName == "" && len(udpClientMap) == 1 {
+		for _, udpClient := range udpClientMap {
+			defaultClients.udp = udpClient
+		}
+	}
+
+	return &boundClients{
+		clients:      clients,
+		tcpClientMap: tcpClientMap,
+		udpClientMap: udpClientMap,
+	}, nil
+}
+
+// Close stops the domain set updaters and closes the router.
+func (r *Router) Close() error {
+	return r.state.Load().close()
+}
+
+// close stops the domain set updaters and closes the GeoLite2 databases.
+func (s *routerState) close() error {
+	res := s.resources
+
+	for _, u := range res.domainSetUpdaters {
+		u.Stop()
+	}
+
+	var geoipErr, asnErr error
+	if res.geoip != nil {
+		geoipErr = res.geoip.Close()
+	}
+	if res.asn != nil {
+		asnErr = res.asn.Close()
+	}
+	return errors.Join(geoipErr, asnErr)
+}
+
 // GetTCPClient returns the zerocopy.TCPClient for a TCP request received by server
 // from sourceAddrPort to targetAddr.
 func (r *Router) GetTCPClient(ctx context.Context, requestInfo RequestInfo) (zerocopy.TCPClient, error) {
-	route, err := r.match(ctx, protocolTCP, requestInfo)
+	s := r.state.Load()
+	bc := s.clients.Load()
+	if bc == nil {
+		return nil, ErrClientsNotBound
+	}
+
+	index, err := s.match(ctx, ProtocolTCP, requestInfo)
 	if err != nil {
 		return nil, err
 	}
+	route := &s.routes[index]
+	s.hits[index].tcp.Add(1)
 
-	if ce := r.logger.Check(zap.DebugLevel, "Matched route for TCP connection"); ce != nil {
+	if ce := s.logger.Check(zap.DebugLevel, "Matched route for TCP connection"); ce != nil {
 		ce.Write(
 			zap.Int("serverIndex", requestInfo.ServerIndex),
 			zap.String("username", requestInfo.Username),
@@ -143,18 +644,30 @@ func (r *Router) GetTCPClient(ctx context.Context, requestInfo RequestInfo) (zer
 		)
 	}
 
-	return route.TCPClient()
+	tcpClient := bc.clients[index].tcp
+	if tcpClient == nil {
+		return nil, route.rejectError(route.tcpClientName)
+	}
+	return tcpClient, nil
 }
 
 // GetUDPClient returns the zerocopy.UDPClient for a UDP session received by server.
 // The first received packet of the session is from sourceAddrPort to targetAddr.
 func (r *Router) GetUDPClient(ctx context.Context, requestInfo RequestInfo) (zerocopy.UDPClient, error) {
-	route, err := r.match(ctx, protocolUDP, requestInfo)
+	s := r.state.Load()
+	bc := s.clients.Load()
+	if bc == nil {
+		return nil, ErrClientsNotBound
+	}
+
+	index, err := s.match(ctx, ProtocolUDP, requestInfo)
 	if err != nil {
 		return nil, err
 	}
+	route := &s.routes[index]
+	s.hits[index].udp.Add(1)
 
-	if ce := r.logger.Check(zap.DebugLevel, "Matched route for UDP session"); ce != nil {
+	if ce := s.logger.Check(zap.DebugLevel, "Matched route for UDP session"); ce != nil {
 		ce.Write(
 			zap.Int("serverIndex", requestInfo.ServerIndex),
 			zap.String("username", requestInfo.Username),
@@ -164,18 +677,53 @@ func (r *Router) GetUDPClient(ctx context.Context, requestInfo RequestInfo) (zer
 		)
 	}
 
-	return route.UDPClient()
+	udpClient := bc.clients[index].udp
+	if udpClient == nil {
+		return nil, route.rejectError(route.udpClientName)
+	}
+	return udpClient, nil
+}
+
+// Decision is the result of matching a request against the routing rules.
+type Decision struct {
+	// Route is the name of the matched route.
+	Route string
+
+	// Client is the name of the client the request is routed to.
+	// It is "reject" or "blackhole" if the request is rejected by the route.
+	// It is empty if the request matched the default route and the default client is not specified.
+	Client string
 }
 
-// match returns the matched route for the new TCP request or UDP session.
-func (r *Router) match(ctx context.Context, network protocol, requestInfo RequestInfo) (*Route, error) {
-	for i := range r.routes {
-		matched, err := r.routes[i].Match(ctx, network, requestInfo)
+// Match evaluates the routing rules for a new TCP request or UDP session,
+// and returns the routing decision. It does not require bound clients.
+func (r *Router) Match(ctx context.Context, network Protocol, requestInfo RequestInfo) (Decision, error) {
+	s := r.state.Load()
+	index, err := s.match(ctx, network, requestInfo)
+	if err != nil {
+		return Decision{}, err
+	}
+	route := &s.routes[index]
+
+	d := Decision{Route: route.name}
+	switch network {
+	case ProtocolTCP:
+		d.Client = route.tcpClientName
+	case ProtocolUDP:
+		d.Client = route.udpClientName
+	}
+	return d, nil
+}
+
+// match returns the index of the matched route for the new TCP request or UDP session.
+func (s *routerState) match(ctx context.Context, network Protocol, requestInfo RequestInfo) (int, error) {
+	for i := range s.routes {
+		matched, err := s.routes[i].Match(ctx, network, requestInfo)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 		if matched {
-			return &r.routes[i], nil
+			return i, nil
 		}
 	}
 	panic("did not match default route")
@@ -0,0 +1,768 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+var testConfig = Config{
+	DefaultTCPClientName: "",
+	DefaultUDPClientName: "reject",
+	Routes: []RouteConfig{
+		{
+			Name:    "block-smtp",
+			Network: "tcp",
+			Client:  "reject",
+			ToPorts: []uint16{25},
+		},
+		{
+			Name:      "example",
+			Client:    "proxy",
+			ToDomains: []string{"example.com"},
+		},
+	},
+}
+
+func TestStandaloneRouterMatch(t *testing.T) {
+	r, err := testConfig.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	source := netip.MustParseAddrPort("[2001:db8::1]:12345")
+
+	for _, c := range []struct {
+		network    Protocol
+		targetAddr conn.Addr
+		expected   Decision
+	}{
+		{ProtocolTCP, conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:25")), Decision{Route: "block-smtp", Client: "reject"}},
+		{ProtocolUDP, conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:25")), Decision{Route: "default", Client: "reject"}},
+		{ProtocolTCP, conn.MustAddrFromDomainPort("example.com", 443), Decision{Route: "example", Client: "proxy"}},
+		{ProtocolUDP, conn.MustAddrFromDomainPort("example.com", 443), Decision{Route: "example", Client: "proxy"}},
+		{ProtocolTCP, conn.MustAddrFromDomainPort("example.org", 443), Decision{Route: "default", Client: ""}},
+	} {
+		d, err := r.Match(ctx, c.network, RequestInfo{
+			SourceAddrPort: source,
+			TargetAddr:     c.targetAddr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != c.expected {
+			t.Errorf("Match(%s, %s) = %+v, expected %+v", c.network, c.targetAddr, d, c.expected)
+		}
+	}
+
+	if _, err = r.GetTCPClient(ctx, RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.com", 443)}); err != ErrClientsNotBound {
+		t.Errorf("GetTCPClient() error = %v, expected %v", err, ErrClientsNotBound)
+	}
+}
+
+func TestRouterRejectModes(t *testing.T) {
+	rc := Config{
+		DefaultTCPClientName: "blackhole",
+		DefaultUDPClientName: "reject",
+		Routes: []RouteConfig{
+			{
+				Name:       "reset-smtp",
+				Client:     "reject",
+				RejectMode: RejectModeReset,
+				ToPorts:    []uint16{25},
+			},
+			{
+				Name:       "drop-ads",
+				Client:     "reject",
+				RejectMode: RejectModeDrop,
+				ToDomains:  []string{"ads.example.com"},
+			},
+		},
+	}
+	r, err := rc.Router(zap.NewNop(), nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		network    Protocol
+		targetAddr conn.Addr
+		expected   RejectMode
+	}{
+		{ProtocolTCP, conn.MustAddrFromDomainPort("example.org", 25), RejectModeReset},
+		{ProtocolUDP, conn.MustAddrFromDomainPort("example.org", 25), RejectModeReset},
+		{ProtocolTCP, conn.MustAddrFromDomainPort("ads.example.com", 443), RejectModeDrop},
+		{ProtocolUDP, conn.MustAddrFromDomainPort("ads.example.com", 443), RejectModeDrop},
+		{ProtocolTCP, conn.MustAddrFromDomainPort("example.org", 443), RejectModeDrop},
+		{ProtocolUDP, conn.MustAddrFromDomainPort("example.org", 443), RejectModeDefault},
+	} {
+		requestInfo := RequestInfo{TargetAddr: c.targetAddr}
+		if c.network == ProtocolTCP {
+			_, err = r.GetTCPClient(ctx, requestInfo)
+		} else {
+			_, err = r.GetUDPClient(ctx, requestInfo)
+		}
+		if !errors.Is(err, ErrRejected) {
+			t.Errorf("%s %s: error = %v, expected %v", c.network, c.targetAddr, err, ErrRejected)
+		}
+		mode, ok := RejectModeOf(err)
+		if !ok || mode != c.expected {
+			t.Errorf("%s %s: RejectModeOf() = %q, %t, expected %q, true", c.network, c.targetAddr, mode, ok, c.expected)
+		}
+	}
+
+	for _, rc := range []RouteConfig{
+		{Name: "unknown", Client: "reject", RejectMode: "tarpit"},
+		{Name: "not-reject", Client: "proxy", RejectMode: RejectModeDrop},
+		{Name: "blackhole", Client: "blackhole", RejectMode: RejectModeReset},
+	} {
+		if _, err = rc.Route(nil, nil, zap.NewNop(), nil, nil, nil, nil, nil); err == nil {
+			t.Errorf("Route(%+v) succeeded, expected error", rc)
+		}
+	}
+}
+
+func TestRouterBindClients(t *testing.T) {
+	r, err := testConfig.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	proxyTCP := direct.NewTCPClient("proxy", "tcp", conn.DefaultTCPDialer, 0)
+	proxyUDP := direct.NewDirectUDPClient("proxy", "udp", 1500, conn.ListenConfig{})
+
+	if err = r.BindClients(nil, nil); err == nil {
+		t.Error("BindClients() with missing clients succeeded")
+	}
+
+	tcpClientMap := map[string]zerocopy.TCPClient{"proxy": proxyTCP}
+	udpClientMap := map[string]zerocopy.UDPClient{"proxy": proxyUDP}
+	if err = r.BindClients(tcpClientMap, udpClientMap); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// The only TCP client is the default TCP client.
+	tcpClient, err := r.GetTCPClient(ctx, RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.org", 443)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcpClient != proxyTCP {
+		t.Errorf("GetTCPClient() = %v, expected %v", tcpClient, proxyTCP)
+	}
+
+	if _, err = r.GetTCPClient(ctx, RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.org", 25)}); !errors.Is(err, ErrRejected) {
+		t.Errorf("GetTCPClient() error = %v, expected %v", err, ErrRejected)
+	}
+
+	if _, err = r.GetUDPClient(ctx, RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.org", 443)}); !errors.Is(err, ErrRejected) {
+		t.Errorf("GetUDPClient() error = %v, expected %v", err, ErrRejected)
+	}
+
+	udpClient, err := r.GetUDPClient(ctx, RequestInfo{TargetAddr: conn.MustAddrFromDomainPort("example.com", 443)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udpClient != proxyUDP {
+		t.Errorf("GetUDPClient() = %v, expected %v", udpClient, proxyUDP)
+	}
+
+	expectedStats := []RouteStats{
+		{Name: "block-smtp", TCPHits: 1},
+		{Name: "example", UDPHits: 1},
+		{Name: "default", TCPHits: 1, UDPHits: 1},
+	}
+	if stats := r.Stats(); !slices.Equal(stats, expectedStats) {
+		t.Errorf("Stats() = %+v, expected %+v", stats, expectedStats)
+	}
+}
+
+func TestRouterReplace(t *testing.T) {
+	r, err := testConfig.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	config := Config{
+		DefaultTCPClientName: "proxy",
+		DefaultUDPClientName: "proxy",
+	}
+	src, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Replace(src)
+
+	ctx := context.Background()
+	d, err := r.Match(ctx, ProtocolTCP, RequestInfo{TargetAddr: conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:25"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Decision{Route: "default", Client: "proxy"}); d != expected {
+		t.Errorf("Match() = %+v, expected %+v", d, expected)
+	}
+
+	expectedStats := []RouteStats{{Name: "default"}}
+	if stats := r.Stats(); !slices.Equal(stats, expectedStats) {
+		t.Errorf("Stats() = %+v, expected %+v", stats, expectedStats)
+	}
+}
+
+func TestRouterReplaceRoutes(t *testing.T) {
+	r, err := testConfig.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	proxyTCP := direct.NewTCPClient("proxy", "tcp", conn.DefaultTCPDialer, 0)
+	proxyUDP := direct.NewDirectUDPClient("proxy", "udp", 1500, conn.ListenConfig{})
+	tcpClientMap := map[string]zerocopy.TCPClient{"proxy": proxyTCP}
+	udpClientMap := map[string]zerocopy.UDPClient{"proxy": proxyUDP}
+	if err = r.BindClients(tcpClientMap, udpClientMap); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	smtp := RequestInfo{TargetAddr: conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:25"))}
+	if _, err = r.GetTCPClient(ctx, smtp); err == nil {
+		t.Fatal("GetTCPClient() for SMTP succeeded before replacing routes")
+	}
+
+	// Invalid routes leave the router unchanged.
+	for _, routes := range [][]RouteConfig{
+		{{Name: "", Client: "proxy"}},
+		{{Name: "bad-client", Client: "nonexistent"}},
+		{{Name: "bad-domain-set", Client: "proxy", ToDomainSets: []string{"nonexistent"}}},
+	} {
+		if err = r.ReplaceRoutes(routes); err == nil {
+			t.Errorf("ReplaceRoutes(%+v) succeeded", routes)
+		}
+	}
+	if routes := r.Routes(); len(routes) != 2 || routes[0].Name != "block-smtp" || routes[1].Name != "example" {
+		t.Errorf("Routes() = %+v, expected the routes of testConfig", routes)
+	}
+
+	if err = r.ReplaceRoutes([]RouteConfig{
+		{
+			Name:    "allow-smtp",
+			Network: "tcp",
+			Client:  "proxy",
+			ToPorts: []uint16{25},
+		},
+		testConfig.Routes[1],
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tcpClient, err := r.GetTCPClient(ctx, smtp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcpClient != proxyTCP {
+		t.Errorf("GetTCPClient() = %v, expected %v", tcpClient, proxyTCP)
+	}
+
+	if err = r.PatchRoutes(RoutesPatch{Delete: []string{"nonexistent"}}); err == nil {
+		t.Error("PatchRoutes() deleting a nonexistent route succeeded")
+	}
+
+	if err = r.PatchRoutes(RoutesPatch{
+		Delete: []string{"example"},
+		Upsert: []RouteConfig{
+			{
+				Name:    "allow-smtp",
+				Network: "tcp",
+				Client:  "blackhole",
+				ToPorts: []uint16{25},
+			},
+			{
+				Name:      "example",
+				Client:    "reject",
+				ToDomains: []string{"example.com"},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := r.Match(ctx, ProtocolTCP, smtp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Decision{Route: "allow-smtp", Client: "blackhole"}); d != expected {
+		t.Errorf("Match() = %+v, expected %+v", d, expected)
+	}
+
+	// Hit counters are kept for routes with the same names.
+	expectedStats := []RouteStats{
+		{Name: "allow-smtp", TCPHits: 1},
+		{Name: "example"},
+		{Name: "default"},
+	}
+	if stats := r.Stats(); !slices.Equal(stats, expectedStats) {
+		t.Errorf("Stats() = %+v, expected %+v", stats, expectedStats)
+	}
+}
+
+func routeNames(r *Router) []string {
+	routes := r.Routes()
+	names := make([]string, len(routes))
+	for i := range routes {
+		names[i] = routes[i].Name
+	}
+	return names
+}
+
+func TestRouterPatchRoutesNames(t *testing.T) {
+	config := Config{
+		DefaultTCPClientName: "direct",
+		DefaultUDPClientName: "direct",
+		Routes: []RouteConfig{
+			{Name: "dup", Client: "reject", ToPorts: []uint16{25}},
+			{Name: "dup", Client: "reject", ToPorts: []uint16{465}},
+			{Name: "example", Client: "proxy", ToDomains: []string{"example.com"}},
+		},
+	}
+
+	r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, patch := range []RoutesPatch{
+		{Delete: []string{""}},
+		{Delete: []string{"dup"}},
+		{Upsert: []RouteConfig{{Client: "proxy", ToPorts: []uint16{80}}}},
+		{Upsert: []RouteConfig{{Name: "dup", Client: "proxy", ToPorts: []uint16{80}}}},
+		{Upsert: []RouteConfig{
+			{Name: "http", Client: "proxy", ToPorts: []uint16{80}},
+			{Name: "http", Client: "direct", ToPorts: []uint16{80}},
+		}},
+	} {
+		if err = r.PatchRoutes(patch); err == nil {
+			t.Errorf("PatchRoutes(%+v) succeeded", patch)
+		}
+	}
+
+	expectedNames := []string{"dup", "dup", "example"}
+	if names := routeNames(r); !slices.Equal(names, expectedNames) {
+		t.Errorf("routeNames() = %v, expected %v", names, expectedNames)
+	}
+
+	// Routes with unique names can still be patched.
+	if err = r.PatchRoutes(RoutesPatch{
+		Delete: []string{"example"},
+		Upsert: []RouteConfig{{Name: "http", Client: "proxy", ToPorts: []uint16{80}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNames = []string{"dup", "dup", "http"}
+	if names := routeNames(r); !slices.Equal(names, expectedNames) {
+		t.Errorf("routeNames() = %v, expected %v", names, expectedNames)
+	}
+}
+
+func TestRouterReplaceKeepsRouteChanges(t *testing.T) {
+	newRouter := func(t *testing.T, routes ...RouteConfig) *Router {
+		t.Helper()
+		config := Config{
+			DefaultTCPClientName: "direct",
+			DefaultUDPClientName: "direct",
+			Routes:               routes,
+		}
+		r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, map[string]int{"ss": 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	blockSMTP := RouteConfig{Name: "block-smtp", Network: "tcp", Client: "reject", ToPorts: []uint16{25}}
+	example := RouteConfig{Name: "example", Client: "proxy", ToDomains: []string{"example.com"}}
+	http := RouteConfig{Name: "http", Client: "proxy", ToPorts: []uint16{80}}
+	ss := RouteConfig{Name: "ss", Client: "proxy", FromServers: []string{"ss"}}
+
+	r := newRouter(t, blockSMTP, example)
+	defer r.Close()
+
+	// Without changes, the routes from the configuration are used.
+	r.Replace(newRouter(t, example))
+	if names, expected := routeNames(r), []string{"example"}; !slices.Equal(names, expected) {
+		t.Errorf("routeNames() = %v, expected %v", names, expected)
+	}
+
+	// Patches are applied again to the new routes, skipping deletions of removed routes.
+	if err := r.PatchRoutes(RoutesPatch{
+		Delete: []string{"example"},
+		Upsert: []RouteConfig{http},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r.Replace(newRouter(t, blockSMTP, ss))
+	if names, expected := routeNames(r), []string{"block-smtp", "ss", "http"}; !slices.Equal(names, expected) {
+		t.Errorf("routeNames() = %v, expected %v", names, expected)
+	}
+
+	// Replaced routes replace the routes from the configuration.
+	if err := r.ReplaceRoutes([]RouteConfig{ss}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PatchRoutes(RoutesPatch{Upsert: []RouteConfig{http}}); err != nil {
+		t.Fatal(err)
+	}
+	r.Replace(newRouter(t, blockSMTP, example, ss))
+	if names, expected := routeNames(r), []string{"ss", "http"}; !slices.Equal(names, expected) {
+		t.Errorf("routeNames() = %v, expected %v", names, expected)
+	}
+
+	// Changes that no longer apply are dropped: the new router has no server named ss.
+	config := Config{
+		DefaultTCPClientName: "direct",
+		DefaultUDPClientName: "direct",
+		Routes:               []RouteConfig{example},
+	}
+	src, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Replace(src)
+	if names, expected := routeNames(r), []string{"example"}; !slices.Equal(names, expected) {
+		t.Errorf("routeNames() = %v, expected %v", names, expected)
+	}
+	r.Replace(newRouter(t, blockSMTP))
+	if names, expected := routeNames(r), []string{"block-smtp"}; !slices.Equal(names, expected) {
+		t.Errorf("routeNames() = %v, expected %v", names, expected)
+	}
+}
+
+func TestStandaloneRouterListenPorts(t *testing.T) {
+	config := Config{
+		DefaultTCPClientName: "direct",
+		DefaultUDPClientName: "direct",
+		Routes: []RouteConfig{
+			{
+				Name:            "dns",
+				Client:          "resolver",
+				FromListenPorts: []uint16{53},
+			},
+			{
+				Name:                  "not-proxy-ports",
+				Network:               "tcp",
+				Client:                "reject",
+				FromListenPortRanges:  "1080,8000-8999",
+				InvertFromListenPorts: true,
+			},
+			{
+				Name:           "high-source-ports",
+				Client:         "proxy",
+				FromPortRanges: "32768-60999",
+			},
+		},
+	}
+
+	r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	targetAddr := conn.MustAddrFromDomainPort("example.com", 443)
+
+	for _, c := range []struct {
+		network  Protocol
+		listen   string
+		source   string
+		expected Decision
+	}{
+		{ProtocolUDP, "[::]:53", "192.0.2.1:12345", Decision{Route: "dns", Client: "resolver"}},
+		{ProtocolTCP, "192.0.2.2:53", "192.0.2.1:40000", Decision{Route: "dns", Client: "resolver"}},
+		{ProtocolTCP, "192.0.2.2:443", "192.0.2.1:12345", Decision{Route: "not-proxy-ports", Client: "reject"}},
+		{ProtocolTCP, "192.0.2.2:8080", "192.0.2.1:40000", Decision{Route: "high-source-ports", Client: "proxy"}},
+		{ProtocolTCP, "192.0.2.2:1080", "192.0.2.1:12345", Decision{Route: "default", Client: "direct"}},
+		{ProtocolUDP, "[::]:443", "192.0.2.1:12345", Decision{Route: "default", Client: "direct"}},
+	} {
+		d, err := r.Match(ctx, c.network, RequestInfo{
+			ListenAddrPort: netip.MustParseAddrPort(c.listen),
+			SourceAddrPort: netip.MustParseAddrPort(c.source),
+			TargetAddr:     targetAddr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != c.expected {
+			t.Errorf("Match(%s, %s, %s) = %+v, expected %+v", c.network, c.listen, c.source, d, c.expected)
+		}
+	}
+
+	config.Routes[0].FromListenPorts = []uint16{0}
+	if _, err = config.StandaloneRouter(zap.NewNop(), nil, nil, nil); err == nil {
+		t.Error("StandaloneRouter() with zero listen port succeeded")
+	}
+}
+
+func TestStandaloneRouterScript(t *testing.T) {
+	config := Config{
+		Routes: []RouteConfig{
+			{
+				Name:   "alice-on-ss-2022",
+				Client: "reject",
+				Script: `server == "ss-2022" and user == "alice" and in_domain(domain, "example.com")`,
+			},
+			{
+				Name:      "bad-script",
+				Client:    "proxy",
+				ToPorts:   []uint16{8080},
+				Script:    `user < 1`,
+				FromUsers: []string{"bob"},
+			},
+		},
+	}
+	serverIndexByName := map[string]int{"socks5": 0, "ss-2022": 1}
+
+	r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, serverIndexByName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		requestInfo RequestInfo
+		expected    Decision
+	}{
+		{RequestInfo{ServerIndex: 1, Username: "alice", TargetAddr: conn.MustAddrFromDomainPort("www.example.com", 443)}, Decision{Route: "alice-on-ss-2022", Client: "reject"}},
+		{RequestInfo{ServerIndex: 0, Username: "alice", TargetAddr: conn.MustAddrFromDomainPort("www.example.com", 443)}, Decision{Route: "default"}},
+		{RequestInfo{ServerIndex: 1, Username: "bob", TargetAddr: conn.MustAddrFromDomainPort("www.example.com", 443)}, Decision{Route: "default"}},
+	} {
+		d, err := r.Match(ctx, ProtocolTCP, c.requestInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != c.expected {
+			t.Errorf("Match(%+v) = %+v, expected %+v", c.requestInfo, d, c.expected)
+		}
+	}
+
+	// The script is only evaluated when all other criteria are met.
+	if _, err = r.Match(ctx, ProtocolTCP, RequestInfo{Username: "bob", TargetAddr: conn.MustAddrFromDomainPort("example.org", 8080)}); err == nil {
+		t.Error("Match() with failing script succeeded")
+	}
+
+	config.Routes[0].Script = `user ==`
+	if _, err = config.StandaloneRouter(zap.NewNop(), nil, nil, serverIndexByName); err == nil {
+		t.Error("StandaloneRouter() with bad script succeeded")
+	}
+}
+
+func TestRouterUDPNATTimeout(t *testing.T) {
+	config := Config{
+		Routes: []RouteConfig{
+			{
+				Name:          "dns",
+				Network:       "udp",
+				Client:        "proxy",
+				ToPorts:       []uint16{53},
+				UDPNATTimeout: jsonhelper.Duration(30 * time.Second),
+			},
+		},
+	}
+
+	r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	proxyUDP := direct.NewDirectUDPClient("proxy", "udp", 1500, conn.ListenConfig{})
+	if err = r.BindClients(nil, map[string]zerocopy.UDPClient{"proxy": proxyUDP}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		targetAddr         conn.Addr
+		expectedNATTimeout time.Duration
+	}{
+		{conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:53")), 30 * time.Second},
+		{conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:51820")), 0},
+	} {
+		udpClient, err := r.GetUDPClient(ctx, RequestInfo{TargetAddr: c.targetAddr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if natTimeout := udpClient.Info().NATTimeout; natTimeout != c.expectedNATTimeout {
+			t.Errorf("GetUDPClient(%s).Info().NATTimeout = %s, expected %s", c.targetAddr, natTimeout, c.expectedNATTimeout)
+		}
+	}
+
+	config.Routes[0].Network = "tcp"
+	if _, err = config.StandaloneRouter(zap.NewNop(), nil, nil, nil); err == nil {
+		t.Error("StandaloneRouter() with udpNATTimeout on a TCP route succeeded")
+	}
+}
+
+func TestRouterIPFamily(t *testing.T) {
+	config := Config{
+		Routes: []RouteConfig{
+			{
+				Name:      "localhost-v4",
+				Client:    "direct",
+				ToDomains: []string{"localhost"},
+				IPFamily:  conn.IPFamilyPolicyIPv4Only,
+			},
+		},
+	}
+
+	r, err := config.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	directTCP := direct.NewTCPClient("direct", "tcp", conn.DefaultTCPDialer, 0)
+	directUDP := direct.NewDirectUDPClient("direct", "ip", 1500, conn.ListenConfig{})
+	if err = r.BindClients(
+		map[string]zerocopy.TCPClient{"direct": directTCP},
+		map[string]zerocopy.UDPClient{"direct": directUDP},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	targetAddr := conn.MustAddrFromDomainPort("localhost", 53)
+
+	tcpClient, err := r.GetTCPClient(ctx, RequestInfo{TargetAddr: targetAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tcpClient.(*IPFamilyTCPClient); !ok {
+		t.Errorf("GetTCPClient() = %T, expected *IPFamilyTCPClient", tcpClient)
+	}
+
+	udpClient, err := r.GetUDPClient(ctx, RequestInfo{TargetAddr: targetAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, session, err := udpClient.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	destAddrPort, _, _, err := session.Packer.PackInPlace(ctx, b, targetAddr, 0, len(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !destAddrPort.Addr().Unmap().Is4() {
+		t.Errorf("PackInPlace() destAddrPort = %s, expected an IPv4 address", destAddrPort)
+	}
+
+	config.Routes[0].IPFamily = "ipv5Only"
+	if _, err = config.StandaloneRouter(zap.NewNop(), nil, nil, nil); err == nil {
+		t.Error("StandaloneRouter() with unknown ipFamily succeeded")
+	}
+
+	config.Routes[0].IPFamily = conn.IPFamilyPolicyIPv6Only
+	config.Routes[0].Client = "reject"
+	if _, err = config.StandaloneRouter(zap.NewNop(), nil, nil, nil); err == nil {
+		t.Error("StandaloneRouter() with ipFamily on the reject client succeeded")
+	}
+}
+
+// testResolver answers every lookup with its address, or fails with [dns.ErrLookup] if it is invalid.
+type testResolver netip.Addr
+
+func (r testResolver) LookupIP(_ context.Context, _ string) (netip.Addr, error) {
+	if !netip.Addr(r).IsValid() {
+		return netip.Addr{}, dns.ErrLookup
+	}
+	return netip.Addr(r), nil
+}
+
+func (r testResolver) LookupIPs(ctx context.Context, name string) ([]netip.Addr, error) {
+	ip, err := r.LookupIP(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Addr{ip}, nil
+}
+
+func TestRouterResolver(t *testing.T) {
+	var (
+		failing = testResolver{}
+		ip1     = netip.MustParseAddr("192.0.2.1")
+		ip2     = netip.MustParseAddr("192.0.2.2")
+	)
+	resolvers := []dns.SimpleResolver{failing, testResolver(ip1)}
+	resolverMap := map[string]dns.SimpleResolver{
+		"failing": failing,
+		"one":     testResolver(ip1),
+		"two":     testResolver(ip2),
+	}
+
+	r, err := testConfig.StandaloneRouter(zap.NewNop(), resolvers, resolverMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		name string
+		want netip.Addr
+	}{
+		{"", ip1},
+		{"two", ip2},
+	} {
+		resolver, err := r.Resolver(c.name)
+		if err != nil {
+			t.Fatalf("Resolver(%q) failed: %v", c.name, err)
+		}
+		ips, err := resolver.LookupIPs(ctx, "example.com")
+		if err != nil {
+			t.Fatalf("Resolver(%q).LookupIPs failed: %v", c.name, err)
+		}
+		if !slices.Equal(ips, []netip.Addr{c.want}) {
+			t.Errorf("Resolver(%q).LookupIPs = %v, want [%s]", c.name, ips, c.want)
+		}
+	}
+
+	if _, err = r.Resolver("missing"); err == nil {
+		t.Error("Resolver(\"missing\") succeeded, expected error")
+	}
+
+	var emptyConfig Config
+	empty, err := emptyConfig.StandaloneRouter(zap.NewNop(), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+
+	if _, err = empty.Resolver(""); err == nil {
+		t.Error("Resolver(\"\") without resolvers succeeded, expected error")
+	}
+}
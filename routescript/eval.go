@@ -0,0 +1,319 @@
+package routescript
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// checkInterval is the number of evaluation steps between time limit checks.
+const checkInterval = 64
+
+// evaluator holds the state of a single evaluation.
+type evaluator struct {
+	env      *Env
+	deadline time.Time
+	steps    uint
+}
+
+// step counts an evaluation step, and returns [ErrTimeout] if the time limit is exceeded.
+func (e *evaluator) step() error {
+	e.steps++
+	if e.steps%checkInterval == 0 && time.Now().After(e.deadline) {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// node is an expression that evaluates to a bool, int64, string, or []any of int64 and string.
+type node interface {
+	eval(e *evaluator) (any, error)
+}
+
+type literalNode struct {
+	value any
+}
+
+func (n *literalNode) eval(e *evaluator) (any, error) {
+	return n.value, e.step()
+}
+
+type varNode struct {
+	get func(env *Env) any
+}
+
+func (n *varNode) eval(e *evaluator) (any, error) {
+	return n.get(e.env), e.step()
+}
+
+type orNode struct {
+	x, y node
+}
+
+func (n *orNode) eval(e *evaluator) (any, error) {
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if truth(x) {
+		return true, nil
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return truth(y), nil
+}
+
+type andNode struct {
+	x, y node
+}
+
+func (n *andNode) eval(e *evaluator) (any, error) {
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if !truth(x) {
+		return false, nil
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return truth(y), nil
+}
+
+type notNode struct {
+	x node
+}
+
+func (n *notNode) eval(e *evaluator) (any, error) {
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return !truth(x), nil
+}
+
+type cmpNode struct {
+	op   tokenKind
+	x, y node
+}
+
+func (n *cmpNode) eval(e *evaluator) (any, error) {
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.step(); err != nil {
+		return nil, err
+	}
+
+	if n.op == tokenIn || n.op == tokenNotIn {
+		in, err := contains(e, y, x)
+		if err != nil {
+			return nil, err
+		}
+		return in == (n.op == tokenIn), nil
+	}
+
+	switch x := x.(type) {
+	case bool:
+		if y, ok := y.(bool); ok {
+			switch n.op {
+			case tokenEq:
+				return x == y, nil
+			case tokenNe:
+				return x != y, nil
+			}
+		}
+	case int64:
+		if y, ok := y.(int64); ok {
+			return compare(n.op, x, y), nil
+		}
+	case string:
+		if y, ok := y.(string); ok {
+			return compare(n.op, x, y), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported comparison: %s %s %s", typeName(x), n.op, typeName(y))
+}
+
+func compare[T int64 | string](op tokenKind, x, y T) bool {
+	switch op {
+	case tokenEq:
+		return x == y
+	case tokenNe:
+		return x != y
+	case tokenLt:
+		return x < y
+	case tokenLe:
+		return x <= y
+	case tokenGt:
+		return x > y
+	case tokenGe:
+		return x >= y
+	default:
+		panic("unreachable")
+	}
+}
+
+// contains implements the in operator.
+func contains(e *evaluator, container, elem any) (bool, error) {
+	switch container := container.(type) {
+	case string:
+		s, ok := elem.(string)
+		if !ok {
+			return false, fmt.Errorf("'in <string>' requires string as left operand, not %s", typeName(elem))
+		}
+		return strings.Contains(container, s), nil
+	case []any:
+		switch elem.(type) {
+		case int64, string:
+		default:
+			return false, fmt.Errorf("'in <list>' requires integer or string as left operand, not %s", typeName(elem))
+		}
+		for _, v := range container {
+			if err := e.step(); err != nil {
+				return false, err
+			}
+			if v == elem {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("'in' requires string or list as right operand, not %s", typeName(container))
+	}
+}
+
+// truth returns the truth value of v, like Python.
+func truth(v any) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string:
+		return v != ""
+	case []any:
+		return len(v) != 0
+	default:
+		return false
+	}
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case string:
+		return "string"
+	case []any:
+		return "list"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+type callNode struct {
+	name string
+	call func(e *evaluator, s string, pattern any) (bool, error)
+	x, y node
+}
+
+func (n *callNode) eval(e *evaluator) (any, error) {
+	x, err := n.x.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	y, err := n.y.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.step(); err != nil {
+		return nil, err
+	}
+	s, ok := x.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s(): expected string as first argument, got %s", n.name, typeName(x))
+	}
+	v, err := n.call(e, s, y)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %w", n.name, err)
+	}
+	return v, nil
+}
+
+// builtins maps function names to their implementations.
+// Every function is a predicate on a string and a pattern.
+var builtins = map[string]func(e *evaluator, s string, pattern any) (bool, error){
+	"startswith": func(e *evaluator, s string, pattern any) (bool, error) {
+		return matchStrings(e, s, pattern, strings.HasPrefix)
+	},
+	"endswith": func(e *evaluator, s string, pattern any) (bool, error) {
+		return matchStrings(e, s, pattern, strings.HasSuffix)
+	},
+	"in_domain": func(e *evaluator, s string, pattern any) (bool, error) {
+		return matchStrings(e, s, pattern, func(domain, suffix string) bool {
+			return domain == suffix ||
+				len(domain) > len(suffix) && domain[len(domain)-len(suffix)-1] == '.' && strings.HasSuffix(domain, suffix)
+		})
+	},
+	"in_prefix": func(e *evaluator, s string, pattern any) (bool, error) {
+		if s == "" {
+			return false, nil
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return false, err
+		}
+		addr = addr.Unmap()
+		met, matchErr := matchStrings(e, s, pattern, func(_, p string) bool {
+			prefix, parseErr := netip.ParsePrefix(p)
+			if parseErr != nil {
+				err = parseErr
+				return true
+			}
+			return prefix.Contains(addr)
+		})
+		if err != nil {
+			return false, err
+		}
+		return met, matchErr
+	},
+}
+
+// matchStrings returns whether match(s, pattern) is true for pattern,
+// or for any element of pattern if it is a list.
+func matchStrings(e *evaluator, s string, pattern any, match func(s, pattern string) bool) (bool, error) {
+	switch pattern := pattern.(type) {
+	case string:
+		return match(s, pattern), nil
+	case []any:
+		for _, p := range pattern {
+			if err := e.step(); err != nil {
+				return false, err
+			}
+			ps, ok := p.(string)
+			if !ok {
+				return false, fmt.Errorf("expected list of strings, got %s in list", typeName(p))
+			}
+			if match(s, ps) {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected string or list as second argument, got %s", typeName(pattern))
+	}
+}
@@ -0,0 +1,462 @@
+package routescript
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxDepth is the maximum nesting depth of expressions.
+const maxDepth = 64
+
+var errTooDeep = errors.New("expression nested too deeply")
+
+type tokenKind uint8
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenEq
+	tokenNe
+	tokenLt
+	tokenLe
+	tokenGt
+	tokenGe
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenIn
+	tokenNotIn
+	tokenTrue
+	tokenFalse
+)
+
+var keywords = map[string]tokenKind{
+	"and":   tokenAnd,
+	"or":    tokenOr,
+	"not":   tokenNot,
+	"in":    tokenIn,
+	"True":  tokenTrue,
+	"False": tokenFalse,
+}
+
+// String returns the source representation of the token kind.
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of script"
+	case tokenIdent:
+		return "identifier"
+	case tokenInt:
+		return "integer"
+	case tokenString:
+		return "string"
+	case tokenLParen:
+		return "("
+	case tokenRParen:
+		return ")"
+	case tokenLBracket:
+		return "["
+	case tokenRBracket:
+		return "]"
+	case tokenComma:
+		return ","
+	case tokenEq:
+		return "=="
+	case tokenNe:
+		return "!="
+	case tokenLt:
+		return "<"
+	case tokenLe:
+		return "<="
+	case tokenGt:
+		return ">"
+	case tokenGe:
+		return ">="
+	case tokenAnd:
+		return "and"
+	case tokenOr:
+		return "or"
+	case tokenNot:
+		return "not"
+	case tokenIn:
+		return "in"
+	case tokenNotIn:
+		return "not in"
+	case tokenTrue:
+		return "True"
+	case tokenFalse:
+		return "False"
+	default:
+		return "token(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+type token struct {
+	kind tokenKind
+	pos  int
+	text string
+	num  int64
+}
+
+// lex splits src into tokens.
+func lex(src string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			text := src[start:i]
+			kind, ok := keywords[text]
+			if !ok {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, token{kind: kind, pos: start, text: text})
+			continue
+
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			n, err := strconv.ParseUint(src[start:i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad integer at %d: %w", start, err)
+			}
+			tokens = append(tokens, token{kind: tokenInt, pos: start, num: int64(n)})
+			continue
+
+		case c == '"' || c == '\'':
+			start := i
+			s, n, err := unquote(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %d: %w", start, err)
+			}
+			i += n
+			tokens = append(tokens, token{kind: tokenString, pos: start, text: s})
+			continue
+		}
+
+		var (
+			kind tokenKind
+			n    = 1
+		)
+
+		switch c {
+		case '(':
+			kind = tokenLParen
+		case ')':
+			kind = tokenRParen
+		case '[':
+			kind = tokenLBracket
+		case ']':
+			kind = tokenRBracket
+		case ',':
+			kind = tokenComma
+		case '=', '!', '<', '>':
+			var next byte
+			if i+1 < len(src) {
+				next = src[i+1]
+			}
+			switch {
+			case c == '=' && next == '=':
+				kind, n = tokenEq, 2
+			case c == '!' && next == '=':
+				kind, n = tokenNe, 2
+			case c == '<' && next == '=':
+				kind, n = tokenLe, 2
+			case c == '<':
+				kind = tokenLt
+			case c == '>' && next == '=':
+				kind, n = tokenGe, 2
+			case c == '>':
+				kind = tokenGt
+			default:
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+
+		tokens = append(tokens, token{kind: kind, pos: i})
+		i += n
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// unquote parses the single- or double-quoted string literal at the start of s,
+// and returns the string and the length of the literal.
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var sb strings.Builder
+
+	for i := 1; i < len(s); {
+		c := s[i]
+		switch c {
+		case quote:
+			return sb.String(), i + 1, nil
+		case '\n':
+			return "", 0, errors.New("unterminated string")
+		case '\\':
+			value, _, tail, err := strconv.UnquoteChar(s[i:], quote)
+			if err != nil {
+				return "", 0, err
+			}
+			sb.WriteRune(value)
+			i = len(s) - len(tail)
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+
+	return "", 0, errors.New("unterminated string")
+}
+
+// parser is a recursive descent parser for the expression grammar:
+//
+//	expr    = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | cmp
+//	cmp     = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" | "not" "in" ) operand ]
+//	operand = scalar | "True" | "False" | IDENT | IDENT "(" expr "," expr ")"
+//	        | "(" expr ")" | "[" [ scalar { "," scalar } [ "," ] ] "]"
+//	scalar  = INT | STRING
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at %d, got %s", kind, t.pos, t.kind)
+	}
+	return t, nil
+}
+
+func (p *parser) parseExpr() (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &orNode{x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = &andNode{x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek().kind != tokenNot {
+		return p.parseCmp()
+	}
+	p.next()
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return &notNode{x}, nil
+}
+
+func (p *parser) parseCmp() (node, error) {
+	x, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch op.kind {
+	case tokenEq, tokenNe, tokenLt, tokenLe, tokenGt, tokenGe, tokenIn:
+		p.next()
+	case tokenNot:
+		p.next()
+		if _, err = p.expect(tokenIn); err != nil {
+			return nil, err
+		}
+		op.kind = tokenNotIn
+	default:
+		return x, nil
+	}
+
+	y, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &cmpNode{op.kind, x, y}, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenInt:
+		return &literalNode{t.num}, nil
+
+	case tokenString:
+		return &literalNode{t.text}, nil
+
+	case tokenTrue:
+		return &literalNode{true}, nil
+
+	case tokenFalse:
+		return &literalNode{false}, nil
+
+	case tokenLParen:
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return x, nil
+
+	case tokenLBracket:
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &literalNode{list}, nil
+
+	case tokenIdent:
+		if p.peek().kind != tokenLParen {
+			v, ok := variables[t.text]
+			if !ok {
+				return nil, fmt.Errorf("undefined variable %q at %d", t.text, t.pos)
+			}
+			return &varNode{v}, nil
+		}
+		p.next()
+
+		fn, ok := builtins[t.text]
+		if !ok {
+			return nil, fmt.Errorf("undefined function %q at %d", t.text, t.pos)
+		}
+
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokenComma); err != nil {
+			return nil, fmt.Errorf("%s() takes 2 arguments: %w", t.text, err)
+		}
+		y, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokenRParen); err != nil {
+			return nil, fmt.Errorf("%s() takes 2 arguments: %w", t.text, err)
+		}
+		return &callNode{t.text, fn, x, y}, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected %s at %d", t.kind, t.pos)
+	}
+}
+
+// parseList parses a list of integer and string literals after the opening bracket.
+func (p *parser) parseList() ([]any, error) {
+	var list []any
+
+	for {
+		t := p.next()
+		switch t.kind {
+		case tokenRBracket:
+			return list, nil
+		case tokenInt:
+			list = append(list, t.num)
+		case tokenString:
+			list = append(list, t.text)
+		default:
+			return nil, fmt.Errorf("expected integer or string in list at %d, got %s", t.pos, t.kind)
+		}
+
+		switch t = p.next(); t.kind {
+		case tokenRBracket:
+			return list, nil
+		case tokenComma:
+		default:
+			return nil, fmt.Errorf("expected , or ] at %d, got %s", t.pos, t.kind)
+		}
+	}
+}
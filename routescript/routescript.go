@@ -0,0 +1,121 @@
+// Package routescript implements a small, sandboxed expression language for routing decisions.
+//
+// The syntax is the subset of Starlark expressions needed to express routing policies:
+// non-negative integer, string and boolean literals, lists of integer and string literals,
+// comparison operators, "in" and "not in", "and", "or" and "not", parentheses,
+// and calls to a fixed set of predicate functions. Comments start with "#".
+// There is no arithmetic, no statements, loops, assignments or user-defined functions,
+// and scripts have no access to I/O, so evaluation takes time linear in the length of the script
+// and is free of side effects.
+//
+// A script is evaluated to a boolean with Python truthiness rules.
+// Evaluation is aborted with [ErrTimeout] when it exceeds its time limit.
+//
+// Variables:
+//
+//   - network: "tcp" or "udp"
+//   - server: name of the server that received the request
+//   - user: username of the request, or "" if the server has no users
+//   - listen_port: port of the server listener that received the request, or 0 if unknown
+//   - source_ip, source_port: source address of the request
+//   - domain: target domain, or "" if the target is an IP address
+//   - target_ip: target IP address, or "" if the target is a domain
+//   - target_port: target port
+//   - hour, minute: local time of the request, from 0-23 and 0-59
+//   - weekday: local day of the week of the request, from "Mon" to "Sun"
+//
+// Functions:
+//
+//   - startswith(s, prefix), endswith(s, suffix): prefix and suffix can be a string or a list of strings
+//   - in_domain(domain, d): whether domain is d or a subdomain of d; d can be a string or a list of strings
+//   - in_prefix(ip, p): whether ip is in IP prefix p; p can be a string or a list of strings; false if ip is ""
+package routescript
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ErrTimeout is returned when a script exceeds its time limit.
+var ErrTimeout = errors.New("script exceeded time limit")
+
+// Env contains the request information available to scripts.
+type Env struct {
+	Network        string
+	Server         string
+	User           string
+	ListenPort     uint16
+	SourceAddrPort netip.AddrPort
+	TargetDomain   string
+	TargetIP       netip.Addr
+	TargetPort     uint16
+	Time           time.Time
+}
+
+var variables = map[string]func(env *Env) any{
+	"network":     func(env *Env) any { return env.Network },
+	"server":      func(env *Env) any { return env.Server },
+	"user":        func(env *Env) any { return env.User },
+	"listen_port": func(env *Env) any { return int64(env.ListenPort) },
+	"source_ip": func(env *Env) any {
+		return addrString(env.SourceAddrPort.Addr().Unmap())
+	},
+	"source_port": func(env *Env) any { return int64(env.SourceAddrPort.Port()) },
+	"domain":      func(env *Env) any { return env.TargetDomain },
+	"target_ip": func(env *Env) any {
+		return addrString(env.TargetIP.Unmap())
+	},
+	"target_port": func(env *Env) any { return int64(env.TargetPort) },
+	"hour":        func(env *Env) any { return int64(env.Time.Hour()) },
+	"minute":      func(env *Env) any { return int64(env.Time.Minute()) },
+	"weekday":     func(env *Env) any { return env.Time.Weekday().String()[:3] },
+}
+
+func addrString(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+// Program is a compiled script.
+//
+// Program is safe for concurrent use.
+type Program struct {
+	root node
+}
+
+// Compile parses the script and checks that all variables and functions are defined.
+func Compile(src string) (*Program, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t.kind, t.pos)
+	}
+
+	return &Program{root: root}, nil
+}
+
+// Eval evaluates the program with the given environment, and returns the truth value of the result.
+// It returns [ErrTimeout] if evaluation takes longer than timeout.
+func (p *Program) Eval(env *Env, timeout time.Duration) (bool, error) {
+	e := evaluator{
+		env:      env,
+		deadline: time.Now().Add(timeout),
+	}
+	v, err := p.root.eval(&e)
+	if err != nil {
+		return false, err
+	}
+	return truth(v), nil
+}
@@ -0,0 +1,172 @@
+package routescript
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEnv = Env{
+	Network:        "tcp",
+	Server:         "ss-2022",
+	User:           "alice",
+	ListenPort:     1080,
+	SourceAddrPort: netip.MustParseAddrPort("[::ffff:192.0.2.1]:12345"),
+	TargetDomain:   "www.example.com",
+	TargetPort:     443,
+	Time:           time.Date(2024, time.October, 5, 22, 30, 0, 0, time.UTC),
+}
+
+var evalCases = []struct {
+	src      string
+	expected bool
+}{
+	{`True`, true},
+	{`False`, false},
+	{`network == "tcp"`, true},
+	{`network != "tcp"`, false},
+	{`server == 'ss-2022' and user == "alice"`, true},
+	{`user in ["bob", "carol"]`, false},
+	{`user not in ["bob", "carol"]`, true},
+	{`source_ip == "192.0.2.1" and source_port == 12345`, true},
+	{`listen_port == 1080`, true},
+	{`in_prefix(source_ip, "192.0.2.0/24")`, true},
+	{`in_prefix(source_ip, ["10.0.0.0/8", "2001:db8::/32"])`, false},
+	{`in_prefix(target_ip, "0.0.0.0/0")`, false},
+	{`target_ip == "" and target_port == 443`, true},
+	{`target_port in [80, 443,]`, true},
+	{`in_domain(domain, "example.com")`, true},
+	{`in_domain(domain, ["ample.com", "example.org"])`, false},
+	{`in_domain("example.com", "example.com")`, true},
+	{`startswith(domain, "www.") and endswith(domain, [".org", ".com"])`, true},
+	{`"example" in domain`, true},
+	{`hour >= 22 or hour < 6`, true},
+	{`weekday in ["Sat", "Sun"]`, true},
+	{`hour == 22 and minute >= 30`, true},
+	{`not (1 >= 2) and "b" > "a"`, true},
+	{`(1 < 2) == True`, true},
+	{`"" or 0 or []`, false},
+	{"# comment\nuser == 'alice' # trailing comment", true},
+	{`"\x41\n" == 'A\n'`, true},
+}
+
+func TestEval(t *testing.T) {
+	for _, c := range evalCases {
+		p, err := Compile(c.src)
+		if err != nil {
+			t.Errorf("Compile(%q) failed: %v", c.src, err)
+			continue
+		}
+		got, err := p.Eval(&testEnv, time.Second)
+		if err != nil {
+			t.Errorf("Eval(%q) failed: %v", c.src, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("Eval(%q) = %v, expected %v", c.src, got, c.expected)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`foo`,
+		`foo()`,
+		`len(user)`,
+		`in_domain()`,
+		`in_domain(domain)`,
+		`in_domain(domain, "a", "b")`,
+		`user ==`,
+		`(True`,
+		`[1, 2`,
+		`[1, [2]]`,
+		`[user]`,
+		`[,]`,
+		`True True`,
+		`"unterminated`,
+		`user = "alice"`,
+		`hour + 1`,
+		`-1`,
+		`0x10`,
+		`99999999999`,
+		`not in [1]`,
+		`1 < 2 < 3`,
+		strings.Repeat("(", 100) + "True" + strings.Repeat(")", 100),
+		strings.Repeat("not ", 100) + "True",
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("Compile(%q) succeeded, expected error", src)
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	for _, src := range []string{
+		`user < 1`,
+		`True < False`,
+		`[1] == [1]`,
+		`1 in 2`,
+		`1 in "abc"`,
+		`True in [1]`,
+		`startswith(1, "a")`,
+		`endswith("a", 1)`,
+		`in_domain(domain, [1])`,
+		`in_prefix(source_ip, "bad")`,
+		`in_prefix("bad", "192.0.2.0/24")`,
+	} {
+		p, err := Compile(src)
+		if err != nil {
+			t.Errorf("Compile(%q) failed: %v", src, err)
+			continue
+		}
+		if _, err = p.Eval(&testEnv, time.Second); err == nil {
+			t.Errorf("Eval(%q) succeeded, expected error", src)
+		}
+	}
+}
+
+func TestEvalTimeout(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("user in [")
+	for range 10000 {
+		sb.WriteString(`"bob", `)
+	}
+	sb.WriteString("]")
+
+	p, err := Compile(sb.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = p.Eval(&testEnv, -time.Second); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Eval() error = %v, expected %v", err, ErrTimeout)
+	}
+
+	met, err := p.Eval(&testEnv, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if met {
+		t.Error("Eval() = true, expected false")
+	}
+}
+
+func FuzzCompile(f *testing.F) {
+	for _, c := range evalCases {
+		f.Add(c.src)
+	}
+	f.Add(`in_prefix(target_ip, ["192.0.2.0/24", "bad"]) or weekday not in ["Sat"]`)
+
+	f.Fuzz(func(t *testing.T, src string) {
+		p, err := Compile(src)
+		if err != nil {
+			return
+		}
+		if _, err = p.Eval(&testEnv, time.Second); errors.Is(err, ErrTimeout) {
+			t.Errorf("Eval(%q) timed out", src)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"errors"
+	"net/netip"
+
+	"go4.org/netipx"
+)
+
+var errClientAddressDenied = errors.New("client address denied by ACL")
+
+// clientACL restricts which client addresses may connect to a server.
+//
+// A nil *clientACL allows all addresses.
+type clientACL struct {
+	allow *netipx.IPSet
+	deny  *netipx.IPSet
+}
+
+// newClientACL returns a client ACL built from the allow and deny prefix lists.
+// If both lists are empty, it returns nil.
+func newClientACL(allowedPrefixes, deniedPrefixes []netip.Prefix) (*clientACL, error) {
+	if len(allowedPrefixes) == 0 && len(deniedPrefixes) == 0 {
+		return nil, nil
+	}
+
+	var acl clientACL
+
+	if len(allowedPrefixes) > 0 {
+		var sb netipx.IPSetBuilder
+		for _, prefix := range allowedPrefixes {
+			sb.AddPrefix(prefix)
+		}
+		s, err := sb.IPSet()
+		if err != nil {
+			return nil, err
+		}
+		acl.allow = s
+	}
+
+	if len(deniedPrefixes) > 0 {
+		var sb netipx.IPSetBuilder
+		for _, prefix := range deniedPrefixes {
+			sb.AddPrefix(prefix)
+		}
+		s, err := sb.IPSet()
+		if err != nil {
+			return nil, err
+		}
+		acl.deny = s
+	}
+
+	return &acl, nil
+}
+
+// Allowed returns whether the client address is allowed.
+//
+// The address is denied if it matches the deny list,
+// or if the allow list is not empty and the address does not match it.
+func (acl *clientACL) Allowed(addr netip.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	addr = addr.Unmap()
+	if acl.deny != nil && acl.deny.Contains(addr) {
+		return false
+	}
+	return acl.allow == nil || acl.allow.Contains(addr)
+}
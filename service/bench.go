@@ -0,0 +1,329 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultBenchDownloadURL is the default URL downloaded by the benchmark.
+	DefaultBenchDownloadURL = "https://speed.cloudflare.com/__down?bytes=25000000"
+
+	// DefaultBenchUploadURL is the default URL uploaded to by the benchmark.
+	DefaultBenchUploadURL = "https://speed.cloudflare.com/__up"
+
+	// DefaultBenchUploadSize is the default number of bytes uploaded by the benchmark.
+	DefaultBenchUploadSize = 10_000_000
+
+	// DefaultBenchTimeout is the default timeout of each benchmark transfer.
+	DefaultBenchTimeout = 30 * time.Second
+)
+
+// BenchConfig is the configuration of a benchmark of the configured clients.
+type BenchConfig struct {
+	// Clients is the names of the clients to benchmark.
+	// If empty, all clients with TCP enabled are benchmarked, except client groups and internal clients.
+	Clients []string
+
+	// DownloadURL is the HTTP(S) URL to download through each client.
+	// If empty, downloads are not measured.
+	DownloadURL string
+
+	// UploadURL is the HTTP(S) URL to POST to through each client.
+	// If empty, uploads are not measured.
+	UploadURL string
+
+	// UploadSize is the number of bytes to upload.
+	UploadSize int64
+
+	// Timeout is the timeout of each transfer.
+	Timeout time.Duration
+}
+
+// BenchResult is the benchmark result of a client.
+type BenchResult struct {
+	// Client is the name of the client.
+	Client string
+
+	// Protocol is the protocol of the client.
+	Protocol string
+
+	// Err is why the client could not be benchmarked, or nil if it was.
+	Err error
+
+	// Latency is the time from dialing to the first byte of the download response,
+	// including the proxy and TLS handshakes.
+	Latency time.Duration
+
+	// Download is the result of the download.
+	Download BenchTransfer
+
+	// Upload is the result of the upload.
+	Upload BenchTransfer
+}
+
+// BenchTransfer is the result of a benchmark transfer.
+type BenchTransfer struct {
+	// Err is why the transfer failed, or nil if it completed.
+	Err error
+
+	// Bytes is the number of payload bytes transferred.
+	Bytes int64
+
+	// Duration is how long the payload took to transfer, excluding the handshakes.
+	Duration time.Duration
+}
+
+// BitsPerSecond returns the throughput of the transfer in bits per second.
+func (t BenchTransfer) BitsPerSecond() float64 {
+	if t.Duration <= 0 {
+		return 0
+	}
+	return float64(t.Bytes) * 8 / t.Duration.Seconds()
+}
+
+// Bench measures the latency and throughput of the configured clients, one client at a time,
+// by downloading from and uploading to the configured URLs through each client.
+//
+// No servers are started. Clients with SIP003 plugins have their plugins started for the benchmark.
+func (sc *Config) Bench(ctx context.Context, bc BenchConfig, logger *zap.Logger) ([]BenchResult, error) {
+	if bc.DownloadURL == "" && bc.UploadURL == "" {
+		return nil, errors.New("no download or upload URL")
+	}
+	if bc.UploadSize < 0 {
+		return nil, fmt.Errorf("negative upload size: %d", bc.UploadSize)
+	}
+	if bc.Timeout <= 0 {
+		bc.Timeout = DefaultBenchTimeout
+	}
+
+	sc.setDefaultClients()
+
+	clientConfigs := make([]*ClientConfig, 0, len(sc.Clients))
+	if len(bc.Clients) == 0 {
+		for i := range sc.Clients {
+			if sc.Clients[i].EnableTCP && !sc.Clients[i].isGroup() && sc.Clients[i].Protocol != "internal" && sc.Clients[i].Protocol != "sip008" && sc.Clients[i].Dialer == "" {
+				clientConfigs = append(clientConfigs, &sc.Clients[i])
+			}
+		}
+	} else {
+		for _, name := range bc.Clients {
+			i := slices.IndexFunc(sc.Clients, func(cc ClientConfig) bool { return cc.Name == name })
+			if i == -1 {
+				return nil, fmt.Errorf("unknown client: %s", name)
+			}
+			clientConfigs = append(clientConfigs, &sc.Clients[i])
+		}
+	}
+
+	if len(clientConfigs) == 0 {
+		return nil, errors.New("no clients to benchmark")
+	}
+
+	listenConfigCache := conn.NewListenConfigCache()
+	dialerCache := conn.NewDialerCache()
+	results := make([]BenchResult, len(clientConfigs))
+
+	for i, cc := range clientConfigs {
+		results[i] = bc.benchClient(ctx, cc, listenConfigCache, dialerCache, logger)
+		if err := ctx.Err(); err != nil {
+			return results[:i+1], err
+		}
+	}
+
+	return results, nil
+}
+
+// benchClient initializes the client and benchmarks it.
+func (bc *BenchConfig) benchClient(ctx context.Context, cc *ClientConfig, listenConfigCache conn.ListenConfigCache, dialerCache conn.DialerCache, logger *zap.Logger) BenchResult {
+	result := BenchResult{
+		Client:   cc.Name,
+		Protocol: cc.Protocol,
+	}
+
+	if cc.isGroup() {
+		result.Err = errors.New("client groups cannot be benchmarked")
+		return result
+	}
+	if cc.Protocol == "sip008" {
+		result.Err = errors.New("sip008 clients cannot be benchmarked, benchmark their servers as regular clients instead")
+		return result
+	}
+
+	if cc.Dialer != "" {
+		result.Err = errors.New("clients with a dialer cannot be benchmarked")
+		return result
+	}
+
+	if err := cc.Initialize(listenConfigCache, dialerCache, logger); err != nil {
+		result.Err = fmt.Errorf("failed to initialize client: %w", err)
+		return result
+	}
+
+	tcpClient, err := cc.TCPClient()
+	if err != nil {
+		result.Err = fmt.Errorf("failed to create TCP client: %w", err)
+		return result
+	}
+	if _, ok := tcpClient.(*internalTCPClient); ok {
+		result.Err = errors.New("internal clients cannot be benchmarked")
+		return result
+	}
+
+	if cc.plugin != nil {
+		if err = cc.plugin.Start(ctx); err != nil {
+			result.Err = fmt.Errorf("failed to start plugin: %w", err)
+			return result
+		}
+		defer cc.plugin.Stop()
+	}
+
+	logger = logger.With(zap.String("client", cc.Name))
+	httpClient := newBenchHTTPClient(tcpClient)
+
+	if bc.DownloadURL != "" {
+		logger.Info("Benchmarking download", zap.String("url", bc.DownloadURL))
+		result.Latency, result.Download = bc.benchDownload(ctx, httpClient)
+	}
+
+	if bc.UploadURL != "" {
+		logger.Info("Benchmarking upload", zap.String("url", bc.UploadURL), zap.Int64("size", bc.UploadSize))
+		result.Upload = bc.benchUpload(ctx, httpClient)
+	}
+
+	return result
+}
+
+// newBenchHTTPClient returns a new HTTP client that makes a new connection through c for each request.
+func newBenchHTTPClient(c zerocopy.TCPClient) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				targetAddr, err := conn.ParseAddr(address)
+				if err != nil {
+					return nil, err
+				}
+				rawRW, rw, err := c.Dial(ctx, targetAddr, nil)
+				if err != nil {
+					return nil, err
+				}
+				return zerocopy.NewStreamConn(rawRW, rw), nil
+			},
+			DisableKeepAlives:  true,
+			DisableCompression: true,
+		},
+	}
+}
+
+// benchDownload downloads the download URL, and returns the latency and the download result.
+func (bc *BenchConfig) benchDownload(ctx context.Context, httpClient *http.Client) (latency time.Duration, t BenchTransfer) {
+	ctx, cancel := context.WithTimeout(ctx, bc.Timeout)
+	defer cancel()
+
+	var firstByteTime time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			firstByteTime = time.Now()
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bc.DownloadURL, nil)
+	if err != nil {
+		t.Err = err
+		return
+	}
+	req.Header.Set("User-Agent", "shadowsocks-go")
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Err = err
+		return
+	}
+	defer resp.Body.Close()
+	latency = firstByteTime.Sub(start)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Err = fmt.Errorf("unexpected status: %s", resp.Status)
+		return
+	}
+
+	t.Bytes, t.Err = io.Copy(io.Discard, resp.Body)
+	t.Duration = time.Since(firstByteTime)
+	return
+}
+
+// benchUpload uploads to the upload URL, and returns the upload result.
+func (bc *BenchConfig) benchUpload(ctx context.Context, httpClient *http.Client) (t BenchTransfer) {
+	ctx, cancel := context.WithTimeout(ctx, bc.Timeout)
+	defer cancel()
+
+	var connTime, firstByteTime time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			connTime = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			firstByteTime = time.Now()
+		},
+	})
+
+	body := &benchCountingReader{r: io.LimitReader(benchZeroReader{}, bc.UploadSize)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bc.UploadURL, body)
+	if err != nil {
+		t.Err = err
+		return
+	}
+	req.ContentLength = bc.UploadSize
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", "shadowsocks-go")
+
+	resp, err := httpClient.Do(req)
+	t.Bytes = body.n
+	if err != nil {
+		t.Err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	// The server responds after receiving the whole body.
+	t.Duration = firstByteTime.Sub(connTime)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Err = fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return
+}
+
+// benchZeroReader is an [io.Reader] that reads zeros.
+type benchZeroReader struct{}
+
+// Read implements [io.Reader.Read].
+func (benchZeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// benchCountingReader counts the bytes read from r.
+type benchCountingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements [io.Reader.Read].
+func (r *benchCountingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
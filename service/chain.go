@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// maxChainHops is the maximum number of dialer clients a single connection can pass through.
+const maxChainHops = 8
+
+var errChainLoop = errors.New("too many dialer hops, possible dialer loop")
+
+type chainHopsContextKey struct{}
+
+// chainOpener opens TCP connections to a remote proxy server through the client's dialer client,
+// like an upstream SOCKS5 or HTTP proxy, or another Shadowsocks server.
+//
+// chainOpener implements the zerocopy DirectReadWriteCloserOpener interface.
+type chainOpener struct {
+	dialerName string
+	address    conn.Addr
+	client     zerocopy.TCPClient
+}
+
+// newChainOpener returns a new chain opener that dials address through the named client.
+// The opener must be bound to the client with bind before use.
+func newChainOpener(dialerName string, address conn.Addr) *chainOpener {
+	return &chainOpener{
+		dialerName: dialerName,
+		address:    address,
+	}
+}
+
+// bind resolves the dialer client. It is called after all clients and groups are created,
+// so that any of them can be a dialer, regardless of the order of the clients.
+func (o *chainOpener) bind(tcpClientMap map[string]zerocopy.TCPClient) error {
+	client, ok := tcpClientMap[o.dialerName]
+	if !ok {
+		return fmt.Errorf("dialer client not found: %q", o.dialerName)
+	}
+	o.client = client
+	return nil
+}
+
+// Open implements the zerocopy.DirectReadWriteCloserOpener Open method.
+func (o *chainOpener) Open(ctx context.Context, b []byte) (zerocopy.DirectReadWriteCloser, error) {
+	hops, _ := ctx.Value(chainHopsContextKey{}).(int)
+	if hops >= maxChainHops {
+		return nil, errChainLoop
+	}
+	ctx = context.WithValue(ctx, chainHopsContextKey{}, hops+1)
+
+	_, rw, err := o.client.Dial(ctx, o.address, b)
+	if err != nil {
+		return nil, err
+	}
+	return zerocopy.NewCopyReadWriter(rw), nil
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// CheckError is a configuration error found by [Config.Check].
+type CheckError struct {
+	// Path is the JSON path of the configuration section with the error, like "servers[1]".
+	// It is empty if the error is not specific to a section.
+	Path string
+
+	// Err is the error.
+	Err error
+}
+
+// Error implements [error.Error].
+func (e *CheckError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// checker collects configuration errors.
+type checker struct {
+	errs []*CheckError
+}
+
+// add records err at path if err is not nil, and reports whether err is nil.
+func (c *checker) add(path string, err error) bool {
+	if err == nil {
+		return true
+	}
+	c.errs = append(c.errs, &CheckError{Path: path, Err: err})
+	return false
+}
+
+// Check validates the configuration without binding any sockets.
+//
+// It initializes the same clients, client groups, DNS resolvers, router and servers as [Config.Manager],
+// so that references between them are resolved, router rules are compiled, and PSKs and credential files are loaded.
+// Unlike [Config.Manager], it continues after an error and returns all errors found, each located by its JSON path.
+//
+// The configuration must not be used after Check.
+func (sc *Config) Check(logger *zap.Logger) []*CheckError {
+	var c checker
+
+	if len(sc.Servers) == 0 {
+		c.add("servers", errors.New("no services to start"))
+	}
+	if sc.GOMAXPROCS < 0 {
+		c.add("gomaxprocs", fmt.Errorf("negative GOMAXPROCS: %d", sc.GOMAXPROCS))
+	}
+	if sc.DrainTimeout < 0 {
+		c.add("drainTimeout", fmt.Errorf("negative drain timeout: %s", sc.DrainTimeout.Value()))
+	}
+	c.add("log", sc.Log.Validate())
+
+	sc.setDefaultClients()
+
+	if _, err := sc.configSections(); err != nil {
+		c.add("", fmt.Errorf("failed to normalize configuration: %w", err))
+		return c.errs
+	}
+
+	serverIndexByName := make(map[string]int, len(sc.Servers))
+	for i := range sc.Servers {
+		name := sc.Servers[i].Name
+		if _, ok := serverIndexByName[name]; ok {
+			c.add(fmt.Sprintf("servers[%d]", i), fmt.Errorf("duplicate server name: %s", name))
+			continue
+		}
+		serverIndexByName[name] = i
+	}
+
+	listenConfigCache := conn.NewListenConfigCache()
+	dialerCache := conn.NewDialerCache()
+	r, internalTCPClients, maxClientPackerHeadroom := sc.checkClientSide(&c, listenConfigCache, dialerCache, logger, serverIndexByName)
+	if r == nil {
+		// Check the servers with an empty router.
+		var rc router.Config
+		var err error
+		if r, err = rc.StandaloneRouter(logger, nil, nil, nil); !c.add("router", err) {
+			return c.errs
+		}
+	}
+	defer r.Close()
+
+	for _, ic := range internalTCPClients {
+		c.add(ic.path, ic.client.bind(r, serverIndexByName))
+	}
+
+	bus, _, err := sc.Events.Bus(logger)
+	if c.add("events", err) {
+		_, err = sc.Events.AccessLog.AccessLog(bus, logger)
+		c.add("events.accessLog", err)
+	}
+
+	_, apiSM, err := sc.API.Server(logger, bus, r, nil, nil)
+	c.add("api", err)
+
+	m := Manager{
+		listenConfigCache:       listenConfigCache,
+		dialerCache:             dialerCache,
+		statsConfig:             sc.Stats,
+		bus:                     bus,
+		credman:                 cred.NewManager(bus, logger),
+		apiSM:                   apiSM,
+		router:                  r,
+		maxClientPackerHeadroom: maxClientPackerHeadroom,
+		logger:                  logger,
+	}
+
+	for i := range sc.Servers {
+		path := fmt.Sprintf("servers[%d]", i)
+		s, err := m.initServer(&sc.Servers[i], i, "")
+		if !c.add(path, err) {
+			continue
+		}
+		c.add(path, m.postInitServer(s))
+	}
+
+	return c.errs
+}
+
+// checkInternalTCPClient is an internal TCP client to be bound after the router is created.
+type checkInternalTCPClient struct {
+	path   string
+	client *internalTCPClient
+}
+
+// checkClientSide creates the clients, client groups, DNS resolvers, hosts and router,
+// like [Config.clientSide], but records errors in c and continues without the failed sections.
+//
+// The returned router is nil if the router configuration is invalid.
+func (sc *Config) checkClientSide(c *checker, listenConfigCache conn.ListenConfigCache, dialerCache conn.DialerCache, logger *zap.Logger, serverIndexByName map[string]int) (*router.Router, []checkInternalTCPClient, zerocopy.Headroom) {
+	tcpClientMap := make(map[string]zerocopy.TCPClient, len(sc.Clients))
+	udpClientMap := make(map[string]zerocopy.UDPClient, len(sc.Clients))
+	var (
+		internalTCPClients      []checkInternalTCPClient
+		maxClientPackerHeadroom zerocopy.Headroom
+		groupIndexes            []int
+	)
+
+	for i := range sc.Clients {
+		path := fmt.Sprintf("clients[%d]", i)
+		clientConfig := &sc.Clients[i]
+		if !c.add(path, clientConfig.Initialize(listenConfigCache, dialerCache, logger)) {
+			continue
+		}
+
+		if clientConfig.isGroup() {
+			groupIndexes = append(groupIndexes, i)
+			continue
+		}
+
+		tcpClient, err := clientConfig.TCPClient()
+		switch err {
+		case errNetworkDisabled:
+		case nil:
+			tcpClientMap[clientConfig.Name] = tcpClient
+			if ic, ok := tcpClient.(*internalTCPClient); ok {
+				internalTCPClients = append(internalTCPClients, checkInternalTCPClient{path, ic})
+			}
+		default:
+			c.add(path, fmt.Errorf("failed to create TCP client: %w", err))
+		}
+
+		udpClient, err := clientConfig.UDPClient()
+		switch err {
+		case errNetworkDisabled:
+		case nil:
+			udpClientMap[clientConfig.Name] = udpClient
+			maxClientPackerHeadroom = zerocopy.MaxHeadroom(maxClientPackerHeadroom, udpClient.Info().PackerHeadroom)
+		default:
+			c.add(path, fmt.Errorf("failed to create UDP client: %w", err))
+		}
+	}
+
+	groups := make([]clientGroup, 0, len(groupIndexes))
+	groupNames := make([]string, 0, len(groupIndexes))
+	for _, i := range groupIndexes {
+		g, err := sc.Clients[i].clientGroup(tcpClientMap, udpClientMap)
+		if !c.add(fmt.Sprintf("clients[%d]", i), err) {
+			continue
+		}
+		groups = append(groups, g)
+		groupNames = append(groupNames, sc.Clients[i].Name)
+	}
+
+	for i, g := range groups {
+		if g.tcpClient != nil {
+			tcpClientMap[groupNames[i]] = g.tcpClient
+		}
+		if g.udpClient != nil {
+			udpClientMap[groupNames[i]] = g.udpClient
+			maxClientPackerHeadroom = zerocopy.MaxHeadroom(maxClientPackerHeadroom, g.udpClient.Info().PackerHeadroom)
+		}
+	}
+
+	for i := range sc.Clients {
+		if chain := sc.Clients[i].chain; chain != nil {
+			c.add(fmt.Sprintf("clients[%d]", i), chain.bind(tcpClientMap))
+		}
+	}
+
+	hosts, err := sc.Hosts.Hosts(logger)
+	c.add("hosts", err)
+
+	resolvers := make([]dns.SimpleResolver, 0, len(sc.DNS))
+	resolverMap := make(map[string]dns.SimpleResolver, len(sc.DNS))
+
+	for i := range sc.DNS {
+		path := fmt.Sprintf("dns[%d]", i)
+		resolver, err := sc.DNS[i].SimpleResolver(tcpClientMap, udpClientMap, resolverMap, logger)
+		if !c.add(path, err) {
+			continue
+		}
+
+		_, err = sc.DNS[i].CacheSaver(resolver, logger)
+		c.add(path, err)
+
+		if hosts != nil {
+			resolver = hosts.Wrap(resolver)
+		}
+
+		resolvers = append(resolvers, resolver)
+		resolverMap[sc.DNS[i].Name] = resolver
+	}
+
+	if hosts != nil && len(resolvers) == 0 {
+		resolvers = append(resolvers, hosts)
+	}
+
+	r, err := sc.Router.Router(logger, resolvers, resolverMap, tcpClientMap, udpClientMap, serverIndexByName)
+	c.add("router", err)
+	return r, internalTCPClients, maxClientPackerHeadroom
+}
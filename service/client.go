@@ -3,15 +3,30 @@ package service
 import (
 	"errors"
 	"fmt"
+	"net/netip"
+	"time"
 
+	"github.com/database64128/shadowsocks-go/clientgroup"
+	"github.com/database64128/shadowsocks-go/compression"
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/direct"
 	"github.com/database64128/shadowsocks-go/http"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/obfs"
+	"github.com/database64128/shadowsocks-go/proxyproto"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/sip003"
+	"github.com/database64128/shadowsocks-go/socks5"
 	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/ssaead"
+	"github.com/database64128/shadowsocks-go/uot"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
 
+// defaultUDPHopInterval is the default interval between UDP port hops.
+const defaultUDPHopInterval = 30 * time.Second
+
 // ClientConfig stores a client configuration.
 // It may be marshaled as or unmarshaled from JSON.
 type ClientConfig struct {
@@ -19,9 +34,151 @@ type ClientConfig struct {
 	Name string `json:"name"`
 
 	// Protocol is the protocol used by the client.
-	// Valid values include "direct", "socks5", "http", "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm".
+	// Valid values include "direct", "internal", "echo", "urltest", "loadbalance", "failover", "sip008", "socks5", "http", "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305".
+	//
+	// "aes-256-gcm" and "chacha20-ietf-poly1305" are legacy Shadowsocks AEAD methods,
+	// for connecting to servers that do not support Shadowsocks 2022.
+	//
+	// An "echo" client sends everything back to the sender instead of connecting to the target.
+	// It is useful for end-to-end testing, MTU probing, and latency measurement without external hosts.
+	//
+	// A "urltest" client is a group of other clients. It periodically probes its members
+	// with an HTTP(S) request, and dispatches to the healthy member with the lowest latency.
+	//
+	// A "loadbalance" client is a group of other clients. It spreads new TCP connections
+	// and UDP sessions across its members by weight.
+	//
+	// A "failover" client is a group of other clients. It uses its first member that is up,
+	// and fails back when an earlier member recovers.
+	//
+	// A "sip008" client periodically fetches a SIP008 online config document from OnlineConfigURL,
+	// and dispatches to a group of Shadowsocks 2022 clients, one for each server in the document.
+	// The clients are replaced when the document changes, without a restart. Unlike groups,
+	// it can be a member of "urltest", "loadbalance" and "failover" groups.
 	Protocol string `json:"protocol"`
 
+	// InternalServer is the name of a server in the same process.
+	//
+	// TCP connections dispatched to an "internal" client are routed again as if they were
+	// accepted by the named server, without going through a loopback socket.
+	// This allows chaining servers in a single process, e.g. entry -> bridge -> exit.
+	//
+	// Only the named server's routes are applied. Its user ACLs, rate limits, traffic stats
+	// and connection tracking are skipped, as the connection is counted and restricted
+	// by the server that accepted it.
+	//
+	// Only applicable to the "internal" protocol, which only supports TCP.
+	// UDP sessions cannot be chained, and need a loopback client instead.
+	InternalServer string `json:"internalServer"`
+
+	// OnlineConfigURL is the HTTPS URL of the SIP008 online config document.
+	//
+	// Only applicable to the "sip008" protocol.
+	OnlineConfigURL string `json:"onlineConfigURL"`
+
+	// OnlineConfigInterval is the time between fetches of the online config document.
+	//
+	// The default value is 1h.
+	//
+	// Only applicable to the "sip008" protocol.
+	OnlineConfigInterval jsonhelper.Duration `json:"onlineConfigInterval"`
+
+	// OnlineConfigGroup is the group protocol for dispatching to the servers in the online config document:
+	// "failover" (default), "urltest" or "loadbalance". The group is configured by the options of the protocol,
+	// like HealthCheckURL, except that all servers have the same weight.
+	//
+	// Only applicable to the "sip008" protocol.
+	OnlineConfigGroup string `json:"onlineConfigGroup"`
+
+	onlineConfig *onlineConfigClient
+
+	// Members is the list of names of the clients in the group.
+	// Members must not be groups. Members of "urltest" groups must have TCP enabled for probing.
+	// The group supports TCP or UDP if any member has it enabled.
+	// Members of "failover" groups are in order of priority.
+	//
+	// Only applicable to the "urltest", "loadbalance" and "failover" protocols.
+	Members []string `json:"members"`
+
+	// Weights is the list of weights of the members, in the same order as Members.
+	// If empty, all members have a weight of 1.
+	//
+	// Only applicable to the "loadbalance" protocol.
+	Weights []uint `json:"weights"`
+
+	// LoadBalanceStrategy is how members are selected.
+	//
+	//   - "round-robin" (default): Spread connections and sessions in weighted round-robin order.
+	//   - "consistent-hashing": Select members by hashing the target host with the weights,
+	//     so that connections and sessions to the same destination use the same member.
+	//
+	// Only applicable to the "loadbalance" protocol, and "sip008" clients with the "loadbalance" group.
+	LoadBalanceStrategy string `json:"loadBalanceStrategy"`
+
+	// HealthCheckURL is the HTTP or HTTPS URL to check members' health with.
+	// Any HTTP response counts as healthy. Only members with TCP enabled are checked.
+	//
+	// The default value is "https://www.gstatic.com/generate_204".
+	//
+	// Only applicable to the "failover" protocol, "sip008" clients with the "failover" group, and clients with FallbackEndpoints.
+	HealthCheckURL string `json:"healthCheckURL"`
+
+	// HealthCheckInterval is the time between health checks.
+	//
+	// The default value is 30s.
+	//
+	// Only applicable to the "failover" protocol, "sip008" clients with the "failover" group, and clients with FallbackEndpoints.
+	HealthCheckInterval jsonhelper.Duration `json:"healthCheckInterval"`
+
+	// HealthCheckTimeout is how long to wait for a health check response.
+	//
+	// The default value is 5s.
+	//
+	// Only applicable to the "failover" protocol, "sip008" clients with the "failover" group, and clients with FallbackEndpoints.
+	HealthCheckTimeout jsonhelper.Duration `json:"healthCheckTimeout"`
+
+	// FailureThreshold is the number of consecutive dial or health check failures
+	// that mark a member as down. A member is up again after a successful health check.
+	//
+	// The default value is 3.
+	//
+	// Only applicable to the "failover" protocol, "sip008" clients with the "failover" group, and clients with FallbackEndpoints.
+	FailureThreshold int `json:"failureThreshold"`
+
+	// URLTestURL is the HTTP or HTTPS URL to probe members with.
+	// Any HTTP response counts as healthy.
+	//
+	// The default value is "https://www.gstatic.com/generate_204".
+	URLTestURL string `json:"urlTestURL"`
+
+	// URLTestInterval is the time between probes.
+	//
+	// The default value is 5m.
+	URLTestInterval jsonhelper.Duration `json:"urlTestInterval"`
+
+	// URLTestTimeout is how long to wait for a probe response.
+	//
+	// The default value is 5s.
+	URLTestTimeout jsonhelper.Duration `json:"urlTestTimeout"`
+
+	// URLTestTolerance is how much lower the latency of another member must be
+	// to replace a healthy selected member, so that the selection does not flap.
+	//
+	// The default value is 50ms.
+	URLTestTolerance jsonhelper.Duration `json:"urlTestTolerance"`
+
+	// URLTestUDPProbeAddress is the address of a DNS server to measure the UDP round-trip time and packet loss
+	// of members with. Each probe sends a burst of DNS queries through each member with UDP enabled,
+	// and UDP is dispatched to the member with the lowest round-trip time adjusted for packet loss.
+	//
+	// If not set, members are selected for UDP by the URL test latency.
+	URLTestUDPProbeAddress conn.Addr `json:"urlTestUDPProbeAddress"`
+
+	// URLTestUDPProbeCount is the number of DNS queries sent in each UDP probe.
+	//
+	// The default value is 10.
+	URLTestUDPProbeCount int `json:"urlTestUDPProbeCount"`
+
 	// Network controls the address family of the resolved IP address
 	// when the address is a domain name. It is ignored if the address
 	// is an IP address.
@@ -38,6 +195,17 @@ type ClientConfig struct {
 	// Do not use if either TCPAddress or UDPAddress is specified.
 	Endpoint conn.Addr `json:"endpoint"`
 
+	// FallbackEndpoints is the list of other addresses of the same remote proxy server.
+	//
+	// When set, the client works like a "failover" group of one client per address,
+	// starting with Endpoint, and fails over to the next address when the current one
+	// stops passing health checks, e.g. when a server IP is blocked.
+	// Health checks are configured by HealthCheckURL, HealthCheckInterval,
+	// HealthCheckTimeout, and FailureThreshold.
+	//
+	// Requires Endpoint. Only applicable to proxy protocols.
+	FallbackEndpoints []conn.Addr `json:"fallbackEndpoints"`
+
 	// TCPAddress is the TCP address of the remote proxy server, if applicable.
 	//
 	// Do not use if Endpoint is specified.
@@ -48,9 +216,57 @@ type ClientConfig struct {
 	// Do not use if Endpoint is specified.
 	UDPAddress conn.Addr `json:"udpAddress"`
 
+	// Credentials is the list of username/password credentials for the remote proxy server.
+	//
+	// The first credential is used until the server rejects it. Then the next credentials are tried
+	// in order, and the first one accepted is used from then on. This allows credentials rotated by
+	// the upstream provider to be added ahead of time, without restarting when the rotation happens.
+	//
+	// Only applicable to "socks5" and "http".
+	Credentials []direct.UpstreamCredential `json:"credentials"`
+
+	upstreamCredentials *direct.UpstreamCredentialList
+
 	DialerFwmark       int `json:"dialerFwmark"`
 	DialerTrafficClass int `json:"dialerTrafficClass"`
 
+	// DialerDSCP is the DSCP value to mark outgoing TCP connections and UDP packets with,
+	// like 46 for Expedited Forwarding. It is an alternative to DialerTrafficClass,
+	// and cannot be set together with it.
+	//
+	// Available on Unix-like systems.
+	DialerDSCP int `json:"dialerDSCP"`
+
+	dialerTrafficClass int
+
+	// DialerBindInterface is the name of the network interface to bind outgoing sockets to,
+	// like "eth1". It applies to TCP connections and UDP sockets opened for the client.
+	// On multi-WAN hosts, this pins the client's egress without fwmark-based policy routing.
+	//
+	// Available on Linux.
+	DialerBindInterface string `json:"dialerBindInterface"`
+
+	// DialerSourcePrefixes is the pool of local source addresses for outgoing TCP connections and UDP sockets,
+	// like ["2001:db8:1234::/64"] for a routed IPv6 prefix, or ["203.0.113.1/32", "203.0.113.2/32"]
+	// for several public IPv4 addresses. Each connection or UDP session uses an address
+	// of the same address family as its peer, selected by DialerSourcePolicy.
+	//
+	// Selecting an address that is not assigned to an interface requires a local route for the prefix
+	// and nonlocal binding, like "ip -6 route add local 2001:db8:1234::/64 dev lo" and
+	// "sysctl net.ipv6.ip_nonlocal_bind=1" on Linux.
+	//
+	// Only applicable to "direct" and Shadowsocks 2022.
+	DialerSourcePrefixes []netip.Prefix `json:"dialerSourcePrefixes"`
+
+	// DialerSourcePolicy is the policy for selecting source addresses from DialerSourcePrefixes.
+	//
+	//   - "random" (default): a random address for each connection or session.
+	//   - "target": an address chosen by the hash of the target address.
+	//   - "user": an address chosen by the hash of the username. Traffic without a username uses random addresses.
+	DialerSourcePolicy conn.SourceAddrPolicy `json:"dialerSourcePolicy"`
+
+	sourceAddrs *conn.SourceAddrPool
+
 	// TCP
 
 	EnableTCP bool `json:"enableTCP"`
@@ -75,6 +291,15 @@ type ClientConfig struct {
 	// Available on platforms supported by Go std's MPTCP implementation.
 	MultipathTCP bool `json:"multipathTCP"`
 
+	// ProxyProtocolVersion is the version of the PROXY protocol header to send
+	// at the beginning of each outgoing connection. Valid values are 1 and 2.
+	//
+	// The header carries the original client address and the address it connected to.
+	// If unspecified or 0, no header is sent.
+	//
+	// Only applicable to the "direct" protocol.
+	ProxyProtocolVersion int `json:"proxyProtocolVersion"`
+
 	// AllowSegmentedFixedLengthHeader disables the requirement that
 	// the fixed-length header must be read in a single read call.
 	//
@@ -84,17 +309,125 @@ type ClientConfig struct {
 	// Only applicable to Shadowsocks 2022 TCP.
 	AllowSegmentedFixedLengthHeader bool `json:"allowSegmentedFixedLengthHeader"`
 
+	// Compression is the stream compression algorithm for TCP connections to the server.
+	// The server must have the same option enabled.
+	//
+	// - "": No compression.
+	// - "zstd": Zstandard.
+	//
+	// Compression is turned off per connection when the initial payload
+	// or the target port indicates encrypted traffic, such as TLS or SSH.
+	//
+	// Compression happens before encryption, so the encrypted stream length leaks information
+	// about the plaintext. An attacker able to inject chosen plaintext next to a secret in the
+	// same connection can recover the secret, as in CRIME and BREACH.
+	//
+	// Only applicable to "none", "plain" and Shadowsocks 2022.
+	Compression string `json:"compression"`
+
+	compressionAlgorithm compression.Algorithm
+
+	// TCPObfs is the simple-obfs style obfuscation mode for TCP connections to the server.
+	// The server must use the same mode.
+	//
+	// - "": No obfuscation.
+	// - "http": Start each connection with a WebSocket upgrade request.
+	// - "tls": Start each connection with a TLS handshake, and send data in TLS application data records.
+	//
+	// Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD.
+	TCPObfs string `json:"tcpObfs"`
+
+	// TCPObfsHost is the host name in the HTTP Host header or the TLS server name indication.
+	//
+	// The default value is the host of the server's TCP address.
+	TCPObfsHost string `json:"tcpObfsHost"`
+
 	// UDP
 
 	EnableUDP bool `json:"enableUDP"`
 	MTU       int  `json:"mtu"`
 
+	// NATTimeout is the duration after which an inactive NAT mapping through the client expires.
+	// It overrides the server's NAT timeout, but is raised to the server's minimum NAT timeout, if any.
+	// DNS-only clients can use short timeouts, while gaming and VoIP traffic needs several minutes.
+	//
+	// The default value is 0, which uses the server's NAT timeout.
+	//
+	// Not applicable to client groups, which use their members' NAT timeouts.
+	NATTimeout jsonhelper.Duration `json:"natTimeout"`
+
+	// UDPObfs is the obfuscation mode for UDP packets to the server.
+	// The server must use the same mode and UDPObfsPSK.
+	//
+	// - "": No obfuscation.
+	// - "xor": XOR with a key derived from UDPObfsPSK. No overhead.
+	// - "salted-xor": XOR with a keystream derived from UDPObfsPSK and a random salt. 8 bytes of overhead per packet.
+	//
+	// Only applicable to "none", "plain" and Shadowsocks 2022.
+	UDPObfs string `json:"udpObfs"`
+
+	// UDPObfsPSK is the pre-shared key for UDP obfuscation.
+	UDPObfsPSK []byte `json:"udpObfsPSK"`
+
+	udpObfuscator obfs.Obfuscator
+
+	// UDPOverTCP relays UDP sessions over TCP connections to the server,
+	// using sing-box's UDP-over-TCP protocol. The server must have UDPOverTCP enabled.
+	//
+	// - "": Relay UDP sessions over UDP.
+	// - "always": Relay all UDP sessions over TCP.
+	// - "fallback": Relay UDP sessions over UDP, but relay new sessions over TCP for a while
+	//   after consecutive sessions receive nothing, as happens when the path blocks UDP.
+	//
+	// Requires EnableTCP. Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD.
+	UDPOverTCP string `json:"udpOverTCP"`
+
 	// Shadowsocks
 
 	PSK           []byte   `json:"psk"`
 	IPSKs         [][]byte `json:"iPSKs"`
 	PaddingPolicy string   `json:"paddingPolicy"`
 
+	// NextIPSKs is the identity PSKs to switch to at NextIPSKsAt, for rotating the server's identity PSK.
+	// New connections and sessions use IPSKs before NextIPSKsAt, and NextIPSKs from then on.
+	// Existing ones are not affected.
+	//
+	// Must have the same number of identity PSKs as IPSKs.
+	// Only applicable to Shadowsocks 2022.
+	NextIPSKs [][]byte `json:"nextIPSKs"`
+
+	// NextIPSKsAt is when to switch to NextIPSKs.
+	NextIPSKsAt time.Time `json:"nextIPSKsAt"`
+
+	// Password is the password of a legacy Shadowsocks AEAD server.
+	// The key is derived from it the same way as other implementations do.
+	//
+	// Only applicable to "aes-256-gcm" and "chacha20-ietf-poly1305".
+	Password string `json:"password"`
+
+	// Plugin is the path to a SIP003 plugin executable, like v2ray-plugin or kcptun,
+	// or its name to be looked up in PATH.
+	//
+	// When set, the plugin is started with the client, and restarted if it exits.
+	// TCP connections to the server go through the plugin on a local port. UDP is not affected.
+	//
+	// Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD.
+	Plugin string `json:"plugin"`
+
+	// PluginOpts is the options passed to the plugin in SS_PLUGIN_OPTIONS.
+	PluginOpts string `json:"pluginOpts"`
+
+	plugin *sip003.Plugin
+
+	// Dialer is the name of another client or client group to open TCP connections to the server through,
+	// like a "socks5" or "http" client, or another Shadowsocks client. The dialer may have a dialer itself,
+	// so clients can be chained into multi-hop paths, e.g. ss-2022 -> socks5 -> remote server.
+	//
+	// Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD, over TCP.
+	Dialer string `json:"dialer"`
+
+	chain *chainOpener
+
 	// SlidingWindowFilterSize is the size of the sliding window filter.
 	//
 	// The default value is 256.
@@ -102,8 +435,27 @@ type ClientConfig struct {
 	// Only applicable to Shadowsocks 2022 UDP.
 	SlidingWindowFilterSize int `json:"slidingWindowFilterSize"`
 
+	// UDPHopPorts is a range of ports on the server, like "20220-20229", for UDP port hopping.
+	//
+	// When set, each UDP session starts on a random port in the range, and periodically
+	// hops to another random port in the range, while keeping the same Shadowsocks session.
+	// The server must listen on all ports in the range, which is easily done with a port range
+	// in its listen address. The port in the server's UDP address is not used.
+	//
+	// Only applicable to Shadowsocks 2022 UDP.
+	UDPHopPorts string `json:"udpHopPorts"`
+
+	// UDPHopInterval is how long a UDP session stays on a port before hopping to the next one.
+	//
+	// The default value is 30s.
+	UDPHopInterval jsonhelper.Duration `json:"udpHopInterval"`
+
+	udpPortHopping ss2022.PortHopping
+
 	cipherConfig *ss2022.ClientCipherConfig
 
+	aeadCipherConfig *ssaead.CipherConfig
+
 	// Taint
 
 	UnsafeRequestStreamPrefix  []byte `json:"unsafeRequestStreamPrefix"`
@@ -115,7 +467,8 @@ type ClientConfig struct {
 }
 
 func (cc *ClientConfig) checkAddresses() error {
-	if cc.Protocol == "direct" {
+	switch cc.Protocol {
+	case "direct", "internal", "echo", "urltest", "loadbalance", "failover", "sip008":
 		return nil
 	}
 
@@ -158,6 +511,250 @@ func (cc *ClientConfig) Initialize(listenConfigCache conn.ListenConfigCache, dia
 		return
 	}
 
+	if err = proxyproto.CheckVersion(cc.ProxyProtocolVersion); err != nil {
+		return
+	}
+
+	if len(cc.FallbackEndpoints) != 0 {
+		switch cc.Protocol {
+		case "socks5", "http", "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+		default:
+			return fmt.Errorf("fallback endpoints are not supported by protocol %q", cc.Protocol)
+		}
+		if !cc.Endpoint.IsValid() {
+			return errors.New("fallback endpoints require endpoint")
+		}
+		for i, endpoint := range cc.FallbackEndpoints {
+			if !endpoint.IsValid() {
+				return fmt.Errorf("fallback endpoint %d is invalid", i)
+			}
+		}
+	}
+
+	if cc.Protocol == "internal" {
+		if cc.InternalServer == "" {
+			return errors.New("internalServer is required for internal client")
+		}
+		if cc.EnableUDP {
+			return errors.New("internal client does not support UDP")
+		}
+	}
+
+	if cc.Dialer != "" {
+		switch cc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+		default:
+			return fmt.Errorf("dialer is not supported by protocol %q", cc.Protocol)
+		}
+		if cc.Dialer == cc.Name {
+			return errors.New("client cannot be its own dialer")
+		}
+		if cc.EnableUDP {
+			return errors.New("dialer does not support UDP")
+		}
+		if len(cc.FallbackEndpoints) != 0 {
+			return errors.New("dialer cannot be used with fallback endpoints")
+		}
+		if cc.Plugin != "" {
+			return errors.New("dialer cannot be used with plugin")
+		}
+		cc.chain = newChainOpener(cc.Dialer, cc.TCPAddress)
+	}
+
+	switch cc.Protocol {
+	case "urltest", "loadbalance", "failover":
+		if len(cc.Members) == 0 {
+			return fmt.Errorf("members are required for %s client", cc.Protocol)
+		}
+		if cc.NATTimeout != 0 {
+			return fmt.Errorf("NAT timeout is not supported by %s client", cc.Protocol)
+		}
+	}
+
+	if cc.NATTimeout < 0 {
+		return fmt.Errorf("negative NAT timeout: %s", cc.NATTimeout.Value())
+	}
+
+	if cc.Protocol == "loadbalance" {
+		if len(cc.Weights) != 0 && len(cc.Weights) != len(cc.Members) {
+			return fmt.Errorf("got %d weights for %d members", len(cc.Weights), len(cc.Members))
+		}
+		switch cc.LoadBalanceStrategy {
+		case "":
+			cc.LoadBalanceStrategy = "round-robin"
+		case "round-robin", "consistent-hashing":
+		default:
+			return fmt.Errorf("unknown load balance strategy: %q", cc.LoadBalanceStrategy)
+		}
+	}
+
+	if cc.Protocol == "failover" || len(cc.FallbackEndpoints) != 0 {
+		if cc.HealthCheckURL == "" {
+			cc.HealthCheckURL = clientgroup.DefaultURLTestURL
+		}
+		switch {
+		case cc.HealthCheckInterval == 0:
+			cc.HealthCheckInterval = jsonhelper.Duration(clientgroup.DefaultFailoverInterval)
+		case cc.HealthCheckInterval < 0:
+			return fmt.Errorf("negative health check interval: %s", cc.HealthCheckInterval.Value())
+		}
+		switch {
+		case cc.HealthCheckTimeout == 0:
+			cc.HealthCheckTimeout = jsonhelper.Duration(clientgroup.DefaultURLTestTimeout)
+		case cc.HealthCheckTimeout < 0:
+			return fmt.Errorf("negative health check timeout: %s", cc.HealthCheckTimeout.Value())
+		}
+		switch {
+		case cc.FailureThreshold == 0:
+			cc.FailureThreshold = clientgroup.DefaultFailoverFailureThreshold
+		case cc.FailureThreshold < 0:
+			return fmt.Errorf("negative failure threshold: %d", cc.FailureThreshold)
+		}
+	}
+
+	if cc.Protocol == "urltest" {
+		if cc.URLTestURL == "" {
+			cc.URLTestURL = clientgroup.DefaultURLTestURL
+		}
+		switch {
+		case cc.URLTestInterval == 0:
+			cc.URLTestInterval = jsonhelper.Duration(clientgroup.DefaultURLTestInterval)
+		case cc.URLTestInterval < 0:
+			return fmt.Errorf("negative URL test interval: %s", cc.URLTestInterval.Value())
+		}
+		switch {
+		case cc.URLTestTimeout == 0:
+			cc.URLTestTimeout = jsonhelper.Duration(clientgroup.DefaultURLTestTimeout)
+		case cc.URLTestTimeout < 0:
+			return fmt.Errorf("negative URL test timeout: %s", cc.URLTestTimeout.Value())
+		}
+		switch {
+		case cc.URLTestTolerance == 0:
+			cc.URLTestTolerance = jsonhelper.Duration(clientgroup.DefaultURLTestTolerance)
+		case cc.URLTestTolerance < 0:
+			return fmt.Errorf("negative URL test tolerance: %s", cc.URLTestTolerance.Value())
+		}
+		if cc.URLTestUDPProbeAddress.IsValid() {
+			switch {
+			case cc.URLTestUDPProbeCount == 0:
+				cc.URLTestUDPProbeCount = clientgroup.DefaultUDPProbeCount
+			case cc.URLTestUDPProbeCount < 0:
+				return fmt.Errorf("negative URL test UDP probe count: %d", cc.URLTestUDPProbeCount)
+			}
+		}
+	}
+
+	cc.compressionAlgorithm, err = compression.ParseAlgorithm(cc.Compression)
+	if err != nil {
+		return
+	}
+	if cc.compressionAlgorithm != compression.AlgorithmNone {
+		switch cc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("compression is not supported by protocol %q", cc.Protocol)
+		}
+	}
+
+	if len(cc.Credentials) > 0 {
+		switch cc.Protocol {
+		case "socks5", "http":
+		default:
+			return fmt.Errorf("credentials are not supported by protocol %q", cc.Protocol)
+		}
+		for i, c := range cc.Credentials {
+			if c.Username == "" {
+				return fmt.Errorf("credential %d has an empty username", i)
+			}
+			if cc.Protocol == "socks5" && (len(c.Username) > 255 || len(c.Password) > 255) {
+				return fmt.Errorf("credential %d: %w", i, socks5.ErrUsernamePasswordTooLong)
+			}
+		}
+		cc.upstreamCredentials = direct.NewUpstreamCredentialList(cc.Credentials)
+	}
+
+	cc.udpObfuscator, err = obfs.New(cc.UDPObfs, cc.UDPObfsPSK)
+	if err != nil {
+		return
+	}
+	if cc.udpObfuscator != nil {
+		switch cc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("UDP obfuscation is not supported by protocol %q", cc.Protocol)
+		}
+	}
+
+	if err = obfs.CheckStreamMode(cc.TCPObfs); err != nil {
+		return
+	}
+	if cc.TCPObfs != obfs.StreamModeNone {
+		switch cc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+		default:
+			return fmt.Errorf("TCP obfuscation is not supported by protocol %q", cc.Protocol)
+		}
+		if cc.TCPObfsHost == "" {
+			cc.TCPObfsHost = cc.TCPAddress.Host()
+		}
+	}
+
+	switch cc.UDPOverTCP {
+	case "":
+	case "always", "fallback":
+		switch cc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+		default:
+			return fmt.Errorf("UDP over TCP is not supported by protocol %q", cc.Protocol)
+		}
+		if !cc.EnableTCP {
+			return errors.New("UDP over TCP requires TCP to be enabled")
+		}
+	default:
+		return fmt.Errorf("unknown UDP over TCP mode: %q", cc.UDPOverTCP)
+	}
+
+	cc.dialerTrafficClass = cc.DialerTrafficClass
+	if cc.DialerDSCP != 0 {
+		if cc.DialerTrafficClass != 0 {
+			return errors.New("dialerDSCP and dialerTrafficClass cannot be set together")
+		}
+		if cc.dialerTrafficClass, err = conn.TrafficClassFromDSCP(cc.DialerDSCP); err != nil {
+			return fmt.Errorf("bad dialer DSCP: %w", err)
+		}
+	}
+
+	if len(cc.DialerSourcePrefixes) != 0 || cc.DialerSourcePolicy != "" {
+		switch cc.Protocol {
+		case "direct", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("dialer source prefixes are not supported by protocol %q", cc.Protocol)
+		}
+		if cc.sourceAddrs, err = conn.NewSourceAddrPool(cc.DialerSourcePrefixes, cc.DialerSourcePolicy); err != nil {
+			return fmt.Errorf("bad dialer source prefixes: %w", err)
+		}
+	}
+
+	if cc.UDPHopPorts != "" {
+		switch cc.Protocol {
+		case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("UDP port hopping is not supported by protocol %q", cc.Protocol)
+		}
+		cc.udpPortHopping.FirstPort, cc.udpPortHopping.LastPort, err = parsePortRange(cc.UDPHopPorts)
+		if err != nil {
+			return fmt.Errorf("bad UDP hop ports: %w", err)
+		}
+		switch {
+		case cc.UDPHopInterval == 0:
+			cc.udpPortHopping.Interval = defaultUDPHopInterval
+		case cc.UDPHopInterval < 0:
+			return fmt.Errorf("negative UDP hop interval: %s", cc.UDPHopInterval.Value())
+		default:
+			cc.udpPortHopping.Interval = cc.UDPHopInterval.Value()
+		}
+	}
+
 	switch cc.Protocol {
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		if err = ss2022.CheckPSKLength(cc.Protocol, cc.PSK, cc.IPSKs); err != nil {
@@ -167,14 +764,78 @@ func (cc *ClientConfig) Initialize(listenConfigCache conn.ListenConfigCache, dia
 		if err != nil {
 			return
 		}
+		if len(cc.NextIPSKs) > 0 {
+			if len(cc.NextIPSKs) != len(cc.IPSKs) {
+				return fmt.Errorf("nextIPSKs has %d identity PSKs, want %d as in iPSKs", len(cc.NextIPSKs), len(cc.IPSKs))
+			}
+			if cc.NextIPSKsAt.IsZero() {
+				return errors.New("nextIPSKs requires nextIPSKsAt")
+			}
+			if err = ss2022.CheckPSKLength(cc.Protocol, cc.PSK, cc.NextIPSKs); err != nil {
+				return
+			}
+			var next *ss2022.ClientCipherConfig
+			next, err = ss2022.NewClientCipherConfig(cc.PSK, cc.NextIPSKs, cc.EnableUDP)
+			if err != nil {
+				return
+			}
+			cc.cipherConfig.ScheduleNext(next, cc.NextIPSKsAt)
+		}
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		cc.aeadCipherConfig, err = ssaead.NewCipherConfig(cc.Protocol, cc.Password)
+		if err != nil {
+			return
+		}
+	}
+
+	if err = cc.initPlugin(logger); err != nil {
+		return
 	}
 
 	cc.listenConfigCache = listenConfigCache
 	cc.dialerCache = dialerCache
 	cc.logger = logger
+
+	if cc.Protocol == "sip008" {
+		err = cc.initOnlineConfig()
+	}
 	return
 }
 
+// initPlugin creates the SIP003 plugin, if any,
+// and points the TCP address at the plugin's local port.
+func (cc *ClientConfig) initPlugin(logger *zap.Logger) error {
+	if cc.Plugin == "" {
+		if cc.PluginOpts != "" {
+			return errors.New("pluginOpts requires plugin")
+		}
+		return nil
+	}
+
+	switch cc.Protocol {
+	case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+	default:
+		return fmt.Errorf("plugin is not supported by protocol %q", cc.Protocol)
+	}
+
+	if len(cc.FallbackEndpoints) != 0 {
+		return errors.New("plugin does not support fallback endpoints")
+	}
+
+	if !cc.EnableTCP {
+		return nil
+	}
+
+	local, err := sip003.LocalAddrPort(cc.tcpNetwork())
+	if err != nil {
+		return err
+	}
+
+	cc.plugin = sip003.New(cc.Name, cc.Plugin, cc.PluginOpts, cc.TCPAddress.Host(), cc.TCPAddress.Port(), local.Addr().String(), local.Port(), logger)
+	cc.TCPAddress = conn.AddrFromIPPort(local)
+	return nil
+}
+
 func (cc *ClientConfig) tcpNetwork() string {
 	switch cc.Network {
 	case "ip":
@@ -189,13 +850,208 @@ func (cc *ClientConfig) tcpNetwork() string {
 }
 
 func (cc *ClientConfig) dialer() conn.Dialer {
-	return cc.dialerCache.Get(conn.DialerSocketOptions{
+	dialer := cc.dialerCache.Get(conn.DialerSocketOptions{
 		Fwmark:              cc.DialerFwmark,
-		TrafficClass:        cc.DialerTrafficClass,
+		BindInterface:       cc.DialerBindInterface,
+		TrafficClass:        cc.dialerTrafficClass,
 		TCPFastOpen:         cc.DialerTFO,
 		TCPFastOpenFallback: cc.TCPFastOpenFallback,
 		MultipathTCP:        cc.MultipathTCP,
 	})
+	if cc.sourceAddrs != nil {
+		dialer = dialer.WithSourceAddrPool(cc.sourceAddrs)
+	}
+	return dialer
+}
+
+// clientGroup is a client group created from a ClientConfig.
+type clientGroup struct {
+	// tcpClient is nil if the group does not support TCP.
+	tcpClient zerocopy.TCPClient
+
+	// udpClient is nil if the group does not support UDP.
+	udpClient zerocopy.UDPClient
+
+	// service runs in the background for the group, or is nil if the group does not need one.
+	service Relay
+
+	// status reports the group's status to the API, or is nil if the group does not report status.
+	status clientgroup.StatusReporter
+}
+
+// isGroup returns whether the ClientConfig is a client group.
+// Clients with fallback endpoints are groups of clients to each endpoint.
+func (cc *ClientConfig) isGroup() bool {
+	if len(cc.FallbackEndpoints) != 0 {
+		return true
+	}
+	switch cc.Protocol {
+	case "urltest", "loadbalance", "failover":
+		return true
+	default:
+		return false
+	}
+}
+
+// clientGroup creates a client group from the ClientConfig,
+// with members from the maps of non-group clients.
+func (cc *ClientConfig) clientGroup(tcpClientMap map[string]zerocopy.TCPClient, udpClientMap map[string]zerocopy.UDPClient) (clientGroup, error) {
+	if len(cc.FallbackEndpoints) != 0 {
+		return cc.endpointFailoverGroup()
+	}
+
+	members := make([]clientgroup.Member, len(cc.Members))
+	for i, name := range cc.Members {
+		members[i] = clientgroup.Member{
+			Name:      name,
+			TCPClient: tcpClientMap[name],
+			UDPClient: udpClientMap[name],
+		}
+	}
+
+	switch cc.Protocol {
+	case "urltest":
+		for _, m := range members {
+			if m.TCPClient == nil {
+				return clientGroup{}, fmt.Errorf("member %q is not a client with TCP enabled", m.Name)
+			}
+		}
+
+		g, err := clientgroup.NewURLTest(cc.Name, clientgroup.URLTestConfig{
+			URL:             cc.URLTestURL,
+			Interval:        cc.URLTestInterval.Value(),
+			Timeout:         cc.URLTestTimeout.Value(),
+			Tolerance:       cc.URLTestTolerance.Value(),
+			UDPProbeAddress: cc.URLTestUDPProbeAddress,
+			UDPProbeCount:   cc.URLTestUDPProbeCount,
+		}, members, cc.logger)
+		if err != nil {
+			return clientGroup{}, err
+		}
+
+		group := clientGroup{
+			tcpClient: g,
+			service:   g,
+			status:    g,
+		}
+		if g.HasUDP() {
+			group.udpClient = g.UDPClient()
+		}
+		return group, nil
+
+	case "loadbalance":
+		for _, m := range members {
+			if m.TCPClient == nil && m.UDPClient == nil {
+				return clientGroup{}, fmt.Errorf("member %q is not a client", m.Name)
+			}
+		}
+
+		g, err := clientgroup.NewLoadBalance(cc.Name, clientgroup.LoadBalanceConfig{
+			Weights:           cc.Weights,
+			ConsistentHashing: cc.LoadBalanceStrategy == "consistent-hashing",
+		}, members)
+		if err != nil {
+			return clientGroup{}, err
+		}
+
+		var group clientGroup
+		if g.HasTCP() {
+			group.tcpClient = g
+		}
+		if g.HasUDP() {
+			group.udpClient = g.UDPClient()
+		}
+		return group, nil
+
+	case "failover":
+		for _, m := range members {
+			if m.TCPClient == nil && m.UDPClient == nil {
+				return clientGroup{}, fmt.Errorf("member %q is not a client", m.Name)
+			}
+		}
+		return cc.failoverGroup(members)
+
+	default:
+		return clientGroup{}, fmt.Errorf("unknown client group protocol: %s", cc.Protocol)
+	}
+}
+
+// endpointFailoverGroup creates a failover group of clients to Endpoint and each of FallbackEndpoints.
+// Members are named after the client and their endpoint.
+func (cc *ClientConfig) endpointFailoverGroup() (clientGroup, error) {
+	endpoints := make([]conn.Addr, 0, 1+len(cc.FallbackEndpoints))
+	endpoints = append(endpoints, cc.Endpoint)
+	endpoints = append(endpoints, cc.FallbackEndpoints...)
+
+	members := make([]clientgroup.Member, len(endpoints))
+	for i, endpoint := range endpoints {
+		mcc := *cc
+		mcc.Name = cc.Name + "@" + endpoint.String()
+		mcc.Endpoint = endpoint
+		mcc.TCPAddress = endpoint
+		mcc.UDPAddress = endpoint
+		mcc.FallbackEndpoints = nil
+
+		members[i].Name = mcc.Name
+
+		tcpClient, err := mcc.TCPClient()
+		switch err {
+		case errNetworkDisabled:
+		case nil:
+			members[i].TCPClient = tcpClient
+		default:
+			return clientGroup{}, fmt.Errorf("failed to create TCP client for %s: %w", mcc.Name, err)
+		}
+
+		udpClient, err := mcc.UDPClient()
+		switch err {
+		case errNetworkDisabled:
+		case nil:
+			members[i].UDPClient = udpClient
+		default:
+			return clientGroup{}, fmt.Errorf("failed to create UDP client for %s: %w", mcc.Name, err)
+		}
+	}
+
+	return cc.failoverGroup(members)
+}
+
+// failoverGroup creates a failover group of the given members from the ClientConfig.
+func (cc *ClientConfig) failoverGroup(members []clientgroup.Member) (clientGroup, error) {
+	g, err := clientgroup.NewFailover(cc.Name, clientgroup.FailoverConfig{
+		URL:              cc.HealthCheckURL,
+		Interval:         cc.HealthCheckInterval.Value(),
+		Timeout:          cc.HealthCheckTimeout.Value(),
+		FailureThreshold: cc.FailureThreshold,
+	}, members, cc.logger)
+	if err != nil {
+		return clientGroup{}, err
+	}
+
+	group := clientGroup{
+		service: g,
+		status:  g,
+	}
+	if g.HasTCP() {
+		group.tcpClient = g
+	}
+	if g.HasUDP() {
+		group.udpClient = g.UDPClient()
+	}
+	return group, nil
+}
+
+// tcpConnOpener returns the opener of TCP connections to the server, with obfuscation if enabled.
+// Clients with a dialer open connections through the dialer client.
+func (cc *ClientConfig) tcpConnOpener(network string, dialer conn.Dialer) zerocopy.DirectReadWriteCloserOpener {
+	var rwo zerocopy.DirectReadWriteCloserOpener = zerocopy.NewTCPConnOpener(dialer, network, cc.TCPAddress.String())
+	if cc.chain != nil {
+		rwo = cc.chain
+	}
+	if cc.TCPObfs == obfs.StreamModeNone {
+		return rwo
+	}
+	return obfs.NewTCPConnOpener(rwo, cc.TCPObfs, cc.TCPObfsHost)
 }
 
 // TCPClient creates a zerocopy.TCPClient from the ClientConfig.
@@ -207,23 +1063,38 @@ func (cc *ClientConfig) TCPClient() (zerocopy.TCPClient, error) {
 	network := cc.tcpNetwork()
 	dialer := cc.dialer()
 
+	var c zerocopy.TCPClient
+
 	switch cc.Protocol {
 	case "direct":
-		return direct.NewTCPClient(cc.Name, network, dialer), nil
+		return direct.NewTCPClient(cc.Name, network, dialer, cc.ProxyProtocolVersion), nil
+	case "internal":
+		return newInternalTCPClient(cc.Name, cc.InternalServer), nil
+	case "echo":
+		return direct.NewEchoTCPClient(cc.Name), nil
+	case "sip008":
+		return cc.onlineConfig, nil
 	case "none", "plain":
-		return direct.NewShadowsocksNoneTCPClient(cc.Name, network, cc.TCPAddress.String(), dialer), nil
+		c = direct.NewShadowsocksNoneTCPClient(cc.Name, cc.tcpConnOpener(network, dialer))
 	case "socks5":
-		return direct.NewSocks5TCPClient(cc.Name, network, cc.TCPAddress.String(), dialer), nil
+		return direct.NewSocks5TCPClient(cc.Name, network, cc.TCPAddress.String(), dialer, cc.upstreamCredentials), nil
 	case "http":
-		return http.NewProxyClient(cc.Name, network, cc.TCPAddress.String(), dialer), nil
+		return http.NewProxyClient(cc.Name, network, cc.TCPAddress.String(), dialer, cc.upstreamCredentials), nil
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		if len(cc.UnsafeRequestStreamPrefix) != 0 || len(cc.UnsafeResponseStreamPrefix) != 0 {
 			cc.logger.Warn("Unsafe stream prefix taints the client", zap.String("client", cc.Name))
 		}
-		return ss2022.NewTCPClient(cc.Name, network, cc.TCPAddress.String(), dialer, cc.AllowSegmentedFixedLengthHeader, cc.cipherConfig, cc.UnsafeRequestStreamPrefix, cc.UnsafeResponseStreamPrefix), nil
+		c = ss2022.NewTCPClient(cc.Name, cc.tcpConnOpener(network, dialer), cc.AllowSegmentedFixedLengthHeader, cc.cipherConfig, cc.UnsafeRequestStreamPrefix, cc.UnsafeResponseStreamPrefix)
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		return ssaead.NewTCPClient(cc.Name, cc.tcpConnOpener(network, dialer), cc.aeadCipherConfig), nil
 	default:
 		return nil, fmt.Errorf("unknown protocol: %s", cc.Protocol)
 	}
+
+	if cc.compressionAlgorithm != compression.AlgorithmNone {
+		c = compression.NewTCPClient(c, cc.compressionAlgorithm)
+	}
+	return c, nil
 }
 
 func (cc *ClientConfig) UDPClient() (zerocopy.UDPClient, error) {
@@ -239,19 +1110,36 @@ func (cc *ClientConfig) UDPClient() (zerocopy.UDPClient, error) {
 		SendBufferSize:    conn.DefaultUDPSocketBufferSize,
 		ReceiveBufferSize: conn.DefaultUDPSocketBufferSize,
 		Fwmark:            cc.DialerFwmark,
-		TrafficClass:      cc.DialerTrafficClass,
+		BindInterface:     cc.DialerBindInterface,
+		TrafficClass:      cc.dialerTrafficClass,
 		PathMTUDiscovery:  true,
 	})
+	if cc.sourceAddrs != nil {
+		listenConfig = listenConfig.WithSourceAddrPool(cc.sourceAddrs)
+	}
+
+	// Leave room for the obfuscation overhead.
+	mtu := cc.MTU
+	if cc.udpObfuscator != nil {
+		mtu -= cc.udpObfuscator.Overhead()
+	}
+
+	var c zerocopy.UDPClient
 
 	switch cc.Protocol {
 	case "direct":
-		return direct.NewDirectUDPClient(cc.Name, cc.Network, cc.MTU, listenConfig), nil
+		c = direct.NewDirectUDPClient(cc.Name, cc.Network, cc.MTU, listenConfig)
+	case "echo":
+		c = direct.NewEchoUDPClient(cc.Name, cc.MTU, listenConfig)
+	case "sip008":
+		// Members have their own NAT timeouts.
+		return cc.onlineConfig.UDPClient(), nil
 	case "none", "plain":
-		return direct.NewShadowsocksNoneUDPClient(cc.Name, cc.Network, cc.UDPAddress, cc.MTU, listenConfig), nil
+		c = direct.NewShadowsocksNoneUDPClient(cc.Name, cc.Network, cc.UDPAddress, mtu, listenConfig)
 	case "socks5":
 		dialer := cc.dialer()
 		networkTCP := cc.tcpNetwork()
-		return direct.NewSocks5UDPClient(cc.logger, cc.Name, networkTCP, cc.Network, cc.UDPAddress.String(), dialer, cc.MTU, listenConfig), nil
+		c = direct.NewSocks5UDPClient(cc.logger, cc.Name, networkTCP, cc.Network, cc.UDPAddress.String(), dialer, cc.upstreamCredentials, cc.MTU, listenConfig)
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		shouldPad, err := ss2022.ParsePaddingPolicy(cc.PaddingPolicy)
 		if err != nil {
@@ -265,8 +1153,32 @@ func (cc *ClientConfig) UDPClient() (zerocopy.UDPClient, error) {
 			return nil, fmt.Errorf("negative sliding window filter size: %d", cc.SlidingWindowFilterSize)
 		}
 
-		return ss2022.NewUDPClient(cc.Name, cc.Network, cc.UDPAddress, cc.MTU, listenConfig, uint64(cc.SlidingWindowFilterSize), cc.cipherConfig, shouldPad), nil
+		c = ss2022.NewUDPClient(cc.Name, cc.Network, cc.UDPAddress, mtu, listenConfig, uint64(cc.SlidingWindowFilterSize), cc.cipherConfig, shouldPad, cc.udpPortHopping)
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		c = ssaead.NewUDPClient(cc.Name, cc.Network, cc.UDPAddress, mtu, listenConfig, cc.aeadCipherConfig)
 	default:
 		return nil, fmt.Errorf("unknown protocol: %s", cc.Protocol)
 	}
+
+	if cc.udpObfuscator != nil {
+		c = obfs.NewUDPClient(c, cc.udpObfuscator)
+	}
+
+	if cc.UDPOverTCP != "" {
+		tcpClient, err := cc.TCPClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TCP client for UDP over TCP: %w", err)
+		}
+		uotClient := uot.NewUDPClient(cc.logger, cc.Name, tcpClient, cc.MTU)
+		if cc.UDPOverTCP == "always" {
+			c = uotClient
+		} else {
+			c = uot.NewFallbackUDPClient(cc.logger, c, uotClient)
+		}
+	}
+
+	if natTimeout := cc.NATTimeout.Value(); natTimeout != 0 {
+		c = router.NewNATTimeoutUDPClient(c, natTimeout)
+	}
+	return c, nil
 }
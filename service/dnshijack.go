@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/router"
+)
+
+const (
+	// dnsHijackPort is the destination port of intercepted DNS queries.
+	dnsHijackPort = 53
+
+	// dnsHijackTCPIdleTimeout is how long an intercepted DNS over TCP connection can be idle
+	// before it is closed.
+	dnsHijackTCPIdleTimeout = 30 * time.Second
+)
+
+// dnsHijacker answers DNS queries intercepted by transparent proxy servers
+// with a resolver of the router, instead of relaying them.
+type dnsHijacker struct {
+	router       *router.Router
+	resolverName string
+}
+
+// newDNSHijacker returns a new DNS hijacker that answers queries with the router's resolver named resolverName,
+// or the router's resolvers in order if resolverName is empty.
+func newDNSHijacker(router *router.Router, resolverName string) *dnsHijacker {
+	return &dnsHijacker{
+		router:       router,
+		resolverName: resolverName,
+	}
+}
+
+// shouldHijack returns whether packets and connections to targetPort are intercepted.
+func (h *dnsHijacker) shouldHijack(targetPort uint16) bool {
+	return h != nil && targetPort == dnsHijackPort
+}
+
+// respond returns the response to the DNS query message, truncated to maxSize if positive.
+func (h *dnsHijacker) respond(ctx context.Context, query []byte, maxSize int) ([]byte, error) {
+	// The resolver is looked up for each query to follow router reloads.
+	resolver, err := h.router.Resolver(h.resolverName)
+	if err != nil {
+		return nil, err
+	}
+	return dns.Respond(ctx, resolver, query, maxSize)
+}
+
+// serveTCP answers length-prefixed DNS queries on c, starting with payload, until c is closed or idle.
+func (h *dnsHijacker) serveTCP(ctx context.Context, c net.Conn, payload []byte) error {
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(payload), c))
+	buf := make([]byte, 2+65535)
+
+	for {
+		if err := c.SetReadDeadline(time.Now().Add(dnsHijackTCPIdleTimeout)); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		query := buf[2 : 2+binary.BigEndian.Uint16(buf)]
+		if _, err := io.ReadFull(r, query); err != nil {
+			return err
+		}
+
+		resp, err := h.respond(ctx, query, 0)
+		if err != nil {
+			return err
+		}
+
+		b := make([]byte, 0, 2+len(resp))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(resp)))
+		b = append(b, resp...)
+		if _, err = c.Write(b); err != nil {
+			return err
+		}
+	}
+}
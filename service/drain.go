@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// Drainer is a relay service that can be stopped gracefully.
+type Drainer interface {
+	Relay
+
+	// Drain stops accepting new connections and sessions, and waits for existing ones
+	// to finish until ctx is done. Then it stops the service like Stop, closing the remaining ones,
+	// and returns how many were closed.
+	Drain(ctx context.Context) (int, error)
+}
+
+// canceledContext is a canceled context for stopping relay services without draining.
+var canceledContext = func() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}()
+
+// waitGroupWait waits for wg until ctx is done, and reports whether wg is done.
+//
+// Once ctx is done, the caller must make wg done, or a goroutine leaks.
+func waitGroupWait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		// Prefer reporting done if both are ready.
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
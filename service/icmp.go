@@ -0,0 +1,170 @@
+package service
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// portUnreachableSender sends ICMP port unreachable messages to clients of rejected UDP sessions.
+//
+// The raw ICMP sockets are opened on first use, which requires CAP_NET_RAW on Linux.
+// If a socket cannot be opened, the failure is logged once, and rejected packets are silently dropped.
+type portUnreachableSender struct {
+	logger *zap.Logger
+	once4  sync.Once
+	once6  sync.Once
+	conn4  *icmp.PacketConn
+	conn6  *icmp.PacketConn
+}
+
+// newPortUnreachableSender returns a new port unreachable sender.
+func newPortUnreachableSender(logger *zap.Logger) *portUnreachableSender {
+	return &portUnreachableSender{
+		logger: logger,
+	}
+}
+
+// Send sends an ICMP port unreachable message to clientAddrPort,
+// for a UDP packet of payloadLen bytes it sent to localAddrPort.
+func (s *portUnreachableSender) Send(clientAddrPort, localAddrPort netip.AddrPort, payloadLen int) {
+	clientAddrPort = netip.AddrPortFrom(clientAddrPort.Addr().Unmap(), clientAddrPort.Port())
+	localAddrPort = netip.AddrPortFrom(localAddrPort.Addr().Unmap(), localAddrPort.Port())
+
+	var (
+		c   *icmp.PacketConn
+		msg icmp.Message
+	)
+
+	switch {
+	case clientAddrPort.Addr().Is4():
+		if !localAddrPort.Addr().Is4() {
+			localAddrPort = netip.AddrPortFrom(netip.IPv4Unspecified(), localAddrPort.Port())
+		}
+		s.once4.Do(func() {
+			s.conn4 = s.listen("ip4:icmp", "0.0.0.0")
+		})
+		c = s.conn4
+		msg = icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable,
+			Code: 3,
+		}
+	default:
+		if !localAddrPort.Addr().Is6() {
+			localAddrPort = netip.AddrPortFrom(netip.IPv6Unspecified(), localAddrPort.Port())
+		}
+		s.once6.Do(func() {
+			s.conn6 = s.listen("ip6:ipv6-icmp", "::")
+		})
+		c = s.conn6
+		msg = icmp.Message{
+			Type: ipv6.ICMPTypeDestinationUnreachable,
+			Code: 4,
+		}
+	}
+
+	if c == nil {
+		return
+	}
+
+	msg.Body = &icmp.DstUnreach{
+		Data: appendUDPPacketHeaders(nil, clientAddrPort, localAddrPort, payloadLen),
+	}
+
+	// For ICMPv6, the kernel fills in the checksum.
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		s.logger.Warn("Failed to marshal ICMP port unreachable message", zap.Error(err))
+		return
+	}
+
+	if _, err = c.WriteTo(b, &net.IPAddr{IP: clientAddrPort.Addr().AsSlice()}); err != nil {
+		s.logger.Debug("Failed to send ICMP port unreachable message",
+			zap.Stringer("clientAddress", clientAddrPort),
+			zap.Error(err),
+		)
+	}
+}
+
+// listen opens a raw ICMP socket, or returns nil and logs the error if it cannot be opened.
+func (s *portUnreachableSender) listen(network, address string) *icmp.PacketConn {
+	c, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		s.logger.Warn("Failed to open raw ICMP socket, rejected UDP packets will be dropped silently",
+			zap.String("network", network),
+			zap.Error(err),
+		)
+		return nil
+	}
+	return c
+}
+
+// Close closes the raw ICMP sockets.
+func (s *portUnreachableSender) Close() {
+	// Make sure no sockets are opened after closing.
+	s.once4.Do(func() {})
+	s.once6.Do(func() {})
+
+	if s.conn4 != nil {
+		s.conn4.Close()
+	}
+	if s.conn6 != nil {
+		s.conn6.Close()
+	}
+}
+
+// appendUDPPacketHeaders appends the IP and UDP headers of a UDP packet from src to dst
+// with a payload of payloadLen bytes to b, as quoted in an ICMP error message.
+//
+// The UDP checksum is left as zero, which is allowed in ICMP quotes.
+func appendUDPPacketHeaders(b []byte, src, dst netip.AddrPort, payloadLen int) []byte {
+	udpLen := 8 + payloadLen
+
+	if src.Addr().Is4() {
+		var h [20]byte
+		h[0] = 0x45
+		binary.BigEndian.PutUint16(h[2:], uint16(20+udpLen))
+		h[8] = 64
+		h[9] = 17
+		srcAddr := src.Addr().As4()
+		dstAddr := dst.Addr().As4()
+		copy(h[12:], srcAddr[:])
+		copy(h[16:], dstAddr[:])
+		binary.BigEndian.PutUint16(h[10:], ipv4HeaderChecksum(h[:]))
+		b = append(b, h[:]...)
+	} else {
+		var h [40]byte
+		h[0] = 0x60
+		binary.BigEndian.PutUint16(h[4:], uint16(udpLen))
+		h[6] = 17
+		h[7] = 64
+		srcAddr := src.Addr().As16()
+		dstAddr := dst.Addr().As16()
+		copy(h[8:], srcAddr[:])
+		copy(h[24:], dstAddr[:])
+		b = append(b, h[:]...)
+	}
+
+	b = binary.BigEndian.AppendUint16(b, src.Port())
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+	return append(b, 0, 0)
+}
+
+// ipv4HeaderChecksum returns the checksum of the IPv4 header h, whose checksum field is zero.
+func ipv4HeaderChecksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
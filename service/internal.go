@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/proxyproto"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// maxInternalHops is the maximum number of internal clients a single connection can pass through.
+const maxInternalHops = 8
+
+var errInternalLoop = errors.New("too many internal hops, possible routing loop")
+
+type internalHopsContextKey struct{}
+
+// internalTCPClient hands connections over to the router as if they were accepted by another server
+// in the same process. This allows a server to act as the next hop of another server's routes
+// without going through a loopback socket.
+//
+// Only the target server's routes are applied. Its user ACL, rate limiter, stats collector
+// and connection table belong to its relay services, which the connection does not pass through,
+// so internal hops are neither counted nor restricted by the target server.
+// There is no UDP counterpart.
+//
+// internalTCPClient implements the zerocopy TCPClient interface.
+type internalTCPClient struct {
+	name        string
+	serverName  string
+	serverIndex int
+	router      *router.Router
+}
+
+// newInternalTCPClient returns a new internal TCP client that dispatches to the named server.
+// The client must be bound to a router with bind before use.
+func newInternalTCPClient(name, serverName string) *internalTCPClient {
+	return &internalTCPClient{
+		name:       name,
+		serverName: serverName,
+	}
+}
+
+// bind resolves the target server and binds the client to the router.
+func (c *internalTCPClient) bind(r *router.Router, serverIndexByName map[string]int) error {
+	serverIndex, ok := serverIndexByName[c.serverName]
+	if !ok {
+		return fmt.Errorf("internal server not found: %q", c.serverName)
+	}
+	c.serverIndex = serverIndex
+	c.router = r
+	return nil
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+func (c *internalTCPClient) Info() zerocopy.TCPClientInfo {
+	return zerocopy.TCPClientInfo{
+		Name:                 c.name,
+		NativeInitialPayload: true,
+	}
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *internalTCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	hops, _ := ctx.Value(internalHopsContextKey{}).(int)
+	if hops >= maxInternalHops {
+		return nil, nil, errInternalLoop
+	}
+	ctx = context.WithValue(ctx, internalHopsContextKey{}, hops+1)
+
+	header, _ := proxyproto.FromContext(ctx)
+
+	client, err := c.router.GetTCPClient(ctx, router.RequestInfo{
+		ServerIndex:    c.serverIndex,
+		Username:       conn.UsernameFromContext(ctx),
+		SourceAddrPort: header.SourceAddrPort,
+		TargetAddr:     targetAddr,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client.Dial(ctx, targetAddr, payload)
+}
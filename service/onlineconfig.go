@@ -0,0 +1,464 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/clientgroup"
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/sip002"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultOnlineConfigInterval is the default time between fetches of an online config document.
+	defaultOnlineConfigInterval = time.Hour
+
+	// onlineConfigFetchTimeout is the timeout for fetching an online config document.
+	onlineConfigFetchTimeout = 30 * time.Second
+)
+
+// errOnlineConfigNoServers is returned when dispatching to an online config client without usable servers,
+// e.g. before the document is first fetched.
+var errOnlineConfigNoServers = errors.New("no usable servers in online config")
+
+// onlineConfigMembers is a group of clients created from an online config document.
+type onlineConfigMembers struct {
+	// servers are the server entries in the document the group was created from.
+	servers []cred.SIP008Server
+
+	// names are the names of the members.
+	names []string
+
+	group clientGroup
+}
+
+// onlineConfigClient dispatches to a group of clients to the servers in a SIP008 online config document,
+// which is fetched periodically. The group is replaced when the document changes.
+//
+// onlineConfigClient implements [zerocopy.TCPClient], and [onlineConfigClient.UDPClient] returns it
+// as a [zerocopy.UDPClient]. It also has the String, Start and Stop methods of a service, which fetch the document.
+type onlineConfigClient struct {
+	cc         *ClientConfig
+	httpClient *http.Client
+	interval   time.Duration
+	logger     *zap.Logger
+
+	// tcpInfo and udpInfo are the information of a Shadowsocks 2022 client with one identity PSK.
+	// Members whose UDP clients need a larger packer headroom do not get UDP.
+	tcpInfo zerocopy.TCPClientInfo
+	udpInfo zerocopy.UDPClientInfo
+
+	current atomic.Pointer[onlineConfigMembers]
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// initOnlineConfig checks the online config options, and creates the online config client.
+func (cc *ClientConfig) initOnlineConfig() error {
+	u, err := url.Parse(cc.OnlineConfigURL)
+	if err != nil {
+		return fmt.Errorf("bad online config URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("online config URL %q is not HTTPS", cc.OnlineConfigURL)
+	}
+
+	switch {
+	case cc.OnlineConfigInterval == 0:
+		cc.OnlineConfigInterval = jsonhelper.Duration(defaultOnlineConfigInterval)
+	case cc.OnlineConfigInterval < 0:
+		return fmt.Errorf("negative online config interval: %s", cc.OnlineConfigInterval.Value())
+	}
+
+	switch cc.OnlineConfigGroup {
+	case "":
+		cc.OnlineConfigGroup = "failover"
+	case "failover", "loadbalance":
+	case "urltest":
+		if !cc.EnableTCP {
+			return errors.New("urltest online config group requires TCP to be enabled")
+		}
+	default:
+		return fmt.Errorf("unknown online config group: %q", cc.OnlineConfigGroup)
+	}
+
+	if len(cc.Members) != 0 || len(cc.Weights) != 0 {
+		return errors.New("members and weights are not supported by sip008 client")
+	}
+	if cc.Plugin != "" || len(cc.FallbackEndpoints) != 0 {
+		return errors.New("plugins and fallback endpoints are not supported by sip008 client")
+	}
+
+	// Check the group options with a placeholder member.
+	gcc := cc.onlineConfigGroupConfig([]string{cc.Name})
+	if err = gcc.Initialize(cc.listenConfigCache, cc.dialerCache, cc.logger); err != nil {
+		return fmt.Errorf("bad online config group options: %w", err)
+	}
+
+	c := onlineConfigClient{
+		cc:       cc,
+		interval: cc.OnlineConfigInterval.Value(),
+		logger:   cc.logger,
+	}
+
+	// Find out the information of members with a template.
+	template, err := c.memberConfig(cred.SIP008Server{
+		Server:     netip.IPv6Loopback().String(),
+		ServerPort: 1,
+		Password:   "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		Method:     "2022-blake3-aes-256-gcm",
+	}, cc.Name)
+	if err != nil {
+		return fmt.Errorf("failed to create member template: %w", err)
+	}
+	c.tcpInfo = zerocopy.TCPClientInfo{Name: cc.Name}
+	if cc.EnableTCP {
+		tcpClient, err := template.TCPClient()
+		if err != nil {
+			return fmt.Errorf("failed to create member template TCP client: %w", err)
+		}
+		c.tcpInfo.NativeInitialPayload = tcpClient.Info().NativeInitialPayload
+	}
+	if cc.EnableUDP {
+		udpClient, err := template.UDPClient()
+		if err != nil {
+			return fmt.Errorf("failed to create member template UDP client: %w", err)
+		}
+		c.udpInfo = udpClient.Info()
+		c.udpInfo.Name = cc.Name
+	}
+
+	dialer := cc.dialer()
+	c.httpClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				tc, err := dialer.DialTCP(ctx, network, address, nil)
+				if err != nil {
+					return nil, err
+				}
+				return tc, nil
+			},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: onlineConfigFetchTimeout,
+	}
+
+	cc.onlineConfig = &c
+	return nil
+}
+
+// onlineConfigGroupConfig returns the configuration of the group of the given members.
+func (cc *ClientConfig) onlineConfigGroupConfig(members []string) ClientConfig {
+	return ClientConfig{
+		Name:                   cc.Name,
+		Protocol:               cc.OnlineConfigGroup,
+		Members:                members,
+		LoadBalanceStrategy:    cc.LoadBalanceStrategy,
+		HealthCheckURL:         cc.HealthCheckURL,
+		HealthCheckInterval:    cc.HealthCheckInterval,
+		HealthCheckTimeout:     cc.HealthCheckTimeout,
+		FailureThreshold:       cc.FailureThreshold,
+		URLTestURL:             cc.URLTestURL,
+		URLTestInterval:        cc.URLTestInterval,
+		URLTestTimeout:         cc.URLTestTimeout,
+		URLTestTolerance:       cc.URLTestTolerance,
+		URLTestUDPProbeAddress: cc.URLTestUDPProbeAddress,
+		URLTestUDPProbeCount:   cc.URLTestUDPProbeCount,
+	}
+}
+
+// memberConfig returns the initialized configuration of the client to the server entry.
+// Other than the server and credentials, members have the same options as the online config client.
+func (c *onlineConfigClient) memberConfig(server cred.SIP008Server, name string) (ClientConfig, error) {
+	switch server.Method {
+	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+	default:
+		return ClientConfig{}, fmt.Errorf("unsupported method: %q", server.Method)
+	}
+	if server.Plugin != "" {
+		return ClientConfig{}, fmt.Errorf("unsupported plugin: %q", server.Plugin)
+	}
+
+	endpoint, err := conn.AddrFromHostPort(server.Server, server.ServerPort)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+
+	psks, err := sip002.URL{Method: server.Method, Password: server.Password}.PSKs()
+	if err != nil {
+		return ClientConfig{}, err
+	}
+
+	mcc := *c.cc
+	mcc.Name = name
+	mcc.Protocol = server.Method
+	mcc.OnlineConfigURL = ""
+	mcc.onlineConfig = nil
+	mcc.Endpoint = endpoint
+	mcc.TCPAddress = conn.Addr{}
+	mcc.UDPAddress = conn.Addr{}
+	mcc.FallbackEndpoints = nil
+	mcc.PSK = psks[len(psks)-1]
+	mcc.IPSKs = psks[:len(psks)-1]
+	mcc.NextIPSKs = nil
+	mcc.NextIPSKsAt = time.Time{}
+
+	if err = mcc.Initialize(c.cc.listenConfigCache, c.cc.dialerCache, c.logger); err != nil {
+		return ClientConfig{}, err
+	}
+	return mcc, nil
+}
+
+// newMembers creates a group of clients to the server entries.
+// Entries that cannot be used are skipped with a warning.
+func (c *onlineConfigClient) newMembers(servers []cred.SIP008Server) (*onlineConfigMembers, error) {
+	m := onlineConfigMembers{
+		servers: servers,
+		names:   make([]string, 0, len(servers)),
+	}
+	tcpClientMap := make(map[string]zerocopy.TCPClient, len(servers))
+	udpClientMap := make(map[string]zerocopy.UDPClient, len(servers))
+
+	for i, server := range servers {
+		remarks := server.Remarks
+		if remarks == "" {
+			remarks = server.ID
+		}
+		name := c.cc.Name + "/" + remarks
+		if remarks == "" || slices.Contains(m.names, name) {
+			name = fmt.Sprintf("%s/%d", c.cc.Name, i)
+		}
+
+		mcc, err := c.memberConfig(server, name)
+		if err != nil {
+			c.logger.Warn("Skipping online config server",
+				zap.String("client", c.cc.Name),
+				zap.String("member", name),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		tcpClient, err := mcc.TCPClient()
+		switch err {
+		case errNetworkDisabled:
+		case nil:
+			tcpClientMap[name] = tcpClient
+		default:
+			return nil, fmt.Errorf("failed to create TCP client for %s: %w", name, err)
+		}
+
+		udpClient, err := mcc.UDPClient()
+		switch err {
+		case errNetworkDisabled:
+		case nil:
+			if headroom := udpClient.Info().PackerHeadroom; zerocopy.MaxHeadroom(c.udpInfo.PackerHeadroom, headroom) != c.udpInfo.PackerHeadroom {
+				c.logger.Warn("Disabling UDP for online config server with too many identity PSKs",
+					zap.String("client", c.cc.Name),
+					zap.String("member", name),
+					zap.Int("iPSKs", len(mcc.IPSKs)),
+				)
+				break
+			}
+			udpClientMap[name] = udpClient
+		default:
+			return nil, fmt.Errorf("failed to create UDP client for %s: %w", name, err)
+		}
+
+		m.names = append(m.names, name)
+	}
+
+	if len(m.names) == 0 {
+		return nil, errOnlineConfigNoServers
+	}
+
+	gcc := c.cc.onlineConfigGroupConfig(m.names)
+	if err := gcc.Initialize(c.cc.listenConfigCache, c.cc.dialerCache, c.logger); err != nil {
+		return nil, err
+	}
+	g, err := gcc.clientGroup(tcpClientMap, udpClientMap)
+	if err != nil {
+		return nil, err
+	}
+	m.group = g
+	return &m, nil
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+func (c *onlineConfigClient) Info() zerocopy.TCPClientInfo {
+	return c.tcpInfo
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *onlineConfigClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	m := c.current.Load()
+	if m == nil || m.group.tcpClient == nil {
+		return nil, nil, errOnlineConfigNoServers
+	}
+	return m.group.tcpClient.Dial(ctx, targetAddr, payload)
+}
+
+// UDPClient returns the client as a [zerocopy.UDPClient].
+func (c *onlineConfigClient) UDPClient() zerocopy.UDPClient {
+	return (*onlineConfigUDPClient)(c)
+}
+
+// onlineConfigUDPClient is an [onlineConfigClient] as a [zerocopy.UDPClient].
+type onlineConfigUDPClient onlineConfigClient
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *onlineConfigUDPClient) Info() zerocopy.UDPClientInfo {
+	return c.udpInfo
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *onlineConfigUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	m := c.current.Load()
+	if m == nil || m.group.udpClient == nil {
+		return zerocopy.UDPClientInfo{}, zerocopy.UDPClientSession{}, errOnlineConfigNoServers
+	}
+	return m.group.udpClient.NewSession(ctx)
+}
+
+// Status implements [clientgroup.StatusReporter].
+func (c *onlineConfigClient) Status() clientgroup.Status {
+	m := c.current.Load()
+	if m == nil {
+		return clientgroup.Status{
+			Name:    c.cc.Name,
+			Type:    "sip008",
+			Members: []clientgroup.MemberStatus{},
+		}
+	}
+	if m.group.status != nil {
+		return m.group.status.Status()
+	}
+
+	// Load balance groups do not check health.
+	s := clientgroup.Status{
+		Name:    c.cc.Name,
+		Type:    c.cc.OnlineConfigGroup,
+		Members: make([]clientgroup.MemberStatus, len(m.names)),
+	}
+	for i, name := range m.names {
+		s.Members[i] = clientgroup.MemberStatus{
+			Name: name,
+			Up:   true,
+		}
+	}
+	return s
+}
+
+// String implements [Relay.String].
+func (c *onlineConfigClient) String() string {
+	return "online config for client " + c.cc.Name
+}
+
+// Start fetches the online config document, and keeps fetching it periodically in a new goroutine.
+// Failing to fetch the document does not fail the start, as the document is fetched again later.
+func (c *onlineConfigClient) Start(ctx context.Context) error {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.update(ctx)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.update(ctx)
+			}
+		}
+	}()
+
+	c.logger.Info("Started online config",
+		zap.String("client", c.cc.Name),
+		zap.String("url", c.cc.OnlineConfigURL),
+		zap.Duration("interval", c.interval),
+	)
+	return nil
+}
+
+// Stop stops fetching the online config document, and stops the current group.
+func (c *onlineConfigClient) Stop() error {
+	c.cancel()
+	c.wg.Wait()
+	if m := c.current.Swap(nil); m != nil && m.group.service != nil {
+		return m.group.service.Stop()
+	}
+	return nil
+}
+
+// update fetches the online config document, and replaces the group if the document changed.
+func (c *onlineConfigClient) update(ctx context.Context) {
+	cfg, err := cred.FetchSIP008(ctx, c.httpClient, c.cc.OnlineConfigURL)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.logger.Warn("Failed to fetch online config",
+				zap.String("client", c.cc.Name),
+				zap.String("url", c.cc.OnlineConfigURL),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+
+	if old := c.current.Load(); old != nil && slices.Equal(old.servers, cfg.Servers) {
+		c.logger.Debug("Online config unchanged", zap.String("client", c.cc.Name))
+		return
+	}
+
+	m, err := c.newMembers(cfg.Servers)
+	if err != nil {
+		c.logger.Warn("Failed to create clients from online config",
+			zap.String("client", c.cc.Name),
+			zap.Error(err),
+		)
+		return
+	}
+
+	if m.group.service != nil {
+		if err = m.group.service.Start(ctx); err != nil {
+			c.logger.Warn("Failed to start online config group",
+				zap.String("client", c.cc.Name),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+
+	if old := c.current.Swap(m); old != nil && old.group.service != nil {
+		if err = old.group.service.Stop(); err != nil {
+			c.logger.Warn("Failed to stop old online config group",
+				zap.String("client", c.cc.Name),
+				zap.Error(err),
+			)
+		}
+	}
+
+	c.logger.Info("Updated clients from online config",
+		zap.String("client", c.cc.Name),
+		zap.Int("servers", len(cfg.Servers)),
+		zap.Strings("members", m.names),
+	)
+}
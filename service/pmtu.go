@@ -0,0 +1,83 @@
+package service
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// natConnPathMTU tracks the path MTU of a UDP session's natConn, shared by its uplink and downlink.
+//
+// natConn sockets are set to IP_PMTUDISC_DO and, on Linux, IP_RECVERR. ICMP fragmentation needed
+// and packet too big messages, as well as errors for packets exceeding the known path MTU,
+// are queued on the socket with the path MTU. The uplink reads the queue when a write fails with EMSGSIZE,
+// and the downlink reads it when a read fails, which is how queued ICMP errors surface.
+// Reading the queue also keeps it from growing with other ICMP errors, like port unreachable.
+//
+// The path MTU is only lowered. Uplink packets exceeding it are dropped and counted as oversized,
+// instead of failing to send one by one.
+type natConnPathMTU struct {
+	rawConn syscall.RawConn
+	mtu     atomic.Int32
+	tracked *conntrack.Entry
+	logger  *zap.Logger
+}
+
+// newNatConnPathMTU returns a new path MTU tracker for natConn.
+// Discovered path MTUs are logged with logger, and set on tracked.
+func newNatConnPathMTU(natConn *net.UDPConn, tracked *conntrack.Entry, logger *zap.Logger) *natConnPathMTU {
+	rawConn, err := natConn.SyscallConn()
+	if err != nil {
+		logger.Warn("Failed to get raw conn of natConn for path MTU discovery", zap.Error(err))
+	}
+	return &natConnPathMTU{
+		rawConn: rawConn,
+		tracked: tracked,
+		logger:  logger,
+	}
+}
+
+// maxPacketSize returns the maximum size of packets to addr within the discovered path MTU,
+// or 0 if no path MTU has been discovered.
+func (p *natConnPathMTU) maxPacketSize(addr netip.Addr) int {
+	mtu := p.mtu.Load()
+	if mtu == 0 {
+		return 0
+	}
+	return zerocopy.MaxPacketSizeForAddr(int(mtu), addr)
+}
+
+// readErrors reads the errors queued on natConn, and lowers the path MTU if a smaller one is reported.
+// It returns whether any errors were read.
+func (p *natConnPathMTU) readErrors() bool {
+	if p.rawConn == nil {
+		return false
+	}
+
+	mtu, n, err := conn.ReadPathMTU(p.rawConn)
+	if err != nil {
+		p.logger.Warn("Failed to read errors queued on natConn", zap.Error(err))
+	}
+
+	if mtu > 0 {
+		for {
+			old := p.mtu.Load()
+			if old != 0 && int(old) <= mtu {
+				break
+			}
+			if p.mtu.CompareAndSwap(old, int32(mtu)) {
+				p.tracked.SetPathMTU(mtu)
+				p.logger.Info("Discovered path MTU of UDP session", zap.Int("pathMTU", mtu))
+				break
+			}
+		}
+	}
+
+	return n > 0
+}
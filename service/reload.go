@@ -0,0 +1,336 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/database64128/shadowsocks-go/api"
+	"github.com/database64128/shadowsocks-go/api/configs"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/logging"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// errRestartRequired is returned when a reload changes parts of the configuration
+// that can only be changed by restarting the process.
+var errRestartRequired = errors.New("changes to stats, events, api, log or gomaxprocs require a restart")
+
+// sectionKey identifies a configuration section.
+type sectionKey struct {
+	kind string
+	name string
+}
+
+// sectionHashes returns the hashes of the sections by kind and name.
+func sectionHashes(sections []configs.Section) map[sectionKey]string {
+	hashes := make(map[sectionKey]string, len(sections))
+	for _, s := range sections {
+		hashes[sectionKey{s.Kind, s.Name}] = s.Hash
+	}
+	return hashes
+}
+
+// restartSection returns the parts of the configuration that cannot be reloaded as a section in normalized JSON.
+func (sc *Config) restartSection() (configs.Section, error) {
+	return configs.NewSection("restart", "", struct {
+		Stats      stats.Config   `json:"stats"`
+		Events     event.Config   `json:"events"`
+		API        api.Config     `json:"api"`
+		Log        logging.Config `json:"log"`
+		GOMAXPROCS int            `json:"gomaxprocs"`
+	}{sc.Stats, sc.Events, sc.API, sc.Log, sc.GOMAXPROCS})
+}
+
+// updateRouterSection updates the router section served by the configuration API
+// with the current routes, which include changes made at runtime.
+// It must be called with m.mu held.
+func (m *Manager) updateRouterSection() {
+	if m.apiServer == nil {
+		return
+	}
+	cm := m.apiServer.Configs()
+	if cm == nil {
+		return
+	}
+	rc := m.routerConfig
+	rc.Routes = m.router.Routes()
+	s, err := configs.NewSection("router", "", &rc)
+	if err != nil {
+		m.logger.Warn("Failed to update router config section", zap.Error(err))
+		return
+	}
+	cm.SetSection(s)
+}
+
+// SetReloadFunc sets the function that reloads the configuration for the configuration API.
+// It must be called before the services are started.
+func (m *Manager) SetReloadFunc(reload func() error) {
+	if m.apiServer == nil {
+		return
+	}
+	if cm := m.apiServer.Configs(); cm != nil {
+		cm.SetReloadFunc(reload)
+	}
+}
+
+// Reload applies the configuration to the running services.
+//
+// Servers are compared by name with the running ones. Only added, removed and changed servers
+// are started and stopped, so connections and sessions on unchanged servers are kept alive.
+// When clients, DNS resolvers, hosts, the router or the set of server names change,
+// they are all recreated, and unchanged servers route new requests with the new ones.
+//
+// Changes to stats, events, API, log sinks and GOMAXPROCS require a restart, and are rejected.
+// If the configuration is invalid, the running services are left unchanged.
+func (m *Manager) Reload(sc *Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx == nil {
+		return errors.New("services are not started")
+	}
+
+	if len(sc.Servers) == 0 {
+		return errors.New("no services to start")
+	}
+
+	if sc.DrainTimeout < 0 {
+		return fmt.Errorf("negative drain timeout: %s", sc.DrainTimeout.Value())
+	}
+
+	sc.setDefaultClients()
+
+	// Capture the configuration before initialization fills in defaults.
+	sections, err := sc.configSections()
+	if err != nil {
+		return fmt.Errorf("failed to normalize configuration: %w", err)
+	}
+	routerConfig := sc.Router
+	restartSection, err := sc.restartSection()
+	if err != nil {
+		return fmt.Errorf("failed to normalize configuration: %w", err)
+	}
+	if restartSection.Hash != m.restartHash {
+		return errRestartRequired
+	}
+	hashes := sectionHashes(sections)
+
+	// Servers that keep their names keep their indices, which identify them in routes and internal clients.
+	oldServerByName := make(map[string]*serverServices, len(m.servers))
+	for _, s := range m.servers {
+		oldServerByName[s.config.Name] = s
+	}
+
+	serverIndexByName := make(map[string]int, len(sc.Servers))
+	nextServerIndex := m.nextServerIndex
+
+	for i := range sc.Servers {
+		name := sc.Servers[i].Name
+		if _, ok := serverIndexByName[name]; ok {
+			return fmt.Errorf("duplicate server name: %s", name)
+		}
+		if old := oldServerByName[name]; old != nil {
+			serverIndexByName[name] = old.index
+		} else {
+			serverIndexByName[name] = nextServerIndex
+			nextServerIndex++
+		}
+	}
+
+	var cs *clientSide
+	if m.clientSideChanged(hashes, serverIndexByName) {
+		cs, err = sc.clientSide(m.listenConfigCache, m.dialerCache, m.logger, serverIndexByName)
+		if err != nil {
+			return err
+		}
+		// Internal clients are bound to the running router, which takes over the new routes below.
+		if err = cs.bindInternalClients(m.router, serverIndexByName); err != nil {
+			_ = cs.router.Close()
+			return err
+		}
+	}
+
+	// UDP relays reserve headroom for client packers when they are created,
+	// so they must be recreated to use clients that need more.
+	oldMaxClientPackerHeadroom := m.maxClientPackerHeadroom
+	if cs != nil {
+		m.maxClientPackerHeadroom = zerocopy.MaxHeadroom(oldMaxClientPackerHeadroom, cs.maxClientPackerHeadroom)
+	}
+	headroomGrew := m.maxClientPackerHeadroom != oldMaxClientPackerHeadroom
+
+	servers := make([]*serverServices, len(sc.Servers))
+	var newServers []*serverServices
+
+	for i := range sc.Servers {
+		serverConfig := &sc.Servers[i]
+		hash := hashes[sectionKey{"server", serverConfig.Name}]
+		if old := oldServerByName[serverConfig.Name]; old != nil && old.hash == hash && !(headroomGrew && old.config.udpEnabled) {
+			servers[i] = old
+			continue
+		}
+
+		s, err := m.initServer(serverConfig, serverIndexByName[serverConfig.Name], hash)
+		if err != nil {
+			m.maxClientPackerHeadroom = oldMaxClientPackerHeadroom
+			if cs != nil {
+				_ = cs.router.Close()
+			}
+			return err
+		}
+		servers[i] = s
+		newServers = append(newServers, s)
+	}
+
+	// The new configuration is valid. Apply it.
+
+	var removed, replaced int
+	kept := make(map[*serverServices]struct{}, len(servers))
+	for _, s := range servers {
+		kept[s] = struct{}{}
+	}
+	for _, s := range m.servers {
+		if _, ok := kept[s]; ok {
+			continue
+		}
+		m.stopServer(s)
+		if _, ok := serverIndexByName[s.config.Name]; ok {
+			replaced++
+		} else {
+			removed++
+		}
+	}
+
+	var errs []error
+
+	if cs != nil {
+		m.router.Replace(cs.router)
+
+		for _, s := range m.clientServices {
+			m.stopService(s)
+		}
+		m.clientServices = m.clientServices[:0]
+
+		for _, s := range cs.services {
+			if err := s.Start(m.ctx); err != nil {
+				errs = append(errs, fmt.Errorf("failed to start %s: %w", s.String(), err))
+				continue
+			}
+			m.clientServices = append(m.clientServices, s)
+		}
+
+		if m.apiServer != nil {
+			m.apiServer.Groups().SetGroups(cs.groupStatusReporters)
+		}
+	}
+
+	m.servers = m.servers[:0]
+
+	for _, s := range servers {
+		if oldServerByName[s.config.Name] == s {
+			m.servers = append(m.servers, s)
+			continue
+		}
+		if err := m.postInitServer(s); err != nil {
+			m.credman.UnregisterServer(s.config.Name)
+			if m.apiSM != nil {
+				m.apiSM.RemoveServer(s.config.Name)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if err := m.startServer(s); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.servers = append(m.servers, s)
+	}
+
+	m.nextServerIndex = nextServerIndex
+	m.drainTimeout = sc.DrainTimeout.Value()
+	m.sectionHashes = hashes
+	m.routerConfig = routerConfig
+
+	if m.apiServer != nil {
+		if cm := m.apiServer.Configs(); cm != nil {
+			cm.SetSections(sections)
+		}
+	}
+	m.updateRouterSection()
+
+	m.logger.Info("Reloaded configuration",
+		zap.Bool("clientsRecreated", cs != nil),
+		zap.Int("serversStarted", len(newServers)-replaced),
+		zap.Int("serversRestarted", replaced),
+		zap.Int("serversStopped", removed),
+		zap.Int("serversUnchanged", len(servers)-len(newServers)),
+	)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to apply configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// clientSideChanged returns whether the clients, DNS resolvers, hosts or router sections changed,
+// or the set of server names changed.
+func (m *Manager) clientSideChanged(hashes map[sectionKey]string, serverIndexByName map[string]int) bool {
+	if len(serverIndexByName) != len(m.servers) {
+		return true
+	}
+	for _, s := range m.servers {
+		if _, ok := serverIndexByName[s.config.Name]; !ok {
+			return true
+		}
+	}
+
+	var n int
+	for key, hash := range hashes {
+		if key.kind == "server" {
+			continue
+		}
+		if m.sectionHashes[key] != hash {
+			return true
+		}
+		n++
+	}
+	for key := range m.sectionHashes {
+		if key.kind != "server" {
+			n--
+		}
+	}
+	return n != 0
+}
+
+// startServer starts the relay services of a new server.
+// If any service fails to start, the started ones are stopped.
+func (m *Manager) startServer(s *serverServices) error {
+	if cms := s.config.cms; cms != nil {
+		if err := cms.Start(m.ctx); err != nil {
+			s.services = nil
+			m.stopServer(s)
+			return fmt.Errorf("failed to start managed server %s: %w", s.config.Name, err)
+		}
+	}
+
+	for i, service := range s.services {
+		if err := service.Start(m.ctx); err != nil {
+			s.services = s.services[:i]
+			m.stopServer(s)
+			return fmt.Errorf("failed to start %s: %w", service.String(), err)
+		}
+	}
+	return nil
+}
+
+// stopServer stops the relay services of a server, and unregisters it from the credential manager and the API.
+func (m *Manager) stopServer(s *serverServices) {
+	for _, service := range s.services {
+		m.stopService(service)
+	}
+	m.credman.UnregisterServer(s.config.Name)
+	if m.apiSM != nil {
+		m.apiSM.RemoveServer(s.config.Name)
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/redis"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap"
+)
+
+const (
+	// redisSaltKeyPrefix is the prefix of request salt keys in Redis.
+	redisSaltKeyPrefix = "shadowsocks-go:salt:"
+
+	// redisSaltFilterTimeout is the timeout for checking a request salt in Redis.
+	redisSaltFilterTimeout = 2 * time.Second
+)
+
+// redisSaltFilter is a filter of Shadowsocks 2022 request salts shared with other instances of a server via Redis.
+//
+// redisSaltFilter implements [ss2022.SaltFilter] and the Relay interface.
+type redisSaltFilter struct {
+	serverName string
+	client     *redis.Client
+	logger     *zap.Logger
+}
+
+// redisSaltFilter returns a new shared salt filter for the server, and sets it on the server's TCP server.
+// It returns nil if the shared replay filter is not enabled.
+func (sc *ServerConfig) redisSaltFilter() *redisSaltFilter {
+	if sc.replayFilterRedis == nil || sc.ss2022TCPServer == nil {
+		return nil
+	}
+
+	f := &redisSaltFilter{
+		serverName: sc.Name,
+		client:     sc.replayFilterRedis,
+		logger:     sc.logger,
+	}
+	sc.ss2022TCPServer.SetSharedSaltFilter(f)
+	return f
+}
+
+// CheckAndAdd implements [ss2022.SaltFilter].
+//
+// Salts are stored for twice the replay window, because a request's timestamp may be up to
+// [ss2022.MaxTimeDiff] from the time it is first seen, in either direction.
+// When Redis is unreachable, the salt is accepted, and left to the server's own salt pool.
+func (f *redisSaltFilter) CheckAndAdd(salt []byte) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisSaltFilterTimeout)
+	defer cancel()
+
+	ok, err := f.client.SetNX(ctx, redisSaltKeyPrefix+hex.EncodeToString(salt), "1", 2*ss2022.ReplayWindowDuration)
+	if err != nil {
+		f.logger.Warn("Failed to check request salt in Redis",
+			zap.String("server", f.serverName),
+			zap.Stringer("redis", f.client),
+			zap.Error(err),
+		)
+		return true
+	}
+	return ok
+}
+
+// String implements the Relay String method.
+func (f *redisSaltFilter) String() string {
+	return "shared replay filter for " + f.serverName
+}
+
+// Start implements the Relay Start method.
+// Failing to reach Redis is logged but does not fail the start, as the server works without it.
+func (f *redisSaltFilter) Start(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, redisSaltFilterTimeout)
+	defer cancel()
+
+	if err := f.client.Ping(ctx); err != nil {
+		f.logger.Warn("Failed to connect to Redis for shared replay filter",
+			zap.String("server", f.serverName),
+			zap.Stringer("redis", f.client),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	f.logger.Info("Started shared replay filter",
+		zap.String("server", f.serverName),
+		zap.Stringer("redis", f.client),
+	)
+	return nil
+}
+
+// Stop implements the Relay Stop method.
+func (f *redisSaltFilter) Stop() error {
+	return f.client.Close()
+}
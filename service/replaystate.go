@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"go.uber.org/zap"
+)
+
+// replayStateSaveInterval is the interval between saves of a server's replay protection state.
+// It is well within [ss2022.ReplayWindowDuration], so that a crash loses little of the state.
+const replayStateSaveInterval = 10 * time.Second
+
+// replayStateSaver periodically saves the replay protection state of a Shadowsocks 2022 server to a file,
+// so that requests and packets captured before a restart or crash cannot be replayed after it.
+//
+// replayStateSaver implements the Relay interface.
+type replayStateSaver struct {
+	serverName string
+	path       string
+	tcpServer  *ss2022.TCPServer
+	udpServer  *ss2022.UDPServer
+	logger     *zap.Logger
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// replayStateSaver returns a new replay state saver for the server.
+// It returns nil if saving replay state is not enabled.
+//
+// State saved by a previous saver of the server is restored into the server's TCP and UDP servers.
+func (sc *ServerConfig) replayStateSaver() (*replayStateSaver, error) {
+	if sc.ReplayStatePath == "" || sc.ss2022TCPServer == nil && sc.ss2022UDPServer == nil {
+		return nil, nil
+	}
+
+	if sc.ss2022UDPServer != nil {
+		sc.ss2022UDPServer.EnableReplayStateTracking()
+	}
+
+	rs := &replayStateSaver{
+		serverName: sc.Name,
+		path:       sc.ReplayStatePath,
+		tcpServer:  sc.ss2022TCPServer,
+		udpServer:  sc.ss2022UDPServer,
+		logger:     sc.logger,
+	}
+
+	if err := rs.restore(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// restore loads the saved state into the servers.
+// A missing state file is not an error.
+func (rs *replayStateSaver) restore() error {
+	var state ss2022.ReplayState
+	if err := jsonhelper.OpenAndDecodeDisallowUnknownFields(rs.path, &state); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to load replay state: %w", err)
+	}
+
+	var tcpSalts, udpSessions int
+	if rs.tcpServer != nil {
+		tcpSalts = rs.tcpServer.RestoreReplayState(&state)
+	}
+	if rs.udpServer != nil {
+		udpSessions = rs.udpServer.RestoreReplayState(&state)
+	}
+
+	rs.logger.Info("Restored replay state",
+		zap.String("server", rs.serverName),
+		zap.String("path", rs.path),
+		zap.Int("tcpSalts", tcpSalts),
+		zap.Int("udpSessions", udpSessions),
+	)
+	return nil
+}
+
+// save writes the servers' current state to the state file.
+// The file is replaced atomically, so a crash during the save leaves the previous state file intact.
+func (rs *replayStateSaver) save() error {
+	var state ss2022.ReplayState
+	if rs.tcpServer != nil {
+		rs.tcpServer.SaveReplayState(&state)
+	}
+	if rs.udpServer != nil {
+		rs.udpServer.SaveReplayState(&state)
+	}
+
+	b, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(rs.path), filepath.Base(rs.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, rs.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// String implements the Relay String method.
+func (rs *replayStateSaver) String() string {
+	return "replay state saver for " + rs.serverName
+}
+
+// Start implements the Relay Start method.
+func (rs *replayStateSaver) Start(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(rs.path), 0755); err != nil {
+		return err
+	}
+
+	ctx, rs.cancel = context.WithCancel(ctx)
+	rs.wg.Add(1)
+	go func() {
+		rs.run(ctx)
+		rs.wg.Done()
+	}()
+	return nil
+}
+
+func (rs *replayStateSaver) run(ctx context.Context) {
+	ticker := time.NewTicker(replayStateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := rs.save(); err != nil {
+				rs.logger.Warn("Failed to save replay state",
+					zap.String("server", rs.serverName),
+					zap.String("path", rs.path),
+					zap.Error(err),
+				)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop implements the Relay Stop method.
+// It saves the final state after the periodic saves stop.
+// Relay services are stopped before other services, so the final state includes their last requests and packets.
+func (rs *replayStateSaver) Stop() error {
+	rs.cancel()
+	rs.wg.Wait()
+	return rs.save()
+}
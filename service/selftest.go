@@ -0,0 +1,457 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// selfTestClientName is the name of the echo client that receives all traffic during self-test.
+	selfTestClientName = "selftest-echo"
+
+	// selfTestUsername is the name of the user added to multi-user servers during self-test.
+	selfTestUsername = "selftest"
+
+	// selfTestTimeout is the timeout for each self-test check.
+	selfTestTimeout = 5 * time.Second
+
+	// selfTestPayloadSize is the size of the payload transferred in each self-test check.
+	selfTestPayloadSize = 1024
+
+	// selfTestUDPResendInterval is the interval between retransmissions of the self-test UDP packet.
+	selfTestUDPResendInterval = 500 * time.Millisecond
+)
+
+// selfTestTarget is the target address requested by self-test clients.
+// The echo client does not connect to it.
+var selfTestTarget = conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), 7))
+
+// SelfTestResult is the self-test result of a server.
+type SelfTestResult struct {
+	// Server is the name of the server.
+	Server string
+
+	// TCP is the result of the TCP check.
+	TCP SelfTestCheck
+
+	// UDP is the result of the UDP check.
+	UDP SelfTestCheck
+}
+
+// Failed returns whether any check of the server failed.
+func (r SelfTestResult) Failed() bool {
+	return r.TCP.Err != nil || r.UDP.Err != nil
+}
+
+// SelfTestCheck is the result of checking one network of a server.
+type SelfTestCheck struct {
+	// SkipReason is why the check was skipped, or empty if it was run.
+	SkipReason string
+
+	// Err is why the check failed, or nil if it passed or was skipped.
+	Err error
+
+	// RTT is the round-trip time of the transfer, if the check passed.
+	RTT time.Duration
+}
+
+func skippedCheck(reason string) SelfTestCheck {
+	return SelfTestCheck{SkipReason: reason}
+}
+
+// SelfTest starts the configured servers, and checks the datapath of each server
+// by doing a handshake and a small transfer over TCP and UDP with a loopback client.
+//
+// Servers are started with their configured listeners, credentials, MTU, and options,
+// so that bad PSKs, MTU misconfigurations, and unavailable ports are caught.
+// All traffic is routed to an echo client instead of the configured clients,
+// and the API, events, and traffic statistics are disabled.
+//
+// Multi-user Shadowsocks 2022 servers are tested with a generated user,
+// in a temporary copy of the uPSK store. The configured uPSK store is not used.
+//
+// The returned error is non-nil if the servers cannot be started.
+func (sc *Config) SelfTest(ctx context.Context, logger *zap.Logger) ([]SelfTestResult, error) {
+	tempDir, err := os.MkdirTemp("", "shadowsocks-go-selftest-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	echoMTU := 1500
+	for i := range sc.Servers {
+		echoMTU = max(echoMTU, sc.Servers[i].MTU)
+	}
+
+	tc := Config{
+		Servers: slices.Clone(sc.Servers),
+		Clients: []ClientConfig{
+			{
+				Name:      selfTestClientName,
+				Protocol:  "echo",
+				EnableTCP: true,
+				EnableUDP: true,
+				MTU:       echoMTU,
+			},
+		},
+		Router: router.Config{
+			DefaultTCPClientName: selfTestClientName,
+			DefaultUDPClientName: selfTestClientName,
+		},
+	}
+
+	uPSKs := make([][]byte, len(tc.Servers))
+
+	for i := range tc.Servers {
+		serverConfig := &tc.Servers[i]
+		if serverConfig.UPSKStorePath == "" {
+			continue
+		}
+
+		uPSK := make([]byte, len(serverConfig.PSK))
+		rand.Read(uPSK)
+		uPSKs[i] = uPSK
+
+		data, err := json.Marshal(map[string][]byte{selfTestUsername: uPSK})
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(tempDir, fmt.Sprintf("upsks-%d.json", i))
+		if err = os.WriteFile(path, data, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write temporary uPSK store for %s: %w", serverConfig.Name, err)
+		}
+		serverConfig.UPSKStorePath = path
+		serverConfig.WatchUPSKStore = false
+	}
+
+	m, err := tc.Manager(logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service manager: %w", err)
+	}
+	defer m.Close()
+
+	// Services stop their background goroutines when the context passed to Start is canceled.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Like the main program, do not stop services after a failed start,
+	// as services that have not been started cannot be stopped.
+	if err = m.Start(runCtx); err != nil {
+		return nil, fmt.Errorf("failed to start services: %w", err)
+	}
+	defer func() {
+		cancel()
+		m.Stop()
+	}()
+
+	listenConfigCache := conn.NewListenConfigCache()
+	dialerCache := conn.NewDialerCache()
+	results := make([]SelfTestResult, len(tc.Servers))
+
+	for i := range tc.Servers {
+		serverConfig := &tc.Servers[i]
+		results[i] = SelfTestResult{
+			Server: serverConfig.Name,
+			TCP:    serverConfig.selfTestTCP(ctx, listenConfigCache, dialerCache, uPSKs[i], logger),
+			UDP:    serverConfig.selfTestUDP(ctx, listenConfigCache, dialerCache, uPSKs[i], logger),
+		}
+	}
+
+	return results, nil
+}
+
+// selfTestClientConfig returns the configuration of a client that connects to the server's
+// TCP or UDP address. uPSK is the generated user's PSK for multi-user servers, or nil.
+func (sc *ServerConfig) selfTestClientConfig(network string, address conn.Addr, uPSK []byte) (ClientConfig, string) {
+	cc := ClientConfig{
+		Name:                       "selftest-" + sc.Name,
+		MTU:                        sc.MTU,
+		Compression:                sc.Compression,
+		TCPObfs:                    sc.TCPObfs,
+		UDPObfs:                    sc.UDPObfs,
+		UDPObfsPSK:                 sc.UDPObfsPSK,
+		UnsafeRequestStreamPrefix:  sc.UnsafeRequestStreamPrefix,
+		UnsafeResponseStreamPrefix: sc.UnsafeResponseStreamPrefix,
+	}
+
+	switch network {
+	case "tcp":
+		cc.EnableTCP = true
+		cc.TCPAddress = address
+	case "udp":
+		cc.EnableUDP = true
+		cc.UDPAddress = address
+	}
+
+	switch sc.Protocol {
+	case "direct":
+		cc.Protocol = "direct"
+	case "none", "plain", "socks5", "http":
+		cc.Protocol = sc.Protocol
+	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		cc.Protocol = sc.Protocol
+		if uPSK != nil {
+			cc.PSK = uPSK
+			cc.IPSKs = [][]byte{sc.PSK}
+		} else {
+			cc.PSK = sc.PSK
+		}
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		cc.Protocol = sc.Protocol
+		cc.Password = sc.Password
+	default:
+		return cc, fmt.Sprintf("protocol %q cannot be tested with a loopback client", sc.Protocol)
+	}
+
+	return cc, ""
+}
+
+// selfTestTargetAddr returns the target address for the client.
+// Tunnel servers are reached by connecting to them directly.
+func (sc *ServerConfig) selfTestTargetAddr(address conn.Addr) conn.Addr {
+	if sc.Protocol == "direct" {
+		return address
+	}
+	return selfTestTarget
+}
+
+func (sc *ServerConfig) selfTestTCP(ctx context.Context, listenConfigCache conn.ListenConfigCache, dialerCache conn.DialerCache, uPSK []byte, logger *zap.Logger) SelfTestCheck {
+	if len(sc.TCPListeners) == 0 {
+		return skippedCheck("TCP is disabled")
+	}
+
+	lnc := &sc.TCPListeners[0]
+	if lnc.ProxyProtocol {
+		return skippedCheck("listener requires PROXY protocol")
+	}
+
+	address, err := selfTestDialAddr(lnc.Address)
+	if err != nil {
+		return SelfTestCheck{Err: err}
+	}
+
+	cc, skipReason := sc.selfTestClientConfig("tcp", address, uPSK)
+	if skipReason != "" {
+		return skippedCheck(skipReason)
+	}
+	if err = cc.Initialize(listenConfigCache, dialerCache, logger); err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to initialize client: %w", err)}
+	}
+	client, err := cc.TCPClient()
+	if err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to create client: %w", err)}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	payload := make([]byte, selfTestPayloadSize)
+	rand.Read(payload)
+
+	start := time.Now()
+
+	rawRW, rw, err := client.Dial(ctx, sc.selfTestTargetAddr(address), payload)
+	if err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to connect to %s: %w", address, err)}
+	}
+	defer rawRW.Close()
+
+	if tc, ok := rawRW.(*net.TCPConn); ok {
+		go func() {
+			<-ctx.Done()
+			tc.SetReadDeadline(conn.ALongTimeAgo)
+		}()
+	}
+
+	// Read one byte more than sent, so that extra data is noticed.
+	reply := make([]byte, len(payload)+1)
+	n, err := io.ReadAtLeast(zerocopy.NewCopyReadWriter(rw), reply, len(payload))
+	if err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to read echoed payload: %w", err)}
+	}
+	if !bytes.Equal(reply[:n], payload) {
+		return SelfTestCheck{Err: errors.New("echoed payload does not match")}
+	}
+
+	return SelfTestCheck{RTT: time.Since(start)}
+}
+
+func (sc *ServerConfig) selfTestUDP(ctx context.Context, listenConfigCache conn.ListenConfigCache, dialerCache conn.DialerCache, uPSK []byte, logger *zap.Logger) SelfTestCheck {
+	if len(sc.UDPListeners) == 0 {
+		return skippedCheck("UDP is disabled")
+	}
+
+	var (
+		address conn.Addr
+		err     error
+	)
+
+	if sc.Protocol == "socks5" {
+		// SOCKS5 UDP sessions are associated over TCP.
+		if len(sc.TCPListeners) == 0 {
+			return skippedCheck("SOCKS5 UDP requires TCP")
+		}
+		address, err = selfTestDialAddr(sc.TCPListeners[0].Address)
+	} else {
+		address, err = selfTestDialAddr(sc.UDPListeners[0].Address)
+	}
+	if err != nil {
+		return SelfTestCheck{Err: err}
+	}
+
+	cc, skipReason := sc.selfTestClientConfig("udp", address, uPSK)
+	if skipReason != "" {
+		return skippedCheck(skipReason)
+	}
+	if err = cc.Initialize(listenConfigCache, dialerCache, logger); err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to initialize client: %w", err)}
+	}
+	client, err := cc.UDPClient()
+	if err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to create client: %w", err)}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	clientInfo, clientSession, err := client.NewSession(ctx)
+	if err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to create client session: %w", err)}
+	}
+	defer clientSession.Close()
+
+	udpConn, _, err := clientInfo.ListenConfig.ListenUDP(ctx, "udp", "")
+	if err != nil {
+		return SelfTestCheck{Err: fmt.Errorf("failed to create UDP socket: %w", err)}
+	}
+	defer udpConn.Close()
+
+	go func() {
+		<-ctx.Done()
+		udpConn.SetReadDeadline(conn.ALongTimeAgo)
+	}()
+
+	payload := make([]byte, selfTestPayloadSize)
+	rand.Read(payload)
+	targetAddr := sc.selfTestTargetAddr(address)
+	headroom := clientInfo.PackerHeadroom
+
+	// Keep sending the packet until the echo is received, in case it is dropped.
+	sendErrCh := make(chan error, 1)
+	go func() {
+		b := make([]byte, headroom.Front+len(payload)+headroom.Rear)
+		ticker := time.NewTicker(selfTestUDPResendInterval)
+		defer ticker.Stop()
+
+		for {
+			copy(b[headroom.Front:], payload)
+			destAddrPort, packetStart, packetLen, err := clientSession.Packer.PackInPlace(ctx, b, targetAddr, headroom.Front, len(payload))
+			if err != nil {
+				if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+					err = fmt.Errorf("MTU %d is too small for a %d-byte payload: %w", sc.MTU, len(payload), err)
+				}
+				sendErrCh <- fmt.Errorf("failed to pack packet: %w", err)
+				cancel()
+				return
+			}
+			if _, err = udpConn.WriteToUDPAddrPort(b[packetStart:packetStart+packetLen], destAddrPort); err != nil {
+				sendErrCh <- fmt.Errorf("failed to send packet to %s: %w", destAddrPort, err)
+				cancel()
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	recvBuf := make([]byte, clientSession.MaxPacketSize)
+	var lastErr error
+
+	for {
+		n, _, flags, packetSourceAddrPort, err := udpConn.ReadMsgUDPAddrPort(recvBuf, nil)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				select {
+				case err = <-sendErrCh:
+				default:
+					err = errors.Join(errors.New("timed out waiting for echoed packet"), lastErr)
+				}
+				return SelfTestCheck{Err: err}
+			}
+			lastErr = err
+			continue
+		}
+		if err = conn.ParseFlagsForError(flags); err != nil {
+			lastErr = err
+			continue
+		}
+
+		_, payloadStart, payloadLen, err := clientSession.Unpacker.UnpackInPlace(recvBuf, packetSourceAddrPort, 0, n)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to unpack packet from %s: %w", packetSourceAddrPort, err)
+			continue
+		}
+		if !bytes.Equal(recvBuf[payloadStart:payloadStart+payloadLen], payload) {
+			lastErr = errors.New("echoed payload does not match")
+			continue
+		}
+
+		return SelfTestCheck{RTT: time.Since(start)}
+	}
+}
+
+// selfTestDialAddr returns the address for connecting to a listener with the given listen address.
+// Unspecified and empty hosts are replaced with the loopback address of the same family.
+func selfTestDialAddr(listenAddress string) (conn.Addr, error) {
+	host, portString, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return conn.Addr{}, fmt.Errorf("bad listen address %q: %w", listenAddress, err)
+	}
+
+	port64, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return conn.Addr{}, fmt.Errorf("bad listen address %q: %w", listenAddress, err)
+	}
+	port := uint16(port64)
+
+	if host == "" {
+		return conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port)), nil
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return conn.AddrFromDomainPort(host, port)
+	}
+
+	if ip.IsUnspecified() {
+		if ip.Is4() {
+			ip = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		} else {
+			ip = netip.IPv6Loopback()
+		}
+	}
+	return conn.AddrFromIPPort(netip.AddrPortFrom(ip, port)), nil
+}
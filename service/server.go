@@ -3,18 +3,33 @@ package service
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/netip"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/database64128/shadowsocks-go/affinity"
 	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/capture"
+	"github.com/database64128/shadowsocks-go/compression"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
 	"github.com/database64128/shadowsocks-go/cred"
 	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/event"
 	"github.com/database64128/shadowsocks-go/http"
 	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/obfs"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/redis"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/sip003"
 	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/ssaead"
 	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/windivert"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
@@ -26,6 +41,9 @@ type ListenerConfig struct {
 	Network string `json:"network"`
 
 	// Address is the address to listen on.
+	//
+	// The port may be a range like "0.0.0.0:20000-20010",
+	// which expands into one listener with the same configuration for each port in the range.
 	Address string `json:"address"`
 
 	// Fwmark sets the listener's fwmark on Linux, or user cookie on FreeBSD.
@@ -42,6 +60,12 @@ type ListenerConfig struct {
 	//
 	// Available on Linux and the BSDs.
 	ReusePort bool `json:"reusePort"`
+
+	// portRangeOffset is the offset of the port in the port range the listener was expanded from.
+	portRangeOffset int
+
+	// tunnelRemoteAddress is the target address of the listener of a simple tunnel.
+	tunnelRemoteAddress conn.Addr
 }
 
 // TCPListenerConfig is the configuration for a TCP listener.
@@ -73,6 +97,19 @@ type TCPListenerConfig struct {
 	// Available on platforms supported by Go std's MPTCP implementation.
 	Multipath bool `json:"multipath"`
 
+	// ProxyProtocol requires a PROXY protocol (v1 or v2) header at the beginning of each accepted connection.
+	// The source address in the header replaces the connection's remote address for routing and logging.
+	//
+	// Enable this only when the listener is exclusively reached through a trusted load balancer or proxy.
+	ProxyProtocol bool `json:"proxyProtocol"`
+
+	// HandshakeTimeout is the read timeout for completing the inbound handshake,
+	// including the PROXY protocol header, if enabled.
+	// Connections that fail to complete the handshake in time are closed and counted as rejections.
+	//
+	// The default value is 30s. Set to a negative value to disable the timeout.
+	HandshakeTimeout jsonhelper.Duration `json:"handshakeTimeout"`
+
 	// DisableInitialPayloadWait disables the brief wait for initial payload.
 	// Setting it to true is useful when the listener only relays server-speaks-first protocols.
 	DisableInitialPayloadWait bool `json:"disableInitialPayloadWait"`
@@ -104,6 +141,16 @@ type TCPListenerConfig struct {
 	//
 	// Available on Linux.
 	UserTimeoutMsecs int `json:"userTimeoutMsecs"`
+
+	// UrgentData controls how TCP urgent data from clients is handled.
+	//
+	//   - "": Leave it to the kernel. On most systems, the urgent byte is silently removed from the stream.
+	//   - "discard": Remove the urgent byte from the stream, and count discarded bytes in traffic statistics.
+	//     This costs one extra system call per read from the client connection.
+	//   - "inline": Keep the urgent byte in the stream with SO_OOBINLINE, and relay it as regular data.
+	//
+	// Available on Linux.
+	UrgentData string `json:"urgentData"`
 }
 
 // Configure returns a TCP listener configuration.
@@ -123,6 +170,17 @@ func (lnc *TCPListenerConfig) Configure(listenConfigCache conn.ListenConfigCache
 		return tcpRelayListener{}, fmt.Errorf("negative initial payload wait timeout: %s", initialPayloadWaitTimeout)
 	}
 
+	handshakeTimeout := lnc.HandshakeTimeout.Value()
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+
+	switch lnc.UrgentData {
+	case "", "discard", "inline":
+	default:
+		return tcpRelayListener{}, fmt.Errorf("invalid urgent data handling: %s", lnc.UrgentData)
+	}
+
 	switch {
 	case lnc.InitialPayloadWaitBufferSize == 0:
 		lnc.InitialPayloadWaitBufferSize = defaultInitialPayloadWaitBufferSize
@@ -137,12 +195,16 @@ func (lnc *TCPListenerConfig) Configure(listenConfigCache conn.ListenConfigCache
 			TCPFastOpenBacklog:  lnc.FastOpenBacklog,
 			TCPDeferAcceptSecs:  lnc.DeferAcceptSecs,
 			TCPUserTimeoutMsecs: lnc.UserTimeoutMsecs,
+			TCPUrgentInline:     lnc.UrgentData == "inline",
 			ReusePort:           lnc.ReusePort,
 			Transparent:         transparent,
 			TCPFastOpen:         lnc.FastOpen,
 			TCPFastOpenFallback: lnc.FastOpenFallback,
 			MultipathTCP:        lnc.Multipath,
 		}),
+		proxyProtocol:                lnc.ProxyProtocol,
+		handshakeTimeout:             handshakeTimeout,
+		countUrgentData:              lnc.UrgentData == "discard",
 		waitForInitialPayload:        !serverNativeInitialPayload && !lnc.DisableInitialPayloadWait,
 		initialPayloadWaitTimeout:    initialPayloadWaitTimeout,
 		initialPayloadWaitBufferSize: lnc.InitialPayloadWaitBufferSize,
@@ -163,6 +225,27 @@ type UDPListenerConfig struct {
 	//
 	// The default value is 5 minutes.
 	NATTimeout jsonhelper.Duration `json:"natTimeout"`
+
+	// Queues is the number of server sockets to bind to the address with SO_REUSEPORT.
+	// Each socket has its own receive routine, and all sockets share the relay's session table.
+	// The kernel distributes incoming packets among the sockets by hashing the 4-tuple,
+	// so packets of the same client session always arrive on the same socket.
+	//
+	// If greater than 1, ReusePort is implied, and the address must have a non-zero port.
+	// The default value is 1.
+	//
+	// Available on Linux and the BSDs.
+	Queues int `json:"queues"`
+
+	// QueueCPUs is the list of CPUs for the sockets, one for each of Queues.
+	//
+	// Each socket gets SO_INCOMING_CPU set to its CPU, so the kernel delivers packets processed
+	// on that CPU to it, and its receive routine is pinned to the CPU. With NIC IRQs and RSS queues
+	// steered to the same CPUs, each packet is received and relayed on the CPU that processed it.
+	// Session goroutines started by the receive routine are not pinned.
+	//
+	// Available on Linux.
+	QueueCPUs []int `json:"queueCPUs"`
 }
 
 // Configure returns a UDP server socket configuration.
@@ -173,10 +256,43 @@ func (lnc *UDPListenerConfig) Configure(listenConfigCache conn.ListenConfigCache
 		return udpRelayServerConn{}, fmt.Errorf("invalid network: %s", lnc.Network)
 	}
 
+	switch {
+	case lnc.Queues == 0:
+		lnc.Queues = 1
+	case lnc.Queues == 1:
+	case lnc.Queues > 1 && lnc.Queues <= 256:
+		_, port, err := net.SplitHostPort(lnc.Address)
+		if err != nil {
+			return udpRelayServerConn{}, fmt.Errorf("bad listen address %q: %w", lnc.Address, err)
+		}
+		if port == "" || port == "0" {
+			return udpRelayServerConn{}, fmt.Errorf("multiple queues require a non-zero port: %q", lnc.Address)
+		}
+		lnc.ReusePort = true
+	default:
+		return udpRelayServerConn{}, fmt.Errorf("queues out of range [0, 256]: %d", lnc.Queues)
+	}
+
+	if len(lnc.QueueCPUs) != 0 {
+		if len(lnc.QueueCPUs) != lnc.Queues {
+			return udpRelayServerConn{}, fmt.Errorf("got %d queue CPUs for %d queues", len(lnc.QueueCPUs), lnc.Queues)
+		}
+		for _, cpu := range lnc.QueueCPUs {
+			if cpu < 0 {
+				return udpRelayServerConn{}, fmt.Errorf("negative queue CPU: %d", cpu)
+			}
+		}
+	}
+
 	if err := lnc.UDPPerfConfig.CheckAndApplyDefaults(); err != nil {
 		return udpRelayServerConn{}, err
 	}
 
+	udpOffload := lnc.UDPPerfConfig.BatchMode == "gso"
+	if udpOffload && transparent {
+		return udpRelayServerConn{}, errors.New("batch mode gso is not supported by transparent proxy")
+	}
+
 	natTimeout := lnc.NATTimeout.Value()
 
 	switch {
@@ -187,26 +303,52 @@ func (lnc *UDPListenerConfig) Configure(listenConfigCache conn.ListenConfigCache
 	}
 
 	return udpRelayServerConn{
-		listenConfig: listenConfigCache.Get(conn.ListenerSocketOptions{
-			SendBufferSize:    conn.DefaultUDPSocketBufferSize,
-			ReceiveBufferSize: conn.DefaultUDPSocketBufferSize,
-			Fwmark:            lnc.Fwmark,
-			TrafficClass:      lnc.TrafficClass,
-			ReusePort:         lnc.ReusePort,
-			Transparent:       transparent,
-			PathMTUDiscovery:  true,
-			ReceivePacketInfo: true,
-		}),
+		listenConfig:        listenConfigCache.Get(lnc.socketOptions(transparent)),
+		cpu:                 -1,
 		network:             lnc.Network,
 		address:             lnc.Address,
 		batchMode:           lnc.UDPPerfConfig.BatchMode,
 		relayBatchSize:      lnc.UDPPerfConfig.RelayBatchSize,
 		serverRecvBatchSize: lnc.UDPPerfConfig.ServerRecvBatchSize,
 		sendChannelCapacity: lnc.UDPPerfConfig.SendChannelCapacity,
+		v4MappedMode:        lnc.UDPPerfConfig.V4MappedMode,
 		natTimeout:          natTimeout,
+		minNATTimeout:       minNATTimeout,
 	}, nil
 }
 
+// socketOptions returns the socket options of the UDP server sockets.
+func (lnc *UDPListenerConfig) socketOptions(transparent bool) conn.ListenerSocketOptions {
+	udpOffload := lnc.UDPPerfConfig.BatchMode == "gso"
+	return conn.ListenerSocketOptions{
+		SendBufferSize:           conn.DefaultUDPSocketBufferSize,
+		ReceiveBufferSize:        conn.DefaultUDPSocketBufferSize,
+		Fwmark:                   lnc.Fwmark,
+		TrafficClass:             lnc.TrafficClass,
+		ReusePort:                lnc.ReusePort,
+		Transparent:              transparent,
+		PathMTUDiscovery:         true,
+		ProbeUDPGSOSupport:       udpOffload,
+		UDPGenericReceiveOffload: udpOffload,
+		ReceivePacketInfo:        !transparent,
+		ReceiveOriginalDestAddr:  transparent,
+	}
+}
+
+// queueListener returns the listener of the given queue,
+// which differs from listener only if QueueCPUs is set.
+func (lnc *UDPListenerConfig) queueListener(listener udpRelayServerConn, listenConfigCache conn.ListenConfigCache, queue int, transparent bool) udpRelayServerConn {
+	if len(lnc.QueueCPUs) == 0 {
+		return listener
+	}
+	lso := lnc.socketOptions(transparent)
+	lso.SetIncomingCPU = true
+	lso.IncomingCPU = lnc.QueueCPUs[queue]
+	listener.listenConfig = listenConfigCache.Get(lso)
+	listener.cpu = lnc.QueueCPUs[queue]
+	return listener
+}
+
 // ServerConfig stores a server configuration.
 // It may be marshaled as or unmarshaled from JSON.
 type ServerConfig struct {
@@ -214,7 +356,11 @@ type ServerConfig struct {
 	Name string `json:"name"`
 
 	// Protocol is the protocol the server uses.
-	// Valid values include "direct", "tproxy" (Linux only), "socks5", "http", "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm".
+	// Valid values include "direct", "tproxy" (Linux, UDP only on FreeBSD), "redirect" (Linux, TCP only), "windivert" (Windows, TCP only), "socks5", "http", "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305".
+	//
+	// "aes-256-gcm" and "chacha20-ietf-poly1305" are legacy Shadowsocks AEAD methods,
+	// for clients that do not support Shadowsocks 2022. They have no replay protection
+	// beyond remembering recent salts, so prefer Shadowsocks 2022 when clients support it.
 	Protocol string `json:"protocol"`
 
 	// TCPListeners is the list of TCP listeners.
@@ -237,6 +383,7 @@ type ServerConfig struct {
 
 	EnableTCP                 bool `json:"enableTCP"`
 	ListenerTFO               bool `json:"listenerTFO"`
+	ListenerMultipathTCP      bool `json:"listenerMultipathTCP"`
 	DisableInitialPayloadWait bool `json:"disableInitialPayloadWait"`
 
 	// UDP
@@ -256,6 +403,17 @@ type ServerConfig struct {
 	TunnelRemoteAddress conn.Addr `json:"tunnelRemoteAddress"`
 	TunnelUDPTargetOnly bool      `json:"tunnelUDPTargetOnly"`
 
+	// TunnelRemotePorts is a port range like "30000-30010" at the host of TunnelRemoteAddress.
+	// Each port of a listen port range forwards to the port at the same offset in this range,
+	// and listeners without a port range forward to the first port.
+	//
+	// If unspecified, all listeners forward to TunnelRemoteAddress.
+	TunnelRemotePorts string `json:"tunnelRemotePorts"`
+
+	// TunnelRemoteAddressByPort maps listen ports to target addresses,
+	// overriding TunnelRemoteAddress and TunnelRemotePorts for listeners on these ports.
+	TunnelRemoteAddressByPort map[uint16]conn.Addr `json:"tunnelRemoteAddressByPort"`
+
 	tcpEnabled bool
 	udpEnabled bool
 
@@ -268,6 +426,230 @@ type ServerConfig struct {
 	// Only applicable to Shadowsocks 2022 TCP.
 	AllowSegmentedFixedLengthHeader bool `json:"allowSegmentedFixedLengthHeader"`
 
+	// Compression enables stream compression for TCP connections from clients
+	// with the same option enabled. Valid values are "" (disabled) and "zstd".
+	//
+	// The server decompresses the stream with the algorithm chosen by the client for each connection.
+	// Clients without compression enabled cannot connect to a server with compression enabled.
+	//
+	// See [ClientConfig.Compression] for the length side channel introduced by compression.
+	//
+	// Only applicable to "none", "plain" and Shadowsocks 2022.
+	Compression string `json:"compression"`
+
+	compressionAlgorithm compression.Algorithm
+
+	// TCPObfs is the simple-obfs style obfuscation mode for TCP connections from clients.
+	// Clients must use the same mode. Valid values are "" (disabled), "http" and "tls".
+	//
+	// Connections that do not start with the expected WebSocket upgrade request or TLS handshake
+	// are handled by RejectPolicy or UnsafeFallbackAddress, with the data read so far.
+	//
+	// Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD.
+	TCPObfs string `json:"tcpObfs"`
+
+	// UDPObfs is the obfuscation mode for UDP packets from clients.
+	// Clients must use the same mode and UDPObfsPSK.
+	// Valid values are "" (disabled), "xor" and "salted-xor".
+	//
+	// Only applicable to "none", "plain" and Shadowsocks 2022.
+	UDPObfs string `json:"udpObfs"`
+
+	// UDPObfsPSK is the pre-shared key for UDP obfuscation.
+	UDPObfsPSK []byte `json:"udpObfsPSK"`
+
+	udpObfuscator obfs.Obfuscator
+
+	// UDPOverTCP enables relaying UDP sessions over TCP connections to the UDP-over-TCP magic addresses,
+	// as opened by clients with UDPOverTCP set, and by sing-box clients with UDP over TCP enabled.
+	//
+	// Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD.
+	UDPOverTCP bool `json:"udpOverTCP"`
+
+	// OutboundDSCP is the DSCP value to mark the server's outbound traffic with,
+	// overriding the dialer traffic class of the clients it is routed to.
+	// It applies to remote TCP connections and UDP NAT sockets opened for the server's connections and sessions.
+	// For example, a server for VoIP clients can use 46 (Expedited Forwarding),
+	// and a server for bulk downloads can use 8 (CS1), so that upstream QoS can tell them apart.
+	//
+	// The default value 0 leaves the clients' traffic class unchanged.
+	//
+	// Available on Unix-like systems.
+	OutboundDSCP int `json:"outboundDSCP"`
+
+	outboundTrafficClass int
+
+	// TCPSockmap relays TCP connections between plain kernel sockets with an eBPF sockmap,
+	// so that payload is redirected from one socket to the other in the kernel, bypassing userspace.
+	//
+	// Only applies to connections whose both sides are relayed without any transformation,
+	// such as a direct server routed to a direct client. Connections that are tracked, captured,
+	// or rate limited are relayed in userspace.
+	//
+	// Available on Linux. Requires CAP_BPF and CAP_NET_ADMIN.
+	TCPSockmap bool `json:"tcpSockmap"`
+
+	sockmap *conn.Sockmap
+
+	// MaxHTTPHeaderBytes is the maximum size of the request line and header fields of each HTTP request.
+	// Requests exceeding the limit are rejected with status 431 as soon as the limit is reached.
+	//
+	// The default value is 1 MiB.
+	//
+	// Only applicable to "http".
+	MaxHTTPHeaderBytes int `json:"maxHTTPHeaderBytes"`
+
+	// WinDivertFilter is the WinDivert filter that selects outbound TCP packets to divert to the server.
+	// The filter must exclude the proxy's own outbound connections, such as those to upstream servers,
+	// or they will be diverted back to the server in a loop.
+	//
+	// Only applicable to "windivert".
+	WinDivertFilter string `json:"winDivertFilter"`
+
+	winDivertRedirector *windivert.Redirector
+
+	// DNSHijack enables intercepting DNS queries to port 53 that pass through a transparent proxy server,
+	// and answering them with DNSHijackResolver instead of relaying them,
+	// so that clients resolve names the same way as the router's domain rules do.
+	//
+	// A and AAAA queries are answered with the resolved addresses. Other queries are answered with no records.
+	//
+	// Only applicable to "tproxy" (TCP and UDP), "redirect" and "windivert" (TCP).
+	DNSHijack bool `json:"dnsHijack"`
+
+	// DNSHijackResolver is the name of the DNS resolver that answers intercepted queries.
+	// If empty, the configured resolvers are tried in order, like routes without a resolver do.
+	DNSHijackResolver string `json:"dnsHijackResolver"`
+
+	dnsHijack *dnsHijacker
+
+	// MaxSocksDomainLength is the maximum length of domain names in SOCKS5 requests.
+	// Requests with longer domain names are rejected before the domain name is read.
+	//
+	// The default value is 255, the maximum allowed by the protocol.
+	//
+	// Only applicable to "socks5".
+	MaxSocksDomainLength int `json:"maxSocksDomainLength"`
+
+	// RateLimit limits the bandwidth of the server, each user or client IP address, and each connection.
+	//
+	// TCP traffic exceeding the limit is delayed. UDP packets exceeding the limit are dropped.
+	//
+	// Not applicable to transparent proxy UDP relays.
+	RateLimit *ratelimit.Config `json:"rateLimit"`
+
+	rateLimiter *ratelimit.Limiter
+
+	// MaxConcurrentTCPConnections is the maximum number of concurrent TCP connections.
+	// New connections over the limit are rejected.
+	//
+	// The default value 0 means no limit.
+	MaxConcurrentTCPConnections int `json:"maxConcurrentTCPConnections"`
+
+	// MaxUDPSessions is the maximum number of concurrent UDP sessions.
+	// Packets that would start a new session over the limit are handled by UDPSessionLimitPolicy.
+	//
+	// The default value 0 means no limit.
+	MaxUDPSessions int `json:"maxUDPSessions"`
+
+	// UDPSessionLimitPolicy controls how packets that would start a new UDP session over MaxUDPSessions are handled.
+	//
+	//   - "drop": Drop the packet. (Default)
+	//   - "evictLRU": Evict the session that least recently received a packet from its client,
+	//     and start the new session. The session is only evicted after the packet is successfully unpacked,
+	//     so that packets failing authentication cannot evict sessions.
+	//
+	// Not applicable to transparent proxy UDP relays.
+	UDPSessionLimitPolicy string `json:"udpSessionLimitPolicy"`
+
+	udpSessionLimitPolicy udpSessionLimitPolicy
+
+	// UDPPacketBufferPoolSize is the number of packet buffers the UDP relay allocates on start
+	// and keeps for reuse. Buffers needed beyond that are allocated on demand, and freed when no longer used.
+	// Big servers can raise it to avoid allocations and garbage collection under load,
+	// at the cost of memory that is never returned to the system.
+	//
+	// The default value 0 allocates all buffers on demand, and lets the garbage collector free idle ones.
+	UDPPacketBufferPoolSize int `json:"udpPacketBufferPoolSize"`
+
+	// AcceptRampUp paces new TCP connections and UDP sessions for a while after the server starts,
+	// so that a server returning to service is not overwhelmed by clients reconnecting all at once.
+	//
+	// TCP connections over the allowed rate wait in the listen backlog.
+	// Packets that would start a new UDP session over the allowed rate are dropped.
+	//
+	// Not applicable to transparent proxy UDP relays.
+	AcceptRampUp *ratelimit.RampUpConfig `json:"acceptRampUp"`
+
+	acceptRampUp *ratelimit.RampUp
+
+	// OversizedUDPPayload controls how unpacked UDP payloads too big to pack for the path to the client are handled.
+	// Oversized payloads are counted in traffic statistics.
+	//
+	//   - "drop": Drop the packet. (Default)
+	//   - "truncateDNS": Truncate DNS responses from port 53 to the header and question section,
+	//     and set the TC bit, so that the client retries over TCP. Other oversized payloads are dropped.
+	//
+	// Oversized payloads from clients are always dropped.
+	//
+	// Not applicable to transparent proxy UDP relays.
+	OversizedUDPPayload string `json:"oversizedUDPPayload"`
+
+	oversizedPayloadPolicy oversizedPayloadPolicy
+
+	// UDPNATFiltering controls which remote endpoints can send packets to a client through its UDP sessions.
+	// Each session maps all of its destinations to a single UDP socket,
+	// so the mapping behavior is always endpoint-independent.
+	//
+	//   - "endpointIndependent": Accept packets from any remote endpoint (full cone). (Default)
+	//   - "addressDependent": Accept packets from remote addresses the session has sent packets to.
+	//   - "addressAndPortDependent": Accept packets from remote addresses and ports the session has sent packets to.
+	//
+	// Packets are filtered by the remote endpoint of the session's outbound socket.
+	// For sessions relayed through a proxy client, that is the proxy server.
+	//
+	// Not applicable to transparent proxy UDP relays.
+	UDPNATFiltering string `json:"udpNATFiltering"`
+
+	natFiltering natFilteringBehavior
+
+	// TrackConnections enables tracking of live TCP connections and UDP sessions,
+	// so that they can be listed and terminated via the RESTful API.
+	//
+	// Traffic of tracked TCP connections is counted as it is relayed,
+	// which disables zero-copy relaying like splice(2).
+	//
+	// Connections are always tracked on servers with a uPSK store,
+	// to count users' traffic against their quotas as it is relayed.
+	TrackConnections bool `json:"trackConnections"`
+
+	connTable *conntrack.Table
+
+	// TrafficCaptureDir allows capturing decrypted traffic of the server via the RESTful API,
+	// for diagnosing protocol issues. Capture files are created in the directory.
+	// If empty, traffic capture is disabled.
+	//
+	// Captured TCP connections are relayed through the capturing methods,
+	// which disables zero-copy relaying like splice(2).
+	TrafficCaptureDir string `json:"trafficCaptureDir"`
+
+	captures *capture.Server
+
+	resources *resource.Server
+
+	// AllowedClientPrefixes restricts the server to clients with source addresses in the prefixes.
+	// If empty, all client addresses are allowed, unless denied by DeniedClientPrefixes.
+	//
+	// The ACL is checked against the socket's remote address right after accepting a TCP connection
+	// or receiving a UDP packet, before any handshake or PROXY protocol processing.
+	AllowedClientPrefixes []netip.Prefix `json:"allowedClientPrefixes"`
+
+	// DeniedClientPrefixes rejects clients with source addresses in the prefixes.
+	// It takes precedence over AllowedClientPrefixes.
+	DeniedClientPrefixes []netip.Prefix `json:"deniedClientPrefixes"`
+
+	clientACL *clientACL
+
 	// Shadowsocks
 
 	PSK           []byte `json:"psk"`
@@ -275,6 +657,49 @@ type ServerConfig struct {
 	PaddingPolicy string `json:"paddingPolicy"`
 	RejectPolicy  string `json:"rejectPolicy"`
 
+	// IdentityPSKs is the list of identity PSKs with validity periods, for rotating the identity PSK without downtime.
+	// The server accepts all identity PSKs within their validity periods.
+	// Give the old and new identity PSKs overlapping validity periods,
+	// and schedule clients to switch to the new identity PSK within the overlap with NextIPSKs.
+	//
+	// Mutually exclusive with PSK.
+	// Only applicable to Shadowsocks 2022 with UPSKStorePath.
+	IdentityPSKs []ss2022.ScheduledPSK `json:"identityPSKs"`
+
+	// Password is the password for legacy Shadowsocks AEAD clients.
+	// The key is derived from it the same way as other implementations do.
+	//
+	// Only applicable to "aes-256-gcm" and "chacha20-ietf-poly1305".
+	Password string `json:"password"`
+
+	// Plugin is the path to a SIP003 plugin executable, like v2ray-plugin or kcptun,
+	// or its name to be looked up in PATH.
+	//
+	// When set, the plugin is started with the server, and restarted if it exits.
+	// The plugin listens on the TCP listen address, and forwards to the server on a local port.
+	// UDP is not affected.
+	//
+	// Requires exactly one TCP listener.
+	// Only applicable to "none", "plain", Shadowsocks 2022, and legacy Shadowsocks AEAD.
+	Plugin string `json:"plugin"`
+
+	// PluginOpts is the options passed to the plugin in SS_PLUGIN_OPTIONS.
+	PluginOpts string `json:"pluginOpts"`
+
+	plugin *sip003.Plugin
+
+	// WatchUPSKStore enables watching the uPSK store file for changes,
+	// and reloading user credentials automatically when it changes.
+	//
+	// Only applicable to Shadowsocks 2022 with UPSKStorePath.
+	WatchUPSKStore bool `json:"watchUPSKStore"`
+
+	// SIP008Address is the address of the server in users' SIP008 online config documents
+	// served by the API, like "example.com:20220". If empty, the server is left out of the documents.
+	//
+	// Only applicable to Shadowsocks 2022 with UPSKStorePath.
+	SIP008Address conn.Addr `json:"sip008Address"`
+
 	// SlidingWindowFilterSize is the size of the sliding window filter.
 	//
 	// The default value is 256.
@@ -282,10 +707,36 @@ type ServerConfig struct {
 	// Only applicable to Shadowsocks 2022 UDP.
 	SlidingWindowFilterSize int `json:"slidingWindowFilterSize"`
 
+	// ReplayStatePath is the path to the file for saving the server's replay protection state,
+	// which consists of recently seen request salts and client session packet IDs.
+	// The state is saved periodically and on shutdown, and restored on startup,
+	// so that requests and packets captured before a restart cannot be replayed after it.
+	//
+	// Only applicable to Shadowsocks 2022.
+	ReplayStatePath string `json:"replayStatePath"`
+
+	// ReplayFilterRedisURL is the URL of a Redis server for sharing request salts with other instances
+	// of the server, like "redis://:password@10.0.0.10:6379/0", or "rediss://" for TLS.
+	// Use it when several instances with the same PSKs are behind the same address,
+	// so that a request accepted by one instance cannot be replayed to another.
+	//
+	// Each authenticated request adds a key to Redis that expires after the replay window.
+	// If Redis is unreachable, requests are only checked against the instance's own salts.
+	//
+	// Only applicable to Shadowsocks 2022 TCP.
+	ReplayFilterRedisURL string `json:"replayFilterRedisURL"`
+
 	userCipherConfig     ss2022.UserCipherConfig
 	identityCipherConfig ss2022.ServerIdentityCipherConfig
+	aeadCipherConfig     *ssaead.CipherConfig
 	tcpCredStore         *ss2022.CredStore
 	udpCredStore         *ss2022.CredStore
+	ss2022TCPServer      *ss2022.TCPServer
+	ss2022UDPServer      *ss2022.UDPServer
+	replayFilterRedis    *redis.Client
+	udpSessions          *affinity.Table
+	userACL              *cred.ACLChecker
+	cms                  *cred.ManagedServer
 
 	// Taint
 
@@ -295,38 +746,209 @@ type ServerConfig struct {
 
 	listenConfigCache conn.ListenConfigCache
 	collector         stats.Collector
+	events            *event.Bus
 	router            *router.Router
 	logger            *zap.Logger
 	index             int
 }
 
 // Initialize initializes the server configuration.
-func (sc *ServerConfig) Initialize(listenConfigCache conn.ListenConfigCache, collector stats.Collector, router *router.Router, logger *zap.Logger, index int) error {
+func (sc *ServerConfig) Initialize(listenConfigCache conn.ListenConfigCache, collector stats.Collector, events *event.Bus, router *router.Router, logger *zap.Logger, index int) error {
 	sc.tcpEnabled = sc.EnableTCP || len(sc.TCPListeners) > 0
 	sc.udpEnabled = sc.EnableUDP || len(sc.UDPListeners) > 0
 
+	var err error
+	sc.compressionAlgorithm, err = compression.ParseAlgorithm(sc.Compression)
+	if err != nil {
+		return err
+	}
+	if sc.compressionAlgorithm != compression.AlgorithmNone {
+		switch sc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("compression is not supported by protocol %q", sc.Protocol)
+		}
+	}
+
+	sc.udpObfuscator, err = obfs.New(sc.UDPObfs, sc.UDPObfsPSK)
+	if err != nil {
+		return err
+	}
+	if sc.udpObfuscator != nil {
+		switch sc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("UDP obfuscation is not supported by protocol %q", sc.Protocol)
+		}
+	}
+
+	if err = obfs.CheckStreamMode(sc.TCPObfs); err != nil {
+		return err
+	}
+	if sc.TCPObfs != obfs.StreamModeNone {
+		switch sc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+		default:
+			return fmt.Errorf("TCP obfuscation is not supported by protocol %q", sc.Protocol)
+		}
+	}
+
+	if sc.UDPOverTCP {
+		switch sc.Protocol {
+		case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+		default:
+			return fmt.Errorf("UDP over TCP is not supported by protocol %q", sc.Protocol)
+		}
+	}
+
+	if sc.DNSHijack {
+		switch sc.Protocol {
+		case "tproxy", "redirect", "windivert":
+		default:
+			return fmt.Errorf("DNS hijacking is not supported by protocol %q", sc.Protocol)
+		}
+		if _, err = router.Resolver(sc.DNSHijackResolver); err != nil {
+			return fmt.Errorf("bad DNS hijack resolver: %w", err)
+		}
+		sc.dnsHijack = newDNSHijacker(router, sc.DNSHijackResolver)
+	} else if sc.DNSHijackResolver != "" {
+		return errors.New("dnsHijackResolver requires dnsHijack")
+	}
+
+	if sc.outboundTrafficClass, err = conn.TrafficClassFromDSCP(sc.OutboundDSCP); err != nil {
+		return fmt.Errorf("bad outbound DSCP: %w", err)
+	}
+
+	if sc.ReplayStatePath != "" {
+		switch sc.Protocol {
+		case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("saving replay state is not supported by protocol %q", sc.Protocol)
+		}
+	}
+
+	if sc.ReplayFilterRedisURL != "" {
+		switch sc.Protocol {
+		case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		default:
+			return fmt.Errorf("shared replay filter is not supported by protocol %q", sc.Protocol)
+		}
+		if sc.replayFilterRedis, err = redis.ParseURL(sc.ReplayFilterRedisURL); err != nil {
+			return fmt.Errorf("bad replay filter Redis URL: %w", err)
+		}
+	}
+
+	if sc.TCPSockmap {
+		sc.sockmap, err = conn.SharedSockmap()
+		if err != nil {
+			return fmt.Errorf("failed to initialize sockmap: %w", err)
+		}
+	}
+
+	if sc.MaxHTTPHeaderBytes < 0 {
+		return fmt.Errorf("negative max HTTP header bytes: %d", sc.MaxHTTPHeaderBytes)
+	}
+	if sc.MaxSocksDomainLength < 0 || sc.MaxSocksDomainLength > 255 {
+		return fmt.Errorf("max SOCKS domain length out of range [0, 255]: %d", sc.MaxSocksDomainLength)
+	}
+	if sc.MaxConcurrentTCPConnections < 0 {
+		return fmt.Errorf("negative max concurrent TCP connections: %d", sc.MaxConcurrentTCPConnections)
+	}
+	if sc.MaxUDPSessions < 0 {
+		return fmt.Errorf("negative max UDP sessions: %d", sc.MaxUDPSessions)
+	}
+	if sc.UDPPacketBufferPoolSize < 0 {
+		return fmt.Errorf("negative UDP packet buffer pool size: %d", sc.UDPPacketBufferPoolSize)
+	}
+
+	sc.udpSessionLimitPolicy, err = parseUDPSessionLimitPolicy(sc.UDPSessionLimitPolicy)
+	if err != nil {
+		return err
+	}
+
+	sc.oversizedPayloadPolicy, err = parseOversizedPayloadPolicy(sc.OversizedUDPPayload)
+	if err != nil {
+		return err
+	}
+
+	sc.natFiltering, err = parseNATFilteringBehavior(sc.UDPNATFiltering)
+	if err != nil {
+		return err
+	}
+
+	sc.clientACL, err = newClientACL(sc.AllowedClientPrefixes, sc.DeniedClientPrefixes)
+	if err != nil {
+		return fmt.Errorf("failed to build client ACL: %w", err)
+	}
+
+	if sc.RateLimit != nil {
+		sc.rateLimiter, err = sc.RateLimit.Limiter()
+		if err != nil {
+			return fmt.Errorf("failed to create rate limiter: %w", err)
+		}
+	}
+
+	if sc.AcceptRampUp != nil {
+		sc.acceptRampUp, err = sc.AcceptRampUp.RampUp()
+		if err != nil {
+			return fmt.Errorf("failed to create accept ramp-up: %w", err)
+		}
+	}
+
 	switch sc.Protocol {
 	case "direct":
-		if !sc.TunnelRemoteAddress.IsValid() {
+		if !sc.TunnelRemoteAddress.IsValid() && len(sc.TunnelRemoteAddressByPort) == 0 {
 			return errors.New("tunnelRemoteAddress is required for simple tunnel")
 		}
 
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
-		err := ss2022.CheckPSKLength(sc.Protocol, sc.PSK, nil)
+		iPSK := sc.PSK
+		if len(sc.IdentityPSKs) > 0 {
+			if sc.UPSKStorePath == "" {
+				return errors.New("identityPSKs requires uPSKStorePath")
+			}
+			if len(sc.PSK) > 0 {
+				return errors.New("psk and identityPSKs are mutually exclusive")
+			}
+			if err := ss2022.CheckScheduledPSKs(sc.Protocol, sc.IdentityPSKs); err != nil {
+				return err
+			}
+			// The identity PSKs accepted by the server are managed by the credential manager.
+			// The first one only determines the salt length.
+			iPSK = sc.IdentityPSKs[0].PSK
+		}
+
+		err := ss2022.CheckPSKLength(sc.Protocol, iPSK, nil)
 		if err != nil {
 			return err
 		}
 
 		if sc.UPSKStorePath == "" {
+			if sc.WatchUPSKStore {
+				return errors.New("watchUPSKStore requires uPSKStorePath")
+			}
 			sc.userCipherConfig, err = ss2022.NewUserCipherConfig(sc.PSK, sc.udpEnabled)
 			if err != nil {
 				return err
 			}
 		} else {
-			sc.identityCipherConfig, err = ss2022.NewServerIdentityCipherConfig(sc.PSK, sc.udpEnabled)
+			sc.identityCipherConfig, err = ss2022.NewServerIdentityCipherConfig(iPSK, sc.udpEnabled)
 			if err != nil {
 				return err
 			}
+			sc.userACL = cred.NewACLChecker(router)
+		}
+
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		if sc.UPSKStorePath != "" {
+			return fmt.Errorf("uPSKStorePath is not supported by protocol %q", sc.Protocol)
+		}
+		if len(sc.IdentityPSKs) > 0 {
+			return fmt.Errorf("identityPSKs is not supported by protocol %q", sc.Protocol)
+		}
+		sc.aeadCipherConfig, err = ssaead.NewCipherConfig(sc.Protocol, sc.Password)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -339,6 +961,7 @@ func (sc *ServerConfig) Initialize(listenConfigCache conn.ListenConfigCache, col
 				TrafficClass: sc.ListenerTrafficClass,
 			},
 			FastOpen:                  sc.ListenerTFO,
+			Multipath:                 sc.ListenerMultipathTCP,
 			DisableInitialPayloadWait: sc.DisableInitialPayloadWait,
 		})
 	}
@@ -361,8 +984,44 @@ func (sc *ServerConfig) Initialize(listenConfigCache conn.ListenConfigCache, col
 		})
 	}
 
+	sc.TCPListeners, err = expandListenerPortRanges(sc.TCPListeners, func(lnc *TCPListenerConfig) *ListenerConfig {
+		return &lnc.ListenerConfig
+	})
+	if err != nil {
+		return err
+	}
+
+	sc.UDPListeners, err = expandListenerPortRanges(sc.UDPListeners, func(lnc *UDPListenerConfig) *ListenerConfig {
+		return &lnc.ListenerConfig
+	})
+	if err != nil {
+		return err
+	}
+
+	if sc.Protocol == "direct" {
+		if err = sc.initTunnelRemoteAddresses(); err != nil {
+			return err
+		}
+	}
+
+	if err = sc.initPlugin(logger); err != nil {
+		return err
+	}
+
+	// Users' traffic is counted against their quotas from the tracked connections.
+	if sc.TrackConnections || sc.UPSKStorePath != "" {
+		sc.connTable = &conntrack.Table{}
+	}
+
+	if sc.TrafficCaptureDir != "" {
+		sc.captures = capture.NewServer(sc.Name, sc.TrafficCaptureDir, logger)
+	}
+
+	sc.resources = &resource.Server{}
+
 	sc.listenConfigCache = listenConfigCache
 	sc.collector = collector
+	sc.events = events
 	sc.router = router
 	sc.logger = logger
 	sc.index = index
@@ -393,14 +1052,37 @@ func (sc *ServerConfig) TCPRelay() (*TCPRelay, error) {
 		}
 		listenerTransparent = true
 
+	case "redirect":
+		server, err = direct.NewTCPRedirectServer()
+		if err != nil {
+			return nil, err
+		}
+
+	case "windivert":
+		if len(sc.TCPListeners) != 1 {
+			return nil, errors.New("windivert requires exactly one TCP listener")
+		}
+
+		var proxyPort uint16
+		proxyPort, err = listenerPort(sc.TCPListeners[0].Address)
+		if err != nil {
+			return nil, err
+		}
+
+		sc.winDivertRedirector, err = windivert.NewRedirector(sc.Name, sc.WinDivertFilter, proxyPort, sc.logger)
+		if err != nil {
+			return nil, err
+		}
+		server = windivert.NewTCPServer(sc.winDivertRedirector)
+
 	case "none", "plain":
 		server = direct.NewShadowsocksNoneTCPServer()
 
 	case "socks5":
-		server = direct.NewSocks5TCPServer(sc.tcpEnabled, sc.udpEnabled)
+		server = direct.NewSocks5TCPServer(sc.tcpEnabled, sc.udpEnabled, sc.MaxSocksDomainLength)
 
 	case "http":
-		server = http.NewProxyServer(sc.logger)
+		server = http.NewProxyServer(sc.MaxHTTPHeaderBytes, sc.logger)
 
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		if len(sc.UnsafeRequestStreamPrefix) != 0 || len(sc.UnsafeResponseStreamPrefix) != 0 {
@@ -409,12 +1091,17 @@ func (sc *ServerConfig) TCPRelay() (*TCPRelay, error) {
 
 		s := ss2022.NewTCPServer(sc.AllowSegmentedFixedLengthHeader, sc.userCipherConfig, sc.identityCipherConfig, sc.UnsafeRequestStreamPrefix, sc.UnsafeResponseStreamPrefix)
 		sc.tcpCredStore = &s.CredStore
+		sc.ss2022TCPServer = s
 		server = s
 
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		server = ssaead.NewTCPServer(sc.aeadCipherConfig)
+
 	default:
 		return nil, fmt.Errorf("invalid protocol: %s", sc.Protocol)
 	}
 
+	server = sc.wrapTCPServer(server)
 	serverInfo := server.Info()
 
 	connCloser, err = zerocopy.ParseRejectPolicy(sc.RejectPolicy, serverInfo.DefaultTCPConnCloser)
@@ -436,9 +1123,212 @@ func (sc *ServerConfig) TCPRelay() (*TCPRelay, error) {
 		if err != nil {
 			return nil, err
 		}
+		listeners[i].acl = sc.clientACL
+		if target := sc.TCPListeners[i].tunnelRemoteAddress; sc.Protocol == "direct" && !target.Equals(sc.TunnelRemoteAddress) {
+			listeners[i].server = sc.wrapTCPServer(direct.NewTCPServer(target))
+		}
 	}
 
-	return NewTCPRelay(sc.index, sc.Name, listeners, server, connCloser, sc.UnsafeFallbackAddress, sc.collector, sc.router, sc.logger), nil
+	return NewTCPRelay(sc.index, sc.Name, listeners, server, connCloser, sc.UnsafeFallbackAddress, sc.UDPOverTCP, sc.outboundTrafficClass, sc.sockmap, sc.MaxConcurrentTCPConnections, sc.collector, sc.userACL, sc.rateLimiter, sc.acceptRampUp, sc.events, sc.router, sc.dnsHijack, sc.connTable, sc.captures, &sc.resources.TCP, sc.logger), nil
+}
+
+// wrapTCPServer wraps the TCP server with the configured compression and obfuscation, if any.
+func (sc *ServerConfig) wrapTCPServer(server zerocopy.TCPServer) zerocopy.TCPServer {
+	if sc.compressionAlgorithm != compression.AlgorithmNone {
+		server = compression.NewTCPServer(server)
+	}
+
+	if sc.TCPObfs != obfs.StreamModeNone {
+		server = obfs.NewTCPServer(server, sc.TCPObfs)
+	}
+
+	return server
+}
+
+// initTunnelRemoteAddresses sets the target address of each listener of a simple tunnel.
+func (sc *ServerConfig) initTunnelRemoteAddresses() error {
+	var firstPort, lastPort uint16
+	if sc.TunnelRemotePorts != "" {
+		if !sc.TunnelRemoteAddress.IsValid() {
+			return errors.New("tunnelRemotePorts requires tunnelRemoteAddress")
+		}
+		var err error
+		firstPort, lastPort, err = parsePortRange(sc.TunnelRemotePorts)
+		if err != nil {
+			return fmt.Errorf("bad tunnelRemotePorts: %w", err)
+		}
+	}
+
+	for port, addr := range sc.TunnelRemoteAddressByPort {
+		if !addr.IsValid() {
+			return fmt.Errorf("invalid tunnel remote address for port %d", port)
+		}
+	}
+
+	targetAddr := func(lnc *ListenerConfig) (conn.Addr, error) {
+		if len(sc.TunnelRemoteAddressByPort) > 0 {
+			port, err := listenerPort(lnc.Address)
+			if err != nil {
+				return conn.Addr{}, err
+			}
+			if addr, ok := sc.TunnelRemoteAddressByPort[port]; ok {
+				return addr, nil
+			}
+		}
+
+		if !sc.TunnelRemoteAddress.IsValid() {
+			return conn.Addr{}, fmt.Errorf("no tunnel remote address for listener %s", lnc.Address)
+		}
+
+		if sc.TunnelRemotePorts == "" {
+			return sc.TunnelRemoteAddress, nil
+		}
+
+		port := int(firstPort) + lnc.portRangeOffset
+		if port > int(lastPort) {
+			return conn.Addr{}, fmt.Errorf("listener %s is beyond tunnelRemotePorts %q", lnc.Address, sc.TunnelRemotePorts)
+		}
+		return conn.AddrFromHostPort(sc.TunnelRemoteAddress.Host(), uint16(port))
+	}
+
+	for i := range sc.TCPListeners {
+		lnc := &sc.TCPListeners[i].ListenerConfig
+		addr, err := targetAddr(lnc)
+		if err != nil {
+			return err
+		}
+		lnc.tunnelRemoteAddress = addr
+	}
+
+	for i := range sc.UDPListeners {
+		lnc := &sc.UDPListeners[i].ListenerConfig
+		addr, err := targetAddr(lnc)
+		if err != nil {
+			return err
+		}
+		lnc.tunnelRemoteAddress = addr
+	}
+
+	return nil
+}
+
+// initPlugin creates the SIP003 plugin, if any,
+// and moves the TCP listener to the plugin's local port.
+func (sc *ServerConfig) initPlugin(logger *zap.Logger) error {
+	if sc.Plugin == "" {
+		if sc.PluginOpts != "" {
+			return errors.New("pluginOpts requires plugin")
+		}
+		return nil
+	}
+
+	switch sc.Protocol {
+	case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+	default:
+		return fmt.Errorf("plugin is not supported by protocol %q", sc.Protocol)
+	}
+
+	if len(sc.TCPListeners) != 1 {
+		return fmt.Errorf("plugin requires exactly one TCP listener, got %d", len(sc.TCPListeners))
+	}
+	lnc := &sc.TCPListeners[0]
+
+	host, _, err := net.SplitHostPort(lnc.Address)
+	if err != nil {
+		return err
+	}
+	port, err := listenerPort(lnc.Address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "::"
+	}
+
+	local, err := sip003.LocalAddrPort(lnc.Network)
+	if err != nil {
+		return err
+	}
+
+	sc.plugin = sip003.New(sc.Name, sc.Plugin, sc.PluginOpts, host, port, local.Addr().String(), local.Port(), logger)
+	lnc.Address = local.String()
+	return nil
+}
+
+// listenerPort returns the non-zero port of the listen address.
+func listenerPort(address string) (uint16, error) {
+	_, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port in listen address %q: %w", address, err)
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("listen address %q must have a non-zero port", address)
+	}
+	return uint16(port), nil
+}
+
+// parsePortRange parses a port range like "20000-20010".
+func parsePortRange(s string) (start, end uint16, err error) {
+	startString, endString, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing '-' in port range %q", s)
+	}
+
+	start64, err := strconv.ParseUint(startString, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start port: %w", err)
+	}
+	end64, err := strconv.ParseUint(endString, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end port: %w", err)
+	}
+	if start64 == 0 || start64 > end64 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(start64), uint16(end64), nil
+}
+
+// expandListenAddress expands a listen address with a port range, like "0.0.0.0:20000-20010",
+// into one address for each port in the range. Other addresses are returned as is.
+func expandListenAddress(address string) ([]string, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil || !strings.Contains(portString, "-") {
+		return []string{address}, nil
+	}
+
+	start, end, err := parsePortRange(portString)
+	if err != nil {
+		return nil, fmt.Errorf("bad listen address %q: %w", address, err)
+	}
+
+	addresses := make([]string, 0, int(end)-int(start)+1)
+	for port := int(start); port <= int(end); port++ {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addresses, nil
+}
+
+// expandListenerPortRanges returns the listeners with each listener whose address has a port range
+// replaced by one copy for each port in the range.
+func expandListenerPortRanges[T any](listeners []T, listenerConfig func(*T) *ListenerConfig) ([]T, error) {
+	expanded := make([]T, 0, len(listeners))
+	for i := range listeners {
+		addresses, err := expandListenAddress(listenerConfig(&listeners[i]).Address)
+		if err != nil {
+			return nil, err
+		}
+		for offset, address := range addresses {
+			lnc := listeners[i]
+			listenerConfig(&lnc).Address = address
+			listenerConfig(&lnc).portRangeOffset = offset
+			expanded = append(expanded, lnc)
+		}
+	}
+	return expanded, nil
 }
 
 // UDPRelay creates a UDP relay service from the ServerConfig.
@@ -498,14 +1388,27 @@ func (sc *ServerConfig) UDPRelay(maxClientPackerHeadroom zerocopy.Headroom) (Rel
 
 		s := ss2022.NewUDPServer(uint64(sc.SlidingWindowFilterSize), sc.userCipherConfig, sc.identityCipherConfig, shouldPad)
 		sc.udpCredStore = &s.CredStore
+		sc.ss2022UDPServer = s
 		sessionServer = s
 
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		natServer = ssaead.NewUDPNATServer(sc.aeadCipherConfig)
+
 	default:
 		return nil, fmt.Errorf("invalid protocol: %s", sc.Protocol)
 	}
 
+	if sc.udpObfuscator != nil {
+		switch {
+		case natServer != nil:
+			natServer = obfs.NewUDPNATServer(natServer, sc.udpObfuscator)
+		case sessionServer != nil:
+			sessionServer = obfs.NewUDPSessionServer(sessionServer, sc.udpObfuscator)
+		}
+	}
+
 	switch sc.Protocol {
-	case "direct", "none", "plain", "socks5":
+	case "direct", "none", "plain", "socks5", "aes-256-gcm", "chacha20-ietf-poly1305":
 		serverUnpackerHeadroom = natServer.Info().UnpackerHeadroom
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		info := sessionServer.Info()
@@ -517,22 +1420,43 @@ func (sc *ServerConfig) UDPRelay(maxClientPackerHeadroom zerocopy.Headroom) (Rel
 	packetBufRecvSize := zerocopy.MaxPacketSizeForAddr(sc.MTU, netip.IPv4Unspecified())
 	packetBufSize := packetBufHeadroom.Front + packetBufRecvSize + packetBufHeadroom.Rear
 
-	listeners := make([]udpRelayServerConn, len(sc.UDPListeners))
+	listeners := make([]udpRelayServerConn, 0, len(sc.UDPListeners))
 
-	for i := range listeners {
-		listeners[i], err = sc.UDPListeners[i].Configure(sc.listenConfigCache, minNATTimeout, listenerTransparent)
+	for i := range sc.UDPListeners {
+		var listener udpRelayServerConn
+		lnc := &sc.UDPListeners[i]
+		listener, err = lnc.Configure(sc.listenConfigCache, minNATTimeout, listenerTransparent)
 		if err != nil {
 			return nil, err
 		}
+		listener.acl = sc.clientACL
+		if target := lnc.tunnelRemoteAddress; sc.Protocol == "direct" && !target.Equals(sc.TunnelRemoteAddress) {
+			listener.natServer = direct.NewDirectUDPNATServer(target, sc.TunnelUDPTargetOnly)
+			if sc.udpObfuscator != nil {
+				listener.natServer = obfs.NewUDPNATServer(listener.natServer, sc.udpObfuscator)
+			}
+		}
+		for queue := range lnc.Queues {
+			listeners = append(listeners, lnc.queueListener(listener, sc.listenConfigCache, queue, listenerTransparent))
+		}
 	}
 
+	// Only servers that receive plain UDP packets from clients can tell them
+	// about rejected destinations with ICMP port unreachable messages.
+	var portUnreachable *portUnreachableSender
 	switch sc.Protocol {
-	case "direct", "none", "plain", "socks5":
-		return NewUDPNATRelay(sc.Name, sc.index, sc.MTU, packetBufHeadroom.Front, packetBufRecvSize, packetBufSize, listeners, natServer, sc.collector, sc.router, sc.logger), nil
+	case "direct", "tproxy":
+		portUnreachable = newPortUnreachableSender(sc.logger)
+	}
+
+	switch sc.Protocol {
+	case "direct", "none", "plain", "socks5", "aes-256-gcm", "chacha20-ietf-poly1305":
+		return NewUDPNATRelay(sc.Name, sc.index, sc.MTU, packetBufHeadroom.Front, packetBufRecvSize, packetBufSize, sc.UDPPacketBufferPoolSize, listeners, natServer, sc.MaxUDPSessions, sc.udpSessionLimitPolicy, sc.oversizedPayloadPolicy, sc.natFiltering, sc.outboundTrafficClass, sc.collector, sc.rateLimiter, sc.acceptRampUp, sc.events, sc.router, portUnreachable, sc.connTable, sc.captures, &sc.resources.UDP, sc.logger), nil
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
-		return NewUDPSessionRelay(sc.Name, sc.index, sc.MTU, packetBufHeadroom.Front, packetBufRecvSize, packetBufSize, listeners, sessionServer, sc.collector, sc.router, sc.logger), nil
+		sc.udpSessions = &affinity.Table{}
+		return NewUDPSessionRelay(sc.Name, sc.index, sc.MTU, packetBufHeadroom.Front, packetBufRecvSize, packetBufSize, sc.UDPPacketBufferPoolSize, listeners, sessionServer, sc.MaxUDPSessions, sc.udpSessionLimitPolicy, sc.oversizedPayloadPolicy, sc.natFiltering, sc.outboundTrafficClass, sc.collector, sc.userACL, sc.rateLimiter, sc.acceptRampUp, sc.events, sc.router, sc.udpSessions, sc.connTable, sc.captures, &sc.resources.UDP, sc.logger), nil
 	case "tproxy":
-		return NewUDPTransparentRelay(sc.Name, sc.index, sc.MTU, packetBufHeadroom.Front, packetBufRecvSize, packetBufSize, listeners, transparentConnListenConfig, sc.collector, sc.router, sc.logger)
+		return NewUDPTransparentRelay(sc.Name, sc.index, sc.MTU, packetBufHeadroom.Front, packetBufRecvSize, packetBufSize, sc.UDPPacketBufferPoolSize, listeners, transparentConnListenConfig, sc.MaxUDPSessions, sc.outboundTrafficClass, sc.collector, sc.events, sc.router, portUnreachable, sc.dnsHijack, sc.connTable, sc.captures, &sc.resources.UDP, sc.logger)
 	default:
 		return nil, fmt.Errorf("invalid protocol: %s", sc.Protocol)
 	}
@@ -546,15 +1470,26 @@ func (sc *ServerConfig) PostInit(credman *cred.Manager, apiSM *ssm.ServerManager
 	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
 		if sc.UPSKStorePath != "" {
 			var err error
-			cms, err = credman.RegisterServer(sc.Name, sc.UPSKStorePath, len(sc.PSK), sc.tcpCredStore, sc.udpCredStore)
+			cms, err = credman.RegisterServer(sc.Name, sc.Protocol, sc.UPSKStorePath, sc.identityCipherConfig.IPSK, sc.tcpCredStore, sc.udpCredStore)
 			if err != nil {
 				return err
 			}
+			if len(sc.IdentityPSKs) > 0 {
+				if err = cms.RotateIdentityPSKs(sc.IdentityPSKs); err != nil {
+					return fmt.Errorf("failed to rotate identity PSKs: %w", err)
+				}
+			}
+			cms.SetConnTable(sc.connTable)
+			sc.userACL.SetServer(cms)
+			if sc.WatchUPSKStore {
+				cms.WatchFile()
+			}
+			sc.cms = cms
 		}
 	}
 
 	if apiSM != nil {
-		apiSM.AddServer(sc.Name, cms, sc.collector)
+		apiSM.AddServer(sc.Name, cms, sc.collector, sc.udpSessions, sc.connTable, sc.captures, sc.resources, sc.SIP008Address)
 	}
 
 	return nil
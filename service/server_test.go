@@ -0,0 +1,449 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"go.uber.org/zap"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for _, c := range []struct {
+		s          string
+		start, end uint16
+		ok         bool
+	}{
+		{"20000-20010", 20000, 20010, true},
+		{"443-443", 443, 443, true},
+		{"1-65535", 1, 65535, true},
+		{"20000", 0, 0, false},
+		{"20010-20000", 0, 0, false},
+		{"0-10", 0, 0, false},
+		{"1-65536", 0, 0, false},
+		{"-20000", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		start, end, err := parsePortRange(c.s)
+		if c.ok {
+			if err != nil {
+				t.Errorf("parsePortRange(%q) failed: %v", c.s, err)
+				continue
+			}
+			if start != c.start || end != c.end {
+				t.Errorf("parsePortRange(%q) = %d, %d, expected %d, %d", c.s, start, end, c.start, c.end)
+			}
+		} else if err == nil {
+			t.Errorf("parsePortRange(%q) = %d, %d, expected error", c.s, start, end)
+		}
+	}
+}
+
+func TestListenerPort(t *testing.T) {
+	for _, c := range []struct {
+		address string
+		port    uint16
+		ok      bool
+	}{
+		{"127.0.0.1:443", 443, true},
+		{"[::1]:53", 53, true},
+		{":20000", 20000, true},
+		{":0", 0, false},
+		{":65536", 0, false},
+		{"127.0.0.1", 0, false},
+		{"127.0.0.1:https", 0, false},
+		{"127.0.0.1:20000-20010", 0, false},
+	} {
+		port, err := listenerPort(c.address)
+		if c.ok {
+			if err != nil {
+				t.Errorf("listenerPort(%q) failed: %v", c.address, err)
+				continue
+			}
+			if port != c.port {
+				t.Errorf("listenerPort(%q) = %d, expected %d", c.address, port, c.port)
+			}
+		} else if err == nil {
+			t.Errorf("listenerPort(%q) = %d, expected error", c.address, port)
+		}
+	}
+}
+
+func mustParseAddr(t *testing.T, s string) conn.Addr {
+	t.Helper()
+	addr, err := conn.ParseAddr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestInitTunnelRemoteAddresses(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		listen      []string
+		remote      string
+		remotePorts string
+		byPort      map[uint16]string
+
+		// expected is the target of each listener, or nil if initialization fails.
+		expected []string
+	}{
+		{
+			name:     "Single",
+			listen:   []string{"127.0.0.1:20000", "127.0.0.1:20001"},
+			remote:   "192.0.2.1:53",
+			expected: []string{"192.0.2.1:53", "192.0.2.1:53"},
+		},
+		{
+			name:     "RangeWithoutRemotePorts",
+			listen:   []string{"127.0.0.1:20000-20002"},
+			remote:   "192.0.2.1:53",
+			expected: []string{"192.0.2.1:53", "192.0.2.1:53", "192.0.2.1:53"},
+		},
+		{
+			name:        "RangeToRange",
+			listen:      []string{"127.0.0.1:20000-20002"},
+			remote:      "192.0.2.1:30000",
+			remotePorts: "30010-30012",
+			expected:    []string{"192.0.2.1:30010", "192.0.2.1:30011", "192.0.2.1:30012"},
+		},
+		{
+			name:        "RangeToLargerRange",
+			listen:      []string{"127.0.0.1:20000-20001"},
+			remote:      "example.com:30000",
+			remotePorts: "30000-30009",
+			expected:    []string{"example.com:30000", "example.com:30001"},
+		},
+		{
+			name:        "RangesRestartOffsets",
+			listen:      []string{"127.0.0.1:20000-20001", "[::1]:20100", "[::1]:20200-20201"},
+			remote:      "192.0.2.1:30000",
+			remotePorts: "30000-30001",
+			expected:    []string{"192.0.2.1:30000", "192.0.2.1:30001", "192.0.2.1:30000", "192.0.2.1:30000", "192.0.2.1:30001"},
+		},
+		{
+			name:        "BeyondRemotePorts",
+			listen:      []string{"127.0.0.1:20000-20003"},
+			remote:      "192.0.2.1:30000",
+			remotePorts: "30000-30002",
+		},
+		{
+			name:        "ByPortOverride",
+			listen:      []string{"127.0.0.1:20000-20002"},
+			remote:      "192.0.2.1:30000",
+			remotePorts: "30000-30002",
+			byPort:      map[uint16]string{20001: "198.51.100.1:53"},
+			expected:    []string{"192.0.2.1:30000", "198.51.100.1:53", "192.0.2.1:30002"},
+		},
+		{
+			name:        "ByPortOverrideBeyondRemotePorts",
+			listen:      []string{"127.0.0.1:20000-20002"},
+			remote:      "192.0.2.1:30000",
+			remotePorts: "30000-30001",
+			byPort:      map[uint16]string{20002: "198.51.100.1:53"},
+			expected:    []string{"192.0.2.1:30000", "192.0.2.1:30001", "198.51.100.1:53"},
+		},
+		{
+			name:     "ByPortWithoutRemoteAddress",
+			listen:   []string{"127.0.0.1:20000-20001"},
+			byPort:   map[uint16]string{20000: "198.51.100.1:53", 20001: "[2001:db8::1]:853"},
+			expected: []string{"198.51.100.1:53", "[2001:db8::1]:853"},
+		},
+		{
+			name:   "ByPortWithoutRemoteAddressUnmapped",
+			listen: []string{"127.0.0.1:20000-20002"},
+			byPort: map[uint16]string{20000: "198.51.100.1:53", 20001: "198.51.100.1:853"},
+		},
+		{
+			name:        "RemotePortsWithoutRemoteAddress",
+			listen:      []string{"127.0.0.1:20000"},
+			remotePorts: "30000-30001",
+			byPort:      map[uint16]string{20000: "198.51.100.1:53"},
+		},
+		{
+			name:        "BadRemotePorts",
+			listen:      []string{"127.0.0.1:20000"},
+			remote:      "192.0.2.1:30000",
+			remotePorts: "30000",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sc := ServerConfig{
+				Protocol:          "direct",
+				TunnelRemotePorts: c.remotePorts,
+			}
+			if c.remote != "" {
+				sc.TunnelRemoteAddress = mustParseAddr(t, c.remote)
+			}
+			if c.byPort != nil {
+				sc.TunnelRemoteAddressByPort = make(map[uint16]conn.Addr, len(c.byPort))
+				for port, s := range c.byPort {
+					sc.TunnelRemoteAddressByPort[port] = mustParseAddr(t, s)
+				}
+			}
+			for _, address := range c.listen {
+				sc.TCPListeners = append(sc.TCPListeners, TCPListenerConfig{ListenerConfig: ListenerConfig{Network: "tcp", Address: address}})
+				sc.UDPListeners = append(sc.UDPListeners, UDPListenerConfig{ListenerConfig: ListenerConfig{Network: "udp", Address: address}})
+			}
+
+			var err error
+			sc.TCPListeners, err = expandListenerPortRanges(sc.TCPListeners, func(lnc *TCPListenerConfig) *ListenerConfig {
+				return &lnc.ListenerConfig
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc.UDPListeners, err = expandListenerPortRanges(sc.UDPListeners, func(lnc *UDPListenerConfig) *ListenerConfig {
+				return &lnc.ListenerConfig
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = sc.initTunnelRemoteAddresses()
+			if c.expected == nil {
+				if err == nil {
+					t.Fatal("initTunnelRemoteAddresses() succeeded, expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("initTunnelRemoteAddresses() failed: %v", err)
+			}
+
+			tcpTargets := make([]string, len(sc.TCPListeners))
+			for i := range sc.TCPListeners {
+				tcpTargets[i] = sc.TCPListeners[i].tunnelRemoteAddress.String()
+			}
+			if !slices.Equal(tcpTargets, c.expected) {
+				t.Errorf("TCP listener targets = %v, expected %v", tcpTargets, c.expected)
+			}
+
+			udpTargets := make([]string, len(sc.UDPListeners))
+			for i := range sc.UDPListeners {
+				udpTargets[i] = sc.UDPListeners[i].tunnelRemoteAddress.String()
+			}
+			if !slices.Equal(udpTargets, c.expected) {
+				t.Errorf("UDP listener targets = %v, expected %v", udpTargets, c.expected)
+			}
+		})
+	}
+}
+
+// freePortPair returns a port such that it and the next port are free for both TCP and UDP on localhost.
+func freePortPair(t *testing.T) uint16 {
+	t.Helper()
+
+	for range 64 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).AddrPort().Port()
+		_ = ln.Close()
+		if port == 65535 {
+			continue
+		}
+
+		free := true
+		var closers []io.Closer
+		for _, p := range []uint16{port, port + 1} {
+			address := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), p).String()
+			if ln, err := net.Listen("tcp", address); err == nil {
+				closers = append(closers, ln)
+			} else {
+				free = false
+			}
+			if pc, err := net.ListenPacket("udp", address); err == nil {
+				closers = append(closers, pc)
+			} else {
+				free = false
+			}
+		}
+		for _, c := range closers {
+			_ = c.Close()
+		}
+		if free {
+			return port
+		}
+	}
+
+	t.Fatal("no free port pair found")
+	return 0
+}
+
+// startEchoServers starts a TCP and a UDP echo server on the same port,
+// which prefix echoed data with prefix, and returns their address.
+func startEchoServers(t *testing.T, prefix string) netip.AddrPort {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	addrPort := ln.Addr().(*net.TCPAddr).AddrPort()
+
+	pc, err := net.ListenPacket("udp", addrPort.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 1024)
+				for {
+					n, err := c.Read(b)
+					if err != nil {
+						return
+					}
+					if _, err = c.Write(append([]byte(prefix), b[:n]...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if _, err = pc.WriteTo(append([]byte(prefix), b[:n]...), addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	return addrPort
+}
+
+func TestDirectTunnelPortRangeRelay(t *testing.T) {
+	for _, batchMode := range []string{"", "no"} {
+		t.Run("BatchMode="+batchMode, func(t *testing.T) {
+			testDirectTunnelPortRangeRelay(t, batchMode)
+		})
+	}
+}
+
+func testDirectTunnelPortRangeRelay(t *testing.T, batchMode string) {
+	echoA := startEchoServers(t, "a:")
+	echoB := startEchoServers(t, "b:")
+	port := freePortPair(t)
+	listen := "127.0.0.1:" + strconv.Itoa(int(port)) + "-" + strconv.Itoa(int(port)+1)
+
+	sc := Config{
+		Servers: []ServerConfig{
+			{
+				Name:     "tunnel",
+				Protocol: "direct",
+				MTU:      1500,
+				TCPListeners: []TCPListenerConfig{
+					{ListenerConfig: ListenerConfig{Network: "tcp", Address: listen}},
+				},
+				UDPListeners: []UDPListenerConfig{
+					{
+						ListenerConfig: ListenerConfig{Network: "udp", Address: listen},
+						UDPPerfConfig:  UDPPerfConfig{BatchMode: batchMode},
+					},
+				},
+				TunnelRemoteAddressByPort: map[uint16]conn.Addr{
+					port:     conn.AddrFromIPPort(echoA),
+					port + 1: conn.AddrFromIPPort(echoB),
+				},
+			},
+		},
+	}
+
+	m, err := sc.Manager(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	if err = m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	listenAddrPorts := []netip.AddrPort{
+		netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port),
+		netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port+1),
+	}
+	prefixes := []string{"a:", "b:"}
+
+	for i, listenAddrPort := range listenAddrPorts {
+		c, err := net.Dial("tcp", listenAddrPort.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = c.SetDeadline(deadline); err != nil {
+			t.Fatal(err)
+		}
+
+		payload := []byte("hello over tcp")
+		if _, err = c.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		expected := append([]byte(prefixes[i]), payload...)
+		b := make([]byte, len(expected))
+		if _, err = io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, expected) {
+			t.Errorf("TCP via %s got %q, expected %q", listenAddrPort, b, expected)
+		}
+	}
+
+	// The same client socket talks to both listeners, which must not share a NAT session.
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if err = uc.SetDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1024)
+	for range 2 {
+		for i, listenAddrPort := range listenAddrPorts {
+			payload := []byte("hello over udp")
+			if _, err = uc.WriteToUDPAddrPort(payload, listenAddrPort); err != nil {
+				t.Fatal(err)
+			}
+			n, from, err := uc.ReadFromUDPAddrPort(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from != listenAddrPort {
+				t.Errorf("UDP reply from %s, expected %s", from, listenAddrPort)
+			}
+			if expected := append([]byte(prefixes[i]), payload...); !bytes.Equal(b[:n], expected) {
+				t.Errorf("UDP via %s got %q, expected %q", listenAddrPort, b[:n], expected)
+			}
+		}
+	}
+}
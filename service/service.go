@@ -4,12 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/api"
+	"github.com/database64128/shadowsocks-go/api/configs"
+	"github.com/database64128/shadowsocks-go/api/ssm"
+	"github.com/database64128/shadowsocks-go/clientgroup"
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/cred"
 	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/logging"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/ss2022"
 	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
@@ -38,17 +50,205 @@ type Config struct {
 	DNS     []dns.ResolverConfig `json:"dns"`
 	Router  router.Config        `json:"router"`
 	Stats   stats.Config         `json:"stats"`
+	Events  event.Config         `json:"events"`
 	API     api.Config           `json:"api"`
+
+	// Log configures the sinks that operational logs are written to.
+	// If it has no sinks, logs are written as configured by the command line flags.
+	Log logging.Config `json:"log"`
+
+	// Hosts maps domain names to IP addresses.
+	// All DNS resolvers answer mapped names from it without querying upstream servers,
+	// and the router uses it to match domain targets to IP rules.
+	Hosts dns.HostsConfig `json:"hosts"`
+
+	// GOMAXPROCS is the maximum number of CPUs executing Go code simultaneously.
+	//
+	// The Go runtime schedules all services of a process on the same CPUs,
+	// so partition services across NUMA nodes by running one process per node,
+	// with its CPU affinity set to the node (e.g. with numactl) and GOMAXPROCS
+	// set to the node's number of CPUs.
+	//
+	// If zero, the Go runtime default is used.
+	GOMAXPROCS int `json:"gomaxprocs"`
+
+	// DrainTimeout is how long to wait on shutdown for existing TCP connections and UDP sessions
+	// to finish, after servers stop accepting new ones. The remaining ones are then closed.
+	//
+	// If zero, they are closed immediately.
+	DrainTimeout jsonhelper.Duration `json:"drainTimeout"`
+}
+
+// configSections returns the servers, clients, DNS resolvers, hosts and router of the configuration
+// as sections in normalized JSON.
+func (sc *Config) configSections() ([]configs.Section, error) {
+	sections := make([]configs.Section, 0, len(sc.Servers)+len(sc.Clients)+len(sc.DNS)+2)
+
+	for i := range sc.Servers {
+		s, err := configs.NewSection("server", sc.Servers[i].Name, &sc.Servers[i])
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", sc.Servers[i].Name, err)
+		}
+		sections = append(sections, s)
+	}
+
+	for i := range sc.Clients {
+		s, err := configs.NewSection("client", sc.Clients[i].Name, &sc.Clients[i])
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %w", sc.Clients[i].Name, err)
+		}
+		sections = append(sections, s)
+	}
+
+	for i := range sc.DNS {
+		s, err := configs.NewSection("dns", sc.DNS[i].Name, &sc.DNS[i])
+		if err != nil {
+			return nil, fmt.Errorf("DNS resolver %s: %w", sc.DNS[i].Name, err)
+		}
+		sections = append(sections, s)
+	}
+
+	if len(sc.Hosts) != 0 {
+		s, err := configs.NewSection("hosts", "", sc.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("hosts: %w", err)
+		}
+		sections = append(sections, s)
+	}
+
+	s, err := configs.NewSection("router", "", &sc.Router)
+	if err != nil {
+		return nil, fmt.Errorf("router: %w", err)
+	}
+	return append(sections, s), nil
 }
 
 // Manager initializes the service manager.
 //
-// Initialization order: clients -> DNS -> router -> servers
+// Initialization order: clients -> client groups -> DNS -> router -> internal clients -> servers
 func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 	if len(sc.Servers) == 0 {
 		return nil, errors.New("no services to start")
 	}
 
+	switch {
+	case sc.GOMAXPROCS > 0:
+		runtime.GOMAXPROCS(sc.GOMAXPROCS)
+	case sc.GOMAXPROCS < 0:
+		return nil, fmt.Errorf("negative GOMAXPROCS: %d", sc.GOMAXPROCS)
+	}
+
+	if sc.DrainTimeout < 0 {
+		return nil, fmt.Errorf("negative drain timeout: %s", sc.DrainTimeout.Value())
+	}
+
+	sc.setDefaultClients()
+
+	// Capture the configuration before initialization fills in defaults.
+	sections, err := sc.configSections()
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize configuration: %w", err)
+	}
+	routerConfig := sc.Router
+	restartSection, err := sc.restartSection()
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize configuration: %w", err)
+	}
+
+	listenConfigCache := conn.NewListenConfigCache()
+	dialerCache := conn.NewDialerCache()
+	serverIndexByName := make(map[string]int, len(sc.Servers))
+
+	for i := range sc.Servers {
+		serverIndexByName[sc.Servers[i].Name] = i
+	}
+
+	cs, err := sc.clientSide(listenConfigCache, dialerCache, logger, serverIndexByName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cs.bindInternalClients(cs.router, serverIndexByName); err != nil {
+		return nil, err
+	}
+
+	bus, webhooks, err := sc.Events.Bus(logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create event bus: %w", err)
+	}
+
+	accessLog, err := sc.Events.AccessLog.AccessLog(bus, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access log: %w", err)
+	}
+
+	var apiSections []configs.Section
+	if sc.API.Enabled {
+		apiSections = sections
+	}
+
+	credman := cred.NewManager(bus, logger)
+	apiServer, apiSM, err := sc.API.Server(logger, bus, cs.router, cs.groupStatusReporters, apiSections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API server: %w", err)
+	}
+
+	services := make([]Relay, 0, 3+len(webhooks))
+	services = append(services, credman)
+	if apiServer != nil {
+		services = append(services, apiServer)
+	}
+	for _, w := range webhooks {
+		services = append(services, w)
+	}
+	if accessLog != nil {
+		services = append(services, accessLog)
+	}
+
+	m := Manager{
+		services:                services,
+		clientServices:          cs.services,
+		servers:                 make([]*serverServices, len(sc.Servers)),
+		nextServerIndex:         len(sc.Servers),
+		sectionHashes:           sectionHashes(sections),
+		restartHash:             restartSection.Hash,
+		listenConfigCache:       listenConfigCache,
+		dialerCache:             dialerCache,
+		statsConfig:             sc.Stats,
+		bus:                     bus,
+		credman:                 credman,
+		apiServer:               apiServer,
+		apiSM:                   apiSM,
+		router:                  cs.router,
+		maxClientPackerHeadroom: cs.maxClientPackerHeadroom,
+		drainTimeout:            sc.DrainTimeout.Value(),
+		logger:                  logger,
+		routerConfig:            routerConfig,
+	}
+
+	m.router.SetRoutesChangedFunc(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.updateRouterSection()
+	})
+
+	for i := range sc.Servers {
+		serverConfig := &sc.Servers[i]
+		s, err := m.initServer(serverConfig, i, m.sectionHashes[sectionKey{"server", serverConfig.Name}])
+		if err != nil {
+			return nil, err
+		}
+		if err = m.postInitServer(s); err != nil {
+			return nil, err
+		}
+		m.servers[i] = s
+	}
+
+	return &m, nil
+}
+
+// setDefaultClients adds a direct client if the configuration has no clients.
+func (sc *Config) setDefaultClients() {
 	if len(sc.Clients) == 0 {
 		sc.Clients = []ClientConfig{
 			{
@@ -62,12 +262,28 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 			},
 		}
 	}
+}
 
-	listenConfigCache := conn.NewListenConfigCache()
-	dialerCache := conn.NewDialerCache()
+// clientSide contains the clients, DNS resolvers and router created from a configuration.
+type clientSide struct {
+	router                  *router.Router
+	internalTCPClients      []*internalTCPClient
+	groupStatusReporters    []clientgroup.StatusReporter
+	maxClientPackerHeadroom zerocopy.Headroom
+
+	// services are the background services of client groups and DNS resolvers.
+	services []Relay
+}
+
+// clientSide creates the clients, client groups, DNS resolvers, hosts and router.
+// Internal clients must be bound before use.
+func (sc *Config) clientSide(listenConfigCache conn.ListenConfigCache, dialerCache conn.DialerCache, logger *zap.Logger, serverIndexByName map[string]int) (*clientSide, error) {
 	tcpClientMap := make(map[string]zerocopy.TCPClient, len(sc.Clients))
 	udpClientMap := make(map[string]zerocopy.UDPClient, len(sc.Clients))
-	var maxClientPackerHeadroom zerocopy.Headroom
+	var (
+		cs           clientSide
+		groupConfigs []*ClientConfig
+	)
 
 	for i := range sc.Clients {
 		clientConfig := &sc.Clients[i]
@@ -76,11 +292,23 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 			return nil, fmt.Errorf("failed to initialize client %s: %w", clientName, err)
 		}
 
+		// Groups are created after all their potential members.
+		if clientConfig.isGroup() {
+			groupConfigs = append(groupConfigs, clientConfig)
+			continue
+		}
+
 		tcpClient, err := clientConfig.TCPClient()
 		switch err {
 		case errNetworkDisabled:
 		case nil:
 			tcpClientMap[clientName] = tcpClient
+			if c, ok := tcpClient.(*internalTCPClient); ok {
+				cs.internalTCPClients = append(cs.internalTCPClients, c)
+			}
+			if clientConfig.plugin != nil {
+				cs.services = append(cs.services, clientConfig.plugin)
+			}
 		default:
 			return nil, fmt.Errorf("failed to create TCP client for %s: %w", clientName, err)
 		}
@@ -90,91 +318,236 @@ func (sc *Config) Manager(logger *zap.Logger) (*Manager, error) {
 		case errNetworkDisabled:
 		case nil:
 			udpClientMap[clientName] = udpClient
-			maxClientPackerHeadroom = zerocopy.MaxHeadroom(maxClientPackerHeadroom, udpClient.Info().PackerHeadroom)
+			cs.maxClientPackerHeadroom = zerocopy.MaxHeadroom(cs.maxClientPackerHeadroom, udpClient.Info().PackerHeadroom)
 		default:
 			return nil, fmt.Errorf("failed to create UDP client for %s: %w", clientName, err)
 		}
+
+		if c := clientConfig.onlineConfig; c != nil {
+			cs.groupStatusReporters = append(cs.groupStatusReporters, c)
+			cs.services = append(cs.services, c)
+		}
+	}
+
+	groups := make([]clientGroup, len(groupConfigs))
+	for i, clientConfig := range groupConfigs {
+		g, err := clientConfig.clientGroup(tcpClientMap, udpClientMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client group %s: %w", clientConfig.Name, err)
+		}
+		groups[i] = g
+		if g.status != nil {
+			cs.groupStatusReporters = append(cs.groupStatusReporters, g.status)
+		}
+		if g.service != nil {
+			cs.services = append(cs.services, g.service)
+		}
+	}
+
+	// Add groups to the client maps only after all groups are created,
+	// so that groups cannot be members of other groups.
+	for i, g := range groups {
+		clientName := groupConfigs[i].Name
+		if g.tcpClient != nil {
+			tcpClientMap[clientName] = g.tcpClient
+		}
+		if g.udpClient != nil {
+			udpClientMap[clientName] = g.udpClient
+			cs.maxClientPackerHeadroom = zerocopy.MaxHeadroom(cs.maxClientPackerHeadroom, g.udpClient.Info().PackerHeadroom)
+		}
+	}
+
+	// Dialers are bound after all clients and groups are created, so that any of them can be a dialer.
+	for i := range sc.Clients {
+		if c := sc.Clients[i].chain; c != nil {
+			if err := c.bind(tcpClientMap); err != nil {
+				return nil, fmt.Errorf("failed to bind dialer for client %s: %w", sc.Clients[i].Name, err)
+			}
+		}
 	}
 
 	resolvers := make([]dns.SimpleResolver, len(sc.DNS))
 	resolverMap := make(map[string]dns.SimpleResolver, len(sc.DNS))
 
+	hosts, err := sc.Hosts.Hosts(logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hosts: %w", err)
+	}
+
 	for i := range sc.DNS {
-		resolver, err := sc.DNS[i].SimpleResolver(tcpClientMap, udpClientMap, logger)
+		resolver, err := sc.DNS[i].SimpleResolver(tcpClientMap, udpClientMap, resolverMap, logger)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create DNS resolver %s: %w", sc.DNS[i].Name, err)
 		}
 
+		cacheSaver, err := sc.DNS[i].CacheSaver(resolver, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DNS cache saver for %s: %w", sc.DNS[i].Name, err)
+		}
+		if cacheSaver != nil {
+			cs.services = append(cs.services, cacheSaver)
+		}
+
+		if hosts != nil {
+			resolver = hosts.Wrap(resolver)
+		}
+
 		resolvers[i] = resolver
 		resolverMap[sc.DNS[i].Name] = resolver
 	}
 
-	serverIndexByName := make(map[string]int, len(sc.Servers))
-
-	for i := range sc.Servers {
-		serverIndexByName[sc.Servers[i].Name] = i
+	// Without resolvers, the router still resolves mapped names.
+	if hosts != nil && len(resolvers) == 0 {
+		resolvers = append(resolvers, hosts)
 	}
 
-	router, err := sc.Router.Router(logger, resolvers, resolverMap, tcpClientMap, udpClientMap, serverIndexByName)
+	cs.router, err = sc.Router.Router(logger, resolvers, resolverMap, tcpClientMap, udpClientMap, serverIndexByName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create router: %w", err)
 	}
 
-	credman := cred.NewManager(logger)
-	apiServer, apiSM, err := sc.API.Server(logger)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create API server: %w", err)
+	return &cs, nil
+}
+
+// bindInternalClients binds the internal clients to the router.
+func (cs *clientSide) bindInternalClients(r *router.Router, serverIndexByName map[string]int) error {
+	for _, c := range cs.internalTCPClients {
+		if err := c.bind(r, serverIndexByName); err != nil {
+			return fmt.Errorf("failed to bind internal client %s: %w", c.name, err)
+		}
 	}
+	return nil
+}
 
-	services := make([]Relay, 0, 2+2*len(sc.Servers))
-	services = append(services, credman)
-	if apiServer != nil {
-		services = append(services, apiServer)
+// Manager manages the services.
+type Manager struct {
+	// services are the services that live as long as the manager:
+	// the credential manager, the API server, event webhooks and the access log.
+	services []Relay
+
+	// clientServices are the background services of client groups and DNS resolvers.
+	clientServices []Relay
+
+	servers         []*serverServices
+	nextServerIndex int
+	sectionHashes   map[sectionKey]string
+	restartHash     string
+
+	listenConfigCache       conn.ListenConfigCache
+	dialerCache             conn.DialerCache
+	statsConfig             stats.Config
+	bus                     *event.Bus
+	credman                 *cred.Manager
+	apiServer               *api.Server
+	apiSM                   *ssm.ServerManager
+	router                  *router.Router
+	maxClientPackerHeadroom zerocopy.Headroom
+	drainTimeout            time.Duration
+	logger                  *zap.Logger
+
+	// routerConfig is the router section of the configuration.
+	// The configuration API serves it with the routes changed at runtime.
+	routerConfig router.Config
+
+	// mu serializes starting, stopping and reloading.
+	mu sync.Mutex
+
+	// ctx is the context the services were started with.
+	ctx context.Context
+}
+
+// serverServices contains the relay services of a server.
+type serverServices struct {
+	config    *ServerConfig
+	index     int
+	hash      string
+	collector stats.Collector
+	services  []Relay
+}
+
+// initServer initializes the server and creates its relay services.
+func (m *Manager) initServer(serverConfig *ServerConfig, index int, hash string) (*serverServices, error) {
+	collector := m.statsConfig.Collector()
+	if err := serverConfig.Initialize(m.listenConfigCache, collector, m.bus, m.router, m.logger, index); err != nil {
+		return nil, fmt.Errorf("failed to initialize server %s: %w", serverConfig.Name, err)
 	}
 
-	for i := range sc.Servers {
-		serverConfig := &sc.Servers[i]
-		collector := sc.Stats.Collector()
-		if err := serverConfig.Initialize(listenConfigCache, collector, router, logger, i); err != nil {
-			return nil, fmt.Errorf("failed to initialize server %s: %w", serverConfig.Name, err)
-		}
+	s := serverServices{
+		config:    serverConfig,
+		index:     index,
+		hash:      hash,
+		collector: collector,
+	}
 
-		tcpRelay, err := serverConfig.TCPRelay()
-		switch err {
-		case errNetworkDisabled:
-		case nil:
-			services = append(services, tcpRelay)
-		default:
-			return nil, fmt.Errorf("failed to create TCP relay service for %s: %w", serverConfig.Name, err)
+	tcpRelay, err := serverConfig.TCPRelay()
+	switch err {
+	case errNetworkDisabled:
+	case nil:
+		s.services = append(s.services, tcpRelay)
+		if serverConfig.plugin != nil {
+			s.services = append(s.services, serverConfig.plugin)
 		}
-
-		udpRelay, err := serverConfig.UDPRelay(maxClientPackerHeadroom)
-		switch err {
-		case errNetworkDisabled:
-		case nil:
-			services = append(services, udpRelay)
-		default:
-			return nil, fmt.Errorf("failed to create UDP relay service for %s: %w", serverConfig.Name, err)
+		if serverConfig.winDivertRedirector != nil {
+			s.services = append(s.services, serverConfig.winDivertRedirector)
 		}
+	default:
+		return nil, fmt.Errorf("failed to create TCP relay service for %s: %w", serverConfig.Name, err)
+	}
 
-		if err = serverConfig.PostInit(credman, apiSM); err != nil {
-			return nil, fmt.Errorf("failed to post-initialize server %s: %w", serverConfig.Name, err)
-		}
+	udpRelay, err := serverConfig.UDPRelay(m.maxClientPackerHeadroom)
+	switch err {
+	case errNetworkDisabled:
+	case nil:
+		s.services = append(s.services, udpRelay)
+	default:
+		return nil, fmt.Errorf("failed to create UDP relay service for %s: %w", serverConfig.Name, err)
 	}
 
-	return &Manager{services, router, logger}, nil
+	replayStateSaver, err := serverConfig.replayStateSaver()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replay state saver for %s: %w", serverConfig.Name, err)
+	}
+	if replayStateSaver != nil {
+		s.services = append(s.services, replayStateSaver)
+	}
+
+	if saltFilter := serverConfig.redisSaltFilter(); saltFilter != nil {
+		s.services = append(s.services, saltFilter)
+	}
+
+	if serverConfig.captures != nil {
+		s.services = append(s.services, serverConfig.captures)
+	}
+
+	return &s, nil
 }
 
-// Manager manages the services.
-type Manager struct {
-	services []Relay
-	router   *router.Router
-	logger   *zap.Logger
+// postInitServer registers the server to the credential manager and the API,
+// and creates its traffic statistics checkpointer.
+func (m *Manager) postInitServer(s *serverServices) error {
+	serverConfig := s.config
+	if err := serverConfig.PostInit(m.credman, m.apiSM); err != nil {
+		return fmt.Errorf("failed to post-initialize server %s: %w", serverConfig.Name, err)
+	}
+
+	checkpointer, err := m.statsConfig.Checkpointer(serverConfig.Name, s.collector, m.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create traffic statistics checkpointer for %s: %w", serverConfig.Name, err)
+	}
+	if checkpointer != nil {
+		s.services = append(s.services, checkpointer)
+	}
+	return nil
 }
 
 // Start starts all configured services.
 func (m *Manager) Start(ctx context.Context) error {
-	for _, s := range m.services {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ctx = ctx
+
+	for _, s := range m.allServices() {
 		if err := s.Start(ctx); err != nil {
 			return fmt.Errorf("failed to start %s: %w", s.String(), err)
 		}
@@ -183,21 +556,94 @@ func (m *Manager) Start(ctx context.Context) error {
 }
 
 // Stop stops all running services.
+//
+// Relay services are drained first, all at once, for up to the drain timeout.
+// Then the other services are stopped in reverse start order.
 func (m *Manager) Stop() {
-	for _, s := range m.services {
-		if err := s.Stop(); err != nil {
-			m.logger.Warn("Failed to stop service",
-				zap.Stringer("service", s),
-				zap.Error(err),
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.drainTimeout)
+	defer cancel()
+
+	services := m.allServices()
+	var (
+		wg     sync.WaitGroup
+		closed atomic.Int64
+	)
+
+	for _, s := range services {
+		d, ok := s.(Drainer)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := d.Drain(ctx)
+			if err != nil {
+				m.logger.Warn("Failed to stop service",
+					zap.Stringer("service", d),
+					zap.Error(err),
+				)
+			}
+			m.logger.Info("Stopped service",
+				zap.Stringer("service", d),
+				zap.Int("closed", n),
 			)
+			closed.Add(int64(n))
+		}()
+	}
+
+	wg.Wait()
+
+	// Without a drain timeout, closing active connections and sessions is expected.
+	if n := closed.Load(); n > 0 && m.drainTimeout > 0 {
+		m.logger.Warn("Closed connections and sessions still active after the drain timeout",
+			zap.Duration("drainTimeout", m.drainTimeout),
+			zap.Int64("closed", n),
+		)
+	}
+
+	for _, s := range slices.Backward(services) {
+		if _, ok := s.(Drainer); !ok {
+			m.stopService(s)
 		}
-		m.logger.Info("Stopped service", zap.Stringer("service", s))
 	}
 }
 
+// allServices returns all services in start order.
+func (m *Manager) allServices() []Relay {
+	services := slices.Concat(m.services, m.clientServices)
+	for _, s := range m.servers {
+		services = append(services, s.services...)
+	}
+	return services
+}
+
+// stopService stops the service and logs the result.
+func (m *Manager) stopService(s Relay) {
+	if err := s.Stop(); err != nil {
+		m.logger.Warn("Failed to stop service",
+			zap.Stringer("service", s),
+			zap.Error(err),
+		)
+	}
+	m.logger.Info("Stopped service", zap.Stringer("service", s))
+}
+
 // Close closes the manager.
 func (m *Manager) Close() {
 	if err := m.router.Close(); err != nil {
 		m.logger.Warn("Failed to close router", zap.Error(err))
 	}
 }
+
+// rejectionKindOf returns [stats.RejectionKindReplay] if err is caused by a detected replay,
+// or kind otherwise.
+func rejectionKindOf(kind stats.RejectionKind, err error) stats.RejectionKind {
+	if errors.Is(err, ss2022.ErrReplay) || errors.Is(err, ss2022.ErrRepeatedSalt) {
+		return stats.RejectionKindReplay
+	}
+	return kind
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/sip002"
+	"github.com/database64128/shadowsocks-go/ss2022"
+)
+
+// ClientConfigFromSIP002 returns the configuration of a client that connects to the server in the SIP002 URL,
+// with TCP and UDP enabled.
+//
+// The client is named after the URL fragment, or the server address if the fragment is empty.
+func ClientConfigFromSIP002(u sip002.URL) (ClientConfig, error) {
+	endpoint, err := conn.AddrFromHostPort(u.Host, u.Port)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+
+	cc := ClientConfig{
+		Name:       u.Name,
+		Protocol:   u.Method,
+		Endpoint:   endpoint,
+		EnableTCP:  true,
+		EnableUDP:  true,
+		MTU:        1500,
+		Plugin:     u.Plugin,
+		PluginOpts: u.PluginOpts,
+	}
+	if cc.Name == "" {
+		cc.Name = endpoint.String()
+	}
+
+	switch u.Method {
+	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		psks, err := u.PSKs()
+		if err != nil {
+			return ClientConfig{}, err
+		}
+		cc.PSK = psks[len(psks)-1]
+		if len(psks) > 1 {
+			cc.IPSKs = psks[:len(psks)-1]
+		}
+		if err = ss2022.CheckPSKLength(u.Method, cc.PSK, cc.IPSKs); err != nil {
+			return ClientConfig{}, err
+		}
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		if u.Password == "" {
+			return ClientConfig{}, errors.New("missing password")
+		}
+		cc.Password = u.Password
+	case "none", "plain":
+	default:
+		return ClientConfig{}, fmt.Errorf("unsupported method: %q", u.Method)
+	}
+
+	return cc, nil
+}
+
+// SIP002URLs returns SIP002 URLs for connecting to the Shadowsocks servers in the config.
+// Servers of other protocols are skipped.
+//
+// The URLs point to host, or the listen address of each server if host is empty.
+// Each URL is named after the server, except that multi-user Shadowsocks 2022 servers
+// have one URL for each user in the uPSK store, named after the user.
+//
+// Only options with a SIP002 equivalent are included. Plugin options are copied as is,
+// and may need to be changed for clients.
+func (sc *Config) SIP002URLs(host string) ([]sip002.URL, error) {
+	var urls []sip002.URL
+	for i := range sc.Servers {
+		serverConfig := &sc.Servers[i]
+		serverURLs, err := serverConfig.sip002URLs(host)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %w", serverConfig.Name, err)
+		}
+		urls = append(urls, serverURLs...)
+	}
+	return urls, nil
+}
+
+// sip002URLs returns the SIP002 URLs of the server, or nil if it is not a Shadowsocks server.
+func (sc *ServerConfig) sip002URLs(host string) ([]sip002.URL, error) {
+	switch sc.Protocol {
+	case "none", "plain", "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "aes-256-gcm", "chacha20-ietf-poly1305":
+	default:
+		return nil, nil
+	}
+
+	listenHost, port, err := sc.sip002HostPort()
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		if ip, err := netip.ParseAddr(listenHost); listenHost == "" || err == nil && ip.IsUnspecified() {
+			return nil, fmt.Errorf("server listens on unspecified address %q, host is required", listenHost)
+		}
+		host = listenHost
+	}
+
+	u := sip002.URL{
+		Method: sc.Protocol,
+		Host:   host,
+		Port:   port,
+		Name:   sc.Name,
+	}
+	if sc.Plugin != "" {
+		u.Plugin = filepath.Base(sc.Plugin)
+		u.PluginOpts = sc.PluginOpts
+	}
+
+	switch sc.Protocol {
+	case "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm":
+		if sc.UPSKStorePath != "" {
+			return sc.sip002UserURLs(u)
+		}
+		u.Password = base64.StdEncoding.EncodeToString(sc.PSK)
+	case "aes-256-gcm", "chacha20-ietf-poly1305":
+		u.Password = sc.Password
+	}
+
+	return []sip002.URL{u}, nil
+}
+
+// sip002HostPort returns the host and port of the server's first listener.
+func (sc *ServerConfig) sip002HostPort() (string, uint16, error) {
+	var address string
+	switch {
+	case sc.Listen != "" && (sc.EnableTCP || sc.EnableUDP):
+		address = sc.Listen
+	case len(sc.TCPListeners) > 0:
+		address = sc.TCPListeners[0].Address
+	case len(sc.UDPListeners) > 0:
+		address = sc.UDPListeners[0].Address
+	default:
+		return "", 0, errors.New("no listeners")
+	}
+
+	addresses, err := expandListenAddress(address)
+	if err != nil {
+		return "", 0, err
+	}
+	host, _, err := net.SplitHostPort(addresses[0])
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := listenerPort(addresses[0])
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// sip002UserURLs returns a copy of u for each user in the server's uPSK store, sorted by username.
+func (sc *ServerConfig) sip002UserURLs(u sip002.URL) ([]sip002.URL, error) {
+	iPSK := sc.PSK
+	if len(sc.IdentityPSKs) > 0 {
+		// Like the credential manager, prefer the newest valid identity PSK, which lasts the longest.
+		var preferred *ss2022.ScheduledPSK
+		now := time.Now()
+		for i := range sc.IdentityPSKs {
+			p := &sc.IdentityPSKs[i]
+			if p.ValidAt(now) && (preferred == nil || p.NotBefore.After(preferred.NotBefore)) {
+				preferred = p
+			}
+		}
+		if preferred == nil {
+			return nil, errors.New("no identity PSK is valid now")
+		}
+		iPSK = preferred.PSK
+	}
+
+	data, err := os.ReadFile(sc.UPSKStorePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uPSK store: %w", err)
+	}
+	ucs, err := cred.UsersFromUPSKMap(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load uPSK store: %w", err)
+	}
+	slices.SortFunc(ucs, func(a, b cred.UserCredential) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	b64iPSK := base64.StdEncoding.EncodeToString(iPSK)
+	urls := make([]sip002.URL, len(ucs))
+	for i, uc := range ucs {
+		uu := u
+		uu.Password = b64iPSK + ":" + base64.StdEncoding.EncodeToString(uc.UPSK)
+		uu.Name = uc.Name
+		urls[i] = uu
+	}
+	return urls, nil
+}
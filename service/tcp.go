@@ -5,14 +5,26 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/cred"
 	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/proxyproto"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
 	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/uot"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
@@ -20,18 +32,30 @@ import (
 const (
 	defaultInitialPayloadWaitBufferSize = 1440
 	defaultInitialPayloadWaitTimeout    = 250 * time.Millisecond
+	defaultHandshakeTimeout             = 30 * time.Second
 )
 
+var errTCPConnLimit = errors.New("too many concurrent TCP connections")
+
 // tcpRelayListener configures the TCP listener for a relay service.
 type tcpRelayListener struct {
 	logger                       *zap.Logger
 	listener                     *net.TCPListener
 	listenConfig                 conn.ListenConfig
+	proxyProtocol                bool
+	handshakeTimeout             time.Duration
+	countUrgentData              bool
 	waitForInitialPayload        bool
 	initialPayloadWaitTimeout    time.Duration
 	initialPayloadWaitBufferSize int
 	network                      string
 	address                      string
+	listenAddrPort               netip.AddrPort
+	acl                          *clientACL
+
+	// server, if not nil, overrides the relay's server for connections accepted by this listener,
+	// like simple tunnels forwarding each port to a different target.
+	server zerocopy.TCPServer
 }
 
 // TCPRelay is a relay service for TCP traffic.
@@ -45,11 +69,27 @@ type TCPRelay struct {
 	serverName      string
 	listeners       []tcpRelayListener
 	acceptWg        sync.WaitGroup
+	connWg          sync.WaitGroup
+	activeConns     atomic.Int64
+	cancelConns     context.CancelFunc
 	server          zerocopy.TCPServer
 	connCloser      zerocopy.TCPConnCloser
 	fallbackAddress conn.Addr
+	udpOverTCP      bool
+	trafficClass    int
+	sockmap         *conn.Sockmap
+	maxConns        int64
+	conns           atomic.Int64
 	collector       stats.Collector
+	userACL         *cred.ACLChecker
+	rateLimiter     *ratelimit.Limiter
+	acceptRampUp    *ratelimit.RampUp
+	events          *event.Bus
 	router          *router.Router
+	dnsHijack       *dnsHijacker
+	connTable       *conntrack.Table
+	captures        *capture.Server
+	resources       *resource.Counter
 	logger          *zap.Logger
 }
 
@@ -60,8 +100,20 @@ func NewTCPRelay(
 	server zerocopy.TCPServer,
 	connCloser zerocopy.TCPConnCloser,
 	fallbackAddress conn.Addr,
+	udpOverTCP bool,
+	trafficClass int,
+	sockmap *conn.Sockmap,
+	maxConns int,
 	collector stats.Collector,
+	userACL *cred.ACLChecker,
+	rateLimiter *ratelimit.Limiter,
+	acceptRampUp *ratelimit.RampUp,
+	events *event.Bus,
 	router *router.Router,
+	dnsHijack *dnsHijacker,
+	connTable *conntrack.Table,
+	captures *capture.Server,
+	resources *resource.Counter,
 	logger *zap.Logger,
 ) *TCPRelay {
 	return &TCPRelay{
@@ -71,8 +123,20 @@ func NewTCPRelay(
 		server:          server,
 		connCloser:      connCloser,
 		fallbackAddress: fallbackAddress,
+		udpOverTCP:      udpOverTCP,
+		trafficClass:    trafficClass,
+		sockmap:         sockmap,
+		maxConns:        int64(maxConns),
 		collector:       collector,
+		userACL:         userACL,
+		rateLimiter:     rateLimiter,
+		acceptRampUp:    acceptRampUp,
+		events:          events,
 		router:          router,
+		dnsHijack:       dnsHijack,
+		connTable:       connTable,
+		captures:        captures,
+		resources:       resources,
 		logger:          logger,
 	}
 }
@@ -84,6 +148,10 @@ func (s *TCPRelay) String() string {
 
 // Start implements the Service Start method.
 func (s *TCPRelay) Start(ctx context.Context) error {
+	// Connections outlive ctx until the relay service is stopped, so they can be drained.
+	connCtx, cancelConns := context.WithCancel(context.WithoutCancel(ctx))
+	s.cancelConns = cancelConns
+
 	for i := range s.listeners {
 		index := i
 		lnc := &s.listeners[index]
@@ -93,7 +161,9 @@ func (s *TCPRelay) Start(ctx context.Context) error {
 			return err
 		}
 		lnc.listener = l
+		s.resources.AddFDs(1)
 		lnc.address = l.Addr().String()
+		lnc.listenAddrPort = l.Addr().(*net.TCPAddr).AddrPort()
 		lnc.logger = s.logger.With(
 			zap.String("server", s.serverName),
 			zap.Int("listener", index),
@@ -102,8 +172,11 @@ func (s *TCPRelay) Start(ctx context.Context) error {
 
 		s.acceptWg.Add(1)
 
-		go func() {
+		s.resources.Go(func() {
 			for {
+				// Leave connections over the ramp-up rate in the listen backlog.
+				s.acceptRampUp.Wait()
+
 				clientConn, err := lnc.listener.AcceptTCP()
 				if err != nil {
 					if errors.Is(err, os.ErrDeadlineExceeded) {
@@ -113,11 +186,26 @@ func (s *TCPRelay) Start(ctx context.Context) error {
 					continue
 				}
 
-				go s.handleConn(ctx, lnc, clientConn)
+				if clientAddrPort := clientConn.RemoteAddr().(*net.TCPAddr).AddrPort(); !lnc.acl.Allowed(clientAddrPort.Addr()) {
+					if ce := lnc.logger.Check(zap.DebugLevel, "Rejecting TCP connection denied by ACL"); ce != nil {
+						ce.Write(
+							zap.Stringer("clientAddress", clientAddrPort),
+						)
+					}
+					s.collector.CollectRejection(stats.RejectionKindACL, "tcp", clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+					clientConn.Close()
+					continue
+				}
+
+				s.connWg.Add(1)
+				s.resources.Go(func() {
+					s.handleConn(connCtx, lnc, clientConn)
+					s.connWg.Done()
+				})
 			}
 
 			s.acceptWg.Done()
-		}()
+		})
 
 		lnc.logger.Info("Started TCP relay service listener")
 	}
@@ -126,12 +214,113 @@ func (s *TCPRelay) Start(ctx context.Context) error {
 
 // handleConn handles an accepted TCP connection.
 func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, clientConn *net.TCPConn) {
+	// clientConn is closed before handleConn returns.
+	s.resources.AddFDs(1)
+	defer s.resources.AddFDs(-1)
+
+	s.activeConns.Add(1)
+	defer s.activeConns.Add(-1)
+
+	// Closing the connections of the relay service unblocks the handshake.
+	stopInterrupt := context.AfterFunc(ctx, func() {
+		_ = clientConn.SetDeadline(conn.ALongTimeAgo)
+	})
+	defer func() {
+		stopInterrupt()
+	}()
+
 	// Get client address.
 	clientAddrPort := clientConn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	serverAddrPort := clientConn.LocalAddr().(*net.TCPAddr).AddrPort()
+
+	if lnc.handshakeTimeout > 0 {
+		if err := clientConn.SetReadDeadline(time.Now().Add(lnc.handshakeTimeout)); err != nil {
+			lnc.logger.Warn("Failed to set read deadline to handshake timeout",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Error(err),
+			)
+			clientConn.Close()
+			return
+		}
+	}
+
+	if lnc.proxyProtocol {
+		h, err := proxyproto.ReadHeader(clientConn)
+		if err != nil {
+			lnc.logger.Warn("Failed to read PROXY protocol header",
+				zap.Stringer("proxyAddress", clientAddrPort),
+				zap.Error(err),
+			)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.collector.CollectRejection(stats.RejectionKindHandshakeTimeout, "tcp", clientAddrPort, "", conn.Addr{}, err)
+			}
+			clientConn.Close()
+			return
+		}
+
+		if h.IsValid() {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Got PROXY protocol header"); ce != nil {
+				ce.Write(
+					zap.Stringer("proxyAddress", clientAddrPort),
+					zap.Stringer("sourceAddress", h.SourceAddrPort),
+					zap.Stringer("destAddress", h.DestAddrPort),
+				)
+			}
+			clientAddrPort = h.SourceAddrPort
+			serverAddrPort = h.DestAddrPort
+		}
+	}
+
 	clientAddress := clientAddrPort.String()
 
+	if s.maxConns > 0 {
+		if s.conns.Add(1) > s.maxConns {
+			s.conns.Add(-1)
+			logger := lnc.logger.With(
+				zap.String("clientAddress", clientAddress),
+			)
+			logger.Warn("Rejecting TCP connection over the concurrent connection limit",
+				zap.Int64("maxConns", s.maxConns),
+			)
+			s.collector.CollectRejection(stats.RejectionKindLimit, "tcp", clientAddrPort, "", conn.Addr{}, errTCPConnLimit)
+			s.connCloser(clientConn, logger)
+			clientConn.Close()
+			return
+		}
+		defer s.conns.Add(-1)
+	}
+
+	ctx = proxyproto.NewContext(ctx, proxyproto.Header{
+		SourceAddrPort: clientAddrPort,
+		DestAddrPort:   serverAddrPort,
+	})
+
+	var clientRawRW zerocopy.DirectReadWriteCloser = clientConn
+
+	var urgentRW *urgentDataCountingReadWriter
+	if lnc.countUrgentData {
+		rawConn, err := clientConn.SyscallConn()
+		if err != nil {
+			lnc.logger.Warn("Failed to get raw client connection",
+				zap.String("clientAddress", clientAddress),
+				zap.Error(err),
+			)
+			clientConn.Close()
+			return
+		}
+		urgentRW = &urgentDataCountingReadWriter{
+			DirectReadWriteCloser: clientRawRW,
+			rawConn:               rawConn,
+		}
+		clientRawRW = urgentRW
+	}
+
 	// Handshake.
-	clientRW, targetAddr, payload, username, err := s.server.Accept(clientConn)
+	server := s.server
+	if lnc.server != nil {
+		server = lnc.server
+	}
+	clientRW, targetAddr, payload, username, err := server.Accept(clientRawRW)
 	if err != nil {
 		if err == zerocopy.ErrAcceptDoneNoRelay {
 			if ce := lnc.logger.Check(zap.DebugLevel, "The accepted connection has been handled without relaying"); ce != nil {
@@ -148,6 +337,18 @@ func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, client
 		)
 
 		logger.Warn("Failed to complete handshake with client", zap.Error(err))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.collector.CollectRejection(stats.RejectionKindHandshakeTimeout, "tcp", clientAddrPort, "", conn.Addr{}, err)
+		} else {
+			s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindHandshake, err), "tcp", clientAddrPort, "", conn.Addr{}, err)
+			s.events.Publish(event.Event{
+				Kind:          event.KindAuthFailed,
+				Server:        s.serverName,
+				Network:       "tcp",
+				ClientAddress: clientAddrPort,
+				Error:         err.Error(),
+			})
+		}
 
 		if !s.fallbackAddress.IsValid() || len(payload) == 0 {
 			s.connCloser(clientConn, logger)
@@ -155,17 +356,70 @@ func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, client
 			return
 		}
 
-		clientRW = direct.NewDirectStreamReadWriter(clientConn)
+		clientRW = direct.NewDirectStreamReadWriter(clientRawRW)
 		targetAddr = s.fallbackAddress
 	}
 	defer clientRW.Close()
 
+	// Servers reached through internal clients route by the original user,
+	// and clients may select source addresses by user.
+	if username != "" {
+		ctx = conn.NewUsernameContext(ctx, username)
+	}
+
+	// Protocols like SOCKS5 and HTTP CONNECT wait for the outcome of the request.
+	// Reply with failure if the request is not relayed.
+	replier, _ := clientRW.(zerocopy.TCPServerReplier)
+	defer func() {
+		s.reply(ctx, replier, zerocopy.TCPReplyGeneralFailure)
+	}()
+
+	if lnc.handshakeTimeout > 0 {
+		if err = clientConn.SetReadDeadline(time.Time{}); err != nil {
+			lnc.logger.Warn("Failed to reset read deadline after handshake",
+				zap.String("clientAddress", clientAddress),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+
+	if s.udpOverTCP {
+		if version := uot.Version(targetAddr); version != 0 {
+			s.relayUoT(ctx, lnc, clientConn, clientRW, payload, clientAddrPort, username, version)
+			return
+		}
+	}
+
+	if s.dnsHijack.shouldHijack(targetAddr.Port()) {
+		if err = s.dnsHijack.serveTCP(ctx, clientConn, payload); err != nil {
+			lnc.logger.Warn("Failed to answer intercepted DNS queries",
+				zap.String("clientAddress", clientAddress),
+				zap.Stringer("targetAddress", targetAddr),
+				zap.Error(err),
+			)
+		}
+		return
+	}
+
 	// Convert target address to string once for log messages.
 	targetAddress := targetAddr.String()
 
+	if !s.userACL.Allowed(ctx, username, targetAddr) {
+		lnc.logger.Warn("Rejected TCP connection by user ACL",
+			zap.String("clientAddress", clientAddress),
+			zap.String("username", username),
+			zap.String("targetAddress", targetAddress),
+		)
+		s.collector.CollectRejection(stats.RejectionKindRoute, "tcp", clientAddrPort, username, targetAddr, cred.ErrDestinationDenied)
+		s.reply(ctx, replier, zerocopy.TCPReplyNotAllowed)
+		return
+	}
+
 	// Route.
 	c, err := s.router.GetTCPClient(ctx, router.RequestInfo{
 		ServerIndex:    s.serverIndex,
+		ListenAddrPort: lnc.listenAddrPort,
 		Username:       username,
 		SourceAddrPort: clientAddrPort,
 		TargetAddr:     targetAddr,
@@ -177,6 +431,24 @@ func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, client
 			zap.String("targetAddress", targetAddress),
 			zap.Error(err),
 		)
+		status := zerocopy.TCPReplyGeneralFailure
+		if mode, ok := router.RejectModeOf(err); ok {
+			s.collector.CollectRejection(stats.RejectionKindRoute, "tcp", clientAddrPort, username, targetAddr, err)
+			switch mode {
+			case router.RejectModeDrop:
+				// Discard everything until the client gives up, or the relay service is stopped.
+				replier = nil
+				_, _ = io.Copy(io.Discard, clientConn)
+				return
+			case router.RejectModeReset:
+				// Closing with a zero linger timeout sends RST.
+				replier = nil
+				_ = clientConn.SetLinger(0)
+				return
+			}
+			status = zerocopy.TCPReplyNotAllowed
+		}
+		s.reply(ctx, replier, status)
 		return
 	}
 
@@ -195,7 +467,18 @@ func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, client
 	// 1. not disabled
 	// 2. server does not have native support
 	// 3. client has native support
+	//
+	// The client only sends the initial payload after a successful reply,
+	// so dial failures cannot be reported when waiting.
 	if lnc.waitForInitialPayload && clientInfo.NativeInitialPayload {
+		if replier != nil {
+			if err = replier.Reply(zerocopy.TCPReplySucceeded); err != nil {
+				logger.Warn("Failed to reply to client", zap.Error(err))
+				return
+			}
+			replier = nil
+		}
+
 		clientReaderInfo := clientRW.ReaderInfo()
 		payloadBufSize := max(clientReaderInfo.MinPayloadBufferSizePerRead, lnc.initialPayloadWaitBufferSize)
 		payload = make([]byte, clientReaderInfo.Headroom.Front+payloadBufSize+clientReaderInfo.Headroom.Rear)
@@ -242,24 +525,131 @@ func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, client
 	}
 
 	// Create remote connection.
-	remoteRawRW, remoteRW, err := c.Dial(ctx, targetAddr, payload)
+	remoteRawRW, remoteRW, err := c.Dial(conn.NewTargetAddrContext(ctx, targetAddr), targetAddr, payload)
 	if err != nil {
 		logger.Warn("Failed to create remote connection",
 			zap.Int("initialPayloadLength", len(payload)),
 			zap.Error(err),
 		)
+		s.reply(ctx, replier, zerocopy.TCPReplyStatusFromDialError(err))
 		return
 	}
 	defer remoteRawRW.Close()
 
+	// Mark the remote connection with the server's traffic class, if any.
+	if s.trafficClass != 0 {
+		if tc, ok := remoteRawRW.(*net.TCPConn); ok {
+			if err = conn.SetTCPConnTrafficClass(tc, s.trafficClass); err != nil {
+				logger.Warn("Failed to set traffic class on remote connection", zap.Error(err))
+			}
+		}
+	}
+
+	if replier != nil {
+		if err = replier.Reply(zerocopy.TCPReplySucceeded); err != nil {
+			logger.Warn("Failed to reply to client", zap.Error(err))
+			return
+		}
+		replier = nil
+	}
+
+	// Only count remote connections backed by sockets.
+	if _, ok := remoteRawRW.(syscall.Conn); ok {
+		s.resources.AddFDs(1)
+		defer s.resources.AddFDs(-1)
+	}
+
 	logger.Info("Two-way relay started",
 		zap.Int("initialPayloadLength", len(payload)),
 	)
 
+	connEvent := event.Event{
+		Kind:          event.KindConnOpened,
+		Server:        s.serverName,
+		Network:       "tcp",
+		ClientAddress: clientAddrPort,
+		Username:      username,
+		TargetAddress: targetAddr,
+		Client:        clientInfo.Name,
+	}
+	s.events.Publish(connEvent)
+	relayStartTime := time.Now()
+
+	// Apply rate limit.
+	// Rate limit waits are canceled when the relay is interrupted.
+	limitCtx, cancelLimit := context.WithCancel(ctx)
+	defer cancelLimit()
+	var limitedRW *ratelimit.StreamReadWriter
+	if h := s.rateLimiter.Acquire(username, clientAddrPort.Addr()); h != nil {
+		defer h.Release()
+		limitedRW = ratelimit.NewStreamReadWriter(limitCtx, clientRW, h)
+		clientRW = limitedRW
+	}
+
+	// From now on, closing the connections of the relay service interrupts the relay.
+	if !stopInterrupt() {
+		return
+	}
+	stopInterrupt = context.AfterFunc(ctx, func() {
+		interruptTCPRelay(clientConn, remoteRawRW)
+	})
+
+	// Track the connection.
+	var closedByAPI atomic.Bool
+	if tracked := s.connTable.Add("tcp", clientAddrPort, username, targetAddr, clientInfo.Name, func() {
+		closedByAPI.Store(true)
+		cancelLimit()
+		interruptTCPRelay(clientConn, remoteRawRW)
+	}); tracked != nil {
+		defer tracked.Remove()
+		tracked.AddUplinkBytes(uint64(len(payload)))
+		clientRW = conntrack.NewStreamReadWriter(clientRW, tracked)
+	}
+
+	// Capture the connection.
+	if flow := s.captures.NewFlow("tcp", clientAddrPort, username, targetAddr); flow != nil {
+		defer flow.Close()
+		flow.Uplink(payload)
+		clientRW = capture.NewStreamReadWriter(clientRW, flow)
+	}
+
 	// Two-way relay.
-	nl2r, nr2l, err := zerocopy.TwoWayRelay(clientRW, remoteRW)
+	// Both relay functions relay one direction in a new goroutine.
+	s.resources.AddGoroutines(1)
+	nl2r, nr2l, err := s.twoWayRelay(clientRW, remoteRW, logger)
+	s.resources.AddGoroutines(-1)
 	nl2r += int64(len(payload))
 	s.collector.CollectTCPSession(username, uint64(nr2l), uint64(nl2r))
+	if limitedRW != nil {
+		if delayedBytes := limitedRW.DelayedBytes(); delayedBytes > 0 {
+			s.collector.CollectRateLimit(username, delayedBytes, 0)
+		}
+	}
+	if urgentRW != nil && urgentRW.discardedBytes > 0 {
+		logger.Warn("Discarded TCP urgent data from client",
+			zap.Uint64("discardedBytes", urgentRW.discardedBytes),
+		)
+		s.collector.CollectTCPUrgentData(username, urgentRW.discardedBytes)
+	}
+
+	connEvent.Kind = event.KindConnClosed
+	connEvent.UplinkBytes = uint64(nl2r)
+	connEvent.DownlinkBytes = uint64(nr2l)
+	connEvent.Duration = jsonhelper.Duration(time.Since(relayStartTime))
+	switch {
+	case closedByAPI.Load():
+		connEvent.CloseReason = event.CloseReasonClosed
+	case ctx.Err() != nil:
+		connEvent.CloseReason = event.CloseReasonShutdown
+	case err != nil:
+		connEvent.CloseReason = event.CloseReasonError
+	default:
+		connEvent.CloseReason = event.CloseReasonEOF
+	}
+	if err != nil {
+		connEvent.Error = err.Error()
+	}
+	s.events.Publish(connEvent)
 	if err != nil {
 		logger.Warn("Two-way relay failed",
 			zap.Int64("nl2r", nl2r),
@@ -275,8 +665,63 @@ func (s *TCPRelay) handleConn(ctx context.Context, lnc *tcpRelayListener, client
 	)
 }
 
+// twoWayRelay relays data between clientRW and remoteRW.
+//
+// If the sockmap is enabled, and both sides are plain TCP connections,
+// the payload is redirected between them in the kernel.
+func (s *TCPRelay) twoWayRelay(clientRW, remoteRW zerocopy.ReadWriter, logger *zap.Logger) (nl2r, nr2l int64, err error) {
+	if s.sockmap != nil {
+		if clientConn, ok := directTCPConn(clientRW); ok {
+			if remoteConn, ok := directTCPConn(remoteRW); ok {
+				p, err := s.sockmap.Attach(clientConn, remoteConn)
+				if err == nil {
+					return p.Relay()
+				}
+				logger.Warn("Failed to attach connections to sockmap, falling back to userspace relay", zap.Error(err))
+			}
+		}
+	}
+	return zerocopy.TwoWayRelay(clientRW, remoteRW)
+}
+
+// directTCPConn returns the [*net.TCPConn] that rw directly reads from and writes to, if any.
+func directTCPConn(rw zerocopy.ReadWriter) (*net.TCPConn, bool) {
+	dr, ok := rw.(zerocopy.DirectReader)
+	if !ok {
+		return nil, false
+	}
+	dw, ok := rw.(zerocopy.DirectWriter)
+	if !ok {
+		return nil, false
+	}
+	tc, ok := dr.DirectReader().(*net.TCPConn)
+	if !ok || dw.DirectWriter() != io.Writer(tc) {
+		return nil, false
+	}
+	return tc, true
+}
+
+// reply reports a failed request to the client, if the protocol supports it.
+// Requests failed by shutting down the relay are reported as such.
+func (s *TCPRelay) reply(ctx context.Context, replier zerocopy.TCPServerReplier, status zerocopy.TCPReplyStatus) {
+	if replier == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		status = zerocopy.TCPReplyShuttingDown
+	}
+	_ = replier.Reply(status)
+}
+
 // Stop implements the Service Stop method.
+// It closes all connections without draining.
 func (s *TCPRelay) Stop() error {
+	_, err := s.Drain(canceledContext)
+	return err
+}
+
+// Drain implements [Drainer.Drain].
+func (s *TCPRelay) Drain(ctx context.Context) (int, error) {
 	for i := range s.listeners {
 		lnc := &s.listeners[i]
 		if err := lnc.listener.SetDeadline(conn.ALongTimeAgo); err != nil {
@@ -291,7 +736,45 @@ func (s *TCPRelay) Stop() error {
 		if err := lnc.listener.Close(); err != nil {
 			lnc.logger.Warn("Failed to close listener", zap.Error(err))
 		}
+		s.resources.AddFDs(-1)
 	}
 
-	return nil
+	var closed int
+	if !waitGroupWait(ctx, &s.connWg) {
+		closed = int(s.activeConns.Load())
+	}
+	s.cancelConns()
+	s.connWg.Wait()
+
+	return closed, nil
+}
+
+// interruptTCPRelay forcibly terminates the two-way relay between clientConn and remoteRawRW.
+//
+// Deadlines unblock pending reads and writes, and shutting down the read side
+// also unblocks reads not managed by the Go runtime poller.
+func interruptTCPRelay(clientConn *net.TCPConn, remoteRawRW zerocopy.DirectReadWriteCloser) {
+	_ = clientConn.SetDeadline(conn.ALongTimeAgo)
+	_ = clientConn.CloseRead()
+	if c, ok := remoteRawRW.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = c.SetDeadline(conn.ALongTimeAgo)
+	}
+	_ = remoteRawRW.CloseRead()
+}
+
+// urgentDataCountingReadWriter counts TCP urgent bytes skipped by the kernel when reading from the connection.
+//
+// The counter is not safe for concurrent reads.
+type urgentDataCountingReadWriter struct {
+	zerocopy.DirectReadWriteCloser
+	rawConn        syscall.RawConn
+	discardedBytes uint64
+}
+
+// Read implements the io.Reader Read method.
+func (rw *urgentDataCountingReadWriter) Read(b []byte) (int, error) {
+	if atMark, err := conn.TCPAtUrgentMark(rw.rawConn); err == nil && atMark {
+		rw.discardedBytes++
+	}
+	return rw.DirectReadWriteCloser.Read(b)
 }
@@ -1,12 +1,20 @@
 package service
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 )
 
@@ -36,6 +44,172 @@ const (
 
 var ErrMTUTooSmall = errors.New("MTU must be at least 1280")
 
+var errUDPSessionLimit = errors.New("too many concurrent UDP sessions")
+
+var errUDPSessionRampUp = errors.New("too many new UDP sessions during ramp-up")
+
+// udpSessionLimitPolicy controls how UDP relays handle packets that would start a new session
+// when the session table is full.
+type udpSessionLimitPolicy uint8
+
+const (
+	// udpSessionLimitDrop drops packets that would start a new session.
+	udpSessionLimitDrop udpSessionLimitPolicy = iota
+
+	// udpSessionLimitEvictLRU evicts the least recently active session to make room for the new session.
+	udpSessionLimitEvictLRU
+)
+
+// parseUDPSessionLimitPolicy parses the UDP session limit policy from its configuration value.
+func parseUDPSessionLimitPolicy(s string) (udpSessionLimitPolicy, error) {
+	switch s {
+	case "", "drop":
+		return udpSessionLimitDrop, nil
+	case "evictLRU":
+		return udpSessionLimitEvictLRU, nil
+	default:
+		return 0, fmt.Errorf("invalid UDP session limit policy: %q", s)
+	}
+}
+
+// udpSessionLRU orders the sessions of a UDP relay by when they last received a packet from the client.
+// It must be guarded by the lock of the relay's session table.
+//
+// The zero value is an empty list ready to use.
+type udpSessionLRU[K comparable] struct {
+	l list.List
+}
+
+// add adds a new session as the most recently active one.
+func (l *udpSessionLRU[K]) add(key K) *list.Element {
+	return l.l.PushFront(key)
+}
+
+// touch marks the session as the most recently active one.
+func (l *udpSessionLRU[K]) touch(e *list.Element) {
+	l.l.MoveToFront(e)
+}
+
+// remove removes the session from the list. It is a no-op if the session has already been removed.
+func (l *udpSessionLRU[K]) remove(e *list.Element) {
+	l.l.Remove(e)
+}
+
+// popOldest removes the least recently active session from the list and returns its key.
+func (l *udpSessionLRU[K]) popOldest() (key K, ok bool) {
+	e := l.l.Back()
+	if e == nil {
+		return key, false
+	}
+	return l.l.Remove(e).(K), true
+}
+
+// udpSessionRecord collects the traffic and close reason of a UDP session,
+// and publishes its expired event after both directions have finished relaying.
+//
+// The uplink and downlink goroutines write their own traffic fields,
+// and the last one to finish publishes the event.
+type udpSessionRecord struct {
+	event       event.Event
+	startTime   time.Time
+	closeReason atomic.Pointer[string]
+	remaining   atomic.Int32
+}
+
+// newUDPSessionRecord returns a new record for a UDP session starting now.
+func newUDPSessionRecord() *udpSessionRecord {
+	r := udpSessionRecord{
+		startTime: time.Now(),
+	}
+	r.remaining.Store(2)
+	return &r
+}
+
+// setEvent sets the session's fields from its created event.
+// It must be called before the relay goroutines are started.
+func (r *udpSessionRecord) setEvent(sessionEvent event.Event) {
+	r.event = sessionEvent
+	r.event.Kind = event.KindSessionExpired
+}
+
+// setCloseReason records why the session is being closed, unless a reason has already been recorded.
+// Sessions without a recorded reason are closed for being idle.
+func (r *udpSessionRecord) setCloseReason(reason string) {
+	r.closeReason.CompareAndSwap(nil, &reason)
+}
+
+// finishUplink records the uplink traffic, and publishes the event if the downlink has finished.
+func (r *udpSessionRecord) finishUplink(bus *event.Bus, packets, payloadBytes uint64) {
+	r.event.UplinkPackets = packets
+	r.event.UplinkBytes = payloadBytes
+	r.finish(bus)
+}
+
+// finishDownlink records the client's latest address and the downlink traffic,
+// and publishes the event if the uplink has finished.
+func (r *udpSessionRecord) finishDownlink(bus *event.Bus, clientAddrPort netip.AddrPort, packets, payloadBytes uint64) {
+	r.event.ClientAddress = clientAddrPort
+	r.event.DownlinkPackets = packets
+	r.event.DownlinkBytes = payloadBytes
+	r.finish(bus)
+}
+
+func (r *udpSessionRecord) finish(bus *event.Bus) {
+	if r.remaining.Add(-1) != 0 {
+		return
+	}
+
+	r.event.Duration = jsonhelper.Duration(time.Since(r.startTime))
+	r.event.CloseReason = event.CloseReasonIdleTimeout
+	if reason := r.closeReason.Load(); reason != nil {
+		r.event.CloseReason = *reason
+	}
+	bus.Publish(r.event)
+}
+
+// oversizedPayloadPolicy controls how UDP relays handle unpacked payloads
+// that are too big to pack for the outgoing path.
+//
+// Oversized payloads are always dropped and counted in the uplink direction.
+type oversizedPayloadPolicy uint8
+
+const (
+	// oversizedPayloadDrop drops oversized payloads.
+	oversizedPayloadDrop oversizedPayloadPolicy = iota
+
+	// oversizedPayloadTruncateDNS truncates oversized DNS responses to the client,
+	// and drops other oversized payloads.
+	oversizedPayloadTruncateDNS
+)
+
+// parseOversizedPayloadPolicy parses the oversized payload policy from its configuration value.
+func parseOversizedPayloadPolicy(s string) (oversizedPayloadPolicy, error) {
+	switch s {
+	case "", "drop":
+		return oversizedPayloadDrop, nil
+	case "truncateDNS":
+		return oversizedPayloadTruncateDNS, nil
+	default:
+		return 0, fmt.Errorf("invalid oversized UDP payload policy: %q", s)
+	}
+}
+
+// truncatesFrom returns whether an oversized payload to the client from the given source should be truncated.
+func (p oversizedPayloadPolicy) truncatesFrom(payloadSourceAddrPort netip.AddrPort) bool {
+	return p == oversizedPayloadTruncateDNS && payloadSourceAddrPort.Port() == 53
+}
+
+// packTruncatedDNSResponse truncates the DNS response in b[payloadStart:payloadStart+payloadLength]
+// and packs it with the server packer. It returns the packet position and the truncated payload length.
+func packTruncatedDNSResponse(packer zerocopy.ServerPacker, b []byte, payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLength, maxPacketSize int) (packetStart, packetLength, truncatedPayloadLength int, err error) {
+	msg, err := dns.TruncateResponse(b[payloadStart : payloadStart+payloadLength])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to truncate DNS response: %w", err)
+	}
+	packetStart, packetLength, err = packer.PackInPlace(b, payloadSourceAddrPort, payloadStart, len(msg), maxPacketSize)
+	return packetStart, packetLength, len(msg), err
+}
+
 // UDPPerfConfig exposes performance tuning parameters for UDP relays.
 type UDPPerfConfig struct {
 	// BatchMode controls the mode of batch receiving and sending.
@@ -44,6 +218,11 @@ type UDPPerfConfig struct {
 	// - "": Platform default.
 	// - "no": Do not receive or send packets in batches.
 	// - "sendmmsg": Use recvmmsg(2) and sendmmsg(2) calls. This is the default on Linux and NetBSD.
+	// - "gso": Use UDP GSO on send and UDP GRO on receive for both serverConn and natConn.
+	//   Consecutive packets to the same destination are coalesced into a single large datagram,
+	//   and received coalesced datagrams are split back into packets in userspace.
+	//   Falls back to "no" if the system does not support UDP GSO or GRO.
+	//   Available on Linux and Windows. Not supported by the transparent proxy.
 	BatchMode string `json:"batchMode"`
 
 	// RelayBatchSize is the batch size of recvmmsg(2) and sendmmsg(2) calls in relay sessions.
@@ -60,16 +239,37 @@ type UDPPerfConfig struct {
 	//
 	// The default value is 1024.
 	SendChannelCapacity int `json:"sendChannelCapacity"`
+
+	// V4MappedMode controls whether IPv4 destinations are converted to IPv4-mapped IPv6 addresses
+	// when sending packets to targets with sendmmsg(2).
+	//
+	// Available values:
+	// - "": Same as "always".
+	// - "always": Always convert. This requires NAT sockets to be dual-stack IPv6 sockets.
+	//   NAT sockets bound to an IPv4 source address by the client's dialerSourcePrefixes are exempt.
+	// - "auto": Only convert when the NAT socket is a dual-stack IPv6 socket.
+	//   IPv4 sockets, like those on systems with IPv6 disabled, and IPv6-only sockets get IPv4 addresses.
+	// - "never": Never convert. Use this if the kernel accepts IPv4 addresses on all NAT sockets.
+	//
+	// Only applicable to the "sendmmsg" batch mode.
+	// Other batch modes leave the conversion to the Go standard library, which handles it for all supported Go versions.
+	V4MappedMode string `json:"v4MappedMode"`
 }
 
 // CheckAndApplyDefaults checks the validity of the configuration and applies default values.
 func (c *UDPPerfConfig) CheckAndApplyDefaults() error {
 	switch c.BatchMode {
-	case "", "no", "sendmmsg":
+	case "", "no", "sendmmsg", "gso":
 	default:
 		return fmt.Errorf("unknown batch mode: %s", c.BatchMode)
 	}
 
+	switch c.V4MappedMode {
+	case "", "always", "auto", "never":
+	default:
+		return fmt.Errorf("unknown v4-mapped mode: %s", c.V4MappedMode)
+	}
+
 	switch {
 	case c.RelayBatchSize > 0 && c.RelayBatchSize <= 1024:
 	case c.RelayBatchSize == 0:
@@ -97,16 +297,129 @@ func (c *UDPPerfConfig) CheckAndApplyDefaults() error {
 	return nil
 }
 
+// packetPool is a pool of queued packets for a UDP relay.
+//
+// With a positive size, the pool allocates size packets upfront, and keeps up to size idle packets,
+// which are never freed. Packets beyond that are allocated on demand, and dropped when returned to a full pool.
+// Otherwise, idle packets are kept in a [sync.Pool].
+type packetPool[T any] struct {
+	idle chan *T
+	pool sync.Pool
+}
+
+// newPacketPool returns a new pool of size packets allocated by newPacket.
+func newPacketPool[T any](size int, newPacket func() *T) *packetPool[T] {
+	p := packetPool[T]{
+		pool: sync.Pool{
+			New: func() any {
+				return newPacket()
+			},
+		},
+	}
+	if size > 0 {
+		p.idle = make(chan *T, size)
+		for range size {
+			p.idle <- newPacket()
+		}
+	}
+	return &p
+}
+
+// Get returns an idle packet, or a new packet if there is none.
+func (p *packetPool[T]) Get() *T {
+	if p.idle == nil {
+		return p.pool.Get().(*T)
+	}
+	select {
+	case packet := <-p.idle:
+		return packet
+	default:
+		return p.pool.New().(*T)
+	}
+}
+
+// Put returns the packet to the pool.
+func (p *packetPool[T]) Put(packet *T) {
+	if p.idle == nil {
+		p.pool.Put(packet)
+		return
+	}
+	select {
+	case p.idle <- packet:
+	default:
+	}
+}
+
 // udpRelayServerConn configures the server socket for a UDP relay.
 type udpRelayServerConn struct {
 	logger              *zap.Logger
 	serverConn          *net.UDPConn
+	serverConnInfo      conn.SocketInfo
 	listenConfig        conn.ListenConfig
 	network             string
 	address             string
+	listenAddrPort      netip.AddrPort
 	batchMode           string
 	relayBatchSize      int
 	serverRecvBatchSize int
 	sendChannelCapacity int
+	v4MappedMode        string
 	natTimeout          time.Duration
+	minNATTimeout       time.Duration
+	acl                 *clientACL
+
+	// natServer, if not nil, overrides the relay's server for sessions started on this listener,
+	// like simple tunnels forwarding each port to a different target.
+	natServer zerocopy.UDPNATServer
+
+	// cpu is the CPU to pin the receive routine to, or -1 to not pin it.
+	cpu int
+}
+
+// natTimeoutFor returns the NAT timeout for a session through the client.
+// The client's NAT timeout, if any, overrides the listener's, but not the server's minimum.
+func (lnc *udpRelayServerConn) natTimeoutFor(clientInfo zerocopy.UDPClientInfo) time.Duration {
+	if clientInfo.NATTimeout == 0 {
+		return lnc.natTimeout
+	}
+	return max(clientInfo.NATTimeout, lnc.minNATTimeout)
+}
+
+// pinReceiveRoutine pins the calling receive routine to the listener's CPU, if any.
+// It must be called at the start of the routine's goroutine.
+func (lnc *udpRelayServerConn) pinReceiveRoutine() {
+	if lnc.cpu < 0 {
+		return
+	}
+	if err := conn.PinThreadToCPU(lnc.cpu); err != nil {
+		lnc.logger.Warn("Failed to pin receive routine to CPU", zap.Int("cpu", lnc.cpu), zap.Error(err))
+	}
+}
+
+// udpMsgReader reads packets and their socket control messages from a UDP socket.
+type udpMsgReader interface {
+	// ReadMsgUDPAddrPort reads a packet and its socket control message.
+	ReadMsgUDPAddrPort(b, oob []byte) (n, oobn, flags int, addr netip.AddrPort, err error)
+
+	// Buffered returns the number of bytes that can be read without a system call.
+	Buffered() int
+}
+
+// plainUDPMsgReader is a udpMsgReader for sockets without UDP GRO.
+type plainUDPMsgReader struct {
+	*net.UDPConn
+}
+
+// Buffered implements the udpMsgReader Buffered method.
+func (plainUDPMsgReader) Buffered() int {
+	return 0
+}
+
+// newUDPMsgReader returns a udpMsgReader for the socket.
+// If UDP GRO is enabled on the socket, coalesced datagrams are split into packets.
+func newUDPMsgReader(c *net.UDPConn, info conn.SocketInfo) udpMsgReader {
+	if info.UDPGenericReceiveOffload {
+		return conn.NewUDPGROReader(c)
+	}
+	return plainUDPMsgReader{c}
 }
@@ -0,0 +1,42 @@
+//go:build linux || netbsd
+
+package service
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"golang.org/x/sys/unix"
+)
+
+// useV4MappedDestinations returns whether IPv4 destinations of packets sent on natConn
+// should be converted to IPv4-mapped IPv6 addresses.
+func (lnc *udpRelayServerConn) useV4MappedDestinations(natConn conn.MmsgConn, natConnInfo conn.SocketInfo) bool {
+	localAddr := natConn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	switch lnc.v4MappedMode {
+	case "never":
+		return false
+	case "auto":
+		// Only dual-stack IPv6 sockets can send to IPv4-mapped addresses.
+		return !natConnInfo.IPv6Only && !localAddr.Is4()
+	default:
+		// NAT sockets bound to an IPv4 source address are IPv4 sockets.
+		return !localAddr.Is4() || localAddr.IsUnspecified()
+	}
+}
+
+// putDestSockaddr writes the socket address of destAddrPort to rsa6 for sendmmsg(2),
+// and returns the length of the socket address.
+//
+// If v4Mapped is true, IPv4 addresses are written as IPv4-mapped IPv6 addresses.
+// Otherwise, IPv4-mapped IPv6 addresses are written as IPv4 addresses.
+func putDestSockaddr(rsa6 *unix.RawSockaddrInet6, destAddrPort netip.AddrPort, v4Mapped bool) uint32 {
+	if v4Mapped {
+		*rsa6 = conn.AddrPortToSockaddrInet6(destAddrPort)
+		return unix.SizeofSockaddrInet6
+	}
+	var namelen uint32
+	*rsa6, namelen = conn.AddrPortToSockaddrValue(netip.AddrPortFrom(destAddrPort.Addr().Unmap(), destAddrPort.Port()))
+	return namelen
+}
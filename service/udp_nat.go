@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"net"
@@ -9,9 +10,15 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
 	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -26,6 +33,14 @@ type natQueuedPacket struct {
 	targetAddr conn.Addr
 }
 
+// natKey identifies a NAT session by the listener it was started on and the client address.
+// The listeners of a direct tunnel may forward to different targets, so the same client address
+// has a separate session on each listener.
+type natKey struct {
+	listener       *udpRelayServerConn
+	clientAddrPort netip.AddrPort
+}
+
 // natEntry is an entry in the NAT table.
 type natEntry struct {
 	// state synchronizes session initialization and shutdown.
@@ -45,6 +60,13 @@ type natEntry struct {
 	serverConn         *net.UDPConn
 	serverConnUnpacker zerocopy.ServerUnpacker
 	logger             *zap.Logger
+
+	// lruElem is the entry's element in the relay's LRU list,
+	// or nil if the relay does not evict sessions.
+	lruElem *list.Element
+
+	// record collects the session's traffic and close reason for its expired event.
+	record *udpSessionRecord
 }
 
 // natUplinkGeneric is used for passing information about relay uplink to the relay goroutine.
@@ -52,9 +74,16 @@ type natUplinkGeneric struct {
 	clientName     string
 	clientAddrPort netip.AddrPort
 	natConn        *net.UDPConn
+	natConnInfo    conn.SocketInfo
 	natConnSendCh  <-chan *natQueuedPacket
 	natConnPacker  zerocopy.ClientPacker
 	natTimeout     time.Duration
+	pathMTU        *natConnPathMTU
+	rateLimit      *ratelimit.Handle
+	filter         *natFilter
+	tracked        *conntrack.Entry
+	flow           *capture.Flow
+	record         *udpSessionRecord
 	logger         *zap.Logger
 }
 
@@ -64,10 +93,18 @@ type natDownlinkGeneric struct {
 	clientAddrPort     netip.AddrPort
 	clientPktinfo      *atomic.Pointer[[]byte]
 	natConn            *net.UDPConn
+	natConnInfo        conn.SocketInfo
 	natConnRecvBufSize int
 	natConnUnpacker    zerocopy.ClientUnpacker
 	serverConn         *net.UDPConn
+	serverConnInfo     conn.SocketInfo
 	serverConnPacker   zerocopy.ServerPacker
+	pathMTU            *natConnPathMTU
+	rateLimit          *ratelimit.Handle
+	filter             *natFilter
+	tracked            *conntrack.Entry
+	flow               *capture.Flow
+	record             *udpSessionRecord
 	logger             *zap.Logger
 }
 
@@ -82,23 +119,49 @@ type UDPNATRelay struct {
 	packetBufRecvSize      int
 	listeners              []udpRelayServerConn
 	server                 zerocopy.UDPNATServer
+	maxSessions            int
+	sessionLimitPolicy     udpSessionLimitPolicy
+	oversizedPayloadPolicy oversizedPayloadPolicy
+	natFiltering           natFilteringBehavior
+	trafficClass           int
 	collector              stats.Collector
+	rateLimiter            *ratelimit.Limiter
+	acceptRampUp           *ratelimit.RampUp
+	events                 *event.Bus
 	router                 *router.Router
+	portUnreachable        *portUnreachableSender
+	connTable              *conntrack.Table
+	captures               *capture.Server
+	resources              *resource.Counter
 	logger                 *zap.Logger
-	queuedPacketPool       sync.Pool
+	queuedPacketPool       *packetPool[natQueuedPacket]
 	mu                     sync.Mutex
 	wg                     sync.WaitGroup
 	mwg                    sync.WaitGroup
-	table                  map[netip.AddrPort]*natEntry
+	table                  map[natKey]*natEntry
+	lru                    udpSessionLRU[natKey]
+	draining               bool
 }
 
 func NewUDPNATRelay(
 	serverName string,
-	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize int,
+	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize, packetBufPoolSize int,
 	listeners []udpRelayServerConn,
 	server zerocopy.UDPNATServer,
+	maxSessions int,
+	sessionLimitPolicy udpSessionLimitPolicy,
+	oversizedPayloadPolicy oversizedPayloadPolicy,
+	natFiltering natFilteringBehavior,
+	trafficClass int,
 	collector stats.Collector,
+	rateLimiter *ratelimit.Limiter,
+	acceptRampUp *ratelimit.RampUp,
+	events *event.Bus,
 	router *router.Router,
+	portUnreachable *portUnreachableSender,
+	connTable *conntrack.Table,
+	captures *capture.Server,
+	resources *resource.Counter,
 	logger *zap.Logger,
 ) *UDPNATRelay {
 	return &UDPNATRelay{
@@ -109,17 +172,28 @@ func NewUDPNATRelay(
 		packetBufRecvSize:      packetBufRecvSize,
 		listeners:              listeners,
 		server:                 server,
+		maxSessions:            maxSessions,
+		sessionLimitPolicy:     sessionLimitPolicy,
+		oversizedPayloadPolicy: oversizedPayloadPolicy,
+		natFiltering:           natFiltering,
+		trafficClass:           trafficClass,
 		collector:              collector,
+		rateLimiter:            rateLimiter,
+		acceptRampUp:           acceptRampUp,
+		events:                 events,
 		router:                 router,
+		portUnreachable:        portUnreachable,
+		connTable:              connTable,
+		captures:               captures,
+		resources:              resources,
 		logger:                 logger,
-		queuedPacketPool: sync.Pool{
-			New: func() any {
-				return &natQueuedPacket{
-					buf: make([]byte, packetBufSize),
-				}
-			},
-		},
-		table: make(map[netip.AddrPort]*natEntry),
+		queuedPacketPool: newPacketPool(packetBufPoolSize, func() *natQueuedPacket {
+			resources.AllocBuffer()
+			return &natQueuedPacket{
+				buf: make([]byte, packetBufSize),
+			}
+		}),
+		table: make(map[natKey]*natEntry),
 	}
 }
 
@@ -134,16 +208,18 @@ func (s *UDPNATRelay) Start(ctx context.Context) error {
 		if err := s.start(ctx, i, &s.listeners[i]); err != nil {
 			return err
 		}
+		s.resources.AddFDs(1)
 	}
 	return nil
 }
 
 func (s *UDPNATRelay) startGeneric(ctx context.Context, index int, lnc *udpRelayServerConn) (err error) {
-	lnc.serverConn, _, err = lnc.listenConfig.ListenUDP(ctx, lnc.network, lnc.address)
+	lnc.serverConn, lnc.serverConnInfo, err = lnc.listenConfig.ListenUDP(ctx, lnc.network, lnc.address)
 	if err != nil {
 		return
 	}
 	lnc.address = lnc.serverConn.LocalAddr().String()
+	lnc.listenAddrPort = lnc.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
 	lnc.logger = s.logger.With(
 		zap.String("server", s.serverName),
 		zap.Int("listener", index),
@@ -152,10 +228,11 @@ func (s *UDPNATRelay) startGeneric(ctx context.Context, index int, lnc *udpRelay
 
 	s.mwg.Add(1)
 
-	go func() {
+	s.resources.Go(func() {
+		lnc.pinReceiveRoutine()
 		s.recvFromServerConnGeneric(ctx, lnc)
 		s.mwg.Done()
-	}()
+	})
 
 	lnc.logger.Info("Started UDP NAT relay service listener")
 	return
@@ -163,6 +240,7 @@ func (s *UDPNATRelay) startGeneric(ctx context.Context, index int, lnc *udpRelay
 
 func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRelayServerConn) {
 	cmsgBuf := make([]byte, conn.SocketControlMessageBufferSize)
+	serverConnReader := newUDPMsgReader(lnc.serverConn, lnc.serverConnInfo)
 
 	var (
 		packetsReceived      uint64
@@ -174,7 +252,7 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 		packetBuf := queuedPacket.buf
 		recvBuf := packetBuf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+s.packetBufRecvSize]
 
-		n, cmsgn, flags, clientAddrPort, err := lnc.serverConn.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
+		n, cmsgn, flags, clientAddrPort, err := serverConnReader.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				s.putQueuedPacket(queuedPacket)
@@ -190,6 +268,17 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 			s.putQueuedPacket(queuedPacket)
 			continue
 		}
+
+		if !lnc.acl.Allowed(clientAddrPort.Addr()) {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet denied by ACL"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindACL, "udp", clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
 			lnc.logger.Warn("Failed to read packet from serverConn",
@@ -204,19 +293,64 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 
 		s.mu.Lock()
 
-		entry, ok := s.table[clientAddrPort]
+		key := natKey{lnc, clientAddrPort}
+		entry, ok := s.table[key]
+		if !ok && s.maxSessions > 0 && len(s.table) >= s.maxSessions && s.sessionLimitPolicy == udpSessionLimitDrop {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session limit"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Int("maxSessions", s.maxSessions),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, errUDPSessionLimit)
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
+		if !ok && s.draining {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet of new UDP session while draining"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
+		if !ok && !s.acceptRampUp.Allow() {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session ramp-up rate"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, errUDPSessionRampUp)
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
 		if !ok {
 			entry = &natEntry{
 				serverConn: lnc.serverConn,
 				logger:     lnc.logger,
 			}
 
-			entry.serverConnUnpacker, err = s.server.NewUnpacker()
+			entry.serverConnUnpacker, err = s.serverFor(lnc).NewUnpacker()
 			if err != nil {
 				lnc.logger.Warn("Failed to create unpacker for serverConn",
 					zap.Stringer("clientAddress", clientAddrPort),
 					zap.Error(err),
 				)
+				s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", clientAddrPort, "", conn.Addr{}, err)
+				s.events.Publish(event.Event{
+					Kind:          event.KindAuthFailed,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: clientAddrPort,
+					Error:         err.Error(),
+				})
 
 				s.putQueuedPacket(queuedPacket)
 				s.mu.Unlock()
@@ -231,6 +365,14 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 				zap.Int("packetLength", n),
 				zap.Error(err),
 			)
+			s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", clientAddrPort, "", conn.Addr{}, err)
+			s.events.Publish(event.Event{
+				Kind:          event.KindAuthFailed,
+				Server:        s.serverName,
+				Network:       "udp",
+				ClientAddress: clientAddrPort,
+				Error:         err.Error(),
+			})
 
 			s.putQueuedPacket(queuedPacket)
 			s.mu.Unlock()
@@ -272,18 +414,28 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 		}
 
 		if !ok {
+			if s.maxSessions > 0 && len(s.table) >= s.maxSessions {
+				s.evictLeastRecentlyActiveSession()
+			}
+
 			natConnSendCh := make(chan *natQueuedPacket, lnc.sendChannelCapacity)
+			removeNatConnSendCh := resource.AddChannel(s.resources, natConnSendCh)
 			entry.natConnSendCh = natConnSendCh
-			s.table[clientAddrPort] = entry
+			entry.record = newUDPSessionRecord()
+			if s.sessionLimitPolicy == udpSessionLimitEvictLRU {
+				entry.lruElem = s.lru.add(key)
+			}
+			s.table[key] = entry
 			s.wg.Add(1)
 
-			go func() {
+			s.resources.Go(func() {
 				var sendChClean bool
 
 				defer func() {
 					s.mu.Lock()
+					removeNatConnSendCh()
 					close(natConnSendCh)
-					delete(s.table, clientAddrPort)
+					s.removeEntry(key, entry)
 					s.mu.Unlock()
 
 					if !sendChClean {
@@ -297,6 +449,7 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 
 				c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
 					ServerIndex:    s.serverIndex,
+					ListenAddrPort: lnc.listenAddrPort,
 					SourceAddrPort: clientAddrPort,
 					TargetAddr:     queuedPacket.targetAddr,
 				})
@@ -306,10 +459,16 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.Error(err),
 					)
+					if mode, ok := router.RejectModeOf(err); ok {
+						s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, "", queuedPacket.targetAddr, err)
+						if mode == router.RejectModeReset {
+							s.sendPortUnreachable(lnc, entry, clientAddrPort, int(queuedPacket.length))
+						}
+					}
 					return
 				}
 
-				clientInfo, clientSession, err := c.NewSession(ctx)
+				clientInfo, clientSession, err := c.NewSession(zerocopy.WithUDPSessionTargetAddr(ctx, queuedPacket.targetAddr))
 				if err != nil {
 					lnc.logger.Warn("Failed to create new UDP client session",
 						zap.Stringer("clientAddress", clientAddrPort),
@@ -320,7 +479,16 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 					return
 				}
 
-				natConn, _, err := clientInfo.ListenConfig.ListenUDP(ctx, "udp", "")
+				natConnListenConfig := clientInfo.ListenConfig
+				if s.trafficClass != 0 {
+					natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+				}
+				if lnc.batchMode == "gso" {
+					natConnListenConfig = natConnListenConfig.WithUDPOffload()
+				}
+				natConnListenConfig = natConnListenConfig.WithReceiveErrors()
+
+				natConn, natConnInfo, err := natConnListenConfig.ListenUDP(ctx, "udp", "")
 				if err != nil {
 					lnc.logger.Warn("Failed to create UDP socket for new NAT session",
 						zap.Stringer("clientAddress", clientAddrPort),
@@ -332,13 +500,18 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 					return
 				}
 
-				err = natConn.SetReadDeadline(time.Now().Add(lnc.natTimeout))
+				// Count natConn for the lifetime of the session goroutine.
+				s.resources.AddFDs(1)
+				defer s.resources.AddFDs(-1)
+
+				natTimeout := lnc.natTimeoutFor(clientInfo)
+				err = natConn.SetReadDeadline(time.Now().Add(natTimeout))
 				if err != nil {
 					lnc.logger.Warn("Failed to set read deadline on natConn",
 						zap.Stringer("clientAddress", clientAddrPort),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.String("client", clientInfo.Name),
-						zap.Duration("natTimeout", lnc.natTimeout),
+						zap.Duration("natTimeout", natTimeout),
 						zap.Error(err),
 					)
 					natConn.Close()
@@ -374,35 +547,80 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 					zap.String("client", clientInfo.Name),
 				)
 
+				sessionEvent := event.Event{
+					Kind:          event.KindSessionCreated,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: clientAddrPort,
+					TargetAddress: queuedPacket.targetAddr,
+					Client:        clientInfo.Name,
+				}
+				s.events.Publish(sessionEvent)
+				entry.record.setEvent(sessionEvent)
+
+				tracked := s.connTable.Add("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress, sessionEvent.Client, func() {
+					entry.record.setCloseReason(event.CloseReasonClosed)
+					natConn.Close()
+				})
+
+				flow := s.captures.NewFlow("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress)
+
+				pathMTU := newNatConnPathMTU(natConn, tracked, lnc.logger.With(
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.String("client", clientInfo.Name),
+				))
+
+				filter := s.natFiltering.newFilter()
+				uplinkRateLimit := s.rateLimiter.Acquire("", clientAddrPort.Addr())
+				downlinkRateLimit := s.rateLimiter.Acquire("", clientAddrPort.Addr())
+
 				s.wg.Add(1)
 
-				go func() {
+				s.resources.Go(func() {
 					s.relayServerConnToNatConnGeneric(ctx, natUplinkGeneric{
 						clientName:     clientInfo.Name,
 						clientAddrPort: clientAddrPort,
 						natConn:        natConn,
+						natConnInfo:    natConnInfo,
 						natConnSendCh:  natConnSendCh,
 						natConnPacker:  clientSession.Packer,
-						natTimeout:     lnc.natTimeout,
+						natTimeout:     natTimeout,
+						pathMTU:        pathMTU,
+						rateLimit:      uplinkRateLimit,
+						filter:         filter,
+						tracked:        tracked,
+						flow:           flow,
+						record:         entry.record,
 						logger:         lnc.logger,
 					})
+					uplinkRateLimit.Release()
 					natConn.Close()
 					clientSession.Close()
 					s.wg.Done()
-				}()
+				})
 
 				s.relayNatConnToServerConnGeneric(natDownlinkGeneric{
 					clientName:         clientInfo.Name,
 					clientAddrPort:     clientAddrPort,
 					clientPktinfo:      &entry.clientPktinfo,
 					natConn:            natConn,
+					natConnInfo:        natConnInfo,
 					natConnRecvBufSize: clientSession.MaxPacketSize,
 					natConnUnpacker:    clientSession.Unpacker,
 					serverConn:         lnc.serverConn,
+					serverConnInfo:     lnc.serverConnInfo,
 					serverConnPacker:   serverConnPacker,
+					pathMTU:            pathMTU,
+					rateLimit:          downlinkRateLimit,
+					filter:             filter,
+					tracked:            tracked,
+					flow:               flow,
+					record:             entry.record,
 					logger:             lnc.logger,
 				})
-			}()
+				downlinkRateLimit.Release()
+				tracked.Remove()
+			})
 
 			if ce := lnc.logger.Check(zap.DebugLevel, "New UDP NAT session"); ce != nil {
 				ce.Write(
@@ -410,6 +628,8 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 				)
 			}
+		} else if entry.lruElem != nil {
+			s.lru.touch(entry.lruElem)
 		}
 
 		select {
@@ -436,17 +656,51 @@ func (s *UDPNATRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRel
 
 func (s *UDPNATRelay) relayServerConnToNatConnGeneric(ctx context.Context, uplink natUplinkGeneric) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		packetsSent      uint64
-		payloadBytesSent uint64
+		destAddrPort            netip.AddrPort
+		packetStart             int
+		packetLength            int
+		err                     error
+		packetsSent             uint64
+		payloadBytesSent        uint64
+		packetsDropped          uint64
+		oversizedPacketsDropped uint64
 	)
 
+	natConnWriter := conn.NewUDPGSOWriter(uplink.natConn, uplink.natConnInfo.MaxUDPGSOSegments)
+
+	// flushIfIdle sends out coalesced packets when there are no more queued packets.
+	flushIfIdle := func() {
+		if len(uplink.natConnSendCh) > 0 {
+			return
+		}
+		if err := natConnWriter.Flush(); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				uplink.pathMTU.readErrors()
+			}
+			uplink.logger.Warn("Failed to write packets to natConn",
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.String("client", uplink.clientName),
+				zap.Stringer("lastWriteDestAddress", destAddrPort),
+				zap.Error(err),
+			)
+		}
+	}
+
 	for queuedPacket := range uplink.natConnSendCh {
+		if !uplink.rateLimit.AllowUplink(queuedPacket.length) {
+			packetsDropped++
+			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
+			continue
+		}
+
+		uplink.flow.UplinkDatagram(queuedPacket.targetAddr, queuedPacket.buf[queuedPacket.start:queuedPacket.start+queuedPacket.length])
+
 		destAddrPort, packetStart, packetLength, err = uplink.natConnPacker.PackInPlace(ctx, queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
 		if err != nil {
+			if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+				oversizedPacketsDropped++
+			}
 			uplink.logger.Warn("Failed to pack packet for natConn",
 				zap.Stringer("clientAddress", uplink.clientAddrPort),
 				zap.Stringer("targetAddress", &queuedPacket.targetAddr),
@@ -456,11 +710,34 @@ func (s *UDPNATRelay) relayServerConnToNatConnGeneric(ctx context.Context, uplin
 			)
 
 			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
 			continue
 		}
 
-		_, err = uplink.natConn.WriteToUDPAddrPort(queuedPacket.buf[packetStart:packetStart+packetLength], destAddrPort)
+		if maxPacketSize := uplink.pathMTU.maxPacketSize(destAddrPort.Addr()); maxPacketSize > 0 && packetLength > maxPacketSize {
+			oversizedPacketsDropped++
+			if ce := uplink.logger.Check(zap.DebugLevel, "Dropping packet exceeding path MTU"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", uplink.clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+					zap.String("client", uplink.clientName),
+					zap.Int("packetLength", packetLength),
+					zap.Int("maxPacketSize", maxPacketSize),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
+			continue
+		}
+
+		uplink.filter.permit(destAddrPort)
+
+		err = natConnWriter.WriteMsgUDPAddrPort(queuedPacket.buf[packetStart:packetStart+packetLength], nil, destAddrPort)
 		if err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				uplink.pathMTU.readErrors()
+			}
 			uplink.logger.Warn("Failed to write packet to natConn",
 				zap.Stringer("clientAddress", uplink.clientAddrPort),
 				zap.Stringer("targetAddress", &queuedPacket.targetAddr),
@@ -481,9 +758,11 @@ func (s *UDPNATRelay) relayServerConnToNatConnGeneric(ctx context.Context, uplin
 			)
 		}
 
-		s.putQueuedPacket(queuedPacket)
 		packetsSent++
 		payloadBytesSent += uint64(queuedPacket.length)
+		uplink.tracked.AddUplinkBytes(uint64(queuedPacket.length))
+		s.putQueuedPacket(queuedPacket)
+		flushIfIdle()
 	}
 
 	uplink.logger.Info("Finished relay serverConn -> natConn",
@@ -495,6 +774,13 @@ func (s *UDPNATRelay) relayServerConnToNatConnGeneric(ctx context.Context, uplin
 	)
 
 	s.collector.CollectUDPSessionUplink("", packetsSent, payloadBytesSent)
+	uplink.record.finishUplink(s.events, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit("", 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 {
+		s.collector.CollectOversizedPackets("", oversizedPacketsDropped, 0)
+	}
 }
 
 func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneric) {
@@ -505,22 +791,46 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneri
 	headroom := zerocopy.UDPRelayHeadroom(serverConnPackerInfo.Headroom, natConnUnpackerInfo.Headroom)
 
 	var (
-		clientPktinfo    []byte
-		clientPktinfop   *[]byte
-		packetsSent      uint64
-		payloadBytesSent uint64
+		clientPktinfo             []byte
+		clientPktinfop            *[]byte
+		packetsSent               uint64
+		payloadBytesSent          uint64
+		packetsDropped            uint64
+		packetsFiltered           uint64
+		oversizedPacketsDropped   uint64
+		oversizedPacketsTruncated uint64
 	)
 
 	packetBuf := make([]byte, headroom.Front+downlink.natConnRecvBufSize+headroom.Rear)
 	recvBuf := packetBuf[headroom.Front : headroom.Front+downlink.natConnRecvBufSize]
 
+	natConnReader := newUDPMsgReader(downlink.natConn, downlink.natConnInfo)
+	serverConnWriter := conn.NewUDPGSOWriter(downlink.serverConn, downlink.serverConnInfo.MaxUDPGSOSegments)
+
 	for {
-		n, _, flags, packetSourceAddrPort, err := downlink.natConn.ReadMsgUDPAddrPort(recvBuf, nil)
+		// Send out coalesced packets before blocking on the next read.
+		if natConnReader.Buffered() == 0 {
+			if err := serverConnWriter.Flush(); err != nil {
+				downlink.logger.Warn("Failed to write packets to serverConn",
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.String("client", downlink.clientName),
+					zap.Error(err),
+				)
+			}
+		}
+
+		n, _, flags, packetSourceAddrPort, err := natConnReader.ReadMsgUDPAddrPort(recvBuf, nil)
 		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
+			// natConn is closed when the session is forcibly terminated.
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
 				break
 			}
 
+			// Queued ICMP errors fail reads. They are not errors of the relay.
+			if downlink.pathMTU.readErrors() {
+				continue
+			}
+
 			downlink.logger.Warn("Failed to read packet from natConn",
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
 				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
@@ -542,6 +852,11 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneri
 			continue
 		}
 
+		if !downlink.filter.allows(packetSourceAddrPort) {
+			packetsFiltered++
+			continue
+		}
+
 		payloadSourceAddrPort, payloadStart, payloadLength, err := downlink.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, headroom.Front, n)
 		if err != nil {
 			downlink.logger.Warn("Failed to unpack packet from natConn",
@@ -554,7 +869,27 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneri
 			continue
 		}
 
+		if !downlink.rateLimit.AllowDownlink(payloadLength) {
+			packetsDropped++
+			continue
+		}
+
+		downlink.flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLength])
+
 		packetStart, packetLength, err := downlink.serverConnPacker.PackInPlace(packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+		if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+			if s.oversizedPayloadPolicy.truncatesFrom(payloadSourceAddrPort) {
+				var truncatedPayloadLength int
+				packetStart, packetLength, truncatedPayloadLength, err = packTruncatedDNSResponse(downlink.serverConnPacker, packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+				if err == nil {
+					payloadLength = truncatedPayloadLength
+					oversizedPacketsTruncated++
+				}
+			}
+			if err != nil {
+				oversizedPacketsDropped++
+			}
+		}
 		if err != nil {
 			downlink.logger.Warn("Failed to pack packet for serverConn",
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -573,7 +908,7 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneri
 			clientPktinfop = cpp
 		}
 
-		_, _, err = downlink.serverConn.WriteMsgUDPAddrPort(packetBuf[packetStart:packetStart+packetLength], clientPktinfo, downlink.clientAddrPort)
+		err = serverConnWriter.WriteMsgUDPAddrPort(packetBuf[packetStart:packetStart+packetLength], clientPktinfo, downlink.clientAddrPort)
 		if err != nil {
 			downlink.logger.Warn("Failed to write packet to serverConn",
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -587,6 +922,7 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneri
 
 		packetsSent++
 		payloadBytesSent += uint64(payloadLength)
+		downlink.tracked.AddDownlinkBytes(uint64(payloadLength))
 	}
 
 	downlink.logger.Info("Finished relay serverConn <- natConn",
@@ -594,21 +930,102 @@ func (s *UDPNATRelay) relayNatConnToServerConnGeneric(downlink natDownlinkGeneri
 		zap.String("client", downlink.clientName),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Uint64("packetsFiltered", packetsFiltered),
 	)
 
 	s.collector.CollectUDPSessionDownlink("", packetsSent, payloadBytesSent)
+	downlink.record.finishDownlink(s.events, downlink.clientAddrPort, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit("", 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 || oversizedPacketsTruncated > 0 {
+		s.collector.CollectOversizedPackets("", oversizedPacketsDropped, oversizedPacketsTruncated)
+	}
 }
 
 // getQueuedPacket retrieves a queued packet from the pool.
 func (s *UDPNATRelay) getQueuedPacket() *natQueuedPacket {
-	return s.queuedPacketPool.Get().(*natQueuedPacket)
+	queuedPacket := s.queuedPacketPool.Get()
+	s.resources.GetBuffer(len(queuedPacket.buf))
+	return queuedPacket
 }
 
 // putQueuedPacket puts the queued packet back into the pool.
 func (s *UDPNATRelay) putQueuedPacket(queuedPacket *natQueuedPacket) {
+	s.resources.PutBuffer(len(queuedPacket.buf))
 	s.queuedPacketPool.Put(queuedPacket)
 }
 
+// serverFor returns the server for sessions started on the listener.
+func (s *UDPNATRelay) serverFor(lnc *udpRelayServerConn) zerocopy.UDPNATServer {
+	if lnc.natServer != nil {
+		return lnc.natServer
+	}
+	return s.server
+}
+
+// evictLeastRecentlyActiveSession removes the least recently active session from the table and shuts it down,
+// to make room for a new session.
+//
+// It must be called with s.mu held.
+func (s *UDPNATRelay) evictLeastRecentlyActiveSession() {
+	key, ok := s.lru.popOldest()
+	if !ok {
+		return
+	}
+	entry := s.table[key]
+	delete(s.table, key)
+
+	entry.record.setCloseReason(event.CloseReasonEvicted)
+	if natConn := entry.state.Swap(entry.serverConn); natConn != nil {
+		if err := natConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
+			entry.logger.Warn("Failed to set read deadline on natConn",
+				zap.Stringer("clientAddress", key.clientAddrPort),
+				zap.Error(err),
+			)
+		}
+	}
+
+	if ce := entry.logger.Check(zap.DebugLevel, "Evicted least recently active UDP NAT session"); ce != nil {
+		ce.Write(
+			zap.Stringer("clientAddress", key.clientAddrPort),
+			zap.Int("maxSessions", s.maxSessions),
+		)
+	}
+	s.collector.CollectUDPSessionEviction("")
+}
+
+// removeEntry removes the session's entry from the table, unless it has been evicted and replaced.
+//
+// It must be called with s.mu held.
+func (s *UDPNATRelay) removeEntry(key natKey, entry *natEntry) {
+	if s.table[key] == entry {
+		delete(s.table, key)
+	}
+	if entry.lruElem != nil {
+		s.lru.remove(entry.lruElem)
+	}
+}
+
+// sendPortUnreachable tells the client that the destination of its first packet was rejected,
+// if the relay can send ICMP port unreachable messages.
+func (s *UDPNATRelay) sendPortUnreachable(lnc *udpRelayServerConn, entry *natEntry, clientAddrPort netip.AddrPort, payloadLen int) {
+	if s.portUnreachable == nil {
+		return
+	}
+
+	// The quoted packet must be addressed to where the client sent it,
+	// which is the pktinfo address when listening on an unspecified address.
+	localAddrPort := lnc.listenAddrPort
+	if cpp := entry.clientPktinfo.Load(); cpp != nil {
+		if m, err := conn.ParseSocketControlMessage(*cpp); err == nil && m.PktinfoAddr.IsValid() {
+			localAddrPort = netip.AddrPortFrom(m.PktinfoAddr, localAddrPort.Port())
+		}
+	}
+
+	s.portUnreachable.Send(clientAddrPort, localAddrPort, payloadLen)
+}
+
 // Stop implements the Service Stop method.
 func (s *UDPNATRelay) Stop() error {
 	for i := range s.listeners {
@@ -623,7 +1040,8 @@ func (s *UDPNATRelay) Stop() error {
 	s.mwg.Wait()
 
 	s.mu.Lock()
-	for clientAddrPort, entry := range s.table {
+	for key, entry := range s.table {
+		entry.record.setCloseReason(event.CloseReasonShutdown)
 		natConn := entry.state.Swap(entry.serverConn)
 		if natConn == nil {
 			continue
@@ -631,7 +1049,7 @@ func (s *UDPNATRelay) Stop() error {
 
 		if err := natConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
 			entry.logger.Warn("Failed to set read deadline on natConn",
-				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("clientAddress", key.clientAddrPort),
 				zap.Error(err),
 			)
 		}
@@ -647,7 +1065,29 @@ func (s *UDPNATRelay) Stop() error {
 		if err := lnc.serverConn.Close(); err != nil {
 			lnc.logger.Warn("Failed to close serverConn", zap.Error(err))
 		}
+		s.resources.AddFDs(-1)
+	}
+
+	if s.portUnreachable != nil {
+		s.portUnreachable.Close()
 	}
 
 	return nil
 }
+
+// Drain implements [Drainer.Drain].
+// Sessions finish when they are idle for the NAT timeout.
+func (s *UDPNATRelay) Drain(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	var closed int
+	if !waitGroupWait(ctx, &s.wg) {
+		s.mu.Lock()
+		closed = len(s.table)
+		s.mu.Unlock()
+	}
+
+	return closed, s.Stop()
+}
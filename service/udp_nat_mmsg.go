@@ -6,14 +6,22 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"net"
 	"net/netip"
 	"os"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -27,7 +35,14 @@ type natUplinkMmsg struct {
 	natConnSendCh  <-chan *natQueuedPacket
 	natConnPacker  zerocopy.ClientPacker
 	natTimeout     time.Duration
+	pathMTU        *natConnPathMTU
+	rateLimit      *ratelimit.Handle
+	filter         *natFilter
 	relayBatchSize int
+	v4Mapped       bool
+	tracked        *conntrack.Entry
+	flow           *capture.Flow
+	record         *udpSessionRecord
 	logger         *zap.Logger
 }
 
@@ -42,7 +57,13 @@ type natDownlinkMmsg struct {
 	natConnUnpacker    zerocopy.ClientUnpacker
 	serverConn         *conn.MmsgWConn
 	serverConnPacker   zerocopy.ServerPacker
+	pathMTU            *natConnPathMTU
+	rateLimit          *ratelimit.Handle
+	filter             *natFilter
 	relayBatchSize     int
+	tracked            *conntrack.Entry
+	flow               *capture.Flow
+	record             *udpSessionRecord
 	logger             *zap.Logger
 }
 
@@ -62,6 +83,7 @@ func (s *UDPNATRelay) startMmsg(ctx context.Context, index int, lnc *udpRelaySer
 	}
 	lnc.serverConn = serverConn.UDPConn
 	lnc.address = serverConn.LocalAddr().String()
+	lnc.listenAddrPort = lnc.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
 	lnc.logger = s.logger.With(
 		zap.String("server", s.serverName),
 		zap.Int("listener", index),
@@ -70,10 +92,11 @@ func (s *UDPNATRelay) startMmsg(ctx context.Context, index int, lnc *udpRelaySer
 
 	s.mwg.Add(1)
 
-	go func() {
+	s.resources.Go(func() {
+		lnc.pinReceiveRoutine()
 		s.recvFromServerConnRecvmmsg(ctx, lnc, serverConn.NewRConn())
 		s.mwg.Done()
-	}()
+	})
 
 	lnc.logger.Info("Started UDP NAT relay service listener")
 	return nil
@@ -152,6 +175,17 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 				continue
 			}
 
+			if !lnc.acl.Allowed(clientAddrPort.Addr()) {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet denied by ACL"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+					)
+				}
+				s.collector.CollectRejection(stats.RejectionKindACL, "udp", clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
 				lnc.logger.Warn("Packet from serverConn discarded",
@@ -164,19 +198,61 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 				continue
 			}
 
-			entry, ok := s.table[clientAddrPort]
+			key := natKey{lnc, clientAddrPort}
+			entry, ok := s.table[key]
+			if !ok && s.maxSessions > 0 && len(s.table) >= s.maxSessions && s.sessionLimitPolicy == udpSessionLimitDrop {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session limit"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Int("maxSessions", s.maxSessions),
+					)
+				}
+				s.collector.CollectRejection(stats.RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, errUDPSessionLimit)
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+			if !ok && s.draining {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet of new UDP session while draining"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+			if !ok && !s.acceptRampUp.Allow() {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session ramp-up rate"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+					)
+				}
+				s.collector.CollectRejection(stats.RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, errUDPSessionRampUp)
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
 			if !ok {
 				entry = &natEntry{
 					serverConn: lnc.serverConn,
 					logger:     lnc.logger,
 				}
 
-				entry.serverConnUnpacker, err = s.server.NewUnpacker()
+				entry.serverConnUnpacker, err = s.serverFor(lnc).NewUnpacker()
 				if err != nil {
 					lnc.logger.Warn("Failed to create unpacker for serverConn",
 						zap.Stringer("clientAddress", clientAddrPort),
 						zap.Error(err),
 					)
+					s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", clientAddrPort, "", conn.Addr{}, err)
+					s.events.Publish(event.Event{
+						Kind:          event.KindAuthFailed,
+						Server:        s.serverName,
+						Network:       "udp",
+						ClientAddress: clientAddrPort,
+						Error:         err.Error(),
+					})
 					s.putQueuedPacket(queuedPacket)
 					continue
 				}
@@ -189,6 +265,14 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 					zap.Uint32("packetLength", msg.Msglen),
 					zap.Error(err),
 				)
+				s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", clientAddrPort, "", conn.Addr{}, err)
+				s.events.Publish(event.Event{
+					Kind:          event.KindAuthFailed,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: clientAddrPort,
+					Error:         err.Error(),
+				})
 				s.putQueuedPacket(queuedPacket)
 				continue
 			}
@@ -227,18 +311,28 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 			}
 
 			if !ok {
+				if s.maxSessions > 0 && len(s.table) >= s.maxSessions {
+					s.evictLeastRecentlyActiveSession()
+				}
+
 				natConnSendCh := make(chan *natQueuedPacket, lnc.sendChannelCapacity)
+				removeNatConnSendCh := resource.AddChannel(s.resources, natConnSendCh)
 				entry.natConnSendCh = natConnSendCh
-				s.table[clientAddrPort] = entry
+				entry.record = newUDPSessionRecord()
+				if s.sessionLimitPolicy == udpSessionLimitEvictLRU {
+					entry.lruElem = s.lru.add(key)
+				}
+				s.table[key] = entry
 				s.wg.Add(1)
 
-				go func() {
+				s.resources.Go(func() {
 					var sendChClean bool
 
 					defer func() {
 						s.mu.Lock()
+						removeNatConnSendCh()
 						close(natConnSendCh)
-						delete(s.table, clientAddrPort)
+						s.removeEntry(key, entry)
 						s.mu.Unlock()
 
 						if !sendChClean {
@@ -252,6 +346,7 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 
 					c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
 						ServerIndex:    s.serverIndex,
+						ListenAddrPort: lnc.listenAddrPort,
 						SourceAddrPort: clientAddrPort,
 						TargetAddr:     queuedPacket.targetAddr,
 					})
@@ -261,10 +356,16 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 							zap.Error(err),
 						)
+						if mode, ok := router.RejectModeOf(err); ok {
+							s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, "", queuedPacket.targetAddr, err)
+							if mode == router.RejectModeReset {
+								s.sendPortUnreachable(lnc, entry, clientAddrPort, int(queuedPacket.length))
+							}
+						}
 						return
 					}
 
-					clientInfo, clientSession, err := c.NewSession(ctx)
+					clientInfo, clientSession, err := c.NewSession(zerocopy.WithUDPSessionTargetAddr(ctx, queuedPacket.targetAddr))
 					if err != nil {
 						lnc.logger.Warn("Failed to create new UDP client session",
 							zap.Stringer("clientAddress", clientAddrPort),
@@ -275,7 +376,13 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 						return
 					}
 
-					natConn, _, err := clientInfo.ListenConfig.ListenUDPMmsgConn(ctx, "udp", "")
+					natConnListenConfig := clientInfo.ListenConfig
+					if s.trafficClass != 0 {
+						natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+					}
+					natConnListenConfig = natConnListenConfig.WithReceiveErrors()
+
+					natConn, natConnInfo, err := natConnListenConfig.ListenUDPMmsgConn(ctx, "udp", "")
 					if err != nil {
 						lnc.logger.Warn("Failed to create UDP socket for new NAT session",
 							zap.Stringer("clientAddress", clientAddrPort),
@@ -287,13 +394,18 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 						return
 					}
 
-					err = natConn.SetReadDeadline(time.Now().Add(lnc.natTimeout))
+					// Count natConn for the lifetime of the session goroutine.
+					s.resources.AddFDs(1)
+					defer s.resources.AddFDs(-1)
+
+					natTimeout := lnc.natTimeoutFor(clientInfo)
+					err = natConn.SetReadDeadline(time.Now().Add(natTimeout))
 					if err != nil {
 						lnc.logger.Warn("Failed to set read deadline on natConn",
 							zap.Stringer("clientAddress", clientAddrPort),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 							zap.String("client", clientInfo.Name),
-							zap.Duration("natTimeout", lnc.natTimeout),
+							zap.Duration("natTimeout", natTimeout),
 							zap.Error(err),
 						)
 						natConn.Close()
@@ -329,23 +441,58 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 						zap.String("client", clientInfo.Name),
 					)
 
+					sessionEvent := event.Event{
+						Kind:          event.KindSessionCreated,
+						Server:        s.serverName,
+						Network:       "udp",
+						ClientAddress: clientAddrPort,
+						TargetAddress: queuedPacket.targetAddr,
+						Client:        clientInfo.Name,
+					}
+					s.events.Publish(sessionEvent)
+					entry.record.setEvent(sessionEvent)
+
+					tracked := s.connTable.Add("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress, sessionEvent.Client, func() {
+						entry.record.setCloseReason(event.CloseReasonClosed)
+						natConn.Close()
+					})
+
+					flow := s.captures.NewFlow("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress)
+
+					pathMTU := newNatConnPathMTU(natConn.UDPConn, tracked, lnc.logger.With(
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.String("client", clientInfo.Name),
+					))
+
+					filter := s.natFiltering.newFilter()
+					uplinkRateLimit := s.rateLimiter.Acquire("", clientAddrPort.Addr())
+					downlinkRateLimit := s.rateLimiter.Acquire("", clientAddrPort.Addr())
+
 					s.wg.Add(1)
 
-					go func() {
+					s.resources.Go(func() {
 						s.relayServerConnToNatConnSendmmsg(ctx, natUplinkMmsg{
 							clientName:     clientInfo.Name,
 							clientAddrPort: clientAddrPort,
 							natConn:        natConn.NewWConn(),
 							natConnSendCh:  natConnSendCh,
 							natConnPacker:  clientSession.Packer,
-							natTimeout:     lnc.natTimeout,
+							natTimeout:     natTimeout,
+							pathMTU:        pathMTU,
+							rateLimit:      uplinkRateLimit,
+							filter:         filter,
 							relayBatchSize: lnc.relayBatchSize,
+							v4Mapped:       lnc.useV4MappedDestinations(natConn, natConnInfo),
+							tracked:        tracked,
+							flow:           flow,
+							record:         entry.record,
 							logger:         lnc.logger,
 						})
+						uplinkRateLimit.Release()
 						natConn.Close()
 						clientSession.Close()
 						s.wg.Done()
-					}()
+					})
 
 					s.relayNatConnToServerConnSendmmsg(natDownlinkMmsg{
 						clientName:         clientInfo.Name,
@@ -357,10 +504,18 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 						natConnUnpacker:    clientSession.Unpacker,
 						serverConn:         serverConn.NewWConn(),
 						serverConnPacker:   serverConnPacker,
+						pathMTU:            pathMTU,
+						rateLimit:          downlinkRateLimit,
+						filter:             filter,
 						relayBatchSize:     lnc.relayBatchSize,
+						tracked:            tracked,
+						flow:               flow,
+						record:             entry.record,
 						logger:             lnc.logger,
 					})
-				}()
+					downlinkRateLimit.Release()
+					tracked.Remove()
+				})
 
 				if ce := lnc.logger.Check(zap.DebugLevel, "New UDP NAT session"); ce != nil {
 					ce.Write(
@@ -368,6 +523,8 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 					)
 				}
+			} else if entry.lruElem != nil {
+				s.lru.touch(entry.lruElem)
 			}
 
 			select {
@@ -401,14 +558,16 @@ func (s *UDPNATRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *udpRe
 
 func (s *UDPNATRelay) relayServerConnToNatConnSendmmsg(ctx context.Context, uplink natUplinkMmsg) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
-		burstBatchSize   int
+		destAddrPort            netip.AddrPort
+		packetStart             int
+		packetLength            int
+		err                     error
+		sendmmsgCount           uint64
+		packetsSent             uint64
+		payloadBytesSent        uint64
+		packetsDropped          uint64
+		oversizedPacketsDropped uint64
+		burstBatchSize          int
 	)
 
 	qpvec := make([]*natQueuedPacket, uplink.relayBatchSize)
@@ -436,8 +595,23 @@ main:
 
 	dequeue:
 		for {
+			if !uplink.rateLimit.AllowUplink(queuedPacket.length) {
+				packetsDropped++
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
+			uplink.flow.UplinkDatagram(queuedPacket.targetAddr, queuedPacket.buf[queuedPacket.start:queuedPacket.start+queuedPacket.length])
+
 			destAddrPort, packetStart, packetLength, err = uplink.natConnPacker.PackInPlace(ctx, queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
 			if err != nil {
+				if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+					oversizedPacketsDropped++
+				}
 				uplink.logger.Warn("Failed to pack packet for natConn",
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
@@ -454,13 +628,36 @@ main:
 				goto next
 			}
 
+			if maxPacketSize := uplink.pathMTU.maxPacketSize(destAddrPort.Addr()); maxPacketSize > 0 && packetLength > maxPacketSize {
+				oversizedPacketsDropped++
+				if ce := uplink.logger.Check(zap.DebugLevel, "Dropping packet exceeding path MTU"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", uplink.clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.String("client", uplink.clientName),
+						zap.Int("packetLength", packetLength),
+						zap.Int("maxPacketSize", maxPacketSize),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
+			uplink.filter.permit(destAddrPort)
+
 			qpvec[count] = queuedPacket
 			dapvec[count] = destAddrPort
-			namevec[count] = conn.AddrPortToSockaddrInet6(destAddrPort)
+			msgvec[count].Msghdr.Namelen = putDestSockaddr(&namevec[count], destAddrPort, uplink.v4Mapped)
 			iovec[count].Base = &queuedPacket.buf[packetStart]
 			iovec[count].SetLen(packetLength)
 			count++
 			payloadBytesSent += uint64(queuedPacket.length)
+			uplink.tracked.AddUplinkBytes(uint64(queuedPacket.length))
 
 			if count == uplink.relayBatchSize {
 				break
@@ -481,6 +678,9 @@ main:
 			n, err := uplink.natConn.WriteMsgs(msgvec[start:count], 0)
 			start += n
 			if err != nil {
+				if errors.Is(err, syscall.EMSGSIZE) {
+					uplink.pathMTU.readErrors()
+				}
 				uplink.logger.Warn("Failed to batch write packets to natConn",
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
 					zap.Stringer("targetAddress", &qpvec[start].targetAddr),
@@ -528,6 +728,13 @@ main:
 	)
 
 	s.collector.CollectUDPSessionUplink("", packetsSent, payloadBytesSent)
+	uplink.record.finishUplink(s.events, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit("", 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 {
+		s.collector.CollectOversizedPackets("", oversizedPacketsDropped, 0)
+	}
 }
 
 func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg) {
@@ -540,10 +747,14 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg)
 	headroom := zerocopy.UDPRelayHeadroom(serverConnPackerInfo.Headroom, natConnUnpackerInfo.Headroom)
 
 	var (
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
-		burstBatchSize   int
+		sendmmsgCount             uint64
+		packetsSent               uint64
+		payloadBytesSent          uint64
+		packetsDropped            uint64
+		packetsFiltered           uint64
+		oversizedPacketsDropped   uint64
+		oversizedPacketsTruncated uint64
+		burstBatchSize            int
 	)
 
 	name, namelen := conn.AddrPortToSockaddr(downlink.clientAddrPort)
@@ -577,10 +788,16 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg)
 	for {
 		nr, err := downlink.natConn.ReadMsgs(rmsgvec, 0)
 		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
+			// natConn is closed when the session is forcibly terminated.
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
 				break
 			}
 
+			// Queued ICMP errors fail reads. They are not errors of the relay.
+			if downlink.pathMTU.readErrors() {
+				continue
+			}
+
 			downlink.logger.Warn("Failed to batch read packets from natConn",
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
 				zap.String("client", downlink.clientName),
@@ -617,6 +834,11 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg)
 				continue
 			}
 
+			if !downlink.filter.allows(packetSourceAddrPort) {
+				packetsFiltered++
+				continue
+			}
+
 			packetBuf := bufvec[i]
 
 			payloadSourceAddrPort, payloadStart, payloadLength, err := downlink.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, headroom.Front, int(msg.Msglen))
@@ -631,7 +853,27 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg)
 				continue
 			}
 
+			if !downlink.rateLimit.AllowDownlink(payloadLength) {
+				packetsDropped++
+				continue
+			}
+
+			downlink.flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLength])
+
 			packetStart, packetLength, err := downlink.serverConnPacker.PackInPlace(packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+			if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+				if s.oversizedPayloadPolicy.truncatesFrom(payloadSourceAddrPort) {
+					var truncatedPayloadLength int
+					packetStart, packetLength, truncatedPayloadLength, err = packTruncatedDNSResponse(downlink.serverConnPacker, packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+					if err == nil {
+						payloadLength = truncatedPayloadLength
+						oversizedPacketsTruncated++
+					}
+				}
+				if err != nil {
+					oversizedPacketsDropped++
+				}
+			}
 			if err != nil {
 				downlink.logger.Warn("Failed to pack packet for serverConn",
 					zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -649,6 +891,7 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg)
 			siovec[ns].SetLen(packetLength)
 			ns++
 			payloadBytesSent += uint64(payloadLength)
+			downlink.tracked.AddDownlinkBytes(uint64(payloadLength))
 		}
 
 		if ns == 0 {
@@ -690,8 +933,16 @@ func (s *UDPNATRelay) relayNatConnToServerConnSendmmsg(downlink natDownlinkMmsg)
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Uint64("packetsFiltered", packetsFiltered),
 		zap.Int("burstBatchSize", burstBatchSize),
 	)
 
 	s.collector.CollectUDPSessionDownlink("", packetsSent, payloadBytesSent)
+	downlink.record.finishDownlink(s.events, downlink.clientAddrPort, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit("", 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 || oversizedPacketsTruncated > 0 {
+		s.collector.CollectOversizedPackets("", oversizedPacketsDropped, oversizedPacketsTruncated)
+	}
 }
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// natFilteringBehavior controls which remote endpoints can send packets to a UDP relay session's natConn,
+// as described in RFC 4787 section 5.
+//
+// The mapping behavior is always endpoint-independent, as each session uses a single natConn for all destinations.
+type natFilteringBehavior uint8
+
+const (
+	// natFilteringEndpointIndependent accepts packets from any remote endpoint. This is also known as full cone.
+	natFilteringEndpointIndependent natFilteringBehavior = iota
+
+	// natFilteringAddressDependent accepts packets from remote addresses the session has sent packets to.
+	// This is also known as address-restricted cone.
+	natFilteringAddressDependent
+
+	// natFilteringAddressAndPortDependent accepts packets from remote addresses and ports the session has sent packets to.
+	// This is also known as port-restricted cone.
+	natFilteringAddressAndPortDependent
+)
+
+// parseNATFilteringBehavior parses the NAT filtering behavior from its configuration value.
+func parseNATFilteringBehavior(s string) (natFilteringBehavior, error) {
+	switch s {
+	case "", "endpointIndependent":
+		return natFilteringEndpointIndependent, nil
+	case "addressDependent":
+		return natFilteringAddressDependent, nil
+	case "addressAndPortDependent":
+		return natFilteringAddressAndPortDependent, nil
+	default:
+		return 0, fmt.Errorf("invalid UDP NAT filtering behavior: %q", s)
+	}
+}
+
+// newFilter returns a new filter for a UDP relay session,
+// or nil if the behavior accepts packets from any remote endpoint.
+func (b natFilteringBehavior) newFilter() *natFilter {
+	if b == natFilteringEndpointIndependent {
+		return nil
+	}
+	return &natFilter{
+		portDependent: b == natFilteringAddressAndPortDependent,
+		endpoints:     make(map[netip.AddrPort]struct{}),
+	}
+}
+
+// natFilter tracks the remote endpoints a UDP relay session has sent packets to,
+// and decides whether packets received from a remote endpoint are accepted.
+//
+// The uplink goroutine calls permit and the downlink goroutine calls allows concurrently.
+// A nil *natFilter accepts packets from any remote endpoint.
+type natFilter struct {
+	portDependent bool
+	mu            sync.RWMutex
+	endpoints     map[netip.AddrPort]struct{}
+}
+
+// key returns the map key for the remote endpoint.
+func (f *natFilter) key(addrPort netip.AddrPort) netip.AddrPort {
+	addr := addrPort.Addr().Unmap()
+	if !f.portDependent {
+		return netip.AddrPortFrom(addr, 0)
+	}
+	return netip.AddrPortFrom(addr, addrPort.Port())
+}
+
+// permit allows packets from the remote endpoint the session is sending a packet to.
+func (f *natFilter) permit(destAddrPort netip.AddrPort) {
+	if f == nil {
+		return
+	}
+
+	key := f.key(destAddrPort)
+
+	f.mu.RLock()
+	_, ok := f.endpoints[key]
+	f.mu.RUnlock()
+	if ok {
+		return
+	}
+
+	f.mu.Lock()
+	f.endpoints[key] = struct{}{}
+	f.mu.Unlock()
+}
+
+// allows returns whether a packet from the remote endpoint is accepted.
+func (f *natFilter) allows(packetSourceAddrPort netip.AddrPort) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.RLock()
+	_, ok := f.endpoints[f.key(packetSourceAddrPort)]
+	f.mu.RUnlock()
+	return ok
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"net"
@@ -9,9 +10,17 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/database64128/shadowsocks-go/affinity"
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
 	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -31,6 +40,10 @@ type sessionQueuedPacket struct {
 type sessionClientAddrInfo struct {
 	addrPort netip.AddrPort
 	pktinfo  []byte
+
+	// listener is the listener that last received a packet from the client.
+	// Replies are sent through it, so that clients hopping between ports keep working.
+	listener *udpRelayServerConn
 }
 
 // session keeps track of a UDP session.
@@ -49,11 +62,19 @@ type session struct {
 	clientAddrInfo      atomic.Pointer[sessionClientAddrInfo]
 	clientAddrPortCache netip.AddrPort
 	clientPktinfoCache  []byte
+	listenerCache       *udpRelayServerConn
 	natConnSendCh       chan<- *sessionQueuedPacket
 	serverConn          *net.UDPConn
 	serverConnUnpacker  zerocopy.ServerUnpacker
 	username            string
 	logger              *zap.Logger
+
+	// lruElem is the session's element in the relay's LRU list,
+	// or nil if the relay does not evict sessions.
+	lruElem *list.Element
+
+	// record collects the session's traffic and close reason for its expired event.
+	record *udpSessionRecord
 }
 
 // sessionUplinkGeneric is used for passing information about relay uplink to the relay goroutine.
@@ -61,10 +82,17 @@ type sessionUplinkGeneric struct {
 	csid          uint64
 	clientName    string
 	natConn       *net.UDPConn
+	natConnInfo   conn.SocketInfo
 	natConnSendCh <-chan *sessionQueuedPacket
 	natConnPacker zerocopy.ClientPacker
 	natTimeout    time.Duration
+	pathMTU       *natConnPathMTU
 	username      string
+	rateLimit     *ratelimit.Handle
+	filter        *natFilter
+	tracked       *conntrack.Entry
+	flow          *capture.Flow
+	record        *udpSessionRecord
 	logger        *zap.Logger
 }
 
@@ -75,11 +103,19 @@ type sessionDownlinkGeneric struct {
 	clientAddrInfop    *sessionClientAddrInfo
 	clientAddrInfo     *atomic.Pointer[sessionClientAddrInfo]
 	natConn            *net.UDPConn
+	natConnInfo        conn.SocketInfo
 	natConnRecvBufSize int
 	natConnUnpacker    zerocopy.ClientUnpacker
 	serverConn         *net.UDPConn
+	serverConnInfo     conn.SocketInfo
 	serverConnPacker   zerocopy.ServerPacker
+	pathMTU            *natConnPathMTU
 	username           string
+	rateLimit          *ratelimit.Handle
+	filter             *natFilter
+	tracked            *conntrack.Entry
+	flow               *capture.Flow
+	record             *udpSessionRecord
 	logger             *zap.Logger
 }
 
@@ -94,22 +130,50 @@ type UDPSessionRelay struct {
 	packetBufRecvSize      int
 	listeners              []udpRelayServerConn
 	server                 zerocopy.UDPSessionServer
+	maxSessions            int
+	sessionLimitPolicy     udpSessionLimitPolicy
+	oversizedPayloadPolicy oversizedPayloadPolicy
+	natFiltering           natFilteringBehavior
+	trafficClass           int
 	collector              stats.Collector
+	userACL                *cred.ACLChecker
+	rateLimiter            *ratelimit.Limiter
+	acceptRampUp           *ratelimit.RampUp
+	events                 *event.Bus
 	router                 *router.Router
 	logger                 *zap.Logger
-	queuedPacketPool       sync.Pool
+	queuedPacketPool       *packetPool[sessionQueuedPacket]
 	wg                     sync.WaitGroup
 	mwg                    sync.WaitGroup
 	table                  map[uint64]*session
+	lru                    udpSessionLRU[uint64]
+	draining               bool
+	sessions               *affinity.Table
+	connTable              *conntrack.Table
+	captures               *capture.Server
+	resources              *resource.Counter
 }
 
 func NewUDPSessionRelay(
 	serverName string,
-	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize int,
+	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize, packetBufPoolSize int,
 	listeners []udpRelayServerConn,
 	server zerocopy.UDPSessionServer,
+	maxSessions int,
+	sessionLimitPolicy udpSessionLimitPolicy,
+	oversizedPayloadPolicy oversizedPayloadPolicy,
+	natFiltering natFilteringBehavior,
+	trafficClass int,
 	collector stats.Collector,
+	userACL *cred.ACLChecker,
+	rateLimiter *ratelimit.Limiter,
+	acceptRampUp *ratelimit.RampUp,
+	events *event.Bus,
 	router *router.Router,
+	sessions *affinity.Table,
+	connTable *conntrack.Table,
+	captures *capture.Server,
+	resources *resource.Counter,
 	logger *zap.Logger,
 ) *UDPSessionRelay {
 	return &UDPSessionRelay{
@@ -120,17 +184,29 @@ func NewUDPSessionRelay(
 		packetBufRecvSize:      packetBufRecvSize,
 		listeners:              listeners,
 		server:                 server,
+		maxSessions:            maxSessions,
+		sessionLimitPolicy:     sessionLimitPolicy,
+		oversizedPayloadPolicy: oversizedPayloadPolicy,
+		natFiltering:           natFiltering,
+		trafficClass:           trafficClass,
 		collector:              collector,
+		userACL:                userACL,
+		rateLimiter:            rateLimiter,
+		acceptRampUp:           acceptRampUp,
+		events:                 events,
 		router:                 router,
 		logger:                 logger,
-		queuedPacketPool: sync.Pool{
-			New: func() any {
-				return &sessionQueuedPacket{
-					buf: make([]byte, packetBufSize),
-				}
-			},
-		},
-		table: make(map[uint64]*session),
+		queuedPacketPool: newPacketPool(packetBufPoolSize, func() *sessionQueuedPacket {
+			resources.AllocBuffer()
+			return &sessionQueuedPacket{
+				buf: make([]byte, packetBufSize),
+			}
+		}),
+		table:     make(map[uint64]*session),
+		sessions:  sessions,
+		connTable: connTable,
+		captures:  captures,
+		resources: resources,
 	}
 }
 
@@ -145,16 +221,18 @@ func (s *UDPSessionRelay) Start(ctx context.Context) error {
 		if err := s.start(ctx, i, &s.listeners[i]); err != nil {
 			return err
 		}
+		s.resources.AddFDs(1)
 	}
 	return nil
 }
 
 func (s *UDPSessionRelay) startGeneric(ctx context.Context, index int, lnc *udpRelayServerConn) (err error) {
-	lnc.serverConn, _, err = lnc.listenConfig.ListenUDP(ctx, lnc.network, lnc.address)
+	lnc.serverConn, lnc.serverConnInfo, err = lnc.listenConfig.ListenUDP(ctx, lnc.network, lnc.address)
 	if err != nil {
 		return
 	}
 	lnc.address = lnc.serverConn.LocalAddr().String()
+	lnc.listenAddrPort = lnc.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
 	lnc.logger = s.logger.With(
 		zap.String("server", s.serverName),
 		zap.Int("listener", index),
@@ -163,10 +241,11 @@ func (s *UDPSessionRelay) startGeneric(ctx context.Context, index int, lnc *udpR
 
 	s.mwg.Add(1)
 
-	go func() {
+	s.resources.Go(func() {
+		lnc.pinReceiveRoutine()
 		s.recvFromServerConnGeneric(ctx, lnc)
 		s.mwg.Done()
-	}()
+	})
 
 	lnc.logger.Info("Started UDP session relay service listener")
 	return
@@ -174,6 +253,7 @@ func (s *UDPSessionRelay) startGeneric(ctx context.Context, index int, lnc *udpR
 
 func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRelayServerConn) {
 	cmsgBuf := make([]byte, conn.SocketControlMessageBufferSize)
+	serverConnReader := newUDPMsgReader(lnc.serverConn, lnc.serverConnInfo)
 
 	var (
 		n                    int
@@ -188,7 +268,7 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 		queuedPacket := s.getQueuedPacket()
 		recvBuf := queuedPacket.buf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+s.packetBufRecvSize]
 
-		n, cmsgn, flags, queuedPacket.clientAddrPort, err = lnc.serverConn.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
+		n, cmsgn, flags, queuedPacket.clientAddrPort, err = serverConnReader.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				s.putQueuedPacket(queuedPacket)
@@ -204,6 +284,17 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 			s.putQueuedPacket(queuedPacket)
 			continue
 		}
+
+		if !lnc.acl.Allowed(queuedPacket.clientAddrPort.Addr()) {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet denied by ACL"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindACL, "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
 		err = conn.ParseFlagsForError(flags)
 		if err != nil {
 			lnc.logger.Warn("Failed to read packet from serverConn",
@@ -225,6 +316,14 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 				zap.Int("packetLength", n),
 				zap.Error(err),
 			)
+			s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, err)
+			s.events.Publish(event.Event{
+				Kind:          event.KindAuthFailed,
+				Server:        s.serverName,
+				Network:       "udp",
+				ClientAddress: queuedPacket.clientAddrPort,
+				Error:         err.Error(),
+			})
 
 			s.putQueuedPacket(queuedPacket)
 			continue
@@ -233,6 +332,45 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 		s.server.Lock()
 
 		entry, ok := s.table[csid]
+		if !ok && s.maxSessions > 0 && len(s.table) >= s.maxSessions && s.sessionLimitPolicy == udpSessionLimitDrop {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session limit"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Uint64("clientSessionID", csid),
+					zap.Int("maxSessions", s.maxSessions),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindLimit, "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, errUDPSessionLimit)
+
+			s.putQueuedPacket(queuedPacket)
+			s.server.Unlock()
+			continue
+		}
+		if !ok && s.draining {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet of new UDP session while draining"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Uint64("clientSessionID", csid),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			s.server.Unlock()
+			continue
+		}
+		if !ok && !s.acceptRampUp.Allow() {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session ramp-up rate"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.Uint64("clientSessionID", csid),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindLimit, "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, errUDPSessionRampUp)
+
+			s.putQueuedPacket(queuedPacket)
+			s.server.Unlock()
+			continue
+		}
 		if !ok {
 			entry = &session{
 				serverConn: lnc.serverConn,
@@ -247,6 +385,14 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 					zap.Int("packetLength", n),
 					zap.Error(err),
 				)
+				s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, err)
+				s.events.Publish(event.Event{
+					Kind:          event.KindAuthFailed,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: queuedPacket.clientAddrPort,
+					Error:         err.Error(),
+				})
 
 				s.putQueuedPacket(queuedPacket)
 				s.server.Unlock()
@@ -263,6 +409,15 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 				zap.Int("packetLength", n),
 				zap.Error(err),
 			)
+			s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", queuedPacket.clientAddrPort, entry.username, conn.Addr{}, err)
+			s.events.Publish(event.Event{
+				Kind:          event.KindAuthFailed,
+				Server:        s.serverName,
+				Network:       "udp",
+				ClientAddress: queuedPacket.clientAddrPort,
+				Username:      entry.username,
+				Error:         err.Error(),
+			})
 
 			s.putQueuedPacket(queuedPacket)
 			s.server.Unlock()
@@ -277,9 +432,11 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 
 		updateClientAddrPort := entry.clientAddrPortCache != queuedPacket.clientAddrPort
 		updateClientPktinfo := !bytes.Equal(entry.clientPktinfoCache, cmsg)
+		updateListener := entry.listenerCache != lnc
 
 		if updateClientAddrPort {
 			entry.clientAddrPortCache = queuedPacket.clientAddrPort
+			s.sessions.UpdateClientAddress(csid, queuedPacket.clientAddrPort)
 		}
 
 		if updateClientPktinfo {
@@ -287,7 +444,11 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 			copy(entry.clientPktinfoCache, cmsg)
 		}
 
-		if updateClientAddrPort || updateClientPktinfo {
+		if updateListener {
+			entry.listenerCache = lnc
+		}
+
+		if updateClientAddrPort || updateClientPktinfo || updateListener {
 			m, err := conn.ParseSocketControlMessage(cmsg)
 			if err != nil {
 				lnc.logger.Warn("Failed to parse pktinfo control message from serverConn",
@@ -303,7 +464,7 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 				continue
 			}
 
-			clientAddrInfop = &sessionClientAddrInfo{entry.clientAddrPortCache, entry.clientPktinfoCache}
+			clientAddrInfop = &sessionClientAddrInfo{entry.clientAddrPortCache, entry.clientPktinfoCache, entry.listenerCache}
 			entry.clientAddrInfo.Store(clientAddrInfop)
 
 			if ce := lnc.logger.Check(zap.DebugLevel, "Updated client address info"); ce != nil {
@@ -319,18 +480,28 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 		}
 
 		if !ok {
+			if s.maxSessions > 0 && len(s.table) >= s.maxSessions {
+				s.evictLeastRecentlyActiveSession()
+			}
+
 			natConnSendCh := make(chan *sessionQueuedPacket, lnc.sendChannelCapacity)
+			removeNatConnSendCh := resource.AddChannel(s.resources, natConnSendCh)
 			entry.natConnSendCh = natConnSendCh
+			entry.record = newUDPSessionRecord()
+			if s.sessionLimitPolicy == udpSessionLimitEvictLRU {
+				entry.lruElem = s.lru.add(csid)
+			}
 			s.table[csid] = entry
 			s.wg.Add(1)
 
-			go func() {
+			s.resources.Go(func() {
 				var sendChClean bool
 
 				defer func() {
 					s.server.Lock()
+					removeNatConnSendCh()
 					close(natConnSendCh)
-					delete(s.table, csid)
+					s.removeEntry(csid, entry)
 					s.server.Unlock()
 
 					if !sendChClean {
@@ -344,6 +515,7 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 
 				c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
 					ServerIndex:    s.serverIndex,
+					ListenAddrPort: lnc.listenAddrPort,
 					Username:       entry.username,
 					SourceAddrPort: queuedPacket.clientAddrPort,
 					TargetAddr:     queuedPacket.targetAddr,
@@ -356,10 +528,18 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.Error(err),
 					)
+					if errors.Is(err, router.ErrRejected) {
+						s.collector.CollectRejection(stats.RejectionKindRoute, "udp", queuedPacket.clientAddrPort, entry.username, queuedPacket.targetAddr, err)
+					}
 					return
 				}
 
-				clientInfo, clientSession, err := c.NewSession(ctx)
+				sessionCtx := zerocopy.WithUDPSessionTargetAddr(ctx, queuedPacket.targetAddr)
+				if entry.username != "" {
+					sessionCtx = conn.NewUsernameContext(sessionCtx, entry.username)
+				}
+
+				clientInfo, clientSession, err := c.NewSession(sessionCtx)
 				if err != nil {
 					lnc.logger.Warn("Failed to create new UDP client session",
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
@@ -372,7 +552,16 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 					return
 				}
 
-				natConn, _, err := clientInfo.ListenConfig.ListenUDP(ctx, "udp", "")
+				natConnListenConfig := clientInfo.ListenConfig
+				if s.trafficClass != 0 {
+					natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+				}
+				if lnc.batchMode == "gso" {
+					natConnListenConfig = natConnListenConfig.WithUDPOffload()
+				}
+				natConnListenConfig = natConnListenConfig.WithReceiveErrors()
+
+				natConn, natConnInfo, err := natConnListenConfig.ListenUDP(ctx, "udp", "")
 				if err != nil {
 					lnc.logger.Warn("Failed to create UDP socket for new NAT session",
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
@@ -386,7 +575,12 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 					return
 				}
 
-				err = natConn.SetReadDeadline(time.Now().Add(lnc.natTimeout))
+				// Count natConn for the lifetime of the session goroutine.
+				s.resources.AddFDs(1)
+				defer s.resources.AddFDs(-1)
+
+				natTimeout := lnc.natTimeoutFor(clientInfo)
+				err = natConn.SetReadDeadline(time.Now().Add(natTimeout))
 				if err != nil {
 					lnc.logger.Warn("Failed to set read deadline on natConn",
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
@@ -394,7 +588,7 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 						zap.Uint64("clientSessionID", csid),
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 						zap.String("client", clientInfo.Name),
-						zap.Duration("natTimeout", lnc.natTimeout),
+						zap.Duration("natTimeout", natTimeout),
 						zap.Error(err),
 					)
 					natConn.Close()
@@ -426,6 +620,19 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 				// No more early returns!
 				sendChClean = true
 
+				s.server.Lock()
+				s.sessions.Add(affinity.Session{
+					ClientSessionID: csid,
+					ClientAddress:   entry.clientAddrInfo.Load().addrPort,
+					Username:        entry.username,
+					Client:          clientInfo.Name,
+					StartTime:       time.Now(),
+				}, func() {
+					entry.record.setCloseReason(event.CloseReasonClosed)
+					natConn.Close()
+				})
+				s.server.Unlock()
+
 				lnc.logger.Info("UDP session relay started",
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.String("username", entry.username),
@@ -434,23 +641,60 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 					zap.String("client", clientInfo.Name),
 				)
 
+				sessionEvent := event.Event{
+					Kind:          event.KindSessionCreated,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: queuedPacket.clientAddrPort,
+					Username:      entry.username,
+					TargetAddress: queuedPacket.targetAddr,
+					Client:        clientInfo.Name,
+				}
+				s.events.Publish(sessionEvent)
+				entry.record.setEvent(sessionEvent)
+
+				tracked := s.connTable.Add("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress, sessionEvent.Client, func() {
+					entry.record.setCloseReason(event.CloseReasonClosed)
+					natConn.Close()
+				})
+
+				flow := s.captures.NewFlow("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress)
+
+				pathMTU := newNatConnPathMTU(natConn, tracked, lnc.logger.With(
+					zap.String("username", entry.username),
+					zap.Uint64("clientSessionID", csid),
+					zap.String("client", clientInfo.Name),
+				))
+
+				filter := s.natFiltering.newFilter()
+				uplinkRateLimit := s.rateLimiter.Acquire(entry.username, queuedPacket.clientAddrPort.Addr())
+				downlinkRateLimit := s.rateLimiter.Acquire(entry.username, queuedPacket.clientAddrPort.Addr())
+
 				s.wg.Add(1)
 
-				go func() {
+				s.resources.Go(func() {
 					s.relayServerConnToNatConnGeneric(ctx, sessionUplinkGeneric{
 						csid:          csid,
 						clientName:    clientInfo.Name,
 						natConn:       natConn,
+						natConnInfo:   natConnInfo,
 						natConnSendCh: natConnSendCh,
 						natConnPacker: clientSession.Packer,
-						natTimeout:    lnc.natTimeout,
+						natTimeout:    natTimeout,
+						pathMTU:       pathMTU,
 						username:      entry.username,
+						rateLimit:     uplinkRateLimit,
+						filter:        filter,
+						tracked:       tracked,
+						flow:          flow,
+						record:        entry.record,
 						logger:        lnc.logger,
 					})
+					uplinkRateLimit.Release()
 					natConn.Close()
 					clientSession.Close()
 					s.wg.Done()
-				}()
+				})
 
 				s.relayNatConnToServerConnGeneric(sessionDownlinkGeneric{
 					csid:               csid,
@@ -458,14 +702,24 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 					clientAddrInfop:    clientAddrInfop,
 					clientAddrInfo:     &entry.clientAddrInfo,
 					natConn:            natConn,
+					natConnInfo:        natConnInfo,
 					natConnRecvBufSize: clientSession.MaxPacketSize,
 					natConnUnpacker:    clientSession.Unpacker,
 					serverConn:         lnc.serverConn,
+					serverConnInfo:     lnc.serverConnInfo,
 					serverConnPacker:   serverConnPacker,
+					pathMTU:            pathMTU,
 					username:           entry.username,
+					rateLimit:          downlinkRateLimit,
+					filter:             filter,
+					tracked:            tracked,
+					flow:               flow,
+					record:             entry.record,
 					logger:             lnc.logger,
 				})
-			}()
+				downlinkRateLimit.Release()
+				tracked.Remove()
+			})
 
 			if ce := lnc.logger.Check(zap.DebugLevel, "New UDP session"); ce != nil {
 				ce.Write(
@@ -475,6 +729,8 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 				)
 			}
+		} else if entry.lruElem != nil {
+			s.lru.touch(entry.lruElem)
 		}
 
 		select {
@@ -503,17 +759,58 @@ func (s *UDPSessionRelay) recvFromServerConnGeneric(ctx context.Context, lnc *ud
 
 func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(ctx context.Context, uplink sessionUplinkGeneric) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		packetsSent      uint64
-		payloadBytesSent uint64
+		destAddrPort            netip.AddrPort
+		packetStart             int
+		packetLength            int
+		err                     error
+		packetsSent             uint64
+		payloadBytesSent        uint64
+		packetsDropped          uint64
+		oversizedPacketsDropped uint64
 	)
 
+	natConnWriter := conn.NewUDPGSOWriter(uplink.natConn, uplink.natConnInfo.MaxUDPGSOSegments)
+
+	// flushIfIdle sends out coalesced packets when there are no more queued packets.
+	flushIfIdle := func() {
+		if len(uplink.natConnSendCh) > 0 {
+			return
+		}
+		if err := natConnWriter.Flush(); err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				uplink.pathMTU.readErrors()
+			}
+			uplink.logger.Warn("Failed to write packets to natConn",
+				zap.String("username", uplink.username),
+				zap.Uint64("clientSessionID", uplink.csid),
+				zap.String("client", uplink.clientName),
+				zap.Stringer("lastWriteDestAddress", destAddrPort),
+				zap.Error(err),
+			)
+		}
+	}
+
 	for queuedPacket := range uplink.natConnSendCh {
+		if !s.userACLAllowed(ctx, uplink.logger, uplink.username, uplink.csid, queuedPacket) {
+			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
+			continue
+		}
+
+		if !uplink.rateLimit.AllowUplink(queuedPacket.length) {
+			packetsDropped++
+			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
+			continue
+		}
+
+		uplink.flow.UplinkDatagram(queuedPacket.targetAddr, queuedPacket.buf[queuedPacket.start:queuedPacket.start+queuedPacket.length])
+
 		destAddrPort, packetStart, packetLength, err = uplink.natConnPacker.PackInPlace(ctx, queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
 		if err != nil {
+			if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+				oversizedPacketsDropped++
+			}
 			uplink.logger.Warn("Failed to pack packet",
 				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 				zap.String("username", uplink.username),
@@ -525,11 +822,36 @@ func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(ctx context.Context, u
 			)
 
 			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
+			continue
+		}
+
+		if maxPacketSize := uplink.pathMTU.maxPacketSize(destAddrPort.Addr()); maxPacketSize > 0 && packetLength > maxPacketSize {
+			oversizedPacketsDropped++
+			if ce := uplink.logger.Check(zap.DebugLevel, "Dropping packet exceeding path MTU"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					zap.String("username", uplink.username),
+					zap.Uint64("clientSessionID", uplink.csid),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+					zap.String("client", uplink.clientName),
+					zap.Int("packetLength", packetLength),
+					zap.Int("maxPacketSize", maxPacketSize),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			flushIfIdle()
 			continue
 		}
 
-		_, err = uplink.natConn.WriteToUDPAddrPort(queuedPacket.buf[packetStart:packetStart+packetLength], destAddrPort)
+		uplink.filter.permit(destAddrPort)
+
+		err = natConnWriter.WriteMsgUDPAddrPort(queuedPacket.buf[packetStart:packetStart+packetLength], nil, destAddrPort)
 		if err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				uplink.pathMTU.readErrors()
+			}
 			uplink.logger.Warn("Failed to write packet to natConn",
 				zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 				zap.String("username", uplink.username),
@@ -554,9 +876,11 @@ func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(ctx context.Context, u
 			)
 		}
 
-		s.putQueuedPacket(queuedPacket)
 		packetsSent++
 		payloadBytesSent += uint64(queuedPacket.length)
+		uplink.tracked.AddUplinkBytes(uint64(queuedPacket.length))
+		s.putQueuedPacket(queuedPacket)
+		flushIfIdle()
 	}
 
 	uplink.logger.Info("Finished relay serverConn -> natConn",
@@ -569,6 +893,34 @@ func (s *UDPSessionRelay) relayServerConnToNatConnGeneric(ctx context.Context, u
 	)
 
 	s.collector.CollectUDPSessionUplink(uplink.username, packetsSent, payloadBytesSent)
+	uplink.record.finishUplink(s.events, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit(uplink.username, 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 {
+		s.collector.CollectOversizedPackets(uplink.username, oversizedPacketsDropped, 0)
+	}
+}
+
+// userACLAllowed returns whether the user's ACL allows the destination of the queued packet,
+// and records the rejection if not.
+//
+// Checking may resolve domain destinations, so it is done by the uplink of each session,
+// instead of the receive loop shared by all sessions.
+func (s *UDPSessionRelay) userACLAllowed(ctx context.Context, logger *zap.Logger, username string, csid uint64, queuedPacket *sessionQueuedPacket) bool {
+	if s.userACL.Allowed(ctx, username, queuedPacket.targetAddr) {
+		return true
+	}
+	if ce := logger.Check(zap.DebugLevel, "Dropped packet by user ACL"); ce != nil {
+		ce.Write(
+			zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+			zap.String("username", username),
+			zap.Uint64("clientSessionID", csid),
+			zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+		)
+	}
+	s.collector.CollectRejection(stats.RejectionKindRoute, "udp", queuedPacket.clientAddrPort, username, queuedPacket.targetAddr, cred.ErrDestinationDenied)
+	return false
 }
 
 func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownlinkGeneric) {
@@ -582,20 +934,44 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownli
 	headroom := zerocopy.UDPRelayHeadroom(serverConnPackerInfo.Headroom, natConnUnpackerInfo.Headroom)
 
 	var (
-		packetsSent      uint64
-		payloadBytesSent uint64
+		packetsSent               uint64
+		payloadBytesSent          uint64
+		packetsDropped            uint64
+		packetsFiltered           uint64
+		oversizedPacketsDropped   uint64
+		oversizedPacketsTruncated uint64
 	)
 
 	packetBuf := make([]byte, headroom.Front+downlink.natConnRecvBufSize+headroom.Rear)
 	recvBuf := packetBuf[headroom.Front : headroom.Front+downlink.natConnRecvBufSize]
 
+	natConnReader := newUDPMsgReader(downlink.natConn, downlink.natConnInfo)
+	serverConnWriter := conn.NewUDPGSOWriter(downlink.serverConn, downlink.serverConnInfo.MaxUDPGSOSegments)
+
 	for {
-		n, _, flags, packetSourceAddrPort, err := downlink.natConn.ReadMsgUDPAddrPort(recvBuf, nil)
+		// Send out coalesced packets before blocking on the next read.
+		if natConnReader.Buffered() == 0 {
+			if err := serverConnWriter.Flush(); err != nil {
+				downlink.logger.Warn("Failed to write packets to serverConn",
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.String("client", downlink.clientName),
+					zap.Error(err),
+				)
+			}
+		}
+
+		n, _, flags, packetSourceAddrPort, err := natConnReader.ReadMsgUDPAddrPort(recvBuf, nil)
 		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
+			// natConn is closed when the session is forcibly terminated.
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
 				break
 			}
 
+			// Queued ICMP errors fail reads. They are not errors of the relay.
+			if downlink.pathMTU.readErrors() {
+				continue
+			}
+
 			downlink.logger.Warn("Failed to read packet from natConn",
 				zap.Stringer("clientAddress", clientAddrPort),
 				zap.String("username", downlink.username),
@@ -621,6 +997,11 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownli
 			continue
 		}
 
+		if !downlink.filter.allows(packetSourceAddrPort) {
+			packetsFiltered++
+			continue
+		}
+
 		payloadSourceAddrPort, payloadStart, payloadLength, err := downlink.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, headroom.Front, n)
 		if err != nil {
 			downlink.logger.Warn("Failed to unpack packet",
@@ -636,13 +1017,45 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownli
 		}
 
 		if caip := downlink.clientAddrInfo.Load(); caip != clientAddrInfop {
+			// Reply through the listener that last received from the client.
+			if caip.listener != clientAddrInfop.listener {
+				if err := serverConnWriter.Flush(); err != nil {
+					downlink.logger.Warn("Failed to write packets to serverConn",
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.String("client", downlink.clientName),
+						zap.Error(err),
+					)
+				}
+				serverConnWriter = conn.NewUDPGSOWriter(caip.listener.serverConn, caip.listener.serverConnInfo.MaxUDPGSOSegments)
+			}
+
 			clientAddrInfop = caip
 			clientAddrPort = caip.addrPort
 			clientPktinfo = caip.pktinfo
 			maxClientPacketSize = zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
 		}
 
+		if !downlink.rateLimit.AllowDownlink(payloadLength) {
+			packetsDropped++
+			continue
+		}
+
+		downlink.flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLength])
+
 		packetStart, packetLength, err := downlink.serverConnPacker.PackInPlace(packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+		if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+			if s.oversizedPayloadPolicy.truncatesFrom(payloadSourceAddrPort) {
+				var truncatedPayloadLength int
+				packetStart, packetLength, truncatedPayloadLength, err = packTruncatedDNSResponse(downlink.serverConnPacker, packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+				if err == nil {
+					payloadLength = truncatedPayloadLength
+					oversizedPacketsTruncated++
+				}
+			}
+			if err != nil {
+				oversizedPacketsDropped++
+			}
+		}
 		if err != nil {
 			downlink.logger.Warn("Failed to pack packet",
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -658,7 +1071,7 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownli
 			continue
 		}
 
-		_, _, err = downlink.serverConn.WriteMsgUDPAddrPort(packetBuf[packetStart:packetStart+packetLength], clientPktinfo, clientAddrPort)
+		err = serverConnWriter.WriteMsgUDPAddrPort(packetBuf[packetStart:packetStart+packetLength], clientPktinfo, clientAddrPort)
 		if err != nil {
 			downlink.logger.Warn("Failed to write packet to serverConn",
 				zap.Stringer("clientAddress", clientAddrPort),
@@ -674,6 +1087,7 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownli
 
 		packetsSent++
 		payloadBytesSent += uint64(payloadLength)
+		downlink.tracked.AddDownlinkBytes(uint64(payloadLength))
 	}
 
 	downlink.logger.Info("Finished relay serverConn <- natConn",
@@ -682,21 +1096,78 @@ func (s *UDPSessionRelay) relayNatConnToServerConnGeneric(downlink sessionDownli
 		zap.Uint64("clientSessionID", downlink.csid),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Uint64("packetsFiltered", packetsFiltered),
 	)
 
 	s.collector.CollectUDPSessionDownlink(downlink.username, packetsSent, payloadBytesSent)
+	downlink.record.finishDownlink(s.events, downlink.clientAddrInfo.Load().addrPort, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit(downlink.username, 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 || oversizedPacketsTruncated > 0 {
+		s.collector.CollectOversizedPackets(downlink.username, oversizedPacketsDropped, oversizedPacketsTruncated)
+	}
 }
 
 // getQueuedPacket retrieves a queued packet from the pool.
 func (s *UDPSessionRelay) getQueuedPacket() *sessionQueuedPacket {
-	return s.queuedPacketPool.Get().(*sessionQueuedPacket)
+	queuedPacket := s.queuedPacketPool.Get()
+	s.resources.GetBuffer(len(queuedPacket.buf))
+	return queuedPacket
 }
 
 // putQueuedPacket puts the queued packet back into the pool.
 func (s *UDPSessionRelay) putQueuedPacket(queuedPacket *sessionQueuedPacket) {
+	s.resources.PutBuffer(len(queuedPacket.buf))
 	s.queuedPacketPool.Put(queuedPacket)
 }
 
+// evictLeastRecentlyActiveSession removes the least recently active session from the table and shuts it down,
+// to make room for a new session.
+//
+// It must be called with the server lock held.
+func (s *UDPSessionRelay) evictLeastRecentlyActiveSession() {
+	csid, ok := s.lru.popOldest()
+	if !ok {
+		return
+	}
+	entry := s.table[csid]
+	delete(s.table, csid)
+	s.sessions.Remove(csid)
+
+	entry.record.setCloseReason(event.CloseReasonEvicted)
+	if natConn := entry.state.Swap(entry.serverConn); natConn != nil {
+		if err := natConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
+			entry.logger.Warn("Failed to set read deadline on natConn",
+				zap.Uint64("clientSessionID", csid),
+				zap.Error(err),
+			)
+		}
+	}
+
+	if ce := entry.logger.Check(zap.DebugLevel, "Evicted least recently active UDP session"); ce != nil {
+		ce.Write(
+			zap.String("username", entry.username),
+			zap.Uint64("clientSessionID", csid),
+			zap.Int("maxSessions", s.maxSessions),
+		)
+	}
+	s.collector.CollectUDPSessionEviction(entry.username)
+}
+
+// removeEntry removes the session's entry from the table, unless it has been evicted and replaced.
+//
+// It must be called with the server lock held.
+func (s *UDPSessionRelay) removeEntry(csid uint64, entry *session) {
+	if s.table[csid] == entry {
+		delete(s.table, csid)
+		s.sessions.Remove(csid)
+	}
+	if entry.lruElem != nil {
+		s.lru.remove(entry.lruElem)
+	}
+}
+
 // Stop implements the Service Stop method.
 func (s *UDPSessionRelay) Stop() error {
 	for i := range s.listeners {
@@ -712,6 +1183,7 @@ func (s *UDPSessionRelay) Stop() error {
 
 	s.server.Lock()
 	for csid, entry := range s.table {
+		entry.record.setCloseReason(event.CloseReasonShutdown)
 		natConn := entry.state.Swap(entry.serverConn)
 		if natConn == nil {
 			continue
@@ -735,7 +1207,25 @@ func (s *UDPSessionRelay) Stop() error {
 		if err := lnc.serverConn.Close(); err != nil {
 			lnc.logger.Warn("Failed to close serverConn", zap.Error(err))
 		}
+		s.resources.AddFDs(-1)
 	}
 
 	return nil
 }
+
+// Drain implements [Drainer.Drain].
+// Sessions finish when they are idle for the NAT timeout.
+func (s *UDPSessionRelay) Drain(ctx context.Context) (int, error) {
+	s.server.Lock()
+	s.draining = true
+	s.server.Unlock()
+
+	var closed int
+	if !waitGroupWait(ctx, &s.wg) {
+		s.server.Lock()
+		closed = len(s.table)
+		s.server.Unlock()
+	}
+
+	return closed, s.Stop()
+}
@@ -4,16 +4,27 @@ package service
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"errors"
+	"net"
 	"net/netip"
 	"os"
+	"slices"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/database64128/shadowsocks-go/affinity"
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -27,8 +38,15 @@ type sessionUplinkMmsg struct {
 	natConnSendCh  <-chan *sessionQueuedPacket
 	natConnPacker  zerocopy.ClientPacker
 	natTimeout     time.Duration
+	pathMTU        *natConnPathMTU
 	username       string
+	rateLimit      *ratelimit.Handle
+	filter         *natFilter
 	relayBatchSize int
+	v4Mapped       bool
+	tracked        *conntrack.Entry
+	flow           *capture.Flow
+	record         *udpSessionRecord
 	logger         *zap.Logger
 }
 
@@ -43,8 +61,14 @@ type sessionDownlinkMmsg struct {
 	natConnUnpacker    zerocopy.ClientUnpacker
 	serverConn         *conn.MmsgWConn
 	serverConnPacker   zerocopy.ServerPacker
+	pathMTU            *natConnPathMTU
 	username           string
+	rateLimit          *ratelimit.Handle
+	filter             *natFilter
 	relayBatchSize     int
+	tracked            *conntrack.Entry
+	flow               *capture.Flow
+	record             *udpSessionRecord
 	logger             *zap.Logger
 }
 
@@ -64,6 +88,7 @@ func (s *UDPSessionRelay) startMmsg(ctx context.Context, index int, lnc *udpRela
 	}
 	lnc.serverConn = serverConn.UDPConn
 	lnc.address = serverConn.LocalAddr().String()
+	lnc.listenAddrPort = lnc.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
 	lnc.logger = s.logger.With(
 		zap.String("server", s.serverName),
 		zap.Int("listener", index),
@@ -72,10 +97,11 @@ func (s *UDPSessionRelay) startMmsg(ctx context.Context, index int, lnc *udpRela
 
 	s.mwg.Add(1)
 
-	go func() {
+	s.resources.Go(func() {
+		lnc.pinReceiveRoutine()
 		s.recvFromServerConnRecvmmsg(ctx, lnc, serverConn.NewRConn())
 		s.mwg.Done()
-	}()
+	})
 
 	lnc.logger.Info("Started UDP session relay service listener")
 	return nil
@@ -88,6 +114,8 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 	iovec := make([]unix.Iovec, n)
 	cmsgvec := make([][]byte, n)
 	msgvec := make([]conn.Mmsghdr, n)
+	csidvec := make([]uint64, n)
+	groupvec := make([]int, 0, n)
 
 	for i := range msgvec {
 		cmsgBuf := make([]byte, conn.SocketControlMessageBufferSize)
@@ -133,10 +161,10 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 		packetsReceived += uint64(n)
 		burstBatchSize = max(burstBatchSize, n)
 
-		s.server.Lock()
-
 		msgvecn := msgvec[:n]
+		groupvec = groupvec[:0]
 
+		// Validate packets and extract session IDs without holding the lock.
 		for i := range msgvecn {
 			msg := &msgvecn[i]
 			queuedPacket := qpvec[i]
@@ -154,6 +182,17 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 				continue
 			}
 
+			if !lnc.acl.Allowed(queuedPacket.clientAddrPort.Addr()) {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet denied by ACL"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+					)
+				}
+				s.collector.CollectRejection(stats.RejectionKindACL, "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+
 			err = conn.ParseFlagsForError(int(msg.Msghdr.Flags))
 			if err != nil {
 				lnc.logger.Warn("Packet from serverConn discarded",
@@ -168,63 +207,174 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 
 			packet := queuedPacket.buf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+int(msg.Msglen)]
 
-			csid, err := s.server.SessionInfo(packet)
+			csidvec[i], err = s.server.SessionInfo(packet)
 			if err != nil {
 				lnc.logger.Warn("Failed to extract session info from packet",
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.Uint32("packetLength", msg.Msglen),
 					zap.Error(err),
 				)
+				s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, err)
+				s.events.Publish(event.Event{
+					Kind:          event.KindAuthFailed,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: queuedPacket.clientAddrPort,
+					Error:         err.Error(),
+				})
 
 				s.putQueuedPacket(queuedPacket)
 				continue
 			}
 
+			groupvec = append(groupvec, i)
+		}
+
+		// Group packets by session ID, preserving the order of packets within each session,
+		// so that each session is looked up and enqueued once per batch.
+		slices.SortStableFunc(groupvec, func(a, b int) int {
+			return cmp.Compare(csidvec[a], csidvec[b])
+		})
+
+		s.server.Lock()
+
+		for groupStart := 0; groupStart < len(groupvec); {
+			csid := csidvec[groupvec[groupStart]]
+			groupEnd := groupStart + 1
+			for groupEnd < len(groupvec) && csidvec[groupvec[groupEnd]] == csid {
+				groupEnd++
+			}
+			group := groupvec[groupStart:groupEnd]
+			groupStart = groupEnd
+
 			entry, ok := s.table[csid]
-			if !ok {
-				entry = &session{
-					serverConn: lnc.serverConn,
-					logger:     lnc.logger,
+			if !ok && s.maxSessions > 0 && len(s.table) >= s.maxSessions && s.sessionLimitPolicy == udpSessionLimitDrop {
+				for _, i := range group {
+					queuedPacket := qpvec[i]
+					if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session limit"); ce != nil {
+						ce.Write(
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Uint64("clientSessionID", csid),
+							zap.Int("maxSessions", s.maxSessions),
+						)
+					}
+					s.collector.CollectRejection(stats.RejectionKindLimit, "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, errUDPSessionLimit)
+					s.putQueuedPacket(queuedPacket)
 				}
+				continue
+			}
+			if !ok && s.draining {
+				for _, i := range group {
+					queuedPacket := qpvec[i]
+					if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet of new UDP session while draining"); ce != nil {
+						ce.Write(
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Uint64("clientSessionID", csid),
+						)
+					}
+					s.putQueuedPacket(queuedPacket)
+				}
+				continue
+			}
+			if !ok && !s.acceptRampUp.Allow() {
+				for _, i := range group {
+					queuedPacket := qpvec[i]
+					if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session ramp-up rate"); ce != nil {
+						ce.Write(
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Uint64("clientSessionID", csid),
+						)
+					}
+					s.collector.CollectRejection(stats.RejectionKindLimit, "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, errUDPSessionRampUp)
+					s.putQueuedPacket(queuedPacket)
+				}
+				continue
+			}
+
+			// Unpack the session's packets, keeping the successfully unpacked ones in group.
+			unpacked := group[:0]
+
+			for _, i := range group {
+				msg := &msgvecn[i]
+				queuedPacket := qpvec[i]
+				packet := queuedPacket.buf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+int(msg.Msglen)]
+
+				if entry == nil {
+					newEntry := &session{
+						serverConn: lnc.serverConn,
+						logger:     lnc.logger,
+					}
 
-				entry.serverConnUnpacker, entry.username, err = s.server.NewUnpacker(packet, csid)
+					newEntry.serverConnUnpacker, newEntry.username, err = s.server.NewUnpacker(packet, csid)
+					if err != nil {
+						lnc.logger.Warn("Failed to create unpacker for client session",
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.Uint64("clientSessionID", csid),
+							zap.Uint32("packetLength", msg.Msglen),
+							zap.Error(err),
+						)
+						s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", queuedPacket.clientAddrPort, "", conn.Addr{}, err)
+						s.events.Publish(event.Event{
+							Kind:          event.KindAuthFailed,
+							Server:        s.serverName,
+							Network:       "udp",
+							ClientAddress: queuedPacket.clientAddrPort,
+							Error:         err.Error(),
+						})
+
+						s.putQueuedPacket(queuedPacket)
+						continue
+					}
+
+					entry = newEntry
+				}
+
+				queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length, err = entry.serverConnUnpacker.UnpackInPlace(queuedPacket.buf, queuedPacket.clientAddrPort, s.packetBufFrontHeadroom, int(msg.Msglen))
 				if err != nil {
-					lnc.logger.Warn("Failed to create unpacker for client session",
+					lnc.logger.Warn("Failed to unpack packet from serverConn",
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.String("username", entry.username),
 						zap.Uint64("clientSessionID", csid),
 						zap.Uint32("packetLength", msg.Msglen),
 						zap.Error(err),
 					)
+					s.collector.CollectRejection(rejectionKindOf(stats.RejectionKindUnpack, err), "udp", queuedPacket.clientAddrPort, entry.username, conn.Addr{}, err)
+					s.events.Publish(event.Event{
+						Kind:          event.KindAuthFailed,
+						Server:        s.serverName,
+						Network:       "udp",
+						ClientAddress: queuedPacket.clientAddrPort,
+						Username:      entry.username,
+						Error:         err.Error(),
+					})
 
 					s.putQueuedPacket(queuedPacket)
 					continue
 				}
-			}
 
-			queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length, err = entry.serverConnUnpacker.UnpackInPlace(queuedPacket.buf, queuedPacket.clientAddrPort, s.packetBufFrontHeadroom, int(msg.Msglen))
-			if err != nil {
-				lnc.logger.Warn("Failed to unpack packet from serverConn",
-					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-					zap.String("username", entry.username),
-					zap.Uint64("clientSessionID", csid),
-					zap.Uint32("packetLength", msg.Msglen),
-					zap.Error(err),
-				)
+				payloadBytesReceived += uint64(queuedPacket.length)
+				unpacked = append(unpacked, i)
+			}
 
-				s.putQueuedPacket(queuedPacket)
+			if len(unpacked) == 0 {
 				continue
 			}
 
-			payloadBytesReceived += uint64(queuedPacket.length)
+			// The first packet starts the session, and the last packet carries the latest client address.
+			queuedPacket := qpvec[unpacked[0]]
+			last := unpacked[len(unpacked)-1]
+			lastQueuedPacket := qpvec[last]
 
 			var clientAddrInfop *sessionClientAddrInfo
-			cmsg := cmsgvec[i][:msg.Msghdr.Controllen]
+			cmsg := cmsgvec[last][:msgvecn[last].Msghdr.Controllen]
 
-			updateClientAddrPort := entry.clientAddrPortCache != queuedPacket.clientAddrPort
+			updateClientAddrPort := entry.clientAddrPortCache != lastQueuedPacket.clientAddrPort
 			updateClientPktinfo := !bytes.Equal(entry.clientPktinfoCache, cmsg)
+			updateListener := entry.listenerCache != lnc
 
 			if updateClientAddrPort {
-				entry.clientAddrPortCache = queuedPacket.clientAddrPort
+				entry.clientAddrPortCache = lastQueuedPacket.clientAddrPort
+				s.sessions.UpdateClientAddress(csid, lastQueuedPacket.clientAddrPort)
 			}
 
 			if updateClientPktinfo {
@@ -232,30 +382,36 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 				copy(entry.clientPktinfoCache, cmsg)
 			}
 
-			if updateClientAddrPort || updateClientPktinfo {
+			if updateListener {
+				entry.listenerCache = lnc
+			}
+
+			if updateClientAddrPort || updateClientPktinfo || updateListener {
 				m, err := conn.ParseSocketControlMessage(cmsg)
 				if err != nil {
 					lnc.logger.Warn("Failed to parse pktinfo control message from serverConn",
-						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Stringer("clientAddress", &lastQueuedPacket.clientAddrPort),
 						zap.String("username", entry.username),
 						zap.Uint64("clientSessionID", csid),
-						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.Stringer("targetAddress", &lastQueuedPacket.targetAddr),
 						zap.Error(err),
 					)
 
-					s.putQueuedPacket(queuedPacket)
+					for _, i := range unpacked {
+						s.putQueuedPacket(qpvec[i])
+					}
 					continue
 				}
 
-				clientAddrInfop = &sessionClientAddrInfo{entry.clientAddrPortCache, entry.clientPktinfoCache}
+				clientAddrInfop = &sessionClientAddrInfo{entry.clientAddrPortCache, entry.clientPktinfoCache, entry.listenerCache}
 				entry.clientAddrInfo.Store(clientAddrInfop)
 
 				if ce := lnc.logger.Check(zap.DebugLevel, "Updated client address info"); ce != nil {
 					ce.Write(
-						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.Stringer("clientAddress", &lastQueuedPacket.clientAddrPort),
 						zap.String("username", entry.username),
 						zap.Uint64("clientSessionID", csid),
-						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.Stringer("targetAddress", &lastQueuedPacket.targetAddr),
 						zap.Stringer("clientPktinfoAddr", m.PktinfoAddr),
 						zap.Uint32("clientPktinfoIfindex", m.PktinfoIfindex),
 					)
@@ -263,18 +419,28 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 			}
 
 			if !ok {
+				if s.maxSessions > 0 && len(s.table) >= s.maxSessions {
+					s.evictLeastRecentlyActiveSession()
+				}
+
 				natConnSendCh := make(chan *sessionQueuedPacket, lnc.sendChannelCapacity)
+				removeNatConnSendCh := resource.AddChannel(s.resources, natConnSendCh)
 				entry.natConnSendCh = natConnSendCh
+				entry.record = newUDPSessionRecord()
+				if s.sessionLimitPolicy == udpSessionLimitEvictLRU {
+					entry.lruElem = s.lru.add(csid)
+				}
 				s.table[csid] = entry
 				s.wg.Add(1)
 
-				go func() {
+				s.resources.Go(func() {
 					var sendChClean bool
 
 					defer func() {
 						s.server.Lock()
+						removeNatConnSendCh()
 						close(natConnSendCh)
-						delete(s.table, csid)
+						s.removeEntry(csid, entry)
 						s.server.Unlock()
 
 						if !sendChClean {
@@ -288,6 +454,7 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 
 					c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
 						ServerIndex:    s.serverIndex,
+						ListenAddrPort: lnc.listenAddrPort,
 						Username:       entry.username,
 						SourceAddrPort: queuedPacket.clientAddrPort,
 						TargetAddr:     queuedPacket.targetAddr,
@@ -300,10 +467,18 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 							zap.Error(err),
 						)
+						if errors.Is(err, router.ErrRejected) {
+							s.collector.CollectRejection(stats.RejectionKindRoute, "udp", queuedPacket.clientAddrPort, entry.username, queuedPacket.targetAddr, err)
+						}
 						return
 					}
 
-					clientInfo, clientSession, err := c.NewSession(ctx)
+					sessionCtx := zerocopy.WithUDPSessionTargetAddr(ctx, queuedPacket.targetAddr)
+					if entry.username != "" {
+						sessionCtx = conn.NewUsernameContext(sessionCtx, entry.username)
+					}
+
+					clientInfo, clientSession, err := c.NewSession(sessionCtx)
 					if err != nil {
 						lnc.logger.Warn("Failed to create new UDP client session",
 							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
@@ -316,7 +491,13 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 						return
 					}
 
-					natConn, _, err := clientInfo.ListenConfig.ListenUDPMmsgConn(ctx, "udp", "")
+					natConnListenConfig := clientInfo.ListenConfig
+					if s.trafficClass != 0 {
+						natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+					}
+					natConnListenConfig = natConnListenConfig.WithReceiveErrors()
+
+					natConn, natConnInfo, err := natConnListenConfig.ListenUDPMmsgConn(ctx, "udp", "")
 					if err != nil {
 						lnc.logger.Warn("Failed to create UDP socket for new NAT session",
 							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
@@ -330,7 +511,12 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 						return
 					}
 
-					err = natConn.SetReadDeadline(time.Now().Add(lnc.natTimeout))
+					// Count natConn for the lifetime of the session goroutine.
+					s.resources.AddFDs(1)
+					defer s.resources.AddFDs(-1)
+
+					natTimeout := lnc.natTimeoutFor(clientInfo)
+					err = natConn.SetReadDeadline(time.Now().Add(natTimeout))
 					if err != nil {
 						lnc.logger.Warn("Failed to set read deadline on natConn",
 							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
@@ -338,7 +524,7 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 							zap.Uint64("clientSessionID", csid),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 							zap.String("client", clientInfo.Name),
-							zap.Duration("natTimeout", lnc.natTimeout),
+							zap.Duration("natTimeout", natTimeout),
 							zap.Error(err),
 						)
 						natConn.Close()
@@ -370,6 +556,19 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 					// No more early returns!
 					sendChClean = true
 
+					s.server.Lock()
+					s.sessions.Add(affinity.Session{
+						ClientSessionID: csid,
+						ClientAddress:   entry.clientAddrInfo.Load().addrPort,
+						Username:        entry.username,
+						Client:          clientInfo.Name,
+						StartTime:       time.Now(),
+					}, func() {
+						entry.record.setCloseReason(event.CloseReasonClosed)
+						natConn.Close()
+					})
+					s.server.Unlock()
+
 					lnc.logger.Info("UDP session relay started",
 						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 						zap.String("username", entry.username),
@@ -378,24 +577,61 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 						zap.String("client", clientInfo.Name),
 					)
 
+					sessionEvent := event.Event{
+						Kind:          event.KindSessionCreated,
+						Server:        s.serverName,
+						Network:       "udp",
+						ClientAddress: queuedPacket.clientAddrPort,
+						Username:      entry.username,
+						TargetAddress: queuedPacket.targetAddr,
+						Client:        clientInfo.Name,
+					}
+					s.events.Publish(sessionEvent)
+					entry.record.setEvent(sessionEvent)
+
+					tracked := s.connTable.Add("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress, sessionEvent.Client, func() {
+						entry.record.setCloseReason(event.CloseReasonClosed)
+						natConn.Close()
+					})
+
+					flow := s.captures.NewFlow("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress)
+
+					pathMTU := newNatConnPathMTU(natConn.UDPConn, tracked, lnc.logger.With(
+						zap.String("username", entry.username),
+						zap.Uint64("clientSessionID", csid),
+						zap.String("client", clientInfo.Name),
+					))
+
+					filter := s.natFiltering.newFilter()
+					uplinkRateLimit := s.rateLimiter.Acquire(entry.username, queuedPacket.clientAddrPort.Addr())
+					downlinkRateLimit := s.rateLimiter.Acquire(entry.username, queuedPacket.clientAddrPort.Addr())
+
 					s.wg.Add(1)
 
-					go func() {
+					s.resources.Go(func() {
 						s.relayServerConnToNatConnSendmmsg(ctx, sessionUplinkMmsg{
 							csid:           csid,
 							clientName:     clientInfo.Name,
 							natConn:        natConn.NewWConn(),
 							natConnSendCh:  natConnSendCh,
 							natConnPacker:  clientSession.Packer,
-							natTimeout:     lnc.natTimeout,
+							natTimeout:     natTimeout,
+							pathMTU:        pathMTU,
 							username:       entry.username,
+							rateLimit:      uplinkRateLimit,
+							filter:         filter,
 							relayBatchSize: lnc.relayBatchSize,
+							v4Mapped:       lnc.useV4MappedDestinations(natConn, natConnInfo),
+							tracked:        tracked,
+							flow:           flow,
+							record:         entry.record,
 							logger:         lnc.logger,
 						})
+						uplinkRateLimit.Release()
 						natConn.Close()
 						clientSession.Close()
 						s.wg.Done()
-					}()
+					})
 
 					s.relayNatConnToServerConnSendmmsg(sessionDownlinkMmsg{
 						csid:               csid,
@@ -407,11 +643,19 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 						natConnUnpacker:    clientSession.Unpacker,
 						serverConn:         serverConn.NewWConn(),
 						serverConnPacker:   serverConnPacker,
+						pathMTU:            pathMTU,
 						username:           entry.username,
+						rateLimit:          downlinkRateLimit,
+						filter:             filter,
 						relayBatchSize:     lnc.relayBatchSize,
+						tracked:            tracked,
+						flow:               flow,
+						record:             entry.record,
 						logger:             lnc.logger,
 					})
-				}()
+					downlinkRateLimit.Release()
+					tracked.Remove()
+				})
 
 				if ce := lnc.logger.Check(zap.DebugLevel, "New UDP session"); ce != nil {
 					ce.Write(
@@ -421,21 +665,27 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
 					)
 				}
+			} else if entry.lruElem != nil {
+				s.lru.touch(entry.lruElem)
 			}
 
-			select {
-			case entry.natConnSendCh <- queuedPacket:
-			default:
-				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
-					ce.Write(
-						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
-						zap.String("username", entry.username),
-						zap.Uint64("clientSessionID", csid),
-						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
-					)
-				}
+			for _, i := range unpacked {
+				queuedPacket := qpvec[i]
 
-				s.putQueuedPacket(queuedPacket)
+				select {
+				case entry.natConnSendCh <- queuedPacket:
+				default:
+					if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
+						ce.Write(
+							zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+							zap.String("username", entry.username),
+							zap.Uint64("clientSessionID", csid),
+							zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						)
+					}
+
+					s.putQueuedPacket(queuedPacket)
+				}
 			}
 		}
 
@@ -456,14 +706,16 @@ func (s *UDPSessionRelay) recvFromServerConnRecvmmsg(ctx context.Context, lnc *u
 
 func (s *UDPSessionRelay) relayServerConnToNatConnSendmmsg(ctx context.Context, uplink sessionUplinkMmsg) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
-		burstBatchSize   int
+		destAddrPort            netip.AddrPort
+		packetStart             int
+		packetLength            int
+		err                     error
+		sendmmsgCount           uint64
+		packetsSent             uint64
+		payloadBytesSent        uint64
+		packetsDropped          uint64
+		oversizedPacketsDropped uint64
+		burstBatchSize          int
 	)
 
 	qpvec := make([]*sessionQueuedPacket, uplink.relayBatchSize)
@@ -491,8 +743,32 @@ main:
 
 	dequeue:
 		for {
+			if !s.userACLAllowed(ctx, uplink.logger, uplink.username, uplink.csid, queuedPacket) {
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
+			if !uplink.rateLimit.AllowUplink(queuedPacket.length) {
+				packetsDropped++
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
+			uplink.flow.UplinkDatagram(queuedPacket.targetAddr, queuedPacket.buf[queuedPacket.start:queuedPacket.start+queuedPacket.length])
+
 			destAddrPort, packetStart, packetLength, err = uplink.natConnPacker.PackInPlace(ctx, queuedPacket.buf, queuedPacket.targetAddr, queuedPacket.start, queuedPacket.length)
 			if err != nil {
+				if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+					oversizedPacketsDropped++
+				}
 				uplink.logger.Warn("Failed to pack packet for natConn",
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.String("username", uplink.username),
@@ -511,13 +787,38 @@ main:
 				goto next
 			}
 
+			if maxPacketSize := uplink.pathMTU.maxPacketSize(destAddrPort.Addr()); maxPacketSize > 0 && packetLength > maxPacketSize {
+				oversizedPacketsDropped++
+				if ce := uplink.logger.Check(zap.DebugLevel, "Dropping packet exceeding path MTU"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
+						zap.String("username", uplink.username),
+						zap.Uint64("clientSessionID", uplink.csid),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddr),
+						zap.String("client", uplink.clientName),
+						zap.Int("packetLength", packetLength),
+						zap.Int("maxPacketSize", maxPacketSize),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
+			uplink.filter.permit(destAddrPort)
+
 			qpvec[count] = queuedPacket
 			dapvec[count] = destAddrPort
-			namevec[count] = conn.AddrPortToSockaddrInet6(destAddrPort)
+			msgvec[count].Msghdr.Namelen = putDestSockaddr(&namevec[count], destAddrPort, uplink.v4Mapped)
 			iovec[count].Base = &queuedPacket.buf[packetStart]
 			iovec[count].SetLen(packetLength)
 			count++
 			payloadBytesSent += uint64(queuedPacket.length)
+			uplink.tracked.AddUplinkBytes(uint64(queuedPacket.length))
 
 			if count == uplink.relayBatchSize {
 				break
@@ -538,6 +839,9 @@ main:
 			n, err := uplink.natConn.WriteMsgs(msgvec[start:count], 0)
 			start += n
 			if err != nil {
+				if errors.Is(err, syscall.EMSGSIZE) {
+					uplink.pathMTU.readErrors()
+				}
 				uplink.logger.Warn("Failed to batch write packets to natConn",
 					zap.Stringer("clientAddress", &queuedPacket.clientAddrPort),
 					zap.String("username", uplink.username),
@@ -590,6 +894,13 @@ main:
 	)
 
 	s.collector.CollectUDPSessionUplink(uplink.username, packetsSent, payloadBytesSent)
+	uplink.record.finishUplink(s.events, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit(uplink.username, 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 {
+		s.collector.CollectOversizedPackets(uplink.username, oversizedPacketsDropped, 0)
+	}
 }
 
 func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownlinkMmsg) {
@@ -597,16 +908,21 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 	clientAddrPort := downlink.clientAddrInfop.addrPort
 	clientPktinfo := downlink.clientAddrInfop.pktinfo
 	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, clientAddrPort.Addr())
+	serverConn := downlink.serverConn
 
 	serverConnPackerInfo := downlink.serverConnPacker.ServerPackerInfo()
 	natConnUnpackerInfo := downlink.natConnUnpacker.ClientUnpackerInfo()
 	headroom := zerocopy.UDPRelayHeadroom(serverConnPackerInfo.Headroom, natConnUnpackerInfo.Headroom)
 
 	var (
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
-		burstBatchSize   int
+		sendmmsgCount             uint64
+		packetsSent               uint64
+		payloadBytesSent          uint64
+		packetsDropped            uint64
+		packetsFiltered           uint64
+		oversizedPacketsDropped   uint64
+		oversizedPacketsTruncated uint64
+		burstBatchSize            int
 	)
 
 	rsa6, namelen := conn.AddrPortToSockaddrValue(clientAddrPort)
@@ -640,10 +956,16 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 	for {
 		nr, err := downlink.natConn.ReadMsgs(rmsgvec, 0)
 		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
+			// natConn is closed when the session is forcibly terminated.
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
 				break
 			}
 
+			// Queued ICMP errors fail reads. They are not errors of the relay.
+			if downlink.pathMTU.readErrors() {
+				continue
+			}
+
 			downlink.logger.Warn("Failed to batch read packets from natConn",
 				zap.Stringer("clientAddress", clientAddrPort),
 				zap.String("username", downlink.username),
@@ -655,6 +977,22 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 		}
 
 		if caip := downlink.clientAddrInfo.Load(); caip != clientAddrInfop {
+			// Reply through the listener that last received from the client.
+			if caip.listener != clientAddrInfop.listener {
+				mc, err := conn.NewMmsgConn(caip.listener.serverConn)
+				if err != nil {
+					downlink.logger.Warn("Failed to switch serverConn",
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.String("username", downlink.username),
+						zap.Uint64("clientSessionID", downlink.csid),
+						zap.String("client", downlink.clientName),
+						zap.Error(err),
+					)
+				} else {
+					serverConn = mc.NewWConn()
+				}
+			}
+
 			clientAddrInfop = caip
 			clientAddrPort = caip.addrPort
 			clientPktinfo = caip.pktinfo
@@ -699,6 +1037,11 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 				continue
 			}
 
+			if !downlink.filter.allows(packetSourceAddrPort) {
+				packetsFiltered++
+				continue
+			}
+
 			packetBuf := bufvec[i]
 
 			payloadSourceAddrPort, payloadStart, payloadLength, err := downlink.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, headroom.Front, int(msg.Msglen))
@@ -715,7 +1058,27 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 				continue
 			}
 
+			if !downlink.rateLimit.AllowDownlink(payloadLength) {
+				packetsDropped++
+				continue
+			}
+
+			downlink.flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLength])
+
 			packetStart, packetLength, err := downlink.serverConnPacker.PackInPlace(packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+			if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+				if s.oversizedPayloadPolicy.truncatesFrom(payloadSourceAddrPort) {
+					var truncatedPayloadLength int
+					packetStart, packetLength, truncatedPayloadLength, err = packTruncatedDNSResponse(downlink.serverConnPacker, packetBuf, payloadSourceAddrPort, payloadStart, payloadLength, maxClientPacketSize)
+					if err == nil {
+						payloadLength = truncatedPayloadLength
+						oversizedPacketsTruncated++
+					}
+				}
+				if err != nil {
+					oversizedPacketsDropped++
+				}
+			}
 			if err != nil {
 				downlink.logger.Warn("Failed to pack packet for serverConn",
 					zap.Stringer("clientAddress", clientAddrPort),
@@ -735,6 +1098,7 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 			siovec[ns].SetLen(packetLength)
 			ns++
 			payloadBytesSent += uint64(payloadLength)
+			downlink.tracked.AddDownlinkBytes(uint64(payloadLength))
 		}
 
 		if ns == 0 {
@@ -742,7 +1106,7 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 		}
 
 		for start := 0; start < ns; {
-			n, err := downlink.serverConn.WriteMsgs(smsgvec[start:ns], 0)
+			n, err := serverConn.WriteMsgs(smsgvec[start:ns], 0)
 			start += n
 			if err != nil {
 				downlink.logger.Warn("Failed to batch write packets to serverConn",
@@ -770,8 +1134,16 @@ func (s *UDPSessionRelay) relayNatConnToServerConnSendmmsg(downlink sessionDownl
 		zap.Uint64("sendmmsgCount", sendmmsgCount),
 		zap.Uint64("packetsSent", packetsSent),
 		zap.Uint64("payloadBytesSent", payloadBytesSent),
+		zap.Uint64("packetsFiltered", packetsFiltered),
 		zap.Int("burstBatchSize", burstBatchSize),
 	)
 
 	s.collector.CollectUDPSessionDownlink(downlink.username, packetsSent, payloadBytesSent)
+	downlink.record.finishDownlink(s.events, downlink.clientAddrInfo.Load().addrPort, packetsSent, payloadBytesSent)
+	if packetsDropped > 0 {
+		s.collector.CollectRateLimit(downlink.username, 0, packetsDropped)
+	}
+	if oversizedPacketsDropped > 0 || oversizedPacketsTruncated > 0 {
+		s.collector.CollectOversizedPackets(downlink.username, oversizedPacketsDropped, oversizedPacketsTruncated)
+	}
 }
@@ -0,0 +1,275 @@
+//go:build freebsd || linux
+
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/capture"
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/dns"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/resource"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"go.uber.org/zap"
+)
+
+// transparentQueuedPacket is the structure used by send channels to queue packets for sending.
+type transparentQueuedPacket struct {
+	buf            []byte
+	targetAddrPort netip.AddrPort
+	msglen         uint32
+}
+
+// transparentNATEntry is an entry in the tproxy NAT table.
+type transparentNATEntry struct {
+	// state synchronizes session initialization and shutdown.
+	//
+	//  - Swap the natConn in to signal initialization completion.
+	//  - Swap the serverConn in to signal shutdown.
+	//
+	// Callers must check the swapped-out value to determine the next action.
+	//
+	//  - During initialization, if the swapped-out value is non-nil,
+	//    initialization must not proceed.
+	//  - During shutdown, if the swapped-out value is nil, preceed to the next entry.
+	state         atomic.Pointer[net.UDPConn]
+	natConnSendCh chan<- *transparentQueuedPacket
+	serverConn    *net.UDPConn
+	logger        *zap.Logger
+
+	// record collects the session's traffic and close reason for its expired event.
+	record *udpSessionRecord
+}
+
+// UDPTransparentRelay is like [UDPNATRelay], but for transparent proxy.
+type UDPTransparentRelay struct {
+	serverName                  string
+	serverIndex                 int
+	mtu                         int
+	packetBufFrontHeadroom      int
+	packetBufRecvSize           int
+	listeners                   []udpRelayServerConn
+	transparentConnListenConfig conn.ListenConfig
+	maxSessions                 int
+	trafficClass                int
+	collector                   stats.Collector
+	events                      *event.Bus
+	router                      *router.Router
+	portUnreachable             *portUnreachableSender
+	dnsHijack                   *dnsHijacker
+	connTable                   *conntrack.Table
+	captures                    *capture.Server
+	resources                   *resource.Counter
+	logger                      *zap.Logger
+	queuedPacketPool            *packetPool[transparentQueuedPacket]
+	mu                          sync.Mutex
+	wg                          sync.WaitGroup
+	mwg                         sync.WaitGroup
+	table                       map[netip.AddrPort]*transparentNATEntry
+	draining                    bool
+}
+
+func NewUDPTransparentRelay(
+	serverName string,
+	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize, packetBufPoolSize int,
+	listeners []udpRelayServerConn,
+	transparentConnListenConfig conn.ListenConfig,
+	maxSessions int,
+	trafficClass int,
+	collector stats.Collector,
+	events *event.Bus,
+	router *router.Router,
+	portUnreachable *portUnreachableSender,
+	dnsHijack *dnsHijacker,
+	connTable *conntrack.Table,
+	captures *capture.Server,
+	resources *resource.Counter,
+	logger *zap.Logger,
+) (Relay, error) {
+	return &UDPTransparentRelay{
+		serverName:                  serverName,
+		serverIndex:                 serverIndex,
+		mtu:                         mtu,
+		packetBufFrontHeadroom:      packetBufFrontHeadroom,
+		packetBufRecvSize:           packetBufRecvSize,
+		listeners:                   listeners,
+		transparentConnListenConfig: transparentConnListenConfig,
+		maxSessions:                 maxSessions,
+		trafficClass:                trafficClass,
+		collector:                   collector,
+		events:                      events,
+		router:                      router,
+		portUnreachable:             portUnreachable,
+		dnsHijack:                   dnsHijack,
+		connTable:                   connTable,
+		captures:                    captures,
+		resources:                   resources,
+		logger:                      logger,
+		queuedPacketPool: newPacketPool(packetBufPoolSize, func() *transparentQueuedPacket {
+			resources.AllocBuffer()
+			return &transparentQueuedPacket{
+				buf: make([]byte, packetBufSize),
+			}
+		}),
+		table: make(map[netip.AddrPort]*transparentNATEntry),
+	}, nil
+}
+
+// String implements the Relay String method.
+func (s *UDPTransparentRelay) String() string {
+	return "UDP transparent relay service for " + s.serverName
+}
+
+// Start implements the Relay Start method.
+func (s *UDPTransparentRelay) Start(ctx context.Context) error {
+	for i := range s.listeners {
+		if err := s.start(ctx, i, &s.listeners[i]); err != nil {
+			return err
+		}
+		s.resources.AddFDs(1)
+	}
+	return nil
+}
+
+// getQueuedPacket retrieves a queued packet from the pool.
+func (s *UDPTransparentRelay) getQueuedPacket() *transparentQueuedPacket {
+	queuedPacket := s.queuedPacketPool.Get()
+	s.resources.GetBuffer(len(queuedPacket.buf))
+	return queuedPacket
+}
+
+// putQueuedPacket puts the queued packet back into the pool.
+func (s *UDPTransparentRelay) putQueuedPacket(queuedPacket *transparentQueuedPacket) {
+	s.resources.PutBuffer(len(queuedPacket.buf))
+	s.queuedPacketPool.Put(queuedPacket)
+}
+
+// hijackDNS answers the intercepted DNS query in queuedPacket from clientAddrPort in a new goroutine,
+// and sends the response from the query's target address.
+func (s *UDPTransparentRelay) hijackDNS(ctx context.Context, lnc *udpRelayServerConn, clientAddrPort netip.AddrPort, queuedPacket *transparentQueuedPacket) {
+	s.wg.Add(1)
+
+	s.resources.Go(func() {
+		defer s.wg.Done()
+		defer s.putQueuedPacket(queuedPacket)
+
+		clientAddrPort := netip.AddrPortFrom(clientAddrPort.Addr().Unmap(), clientAddrPort.Port())
+		targetAddrPort := netip.AddrPortFrom(queuedPacket.targetAddrPort.Addr().Unmap(), queuedPacket.targetAddrPort.Port())
+		query := queuedPacket.buf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+int(queuedPacket.msglen)]
+
+		resp, err := s.dnsHijack.respond(ctx, query, dns.MaxUDPResponseSize)
+		if err != nil {
+			lnc.logger.Warn("Failed to answer intercepted DNS query",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("targetAddress", targetAddrPort),
+				zap.Error(err),
+			)
+			return
+		}
+
+		// Queries sent to the listener itself are answered from the listener.
+		tc := lnc.serverConn
+		if targetAddrPort != lnc.listenAddrPort {
+			tc, _, err = s.transparentConnListenConfig.ListenUDP(ctx, "udp", targetAddrPort.String())
+			if err != nil {
+				lnc.logger.Warn("Failed to create transparent socket for intercepted DNS query",
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("targetAddress", targetAddrPort),
+					zap.Error(err),
+				)
+				return
+			}
+			defer tc.Close()
+		}
+
+		if _, err = tc.WriteToUDPAddrPort(resp, clientAddrPort); err != nil {
+			lnc.logger.Warn("Failed to send response to intercepted DNS query",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("targetAddress", targetAddrPort),
+				zap.Error(err),
+			)
+			return
+		}
+
+		if ce := lnc.logger.Check(zap.DebugLevel, "Answered intercepted DNS query"); ce != nil {
+			ce.Write(
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Stringer("targetAddress", targetAddrPort),
+				zap.Int("responseLength", len(resp)),
+			)
+		}
+	})
+}
+
+// Stop implements the Relay Stop method.
+func (s *UDPTransparentRelay) Stop() error {
+	for i := range s.listeners {
+		lnc := &s.listeners[i]
+		if err := lnc.serverConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
+			lnc.logger.Warn("Failed to set read deadline on serverConn", zap.Error(err))
+		}
+	}
+
+	// Wait for serverConn receive goroutines to exit,
+	// so there won't be any new sessions added to the table.
+	s.mwg.Wait()
+
+	s.mu.Lock()
+	for clientAddrPort, entry := range s.table {
+		entry.record.setCloseReason(event.CloseReasonShutdown)
+		natConn := entry.state.Swap(entry.serverConn)
+		if natConn == nil {
+			continue
+		}
+
+		if err := natConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
+			entry.logger.Warn("Failed to set read deadline on natConn",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Error(err),
+			)
+		}
+	}
+	s.mu.Unlock()
+
+	// Wait for all relay goroutines to exit before closing serverConn,
+	// so in-flight packets can be written out.
+	s.wg.Wait()
+
+	for i := range s.listeners {
+		lnc := &s.listeners[i]
+		if err := lnc.serverConn.Close(); err != nil {
+			lnc.logger.Warn("Failed to close serverConn", zap.Error(err))
+		}
+		s.resources.AddFDs(-1)
+	}
+
+	if s.portUnreachable != nil {
+		s.portUnreachable.Close()
+	}
+
+	return nil
+}
+
+// Drain implements [Drainer.Drain].
+// Sessions finish when they are idle for the NAT timeout.
+func (s *UDPTransparentRelay) Drain(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	var closed int
+	if !waitGroupWait(ctx, &s.wg) {
+		s.mu.Lock()
+		closed = len(s.table)
+		s.mu.Unlock()
+	}
+
+	return closed, s.Stop()
+}
@@ -0,0 +1,563 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/capture"
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/resource"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// transparentUplinkGeneric is used for passing information about relay uplink to the relay goroutine.
+type transparentUplinkGeneric struct {
+	clientName     string
+	clientAddrPort netip.AddrPort
+	natConn        *net.UDPConn
+	natConnSendCh  <-chan *transparentQueuedPacket
+	natConnPacker  zerocopy.ClientPacker
+	natTimeout     time.Duration
+	tracked        *conntrack.Entry
+	flow           *capture.Flow
+	record         *udpSessionRecord
+	logger         *zap.Logger
+}
+
+// transparentDownlinkGeneric is used for passing information about relay downlink to the relay goroutine.
+type transparentDownlinkGeneric struct {
+	clientName         string
+	clientAddrPort     netip.AddrPort
+	natConn            *net.UDPConn
+	natConnRecvBufSize int
+	natConnUnpacker    zerocopy.ClientUnpacker
+	tracked            *conntrack.Entry
+	flow               *capture.Flow
+	record             *udpSessionRecord
+	logger             *zap.Logger
+}
+
+// On FreeBSD, packets are intercepted by redirecting them to the listener without
+// rewriting the destination address, e.g. with ipfw fwd or pf route-to lo0.
+// The listener receives the original destination address via IP_ORIGDSTADDR/IPV6_ORIGDSTADDR,
+// and replies are sent from sockets bound to the original destination address with IP_BINDANY/IPV6_BINDANY.
+func (s *UDPTransparentRelay) start(ctx context.Context, index int, lnc *udpRelayServerConn) (err error) {
+	lnc.serverConn, _, err = lnc.listenConfig.ListenUDP(ctx, lnc.network, lnc.address)
+	if err != nil {
+		return
+	}
+	lnc.address = lnc.serverConn.LocalAddr().String()
+	lnc.listenAddrPort = lnc.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	lnc.logger = s.logger.With(
+		zap.String("server", s.serverName),
+		zap.Int("listener", index),
+		zap.String("listenAddress", lnc.address),
+	)
+
+	s.mwg.Add(1)
+
+	s.resources.Go(func() {
+		lnc.pinReceiveRoutine()
+		s.recvFromServerConnGeneric(ctx, lnc)
+		s.mwg.Done()
+	})
+
+	lnc.logger.Info("Started UDP transparent relay service listener")
+	return
+}
+
+func (s *UDPTransparentRelay) recvFromServerConnGeneric(ctx context.Context, lnc *udpRelayServerConn) {
+	cmsgBuf := make([]byte, conn.TransparentSocketControlMessageBufferSize)
+
+	var (
+		packetsReceived      uint64
+		payloadBytesReceived uint64
+	)
+
+	for {
+		queuedPacket := s.getQueuedPacket()
+		recvBuf := queuedPacket.buf[s.packetBufFrontHeadroom : s.packetBufFrontHeadroom+s.packetBufRecvSize]
+
+		n, cmsgn, flags, clientAddrPort, err := lnc.serverConn.ReadMsgUDPAddrPort(recvBuf, cmsgBuf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.putQueuedPacket(queuedPacket)
+				break
+			}
+
+			lnc.logger.Warn("Failed to read packet from serverConn",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+
+		if !lnc.acl.Allowed(clientAddrPort.Addr()) {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet denied by ACL"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindACL, "udp", clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+		if err = conn.ParseFlagsForError(flags); err != nil {
+			lnc.logger.Warn("Packet from serverConn discarded",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+
+		queuedPacket.targetAddrPort, err = conn.ParseOrigDstAddrCmsg(cmsgBuf[:cmsgn])
+		if err != nil {
+			lnc.logger.Warn("Failed to parse original destination address control message from serverConn",
+				zap.Stringer("clientAddress", clientAddrPort),
+				zap.Error(err),
+			)
+
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+
+		queuedPacket.msglen = uint32(n)
+		packetsReceived++
+		payloadBytesReceived += uint64(n)
+
+		if s.dnsHijack.shouldHijack(queuedPacket.targetAddrPort.Port()) {
+			s.hijackDNS(ctx, lnc, clientAddrPort, queuedPacket)
+			continue
+		}
+
+		s.mu.Lock()
+
+		entry := s.table[clientAddrPort]
+		if entry == nil && s.maxSessions > 0 && len(s.table) >= s.maxSessions {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session limit"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Int("maxSessions", s.maxSessions),
+				)
+			}
+			s.collector.CollectRejection(stats.RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, errUDPSessionLimit)
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
+		if entry == nil && s.draining {
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet of new UDP session while draining"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+			s.mu.Unlock()
+			continue
+		}
+		if entry == nil {
+			natConnSendCh := make(chan *transparentQueuedPacket, lnc.sendChannelCapacity)
+			removeNatConnSendCh := resource.AddChannel(s.resources, natConnSendCh)
+			entry = &transparentNATEntry{
+				natConnSendCh: natConnSendCh,
+				serverConn:    lnc.serverConn,
+				record:        newUDPSessionRecord(),
+				logger:        lnc.logger,
+			}
+			s.table[clientAddrPort] = entry
+			s.wg.Add(1)
+
+			s.resources.Go(func() {
+				var sendChClean bool
+
+				defer func() {
+					s.mu.Lock()
+					removeNatConnSendCh()
+					close(natConnSendCh)
+					delete(s.table, clientAddrPort)
+					s.mu.Unlock()
+
+					if !sendChClean {
+						for queuedPacket := range natConnSendCh {
+							s.putQueuedPacket(queuedPacket)
+						}
+					}
+
+					s.wg.Done()
+				}()
+
+				c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
+					ServerIndex:    s.serverIndex,
+					ListenAddrPort: lnc.listenAddrPort,
+					SourceAddrPort: clientAddrPort,
+					TargetAddr:     conn.AddrFromIPPort(queuedPacket.targetAddrPort),
+				})
+				if err != nil {
+					lnc.logger.Warn("Failed to get UDP client for new NAT session",
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+						zap.Error(err),
+					)
+					if mode, ok := router.RejectModeOf(err); ok {
+						s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, "", conn.AddrFromIPPort(queuedPacket.targetAddrPort), err)
+						if mode == router.RejectModeReset && s.portUnreachable != nil {
+							s.portUnreachable.Send(clientAddrPort, queuedPacket.targetAddrPort, int(queuedPacket.msglen))
+						}
+					}
+					return
+				}
+
+				clientInfo, clientSession, err := c.NewSession(zerocopy.WithUDPSessionTargetAddr(ctx, conn.AddrFromIPPort(queuedPacket.targetAddrPort)))
+				if err != nil {
+					lnc.logger.Warn("Failed to create new UDP client session",
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+						zap.String("client", clientInfo.Name),
+						zap.Error(err),
+					)
+					return
+				}
+
+				natConnListenConfig := clientInfo.ListenConfig
+				if s.trafficClass != 0 {
+					natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+				}
+
+				natConn, _, err := natConnListenConfig.ListenUDP(ctx, "udp", "")
+				if err != nil {
+					lnc.logger.Warn("Failed to create UDP socket for new NAT session",
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+						zap.String("client", clientInfo.Name),
+						zap.Error(err),
+					)
+					clientSession.Close()
+					return
+				}
+
+				// Count natConn for the lifetime of the session goroutine.
+				s.resources.AddFDs(1)
+				defer s.resources.AddFDs(-1)
+
+				natTimeout := lnc.natTimeoutFor(clientInfo)
+				if err = natConn.SetReadDeadline(time.Now().Add(natTimeout)); err != nil {
+					lnc.logger.Warn("Failed to set read deadline on natConn",
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+						zap.String("client", clientInfo.Name),
+						zap.Duration("natTimeout", natTimeout),
+						zap.Error(err),
+					)
+					natConn.Close()
+					clientSession.Close()
+					return
+				}
+
+				oldState := entry.state.Swap(natConn)
+				if oldState != nil {
+					natConn.Close()
+					clientSession.Close()
+					return
+				}
+
+				// No more early returns!
+				sendChClean = true
+
+				lnc.logger.Info("UDP transparent relay started",
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+					zap.String("client", clientInfo.Name),
+				)
+
+				sessionEvent := event.Event{
+					Kind:          event.KindSessionCreated,
+					Server:        s.serverName,
+					Network:       "udp",
+					ClientAddress: clientAddrPort,
+					TargetAddress: conn.AddrFromIPPort(queuedPacket.targetAddrPort),
+					Client:        clientInfo.Name,
+				}
+				s.events.Publish(sessionEvent)
+				entry.record.setEvent(sessionEvent)
+
+				tracked := s.connTable.Add("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress, sessionEvent.Client, func() {
+					entry.record.setCloseReason(event.CloseReasonClosed)
+					natConn.Close()
+				})
+
+				flow := s.captures.NewFlow("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress)
+
+				s.wg.Add(1)
+
+				s.resources.Go(func() {
+					s.relayServerConnToNatConnGeneric(ctx, transparentUplinkGeneric{
+						clientName:     clientInfo.Name,
+						clientAddrPort: clientAddrPort,
+						natConn:        natConn,
+						natConnSendCh:  natConnSendCh,
+						natConnPacker:  clientSession.Packer,
+						natTimeout:     natTimeout,
+						tracked:        tracked,
+						flow:           flow,
+						record:         entry.record,
+						logger:         lnc.logger,
+					})
+					natConn.Close()
+					clientSession.Close()
+					s.wg.Done()
+				})
+
+				s.relayNatConnToTransparentConnGeneric(ctx, transparentDownlinkGeneric{
+					clientName:         clientInfo.Name,
+					clientAddrPort:     clientAddrPort,
+					natConn:            natConn,
+					natConnRecvBufSize: clientSession.MaxPacketSize,
+					natConnUnpacker:    clientSession.Unpacker,
+					tracked:            tracked,
+					flow:               flow,
+					record:             entry.record,
+					logger:             lnc.logger,
+				})
+				tracked.Remove()
+			})
+
+			if ce := lnc.logger.Check(zap.DebugLevel, "New UDP transparent session"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+				)
+			}
+		}
+
+		select {
+		case entry.natConnSendCh <- queuedPacket:
+		default:
+			if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet due to full send channel"); ce != nil {
+				ce.Write(
+					zap.Stringer("clientAddress", clientAddrPort),
+					zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+				)
+			}
+
+			s.putQueuedPacket(queuedPacket)
+		}
+
+		s.mu.Unlock()
+	}
+
+	lnc.logger.Info("Finished receiving from serverConn",
+		zap.Uint64("packetsReceived", packetsReceived),
+		zap.Uint64("payloadBytesReceived", payloadBytesReceived),
+	)
+}
+
+func (s *UDPTransparentRelay) relayServerConnToNatConnGeneric(ctx context.Context, uplink transparentUplinkGeneric) {
+	var (
+		destAddrPort            netip.AddrPort
+		packetStart             int
+		packetLength            int
+		err                     error
+		packetsSent             uint64
+		payloadBytesSent        uint64
+		oversizedPacketsDropped uint64
+	)
+
+	for queuedPacket := range uplink.natConnSendCh {
+		uplink.flow.UplinkDatagram(conn.AddrFromIPPort(queuedPacket.targetAddrPort), queuedPacket.buf[s.packetBufFrontHeadroom:s.packetBufFrontHeadroom+int(queuedPacket.msglen)])
+
+		destAddrPort, packetStart, packetLength, err = uplink.natConnPacker.PackInPlace(ctx, queuedPacket.buf, conn.AddrFromIPPort(queuedPacket.targetAddrPort), s.packetBufFrontHeadroom, int(queuedPacket.msglen))
+		if err != nil {
+			if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+				oversizedPacketsDropped++
+			}
+			uplink.logger.Warn("Failed to pack packet for natConn",
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+				zap.String("client", uplink.clientName),
+				zap.Uint32("payloadLength", queuedPacket.msglen),
+				zap.Error(err),
+			)
+
+			s.putQueuedPacket(queuedPacket)
+			continue
+		}
+
+		_, err = uplink.natConn.WriteToUDPAddrPort(queuedPacket.buf[packetStart:packetStart+packetLength], destAddrPort)
+		if err != nil {
+			uplink.logger.Warn("Failed to write packet to natConn",
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+				zap.String("client", uplink.clientName),
+				zap.Stringer("writeDestAddress", destAddrPort),
+				zap.Int("packetLength", packetLength),
+				zap.Error(err),
+			)
+		}
+
+		if err = uplink.natConn.SetReadDeadline(time.Now().Add(uplink.natTimeout)); err != nil {
+			uplink.logger.Warn("Failed to set read deadline on natConn",
+				zap.Stringer("clientAddress", uplink.clientAddrPort),
+				zap.String("client", uplink.clientName),
+				zap.Duration("natTimeout", uplink.natTimeout),
+				zap.Error(err),
+			)
+		}
+
+		packetsSent++
+		payloadBytesSent += uint64(queuedPacket.msglen)
+		uplink.tracked.AddUplinkBytes(uint64(queuedPacket.msglen))
+		s.putQueuedPacket(queuedPacket)
+	}
+
+	uplink.logger.Info("Finished relay serverConn -> natConn",
+		zap.Stringer("clientAddress", uplink.clientAddrPort),
+		zap.String("client", uplink.clientName),
+		zap.Stringer("lastWriteDestAddress", destAddrPort),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("payloadBytesSent", payloadBytesSent),
+	)
+
+	s.collector.CollectUDPSessionUplink("", packetsSent, payloadBytesSent)
+	uplink.record.finishUplink(s.events, packetsSent, payloadBytesSent)
+	if oversizedPacketsDropped > 0 {
+		s.collector.CollectOversizedPackets("", oversizedPacketsDropped, 0)
+	}
+}
+
+func (s *UDPTransparentRelay) relayNatConnToTransparentConnGeneric(ctx context.Context, downlink transparentDownlinkGeneric) {
+	var (
+		packetsSent      uint64
+		payloadBytesSent uint64
+	)
+
+	maxClientPacketSize := zerocopy.MaxPacketSizeForAddr(s.mtu, downlink.clientAddrPort.Addr())
+	clientAddrPort := netip.AddrPortFrom(downlink.clientAddrPort.Addr().Unmap(), downlink.clientAddrPort.Port())
+	tcMap := make(map[netip.AddrPort]*net.UDPConn)
+	packetBuf := make([]byte, downlink.natConnRecvBufSize)
+
+	for {
+		n, _, flags, packetSourceAddrPort, err := downlink.natConn.ReadMsgUDPAddrPort(packetBuf, nil)
+		if err != nil {
+			// natConn is closed when the session is forcibly terminated.
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+				break
+			}
+
+			downlink.logger.Warn("Failed to read packet from natConn",
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+				zap.String("client", downlink.clientName),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err = conn.ParseFlagsForError(flags); err != nil {
+			downlink.logger.Warn("Packet from natConn discarded",
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+				zap.String("client", downlink.clientName),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		payloadSourceAddrPort, payloadStart, payloadLength, err := downlink.natConnUnpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, 0, n)
+		if err != nil {
+			downlink.logger.Warn("Failed to unpack packet from natConn",
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+				zap.String("client", downlink.clientName),
+				zap.Int("packetLength", n),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		if payloadLength > maxClientPacketSize {
+			downlink.logger.Warn("Payload too large to send to client",
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+				zap.String("client", downlink.clientName),
+				zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+				zap.Int("payloadLength", payloadLength),
+				zap.Int("maxClientPacketSize", maxClientPacketSize),
+			)
+			continue
+		}
+
+		downlink.flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLength])
+
+		tc := tcMap[payloadSourceAddrPort]
+		if tc == nil {
+			tc, _, err = s.transparentConnListenConfig.ListenUDP(ctx, "udp", payloadSourceAddrPort.String())
+			if err != nil {
+				downlink.logger.Warn("Failed to create transparentConn",
+					zap.Stringer("clientAddress", downlink.clientAddrPort),
+					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+					zap.String("client", downlink.clientName),
+					zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+					zap.Error(err),
+				)
+				continue
+			}
+			tcMap[payloadSourceAddrPort] = tc
+			s.resources.AddFDs(1)
+		}
+
+		if _, err = tc.WriteToUDPAddrPort(packetBuf[payloadStart:payloadStart+payloadLength], clientAddrPort); err != nil {
+			downlink.logger.Warn("Failed to write packet to transparentConn",
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.String("client", downlink.clientName),
+				zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+				zap.Int("payloadLength", payloadLength),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		packetsSent++
+		payloadBytesSent += uint64(payloadLength)
+		downlink.tracked.AddDownlinkBytes(uint64(payloadLength))
+	}
+
+	for payloadSourceAddrPort, tc := range tcMap {
+		if err := tc.Close(); err != nil {
+			downlink.logger.Warn("Failed to close transparentConn",
+				zap.Stringer("clientAddress", downlink.clientAddrPort),
+				zap.String("client", downlink.clientName),
+				zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+				zap.Error(err),
+			)
+		}
+	}
+	s.resources.AddFDs(-int64(len(tcMap)))
+
+	downlink.logger.Info("Finished relay transparentConn <- natConn",
+		zap.Stringer("clientAddress", downlink.clientAddrPort),
+		zap.String("client", downlink.clientName),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("payloadBytesSent", payloadBytesSent),
+	)
+
+	s.collector.CollectUDPSessionDownlink("", packetsSent, payloadBytesSent)
+	downlink.record.finishDownlink(s.events, downlink.clientAddrPort, packetsSent, payloadBytesSent)
+}
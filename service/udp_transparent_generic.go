@@ -1,11 +1,15 @@
-//go:build !linux
+//go:build !freebsd && !linux
 
 package service
 
 import (
 	"errors"
 
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
 	"github.com/database64128/shadowsocks-go/stats"
 	"go.uber.org/zap"
@@ -13,11 +17,19 @@ import (
 
 func NewUDPTransparentRelay(
 	serverName string,
-	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize int,
+	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize, packetBufPoolSize int,
 	listeners []udpRelayServerConn,
 	transparentConnListenConfig conn.ListenConfig,
+	maxSessions int,
+	trafficClass int,
 	collector stats.Collector,
+	events *event.Bus,
 	router *router.Router,
+	portUnreachable *portUnreachableSender,
+	dnsHijack *dnsHijacker,
+	connTable *conntrack.Table,
+	captures *capture.Server,
+	resources *resource.Counter,
 	logger *zap.Logger,
 ) (Relay, error) {
 	return nil, errors.New("transparent proxy is not implemented for this platform")
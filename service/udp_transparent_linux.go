@@ -6,12 +6,15 @@ import (
 	"net"
 	"net/netip"
 	"os"
-	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/database64128/shadowsocks-go/capture"
 	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/conntrack"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/resource"
 	"github.com/database64128/shadowsocks-go/router"
 	"github.com/database64128/shadowsocks-go/stats"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -19,31 +22,6 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// transparentQueuedPacket is the structure used by send channels to queue packets for sending.
-type transparentQueuedPacket struct {
-	buf            []byte
-	targetAddrPort netip.AddrPort
-	msglen         uint32
-}
-
-// transparentNATEntry is an entry in the tproxy NAT table.
-type transparentNATEntry struct {
-	// state synchronizes session initialization and shutdown.
-	//
-	//  - Swap the natConn in to signal initialization completion.
-	//  - Swap the serverConn in to signal shutdown.
-	//
-	// Callers must check the swapped-out value to determine the next action.
-	//
-	//  - During initialization, if the swapped-out value is non-nil,
-	//    initialization must not proceed.
-	//  - During shutdown, if the swapped-out value is nil, preceed to the next entry.
-	state         atomic.Pointer[net.UDPConn]
-	natConnSendCh chan<- *transparentQueuedPacket
-	serverConn    *net.UDPConn
-	logger        *zap.Logger
-}
-
 // transparentUplink is used for passing information about relay uplink to the relay goroutine.
 type transparentUplink struct {
 	clientName     string
@@ -52,7 +30,12 @@ type transparentUplink struct {
 	natConnSendCh  <-chan *transparentQueuedPacket
 	natConnPacker  zerocopy.ClientPacker
 	natTimeout     time.Duration
+	pathMTU        *natConnPathMTU
 	relayBatchSize int
+	v4Mapped       bool
+	tracked        *conntrack.Entry
+	flow           *capture.Flow
+	record         *udpSessionRecord
 	logger         *zap.Logger
 }
 
@@ -63,92 +46,37 @@ type transparentDownlink struct {
 	natConn            *conn.MmsgRConn
 	natConnRecvBufSize int
 	natConnUnpacker    zerocopy.ClientUnpacker
+	pathMTU            *natConnPathMTU
 	relayBatchSize     int
+	tracked            *conntrack.Entry
+	flow               *capture.Flow
+	record             *udpSessionRecord
 	logger             *zap.Logger
 }
 
-// UDPTransparentRelay is like [UDPNATRelay], but for transparent proxy.
-type UDPTransparentRelay struct {
-	serverName                  string
-	serverIndex                 int
-	mtu                         int
-	packetBufFrontHeadroom      int
-	packetBufRecvSize           int
-	listeners                   []udpRelayServerConn
-	transparentConnListenConfig conn.ListenConfig
-	collector                   stats.Collector
-	router                      *router.Router
-	logger                      *zap.Logger
-	queuedPacketPool            sync.Pool
-	mu                          sync.Mutex
-	wg                          sync.WaitGroup
-	mwg                         sync.WaitGroup
-	table                       map[netip.AddrPort]*transparentNATEntry
-}
-
-func NewUDPTransparentRelay(
-	serverName string,
-	serverIndex, mtu, packetBufFrontHeadroom, packetBufRecvSize, packetBufSize int,
-	listeners []udpRelayServerConn,
-	transparentConnListenConfig conn.ListenConfig,
-	collector stats.Collector,
-	router *router.Router,
-	logger *zap.Logger,
-) (Relay, error) {
-	return &UDPTransparentRelay{
-		serverName:                  serverName,
-		serverIndex:                 serverIndex,
-		mtu:                         mtu,
-		packetBufFrontHeadroom:      packetBufFrontHeadroom,
-		packetBufRecvSize:           packetBufRecvSize,
-		listeners:                   listeners,
-		transparentConnListenConfig: transparentConnListenConfig,
-		collector:                   collector,
-		router:                      router,
-		logger:                      logger,
-		queuedPacketPool: sync.Pool{
-			New: func() any {
-				return &transparentQueuedPacket{
-					buf: make([]byte, packetBufSize),
-				}
-			},
-		},
-		table: make(map[netip.AddrPort]*transparentNATEntry),
-	}, nil
-}
+func (s *UDPTransparentRelay) start(ctx context.Context, index int, lnc *udpRelayServerConn) error {
+	serverConn, _, err := lnc.listenConfig.ListenUDPMmsgConn(ctx, lnc.network, lnc.address)
+	if err != nil {
+		return err
+	}
+	lnc.serverConn = serverConn.UDPConn
+	lnc.address = serverConn.LocalAddr().String()
+	lnc.listenAddrPort = lnc.serverConn.LocalAddr().(*net.UDPAddr).AddrPort()
+	lnc.logger = s.logger.With(
+		zap.String("server", s.serverName),
+		zap.Int("listener", index),
+		zap.String("listenAddress", lnc.address),
+	)
 
-// String implements the Relay String method.
-func (s *UDPTransparentRelay) String() string {
-	return "UDP transparent relay service for " + s.serverName
-}
+	s.mwg.Add(1)
 
-// Start implements the Relay Start method.
-func (s *UDPTransparentRelay) Start(ctx context.Context) error {
-	for i := range s.listeners {
-		index := i
-		lnc := &s.listeners[index]
+	s.resources.Go(func() {
+		lnc.pinReceiveRoutine()
+		s.recvFromServerConnRecvmmsg(ctx, lnc, serverConn.NewRConn())
+		s.mwg.Done()
+	})
 
-		serverConn, _, err := lnc.listenConfig.ListenUDPMmsgConn(ctx, lnc.network, lnc.address)
-		if err != nil {
-			return err
-		}
-		lnc.serverConn = serverConn.UDPConn
-		lnc.address = serverConn.LocalAddr().String()
-		lnc.logger = s.logger.With(
-			zap.String("server", s.serverName),
-			zap.Int("listener", index),
-			zap.String("listenAddress", lnc.address),
-		)
-
-		s.mwg.Add(1)
-
-		go func() {
-			s.recvFromServerConnRecvmmsg(ctx, lnc, serverConn.NewRConn())
-			s.mwg.Done()
-		}()
-
-		lnc.logger.Info("Started UDP transparent relay service listener")
-	}
+	lnc.logger.Info("Started UDP transparent relay service listener")
 	return nil
 }
 
@@ -219,6 +147,17 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 				continue
 			}
 
+			if !lnc.acl.Allowed(clientAddrPort.Addr()) {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet denied by ACL"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+					)
+				}
+				s.collector.CollectRejection(stats.RejectionKindACL, "udp", clientAddrPort, "", conn.Addr{}, errClientAddressDenied)
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+
 			if err = conn.ParseFlagsForError(int(msg.Msghdr.Flags)); err != nil {
 				lnc.logger.Warn("Packet from serverConn discarded",
 					zap.Stringer("clientAddress", clientAddrPort),
@@ -243,22 +182,52 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 			queuedPacket.msglen = msg.Msglen
 			payloadBytesReceived += uint64(msg.Msglen)
 
+			if s.dnsHijack.shouldHijack(queuedPacket.targetAddrPort.Port()) {
+				s.hijackDNS(ctx, lnc, clientAddrPort, queuedPacket)
+				continue
+			}
+
 			entry := s.table[clientAddrPort]
+			if entry == nil && s.maxSessions > 0 && len(s.table) >= s.maxSessions {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet over the UDP session limit"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.Int("maxSessions", s.maxSessions),
+					)
+				}
+				s.collector.CollectRejection(stats.RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, errUDPSessionLimit)
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
+			if entry == nil && s.draining {
+				if ce := lnc.logger.Check(zap.DebugLevel, "Dropping packet of new UDP session while draining"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", clientAddrPort),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+				continue
+			}
 			if entry == nil {
 				natConnSendCh := make(chan *transparentQueuedPacket, lnc.sendChannelCapacity)
+				removeNatConnSendCh := resource.AddChannel(s.resources, natConnSendCh)
 				entry = &transparentNATEntry{
 					natConnSendCh: natConnSendCh,
 					serverConn:    lnc.serverConn,
+					record:        newUDPSessionRecord(),
 					logger:        lnc.logger,
 				}
 				s.table[clientAddrPort] = entry
 				s.wg.Add(1)
 
-				go func() {
+				s.resources.Go(func() {
 					var sendChClean bool
 
 					defer func() {
 						s.mu.Lock()
+						removeNatConnSendCh()
 						close(natConnSendCh)
 						delete(s.table, clientAddrPort)
 						s.mu.Unlock()
@@ -274,6 +243,7 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 
 					c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
 						ServerIndex:    s.serverIndex,
+						ListenAddrPort: lnc.listenAddrPort,
 						SourceAddrPort: clientAddrPort,
 						TargetAddr:     conn.AddrFromIPPort(queuedPacket.targetAddrPort),
 					})
@@ -283,10 +253,16 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 							zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
 							zap.Error(err),
 						)
+						if mode, ok := router.RejectModeOf(err); ok {
+							s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, "", conn.AddrFromIPPort(queuedPacket.targetAddrPort), err)
+							if mode == router.RejectModeReset && s.portUnreachable != nil {
+								s.portUnreachable.Send(clientAddrPort, queuedPacket.targetAddrPort, int(queuedPacket.msglen))
+							}
+						}
 						return
 					}
 
-					clientInfo, clientSession, err := c.NewSession(ctx)
+					clientInfo, clientSession, err := c.NewSession(zerocopy.WithUDPSessionTargetAddr(ctx, conn.AddrFromIPPort(queuedPacket.targetAddrPort)))
 					if err != nil {
 						lnc.logger.Warn("Failed to create new UDP client session",
 							zap.Stringer("clientAddress", clientAddrPort),
@@ -297,7 +273,13 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 						return
 					}
 
-					natConn, _, err := clientInfo.ListenConfig.ListenUDPMmsgConn(ctx, "udp", "")
+					natConnListenConfig := clientInfo.ListenConfig
+					if s.trafficClass != 0 {
+						natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+					}
+					natConnListenConfig = natConnListenConfig.WithReceiveErrors()
+
+					natConn, natConnInfo, err := natConnListenConfig.ListenUDPMmsgConn(ctx, "udp", "")
 					if err != nil {
 						lnc.logger.Warn("Failed to create UDP socket for new NAT session",
 							zap.Stringer("clientAddress", clientAddrPort),
@@ -309,12 +291,17 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 						return
 					}
 
-					if err = natConn.SetReadDeadline(time.Now().Add(lnc.natTimeout)); err != nil {
+					// Count natConn for the lifetime of the session goroutine.
+					s.resources.AddFDs(1)
+					defer s.resources.AddFDs(-1)
+
+					natTimeout := lnc.natTimeoutFor(clientInfo)
+					if err = natConn.SetReadDeadline(time.Now().Add(natTimeout)); err != nil {
 						lnc.logger.Warn("Failed to set read deadline on natConn",
 							zap.Stringer("clientAddress", clientAddrPort),
 							zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
 							zap.String("client", clientInfo.Name),
-							zap.Duration("natTimeout", lnc.natTimeout),
+							zap.Duration("natTimeout", natTimeout),
 							zap.Error(err),
 						)
 						natConn.Close()
@@ -338,23 +325,51 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 						zap.String("client", clientInfo.Name),
 					)
 
+					sessionEvent := event.Event{
+						Kind:          event.KindSessionCreated,
+						Server:        s.serverName,
+						Network:       "udp",
+						ClientAddress: clientAddrPort,
+						TargetAddress: conn.AddrFromIPPort(queuedPacket.targetAddrPort),
+						Client:        clientInfo.Name,
+					}
+					s.events.Publish(sessionEvent)
+					entry.record.setEvent(sessionEvent)
+
+					tracked := s.connTable.Add("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress, sessionEvent.Client, func() {
+						entry.record.setCloseReason(event.CloseReasonClosed)
+						natConn.Close()
+					})
+
+					flow := s.captures.NewFlow("udp", sessionEvent.ClientAddress, sessionEvent.Username, sessionEvent.TargetAddress)
+
+					pathMTU := newNatConnPathMTU(natConn.UDPConn, tracked, lnc.logger.With(
+						zap.Stringer("clientAddress", clientAddrPort),
+						zap.String("client", clientInfo.Name),
+					))
+
 					s.wg.Add(1)
 
-					go func() {
+					s.resources.Go(func() {
 						s.relayServerConnToNatConnSendmmsg(ctx, transparentUplink{
 							clientName:     clientInfo.Name,
 							clientAddrPort: clientAddrPort,
 							natConn:        natConn.NewWConn(),
 							natConnSendCh:  natConnSendCh,
 							natConnPacker:  clientSession.Packer,
-							natTimeout:     lnc.natTimeout,
+							natTimeout:     natTimeout,
+							pathMTU:        pathMTU,
 							relayBatchSize: lnc.relayBatchSize,
+							v4Mapped:       lnc.useV4MappedDestinations(natConn, natConnInfo),
+							tracked:        tracked,
+							flow:           flow,
+							record:         entry.record,
 							logger:         lnc.logger,
 						})
 						natConn.Close()
 						clientSession.Close()
 						s.wg.Done()
-					}()
+					})
 
 					s.relayNatConnToTransparentConnSendmmsg(ctx, transparentDownlink{
 						clientName:         clientInfo.Name,
@@ -362,9 +377,15 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 						natConn:            natConn.NewRConn(),
 						natConnRecvBufSize: clientSession.MaxPacketSize,
 						natConnUnpacker:    clientSession.Unpacker,
+						pathMTU:            pathMTU,
 						relayBatchSize:     lnc.relayBatchSize,
+						tracked:            tracked,
+						flow:               flow,
+						record:             entry.record,
+						logger:             lnc.logger,
 					})
-				}()
+					tracked.Remove()
+				})
 
 				if ce := lnc.logger.Check(zap.DebugLevel, "New UDP transparent session"); ce != nil {
 					ce.Write(
@@ -405,14 +426,15 @@ func (s *UDPTransparentRelay) recvFromServerConnRecvmmsg(ctx context.Context, ln
 
 func (s *UDPTransparentRelay) relayServerConnToNatConnSendmmsg(ctx context.Context, uplink transparentUplink) {
 	var (
-		destAddrPort     netip.AddrPort
-		packetStart      int
-		packetLength     int
-		err              error
-		sendmmsgCount    uint64
-		packetsSent      uint64
-		payloadBytesSent uint64
-		burstBatchSize   int
+		destAddrPort            netip.AddrPort
+		packetStart             int
+		packetLength            int
+		err                     error
+		sendmmsgCount           uint64
+		packetsSent             uint64
+		payloadBytesSent        uint64
+		oversizedPacketsDropped uint64
+		burstBatchSize          int
 	)
 
 	qpvec := make([]*transparentQueuedPacket, uplink.relayBatchSize)
@@ -440,8 +462,13 @@ main:
 
 	dequeue:
 		for {
+			uplink.flow.UplinkDatagram(conn.AddrFromIPPort(queuedPacket.targetAddrPort), queuedPacket.buf[s.packetBufFrontHeadroom:s.packetBufFrontHeadroom+int(queuedPacket.msglen)])
+
 			destAddrPort, packetStart, packetLength, err = uplink.natConnPacker.PackInPlace(ctx, queuedPacket.buf, conn.AddrFromIPPort(queuedPacket.targetAddrPort), s.packetBufFrontHeadroom, int(queuedPacket.msglen))
 			if err != nil {
+				if errors.Is(err, zerocopy.ErrPayloadTooBig) {
+					oversizedPacketsDropped++
+				}
 				uplink.logger.Warn("Failed to pack packet for natConn",
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
 					zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
@@ -458,13 +485,34 @@ main:
 				goto next
 			}
 
+			if maxPacketSize := uplink.pathMTU.maxPacketSize(destAddrPort.Addr()); maxPacketSize > 0 && packetLength > maxPacketSize {
+				oversizedPacketsDropped++
+				if ce := uplink.logger.Check(zap.DebugLevel, "Dropping packet exceeding path MTU"); ce != nil {
+					ce.Write(
+						zap.Stringer("clientAddress", uplink.clientAddrPort),
+						zap.Stringer("targetAddress", &queuedPacket.targetAddrPort),
+						zap.String("client", uplink.clientName),
+						zap.Int("packetLength", packetLength),
+						zap.Int("maxPacketSize", maxPacketSize),
+					)
+				}
+
+				s.putQueuedPacket(queuedPacket)
+
+				if count == 0 {
+					continue main
+				}
+				goto next
+			}
+
 			qpvec[count] = queuedPacket
 			dapvec[count] = destAddrPort
-			namevec[count] = conn.AddrPortToSockaddrInet6(destAddrPort)
+			msgvec[count].Msghdr.Namelen = putDestSockaddr(&namevec[count], destAddrPort, uplink.v4Mapped)
 			iovec[count].Base = &queuedPacket.buf[packetStart]
 			iovec[count].SetLen(packetLength)
 			count++
 			payloadBytesSent += uint64(queuedPacket.msglen)
+			uplink.tracked.AddUplinkBytes(uint64(queuedPacket.msglen))
 
 			if count == uplink.relayBatchSize {
 				break
@@ -485,6 +533,9 @@ main:
 			n, err := uplink.natConn.WriteMsgs(msgvec[start:count], 0)
 			start += n
 			if err != nil {
+				if errors.Is(err, syscall.EMSGSIZE) {
+					uplink.pathMTU.readErrors()
+				}
 				uplink.logger.Warn("Failed to batch write packets to natConn",
 					zap.Stringer("clientAddress", uplink.clientAddrPort),
 					zap.Stringer("targetAddress", &qpvec[start].targetAddrPort),
@@ -532,16 +583,10 @@ main:
 	)
 
 	s.collector.CollectUDPSessionUplink("", packetsSent, payloadBytesSent)
-}
-
-// getQueuedPacket retrieves a queued packet from the pool.
-func (s *UDPTransparentRelay) getQueuedPacket() *transparentQueuedPacket {
-	return s.queuedPacketPool.Get().(*transparentQueuedPacket)
-}
-
-// putQueuedPacket puts the queued packet back into the pool.
-func (s *UDPTransparentRelay) putQueuedPacket(queuedPacket *transparentQueuedPacket) {
-	s.queuedPacketPool.Put(queuedPacket)
+	uplink.record.finishUplink(s.events, packetsSent, payloadBytesSent)
+	if oversizedPacketsDropped > 0 {
+		s.collector.CollectOversizedPackets("", oversizedPacketsDropped, 0)
+	}
 }
 
 type transparentConn struct {
@@ -617,10 +662,16 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(ctx context.
 	for {
 		nr, err := downlink.natConn.ReadMsgs(msgvec, 0)
 		if err != nil {
-			if errors.Is(err, os.ErrDeadlineExceeded) {
+			// natConn is closed when the session is forcibly terminated.
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
 				break
 			}
 
+			// Queued ICMP errors fail reads. They are not errors of the relay.
+			if downlink.pathMTU.readErrors() {
+				continue
+			}
+
 			downlink.logger.Warn("Failed to batch read packets from natConn",
 				zap.Stringer("clientAddress", downlink.clientAddrPort),
 				zap.String("client", downlink.clientName),
@@ -682,6 +733,8 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(ctx context.
 				continue
 			}
 
+			downlink.flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLength])
+
 			tc := tcMap[payloadSourceAddrPort]
 			if tc == nil {
 				tc, err = s.newTransparentConn(ctx, payloadSourceAddrPort.String(), downlink.relayBatchSize, name, namelen)
@@ -696,10 +749,12 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(ctx context.
 					continue
 				}
 				tcMap[payloadSourceAddrPort] = tc
+				s.resources.AddFDs(1)
 			}
 			tc.putMsg(&packetBuf[payloadStart], payloadLength)
 			ns++
 			payloadBytesSent += uint64(payloadLength)
+			downlink.tracked.AddDownlinkBytes(uint64(payloadLength))
 		}
 
 		if ns == 0 {
@@ -740,6 +795,7 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(ctx context.
 			)
 		}
 	}
+	s.resources.AddFDs(-int64(len(tcMap)))
 
 	downlink.logger.Info("Finished relay transparentConn <- natConn",
 		zap.Stringer("clientAddress", downlink.clientAddrPort),
@@ -751,47 +807,5 @@ func (s *UDPTransparentRelay) relayNatConnToTransparentConnSendmmsg(ctx context.
 	)
 
 	s.collector.CollectUDPSessionDownlink("", packetsSent, payloadBytesSent)
-}
-
-// Stop implements the Relay Stop method.
-func (s *UDPTransparentRelay) Stop() error {
-	for i := range s.listeners {
-		lnc := &s.listeners[i]
-		if err := lnc.serverConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
-			lnc.logger.Warn("Failed to set read deadline on serverConn", zap.Error(err))
-		}
-	}
-
-	// Wait for serverConn receive goroutines to exit,
-	// so there won't be any new sessions added to the table.
-	s.mwg.Wait()
-
-	s.mu.Lock()
-	for clientAddrPort, entry := range s.table {
-		natConn := entry.state.Swap(entry.serverConn)
-		if natConn == nil {
-			continue
-		}
-
-		if err := natConn.SetReadDeadline(conn.ALongTimeAgo); err != nil {
-			entry.logger.Warn("Failed to set read deadline on natConn",
-				zap.Stringer("clientAddress", clientAddrPort),
-				zap.Error(err),
-			)
-		}
-	}
-	s.mu.Unlock()
-
-	// Wait for all relay goroutines to exit before closing serverConn,
-	// so in-flight packets can be written out.
-	s.wg.Wait()
-
-	for i := range s.listeners {
-		lnc := &s.listeners[i]
-		if err := lnc.serverConn.Close(); err != nil {
-			lnc.logger.Warn("Failed to close serverConn", zap.Error(err))
-		}
-	}
-
-	return nil
+	downlink.record.finishDownlink(s.events, downlink.clientAddrPort, packetsSent, payloadBytesSent)
 }
@@ -0,0 +1,340 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/cred"
+	"github.com/database64128/shadowsocks-go/event"
+	"github.com/database64128/shadowsocks-go/ratelimit"
+	"github.com/database64128/shadowsocks-go/router"
+	"github.com/database64128/shadowsocks-go/stats"
+	"github.com/database64128/shadowsocks-go/uot"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// relayUoT relays the UDP session carried by a UDP-over-TCP stream from the client.
+// payload is the data returned by the server's Accept, and goes before the rest of the stream.
+//
+// The session is routed by the target address of its first packet, like a UDP NAT session.
+// It ends when the client closes the stream, or when no packets are sent for the NAT timeout.
+func (s *TCPRelay) relayUoT(ctx context.Context, lnc *tcpRelayListener, clientConn *net.TCPConn, clientRW zerocopy.ReadWriter, payload []byte, clientAddrPort netip.AddrPort, username string, version int) {
+	logger := lnc.logger.With(
+		zap.Stringer("clientAddress", clientAddrPort),
+		zap.String("username", username),
+		zap.Int("uotVersion", version),
+	)
+
+	// Apply rate limit.
+	// Rate limit waits are canceled when either direction of the session ends.
+	limitCtx, cancelLimit := context.WithCancel(ctx)
+	defer cancelLimit()
+	if h := s.rateLimiter.Acquire(username, clientAddrPort.Addr()); h != nil {
+		defer h.Release()
+		clientRW = ratelimit.NewStreamReadWriter(limitCtx, clientRW, h)
+	}
+
+	stream := zerocopy.NewCopyReadWriter(clientRW)
+	var r io.Reader = stream
+	if len(payload) > 0 {
+		r = io.MultiReader(bytes.NewReader(payload), stream)
+	}
+
+	// Version 1 streams have no request, and are always in non-connect mode.
+	var req uot.Request
+	if version == 2 {
+		var err error
+		req, err = uot.ReadRequest(r)
+		if err != nil {
+			logger.Warn("Failed to read UDP-over-TCP request", zap.Error(err))
+			return
+		}
+	}
+
+	var header [uot.MaxFrameHeaderLen]byte
+
+	readFrameHeader := func() (targetAddr conn.Addr, payloadLen int, err error) {
+		targetAddr, _, payloadLen, err = uot.ReadFrameHeader(r, header[:], req.IsConnect)
+		if req.IsConnect {
+			targetAddr = req.Destination
+		}
+		return
+	}
+
+	// Route by the first packet.
+	targetAddr, payloadLen, err := readFrameHeader()
+	if err != nil {
+		if err != io.EOF {
+			logger.Warn("Failed to read UDP-over-TCP frame header", zap.Error(err))
+		}
+		return
+	}
+
+	if !s.userACL.Allowed(ctx, username, targetAddr) {
+		logger.Warn("Rejected UDP-over-TCP session by user ACL", zap.Stringer("targetAddress", &targetAddr))
+		s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, username, targetAddr, cred.ErrDestinationDenied)
+		return
+	}
+
+	c, err := s.router.GetUDPClient(ctx, router.RequestInfo{
+		ServerIndex:    s.serverIndex,
+		ListenAddrPort: lnc.listenAddrPort,
+		Username:       username,
+		SourceAddrPort: clientAddrPort,
+		TargetAddr:     targetAddr,
+	})
+	if err != nil {
+		logger.Warn("Failed to get UDP client for UDP-over-TCP session",
+			zap.Stringer("targetAddress", &targetAddr),
+			zap.Error(err),
+		)
+		if errors.Is(err, router.ErrRejected) {
+			s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, username, targetAddr, err)
+		}
+		return
+	}
+
+	clientInfo, clientSession, err := c.NewSession(zerocopy.WithUDPSessionTargetAddr(ctx, targetAddr))
+	if err != nil {
+		logger.Warn("Failed to create new UDP client session",
+			zap.Stringer("targetAddress", &targetAddr),
+			zap.String("client", clientInfo.Name),
+			zap.Error(err),
+		)
+		return
+	}
+	defer clientSession.Close()
+
+	logger = logger.With(zap.String("client", clientInfo.Name))
+
+	natConnListenConfig := clientInfo.ListenConfig
+	if s.trafficClass != 0 {
+		natConnListenConfig = natConnListenConfig.WithTrafficClass(s.trafficClass)
+	}
+
+	natConn, _, err := natConnListenConfig.ListenUDP(ctx, "udp", "")
+	if err != nil {
+		logger.Warn("Failed to create UDP socket for UDP-over-TCP session", zap.Error(err))
+		return
+	}
+	defer natConn.Close()
+
+	// Count natConn for the lifetime of the session.
+	s.resources.AddFDs(1)
+	defer s.resources.AddFDs(-1)
+
+	natTimeout := defaultNatTimeout
+	if clientInfo.NATTimeout != 0 {
+		natTimeout = clientInfo.NATTimeout
+	}
+
+	logger.Info("UDP-over-TCP relay started",
+		zap.Stringer("targetAddress", &targetAddr),
+		zap.Bool("isConnect", req.IsConnect),
+	)
+
+	sessionEvent := event.Event{
+		Kind:          event.KindSessionCreated,
+		Server:        s.serverName,
+		Network:       "udp",
+		ClientAddress: clientAddrPort,
+		Username:      username,
+		TargetAddress: targetAddr,
+		Client:        clientInfo.Name,
+	}
+	s.events.Publish(sessionEvent)
+
+	record := newUDPSessionRecord()
+	record.setEvent(sessionEvent)
+
+	tracked := s.connTable.Add("udp", clientAddrPort, username, targetAddr, clientInfo.Name, func() {
+		record.setCloseReason(event.CloseReasonClosed)
+		cancelLimit()
+		natConn.Close()
+		_ = clientConn.SetDeadline(conn.ALongTimeAgo)
+	})
+
+	flow := s.captures.NewFlow("udp", clientAddrPort, username, targetAddr)
+
+	downlinkDone := make(chan struct{})
+
+	s.resources.Go(func() {
+		defer close(downlinkDone)
+
+		var packetsSent, payloadBytesSent uint64
+
+		headroom := clientSession.Unpacker.ClientUnpackerInfo().Headroom
+		headroom.Front = max(headroom.Front, uot.MaxFrameHeaderLen)
+		packetBuf := make([]byte, headroom.Front+clientSession.MaxPacketSize+headroom.Rear)
+		recvBuf := packetBuf[headroom.Front : headroom.Front+clientSession.MaxPacketSize]
+
+		for {
+			n, _, flags, packetSourceAddrPort, err := natConn.ReadMsgUDPAddrPort(recvBuf, nil)
+			if err != nil {
+				// natConn is closed when the uplink ends.
+				if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+					break
+				}
+
+				logger.Warn("Failed to read packet from natConn",
+					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+					zap.Int("packetLength", n),
+					zap.Error(err),
+				)
+				continue
+			}
+			if err = conn.ParseFlagsForError(flags); err != nil {
+				logger.Warn("Failed to read packet from natConn",
+					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+					zap.Int("packetLength", n),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			payloadSourceAddrPort, payloadStart, payloadLen, err := clientSession.Unpacker.UnpackInPlace(packetBuf, packetSourceAddrPort, headroom.Front, n)
+			if err != nil {
+				logger.Warn("Failed to unpack packet from natConn",
+					zap.Stringer("packetSourceAddress", packetSourceAddrPort),
+					zap.Int("packetLength", n),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			flow.DownlinkDatagram(payloadSourceAddrPort, packetBuf[payloadStart:payloadStart+payloadLen])
+
+			payloadSourceAddr := conn.AddrFromIPPort(payloadSourceAddrPort)
+			frameStart := payloadStart - uot.FrameHeaderLen(payloadSourceAddr, req.IsConnect)
+			uot.PutFrameHeader(packetBuf[frameStart:], payloadSourceAddr, payloadLen, req.IsConnect)
+
+			if _, err = stream.Write(packetBuf[frameStart : payloadStart+payloadLen]); err != nil {
+				// A canceled rate limit wait means the uplink has ended.
+				if !errors.Is(err, context.Canceled) {
+					logger.Warn("Failed to write packet to UDP-over-TCP stream",
+						zap.Stringer("payloadSourceAddress", payloadSourceAddrPort),
+						zap.Int("payloadLength", payloadLen),
+						zap.Error(err),
+					)
+				}
+				break
+			}
+
+			packetsSent++
+			payloadBytesSent += uint64(payloadLen)
+			tracked.AddDownlinkBytes(uint64(payloadLen))
+		}
+
+		// Stop the uplink if the session timed out.
+		// Shutting down the read side also unblocks reads not managed by the Go runtime poller.
+		cancelLimit()
+		_ = clientConn.SetReadDeadline(conn.ALongTimeAgo)
+		_ = clientConn.CloseRead()
+
+		logger.Info("Finished relay natConn -> UDP-over-TCP stream",
+			zap.Uint64("packetsSent", packetsSent),
+			zap.Uint64("payloadBytesSent", payloadBytesSent),
+		)
+
+		s.collector.CollectUDPSessionDownlink(username, packetsSent, payloadBytesSent)
+		record.finishDownlink(s.events, clientAddrPort, packetsSent, payloadBytesSent)
+	})
+
+	var (
+		packetsSent      uint64
+		payloadBytesSent uint64
+		destAddrPort     netip.AddrPort
+	)
+
+	headroom := clientSession.Packer.ClientPackerInfo().Headroom
+	packetBuf := make([]byte, headroom.Front+uot.MaxPayloadSize+headroom.Rear)
+	payloadBuf := packetBuf[headroom.Front : headroom.Front+uot.MaxPayloadSize]
+
+	for {
+		if _, err = io.ReadFull(r, payloadBuf[:payloadLen]); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				logger.Warn("Failed to read packet from UDP-over-TCP stream",
+					zap.Stringer("targetAddress", &targetAddr),
+					zap.Int("payloadLength", payloadLen),
+					zap.Error(err),
+				)
+			}
+			break
+		}
+
+		flow.UplinkDatagram(targetAddr, payloadBuf[:payloadLen])
+
+		var (
+			packetStart int
+			packetLen   int
+		)
+		if !s.userACL.Allowed(ctx, username, targetAddr) {
+			// Drop packets to denied destinations, like the UDP session relay does.
+			s.collector.CollectRejection(stats.RejectionKindRoute, "udp", clientAddrPort, username, targetAddr, cred.ErrDestinationDenied)
+		} else if destAddrPort, packetStart, packetLen, err = clientSession.Packer.PackInPlace(ctx, packetBuf, targetAddr, headroom.Front, payloadLen); err != nil {
+			logger.Warn("Failed to pack packet for natConn",
+				zap.Stringer("targetAddress", &targetAddr),
+				zap.Int("payloadLength", payloadLen),
+				zap.Error(err),
+			)
+		} else {
+			if _, err = natConn.WriteToUDPAddrPort(packetBuf[packetStart:packetStart+packetLen], destAddrPort); err != nil {
+				logger.Warn("Failed to write packet to natConn",
+					zap.Stringer("targetAddress", &targetAddr),
+					zap.Stringer("writeDestAddress", destAddrPort),
+					zap.Int("packetLength", packetLen),
+					zap.Error(err),
+				)
+			}
+
+			if err = natConn.SetReadDeadline(time.Now().Add(natTimeout)); err != nil {
+				logger.Warn("Failed to set read deadline on natConn",
+					zap.Duration("natTimeout", natTimeout),
+					zap.Error(err),
+				)
+			}
+
+			packetsSent++
+			payloadBytesSent += uint64(payloadLen)
+			tracked.AddUplinkBytes(uint64(payloadLen))
+		}
+
+		targetAddr, payloadLen, err = readFrameHeader()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				logger.Warn("Failed to read UDP-over-TCP frame header", zap.Error(err))
+			}
+			break
+		}
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		record.setCloseReason(event.CloseReasonShutdown)
+	case err == io.EOF:
+		record.setCloseReason(event.CloseReasonEOF)
+	}
+
+	// Stop the downlink, and wait for it to finish writing to the stream.
+	cancelLimit()
+	natConn.Close()
+	<-downlinkDone
+	tracked.Remove()
+
+	logger.Info("Finished relay UDP-over-TCP stream -> natConn",
+		zap.Stringer("lastWriteDestAddress", destAddrPort),
+		zap.Uint64("packetsSent", packetsSent),
+		zap.Uint64("payloadBytesSent", payloadBytesSent),
+	)
+
+	s.collector.CollectUDPSessionUplink(username, packetsSent, payloadBytesSent)
+	record.finishUplink(s.events, packetsSent, payloadBytesSent)
+}
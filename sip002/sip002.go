@@ -0,0 +1,167 @@
+// Package sip002 parses and formats SIP002 ss:// URLs, which share Shadowsocks server configurations
+// in a single line that clients can import.
+package sip002
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Scheme is the URL scheme of SIP002 URLs.
+const Scheme = "ss"
+
+// URL is a SIP002 ss:// URL.
+//
+// The user info of Shadowsocks 2022 URLs is the percent-encoded method and password,
+// as required by SIP022. The user info of other URLs is the unpadded base64url encoding of
+// "method:password", which is what legacy clients expect.
+type URL struct {
+	// Method is the encryption method, like "2022-blake3-aes-128-gcm".
+	Method string
+
+	// Password is the password. For Shadowsocks 2022, it is the base64-encoded PSK,
+	// preceded by the base64-encoded identity PSKs, separated by ':'.
+	Password string
+
+	// Host is the hostname or IP address of the server, without brackets.
+	Host string
+
+	// Port is the port of the server.
+	Port uint16
+
+	// Plugin is the name of the SIP003 plugin, if any.
+	Plugin string
+
+	// PluginOpts is the options of the SIP003 plugin.
+	PluginOpts string
+
+	// Name is the name of the server, in the URL fragment.
+	Name string
+}
+
+// Is2022 returns whether the URL is for a Shadowsocks 2022 server.
+func (u URL) Is2022() bool {
+	return strings.HasPrefix(u.Method, "2022-")
+}
+
+// PSKs returns the base64-decoded PSKs in a Shadowsocks 2022 password.
+// The last PSK is the user's PSK. Any PSKs before it are identity PSKs.
+func (u URL) PSKs() ([][]byte, error) {
+	parts := strings.Split(u.Password, ":")
+	psks := make([][]byte, len(parts))
+	for i, part := range parts {
+		psk, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PSK %d: %w", i, err)
+		}
+		psks[i] = psk
+	}
+	return psks, nil
+}
+
+// String returns the ss:// URL.
+func (u URL) String() string {
+	su := url.URL{
+		Scheme:   Scheme,
+		Host:     net.JoinHostPort(u.Host, strconv.FormatUint(uint64(u.Port), 10)),
+		Fragment: u.Name,
+	}
+
+	if u.Is2022() {
+		su.User = url.UserPassword(u.Method, u.Password)
+	} else {
+		su.User = url.User(base64.RawURLEncoding.EncodeToString([]byte(u.Method + ":" + u.Password)))
+	}
+
+	if u.Plugin != "" {
+		plugin := u.Plugin
+		if u.PluginOpts != "" {
+			plugin += ";" + u.PluginOpts
+		}
+		su.Path = "/"
+		su.RawQuery = url.Values{"plugin": {plugin}}.Encode()
+	}
+
+	return su.String()
+}
+
+var (
+	ErrScheme    = errors.New("not an ss:// URL")
+	ErrNoUser    = errors.New("missing user info")
+	ErrNoMethod  = errors.New("missing method")
+	ErrNoPort    = errors.New("missing port")
+	ErrNoHost    = errors.New("missing host")
+	ErrBadPlugin = errors.New("empty plugin name")
+)
+
+// Parse parses a SIP002 ss:// URL.
+//
+// The user info can be either percent-encoded or base64-encoded, with or without padding,
+// in the URL-safe or standard alphabet.
+func Parse(s string) (URL, error) {
+	su, err := url.Parse(s)
+	if err != nil {
+		return URL{}, err
+	}
+	if su.Scheme != Scheme {
+		return URL{}, ErrScheme
+	}
+	if su.User == nil {
+		return URL{}, ErrNoUser
+	}
+
+	var u URL
+
+	if password, ok := su.User.Password(); ok {
+		u.Method = su.User.Username()
+		u.Password = password
+	} else {
+		userinfo, err := decodeBase64(su.User.Username())
+		if err != nil {
+			return URL{}, fmt.Errorf("failed to decode user info: %w", err)
+		}
+		u.Method, u.Password, _ = strings.Cut(string(userinfo), ":")
+	}
+	if u.Method == "" {
+		return URL{}, ErrNoMethod
+	}
+
+	u.Host = su.Hostname()
+	if u.Host == "" {
+		return URL{}, ErrNoHost
+	}
+
+	portString := su.Port()
+	if portString == "" {
+		return URL{}, ErrNoPort
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return URL{}, fmt.Errorf("bad port %q: %w", portString, err)
+	}
+	u.Port = uint16(port)
+
+	if plugin := su.Query().Get("plugin"); plugin != "" {
+		u.Plugin, u.PluginOpts, _ = strings.Cut(plugin, ";")
+		if u.Plugin == "" {
+			return URL{}, ErrBadPlugin
+		}
+	}
+
+	u.Name = su.Fragment
+	return u, nil
+}
+
+// decodeBase64 decodes s in the URL-safe or standard alphabet, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
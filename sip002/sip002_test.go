@@ -0,0 +1,137 @@
+package sip002
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		s    string
+		want URL
+	}{
+		{
+			name: "Base64URL",
+			s:    "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+			want: URL{Method: "aes-128-gcm", Password: "test", Host: "192.168.100.1", Port: 8888, Name: "Example1"},
+		},
+		{
+			name: "Base64Padded",
+			s:    "ss://YWVzLTEyOC1nY206dGVzdA==@192.168.100.1:8888",
+			want: URL{Method: "aes-128-gcm", Password: "test", Host: "192.168.100.1", Port: 8888},
+		},
+		{
+			name: "Plugin",
+			s:    "ss://cmM0LW1kNTpwYXNzd2Q@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example2",
+			want: URL{Method: "rc4-md5", Password: "passwd", Host: "192.168.100.1", Port: 8888, Plugin: "obfs-local", PluginOpts: "obfs=http", Name: "Example2"},
+		},
+		{
+			name: "PluginNoOpts",
+			s:    "ss://cmM0LW1kNTpwYXNzd2Q@example.com:8888/?plugin=v2ray-plugin",
+			want: URL{Method: "rc4-md5", Password: "passwd", Host: "example.com", Port: 8888, Plugin: "v2ray-plugin"},
+		},
+		{
+			name: "2022",
+			s:    "ss://2022-blake3-aes-256-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2FtRizJN9K8y%2BuKlW2qjlI%3D@192.168.100.1:8888#Example3",
+			want: URL{Method: "2022-blake3-aes-256-gcm", Password: "YctPZ6U7xPPcU+gp3u+0tx/tRizJN9K8y+uKlW2qjlI=", Host: "192.168.100.1", Port: 8888, Name: "Example3"},
+		},
+		{
+			name: "2022MultiUserIPv6",
+			s:    "ss://2022-blake3-aes-128-gcm:ZmVkY2JhOTg3NjU0MzIxMA==%3AMDEyMzQ1Njc4OWFiY2RlZg==@[2001:db8::1]:20220#Alex%20B",
+			want: URL{Method: "2022-blake3-aes-128-gcm", Password: "ZmVkY2JhOTg3NjU0MzIxMA==:MDEyMzQ1Njc4OWFiY2RlZg==", Host: "2001:db8::1", Port: 20220, Name: "Alex B"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			u, err := Parse(c.s)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", c.s, err)
+			}
+			if u != c.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", c.s, u, c.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want error
+	}{
+		{"http://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888", ErrScheme},
+		{"ss://192.168.100.1:8888", ErrNoUser},
+		{"ss://OnRlc3Q@192.168.100.1:8888", ErrNoMethod},
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1", ErrNoPort},
+		{"ss://YWVzLTEyOC1nY206dGVzdA@:8888", ErrNoHost},
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888/?plugin=%3Bobfs%3Dhttp", ErrBadPlugin},
+	} {
+		if _, err := Parse(c.s); !errors.Is(err, c.want) {
+			t.Errorf("Parse(%q) = %v, want %v", c.s, err, c.want)
+		}
+	}
+
+	for _, s := range []string{
+		"ss://!!!@192.168.100.1:8888",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:65536",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestURLString(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		u    URL
+		want string
+	}{
+		{
+			name: "Legacy",
+			u:    URL{Method: "aes-128-gcm", Password: "test", Host: "192.168.100.1", Port: 8888, Name: "Example1"},
+			want: "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+		},
+		{
+			name: "Plugin",
+			u:    URL{Method: "rc4-md5", Password: "passwd", Host: "192.168.100.1", Port: 8888, Plugin: "obfs-local", PluginOpts: "obfs=http", Name: "Example2"},
+			want: "ss://cmM0LW1kNTpwYXNzd2Q@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example2",
+		},
+		{
+			name: "2022IPv6",
+			u:    URL{Method: "2022-blake3-aes-128-gcm", Password: "ZmVkY2JhOTg3NjU0MzIxMA==:MDEyMzQ1Njc4OWFiY2RlZg==", Host: "2001:db8::1", Port: 20220, Name: "Alex B"},
+			want: "ss://2022-blake3-aes-128-gcm:ZmVkY2JhOTg3NjU0MzIxMA==%3AMDEyMzQ1Njc4OWFiY2RlZg==@[2001:db8::1]:20220#Alex%20B",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := c.u.String()
+			if s != c.want {
+				t.Errorf("String() = %q, want %q", s, c.want)
+			}
+			u, err := Parse(s)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", s, err)
+			}
+			if u != c.u {
+				t.Errorf("Parse(String()) = %+v, want %+v", u, c.u)
+			}
+		})
+	}
+}
+
+func TestURLPSKs(t *testing.T) {
+	u := URL{Method: "2022-blake3-aes-128-gcm", Password: "ZmVkY2JhOTg3NjU0MzIxMA==:MDEyMzQ1Njc4OWFiY2RlZg=="}
+	psks, err := u.PSKs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(psks) != 2 || !bytes.Equal(psks[0], []byte("fedcba9876543210")) || !bytes.Equal(psks[1], []byte("0123456789abcdef")) {
+		t.Errorf("PSKs() = %q, want [fedcba9876543210 0123456789abcdef]", psks)
+	}
+
+	u.Password = "not base64"
+	if _, err := u.PSKs(); err == nil {
+		t.Error("PSKs() succeeded with invalid password, want error")
+	}
+}
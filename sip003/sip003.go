@@ -0,0 +1,184 @@
+// Package sip003 runs SIP003 plugins, which transform the TCP traffic between
+// Shadowsocks clients and servers, such as v2ray-plugin and kcptun.
+package sip003
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// minRestartDelay is the delay before restarting a plugin that crashed.
+	// It doubles on each consecutive crash, up to maxRestartDelay.
+	minRestartDelay = time.Second
+
+	// maxRestartDelay is the maximum delay before restarting a plugin that crashed.
+	maxRestartDelay = time.Minute
+
+	// stableDuration is how long a plugin must run before its restart delay is reset.
+	stableDuration = time.Minute
+)
+
+// Plugin supervises a SIP003 plugin process.
+//
+// The plugin listens on the local address and forwards to the remote address.
+// On a client, the local address is where the client connects to, and the remote address is the server.
+// On a server, the remote address is where clients connect to, and the local address is the server's listener.
+//
+// If the plugin exits before the plugin is stopped, it is restarted after a delay.
+type Plugin struct {
+	name   string
+	path   string
+	env    []string
+	logger *zap.Logger
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a new plugin that runs the executable at path, or found in PATH, with the given options.
+// name identifies the plugin's client or server in logs.
+func New(name, path, options, remoteHost string, remotePort uint16, localHost string, localPort uint16, logger *zap.Logger) *Plugin {
+	return &Plugin{
+		name: name,
+		path: path,
+		env: append(os.Environ(),
+			"SS_REMOTE_HOST="+remoteHost,
+			"SS_REMOTE_PORT="+strconv.FormatUint(uint64(remotePort), 10),
+			"SS_LOCAL_HOST="+localHost,
+			"SS_LOCAL_PORT="+strconv.FormatUint(uint64(localPort), 10),
+			"SS_PLUGIN_OPTIONS="+options,
+		),
+		logger: logger,
+	}
+}
+
+// String implements the service.Relay String method.
+func (p *Plugin) String() string {
+	return "SIP003 plugin " + p.path + " for " + p.name
+}
+
+// Start implements the service.Relay Start method.
+//
+// The first start of the plugin process must succeed. Later restarts are retried until the plugin is stopped.
+func (p *Plugin) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	cmd, err := p.startProcess(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	p.cancel = cancel
+
+	p.wg.Add(1)
+	go func() {
+		p.supervise(ctx, cmd)
+		p.wg.Done()
+	}()
+	return nil
+}
+
+// startProcess starts the plugin process, which is killed when ctx is canceled.
+func (p *Plugin) startProcess(ctx context.Context) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start plugin %s: %w", p.path, err)
+	}
+
+	p.logger.Info("Started plugin",
+		zap.String("name", p.name),
+		zap.String("plugin", p.path),
+		zap.Int("pid", cmd.Process.Pid),
+	)
+	return cmd, nil
+}
+
+// supervise waits for the plugin process to exit, and restarts it until ctx is canceled.
+func (p *Plugin) supervise(ctx context.Context, cmd *exec.Cmd) {
+	delay := minRestartDelay
+
+	for {
+		startTime := time.Now()
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(startTime) >= stableDuration {
+			delay = minRestartDelay
+		}
+
+		p.logger.Warn("Plugin exited, restarting",
+			zap.String("name", p.name),
+			zap.String("plugin", p.path),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+
+		for {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			delay = min(delay*2, maxRestartDelay)
+
+			cmd, err = p.startProcess(ctx)
+			if err == nil {
+				break
+			}
+
+			p.logger.Warn("Failed to restart plugin",
+				zap.String("name", p.name),
+				zap.String("plugin", p.path),
+				zap.Duration("delay", delay),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// Stop implements the service.Relay Stop method.
+func (p *Plugin) Stop() error {
+	if p.cancel == nil {
+		return nil
+	}
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
+
+// LocalAddrPort returns a loopback address with a port that is free at the time of the call,
+// for the plugin to listen on or forward to.
+//
+// The address is IPv6 if network is "tcp6", and IPv4 otherwise.
+func LocalAddrPort(network string) (netip.AddrPort, error) {
+	ip := netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	if network == "tcp6" {
+		ip = netip.IPv6Loopback()
+	}
+
+	ln, err := net.ListenTCP(network, net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to find a free local port: %w", err)
+	}
+	defer ln.Close()
+
+	return netip.AddrPortFrom(ip, ln.Addr().(*net.TCPAddr).AddrPort().Port()), nil
+}
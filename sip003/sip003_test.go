@@ -0,0 +1,90 @@
+package sip003
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// TestMain runs the test binary as a plugin that appends its environment to the file
+// named by its plugin options, and exits, so that it is restarted.
+func TestMain(m *testing.M) {
+	if os.Getenv("SIP003_TEST_PLUGIN") == "1" {
+		f, err := os.OpenFile(os.Getenv("SS_PLUGIN_OPTIONS"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			os.Exit(2)
+		}
+		for _, key := range []string{"SS_REMOTE_HOST", "SS_REMOTE_PORT", "SS_LOCAL_HOST", "SS_LOCAL_PORT"} {
+			f.WriteString(key + "=" + os.Getenv(key) + " ")
+		}
+		f.WriteString("\n")
+		f.Close()
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPluginRestart(t *testing.T) {
+	t.Setenv("SIP003_TEST_PLUGIN", "1")
+
+	path := filepath.Join(t.TempDir(), "starts")
+	p := New("test", os.Args[0], path, "example.com", 8388, "127.0.0.1", 1080, zaptest.NewLogger(t))
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plugin exits right away, and is restarted after minRestartDelay.
+	deadline := time.Now().Add(10 * time.Second)
+	var b []byte
+	for time.Now().Before(deadline) {
+		b, _ = os.ReadFile(path)
+		if bytes.Count(b, []byte("\n")) >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("Plugin started %d times, expected at least 2", len(lines))
+	}
+
+	const expectedEnv = "SS_REMOTE_HOST=example.com SS_REMOTE_PORT=8388 SS_LOCAL_HOST=127.0.0.1 SS_LOCAL_PORT=1080"
+	for i, line := range lines {
+		if strings.TrimSpace(line) != expectedEnv {
+			t.Errorf("Start %d: got environment %q, expected %q", i, line, expectedEnv)
+		}
+	}
+}
+
+func TestPluginStartError(t *testing.T) {
+	p := New("test", filepath.Join(t.TempDir(), "nonexistent"), "", "example.com", 8388, "127.0.0.1", 1080, zaptest.NewLogger(t))
+	if err := p.Start(context.Background()); err == nil {
+		t.Error("Start() succeeded with a nonexistent plugin")
+	}
+	if err := p.Stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocalAddrPort(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp4"} {
+		addrPort, err := LocalAddrPort(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addrPort.Addr().Is4() || !addrPort.Addr().IsLoopback() || addrPort.Port() == 0 {
+			t.Errorf("LocalAddrPort(%q) = %s, expected an IPv4 loopback address with a port", network, addrPort)
+		}
+	}
+}
@@ -157,9 +157,19 @@ func LengthOfAddrFromConnAddr(addr conn.Addr) int {
 	return 1 + 1 + len(domain) + 2
 }
 
+// ErrDomainNameTooLong is returned when a domain name in a SOCKS address is longer than the limit.
+var ErrDomainNameTooLong = errors.New("domain name too long")
+
 // AppendFromReader reads just enough bytes from r to get a valid Addr
 // and appends it to the buffer.
 func AppendFromReader(b []byte, r io.Reader) ([]byte, error) {
+	return AppendFromReaderWithMaxDomainLength(b, r, 255)
+}
+
+// AppendFromReaderWithMaxDomainLength is like [AppendFromReader],
+// but returns [ErrDomainNameTooLong] without reading the rest of the address
+// if the domain name is longer than maxDomainLength.
+func AppendFromReaderWithMaxDomainLength(b []byte, r io.Reader, maxDomainLength int) ([]byte, error) {
 	ret, out := slicehelper.Extend(b, 2)
 
 	// Read ATYP and an extra byte.
@@ -172,6 +182,9 @@ func AppendFromReader(b []byte, r io.Reader) ([]byte, error) {
 
 	switch out[0] {
 	case AtypDomainName:
+		if int(out[1]) > maxDomainLength {
+			return nil, fmt.Errorf("%w: %d > %d", ErrDomainNameTooLong, out[1], maxDomainLength)
+		}
 		addrLen = 1 + 1 + int(out[1]) + 2
 	case AtypIPv4:
 		addrLen = 1 + 4 + 2
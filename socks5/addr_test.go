@@ -3,6 +3,7 @@ package socks5
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
 	"net/netip"
 	"testing"
@@ -276,3 +277,23 @@ func TestLengthOfAndWriteAddrFromConnAddr(t *testing.T) {
 	testLengthOfAndWriteAddrFromConnAddr(t, addr6connaddr, addr6[:])
 	testLengthOfAndWriteAddrFromConnAddr(t, addrDomainConnAddr, addrDomain[:])
 }
+
+func TestAppendFromReaderWithMaxDomainLength(t *testing.T) {
+	domainLength := int(addrDomain[1])
+
+	b, err := AppendFromReaderWithMaxDomainLength(nil, bytes.NewReader(addrDomain[:]), domainLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, addrDomain[:]) {
+		t.Errorf("AppendFromReaderWithMaxDomainLength() = %v, expected %v", b, addrDomain)
+	}
+
+	r := bytes.NewReader(addrDomain[:])
+	if _, err = AppendFromReaderWithMaxDomainLength(nil, r, domainLength-1); !errors.Is(err, ErrDomainNameTooLong) {
+		t.Errorf("AppendFromReaderWithMaxDomainLength() error = %v, expected %v", err, ErrDomainNameTooLong)
+	}
+	if n := r.Len(); n != len(addrDomain)-2 {
+		t.Errorf("AppendFromReaderWithMaxDomainLength() read %d bytes past ATYP and length, expected 0", len(addrDomain)-2-n)
+	}
+}
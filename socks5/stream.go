@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"github.com/database64128/shadowsocks-go/zerocopy"
@@ -47,6 +48,14 @@ var (
 	ErrUnsupportedAuthenticationMethod = errors.New("unsupported authentication method")
 	ErrUnsupportedCommand              = errors.New("unsupported command")
 	ErrUDPAssociateDone                = errors.New("UDP ASSOCIATE done")
+	ErrAuthenticationFailed            = errors.New("username/password authentication failed")
+	ErrUsernamePasswordTooLong         = errors.New("username or password longer than 255 bytes")
+)
+
+// Username/password authentication as defined in RFC 1929.
+const (
+	UsernamePasswordVersion = 1
+	UsernamePasswordSuccess = 0
 )
 
 // replyWithStatus writes a reply to w with the REP field set to status.
@@ -61,15 +70,55 @@ func replyWithStatus(w io.Writer, b []byte, status byte) error {
 	return err
 }
 
+// ServerReply writes the reply to a CONNECT request accepted by [ServerAccept] to w.
+func ServerReply(w io.Writer, status zerocopy.TCPReplyStatus) error {
+	var b [3 + IPv4AddrLen]byte
+	return replyWithStatus(w, b[:], replyCode(status))
+}
+
+// replyCode returns the REP field for status.
+func replyCode(status zerocopy.TCPReplyStatus) byte {
+	switch status {
+	case zerocopy.TCPReplySucceeded:
+		return Succeeded
+	case zerocopy.TCPReplyNotAllowed:
+		return ErrConnectionNotAllowed
+	case zerocopy.TCPReplyNetworkUnreachable:
+		return ErrNetworkUnreachable
+	case zerocopy.TCPReplyHostUnreachable:
+		return ErrHostUnreachable
+	case zerocopy.TCPReplyConnectionRefused:
+		return ErrConnectionRefused
+	case zerocopy.TCPReplyTimedOut:
+		return ErrTTLExpired
+	default:
+		return ErrGeneralFailure
+	}
+}
+
 // ClientRequest writes a request to targetAddr and returns the bound address in reply.
-func ClientRequest(rw io.ReadWriter, command byte, targetAddr conn.Addr) (addr conn.Addr, err error) {
-	b := make([]byte, 3+MaxAddrLen)
+//
+// If username is not empty, username/password authentication is offered in addition to
+// no authentication. If the server rejects the credential, [ErrAuthenticationFailed] is returned.
+func ClientRequest(rw io.ReadWriter, command byte, targetAddr conn.Addr, username, password string) (addr conn.Addr, err error) {
+	if len(username) > 255 || len(password) > 255 {
+		err = ErrUsernamePasswordTooLong
+		return
+	}
+
+	b := make([]byte, 3+MaxAddrLen, 3+255+255)
 	b[0] = Version
 	b[1] = 1
 	b[2] = MethodNoAuthenticationRequired
+	methodsLen := 3
+	if username != "" {
+		b[1] = 2
+		b[3] = MethodUsernamePassword
+		methodsLen = 4
+	}
 
 	// Write VER NMETHDOS METHODS.
-	_, err = rw.Write(b[:3])
+	_, err = rw.Write(b[:methodsLen])
 	if err != nil {
 		return
 	}
@@ -87,13 +136,21 @@ func ClientRequest(rw io.ReadWriter, command byte, targetAddr conn.Addr) (addr c
 	}
 
 	// Check METHOD.
-	if b[1] != MethodNoAuthenticationRequired {
+	switch {
+	case b[1] == MethodNoAuthenticationRequired:
+	case b[1] == MethodUsernamePassword && username != "":
+		if err = clientUsernamePasswordAuth(rw, b, username, password); err != nil {
+			return
+		}
+	default:
 		err = fmt.Errorf("%w: %d", ErrUnsupportedAuthenticationMethod, b[1])
 		return
 	}
 
 	// Write VER, CMD, RSV, SOCKS address.
+	b[0] = Version
 	b[1] = command
+	b[2] = 0
 	n := WriteAddrFromConnAddr(b[3:], targetAddr)
 	_, err = rw.Write(b[:3+n])
 	if err != nil {
@@ -127,24 +184,61 @@ func ClientRequest(rw io.ReadWriter, command byte, targetAddr conn.Addr) (addr c
 	return
 }
 
+// clientUsernamePasswordAuth performs the username/password subnegotiation as defined in RFC 1929.
+// b must have a capacity of at least 3+255+255 bytes.
+func clientUsernamePasswordAuth(rw io.ReadWriter, b []byte, username, password string) error {
+	// Write VER ULEN UNAME PLEN PASSWD.
+	req := append(b[:0], UsernamePasswordVersion, byte(len(username)))
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	// Read VER STATUS.
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != UsernamePasswordVersion {
+		return fmt.Errorf("unsupported username/password authentication version: %d", b[0])
+	}
+	if b[1] != UsernamePasswordSuccess {
+		return fmt.Errorf("%w: status %d", ErrAuthenticationFailed, b[1])
+	}
+	return nil
+}
+
 // ClientConnect writes a CONNECT request to targetAddr.
-func ClientConnect(rw io.ReadWriter, targetAddr conn.Addr) error {
-	_, err := ClientRequest(rw, CmdConnect, targetAddr)
+// If username is not empty, username/password authentication is offered.
+func ClientConnect(rw io.ReadWriter, targetAddr conn.Addr, username, password string) error {
+	_, err := ClientRequest(rw, CmdConnect, targetAddr, username, password)
 	return err
 }
 
 // ClientUDPAssociate writes a UDP ASSOCIATE request to targetAddr.
-func ClientUDPAssociate(rw io.ReadWriter, targetAddr conn.Addr) (conn.Addr, error) {
-	return ClientRequest(rw, CmdUDPAssociate, targetAddr)
+// If username is not empty, username/password authentication is offered.
+func ClientUDPAssociate(rw io.ReadWriter, targetAddr conn.Addr, username, password string) (conn.Addr, error) {
+	return ClientRequest(rw, CmdUDPAssociate, targetAddr, username, password)
 }
 
 // ServerAccept processes an incoming request from rw.
 //
+// A CONNECT request is not replied to. The caller must reply with [ServerReply]
+// once the outcome of the request is known.
+//
 // enableTCP enables the CONNECT command.
 // enableUDP enables the UDP ASSOCIATE command.
 //
 // When UDP is enabled, rw must be a [*net.TCPConn].
-func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool) (addr conn.Addr, err error) {
+//
+// If maxDomainLength is positive, requests with longer domain names are rejected
+// before the domain name is read.
+func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool, maxDomainLength int) (addr conn.Addr, err error) {
+	if maxDomainLength <= 0 {
+		maxDomainLength = 255
+	}
+
 	b := make([]byte, 3+MaxAddrLen)
 
 	// Read VER, NMETHODS.
@@ -209,8 +303,11 @@ func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool) (addr conn.Addr,
 	}
 
 	// Read SOCKS address.
-	sa, err := AppendFromReader(b[3:3], rw)
+	sa, err := AppendFromReaderWithMaxDomainLength(b[3:3], rw, maxDomainLength)
 	if err != nil {
+		if errors.Is(err, ErrDomainNameTooLong) {
+			_ = replyWithStatus(rw, b, ErrGeneralFailure)
+		}
 		return
 	}
 	addr, _, err = ConnAddrFromSlice(sa)
@@ -220,7 +317,7 @@ func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool) (addr conn.Addr,
 
 	switch {
 	case b[1] == CmdConnect && enableTCP:
-		err = replyWithStatus(rw, b, Succeeded)
+		// The caller replies with the outcome of the request.
 
 	case b[1] == CmdUDPAssociate && enableUDP:
 		// Use the connection's local address as the returned UDP bound address.
@@ -241,6 +338,12 @@ func ServerAccept(rw io.ReadWriter, enableTCP, enableUDP bool) (addr conn.Addr,
 			return
 		}
 
+		// Clear the caller's handshake deadline, if any.
+		// The association lasts until the client closes the connection.
+		if err = tc.SetReadDeadline(time.Time{}); err != nil {
+			return
+		}
+
 		// Hold the connection open.
 		_, err = rw.Read(b[:1])
 		if err == nil || err == io.EOF {
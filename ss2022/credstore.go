@@ -6,6 +6,13 @@ import "sync"
 type CredStore struct {
 	mu  sync.Mutex
 	ulm UserLookupMap
+
+	// iccs is the identity cipher configs accepted during identity PSK rotation.
+	iccs []ServerIdentityCipherConfig
+
+	// rotatingIdentityPSK is whether iccs is used instead of the server's own identity cipher config.
+	// It is set before the server is used, and does not change afterwards.
+	rotatingIdentityPSK bool
 }
 
 // Lock locks its internal mutex.
@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"lukechampine.com/blake3"
 )
@@ -78,6 +79,8 @@ type ClientCipherConfig struct {
 	iPSKs        [][]byte
 	eihCiphers   []cipher.Block
 	eihPSKHashes [][IdentityHeaderLength]byte
+	next         *ClientCipherConfig
+	nextAt       time.Time
 }
 
 // TCPIdentityHeaderCiphers creates block ciphers for a client TCP session's identity headers.
@@ -99,7 +99,14 @@ type ShadowPacketClientPacker struct {
 	info zerocopy.ClientPackerInfo
 
 	// serverAddrPort is the Shadowsocks server's address.
+	// The port changes over time when port hopping is enabled.
 	serverAddrPort netip.AddrPort
+
+	// hopping is the port hopping configuration.
+	hopping PortHopping
+
+	// nextHopTime is when the session hops to the next port.
+	nextHopTime time.Time
 }
 
 // ClientPackerInfo implements the zerocopy.ClientPacker ClientPackerInfo method.
@@ -132,6 +139,13 @@ func (p *ShadowPacketClientPacker) PackInPlace(ctx context.Context, b []byte, ta
 	// Write message header.
 	WriteUDPClientMessageHeader(b[messageHeaderStart:payloadStart], paddingLen, targetAddr)
 
+	if p.hopping.Enabled() {
+		if now := time.Now(); !now.Before(p.nextHopTime) {
+			p.serverAddrPort = netip.AddrPortFrom(p.serverAddrPort.Addr(), p.hopping.nextPort(p.serverAddrPort.Port()))
+			p.nextHopTime = now.Add(p.hopping.Interval)
+		}
+	}
+
 	destAddrPort = p.serverAddrPort
 	packetStart = messageHeaderStart - p.nonAEADHeaderLen
 	packetLen = payloadStart - packetStart + payloadLen + p.aead.Overhead()
@@ -405,6 +419,10 @@ type ShadowPacketServerUnpacker struct {
 	// We trade 2 extra nil checks during unpacking for better performance when the server is flooded by invalid packets.
 	filter *SlidingWindowFilter
 
+	// replayState tracks accepted packet IDs for saving the server's replay state,
+	// or is nil if replay state tracking is not enabled.
+	replayState *udpSessionReplayState
+
 	// cachedDomain caches the last used domain target to avoid allocating new strings.
 	cachedDomain string
 
@@ -467,6 +485,9 @@ func (p *ShadowPacketServerUnpacker) UnpackInPlace(b []byte, sourceAddr netip.Ad
 		p.filter = NewSlidingWindowFilter(p.filterSize)
 	}
 	p.filter.MustAdd(cpid)
+	if p.replayState != nil {
+		p.replayState.add(cpid)
+	}
 
 	return
 }
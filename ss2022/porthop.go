@@ -0,0 +1,46 @@
+package ss2022
+
+import (
+	mrand "math/rand/v2"
+	"time"
+)
+
+// PortHopping configures UDP port hopping for client sessions.
+//
+// When enabled, each client session periodically switches its destination port
+// to a random port in the range, while keeping the same session.
+// The server must listen on all ports in the range.
+//
+// The zero value disables port hopping.
+type PortHopping struct {
+	// FirstPort is the first port in the range.
+	FirstPort uint16
+
+	// LastPort is the last port in the range, inclusive.
+	LastPort uint16
+
+	// Interval is how long a session stays on a port before hopping to the next one.
+	Interval time.Duration
+}
+
+// Enabled returns whether port hopping is enabled.
+func (h PortHopping) Enabled() bool {
+	return h.Interval > 0
+}
+
+// nextPort returns a random port in the range that is different from current, if possible.
+func (h PortHopping) nextPort(current uint16) uint16 {
+	n := uint32(h.LastPort-h.FirstPort) + 1
+	if n == 1 {
+		return h.FirstPort
+	}
+	if current < h.FirstPort || current > h.LastPort {
+		return h.FirstPort + uint16(mrand.Uint32N(n))
+	}
+	// Skip the current port by picking from the other n-1 ports.
+	port := h.FirstPort + uint16(mrand.Uint32N(n-1))
+	if port >= current {
+		port++
+	}
+	return port
+}
@@ -0,0 +1,144 @@
+package ss2022
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// ScheduledPSK is a PSK with a validity period, for rotating PSKs without downtime.
+//
+// Give the old and new PSKs overlapping validity periods, and schedule clients to switch to the new PSK
+// within the overlap. The server accepts both PSKs during the overlap.
+type ScheduledPSK struct {
+	PSK []byte `json:"psk"`
+
+	// NotBefore is when the PSK becomes valid.
+	// The zero value means the PSK is valid from the start.
+	NotBefore time.Time `json:"notBefore"`
+
+	// NotAfter is when the PSK stops being valid.
+	// The zero value means the PSK never expires.
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// ValidAt returns whether the PSK is valid at t.
+func (p ScheduledPSK) ValidAt(t time.Time) bool {
+	return !t.Before(p.NotBefore) && (p.NotAfter.IsZero() || t.Before(p.NotAfter))
+}
+
+// CheckScheduledPSKs checks that the scheduled PSKs are the correct length for the given method,
+// and have valid validity periods.
+func CheckScheduledPSKs(method string, psks []ScheduledPSK) error {
+	pskLength, err := PSKLengthForMethod(method)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range psks {
+		if len(p.PSK) != pskLength {
+			return &PSKLengthError{p.PSK, pskLength}
+		}
+		if !p.NotAfter.IsZero() && !p.NotAfter.After(p.NotBefore) {
+			return fmt.Errorf("PSK expires at %v before becoming valid at %v", p.NotAfter, p.NotBefore)
+		}
+	}
+
+	return nil
+}
+
+// ReplaceIdentityCipherConfigs replaces the identity cipher configs accepted by the server for identity PSK rotation.
+//
+// Once called, the server accepts identity headers encrypted with any of the given configs,
+// instead of the identity cipher config it was created with. If iccs is empty, all identity headers are rejected.
+// It must be first called before the server is used.
+func (s *CredStore) ReplaceIdentityCipherConfigs(iccs []ServerIdentityCipherConfig) {
+	s.mu.Lock()
+	s.iccs = iccs
+	s.rotatingIdentityPSK = true
+	s.mu.Unlock()
+}
+
+// lookupTCPIdentityHeader decrypts the identity header of a TCP request with the server's identity PSKs,
+// and returns the user whose uPSK hash matches.
+// It must be called with the lock held.
+func (s *TCPServer) lookupTCPIdentityHeader(salt, identityHeader []byte) (*ServerUserCipherConfig, error) {
+	var uPSKHash [IdentityHeaderLength]byte
+
+	if !s.rotatingIdentityPSK {
+		identityHeaderCipher, err := s.identityCipherConfig.TCP(salt)
+		if err != nil {
+			return nil, err
+		}
+		identityHeaderCipher.Decrypt(uPSKHash[:], identityHeader)
+		if serverUserCipherConfig := s.ulm[uPSKHash]; serverUserCipherConfig != nil {
+			return serverUserCipherConfig, nil
+		}
+		return nil, ErrIdentityHeaderUserPSKNotFound
+	}
+
+	for _, icc := range s.iccs {
+		identityHeaderCipher, err := icc.TCP(salt)
+		if err != nil {
+			return nil, err
+		}
+		identityHeaderCipher.Decrypt(uPSKHash[:], identityHeader)
+		if serverUserCipherConfig := s.ulm[uPSKHash]; serverUserCipherConfig != nil {
+			return serverUserCipherConfig, nil
+		}
+	}
+	return nil, ErrIdentityHeaderUserPSKNotFound
+}
+
+// sessionInfoRotatingIdentityPSK implements [UDPServer.SessionInfo] for identity PSK rotation.
+//
+// It decrypts the separate header and the identity header with each accepted identity PSK,
+// until the identity header matches a user. The headers are then decrypted in place,
+// with the identity header holding the uPSK hash.
+func (s *UDPServer) sessionInfoRotatingIdentityPSK(b []byte) (csid uint64, err error) {
+	if len(b) < UDPSeparateHeaderLength+IdentityHeaderLength {
+		err = fmt.Errorf("%w: %d", zerocopy.ErrPacketTooSmall, len(b))
+		return
+	}
+
+	var (
+		separateHeader [UDPSeparateHeaderLength]byte
+		uPSKHash       [IdentityHeaderLength]byte
+	)
+	identityHeader := b[UDPSeparateHeaderLength : UDPSeparateHeaderLength+IdentityHeaderLength]
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, icc := range s.iccs {
+		block := icc.UDP()
+		block.Decrypt(separateHeader[:], b)
+		block.Decrypt(uPSKHash[:], identityHeader)
+		subtle.XORBytes(uPSKHash[:], uPSKHash[:], separateHeader[:])
+		if s.ulm[uPSKHash] != nil {
+			copy(b, separateHeader[:])
+			copy(identityHeader, uPSKHash[:])
+			return binary.BigEndian.Uint64(separateHeader[:]), nil
+		}
+	}
+	return 0, ErrIdentityHeaderUserPSKNotFound
+}
+
+// ScheduleNext schedules the client to switch to next at the given time, for identity PSK rotation.
+// It must be called before the client is used.
+func (c *ClientCipherConfig) ScheduleNext(next *ClientCipherConfig, at time.Time) {
+	c.next = next
+	c.nextAt = at
+}
+
+// Current returns the cipher config to use for a new connection or session,
+// which is the scheduled next config after its scheduled time, or c itself.
+func (c *ClientCipherConfig) Current() *ClientCipherConfig {
+	if c.next != nil && !time.Now().Before(c.nextAt) {
+		return c.next.Current()
+	}
+	return c
+}
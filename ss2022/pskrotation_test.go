@@ -0,0 +1,223 @@
+package ss2022
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/pipe"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+func TestScheduledPSKValidAt(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name string
+		psk  ScheduledPSK
+		want bool
+	}{
+		{"Unbounded", ScheduledPSK{}, true},
+		{"NotYetValid", ScheduledPSK{NotBefore: now.Add(time.Second)}, false},
+		{"ValidFrom", ScheduledPSK{NotBefore: now}, true},
+		{"ValidUntil", ScheduledPSK{NotAfter: now.Add(time.Second)}, true},
+		{"Expired", ScheduledPSK{NotAfter: now}, false},
+		{"Window", ScheduledPSK{NotBefore: now.Add(-time.Second), NotAfter: now.Add(time.Second)}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.psk.ValidAt(now); got != c.want {
+				t.Errorf("ValidAt() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckScheduledPSKs(t *testing.T) {
+	const method = "2022-blake3-aes-128-gcm"
+	now := time.Now()
+	psk := make([]byte, 16)
+
+	if err := CheckScheduledPSKs(method, []ScheduledPSK{{PSK: psk}, {PSK: psk, NotBefore: now, NotAfter: now.Add(time.Hour)}}); err != nil {
+		t.Errorf("CheckScheduledPSKs() with valid PSKs failed: %v", err)
+	}
+
+	var pskLengthErr *PSKLengthError
+	if err := CheckScheduledPSKs(method, []ScheduledPSK{{PSK: make([]byte, 32)}}); !errors.As(err, &pskLengthErr) {
+		t.Errorf("CheckScheduledPSKs() with wrong PSK length returned %v, want %T", err, pskLengthErr)
+	}
+
+	if err := CheckScheduledPSKs(method, []ScheduledPSK{{PSK: psk, NotBefore: now, NotAfter: now}}); err == nil {
+		t.Error("CheckScheduledPSKs() with empty validity period succeeded")
+	}
+}
+
+// newRotatingIdentityPSKTuple returns client cipher configs for the same user with different identity PSKs,
+// the identity cipher configs of the identity PSKs, and the server's user lookup map.
+func newRotatingIdentityPSKTuple(t *testing.T, enableUDP bool) ([2]*ClientCipherConfig, [2]ServerIdentityCipherConfig, UserLookupMap) {
+	t.Helper()
+
+	var (
+		clientCipherConfigs   [2]*ClientCipherConfig
+		identityCipherConfigs [2]ServerIdentityCipherConfig
+	)
+
+	uPSK := make([]byte, 16)
+	if _, err := rand.Read(uPSK); err != nil {
+		t.Fatal(err)
+	}
+	userCipherConfig, err := NewServerUserCipherConfig("Alex", uPSK, enableUDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		iPSK := make([]byte, 16)
+		if _, err = rand.Read(iPSK); err != nil {
+			t.Fatal(err)
+		}
+		clientCipherConfigs[i], err = NewClientCipherConfig(uPSK, [][]byte{iPSK}, enableUDP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identityCipherConfigs[i], err = NewServerIdentityCipherConfig(iPSK, enableUDP)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return clientCipherConfigs, identityCipherConfigs, UserLookupMap{PSKHash(uPSK): userCipherConfig}
+}
+
+// acceptTCPRequest sends a request with a client using cipherConfig, and returns the username accepted by s.
+func acceptTCPRequest(t *testing.T, s *TCPServer, cipherConfig *ClientCipherConfig) (string, error) {
+	t.Helper()
+
+	pl, pr := pipe.NewDuplexPipe()
+	c := NewTCPClient(name, &zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl}, false, cipherConfig, nil, nil)
+
+	done := make(chan struct{})
+	go func() {
+		_, _, _ = c.Dial(context.Background(), targetAddr, []byte("hello"))
+		close(done)
+	}()
+
+	_, _, _, username, err := s.Accept(pr)
+	pr.Close()
+	<-done
+	pl.Close()
+	return username, err
+}
+
+func TestTCPServerRotatingIdentityPSK(t *testing.T) {
+	clientCipherConfigs, identityCipherConfigs, userLookupMap := newRotatingIdentityPSKTuple(t, false)
+
+	s := NewTCPServer(false, UserCipherConfig{}, identityCipherConfigs[0], nil, nil)
+	s.ReplaceUserLookupMap(userLookupMap)
+	s.ReplaceIdentityCipherConfigs(identityCipherConfigs[:])
+
+	for i, cipherConfig := range clientCipherConfigs {
+		username, err := acceptTCPRequest(t, s, cipherConfig)
+		if err != nil {
+			t.Fatalf("Accept() with identity PSK %d failed: %v", i, err)
+		}
+		if username != "Alex" {
+			t.Errorf("Accept() with identity PSK %d returned username %q, want %q", i, username, "Alex")
+		}
+	}
+
+	// The old identity PSK expires.
+	s.ReplaceIdentityCipherConfigs(identityCipherConfigs[1:])
+
+	if _, err := acceptTCPRequest(t, s, clientCipherConfigs[0]); err != ErrIdentityHeaderUserPSKNotFound {
+		t.Errorf("Accept() with expired identity PSK returned %v, want %v", err, ErrIdentityHeaderUserPSKNotFound)
+	}
+	if _, err := acceptTCPRequest(t, s, clientCipherConfigs[1]); err != nil {
+		t.Errorf("Accept() with new identity PSK failed: %v", err)
+	}
+}
+
+// unpackUDPPacket sends a packet with a new client session using cipherConfig, and returns the username accepted by s.
+func unpackUDPPacket(t *testing.T, s *UDPServer, cipherConfig *ClientCipherConfig) (string, error) {
+	t.Helper()
+
+	ctx := context.Background()
+	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, cipherConfig, NoPadding, PortHopping{})
+	_, clientSession, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSession.Close()
+
+	headroom := c.Info().PackerHeadroom
+	b := make([]byte, headroom.Front+payloadLen+headroom.Rear)
+	_, packetStart, packetLen, err := clientSession.Packer.PackInPlace(ctx, b, targetAddr, headroom.Front, payloadLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := b[packetStart : packetStart+packetLen]
+
+	csid, err := s.SessionInfo(p)
+	if err != nil {
+		return "", err
+	}
+	unpacker, username, err := s.NewUnpacker(p, csid)
+	if err != nil {
+		return "", err
+	}
+	if _, _, _, err = unpacker.UnpackInPlace(p, clientAddrPort, 0, len(p)); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func TestUDPServerRotatingIdentityPSK(t *testing.T) {
+	clientCipherConfigs, identityCipherConfigs, userLookupMap := newRotatingIdentityPSKTuple(t, true)
+
+	s := NewUDPServer(DefaultSlidingWindowFilterSize, UserCipherConfig{}, identityCipherConfigs[0], NoPadding)
+	s.ReplaceUserLookupMap(userLookupMap)
+	s.ReplaceIdentityCipherConfigs(identityCipherConfigs[:])
+
+	for i, cipherConfig := range clientCipherConfigs {
+		username, err := unpackUDPPacket(t, s, cipherConfig)
+		if err != nil {
+			t.Fatalf("Unpacking packet with identity PSK %d failed: %v", i, err)
+		}
+		if username != "Alex" {
+			t.Errorf("Unpacking packet with identity PSK %d returned username %q, want %q", i, username, "Alex")
+		}
+	}
+
+	// The old identity PSK expires.
+	s.ReplaceIdentityCipherConfigs(identityCipherConfigs[1:])
+
+	if _, err := unpackUDPPacket(t, s, clientCipherConfigs[0]); err != ErrIdentityHeaderUserPSKNotFound {
+		t.Errorf("Unpacking packet with expired identity PSK returned %v, want %v", err, ErrIdentityHeaderUserPSKNotFound)
+	}
+	if _, err := unpackUDPPacket(t, s, clientCipherConfigs[1]); err != nil {
+		t.Errorf("Unpacking packet with new identity PSK failed: %v", err)
+	}
+}
+
+func TestClientCipherConfigScheduleNext(t *testing.T) {
+	clientCipherConfigs, identityCipherConfigs, userLookupMap := newRotatingIdentityPSKTuple(t, false)
+	current, next := clientCipherConfigs[0], clientCipherConfigs[1]
+
+	current.ScheduleNext(next, time.Now().Add(time.Hour))
+	if got := current.Current(); got != current {
+		t.Error("Current() switched before the scheduled time")
+	}
+
+	current.ScheduleNext(next, time.Now())
+	if got := current.Current(); got != next {
+		t.Error("Current() did not switch at the scheduled time")
+	}
+
+	// New requests use the new identity PSK.
+	s := NewTCPServer(false, UserCipherConfig{}, identityCipherConfigs[1], nil, nil)
+	s.ReplaceUserLookupMap(userLookupMap)
+	if _, err := acceptTCPRequest(t, s, current); err != nil {
+		t.Errorf("Accept() after switching failed: %v", err)
+	}
+}
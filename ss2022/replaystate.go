@@ -0,0 +1,179 @@
+package ss2022
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayState is the saved replay protection state of a Shadowsocks 2022 server.
+// It may be marshaled as or unmarshaled from JSON.
+//
+// The state is only useful for [ReplayWindowDuration] after it is saved.
+// Requests and packets older than that are rejected by their timestamps.
+type ReplayState struct {
+	// TCPSalts is the list of request salts seen by the TCP server.
+	TCPSalts []ReplayStateSalt `json:"tcpSalts,omitempty"`
+
+	// UDPSessions is the list of client sessions seen by the UDP server.
+	UDPSessions []ReplayStateUDPSession `json:"udpSessions,omitempty"`
+}
+
+// ReplayStateSalt is a saved request salt.
+type ReplayStateSalt struct {
+	Salt    []byte    `json:"salt"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// ReplayStateUDPSession is a saved client session.
+type ReplayStateUDPSession struct {
+	// ClientSessionID is the client session ID.
+	ClientSessionID uint64 `json:"csid"`
+
+	// LastPacketID is the largest packet ID accepted in the session.
+	LastPacketID uint64 `json:"lastPacketID"`
+
+	// LastSeen is approximately when the last packet of the session was accepted.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// SaveReplayState appends the salts in the server's salt pool to state.
+func (s *TCPServer) SaveReplayState(state *ReplayState) {
+	s.Lock()
+	defer s.Unlock()
+	for salt, added := range s.saltPool.All() {
+		state.TCPSalts = append(state.TCPSalts, ReplayStateSalt{
+			Salt:    []byte(salt),
+			AddedAt: added,
+		})
+	}
+}
+
+// RestoreReplayState adds the salts in state to the server's salt pool,
+// and returns the number of salts restored. Expired salts are ignored.
+func (s *TCPServer) RestoreReplayState(state *ReplayState) (n int) {
+	s.Lock()
+	defer s.Unlock()
+	for _, salt := range state.TCPSalts {
+		if time.Since(salt.AddedAt) > ReplayWindowDuration {
+			continue
+		}
+		s.saltPool.AddAt(string(salt.Salt), salt.AddedAt)
+		n++
+	}
+	return n
+}
+
+// udpReplayTracker tracks the packet IDs of the UDP server's client sessions,
+// so that the sliding window filters of restored sessions can reject packets seen before a restart.
+type udpReplayTracker struct {
+	mu       sync.Mutex
+	sessions map[uint64]*udpSessionReplayState
+	restored map[uint64]uint64
+}
+
+// udpSessionReplayState tracks the packet IDs of a client session.
+type udpSessionReplayState struct {
+	tracker      *udpReplayTracker
+	csid         uint64
+	registered   bool
+	lastPacketID atomic.Uint64
+
+	// savedPacketID and savedAt are guarded by tracker.mu.
+	savedPacketID uint64
+	savedAt       time.Time
+}
+
+// add records an accepted packet ID.
+// It must be called by the session's unpacker after adding the packet ID to its filter.
+func (s *udpSessionReplayState) add(cpid uint64) {
+	if !s.registered {
+		s.tracker.mu.Lock()
+		s.tracker.sessions[s.csid] = s
+		s.tracker.mu.Unlock()
+		s.registered = true
+	}
+	if cpid > s.lastPacketID.Load() {
+		s.lastPacketID.Store(cpid)
+	}
+}
+
+// newSession returns the replay state for a new unpacker of the client session,
+// and the filter to start the unpacker with, which is nil unless the session was restored.
+func (t *udpReplayTracker) newSession(csid, filterSize uint64) (*udpSessionReplayState, *SlidingWindowFilter) {
+	s := &udpSessionReplayState{
+		tracker: t,
+		csid:    csid,
+	}
+
+	t.mu.Lock()
+	lastPacketID, ok := t.restored[csid]
+	if ok {
+		delete(t.restored, csid)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return s, nil
+	}
+	s.lastPacketID.Store(lastPacketID)
+	return s, NewSlidingWindowFilterAfter(filterSize, lastPacketID)
+}
+
+// EnableReplayStateTracking makes the server track the packet IDs of its client sessions
+// for [UDPServer.SaveReplayState]. It must be called before the server is used.
+func (s *UDPServer) EnableReplayStateTracking() {
+	s.replayTracker = &udpReplayTracker{
+		sessions: make(map[uint64]*udpSessionReplayState),
+		restored: make(map[uint64]uint64),
+	}
+}
+
+// SaveReplayState appends the client sessions seen in the last [ReplayWindowDuration] to state.
+// Sessions that have been idle for longer are forgotten.
+//
+// Replay state tracking must be enabled with [UDPServer.EnableReplayStateTracking].
+func (s *UDPServer) SaveReplayState(state *ReplayState) {
+	t := s.replayTracker
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for csid, session := range t.sessions {
+		if lastPacketID := session.lastPacketID.Load(); lastPacketID != session.savedPacketID || session.savedAt.IsZero() {
+			session.savedPacketID = lastPacketID
+			session.savedAt = now
+		}
+		if now.Sub(session.savedAt) > ReplayWindowDuration {
+			delete(t.sessions, csid)
+			continue
+		}
+		state.UDPSessions = append(state.UDPSessions, ReplayStateUDPSession{
+			ClientSessionID: csid,
+			LastPacketID:    session.savedPacketID,
+			LastSeen:        session.savedAt,
+		})
+	}
+}
+
+// RestoreReplayState makes new unpackers of the client sessions in state reject
+// the packet IDs accepted before the state was saved, and returns the number of sessions restored.
+// Expired sessions are ignored.
+//
+// Replay state tracking must be enabled with [UDPServer.EnableReplayStateTracking].
+func (s *UDPServer) RestoreReplayState(state *ReplayState) (n int) {
+	t := s.replayTracker
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, session := range state.UDPSessions {
+		if time.Since(session.LastSeen) > ReplayWindowDuration {
+			continue
+		}
+		t.restored[session.ClientSessionID] = session.LastPacketID
+		n++
+	}
+	return n
+}
@@ -0,0 +1,167 @@
+package ss2022
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+func TestNewSlidingWindowFilterAfter(t *testing.T) {
+	for _, last := range []uint64{0, 63, 64, 100, 1000} {
+		f := NewSlidingWindowFilterAfter(DefaultSlidingWindowFilterSize, last)
+
+		for _, counter := range []uint64{0, last / 2, last} {
+			if f.IsOk(counter) {
+				t.Errorf("last %d: IsOk(%d) = true, want false", last, counter)
+			}
+		}
+		if !f.IsOk(last + 1) {
+			t.Errorf("last %d: IsOk(%d) = false, want true", last, last+1)
+		}
+
+		// Counters after last are still accepted out of order.
+		f.MustAdd(last + 3)
+		if !f.IsOk(last + 1) {
+			t.Errorf("last %d: IsOk(%d) after adding %d = false, want true", last, last+1, last+3)
+		}
+		if f.IsOk(last + 3) {
+			t.Errorf("last %d: IsOk(%d) after adding it = true, want false", last, last+3)
+		}
+	}
+}
+
+// roundTripReplayState saves the state to JSON and loads it back, like the server does across restarts.
+func roundTripReplayState(t *testing.T, state *ReplayState) *ReplayState {
+	t.Helper()
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded ReplayState
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	return &loaded
+}
+
+func TestTCPServerReplayState(t *testing.T) {
+	s := NewTCPServer(false, UserCipherConfig{}, ServerIdentityCipherConfig{}, nil, nil)
+
+	salts := make([]string, 3)
+	for i := range salts {
+		var salt [32]byte
+		if _, err := rand.Read(salt[:]); err != nil {
+			t.Fatal(err)
+		}
+		salts[i] = string(salt[:])
+		s.saltPool.Add(salts[i])
+	}
+
+	var state ReplayState
+	s.SaveReplayState(&state)
+
+	// An expired salt is not restored.
+	state.TCPSalts = append(state.TCPSalts, ReplayStateSalt{
+		Salt:    []byte("expired"),
+		AddedAt: time.Now().Add(-2 * ReplayWindowDuration),
+	})
+
+	restored := NewTCPServer(false, UserCipherConfig{}, ServerIdentityCipherConfig{}, nil, nil)
+	if n := restored.RestoreReplayState(roundTripReplayState(t, &state)); n != len(salts) {
+		t.Errorf("RestoreReplayState() = %d, want %d", n, len(salts))
+	}
+	for _, salt := range salts {
+		if restored.saltPool.Check(salt) {
+			t.Error("Restored server accepted a saved salt")
+		}
+	}
+	if !restored.saltPool.Check("expired") {
+		t.Error("Restored server denied an expired salt")
+	}
+}
+
+func TestUDPServerReplayState(t *testing.T) {
+	ctx := context.Background()
+	clientCipherConfig, userCipherConfig, err := newRandomCipherConfigTupleNoEIH("2022-blake3-aes-128-gcm", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, clientCipherConfig, NoPadding, PortHopping{})
+	_, clientSession, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSession.Close()
+
+	headroom := c.Info().PackerHeadroom
+	b := make([]byte, headroom.Front+payloadLen+headroom.Rear)
+
+	// pack returns a new packet from the client session.
+	pack := func() []byte {
+		t.Helper()
+		_, packetStart, packetLen, err := clientSession.Packer.PackInPlace(ctx, b, targetAddr, headroom.Front, payloadLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte(nil), b[packetStart:packetStart+packetLen]...)
+	}
+
+	// unpack unpacks a copy of the packet with a new unpacker from s.
+	unpack := func(s *UDPServer, packet []byte) error {
+		t.Helper()
+		p := append([]byte(nil), packet...)
+		csid, err := s.SessionInfo(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacker, _, err := s.NewUnpacker(p, csid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err = unpacker.UnpackInPlace(p, clientAddrPort, 0, len(p))
+		return err
+	}
+
+	s := NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, ServerIdentityCipherConfig{}, NoPadding)
+	s.EnableReplayStateTracking()
+
+	first := pack()
+	if err = unpack(s, first); err != nil {
+		t.Fatal(err)
+	}
+
+	var state ReplayState
+	s.SaveReplayState(&state)
+	if len(state.UDPSessions) != 1 {
+		t.Fatalf("len(state.UDPSessions) = %d, want 1", len(state.UDPSessions))
+	}
+
+	// Without the saved state, a restarted server accepts the replayed packet.
+	fresh := NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, ServerIdentityCipherConfig{}, NoPadding)
+	if err = unpack(fresh, first); err != nil {
+		t.Fatalf("Fresh server rejected the packet: %v", err)
+	}
+
+	restored := NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, ServerIdentityCipherConfig{}, NoPadding)
+	restored.EnableReplayStateTracking()
+	if n := restored.RestoreReplayState(roundTripReplayState(t, &state)); n != 1 {
+		t.Errorf("RestoreReplayState() = %d, want 1", n)
+	}
+	if err = unpack(restored, first); !errors.Is(err, ErrReplay) {
+		t.Errorf("Restored server returned %v for the replayed packet, want %v", err, ErrReplay)
+	}
+
+	// New packets of the session are accepted.
+	restored = NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, ServerIdentityCipherConfig{}, NoPadding)
+	restored.EnableReplayStateTracking()
+	restored.RestoreReplayState(&state)
+	if err = unpack(restored, pack()); err != nil {
+		t.Errorf("Restored server rejected a new packet: %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package ss2022
 
-import "time"
+import (
+	"iter"
+	"time"
+)
 
 // SaltPool stores salts for [retention, 2*retention) to protect against replay attacks
 // during the replay window.
@@ -36,6 +39,37 @@ func (p *SaltPool[T]) Add(salt T) {
 	p.pool[salt] = time.Now()
 }
 
+// AddAt adds the given salt to the pool as if it were added at the given time.
+// It is used for restoring saved salts. Salts added more than retention ago are ignored.
+func (p *SaltPool[T]) AddAt(salt T, added time.Time) {
+	if time.Since(added) > p.retention {
+		return
+	}
+	p.pool[salt] = added
+}
+
+// All returns an iterator over the salts in the pool and the times they were added.
+func (p *SaltPool[T]) All() iter.Seq2[T, time.Time] {
+	return func(yield func(T, time.Time) bool) {
+		for salt, added := range p.pool {
+			if !yield(salt, added) {
+				return
+			}
+		}
+	}
+}
+
+// SaltFilter is a filter of request salts shared by servers with the same PSKs,
+// like instances of a server behind a load balancer, so that a request accepted by one
+// cannot be replayed to another.
+//
+// Implementations must be safe for concurrent use.
+type SaltFilter interface {
+	// CheckAndAdd adds the salt to the filter for [ReplayWindowDuration],
+	// and returns whether it was not already in the filter.
+	CheckAndAdd(salt []byte) bool
+}
+
 // NewSaltPool returns a new SaltPool with the given retention.
 func NewSaltPool[T comparable](retention time.Duration) *SaltPool[T] {
 	return &SaltPool[T]{
@@ -23,6 +23,18 @@ func NewSlidingWindowFilter(size uint64) *SlidingWindowFilter {
 	}
 }
 
+// NewSlidingWindowFilterAfter returns a new sliding window filter with the given size,
+// which rejects last and all counters before it, as if every one of them had been added.
+func NewSlidingWindowFilterAfter(size, last uint64) *SlidingWindowFilter {
+	f := NewSlidingWindowFilter(size)
+	f.last = last
+	for i := range f.ring {
+		f.ring[i] = ^uint(0)
+	}
+	f.ring[f.blockIndex(last)] = 1<<(f.bitIndex(last)+1) - 1
+	return f
+}
+
 // Size returns the size of the sliding window.
 func (f *SlidingWindowFilter) Size() uint64 {
 	return f.size
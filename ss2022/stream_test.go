@@ -75,7 +75,25 @@ func testShadowStreamReadWriter(t *testing.T, ctx context.Context, allowSegmente
 	zerocopy.ReadWriterTestFunc(t, crw, srw)
 }
 
-func testShadowStreamReadWriterReplay(t *testing.T, ctx context.Context, clientCipherConfig *ClientCipherConfig, userCipherConfig UserCipherConfig, identityCipherConfig ServerIdentityCipherConfig, userLookupMap UserLookupMap) {
+// mapSaltFilter is a [SaltFilter] backed by a map.
+type mapSaltFilter struct {
+	mu    sync.Mutex
+	salts map[string]struct{}
+}
+
+func (f *mapSaltFilter) CheckAndAdd(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.salts[string(salt)]; ok {
+		return false
+	}
+	f.salts[string(salt)] = struct{}{}
+	return true
+}
+
+// testShadowStreamReadWriterReplay tests that a replayed request is rejected.
+// If shared is true, the request is replayed to another server sharing a salt filter with the first one.
+func testShadowStreamReadWriterReplay(t *testing.T, ctx context.Context, clientCipherConfig *ClientCipherConfig, userCipherConfig UserCipherConfig, identityCipherConfig ServerIdentityCipherConfig, userLookupMap UserLookupMap, shared bool) {
 	pl, pr := pipe.NewDuplexPipe()
 	plo := zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl}
 	clientTargetAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53))
@@ -86,6 +104,14 @@ func testShadowStreamReadWriterReplay(t *testing.T, ctx context.Context, clientC
 	}
 	s := NewTCPServer(false, userCipherConfig, identityCipherConfig, nil, nil)
 	s.ReplaceUserLookupMap(userLookupMap)
+	replayServer := s
+	if shared {
+		filter := mapSaltFilter{salts: make(map[string]struct{})}
+		s.SetSharedSaltFilter(&filter)
+		replayServer = NewTCPServer(false, userCipherConfig, identityCipherConfig, nil, nil)
+		replayServer.ReplaceUserLookupMap(userLookupMap)
+		replayServer.SetSharedSaltFilter(&filter)
+	}
 
 	var (
 		wg   sync.WaitGroup
@@ -131,7 +157,7 @@ func testShadowStreamReadWriterReplay(t *testing.T, ctx context.Context, clientC
 	go sendFunc()
 
 	// Start server from replay.
-	_, _, _, _, serr = s.Accept(pr)
+	_, _, _, _, serr = replayServer.Accept(pr)
 	if serr != ErrRepeatedSalt {
 		t.Errorf("Expected ErrRepeatedSalt, got %v", serr)
 	}
@@ -173,7 +199,10 @@ func testShadowStreamReadWriterWithCipher(t *testing.T, ctx context.Context, cli
 	})
 
 	t.Run("Replay", func(t *testing.T) {
-		testShadowStreamReadWriterReplay(t, ctx, clientCipherConfig, userCipherConfig, identityCipherConfig, userLookupMap)
+		testShadowStreamReadWriterReplay(t, ctx, clientCipherConfig, userCipherConfig, identityCipherConfig, userLookupMap, false)
+	})
+	t.Run("SharedReplay", func(t *testing.T) {
+		testShadowStreamReadWriterReplay(t, ctx, clientCipherConfig, userCipherConfig, identityCipherConfig, userLookupMap, true)
 	})
 }
 
@@ -3,7 +3,6 @@ package ss2022
 import (
 	"bytes"
 	"context"
-	"crypto/cipher"
 	"crypto/rand"
 	"io"
 	mrand "math/rand/v2"
@@ -23,10 +22,11 @@ type TCPClient struct {
 	unsafeResponseStreamPrefix []byte
 }
 
-func NewTCPClient(name, network, address string, dialer conn.Dialer, allowSegmentedFixedLengthHeader bool, cipherConfig *ClientCipherConfig, unsafeRequestStreamPrefix, unsafeResponseStreamPrefix []byte) *TCPClient {
+// NewTCPClient returns a new Shadowsocks 2022 TCP client that opens connections to the server with rwo.
+func NewTCPClient(name string, rwo zerocopy.DirectReadWriteCloserOpener, allowSegmentedFixedLengthHeader bool, cipherConfig *ClientCipherConfig, unsafeRequestStreamPrefix, unsafeResponseStreamPrefix []byte) *TCPClient {
 	return &TCPClient{
 		name:                       name,
-		rwo:                        zerocopy.NewTCPConnOpener(dialer, network, address),
+		rwo:                        rwo,
 		readOnceOrFull:             readOnceOrFullFunc(allowSegmentedFixedLengthHeader),
 		cipherConfig:               cipherConfig,
 		unsafeRequestStreamPrefix:  unsafeRequestStreamPrefix,
@@ -66,9 +66,10 @@ func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []by
 		paddingPayloadLen = 1 + mrand.IntN(MaxPaddingLength)
 	}
 
+	cipherConfig := c.cipherConfig.Current()
 	urspLen := len(c.unsafeRequestStreamPrefix)
-	saltLen := len(c.cipherConfig.PSK)
-	eihPSKHashes := c.cipherConfig.EIHPSKHashes()
+	saltLen := len(cipherConfig.PSK)
+	eihPSKHashes := cipherConfig.EIHPSKHashes()
 	identityHeadersLen := IdentityHeaderLength * len(eihPSKHashes)
 	identityHeadersStart := urspLen + saltLen
 	fixedLengthHeaderStart := identityHeadersStart + identityHeadersLen
@@ -94,7 +95,7 @@ func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []by
 	}
 
 	// Write and encrypt identity headers.
-	eihCiphers, err := c.cipherConfig.TCPIdentityHeaderCiphers(salt)
+	eihCiphers, err := cipherConfig.TCPIdentityHeaderCiphers(salt)
 	if err != nil {
 		return
 	}
@@ -111,7 +112,7 @@ func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []by
 	WriteTCPRequestFixedLengthHeader(fixedLengthHeaderPlaintext, uint16(variableLengthHeaderLen))
 
 	// Create AEAD cipher.
-	shadowStreamCipher, err := c.cipherConfig.ShadowStreamCipher(salt)
+	shadowStreamCipher, err := cipherConfig.ShadowStreamCipher(salt)
 	if err != nil {
 		return
 	}
@@ -147,7 +148,7 @@ func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []by
 		ShadowStreamWriter:         &w,
 		rawRW:                      rawRW,
 		readOnceOrFull:             c.readOnceOrFull,
-		cipherConfig:               c.cipherConfig,
+		cipherConfig:               cipherConfig,
 		requestSalt:                salt,
 		unsafeResponseStreamPrefix: c.unsafeResponseStreamPrefix,
 	}
@@ -159,6 +160,7 @@ func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []by
 type TCPServer struct {
 	CredStore
 	saltPool                   *SaltPool[string]
+	sharedSaltFilter           SaltFilter
 	readOnceOrFull             func(io.Reader, []byte) (int, error)
 	userCipherConfig           UserCipherConfig
 	identityCipherConfig       ServerIdentityCipherConfig
@@ -177,6 +179,13 @@ func NewTCPServer(allowSegmentedFixedLengthHeader bool, userCipherConfig UserCip
 	}
 }
 
+// SetSharedSaltFilter sets the filter of request salts shared with other servers.
+// Requests with salts in the filter are rejected as replays.
+// It must be called before the server is used.
+func (s *TCPServer) SetSharedSaltFilter(f SaltFilter) {
+	s.sharedSaltFilter = f
+}
+
 // Info implements the zerocopy.TCPServer Info method.
 func (s *TCPServer) Info() zerocopy.TCPServerInfo {
 	return zerocopy.TCPServerInfo{
@@ -232,22 +241,13 @@ func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.Re
 
 	// Process identity header.
 	if identityHeaderLen != 0 {
-		var identityHeaderCipher cipher.Block
-		identityHeaderCipher, err = s.identityCipherConfig.TCP(salt)
+		var serverUserCipherConfig *ServerUserCipherConfig
+		serverUserCipherConfig, err = s.lookupTCPIdentityHeader(salt, b[identityHeaderStart:fixedLengthHeaderStart])
 		if err != nil {
 			s.Unlock()
-			return
-		}
-
-		var uPSKHash [IdentityHeaderLength]byte
-		identityHeader := b[identityHeaderStart:fixedLengthHeaderStart]
-		identityHeaderCipher.Decrypt(uPSKHash[:], identityHeader)
-
-		serverUserCipherConfig := s.ulm[uPSKHash]
-		if serverUserCipherConfig == nil {
-			s.Unlock()
-			payload = b[:n]
-			err = ErrIdentityHeaderUserPSKNotFound
+			if err == ErrIdentityHeaderUserPSKNotFound {
+				payload = b[:n]
+			}
 			return
 		}
 		userCipherConfig = serverUserCipherConfig.UserCipherConfig
@@ -281,6 +281,14 @@ func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.Re
 
 	s.Unlock()
 
+	// Check and add request salt to the shared filter, only after the request is authenticated,
+	// so that unauthenticated probes cannot fill the filter.
+	if s.sharedSaltFilter != nil && !s.sharedSaltFilter.CheckAndAdd(salt) {
+		payload = b[:n]
+		err = ErrRepeatedSalt
+		return
+	}
+
 	b = make([]byte, vhlen+16)
 
 	// Read variable-length header.
@@ -21,9 +21,10 @@ type UDPClient struct {
 	filterSize       uint64
 	cipherConfig     *ClientCipherConfig
 	shouldPad        PaddingPolicy
+	hopping          PortHopping
 }
 
-func NewUDPClient(name, network string, addr conn.Addr, mtu int, listenConfig conn.ListenConfig, filterSize uint64, cipherConfig *ClientCipherConfig, shouldPad PaddingPolicy) *UDPClient {
+func NewUDPClient(name, network string, addr conn.Addr, mtu int, listenConfig conn.ListenConfig, filterSize uint64, cipherConfig *ClientCipherConfig, shouldPad PaddingPolicy, hopping PortHopping) *UDPClient {
 	identityHeadersLen := IdentityHeaderLength * len(cipherConfig.iPSKs)
 	return &UDPClient{
 		network: network,
@@ -38,6 +39,7 @@ func NewUDPClient(name, network string, addr conn.Addr, mtu int, listenConfig co
 		filterSize:       filterSize,
 		cipherConfig:     cipherConfig,
 		shouldPad:        shouldPad,
+		hopping:          hopping,
 	}
 }
 
@@ -59,31 +61,36 @@ func (c *UDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zer
 		return c.info, zerocopy.UDPClientSession{}, err
 	}
 	csid := binary.BigEndian.Uint64(salt)
-	aead, err := c.cipherConfig.AEAD(salt)
+	cipherConfig := c.cipherConfig.Current()
+	aead, err := cipherConfig.AEAD(salt)
 	if err != nil {
 		return c.info, zerocopy.UDPClientSession{}, err
 	}
 
-	return c.info, zerocopy.UDPClientSession{
+	info := c.info
+	info.ListenConfig = info.ListenConfig.WithSourceAddrFor(ctx, addrPort.Addr())
+
+	return info, zerocopy.UDPClientSession{
 		MaxPacketSize: maxPacketSize,
 		Packer: &ShadowPacketClientPacker{
 			csid:             csid,
 			aead:             aead,
-			block:            c.cipherConfig.UDPSeparateHeaderPackerCipher(),
+			block:            cipherConfig.UDPSeparateHeaderPackerCipher(),
 			shouldPad:        c.shouldPad,
-			eihCiphers:       c.cipherConfig.UDPIdentityHeaderCiphers(),
-			eihPSKHashes:     c.cipherConfig.EIHPSKHashes(),
+			eihCiphers:       cipherConfig.UDPIdentityHeaderCiphers(),
+			eihPSKHashes:     cipherConfig.EIHPSKHashes(),
 			maxPacketSize:    maxPacketSize,
 			nonAEADHeaderLen: c.nonAEADHeaderLen,
 			info: zerocopy.ClientPackerInfo{
 				Headroom: c.info.PackerHeadroom,
 			},
 			serverAddrPort: addrPort,
+			hopping:        c.hopping,
 		},
 		Unpacker: &ShadowPacketClientUnpacker{
 			csid:         csid,
 			filterSize:   c.filterSize,
-			cipherConfig: c.cipherConfig,
+			cipherConfig: cipherConfig,
 		},
 		Close: zerocopy.NoopClose,
 	}, nil
@@ -99,6 +106,7 @@ type UDPServer struct {
 	identityCipherConfig ServerIdentityCipherConfig
 	shouldPad            PaddingPolicy
 	userCipherConfig     UserCipherConfig
+	replayTracker        *udpReplayTracker
 }
 
 func NewUDPServer(filterSize uint64, userCipherConfig UserCipherConfig, identityCipherConfig ServerIdentityCipherConfig, shouldPad PaddingPolicy) *UDPServer {
@@ -135,6 +143,10 @@ func (s *UDPServer) SessionInfo(b []byte) (csid uint64, err error) {
 		return
 	}
 
+	if s.rotatingIdentityPSK {
+		return s.sessionInfoRotatingIdentityPSK(b)
+	}
+
 	s.block.Decrypt(b, b)
 
 	csid = binary.BigEndian.Uint64(b)
@@ -156,8 +168,11 @@ func (s *UDPServer) NewUnpacker(b []byte, csid uint64) (zerocopy.ServerUnpacker,
 	if s.identityHeaderLen != 0 {
 		separateHeader := b[:UDPSeparateHeaderLength]
 		identityHeader := b[UDPSeparateHeaderLength:nonAEADHeaderLen]
-		s.block.Decrypt(identityHeader, identityHeader)
-		subtle.XORBytes(identityHeader, identityHeader, separateHeader)
+		// SessionInfo has already decrypted the identity header when rotating identity PSKs.
+		if !s.rotatingIdentityPSK {
+			s.block.Decrypt(identityHeader, identityHeader)
+			subtle.XORBytes(identityHeader, identityHeader, separateHeader)
+		}
 		uPSKHash := *(*[IdentityHeaderLength]byte)(identityHeader)
 		serverUserCipherConfig := s.ulm[uPSKHash]
 		if serverUserCipherConfig == nil {
@@ -172,7 +187,7 @@ func (s *UDPServer) NewUnpacker(b []byte, csid uint64) (zerocopy.ServerUnpacker,
 		return nil, "", err
 	}
 
-	return &ShadowPacketServerUnpacker{
+	p := &ShadowPacketServerUnpacker{
 		csid:             csid,
 		aead:             aead,
 		filterSize:       s.filterSize,
@@ -182,5 +197,11 @@ func (s *UDPServer) NewUnpacker(b []byte, csid uint64) (zerocopy.ServerUnpacker,
 		},
 		userCipherConfig: userCipherConfig,
 		packerShouldPad:  s.shouldPad,
-	}, username, nil
+	}
+
+	if s.replayTracker != nil {
+		p.replayState, p.filter = s.replayTracker.newSession(csid, s.filterSize)
+	}
+
+	return p, username, nil
 }
@@ -38,7 +38,7 @@ var (
 )
 
 func testUDPClientServer(t *testing.T, ctx context.Context, clientCipherConfig *ClientCipherConfig, userCipherConfig UserCipherConfig, identityCipherConfig ServerIdentityCipherConfig, userLookupMap UserLookupMap, clientShouldPad, serverShouldPad PaddingPolicy, mtu, packetSize, payloadLen int) {
-	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, clientCipherConfig, clientShouldPad)
+	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, clientCipherConfig, clientShouldPad, PortHopping{})
 	s := NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, identityCipherConfig, serverShouldPad)
 	s.ReplaceUserLookupMap(userLookupMap)
 
@@ -148,7 +148,7 @@ func testUDPClientServerSessionChangeAndReplay(t *testing.T, ctx context.Context
 		t.Fatal(err)
 	}
 
-	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, clientCipherConfig, shouldPad)
+	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, clientCipherConfig, shouldPad, PortHopping{})
 	s := NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, identityCipherConfig, shouldPad)
 	s.ReplaceUserLookupMap(userLookupMap)
 
@@ -365,3 +365,90 @@ func TestUDPClientServerWithEIH(t *testing.T) {
 		testUDPClientServerWithCipher(t, ctx, clientCipherConfig256, UserCipherConfig{}, identityCipherConfig256, userLookupMap256)
 	})
 }
+
+func TestUDPClientPortHopping(t *testing.T) {
+	ctx := context.Background()
+	clientCipherConfig, userCipherConfig, err := newRandomCipherConfigTupleNoEIH("2022-blake3-aes-128-gcm", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shouldPad, err := ParsePaddingPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hopping := PortHopping{
+		FirstPort: 20220,
+		LastPort:  20229,
+		Interval:  time.Hour,
+	}
+	c := NewUDPClient(name, "ip", serverAddr, mtu, conn.DefaultUDPClientListenConfig, DefaultSlidingWindowFilterSize, clientCipherConfig, shouldPad, hopping)
+	s := NewUDPServer(DefaultSlidingWindowFilterSize, userCipherConfig, ServerIdentityCipherConfig{}, shouldPad)
+
+	clientInfo, clientSession, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSession.Close()
+
+	frontHeadroom := clientInfo.PackerHeadroom.Front + 8 // Compensate for server message overhead.
+	rearHeadroom := clientInfo.PackerHeadroom.Rear
+	b := make([]byte, frontHeadroom+payloadLen+rearHeadroom)
+
+	pack := func() netip.AddrPort {
+		dap, _, _, err := clientSession.Packer.PackInPlace(ctx, b, targetAddr, frontHeadroom, payloadLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dap.Addr() != serverAddrPort.Addr() || dap.Port() < hopping.FirstPort || dap.Port() > hopping.LastPort {
+			t.Errorf("destAddrPort = %s, expected %s with a port in [%d, %d]", dap, serverAddrPort.Addr(), hopping.FirstPort, hopping.LastPort)
+		}
+		return dap
+	}
+
+	// The first packet picks a port in the range.
+	firstDap := pack()
+	if dap := pack(); dap != firstDap {
+		t.Errorf("destAddrPort = %s before the hop interval elapsed, expected %s", dap, firstDap)
+	}
+
+	// Force a hop.
+	clientSession.Packer.(*ShadowPacketClientPacker).nextHopTime = time.Time{}
+	dap, pkts, pktl, err := clientSession.Packer.PackInPlace(ctx, b, targetAddr, frontHeadroom, payloadLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dap == firstDap {
+		t.Errorf("destAddrPort = %s after hop, expected a different port", dap)
+	}
+
+	// The server sees the same session after the hop.
+	csid, err := s.SessionInfo(b[pkts : pkts+pktl])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csid != clientSession.Packer.(*ShadowPacketClientPacker).csid {
+		t.Errorf("csid = %d, expected %d", csid, clientSession.Packer.(*ShadowPacketClientPacker).csid)
+	}
+}
+
+func TestPortHoppingNextPort(t *testing.T) {
+	h := PortHopping{FirstPort: 1000, LastPort: 1001, Interval: time.Second}
+	for range 16 {
+		if port := h.nextPort(1000); port != 1001 {
+			t.Fatalf("h.nextPort(1000) = %d, expected 1001", port)
+		}
+	}
+
+	h = PortHopping{FirstPort: 1000, LastPort: 1000, Interval: time.Second}
+	if port := h.nextPort(1000); port != 1000 {
+		t.Errorf("h.nextPort(1000) = %d, expected 1000", port)
+	}
+
+	h = PortHopping{FirstPort: 65530, LastPort: 65535, Interval: time.Second}
+	for range 64 {
+		if port := h.nextPort(443); port < 65530 {
+			t.Fatalf("h.nextPort(443) = %d, expected a port in [65530, 65535]", port)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Package ssaead implements the legacy Shadowsocks AEAD protocol (SIP004),
+// for interoperability with servers and clients that do not support Shadowsocks 2022.
+package ssaead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize is the size of the master key and session subkeys of all supported methods.
+const KeySize = 32
+
+// SaltSize is the size of the salt prefixed to each TCP stream and UDP packet.
+const SaltSize = KeySize
+
+// TagSize is the size of an AEAD tag.
+const TagSize = 16
+
+var subkeyInfo = []byte("ss-subkey")
+
+var ErrEmptyPassword = errors.New("empty password")
+
+// CipherConfig stores the master key and the AEAD constructor of a method.
+type CipherConfig struct {
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewCipherConfig returns a new CipherConfig for the method, with the master key derived from the password.
+func NewCipherConfig(method, password string) (*CipherConfig, error) {
+	if password == "" {
+		return nil, ErrEmptyPassword
+	}
+
+	var newAEAD func(key []byte) (cipher.AEAD, error)
+
+	switch method {
+	case "aes-256-gcm":
+		newAEAD = newAESGCM
+	case "chacha20-ietf-poly1305":
+		newAEAD = chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unknown method: %s", method)
+	}
+
+	return &CipherConfig{
+		key:     DeriveKey(password, KeySize),
+		newAEAD: newAEAD,
+	}, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AEAD derives a session subkey from the salt and returns a new AEAD cipher.
+func (c *CipherConfig) AEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, subkeyInfo), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// DeriveKey derives a master key of keyLen bytes from the password,
+// using OpenSSL's EVP_BytesToKey with MD5, one iteration, and no salt.
+func DeriveKey(password string, keyLen int) []byte {
+	key := make([]byte, 0, keyLen+md5.Size)
+	var prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-md5.Size:]
+	}
+	return key[:keyLen]
+}
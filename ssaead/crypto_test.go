@@ -0,0 +1,34 @@
+package ssaead
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	expectedKey, err := hex.DecodeString("9cc2ae8a1ba7a93da39b46fc1019c481f5eed4f36a1de6859cad92c665562831")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := DeriveKey("correct horse battery staple", KeySize)
+	if !bytes.Equal(key, expectedKey) {
+		t.Errorf("DeriveKey() = %x, expected %x", key, expectedKey)
+	}
+}
+
+func TestNewCipherConfigError(t *testing.T) {
+	for _, c := range []struct {
+		method   string
+		password string
+	}{
+		{"aes-256-gcm", ""},
+		{"aes-128-cfb", "password"},
+		{"2022-blake3-aes-256-gcm", "password"},
+	} {
+		if _, err := NewCipherConfig(c.method, c.password); err == nil {
+			t.Errorf("NewCipherConfig(%q, %q) succeeded, expected error", c.method, c.password)
+		}
+	}
+}
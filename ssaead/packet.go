@@ -0,0 +1,222 @@
+package ssaead
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// zeroNonce is the nonce of all packets. Each packet has its own salt, and thus its own subkey.
+var zeroNonce [12]byte
+
+// ShadowPacketClientMessageHeadroom is the headroom required by an encrypted Shadowsocks AEAD client message.
+var ShadowPacketClientMessageHeadroom = zerocopy.Headroom{
+	Front: SaltSize + socks5.MaxAddrLen,
+	Rear:  TagSize,
+}
+
+// ShadowPacketServerMessageHeadroom is the headroom required by an encrypted Shadowsocks AEAD server message.
+var ShadowPacketServerMessageHeadroom = zerocopy.Headroom{
+	Front: SaltSize + socks5.IPv6AddrLen,
+	Rear:  TagSize,
+}
+
+// sealPacket writes a random salt to the start of the packet,
+// and seals the rest of the packet in-place, except the room for the tag at the end.
+func sealPacket(cipherConfig *CipherConfig, packet []byte) error {
+	salt := packet[:SaltSize]
+	plaintext := packet[SaltSize : len(packet)-TagSize]
+
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	aead, err := cipherConfig.AEAD(salt)
+	if err != nil {
+		return err
+	}
+
+	aead.Seal(plaintext[:0], zeroNonce[:], plaintext, nil)
+	return nil
+}
+
+// openPacket opens the packet in-place, and returns the plaintext.
+func openPacket(cipherConfig *CipherConfig, packet []byte) ([]byte, error) {
+	if len(packet) < SaltSize+TagSize {
+		return nil, fmt.Errorf("%w: %d", zerocopy.ErrPacketTooSmall, len(packet))
+	}
+
+	aead, err := cipherConfig.AEAD(packet[:SaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := packet[SaltSize:]
+	return aead.Open(ciphertext[:0], zeroNonce[:], ciphertext, nil)
+}
+
+// ShadowPacketClientPacker packs UDP packets into authenticated and encrypted
+// Shadowsocks AEAD packets.
+//
+// ShadowPacketClientPacker implements the zerocopy.ClientPacker interface.
+//
+// Packet format:
+//
+//	+------+-----------------------------------+
+//	| salt | encrypted target address and body |
+//	+------+-----------------------------------+
+//	| 32B  |     variable length + 16B tag     |
+//	+------+-----------------------------------+
+type ShadowPacketClientPacker struct {
+	// cipherConfig is the client's cipher configuration.
+	cipherConfig *CipherConfig
+
+	// serverAddrPort is the Shadowsocks server's IP and port.
+	serverAddrPort netip.AddrPort
+
+	// maxPacketSize is the maximum allowed size of a packed packet.
+	// The value is calculated from MTU and server address family.
+	maxPacketSize int
+}
+
+// ClientPackerInfo implements the zerocopy.ClientPacker ClientPackerInfo method.
+func (p *ShadowPacketClientPacker) ClientPackerInfo() zerocopy.ClientPackerInfo {
+	return zerocopy.ClientPackerInfo{
+		Headroom: ShadowPacketClientMessageHeadroom,
+	}
+}
+
+// PackInPlace implements the zerocopy.ClientPacker PackInPlace method.
+func (p *ShadowPacketClientPacker) PackInPlace(ctx context.Context, b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	targetAddrLen := socks5.LengthOfAddrFromConnAddr(targetAddr)
+	destAddrPort = p.serverAddrPort
+	packetStart = payloadStart - targetAddrLen - SaltSize
+	packetLen = SaltSize + targetAddrLen + payloadLen + TagSize
+	if packetLen > p.maxPacketSize {
+		err = zerocopy.ErrPayloadTooBig
+		return
+	}
+	socks5.WriteAddrFromConnAddr(b[packetStart+SaltSize:], targetAddr)
+	err = sealPacket(p.cipherConfig, b[packetStart:packetStart+packetLen])
+	return
+}
+
+// ShadowPacketClientUnpacker unpacks Shadowsocks AEAD server packets and returns
+// target address and plaintext payload.
+//
+// ShadowPacketClientUnpacker implements the zerocopy.ClientUnpacker interface.
+type ShadowPacketClientUnpacker struct {
+	// cipherConfig is the client's cipher configuration.
+	cipherConfig *CipherConfig
+
+	// serverAddrPort is the Shadowsocks server's IP and port.
+	serverAddrPort netip.AddrPort
+}
+
+// ClientUnpackerInfo implements the zerocopy.ClientUnpacker ClientUnpackerInfo method.
+func (p *ShadowPacketClientUnpacker) ClientUnpackerInfo() zerocopy.ClientUnpackerInfo {
+	return zerocopy.ClientUnpackerInfo{
+		Headroom: ShadowPacketServerMessageHeadroom,
+	}
+}
+
+// UnpackInPlace implements the zerocopy.ClientUnpacker UnpackInPlace method.
+func (p *ShadowPacketClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	if !conn.AddrPortMappedEqual(packetSourceAddrPort, p.serverAddrPort) {
+		err = fmt.Errorf("dropped packet from non-server source %s", packetSourceAddrPort)
+		return
+	}
+
+	plaintext, err := openPacket(p.cipherConfig, b[packetStart:packetStart+packetLen])
+	if err != nil {
+		return
+	}
+
+	payloadSourceAddrPort, payloadSourceAddrLen, err := socks5.AddrPortFromSlice(plaintext)
+	if err != nil {
+		return
+	}
+
+	payloadStart = packetStart + SaltSize + payloadSourceAddrLen
+	payloadLen = len(plaintext) - payloadSourceAddrLen
+	return
+}
+
+// ShadowPacketServerPacker packs UDP packets into authenticated and encrypted
+// Shadowsocks AEAD packets.
+//
+// ShadowPacketServerPacker implements the zerocopy.ServerPacker interface.
+type ShadowPacketServerPacker struct {
+	// cipherConfig is the server's cipher configuration.
+	cipherConfig *CipherConfig
+}
+
+// ServerPackerInfo implements the zerocopy.ServerPacker ServerPackerInfo method.
+func (p *ShadowPacketServerPacker) ServerPackerInfo() zerocopy.ServerPackerInfo {
+	return zerocopy.ServerPackerInfo{
+		Headroom: ShadowPacketServerMessageHeadroom,
+	}
+}
+
+// PackInPlace implements the zerocopy.ServerPacker PackInPlace method.
+func (p *ShadowPacketServerPacker) PackInPlace(b []byte, sourceAddrPort netip.AddrPort, payloadStart, payloadLen, maxPacketLen int) (packetStart, packetLen int, err error) {
+	sourceAddrLen := socks5.LengthOfAddrFromAddrPort(sourceAddrPort)
+	packetStart = payloadStart - sourceAddrLen - SaltSize
+	packetLen = SaltSize + sourceAddrLen + payloadLen + TagSize
+	if packetLen > maxPacketLen {
+		err = zerocopy.ErrPayloadTooBig
+		return
+	}
+	socks5.WriteAddrFromAddrPort(b[packetStart+SaltSize:], sourceAddrPort)
+	err = sealPacket(p.cipherConfig, b[packetStart:packetStart+packetLen])
+	return
+}
+
+// ShadowPacketServerUnpacker unpacks Shadowsocks AEAD client packets and returns
+// target address and plaintext payload.
+//
+// ShadowPacketServerUnpacker implements the zerocopy.ServerUnpacker interface.
+type ShadowPacketServerUnpacker struct {
+	// cipherConfig is the server's cipher configuration.
+	cipherConfig *CipherConfig
+
+	// cachedDomain caches the last used domain target to avoid allocating new strings.
+	cachedDomain string
+}
+
+// ServerUnpackerInfo implements the zerocopy.ServerUnpacker ServerUnpackerInfo method.
+func (p *ShadowPacketServerUnpacker) ServerUnpackerInfo() zerocopy.ServerUnpackerInfo {
+	return zerocopy.ServerUnpackerInfo{
+		Headroom: ShadowPacketClientMessageHeadroom,
+	}
+}
+
+// UnpackInPlace implements the zerocopy.ServerUnpacker UnpackInPlace method.
+func (p *ShadowPacketServerUnpacker) UnpackInPlace(b []byte, sourceAddrPort netip.AddrPort, packetStart, packetLen int) (targetAddr conn.Addr, payloadStart, payloadLen int, err error) {
+	plaintext, err := openPacket(p.cipherConfig, b[packetStart:packetStart+packetLen])
+	if err != nil {
+		return
+	}
+
+	var targetAddrLen int
+	targetAddr, targetAddrLen, p.cachedDomain, err = socks5.ConnAddrFromSliceWithDomainCache(plaintext, p.cachedDomain)
+	if err != nil {
+		return
+	}
+
+	payloadStart = packetStart + SaltSize + targetAddrLen
+	payloadLen = len(plaintext) - targetAddrLen
+	return
+}
+
+// NewPacker implements the zerocopy.ServerUnpacker NewPacker method.
+func (p *ShadowPacketServerUnpacker) NewPacker() (zerocopy.ServerPacker, error) {
+	return &ShadowPacketServerPacker{
+		cipherConfig: p.cipherConfig,
+	}, nil
+}
@@ -0,0 +1,274 @@
+package ssaead
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// MaxPayloadSize is the maximum size of a payload chunk.
+// The upper 2 bits of the length are reserved and must be zero.
+const MaxPayloadSize = 0x3FFF
+
+// ShadowStreamHeadroom is the headroom required by an encrypted Shadowsocks AEAD stream.
+//
+// Front is the size of an encrypted length chunk.
+// Rear is the size of an AEAD tag.
+var ShadowStreamHeadroom = zerocopy.Headroom{
+	Front: 2 + TagSize,
+	Rear:  TagSize,
+}
+
+// ShadowStreamReaderInfo contains information about a [ShadowStreamReader].
+var ShadowStreamReaderInfo = zerocopy.ReaderInfo{
+	Headroom:                    ShadowStreamHeadroom,
+	MinPayloadBufferSizePerRead: MaxPayloadSize,
+}
+
+// ShadowStreamWriterInfo contains information about a [ShadowStreamWriter].
+var ShadowStreamWriterInfo = zerocopy.WriterInfo{
+	Headroom:               ShadowStreamHeadroom,
+	MaxPayloadSizePerWrite: MaxPayloadSize,
+}
+
+var (
+	ErrZeroLengthChunk = errors.New("length in length chunk is zero")
+	ErrRepeatedSalt    = errors.New("detected replay: repeated salt")
+)
+
+// ChunkLengthError is returned when the length in a length chunk exceeds [MaxPayloadSize].
+type ChunkLengthError int
+
+func (e ChunkLengthError) Error() string {
+	return fmt.Sprintf("length in length chunk %d exceeds maximum %d", int(e), MaxPayloadSize)
+}
+
+// ShadowStreamServerReadWriter implements Shadowsocks AEAD stream server.
+type ShadowStreamServerReadWriter struct {
+	*ShadowStreamReader
+	*ShadowStreamWriter
+	rawRW        zerocopy.DirectReadWriteCloser
+	cipherConfig *CipherConfig
+}
+
+// WriteZeroCopy implements the Writer WriteZeroCopy method.
+func (rw *ShadowStreamServerReadWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (int, error) {
+	if rw.ShadowStreamWriter == nil { // first write
+		payloadBufStart := SaltSize + ShadowStreamHeadroom.Front
+		hb := make([]byte, payloadBufStart+payloadLen+ShadowStreamHeadroom.Rear)
+		salt := hb[:SaltSize]
+
+		// Random salt.
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+
+		// Create AEAD cipher.
+		aead, err := rw.cipherConfig.AEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+
+		// Create writer.
+		rw.ShadowStreamWriter = &ShadowStreamWriter{
+			writer: rw.rawRW,
+			ssc:    ss2022.NewShadowStreamCipher(aead),
+		}
+
+		// Seal payload after salt.
+		copy(hb[payloadBufStart:], b[payloadStart:payloadStart+payloadLen])
+		rw.ShadowStreamWriter.sealChunks(hb, payloadBufStart, payloadLen)
+
+		// Write out.
+		if _, err = rw.rawRW.Write(hb); err != nil {
+			return 0, err
+		}
+
+		return payloadLen, nil
+	}
+
+	return rw.ShadowStreamWriter.WriteZeroCopy(b, payloadStart, payloadLen)
+}
+
+// CloseRead implements the ReadWriter CloseRead method.
+func (rw *ShadowStreamServerReadWriter) CloseRead() error {
+	return rw.rawRW.CloseRead()
+}
+
+// CloseWrite implements the ReadWriter CloseWrite method.
+func (rw *ShadowStreamServerReadWriter) CloseWrite() error {
+	return rw.rawRW.CloseWrite()
+}
+
+// Close implements the ReadWriter Close method.
+func (rw *ShadowStreamServerReadWriter) Close() error {
+	return rw.rawRW.Close()
+}
+
+// ShadowStreamClientReadWriter implements Shadowsocks AEAD stream client.
+type ShadowStreamClientReadWriter struct {
+	*ShadowStreamReader
+	*ShadowStreamWriter
+	rawRW        zerocopy.DirectReadWriteCloser
+	cipherConfig *CipherConfig
+}
+
+// ReadZeroCopy implements the Reader ReadZeroCopy method.
+func (rw *ShadowStreamClientReadWriter) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (int, error) {
+	if rw.ShadowStreamReader == nil { // first read
+		salt := make([]byte, SaltSize)
+
+		// Read salt.
+		if _, err := io.ReadFull(rw.rawRW, salt); err != nil {
+			return 0, err
+		}
+
+		// Derive key and create cipher.
+		aead, err := rw.cipherConfig.AEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+
+		// Create reader.
+		rw.ShadowStreamReader = &ShadowStreamReader{
+			reader: rw.rawRW,
+			ssc:    ss2022.NewShadowStreamCipher(aead),
+		}
+	}
+
+	return rw.ShadowStreamReader.ReadZeroCopy(b, payloadBufStart, payloadBufLen)
+}
+
+// CloseRead implements the ReadWriter CloseRead method.
+func (rw *ShadowStreamClientReadWriter) CloseRead() error {
+	return rw.rawRW.CloseRead()
+}
+
+// CloseWrite implements the ReadWriter CloseWrite method.
+func (rw *ShadowStreamClientReadWriter) CloseWrite() error {
+	return rw.rawRW.CloseWrite()
+}
+
+// Close implements the ReadWriter Close method.
+func (rw *ShadowStreamClientReadWriter) Close() error {
+	return rw.rawRW.Close()
+}
+
+// ShadowStreamWriter wraps an io.WriteCloser and feeds an encrypted Shadowsocks AEAD stream to it.
+//
+// Wire format:
+//
+//	+------------------------+---------------------------+
+//	| encrypted length chunk |  encrypted payload chunk  |
+//	+------------------------+---------------------------+
+//	|  2B length + 16B tag   | variable length + 16B tag |
+//	+------------------------+---------------------------+
+type ShadowStreamWriter struct {
+	writer io.WriteCloser
+	ssc    *ss2022.ShadowStreamCipher
+}
+
+// WriterInfo implements the Writer WriterInfo method.
+func (w *ShadowStreamWriter) WriterInfo() zerocopy.WriterInfo {
+	return ShadowStreamWriterInfo
+}
+
+// WriteZeroCopy implements the Writer WriteZeroCopy method.
+func (w *ShadowStreamWriter) WriteZeroCopy(b []byte, payloadStart, payloadLen int) (payloadWritten int, err error) {
+	chunksBuf := w.sealChunks(b, payloadStart, payloadLen)
+
+	// Write to wrapped writer.
+	_, err = w.writer.Write(chunksBuf)
+	if err != nil {
+		return
+	}
+	payloadWritten = payloadLen
+	return
+}
+
+// sealChunks seals the payload and its length in-place, and returns the sealed chunks.
+func (w *ShadowStreamWriter) sealChunks(b []byte, payloadStart, payloadLen int) []byte {
+	overhead := w.ssc.Overhead()
+	lengthStart := payloadStart - overhead - 2
+	lengthBuf := b[lengthStart : lengthStart+2]
+	payloadBuf := b[payloadStart : payloadStart+payloadLen]
+	payloadTagEnd := payloadStart + payloadLen + overhead
+
+	// Write length.
+	binary.BigEndian.PutUint16(lengthBuf, uint16(payloadLen))
+
+	// Seal length chunk.
+	w.ssc.EncryptInPlace(lengthBuf)
+
+	// Seal payload chunk.
+	w.ssc.EncryptInPlace(payloadBuf)
+
+	return b[lengthStart:payloadTagEnd]
+}
+
+// ShadowStreamReader wraps an io.ReadCloser and reads from it as an encrypted Shadowsocks AEAD stream.
+type ShadowStreamReader struct {
+	reader io.ReadCloser
+	ssc    *ss2022.ShadowStreamCipher
+}
+
+// ReaderInfo implements the Reader ReaderInfo method.
+func (r *ShadowStreamReader) ReaderInfo() zerocopy.ReaderInfo {
+	return ShadowStreamReaderInfo
+}
+
+// ReadZeroCopy implements the Reader ReadZeroCopy method.
+func (r *ShadowStreamReader) ReadZeroCopy(b []byte, payloadBufStart, payloadBufLen int) (payloadLen int, err error) {
+	overhead := r.ssc.Overhead()
+	sealedLengthChunkStart := payloadBufStart - overhead - 2
+	sealedLengthChunkBuf := b[sealedLengthChunkStart:payloadBufStart]
+
+	// Read sealed length chunk.
+	_, err = io.ReadFull(r.reader, sealedLengthChunkBuf)
+	if err != nil {
+		return
+	}
+
+	// Open sealed length chunk.
+	payloadLen, err = r.openLengthChunk(sealedLengthChunkBuf)
+	if err != nil {
+		return
+	}
+
+	// Read sealed payload chunk.
+	sealedPayloadChunkBuf := b[payloadBufStart : payloadBufStart+payloadLen+overhead]
+	_, err = io.ReadFull(r.reader, sealedPayloadChunkBuf)
+	if err != nil {
+		payloadLen = 0
+		return
+	}
+
+	// Open sealed payload chunk.
+	_, err = r.ssc.DecryptInPlace(sealedPayloadChunkBuf)
+	if err != nil {
+		payloadLen = 0
+	}
+
+	return
+}
+
+// openLengthChunk opens the sealed length chunk in-place and returns the validated payload length.
+func (r *ShadowStreamReader) openLengthChunk(sealedLengthChunkBuf []byte) (int, error) {
+	if _, err := r.ssc.DecryptInPlace(sealedLengthChunkBuf); err != nil {
+		return 0, err
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(sealedLengthChunkBuf))
+	switch {
+	case payloadLen == 0:
+		return 0, ErrZeroLengthChunk
+	case payloadLen > MaxPayloadSize:
+		return 0, ChunkLengthError(payloadLen)
+	}
+	return payloadLen, nil
+}
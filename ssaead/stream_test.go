@@ -0,0 +1,207 @@
+package ssaead
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/pipe"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+var methods = [...]string{"aes-256-gcm", "chacha20-ietf-poly1305"}
+
+func testShadowStreamReadWriter(t *testing.T, ctx context.Context, cipherConfig *CipherConfig, clientInitialPayload []byte) {
+	pl, pr := pipe.NewDuplexPipe()
+	plo := zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl}
+	clientTargetAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53))
+	c := TCPClient{
+		rwo:          &plo,
+		cipherConfig: cipherConfig,
+	}
+	s := NewTCPServer(cipherConfig)
+
+	var (
+		crw                  zerocopy.ReadWriter
+		srw                  zerocopy.ReadWriter
+		serverTargetAddr     conn.Addr
+		serverInitialPayload []byte
+		cerr, serr           error
+	)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		_, crw, cerr = c.Dial(ctx, clientTargetAddr, clientInitialPayload)
+		wg.Done()
+	}()
+
+	go func() {
+		srw, serverTargetAddr, serverInitialPayload, _, serr = s.Accept(pr)
+		if serr == nil && len(serverInitialPayload) < len(clientInitialPayload) {
+			// Read excess payload.
+			b := make([]byte, len(clientInitialPayload))
+			copy(b, serverInitialPayload)
+			scrw := zerocopy.NewCopyReadWriter(srw)
+			_, serr = io.ReadFull(scrw, b[len(serverInitialPayload):])
+			serverInitialPayload = b
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+
+	if !clientTargetAddr.Equals(serverTargetAddr) {
+		t.Errorf("Target address mismatch: c: %s, s: %s", clientTargetAddr, serverTargetAddr)
+	}
+	if !bytes.Equal(clientInitialPayload, serverInitialPayload) {
+		t.Errorf("Initial payload mismatch: c: %v, s: %v", clientInitialPayload, serverInitialPayload)
+	}
+
+	zerocopy.ReadWriterTestFunc(t, crw, srw)
+}
+
+func testShadowStreamReadWriterReplay(t *testing.T, ctx context.Context, cipherConfig *CipherConfig) {
+	pl, pr := pipe.NewDuplexPipe()
+	plo := zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl}
+	clientTargetAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53))
+	c := TCPClient{
+		rwo:          &plo,
+		cipherConfig: cipherConfig,
+	}
+	s := NewTCPServer(cipherConfig)
+
+	var (
+		wg   sync.WaitGroup
+		cerr error
+	)
+
+	// Start client.
+	wg.Add(1)
+	go func() {
+		_, _, cerr = c.Dial(ctx, clientTargetAddr, []byte("hello"))
+		wg.Done()
+	}()
+
+	// Hijack client request and save it in b.
+	b := make([]byte, 1440)
+	n, err := pr.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendFunc := func() {
+		_, err = pl.Write(b[:n])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Ensure client success.
+	wg.Wait()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	// Actually send the request.
+	go sendFunc()
+
+	// Start server.
+	_, _, _, _, serr := s.Accept(pr)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+
+	// Send it again.
+	go sendFunc()
+
+	// Start server from replay.
+	_, _, payload, _, serr := s.Accept(pr)
+	if serr != ErrRepeatedSalt {
+		t.Errorf("Expected ErrRepeatedSalt, got %v", serr)
+	}
+	if !bytes.Equal(payload, b[:len(payload)]) {
+		t.Error("Payload of rejected request does not match the data read")
+	}
+}
+
+func TestShadowStreamReadWriter(t *testing.T) {
+	ctx := context.Background()
+	smallInitialPayload := make([]byte, 1024)
+	largeInitialPayload := make([]byte, 128*1024)
+
+	if _, err := rand.Read(smallInitialPayload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rand.Read(largeInitialPayload); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			cipherConfig, err := NewCipherConfig(method, "correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("NoInitialPayload", func(t *testing.T) {
+				testShadowStreamReadWriter(t, ctx, cipherConfig, nil)
+			})
+			t.Run("SmallInitialPayload", func(t *testing.T) {
+				testShadowStreamReadWriter(t, ctx, cipherConfig, smallInitialPayload)
+			})
+			t.Run("LargeInitialPayload", func(t *testing.T) {
+				testShadowStreamReadWriter(t, ctx, cipherConfig, largeInitialPayload)
+			})
+			t.Run("Replay", func(t *testing.T) {
+				testShadowStreamReadWriterReplay(t, ctx, cipherConfig)
+			})
+		})
+	}
+}
+
+func TestShadowStreamWrongPassword(t *testing.T) {
+	clientCipherConfig, err := NewCipherConfig("aes-256-gcm", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCipherConfig, err := NewCipherConfig("aes-256-gcm", "incorrect horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl, pr := pipe.NewDuplexPipe()
+	defer pl.Close()
+	defer pr.Close()
+
+	c := TCPClient{
+		rwo:          &zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl},
+		cipherConfig: clientCipherConfig,
+	}
+	s := NewTCPServer(serverCipherConfig)
+
+	go c.Dial(context.Background(), conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53)), nil)
+
+	_, _, payload, _, err := s.Accept(pr)
+	if err == nil {
+		t.Fatal("Accept() succeeded with wrong password")
+	}
+	if errors.Is(err, ErrRepeatedSalt) {
+		t.Errorf("Accept() returned %v, expected authentication failure", err)
+	}
+	if len(payload) != SaltSize+ShadowStreamHeadroom.Front {
+		t.Errorf("len(payload) = %d, expected %d", len(payload), SaltSize+ShadowStreamHeadroom.Front)
+	}
+}
@@ -0,0 +1,206 @@
+package ssaead
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/socks5"
+	"github.com/database64128/shadowsocks-go/ss2022"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// SaltRetention is the minimum duration for which the server remembers the salts of accepted streams.
+//
+// Unlike Shadowsocks 2022, the protocol has no timestamp, so a replay is only detected
+// when the salt is still remembered.
+const SaltRetention = 5 * time.Minute
+
+// TCPClient implements the zerocopy TCPClient interface.
+type TCPClient struct {
+	name         string
+	rwo          zerocopy.DirectReadWriteCloserOpener
+	cipherConfig *CipherConfig
+}
+
+// NewTCPClient returns a new legacy Shadowsocks AEAD TCP client that opens connections to the server with rwo.
+func NewTCPClient(name string, rwo zerocopy.DirectReadWriteCloserOpener, cipherConfig *CipherConfig) *TCPClient {
+	return &TCPClient{
+		name:         name,
+		rwo:          rwo,
+		cipherConfig: cipherConfig,
+	}
+}
+
+// Info implements the zerocopy.TCPClient Info method.
+func (c *TCPClient) Info() zerocopy.TCPClientInfo {
+	return zerocopy.TCPClientInfo{
+		Name:                 c.name,
+		NativeInitialPayload: true,
+	}
+}
+
+// Dial implements the zerocopy.TCPClient Dial method.
+func (c *TCPClient) Dial(ctx context.Context, targetAddr conn.Addr, payload []byte) (rawRW zerocopy.DirectReadWriteCloser, rw zerocopy.ReadWriter, err error) {
+	// The target address and as much of the payload as fits go in the first chunk.
+	targetAddrLen := socks5.LengthOfAddrFromConnAddr(targetAddr)
+	firstChunkLen := min(targetAddrLen+len(payload), MaxPayloadSize)
+	excessPayload := payload[firstChunkLen-targetAddrLen:]
+	payload = payload[:firstChunkLen-targetAddrLen]
+
+	payloadBufStart := SaltSize + ShadowStreamHeadroom.Front
+	b := make([]byte, payloadBufStart+firstChunkLen+ShadowStreamHeadroom.Rear)
+	salt := b[:SaltSize]
+	firstChunkBuf := b[payloadBufStart : payloadBufStart+firstChunkLen]
+
+	// Random salt.
+	_, err = rand.Read(salt)
+	if err != nil {
+		return
+	}
+
+	// Create AEAD cipher.
+	aead, err := c.cipherConfig.AEAD(salt)
+	if err != nil {
+		return
+	}
+
+	w := ShadowStreamWriter{
+		ssc: ss2022.NewShadowStreamCipher(aead),
+	}
+
+	// Write and seal the first chunk.
+	socks5.WriteAddrFromConnAddr(firstChunkBuf, targetAddr)
+	copy(firstChunkBuf[targetAddrLen:], payload)
+	w.sealChunks(b, payloadBufStart, firstChunkLen)
+
+	// Write out.
+	rawRW, err = c.rwo.Open(ctx, b)
+	if err != nil {
+		return
+	}
+	w.writer = rawRW
+
+	// Write excess payload, reusing the first chunk buffer.
+	// Excess payload only exists when the first chunk is full.
+	for len(excessPayload) > 0 {
+		n := copy(firstChunkBuf, excessPayload)
+		excessPayload = excessPayload[n:]
+		if _, err = w.WriteZeroCopy(b, payloadBufStart, n); err != nil {
+			rawRW.Close()
+			return
+		}
+	}
+
+	rw = &ShadowStreamClientReadWriter{
+		ShadowStreamWriter: &w,
+		rawRW:              rawRW,
+		cipherConfig:       c.cipherConfig,
+	}
+
+	return
+}
+
+// TCPServer implements the zerocopy TCPServer interface.
+type TCPServer struct {
+	mu           sync.Mutex
+	saltPool     *ss2022.SaltPool[string]
+	cipherConfig *CipherConfig
+}
+
+func NewTCPServer(cipherConfig *CipherConfig) *TCPServer {
+	return &TCPServer{
+		saltPool:     ss2022.NewSaltPool[string](SaltRetention),
+		cipherConfig: cipherConfig,
+	}
+}
+
+// Info implements the zerocopy.TCPServer Info method.
+func (s *TCPServer) Info() zerocopy.TCPServerInfo {
+	return zerocopy.TCPServerInfo{
+		NativeInitialPayload: true,
+		DefaultTCPConnCloser: zerocopy.ReplyWithGibberish,
+	}
+}
+
+// Accept implements the zerocopy.TCPServer Accept method.
+func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
+	b := make([]byte, SaltSize+ShadowStreamHeadroom.Front)
+
+	// Read salt and sealed length chunk.
+	// Some clients write the salt separately, so it may take more than one read.
+	n, err := io.ReadFull(rawRW, b)
+	if err != nil {
+		payload = b[:n]
+		return
+	}
+
+	salt := b[:SaltSize]
+
+	// Derive key and create cipher.
+	aead, err := s.cipherConfig.AEAD(salt)
+	if err != nil {
+		return
+	}
+
+	r := ShadowStreamReader{
+		reader: rawRW,
+		ssc:    ss2022.NewShadowStreamCipher(aead),
+	}
+
+	s.mu.Lock()
+
+	// Check but not add request salt to pool.
+	if !s.saltPool.Check(string(salt)) {
+		s.mu.Unlock()
+		payload = b[:n]
+		err = ErrRepeatedSalt
+		return
+	}
+
+	// Open sealed length chunk.
+	sealedLengthChunkBuf := make([]byte, ShadowStreamHeadroom.Front)
+	copy(sealedLengthChunkBuf, b[SaltSize:])
+	payloadLen, err := r.openLengthChunk(sealedLengthChunkBuf)
+	if err != nil {
+		s.mu.Unlock()
+		payload = b[:n]
+		return
+	}
+
+	// Add request salt to pool.
+	s.saltPool.Add(string(salt))
+
+	s.mu.Unlock()
+
+	b = make([]byte, payloadLen+TagSize)
+
+	// Read sealed payload chunk.
+	_, err = io.ReadFull(rawRW, b)
+	if err != nil {
+		return
+	}
+
+	// AEAD open.
+	plaintext, err := r.ssc.DecryptInPlace(b)
+	if err != nil {
+		return
+	}
+
+	// Parse target address.
+	targetAddr, targetAddrLen, err := socks5.ConnAddrFromSlice(plaintext)
+	if err != nil {
+		return
+	}
+	payload = plaintext[targetAddrLen:]
+
+	rw = &ShadowStreamServerReadWriter{
+		ShadowStreamReader: &r,
+		rawRW:              rawRW,
+		cipherConfig:       s.cipherConfig,
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package ssaead
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// UDPClient implements the zerocopy UDPClient interface.
+type UDPClient struct {
+	network      string
+	addr         conn.Addr
+	info         zerocopy.UDPClientInfo
+	cipherConfig *CipherConfig
+}
+
+func NewUDPClient(name, network string, addr conn.Addr, mtu int, listenConfig conn.ListenConfig, cipherConfig *CipherConfig) *UDPClient {
+	return &UDPClient{
+		network: network,
+		addr:    addr,
+		info: zerocopy.UDPClientInfo{
+			Name:           name,
+			PackerHeadroom: ShadowPacketClientMessageHeadroom,
+			MTU:            mtu,
+			ListenConfig:   listenConfig,
+		},
+		cipherConfig: cipherConfig,
+	}
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *UDPClient) Info() zerocopy.UDPClientInfo {
+	return c.info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *UDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	addrPort, err := c.addr.ResolveIPPort(ctx, c.network)
+	if err != nil {
+		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to resolve endpoint address: %w", err)
+	}
+	maxPacketSize := zerocopy.MaxPacketSizeForAddr(c.info.MTU, addrPort.Addr())
+
+	return c.info, zerocopy.UDPClientSession{
+		MaxPacketSize: maxPacketSize,
+		Packer: &ShadowPacketClientPacker{
+			cipherConfig:   c.cipherConfig,
+			serverAddrPort: addrPort,
+			maxPacketSize:  maxPacketSize,
+		},
+		Unpacker: &ShadowPacketClientUnpacker{
+			cipherConfig:   c.cipherConfig,
+			serverAddrPort: addrPort,
+		},
+		Close: zerocopy.NoopClose,
+	}, nil
+}
+
+// UDPNATServer implements the zerocopy UDPNATServer interface.
+//
+// The protocol has no session ID, so sessions are identified by client address.
+type UDPNATServer struct {
+	cipherConfig *CipherConfig
+}
+
+func NewUDPNATServer(cipherConfig *CipherConfig) *UDPNATServer {
+	return &UDPNATServer{
+		cipherConfig: cipherConfig,
+	}
+}
+
+// Info implements the zerocopy.UDPNATServer Info method.
+func (s *UDPNATServer) Info() zerocopy.UDPNATServerInfo {
+	return zerocopy.UDPNATServerInfo{
+		UnpackerHeadroom: ShadowPacketClientMessageHeadroom,
+	}
+}
+
+// NewUnpacker implements the zerocopy.UDPNATServer NewUnpacker method.
+func (s *UDPNATServer) NewUnpacker() (zerocopy.ServerUnpacker, error) {
+	return &ShadowPacketServerUnpacker{
+		cipherConfig: s.cipherConfig,
+	}, nil
+}
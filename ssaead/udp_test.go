@@ -0,0 +1,88 @@
+package ssaead
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+const (
+	name       = "test"
+	mtu        = 1500
+	packetSize = 1452
+)
+
+var serverAddrPort = netip.AddrPortFrom(netip.IPv6Unspecified(), 1080)
+
+func TestUDPClientServer(t *testing.T) {
+	ctx := context.Background()
+
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			cipherConfig, err := NewCipherConfig(method, "correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewUDPClient(name, "ip", conn.AddrFromIPPort(serverAddrPort), mtu, conn.DefaultUDPClientListenConfig, cipherConfig)
+			s := NewUDPNATServer(cipherConfig)
+
+			_, clientSession, err := c.NewSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientSession.Close()
+
+			if clientSession.MaxPacketSize != packetSize {
+				t.Errorf("Fixed MTU mismatch: in: %d, out: %d", mtu, clientSession.MaxPacketSize)
+			}
+
+			serverUnpacker, err := s.NewUnpacker()
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverPacker, err := serverUnpacker.NewPacker()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			zerocopy.ClientServerPackerUnpackerTestFunc(t, clientSession.Packer, clientSession.Unpacker, serverPacker, serverUnpacker)
+		})
+	}
+}
+
+func TestUDPWrongPassword(t *testing.T) {
+	clientCipherConfig, err := NewCipherConfig("chacha20-ietf-poly1305", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCipherConfig, err := NewCipherConfig("chacha20-ietf-poly1305", "incorrect horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ShadowPacketClientPacker{
+		cipherConfig:   clientCipherConfig,
+		serverAddrPort: serverAddrPort,
+		maxPacketSize:  packetSize,
+	}
+	u := ShadowPacketServerUnpacker{
+		cipherConfig: serverCipherConfig,
+	}
+
+	headroom := ShadowPacketClientMessageHeadroom
+	b := make([]byte, headroom.Front+64+headroom.Rear)
+	targetAddr := conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 53))
+
+	_, packetStart, packetLen, err := p.PackInPlace(context.Background(), b, targetAddr, headroom.Front, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err = u.UnpackInPlace(b, netip.AddrPort{}, packetStart, packetLen); err == nil {
+		t.Error("UnpackInPlace() succeeded with wrong password")
+	}
+}
@@ -0,0 +1,159 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/jsonhelper"
+	"go.uber.org/zap"
+)
+
+// DefaultCheckpointInterval is the default interval between checkpoints of traffic statistics.
+const DefaultCheckpointInterval = 5 * time.Minute
+
+// Checkpointer periodically saves a server's traffic statistics to a file,
+// so that they survive restarts and crashes.
+//
+// Checkpointer implements the service.Relay interface.
+type Checkpointer struct {
+	serverName string
+	path       string
+	interval   time.Duration
+	collector  Collector
+	logger     *zap.Logger
+	wg         sync.WaitGroup
+}
+
+// Checkpointer returns a new checkpointer for the server's collector.
+// It returns nil if checkpointing is not enabled.
+//
+// Statistics saved by a previous checkpointer of the server are restored into the collector.
+func (c Config) Checkpointer(serverName string, collector Collector, logger *zap.Logger) (*Checkpointer, error) {
+	if !c.Enabled || c.StateDir == "" {
+		return nil, nil
+	}
+
+	interval := c.CheckpointInterval.Value()
+	switch {
+	case interval == 0:
+		interval = DefaultCheckpointInterval
+	case interval < 0:
+		return nil, fmt.Errorf("negative checkpoint interval: %s", interval)
+	}
+
+	cp := &Checkpointer{
+		serverName: serverName,
+		path:       filepath.Join(c.StateDir, serverName+".json"),
+		interval:   interval,
+		collector:  collector,
+		logger:     logger,
+	}
+
+	if err := cp.restore(); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// restore loads the saved statistics into the collector.
+// A missing state file is not an error.
+func (cp *Checkpointer) restore() error {
+	var s Server
+	if err := jsonhelper.OpenAndDecodeDisallowUnknownFields(cp.path, &s); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to load traffic statistics: %w", err)
+	}
+	cp.collector.Restore(s)
+
+	cp.logger.Info("Restored traffic statistics",
+		zap.String("server", cp.serverName),
+		zap.String("path", cp.path),
+		zap.Int("users", len(s.Users)),
+	)
+	return nil
+}
+
+// save writes the collector's current statistics to the state file.
+// The file is replaced atomically, so a crash during the save leaves the previous checkpoint intact.
+func (cp *Checkpointer) save() error {
+	b, err := json.MarshalIndent(cp.collector.Snapshot(), "", "    ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(cp.path), filepath.Base(cp.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, cp.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// String implements the service.Relay String method.
+func (cp *Checkpointer) String() string {
+	return "traffic statistics checkpointer for " + cp.serverName
+}
+
+// Start implements the service.Relay Start method.
+func (cp *Checkpointer) Start(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(cp.path), 0755); err != nil {
+		return err
+	}
+
+	cp.wg.Add(1)
+	go func() {
+		cp.run(ctx)
+		cp.wg.Done()
+	}()
+	return nil
+}
+
+func (cp *Checkpointer) run(ctx context.Context) {
+	ticker := time.NewTicker(cp.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := cp.save(); err != nil {
+				cp.logger.Warn("Failed to save traffic statistics",
+					zap.String("server", cp.serverName),
+					zap.String("path", cp.path),
+					zap.Error(err),
+				)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop implements the service.Relay Stop method.
+// It saves a final checkpoint after the periodic checkpoints stop.
+func (cp *Checkpointer) Stop() error {
+	cp.wg.Wait()
+	return cp.save()
+}
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func checkpointRoundTrip(t *testing.T, collectFunc func(*testing.T, Collector), verifyFunc func(*testing.T, Server)) {
+	t.Helper()
+	logger := zaptest.NewLogger(t)
+	cfg := Config{
+		Enabled:  true,
+		StateDir: t.TempDir(),
+	}
+
+	c := cfg.Collector()
+	cp, err := cfg.Checkpointer("test", c, logger)
+	if err != nil {
+		t.Fatalf("cfg.Checkpointer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = cp.Start(ctx); err != nil {
+		t.Fatalf("cp.Start failed: %v", err)
+	}
+	collectFunc(t, c)
+	cancel()
+	if err = cp.Stop(); err != nil {
+		t.Fatalf("cp.Stop failed: %v", err)
+	}
+
+	restored := cfg.Collector()
+	if _, err = cfg.Checkpointer("test", restored, logger); err != nil {
+		t.Fatalf("cfg.Checkpointer failed to restore: %v", err)
+	}
+	verifyFunc(t, restored.Snapshot())
+}
+
+func TestCheckpointer(t *testing.T) {
+	checkpointRoundTrip(t, collect, verify)
+	checkpointRoundTrip(t, collectNoUsername, verifyNoUsername)
+}
+
+func TestCheckpointerDisabled(t *testing.T) {
+	for _, cfg := range []Config{
+		{StateDir: t.TempDir()},
+		{Enabled: true},
+	} {
+		cp, err := cfg.Checkpointer("test", cfg.Collector(), zaptest.NewLogger(t))
+		if err != nil {
+			t.Fatalf("cfg.Checkpointer failed: %v", err)
+		}
+		if cp != nil {
+			t.Errorf("cfg.Checkpointer returned non-nil checkpointer for %+v", cfg)
+		}
+	}
+}
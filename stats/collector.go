@@ -2,9 +2,13 @@ package stats
 
 import (
 	"cmp"
+	"net/netip"
 	"slices"
 	"sync"
 	"sync/atomic"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/jsonhelper"
 )
 
 type trafficCollector struct {
@@ -14,6 +18,16 @@ type trafficCollector struct {
 	uplinkBytes     atomic.Uint64
 	tcpSessions     atomic.Uint64
 	udpSessions     atomic.Uint64
+
+	rateLimitDelayedBytes   atomic.Uint64
+	rateLimitDroppedPackets atomic.Uint64
+
+	tcpUrgentBytesDiscarded atomic.Uint64
+
+	oversizedPacketsDropped   atomic.Uint64
+	oversizedPacketsTruncated atomic.Uint64
+
+	udpSessionsEvicted atomic.Uint64
 }
 
 func (tc *trafficCollector) collectTCPSession(downlinkBytes, uplinkBytes uint64) {
@@ -33,6 +47,24 @@ func (tc *trafficCollector) collectUDPSessionUplink(uplinkPackets, uplinkBytes u
 	tc.uplinkBytes.Add(uplinkBytes)
 }
 
+func (tc *trafficCollector) collectRateLimit(delayedBytes, droppedPackets uint64) {
+	tc.rateLimitDelayedBytes.Add(delayedBytes)
+	tc.rateLimitDroppedPackets.Add(droppedPackets)
+}
+
+func (tc *trafficCollector) collectTCPUrgentData(discardedBytes uint64) {
+	tc.tcpUrgentBytesDiscarded.Add(discardedBytes)
+}
+
+func (tc *trafficCollector) collectOversizedPackets(droppedPackets, truncatedPackets uint64) {
+	tc.oversizedPacketsDropped.Add(droppedPackets)
+	tc.oversizedPacketsTruncated.Add(truncatedPackets)
+}
+
+func (tc *trafficCollector) collectUDPSessionEviction() {
+	tc.udpSessionsEvicted.Add(1)
+}
+
 // Traffic stores the traffic statistics.
 type Traffic struct {
 	DownlinkPackets uint64 `json:"downlinkPackets"`
@@ -41,6 +73,68 @@ type Traffic struct {
 	UplinkBytes     uint64 `json:"uplinkBytes"`
 	TCPSessions     uint64 `json:"tcpSessions"`
 	UDPSessions     uint64 `json:"udpSessions"`
+
+	// RateLimitDelayedBytes is the number of bytes delayed by rate limiting.
+	RateLimitDelayedBytes uint64 `json:"rateLimitDelayedBytes"`
+
+	// RateLimitDroppedPackets is the number of packets dropped by rate limiting.
+	RateLimitDroppedPackets uint64 `json:"rateLimitDroppedPackets"`
+
+	// TCPUrgentBytesDiscarded is the number of TCP urgent data bytes discarded from client streams.
+	TCPUrgentBytesDiscarded uint64 `json:"tcpUrgentBytesDiscarded"`
+
+	// OversizedPacketsDropped is the number of UDP packets dropped
+	// because the payload was too big to pack for the outgoing path.
+	OversizedPacketsDropped uint64 `json:"oversizedPacketsDropped"`
+
+	// OversizedPacketsTruncated is the number of oversized UDP packets truncated to fit the outgoing path.
+	OversizedPacketsTruncated uint64 `json:"oversizedPacketsTruncated"`
+
+	// UDPSessionsEvicted is the number of UDP sessions evicted to make room for new sessions
+	// when the session table is full.
+	UDPSessionsEvicted uint64 `json:"udpSessionsEvicted"`
+}
+
+// Sub subtracts u from t.
+func (t *Traffic) Sub(u Traffic) {
+	t.DownlinkPackets -= u.DownlinkPackets
+	t.DownlinkBytes -= u.DownlinkBytes
+	t.UplinkPackets -= u.UplinkPackets
+	t.UplinkBytes -= u.UplinkBytes
+	t.TCPSessions -= u.TCPSessions
+	t.UDPSessions -= u.UDPSessions
+	t.RateLimitDelayedBytes -= u.RateLimitDelayedBytes
+	t.RateLimitDroppedPackets -= u.RateLimitDroppedPackets
+	t.TCPUrgentBytesDiscarded -= u.TCPUrgentBytesDiscarded
+	t.OversizedPacketsDropped -= u.OversizedPacketsDropped
+	t.OversizedPacketsTruncated -= u.OversizedPacketsTruncated
+	t.UDPSessionsEvicted -= u.UDPSessionsEvicted
+}
+
+// Delta returns the increase of t over prev.
+// Counters that decreased, for example after a reset, are returned as is.
+func (t Traffic) Delta(prev Traffic) Traffic {
+	return Traffic{
+		DownlinkPackets:           counterDelta(t.DownlinkPackets, prev.DownlinkPackets),
+		DownlinkBytes:             counterDelta(t.DownlinkBytes, prev.DownlinkBytes),
+		UplinkPackets:             counterDelta(t.UplinkPackets, prev.UplinkPackets),
+		UplinkBytes:               counterDelta(t.UplinkBytes, prev.UplinkBytes),
+		TCPSessions:               counterDelta(t.TCPSessions, prev.TCPSessions),
+		UDPSessions:               counterDelta(t.UDPSessions, prev.UDPSessions),
+		RateLimitDelayedBytes:     counterDelta(t.RateLimitDelayedBytes, prev.RateLimitDelayedBytes),
+		RateLimitDroppedPackets:   counterDelta(t.RateLimitDroppedPackets, prev.RateLimitDroppedPackets),
+		TCPUrgentBytesDiscarded:   counterDelta(t.TCPUrgentBytesDiscarded, prev.TCPUrgentBytesDiscarded),
+		OversizedPacketsDropped:   counterDelta(t.OversizedPacketsDropped, prev.OversizedPacketsDropped),
+		OversizedPacketsTruncated: counterDelta(t.OversizedPacketsTruncated, prev.OversizedPacketsTruncated),
+		UDPSessionsEvicted:        counterDelta(t.UDPSessionsEvicted, prev.UDPSessionsEvicted),
+	}
+}
+
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
 }
 
 func (t *Traffic) Add(u Traffic) {
@@ -50,6 +144,27 @@ func (t *Traffic) Add(u Traffic) {
 	t.UplinkBytes += u.UplinkBytes
 	t.TCPSessions += u.TCPSessions
 	t.UDPSessions += u.UDPSessions
+	t.RateLimitDelayedBytes += u.RateLimitDelayedBytes
+	t.RateLimitDroppedPackets += u.RateLimitDroppedPackets
+	t.TCPUrgentBytesDiscarded += u.TCPUrgentBytesDiscarded
+	t.OversizedPacketsDropped += u.OversizedPacketsDropped
+	t.OversizedPacketsTruncated += u.OversizedPacketsTruncated
+	t.UDPSessionsEvicted += u.UDPSessionsEvicted
+}
+
+func (tc *trafficCollector) add(t Traffic) {
+	tc.downlinkPackets.Add(t.DownlinkPackets)
+	tc.downlinkBytes.Add(t.DownlinkBytes)
+	tc.uplinkPackets.Add(t.UplinkPackets)
+	tc.uplinkBytes.Add(t.UplinkBytes)
+	tc.tcpSessions.Add(t.TCPSessions)
+	tc.udpSessions.Add(t.UDPSessions)
+	tc.rateLimitDelayedBytes.Add(t.RateLimitDelayedBytes)
+	tc.rateLimitDroppedPackets.Add(t.RateLimitDroppedPackets)
+	tc.tcpUrgentBytesDiscarded.Add(t.TCPUrgentBytesDiscarded)
+	tc.oversizedPacketsDropped.Add(t.OversizedPacketsDropped)
+	tc.oversizedPacketsTruncated.Add(t.OversizedPacketsTruncated)
+	tc.udpSessionsEvicted.Add(t.UDPSessionsEvicted)
 }
 
 func (tc *trafficCollector) snapshot() Traffic {
@@ -60,6 +175,16 @@ func (tc *trafficCollector) snapshot() Traffic {
 		UplinkBytes:     tc.uplinkBytes.Load(),
 		TCPSessions:     tc.tcpSessions.Load(),
 		UDPSessions:     tc.udpSessions.Load(),
+
+		RateLimitDelayedBytes:   tc.rateLimitDelayedBytes.Load(),
+		RateLimitDroppedPackets: tc.rateLimitDroppedPackets.Load(),
+
+		TCPUrgentBytesDiscarded: tc.tcpUrgentBytesDiscarded.Load(),
+
+		OversizedPacketsDropped:   tc.oversizedPacketsDropped.Load(),
+		OversizedPacketsTruncated: tc.oversizedPacketsTruncated.Load(),
+
+		UDPSessionsEvicted: tc.udpSessionsEvicted.Load(),
 	}
 }
 
@@ -71,6 +196,16 @@ func (tc *trafficCollector) snapshotAndReset() Traffic {
 		UplinkBytes:     tc.uplinkBytes.Swap(0),
 		TCPSessions:     tc.tcpSessions.Swap(0),
 		UDPSessions:     tc.udpSessions.Swap(0),
+
+		RateLimitDelayedBytes:   tc.rateLimitDelayedBytes.Swap(0),
+		RateLimitDroppedPackets: tc.rateLimitDroppedPackets.Swap(0),
+
+		TCPUrgentBytesDiscarded: tc.tcpUrgentBytesDiscarded.Swap(0),
+
+		OversizedPacketsDropped:   tc.oversizedPacketsDropped.Swap(0),
+		OversizedPacketsTruncated: tc.oversizedPacketsTruncated.Swap(0),
+
+		UDPSessionsEvicted: tc.udpSessionsEvicted.Swap(0),
 	}
 }
 
@@ -107,6 +242,7 @@ type serverCollector struct {
 	tc  trafficCollector
 	ucs map[string]*userCollector
 	mu  sync.RWMutex
+	rs  *rejectionSampler
 }
 
 // NewServerCollector returns a new collector for collecting server traffic statistics.
@@ -116,6 +252,14 @@ func NewServerCollector() *serverCollector {
 	}
 }
 
+// NewServerCollectorWithRejectionSampling returns a new collector for collecting server traffic statistics,
+// which also records 1 in every sampleRate rejection events of each kind, keeping up to sampleSize samples.
+func NewServerCollectorWithRejectionSampling(sampleRate, sampleSize int) *serverCollector {
+	sc := NewServerCollector()
+	sc.rs = newRejectionSampler(sampleRate, sampleSize)
+	return sc
+}
+
 func (sc *serverCollector) userCollector(username string) *userCollector {
 	sc.mu.RLock()
 	uc := sc.ucs[username]
@@ -154,6 +298,41 @@ func (sc *serverCollector) CollectUDPSessionUplink(username string, uplinkPacket
 	sc.trafficCollector(username).collectUDPSessionUplink(uplinkPackets, uplinkBytes)
 }
 
+// CollectRateLimit implements the Collector CollectRateLimit method.
+func (sc *serverCollector) CollectRateLimit(username string, delayedBytes, droppedPackets uint64) {
+	sc.trafficCollector(username).collectRateLimit(delayedBytes, droppedPackets)
+}
+
+// CollectTCPUrgentData implements the Collector CollectTCPUrgentData method.
+func (sc *serverCollector) CollectTCPUrgentData(username string, discardedBytes uint64) {
+	sc.trafficCollector(username).collectTCPUrgentData(discardedBytes)
+}
+
+// CollectOversizedPackets implements the Collector CollectOversizedPackets method.
+func (sc *serverCollector) CollectOversizedPackets(username string, droppedPackets, truncatedPackets uint64) {
+	sc.trafficCollector(username).collectOversizedPackets(droppedPackets, truncatedPackets)
+}
+
+// CollectUDPSessionEviction implements the Collector CollectUDPSessionEviction method.
+func (sc *serverCollector) CollectUDPSessionEviction(username string) {
+	sc.trafficCollector(username).collectUDPSessionEviction()
+}
+
+// CollectRejection implements the Collector CollectRejection method.
+func (sc *serverCollector) CollectRejection(kind RejectionKind, network string, clientAddrPort netip.AddrPort, username string, targetAddr conn.Addr, err error) {
+	if sc.rs != nil {
+		sc.rs.collect(kind, network, clientAddrPort, username, targetAddr, err)
+	}
+}
+
+// Rejections implements the Collector Rejections method.
+func (sc *serverCollector) Rejections() Rejections {
+	if sc.rs == nil {
+		return Rejections{}
+	}
+	return sc.rs.snapshot()
+}
+
 // Server stores the server's traffic statistics.
 type Server struct {
 	Traffic
@@ -190,6 +369,15 @@ func (sc *serverCollector) SnapshotAndReset() (s Server) {
 	return
 }
 
+// Restore implements the Collector Restore method.
+func (sc *serverCollector) Restore(s Server) {
+	for _, u := range s.Users {
+		sc.userCollector(u.Name).add(u.Traffic)
+		s.Traffic.Sub(u.Traffic)
+	}
+	sc.tc.add(s.Traffic)
+}
+
 // Collector collects server traffic statistics.
 type Collector interface {
 	// CollectTCPSession collects the TCP session's traffic statistics.
@@ -201,11 +389,33 @@ type Collector interface {
 	// CollectUDPSessionUplink collects the UDP session's uplink traffic statistics.
 	CollectUDPSessionUplink(username string, uplinkPackets, uplinkBytes uint64)
 
+	// CollectRateLimit collects the number of bytes delayed and packets dropped by rate limiting.
+	CollectRateLimit(username string, delayedBytes, droppedPackets uint64)
+
+	// CollectTCPUrgentData collects the number of TCP urgent data bytes discarded from the client stream.
+	CollectTCPUrgentData(username string, discardedBytes uint64)
+
+	// CollectOversizedPackets collects the number of UDP packets dropped or truncated
+	// because the payload was too big to pack for the outgoing path.
+	CollectOversizedPackets(username string, droppedPackets, truncatedPackets uint64)
+
+	// CollectUDPSessionEviction collects a UDP session evicted to make room for a new session.
+	CollectUDPSessionEviction(username string)
+
+	// CollectRejection records a rejected connection or packet.
+	CollectRejection(kind RejectionKind, network string, clientAddrPort netip.AddrPort, username string, targetAddr conn.Addr, err error)
+
 	// Snapshot returns the server's traffic statistics.
 	Snapshot() Server
 
 	// SnapshotAndReset returns the server's traffic statistics and resets the statistics.
 	SnapshotAndReset() Server
+
+	// Rejections returns the server's rejection counters and sampled rejection events.
+	Rejections() Rejections
+
+	// Restore adds the traffic statistics from a previous snapshot to the collector.
+	Restore(s Server)
 }
 
 // NoopCollector is a no-op collector.
@@ -222,6 +432,23 @@ func (NoopCollector) CollectUDPSessionDownlink(username string, downlinkPackets,
 // CollectUDPSessionUplink implements the Collector CollectUDPSessionUplink method.
 func (NoopCollector) CollectUDPSessionUplink(username string, uplinkPackets, uplinkBytes uint64) {}
 
+// CollectRateLimit implements the Collector CollectRateLimit method.
+func (NoopCollector) CollectRateLimit(username string, delayedBytes, droppedPackets uint64) {}
+
+// CollectTCPUrgentData implements the Collector CollectTCPUrgentData method.
+func (NoopCollector) CollectTCPUrgentData(username string, discardedBytes uint64) {}
+
+// CollectOversizedPackets implements the Collector CollectOversizedPackets method.
+func (NoopCollector) CollectOversizedPackets(username string, droppedPackets, truncatedPackets uint64) {
+}
+
+// CollectUDPSessionEviction implements the Collector CollectUDPSessionEviction method.
+func (NoopCollector) CollectUDPSessionEviction(username string) {}
+
+// CollectRejection implements the Collector CollectRejection method.
+func (NoopCollector) CollectRejection(kind RejectionKind, network string, clientAddrPort netip.AddrPort, username string, targetAddr conn.Addr, err error) {
+}
+
 // Snapshot implements the Collector Snapshot method.
 func (NoopCollector) Snapshot() Server {
 	return Server{}
@@ -232,15 +459,57 @@ func (NoopCollector) SnapshotAndReset() Server {
 	return Server{}
 }
 
+// Rejections implements the Collector Rejections method.
+func (NoopCollector) Rejections() Rejections {
+	return Rejections{}
+}
+
+// Restore implements the Collector Restore method.
+func (NoopCollector) Restore(s Server) {}
+
+// DefaultRejectionSampleSize is the default number of rejection samples kept per server.
+const DefaultRejectionSampleSize = 256
+
 // Config stores configuration for the stats collector.
 type Config struct {
 	Enabled bool `json:"enabled"`
+
+	// RejectionSampleRate enables sampling of rejected connections and packets.
+	// 1 in every RejectionSampleRate rejections of each kind is recorded with full detail.
+	//
+	// If unspecified or 0, rejections are not sampled.
+	RejectionSampleRate int `json:"rejectionSampleRate"`
+
+	// RejectionSampleSize is the maximum number of rejection samples kept per server.
+	// When full, the oldest samples are overwritten.
+	//
+	// The default value is 256.
+	RejectionSampleSize int `json:"rejectionSampleSize"`
+
+	// StateDir is the directory where traffic statistics are saved, one file per server.
+	// Saved statistics are restored on start, so that they survive restarts and crashes.
+	//
+	// If unspecified, statistics are not saved.
+	StateDir string `json:"stateDir"`
+
+	// CheckpointInterval is the interval between saves of traffic statistics.
+	// Statistics are also saved when the server stops.
+	//
+	// The default value is 5 minutes.
+	CheckpointInterval jsonhelper.Duration `json:"checkpointInterval"`
 }
 
 // Collector returns a new stats collector from the config.
 func (c Config) Collector() Collector {
-	if c.Enabled {
-		return NewServerCollector()
+	if !c.Enabled {
+		return NoopCollector{}
+	}
+	if c.RejectionSampleRate > 0 {
+		sampleSize := c.RejectionSampleSize
+		if sampleSize <= 0 {
+			sampleSize = DefaultRejectionSampleSize
+		}
+		return NewServerCollectorWithRejectionSampling(c.RejectionSampleRate, sampleSize)
 	}
-	return NoopCollector{}
+	return NewServerCollector()
 }
@@ -20,6 +20,14 @@ func collect(t *testing.T, c Collector) {
 	c.CollectTCPSession("Steve", 17408, 18432)
 	c.CollectUDPSessionDownlink("Alex", 1024, 19456)
 	c.CollectUDPSessionUplink("Alex", 2048, 20480)
+	c.CollectRateLimit("Steve", 4096, 0)
+	c.CollectRateLimit("Alex", 0, 3)
+	c.CollectRateLimit("Steve", 1024, 5)
+	c.CollectTCPUrgentData("Alex", 2)
+	c.CollectOversizedPackets("Steve", 3, 1)
+	c.CollectOversizedPackets("Steve", 0, 2)
+	c.CollectUDPSessionEviction("Alex")
+	c.CollectUDPSessionEviction("Alex")
 }
 
 func collectNoUsername(t *testing.T, c Collector) {
@@ -38,6 +46,16 @@ func verify(t *testing.T, s Server) {
 		UplinkBytes:     114688,
 		TCPSessions:     4,
 		UDPSessions:     6,
+
+		RateLimitDelayedBytes:   5120,
+		RateLimitDroppedPackets: 8,
+
+		TCPUrgentBytesDiscarded: 2,
+
+		OversizedPacketsDropped:   3,
+		OversizedPacketsTruncated: 3,
+
+		UDPSessionsEvicted: 2,
 	}
 	expectedSteveTraffic := Traffic{
 		DownlinkPackets: 34,
@@ -46,6 +64,12 @@ func verify(t *testing.T, s Server) {
 		UplinkBytes:     53248,
 		TCPSessions:     3,
 		UDPSessions:     2,
+
+		RateLimitDelayedBytes:   5120,
+		RateLimitDroppedPackets: 5,
+
+		OversizedPacketsDropped:   3,
+		OversizedPacketsTruncated: 3,
 	}
 	expectedAlexTraffic := Traffic{
 		DownlinkPackets: 1108,
@@ -54,6 +78,12 @@ func verify(t *testing.T, s Server) {
 		UplinkBytes:     61440,
 		TCPSessions:     1,
 		UDPSessions:     4,
+
+		RateLimitDroppedPackets: 3,
+
+		TCPUrgentBytesDiscarded: 2,
+
+		UDPSessionsEvicted: 2,
 	}
 	if s.Traffic != expectedServerTraffic {
 		t.Errorf("expected server traffic %+v, got %+v", expectedServerTraffic, s.Traffic)
@@ -131,3 +161,12 @@ func TestNoopCollector(t *testing.T) {
 	verifyEmpty(t, c.SnapshotAndReset())
 	verifyEmpty(t, c.Snapshot())
 }
+
+func TestTrafficDelta(t *testing.T) {
+	prev := Traffic{DownlinkBytes: 100, UplinkBytes: 200, TCPSessions: 3}
+	cur := Traffic{DownlinkBytes: 150, UplinkBytes: 50, TCPSessions: 3, UDPSessions: 1}
+	expected := Traffic{DownlinkBytes: 50, UplinkBytes: 50, UDPSessions: 1}
+	if d := cur.Delta(prev); d != expected {
+		t.Errorf("cur.Delta(prev) = %+v, expected %+v", d, expected)
+	}
+}
@@ -0,0 +1,160 @@
+package stats
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+// RejectionKind identifies why a connection or packet was rejected.
+type RejectionKind uint8
+
+const (
+	// RejectionKindHandshake is a failed TCP handshake.
+	RejectionKindHandshake RejectionKind = iota
+
+	// RejectionKindUnpack is a UDP packet that could not be unpacked,
+	// including packets that failed authentication.
+	RejectionKindUnpack
+
+	// RejectionKindRoute is a request rejected by the router, or a user's destination ACL.
+	RejectionKindRoute
+
+	// RejectionKindHandshakeTimeout is a TCP handshake that did not complete in time.
+	RejectionKindHandshakeTimeout
+
+	// RejectionKindLimit is a TCP connection or UDP session rejected
+	// because the server reached its concurrency limit or ramp-up rate.
+	RejectionKindLimit
+
+	// RejectionKindACL is a TCP connection or UDP packet from a client address
+	// not allowed by the server's ACL.
+	RejectionKindACL
+
+	// RejectionKindReplay is a TCP handshake or UDP packet that failed replay checks.
+	RejectionKindReplay
+
+	rejectionKindCount
+)
+
+// String returns the string representation of the rejection kind.
+func (k RejectionKind) String() string {
+	switch k {
+	case RejectionKindHandshake:
+		return "handshake"
+	case RejectionKindUnpack:
+		return "unpack"
+	case RejectionKindRoute:
+		return "route"
+	case RejectionKindHandshakeTimeout:
+		return "handshake_timeout"
+	case RejectionKindLimit:
+		return "limit"
+	case RejectionKindACL:
+		return "acl"
+	case RejectionKindReplay:
+		return "replay"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler MarshalText method.
+func (k RejectionKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// RejectionSample is a detailed record of a sampled rejection event.
+type RejectionSample struct {
+	Time          time.Time      `json:"time"`
+	Kind          RejectionKind  `json:"kind"`
+	Network       string         `json:"network"`
+	ClientAddress netip.AddrPort `json:"clientAddress"`
+	Username      string         `json:"username,omitempty"`
+	TargetAddress conn.Addr      `json:"targetAddress"`
+	Error         string         `json:"error"`
+}
+
+// Rejections contains rejection counters and recent samples.
+type Rejections struct {
+	Handshake        uint64            `json:"handshake"`
+	Unpack           uint64            `json:"unpack"`
+	Route            uint64            `json:"route"`
+	HandshakeTimeout uint64            `json:"handshakeTimeout"`
+	Limit            uint64            `json:"limit"`
+	ACL              uint64            `json:"acl"`
+	Replay           uint64            `json:"replay"`
+	Samples          []RejectionSample `json:"samples"`
+}
+
+// rejectionSampler counts rejection events and records 1-in-N of them
+// into a fixed-size ring buffer.
+type rejectionSampler struct {
+	counts     [rejectionKindCount]atomic.Uint64
+	sampleRate uint64
+
+	mu    sync.Mutex
+	ring  []RejectionSample
+	next  int
+	count int
+}
+
+// newRejectionSampler returns a new rejection sampler that records
+// 1 in every sampleRate rejections of each kind, keeping up to size samples.
+func newRejectionSampler(sampleRate, size int) *rejectionSampler {
+	return &rejectionSampler{
+		sampleRate: uint64(sampleRate),
+		ring:       make([]RejectionSample, size),
+	}
+}
+
+func (rs *rejectionSampler) collect(kind RejectionKind, network string, clientAddrPort netip.AddrPort, username string, targetAddr conn.Addr, err error) {
+	n := rs.counts[kind].Add(1)
+	if (n-1)%rs.sampleRate != 0 {
+		return
+	}
+
+	sample := RejectionSample{
+		Time:          time.Now(),
+		Kind:          kind,
+		Network:       network,
+		ClientAddress: clientAddrPort,
+		Username:      username,
+		TargetAddress: targetAddr,
+	}
+	if err != nil {
+		sample.Error = err.Error()
+	}
+
+	rs.mu.Lock()
+	rs.ring[rs.next] = sample
+	rs.next = (rs.next + 1) % len(rs.ring)
+	rs.count = min(rs.count+1, len(rs.ring))
+	rs.mu.Unlock()
+}
+
+// snapshot returns the counters and the recorded samples, oldest first.
+func (rs *rejectionSampler) snapshot() Rejections {
+	r := Rejections{
+		Handshake:        rs.counts[RejectionKindHandshake].Load(),
+		Unpack:           rs.counts[RejectionKindUnpack].Load(),
+		Route:            rs.counts[RejectionKindRoute].Load(),
+		HandshakeTimeout: rs.counts[RejectionKindHandshakeTimeout].Load(),
+		Limit:            rs.counts[RejectionKindLimit].Load(),
+		ACL:              rs.counts[RejectionKindACL].Load(),
+		Replay:           rs.counts[RejectionKindReplay].Load(),
+	}
+
+	rs.mu.Lock()
+	r.Samples = make([]RejectionSample, 0, rs.count)
+	start := (rs.next - rs.count + len(rs.ring)) % len(rs.ring)
+	for i := range rs.count {
+		r.Samples = append(r.Samples, rs.ring[(start+i)%len(rs.ring)])
+	}
+	rs.mu.Unlock()
+
+	return r
+}
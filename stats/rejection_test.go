@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+func TestRejectionSampling(t *testing.T) {
+	c := Config{Enabled: true, RejectionSampleRate: 3, RejectionSampleSize: 4}.Collector()
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	errBad := errors.New("bad packet")
+
+	for i := range 20 {
+		c.CollectRejection(RejectionKindUnpack, "udp", netip.AddrPortFrom(clientAddrPort.Addr(), uint16(i)), "", conn.Addr{}, errBad)
+	}
+	c.CollectRejection(RejectionKindRoute, "tcp", clientAddrPort, "Steve", conn.MustAddrFromDomainPort("example.com", 443), nil)
+
+	r := c.Rejections()
+	if r.Unpack != 20 {
+		t.Errorf("r.Unpack = %d, expected 20", r.Unpack)
+	}
+	if r.Route != 1 {
+		t.Errorf("r.Route = %d, expected 1", r.Route)
+	}
+	if r.Handshake != 0 {
+		t.Errorf("r.Handshake = %d, expected 0", r.Handshake)
+	}
+
+	// Unpack samples: 0, 3, 6, 9, 12, 15, 18. Route sample: 1.
+	// The ring keeps the last 4: 12, 15, 18, route.
+	if len(r.Samples) != 4 {
+		t.Fatalf("len(r.Samples) = %d, expected 4", len(r.Samples))
+	}
+	for i, port := range []uint16{12, 15, 18} {
+		if got := r.Samples[i].ClientAddress.Port(); got != port {
+			t.Errorf("r.Samples[%d].ClientAddress.Port() = %d, expected %d", i, got, port)
+		}
+		if r.Samples[i].Error != errBad.Error() {
+			t.Errorf("r.Samples[%d].Error = %q, expected %q", i, r.Samples[i].Error, errBad.Error())
+		}
+	}
+	if last := r.Samples[3]; last.Kind != RejectionKindRoute || last.Username != "Steve" {
+		t.Errorf("r.Samples[3] = %+v, expected route rejection for Steve", last)
+	}
+}
+
+func TestRejectionSamplingDisabled(t *testing.T) {
+	for _, c := range []Collector{Config{Enabled: true}.Collector(), Config{}.Collector()} {
+		c.CollectRejection(RejectionKindHandshake, "tcp", netip.AddrPort{}, "", conn.Addr{}, nil)
+		if r := c.Rejections(); r.Handshake != 0 || len(r.Samples) != 0 {
+			t.Errorf("c.Rejections() = %+v, expected empty", r)
+		}
+	}
+}
+
+func TestRejectionKindLimit(t *testing.T) {
+	c := Config{Enabled: true, RejectionSampleRate: 1}.Collector()
+	clientAddrPort := netip.MustParseAddrPort("[2001:db8::1]:12345")
+	c.CollectRejection(RejectionKindLimit, "tcp", clientAddrPort, "", conn.Addr{}, nil)
+	c.CollectRejection(RejectionKindLimit, "udp", clientAddrPort, "", conn.Addr{}, nil)
+
+	r := c.Rejections()
+	if r.Limit != 2 {
+		t.Errorf("r.Limit = %d, expected 2", r.Limit)
+	}
+	if len(r.Samples) != 2 || r.Samples[1].Kind != RejectionKindLimit || r.Samples[1].Network != "udp" {
+		t.Errorf("r.Samples = %+v, expected 2 limit samples", r.Samples)
+	}
+}
@@ -0,0 +1,281 @@
+package uot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// ClientPackerHeadroom is the headroom required by the UDP-over-TCP client packer.
+var ClientPackerHeadroom = zerocopy.Headroom{Front: MaxFrameHeaderLen}
+
+// bridgeListenConfig is the [conn.ListenConfig] for the relay's socket to the session's bridge socket.
+// Both sockets are on the loopback interface, so the client's socket options do not apply.
+var bridgeListenConfig = conn.DefaultUDPClientListenConfig
+
+// UDPClient relays UDP sessions over streams to [MagicAddress] opened by a TCP client.
+//
+// Each session has a bridge socket on the loopback interface. Packets sent to the bridge socket
+// are already framed by the packer, and are written to the stream as is. Frames read from the stream
+// are sent back to the relay's socket, and parsed by the unpacker.
+//
+// UDPClient implements the zerocopy UDPClient interface.
+type UDPClient struct {
+	logger    *zap.Logger
+	tcpClient zerocopy.TCPClient
+	info      zerocopy.UDPClientInfo
+}
+
+// NewUDPClient returns a new UDP-over-TCP client that opens streams with tcpClient.
+// mtu limits the size of packets relayed in each direction, as if the session were over UDP.
+func NewUDPClient(logger *zap.Logger, name string, tcpClient zerocopy.TCPClient, mtu int) *UDPClient {
+	return &UDPClient{
+		logger:    logger,
+		tcpClient: tcpClient,
+		info: zerocopy.UDPClientInfo{
+			Name:           name,
+			PackerHeadroom: ClientPackerHeadroom,
+			MTU:            mtu,
+			ListenConfig:   bridgeListenConfig,
+		},
+	}
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *UDPClient) Info() zerocopy.UDPClientInfo {
+	return c.info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *UDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	destination, ok := zerocopy.UDPSessionTargetAddrFromContext(ctx)
+	if !ok {
+		destination = conn.AddrFromIPPort(netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	}
+
+	bridge, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to create bridge socket: %w", err)
+	}
+	bridgeAddrPort := bridge.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// Packets to different targets share the stream, so the session is never in connect mode.
+	request := AppendRequest(nil, Request{Destination: destination})
+	rawRW, rw, err := c.tcpClient.Dial(ctx, MagicAddr(), request)
+	if err != nil {
+		bridge.Close()
+		return c.info, zerocopy.UDPClientSession{}, fmt.Errorf("failed to open UDP-over-TCP stream: %w", err)
+	}
+
+	// Payloads larger than what fits in an IPv4 packet are dropped,
+	// so that the relay's receive buffer can hold any frame sent back to it.
+	maxPacketSize := MaxFrameHeaderLen + zerocopy.MaxPacketSizeForAddr(c.info.MTU, netip.IPv4Unspecified())
+
+	s := session{
+		logger:        c.logger,
+		name:          c.info.Name,
+		bridge:        bridge,
+		rawRW:         rawRW,
+		stream:        zerocopy.NewCopyReadWriter(rw),
+		maxPacketSize: maxPacketSize,
+	}
+	s.wg.Add(1)
+	go s.relayUplink()
+
+	return c.info, zerocopy.UDPClientSession{
+		MaxPacketSize: maxPacketSize,
+		Packer:        NewClientPacker(bridgeAddrPort, maxPacketSize),
+		Unpacker:      NewClientUnpacker(bridgeAddrPort),
+		Close:         s.close,
+	}, nil
+}
+
+// session relays packets between the bridge socket and the stream.
+type session struct {
+	logger        *zap.Logger
+	name          string
+	bridge        *net.UDPConn
+	rawRW         zerocopy.DirectReadWriteCloser
+	stream        io.ReadWriter
+	maxPacketSize int
+	wg            sync.WaitGroup
+}
+
+// relayUplink writes packets received on the bridge socket to the stream.
+// The first packet's source is the relay's socket, to which relayDownlink sends frames.
+func (s *session) relayUplink() {
+	defer s.wg.Done()
+
+	var relayAddrPort netip.AddrPort
+	b := make([]byte, s.maxPacketSize)
+
+	for {
+		n, addrPort, err := s.bridge.ReadFromUDPAddrPort(b)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Failed to read from bridge socket",
+					zap.String("client", s.name),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		switch {
+		case !relayAddrPort.IsValid():
+			relayAddrPort = addrPort
+			s.wg.Add(1)
+			go s.relayDownlink(relayAddrPort)
+		case addrPort != relayAddrPort:
+			s.logger.Debug("Dropped packet from unknown source",
+				zap.String("client", s.name),
+				zap.Stringer("sourceAddress", addrPort),
+			)
+			continue
+		}
+
+		if _, err = s.stream.Write(b[:n]); err != nil {
+			s.logger.Warn("Failed to write to UDP-over-TCP stream",
+				zap.String("client", s.name),
+				zap.Error(err),
+			)
+			return
+		}
+	}
+}
+
+// relayDownlink sends frames read from the stream to the relay's socket.
+func (s *session) relayDownlink(relayAddrPort netip.AddrPort) {
+	defer s.wg.Done()
+
+	b := make([]byte, MaxFrameHeaderLen+MaxPayloadSize)
+
+	for {
+		_, headerLen, payloadLen, err := ReadFrame(s.stream, b, false)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				s.logger.Warn("Failed to read from UDP-over-TCP stream",
+					zap.String("client", s.name),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		frameLen := headerLen + payloadLen
+		if frameLen > s.maxPacketSize {
+			s.logger.Debug("Dropped oversized packet",
+				zap.String("client", s.name),
+				zap.Int("payloadLength", payloadLen),
+			)
+			continue
+		}
+
+		if _, err = s.bridge.WriteToUDPAddrPort(b[:frameLen], relayAddrPort); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Failed to write to bridge socket",
+					zap.String("client", s.name),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+	}
+}
+
+// close closes the bridge socket and the stream, and waits for the relay goroutines to exit.
+func (s *session) close() error {
+	err := errors.Join(s.bridge.Close(), s.rawRW.Close())
+	s.wg.Wait()
+	return err
+}
+
+// ClientPacker frames packets for the session's bridge socket.
+//
+// ClientPacker implements the zerocopy ClientPacker interface.
+type ClientPacker struct {
+	bridgeAddrPort netip.AddrPort
+	maxPacketSize  int
+}
+
+// NewClientPacker returns a new UDP-over-TCP client packer.
+func NewClientPacker(bridgeAddrPort netip.AddrPort, maxPacketSize int) *ClientPacker {
+	return &ClientPacker{
+		bridgeAddrPort: bridgeAddrPort,
+		maxPacketSize:  maxPacketSize,
+	}
+}
+
+// ClientPackerInfo implements the zerocopy.ClientPacker ClientPackerInfo method.
+func (p *ClientPacker) ClientPackerInfo() zerocopy.ClientPackerInfo {
+	return zerocopy.ClientPackerInfo{
+		Headroom: ClientPackerHeadroom,
+	}
+}
+
+// PackInPlace implements the zerocopy.ClientPacker PackInPlace method.
+func (p *ClientPacker) PackInPlace(ctx context.Context, b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	headerLen := FrameHeaderLen(targetAddr, false)
+	destAddrPort = p.bridgeAddrPort
+	packetStart = payloadStart - headerLen
+	packetLen = payloadLen + headerLen
+	if packetLen > p.maxPacketSize {
+		err = zerocopy.ErrPayloadTooBig
+		return
+	}
+	PutFrameHeader(b[packetStart:], targetAddr, payloadLen, false)
+	return
+}
+
+// ClientUnpacker parses frames sent back by the session's bridge socket.
+//
+// ClientUnpacker implements the zerocopy ClientUnpacker interface.
+type ClientUnpacker struct {
+	bridgeAddrPort netip.AddrPort
+}
+
+// NewClientUnpacker returns a new UDP-over-TCP client unpacker.
+func NewClientUnpacker(bridgeAddrPort netip.AddrPort) *ClientUnpacker {
+	return &ClientUnpacker{
+		bridgeAddrPort: bridgeAddrPort,
+	}
+}
+
+// ClientUnpackerInfo implements the zerocopy.ClientUnpacker ClientUnpackerInfo method.
+func (p *ClientUnpacker) ClientUnpackerInfo() zerocopy.ClientUnpackerInfo {
+	return zerocopy.ClientUnpackerInfo{}
+}
+
+// UnpackInPlace implements the zerocopy.ClientUnpacker UnpackInPlace method.
+func (p *ClientUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	if !conn.AddrPortMappedEqual(packetSourceAddrPort, p.bridgeAddrPort) {
+		err = fmt.Errorf("dropped packet from non-bridge source %s", packetSourceAddrPort)
+		return
+	}
+
+	sourceAddr, payloadLen, headerLen, err := ParseFrameHeader(b[packetStart : packetStart+packetLen])
+	if err != nil {
+		return
+	}
+	if !sourceAddr.IsIP() {
+		err = fmt.Errorf("unexpected domain source address %s", sourceAddr)
+		return
+	}
+	if headerLen+payloadLen != packetLen {
+		err = fmt.Errorf("frame length %d does not match packet length %d", headerLen+payloadLen, packetLen)
+		return
+	}
+
+	payloadSourceAddrPort = sourceAddr.IPPort()
+	payloadStart = packetStart + headerLen
+	return
+}
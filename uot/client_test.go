@@ -0,0 +1,244 @@
+package uot
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/pipe"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+// serveEcho accepts a UDP-over-TCP stream on rawRW, and sends every frame back as is,
+// as if each packet were echoed by its target.
+func serveEcho(t *testing.T, rawRW zerocopy.DirectReadWriteCloser, wantDestination conn.Addr) {
+	rw, targetAddr, _, _, err := direct.NewShadowsocksNoneTCPServer().Accept(rawRW)
+	if err != nil {
+		t.Errorf("Accept() failed: %v", err)
+		return
+	}
+	defer rw.Close()
+
+	if Version(targetAddr) != 2 {
+		t.Errorf("targetAddr = %s, want %s", targetAddr, MagicAddress)
+		return
+	}
+
+	stream := zerocopy.NewCopyReadWriter(rw)
+
+	req, err := ReadRequest(stream)
+	if err != nil {
+		t.Errorf("ReadRequest() failed: %v", err)
+		return
+	}
+	if req.IsConnect || !req.Destination.Equals(wantDestination) {
+		t.Errorf("ReadRequest() = %v, want non-connect request to %s", req, wantDestination)
+	}
+
+	b := make([]byte, MaxFrameHeaderLen+MaxPayloadSize)
+	for {
+		_, headerLen, payloadLen, err := ReadFrame(stream, b, false)
+		if err != nil {
+			return
+		}
+		if _, err = stream.Write(b[:headerLen+payloadLen]); err != nil {
+			return
+		}
+	}
+}
+
+func TestUDPClient(t *testing.T) {
+	pl, pr := pipe.NewDuplexPipe()
+	defer pr.Close()
+
+	targetAddrPort := netip.MustParseAddrPort("192.0.2.1:53")
+	targetAddr := conn.AddrFromIPPort(targetAddrPort)
+
+	serverDone := make(chan struct{})
+	go func() {
+		serveEcho(t, pr, targetAddr)
+		close(serverDone)
+	}()
+
+	tcpClient := direct.NewShadowsocksNoneTCPClient("test", &zerocopy.SimpleDirectReadWriteCloserOpener{DirectReadWriteCloser: pl})
+	c := NewUDPClient(zap.NewNop(), "test", tcpClient, 1500)
+
+	info, session, err := c.NewSession(zerocopy.WithUDPSessionTargetAddr(context.Background(), targetAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uc, _, err := info.ListenConfig.ListenUDP(context.Background(), "udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	headroom := session.Packer.ClientPackerInfo().Headroom
+	b := make([]byte, headroom.Front+session.MaxPacketSize+headroom.Rear)
+
+	for _, addr := range testAddrs {
+		payload := []byte("hello, " + addr.String())
+		copy(b[headroom.Front:], payload)
+
+		destAddrPort, packetStart, packetLen, err := session.Packer.PackInPlace(context.Background(), b, addr, headroom.Front, len(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = uc.WriteToUDPAddrPort(b[packetStart:packetStart+packetLen], destAddrPort); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = uc.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		n, packetSourceAddrPort, err := uc.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payloadSourceAddrPort, payloadStart, payloadLen, err := session.Unpacker.UnpackInPlace(b, packetSourceAddrPort, 0, n)
+		if !addr.IsIP() {
+			// The echo server sends back the domain, which is not a valid source address.
+			if err == nil {
+				t.Error("UnpackInPlace accepted packet from domain source")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payloadSourceAddrPort != addr.IPPort() {
+			t.Errorf("payloadSourceAddrPort = %s, want %s", payloadSourceAddrPort, addr.IPPort())
+		}
+		if echoed := b[payloadStart : payloadStart+payloadLen]; !bytes.Equal(echoed, payload) {
+			t.Errorf("echoed payload = %q, want %q", echoed, payload)
+		}
+	}
+
+	// Packets from other sources are dropped.
+	if _, _, _, err = session.Unpacker.UnpackInPlace(b, netip.MustParseAddrPort("127.0.0.1:1"), 0, 16); err == nil {
+		t.Error("UnpackInPlace accepted packet from non-bridge source")
+	}
+
+	// Payloads that do not fit in a packet are rejected.
+	if _, _, _, err = session.Packer.PackInPlace(context.Background(), make([]byte, headroom.Front+MaxPayloadSize), targetAddr, headroom.Front, MaxPayloadSize); err != zerocopy.ErrPayloadTooBig {
+		t.Errorf("PackInPlace() with oversized payload returned %v, want %v", err, zerocopy.ErrPayloadTooBig)
+	}
+
+	if err = session.Close(); err != nil {
+		t.Error(err)
+	}
+	<-serverDone
+}
+
+// testUDPClient is a UDP client whose sessions are counted and have no-op packers and unpackers.
+type testUDPClient struct {
+	name     string
+	sessions int
+}
+
+func (c *testUDPClient) Info() zerocopy.UDPClientInfo {
+	return zerocopy.UDPClientInfo{Name: c.name, ListenConfig: conn.DefaultUDPClientListenConfig}
+}
+
+func (c *testUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	c.sessions++
+	return c.Info(), zerocopy.UDPClientSession{
+		Packer:   testPacker{},
+		Unpacker: testUnpacker{},
+		Close:    zerocopy.NoopClose,
+	}, nil
+}
+
+type testPacker struct{}
+
+func (testPacker) ClientPackerInfo() zerocopy.ClientPackerInfo {
+	return zerocopy.ClientPackerInfo{}
+}
+
+func (testPacker) PackInPlace(ctx context.Context, b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (netip.AddrPort, int, int, error) {
+	return targetAddr.IPPort(), payloadStart, payloadLen, nil
+}
+
+type testUnpacker struct{}
+
+func (testUnpacker) ClientUnpackerInfo() zerocopy.ClientUnpackerInfo {
+	return zerocopy.ClientUnpackerInfo{}
+}
+
+func (testUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (netip.AddrPort, int, int, error) {
+	return packetSourceAddrPort, packetStart, packetLen, nil
+}
+
+func TestFallbackUDPClient(t *testing.T) {
+	native := &testUDPClient{name: "native"}
+	uotClient := &testUDPClient{name: "uot"}
+	c := NewFallbackUDPClient(zap.NewNop(), native, uotClient)
+
+	newSession := func() (zerocopy.UDPClientSession, *fallbackProbe) {
+		t.Helper()
+		_, session, err := c.NewSession(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := session.Packer.(*fallbackProbePacker)
+		if p == nil {
+			return session, nil
+		}
+		return session, p.probe
+	}
+
+	targetAddr := conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:53"))
+	b := make([]byte, 16)
+
+	// A session that receives packets resets the failure count.
+	for range fallbackThreshold - 1 {
+		session, probe := newSession()
+		if probe == nil {
+			t.Fatal("NewSession() did not use the native client")
+		}
+		probe.timeout()
+		session.Close()
+	}
+	session, _ := newSession()
+	if _, _, _, err := session.Packer.PackInPlace(context.Background(), b, targetAddr, 0, len(b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := session.Unpacker.UnpackInPlace(b, targetAddr.IPPort(), 0, len(b)); err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+	if failures := c.failures.Load(); failures != 0 {
+		t.Errorf("failures = %d, want 0", failures)
+	}
+
+	// Consecutive failed sessions trigger the fallback.
+	for range fallbackThreshold {
+		session, probe := newSession()
+		if probe == nil {
+			t.Fatal("NewSession() did not use the native client")
+		}
+		probe.timeout()
+		session.Close()
+	}
+
+	nativeSessions := native.sessions
+	if _, probe := newSession(); probe != nil {
+		t.Error("NewSession() used the native client after the fallback")
+	}
+	if native.sessions != nativeSessions || uotClient.sessions != 1 {
+		t.Errorf("native.sessions = %d, uotClient.sessions = %d, want %d, 1", native.sessions, uotClient.sessions, nativeSessions)
+	}
+
+	// The native client is used again after the fallback duration.
+	c.fallbackUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	if _, probe := newSession(); probe == nil {
+		t.Error("NewSession() did not use the native client after the fallback expired")
+	}
+}
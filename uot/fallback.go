@@ -0,0 +1,192 @@
+package uot
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+	"go.uber.org/zap"
+)
+
+const (
+	// fallbackProbeTimeout is how long a native session may go without receiving a packet
+	// after sending its first packet, before it is counted as failed.
+	fallbackProbeTimeout = 10 * time.Second
+
+	// fallbackThreshold is the number of consecutive failed native sessions
+	// that triggers the fallback to UDP-over-TCP.
+	fallbackThreshold = 3
+
+	// fallbackDuration is how long new sessions use UDP-over-TCP after the fallback is triggered.
+	fallbackDuration = 5 * time.Minute
+)
+
+// FallbackUDPClient uses a native UDP client until its sessions stop receiving packets,
+// then uses a UDP-over-TCP client for new sessions for a while, before trying the native client again.
+//
+// FallbackUDPClient implements the zerocopy UDPClient interface.
+type FallbackUDPClient struct {
+	logger         *zap.Logger
+	native         zerocopy.UDPClient
+	uot            zerocopy.UDPClient
+	packerHeadroom zerocopy.Headroom
+
+	// failures is the number of consecutive failed native sessions.
+	failures atomic.Int32
+
+	// fallbackUntil is the Unix time in nanoseconds until which new sessions use UDP-over-TCP.
+	fallbackUntil atomic.Int64
+}
+
+// NewFallbackUDPClient returns a new UDP client that falls back from native to uot.
+func NewFallbackUDPClient(logger *zap.Logger, native, uot zerocopy.UDPClient) *FallbackUDPClient {
+	return &FallbackUDPClient{
+		logger:         logger,
+		native:         native,
+		uot:            uot,
+		packerHeadroom: zerocopy.MaxHeadroom(native.Info().PackerHeadroom, uot.Info().PackerHeadroom),
+	}
+}
+
+// Info implements the zerocopy.UDPClient Info method.
+func (c *FallbackUDPClient) Info() zerocopy.UDPClientInfo {
+	info := c.native.Info()
+	info.PackerHeadroom = c.packerHeadroom
+	return info
+}
+
+// NewSession implements the zerocopy.UDPClient NewSession method.
+func (c *FallbackUDPClient) NewSession(ctx context.Context) (zerocopy.UDPClientInfo, zerocopy.UDPClientSession, error) {
+	if time.Now().UnixNano() < c.fallbackUntil.Load() {
+		return c.uot.NewSession(ctx)
+	}
+
+	info, session, err := c.native.NewSession(ctx)
+	if err != nil {
+		return info, session, err
+	}
+
+	p := &fallbackProbe{client: c}
+	closeSession := session.Close
+	session.Packer = &fallbackProbePacker{ClientPacker: session.Packer, probe: p}
+	session.Unpacker = &fallbackProbeUnpacker{ClientUnpacker: session.Unpacker, probe: p}
+	session.Close = func() error {
+		p.stop()
+		return closeSession()
+	}
+	return info, session, nil
+}
+
+// sessionSucceeded resets the failure count.
+func (c *FallbackUDPClient) sessionSucceeded() {
+	c.failures.Store(0)
+}
+
+// sessionFailed counts a failed native session, and triggers the fallback at the threshold.
+func (c *FallbackUDPClient) sessionFailed() {
+	if c.failures.Add(1) < fallbackThreshold {
+		return
+	}
+	c.failures.Store(0)
+	c.fallbackUntil.Store(time.Now().Add(fallbackDuration).UnixNano())
+
+	info := c.native.Info()
+	c.logger.Info("Native UDP sessions are not receiving packets, falling back to UDP-over-TCP",
+		zap.String("client", info.Name),
+		zap.Duration("fallbackDuration", fallbackDuration),
+	)
+}
+
+// fallbackProbe watches a native session for its first received packet.
+type fallbackProbe struct {
+	client   *FallbackUDPClient
+	started  atomic.Bool
+	received atomic.Bool
+	mu       sync.Mutex
+	timer    *time.Timer
+	done     bool
+}
+
+// sent starts the probe timer on the first sent packet.
+func (p *fallbackProbe) sent() {
+	if p.started.Swap(true) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.timer = time.AfterFunc(fallbackProbeTimeout, p.timeout)
+}
+
+// receivedPacket reports a received packet, and counts the session as succeeded on the first one.
+func (p *fallbackProbe) receivedPacket() {
+	if p.received.Swap(true) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.done {
+		p.done = true
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		p.client.sessionSucceeded()
+	}
+}
+
+// timeout counts the session as failed if no packets have been received.
+func (p *fallbackProbe) timeout() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.done = true
+	p.client.sessionFailed()
+}
+
+// stop stops the probe without counting the session.
+func (p *fallbackProbe) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// fallbackProbePacker reports sent packets to the probe.
+type fallbackProbePacker struct {
+	zerocopy.ClientPacker
+	probe *fallbackProbe
+}
+
+// PackInPlace implements the zerocopy.ClientPacker PackInPlace method.
+func (p *fallbackProbePacker) PackInPlace(ctx context.Context, b []byte, targetAddr conn.Addr, payloadStart, payloadLen int) (destAddrPort netip.AddrPort, packetStart, packetLen int, err error) {
+	destAddrPort, packetStart, packetLen, err = p.ClientPacker.PackInPlace(ctx, b, targetAddr, payloadStart, payloadLen)
+	if err == nil {
+		p.probe.sent()
+	}
+	return
+}
+
+// fallbackProbeUnpacker reports received packets to the probe.
+type fallbackProbeUnpacker struct {
+	zerocopy.ClientUnpacker
+	probe *fallbackProbe
+}
+
+// UnpackInPlace implements the zerocopy.ClientUnpacker UnpackInPlace method.
+func (p *fallbackProbeUnpacker) UnpackInPlace(b []byte, packetSourceAddrPort netip.AddrPort, packetStart, packetLen int) (payloadSourceAddrPort netip.AddrPort, payloadStart, payloadLen int, err error) {
+	payloadSourceAddrPort, payloadStart, payloadLen, err = p.ClientUnpacker.UnpackInPlace(b, packetSourceAddrPort, packetStart, packetLen)
+	if err == nil {
+		p.probe.receivedPacket()
+	}
+	return
+}
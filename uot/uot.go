@@ -0,0 +1,259 @@
+// Package uot implements UDP-over-TCP, compatible with version 2 of sing-box's UDP-over-TCP protocol.
+//
+// The client opens a TCP connection through a proxy to [MagicAddress], and sends a request
+// with the session's destination. UDP packets are then carried on the stream in both directions
+// as frames of the packet's target or source address, a 2-byte big-endian length, and the payload.
+//
+// In connect mode, frames omit the address, and all packets go to the request's destination.
+package uot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+const (
+	// MagicAddress is the domain of the target address of version 2 UDP-over-TCP streams.
+	MagicAddress = "sp.v2.udp-over-tcp.arpa"
+
+	// LegacyMagicAddress is the domain of the target address of version 1 UDP-over-TCP streams,
+	// which have no request, and are always in non-connect mode.
+	LegacyMagicAddress = "sp.udp-over-tcp.arpa"
+)
+
+// Address types in frames.
+const (
+	atypIPv4   = 0x00
+	atypIPv6   = 0x01
+	atypDomain = 0x02
+)
+
+const (
+	// MaxAddrLen is the maximum length of an address in a frame.
+	MaxAddrLen = 1 + 1 + 255 + 2
+
+	// MaxFrameHeaderLen is the maximum length of a frame header.
+	MaxFrameHeaderLen = MaxAddrLen + 2
+
+	// MaxPayloadSize is the maximum payload size of a frame.
+	MaxPayloadSize = 65535
+)
+
+var errBadAddrType = errors.New("bad address type")
+
+// MagicAddr returns the target address of version 2 UDP-over-TCP streams.
+func MagicAddr() conn.Addr {
+	return conn.MustAddrFromDomainPort(MagicAddress, 0)
+}
+
+// Version returns the UDP-over-TCP version of streams to targetAddr, or 0 if targetAddr is not a magic address.
+func Version(targetAddr conn.Addr) int {
+	if !targetAddr.IsDomain() {
+		return 0
+	}
+	switch targetAddr.Domain() {
+	case MagicAddress:
+		return 2
+	case LegacyMagicAddress:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Request is the request at the start of a version 2 stream.
+type Request struct {
+	// IsConnect is true if frames omit the address, and all packets go to Destination.
+	IsConnect bool
+
+	// Destination is the destination of the session.
+	Destination conn.Addr
+}
+
+// AppendRequest appends the encoded request to b.
+func AppendRequest(b []byte, req Request) []byte {
+	var isConnect byte
+	if req.IsConnect {
+		isConnect = 1
+	}
+	b = append(b, isConnect)
+	n := len(b)
+	b = slices.Grow(b, AddrLen(req.Destination))[:n+AddrLen(req.Destination)]
+	PutAddr(b[n:], req.Destination)
+	return b
+}
+
+// ReadRequest reads a request from r.
+func ReadRequest(r io.Reader) (req Request, err error) {
+	var b [1 + MaxAddrLen]byte
+	if _, err = io.ReadFull(r, b[:1]); err != nil {
+		return
+	}
+	req.IsConnect = b[0] != 0
+	req.Destination, _, err = ReadAddr(r, b[1:])
+	return
+}
+
+// AddrLen returns the length of addr in a frame.
+func AddrLen(addr conn.Addr) int {
+	switch {
+	case addr.IsDomain():
+		return 1 + 1 + len(addr.Domain()) + 2
+	case addr.IP().Unmap().Is4():
+		return 1 + 4 + 2
+	default:
+		return 1 + 16 + 2
+	}
+}
+
+// PutAddr writes addr to b, which must be at least AddrLen(addr) bytes long.
+// It returns the number of bytes written.
+func PutAddr(b []byte, addr conn.Addr) int {
+	var n int
+	switch {
+	case addr.IsDomain():
+		domain := addr.Domain()
+		b[0] = atypDomain
+		b[1] = byte(len(domain))
+		n = 2 + copy(b[2:], domain)
+	case addr.IP().Unmap().Is4():
+		b[0] = atypIPv4
+		ip4 := addr.IP().As4()
+		n = 1 + copy(b[1:], ip4[:])
+	default:
+		b[0] = atypIPv6
+		ip6 := addr.IP().As16()
+		n = 1 + copy(b[1:], ip6[:])
+	}
+	binary.BigEndian.PutUint16(b[n:], addr.Port())
+	return n + 2
+}
+
+// ReadAddr reads an address from r into the start of b, which must be at least MaxAddrLen bytes long.
+// It returns the address and its length.
+func ReadAddr(r io.Reader, b []byte) (conn.Addr, int, error) {
+	// Read the address type, and the domain length or the first byte of the IP address.
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return conn.Addr{}, 0, err
+	}
+
+	addrLen, err := addrLenFromHeader(b)
+	if err != nil {
+		return conn.Addr{}, 0, err
+	}
+
+	if _, err = io.ReadFull(r, b[2:addrLen]); err != nil {
+		return conn.Addr{}, 0, err
+	}
+
+	return ParseAddr(b[:addrLen])
+}
+
+// addrLenFromHeader returns the length of the address from its first 2 bytes.
+func addrLenFromHeader(b []byte) (int, error) {
+	switch b[0] {
+	case atypIPv4:
+		return 1 + 4 + 2, nil
+	case atypIPv6:
+		return 1 + 16 + 2, nil
+	case atypDomain:
+		return 1 + 1 + int(b[1]) + 2, nil
+	default:
+		return 0, fmt.Errorf("%w: %d", errBadAddrType, b[0])
+	}
+}
+
+// ParseAddr parses the address at the start of b.
+// It returns the address and its length.
+func ParseAddr(b []byte) (addr conn.Addr, n int, err error) {
+	if len(b) < 2 {
+		return conn.Addr{}, 0, io.ErrUnexpectedEOF
+	}
+
+	n, err = addrLenFromHeader(b)
+	if err != nil {
+		return conn.Addr{}, 0, err
+	}
+	if len(b) < n {
+		return conn.Addr{}, 0, io.ErrUnexpectedEOF
+	}
+
+	port := binary.BigEndian.Uint16(b[n-2:])
+	switch b[0] {
+	case atypIPv4:
+		addr = conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[1:5])), port))
+	case atypIPv6:
+		addr = conn.AddrFromIPPort(netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[1:17])), port))
+	case atypDomain:
+		addr, err = conn.AddrFromDomainPort(string(b[2:n-2]), port)
+	}
+	return addr, n, err
+}
+
+// FrameHeaderLen returns the length of the header of a frame with addr.
+// If isConnect is true, the frame has no address.
+func FrameHeaderLen(addr conn.Addr, isConnect bool) int {
+	if isConnect {
+		return 2
+	}
+	return AddrLen(addr) + 2
+}
+
+// PutFrameHeader writes the header of a frame with addr and payloadLen to b,
+// which must be at least FrameHeaderLen(addr, isConnect) bytes long. It returns the header length.
+func PutFrameHeader(b []byte, addr conn.Addr, payloadLen int, isConnect bool) int {
+	var n int
+	if !isConnect {
+		n = PutAddr(b, addr)
+	}
+	binary.BigEndian.PutUint16(b[n:], uint16(payloadLen))
+	return n + 2
+}
+
+// ParseFrameHeader parses the frame header at the start of b.
+// It returns the address, the payload length, and the header length.
+func ParseFrameHeader(b []byte) (addr conn.Addr, payloadLen, headerLen int, err error) {
+	addr, n, err := ParseAddr(b)
+	if err != nil {
+		return conn.Addr{}, 0, 0, err
+	}
+	if len(b) < n+2 {
+		return conn.Addr{}, 0, 0, io.ErrUnexpectedEOF
+	}
+	return addr, int(binary.BigEndian.Uint16(b[n:])), n + 2, nil
+}
+
+// ReadFrameHeader reads a frame header from r into the start of b, which must be at least MaxFrameHeaderLen bytes long.
+// If isConnect is true, the frame has no address.
+// It returns the frame's address, header length, and payload length.
+func ReadFrameHeader(r io.Reader, b []byte, isConnect bool) (addr conn.Addr, headerLen, payloadLen int, err error) {
+	if !isConnect {
+		if addr, headerLen, err = ReadAddr(r, b); err != nil {
+			return
+		}
+	}
+
+	if _, err = io.ReadFull(r, b[headerLen:headerLen+2]); err != nil {
+		return
+	}
+	payloadLen = int(binary.BigEndian.Uint16(b[headerLen:]))
+	headerLen += 2
+	return
+}
+
+// ReadFrame reads a frame from r into the start of b, which must be at least MaxFrameHeaderLen+MaxPayloadSize bytes long.
+// If isConnect is true, the frame has no address.
+// It returns the frame's address, header length, and payload length.
+func ReadFrame(r io.Reader, b []byte, isConnect bool) (addr conn.Addr, headerLen, payloadLen int, err error) {
+	if addr, headerLen, payloadLen, err = ReadFrameHeader(r, b, isConnect); err != nil {
+		return
+	}
+	_, err = io.ReadFull(r, b[headerLen:headerLen+payloadLen])
+	return
+}
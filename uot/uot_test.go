@@ -0,0 +1,124 @@
+package uot
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/shadowsocks-go/conn"
+)
+
+var testAddrs = []conn.Addr{
+	conn.AddrFromIPPort(netip.MustParseAddrPort("192.0.2.1:53")),
+	conn.AddrFromIPPort(netip.MustParseAddrPort("[2001:db8::1]:443")),
+	conn.MustAddrFromDomainPort("example.com", 8080),
+}
+
+func TestRequest(t *testing.T) {
+	for _, addr := range testAddrs {
+		for _, isConnect := range []bool{false, true} {
+			req := Request{IsConnect: isConnect, Destination: addr}
+			b := AppendRequest(nil, req)
+			if len(b) != 1+AddrLen(addr) {
+				t.Errorf("len(AppendRequest(%v)) = %d, want %d", req, len(b), 1+AddrLen(addr))
+			}
+
+			got, err := ReadRequest(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.IsConnect != isConnect || !got.Destination.Equals(addr) {
+				t.Errorf("ReadRequest() = %v, want %v", got, req)
+			}
+		}
+	}
+}
+
+func TestAddrIPv4Mapped(t *testing.T) {
+	addr := conn.AddrFromIPPort(netip.MustParseAddrPort("[::ffff:192.0.2.1]:53"))
+	if n := AddrLen(addr); n != 1+4+2 {
+		t.Errorf("AddrLen(%s) = %d, want %d", addr, n, 1+4+2)
+	}
+
+	b := make([]byte, MaxAddrLen)
+	n := PutAddr(b, addr)
+	got, gotLen, err := ParseAddr(b[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotLen != n {
+		t.Errorf("ParseAddr() length = %d, want %d", gotLen, n)
+	}
+	if want := netip.MustParseAddrPort("192.0.2.1:53"); got.IPPort() != want {
+		t.Errorf("ParseAddr() = %s, want %s", got, want)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	payload := []byte("hello, uot")
+
+	for _, addr := range testAddrs {
+		for _, isConnect := range []bool{false, true} {
+			headerLen := FrameHeaderLen(addr, isConnect)
+			frame := make([]byte, headerLen+len(payload))
+			if n := PutFrameHeader(frame, addr, len(payload), isConnect); n != headerLen {
+				t.Errorf("PutFrameHeader() = %d, want %d", n, headerLen)
+			}
+			copy(frame[headerLen:], payload)
+
+			if !isConnect {
+				gotAddr, gotPayloadLen, gotHeaderLen, err := ParseFrameHeader(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !gotAddr.Equals(addr) || gotPayloadLen != len(payload) || gotHeaderLen != headerLen {
+					t.Errorf("ParseFrameHeader() = %s, %d, %d, want %s, %d, %d", gotAddr, gotPayloadLen, gotHeaderLen, addr, len(payload), headerLen)
+				}
+			}
+
+			b := make([]byte, MaxFrameHeaderLen+MaxPayloadSize)
+			gotAddr, gotHeaderLen, gotPayloadLen, err := ReadFrame(bytes.NewReader(frame), b, isConnect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isConnect && !gotAddr.Equals(addr) {
+				t.Errorf("ReadFrame() address = %s, want %s", gotAddr, addr)
+			}
+			if gotHeaderLen != headerLen {
+				t.Errorf("ReadFrame() header length = %d, want %d", gotHeaderLen, headerLen)
+			}
+			if !bytes.Equal(b[:gotHeaderLen+gotPayloadLen], frame) {
+				t.Errorf("ReadFrame() frame = %x, want %x", b[:gotHeaderLen+gotPayloadLen], frame)
+			}
+		}
+	}
+}
+
+func TestParseFrameHeaderErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		{atypIPv4, 192, 0, 2},
+		{atypDomain, 11, 'e', 'x'},
+		{0x03, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, _, _, err := ParseFrameHeader(b); err == nil {
+			t.Errorf("ParseFrameHeader(%x) succeeded", b)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	for _, c := range []struct {
+		addr conn.Addr
+		want int
+	}{
+		{MagicAddr(), 2},
+		{conn.MustAddrFromDomainPort(LegacyMagicAddress, 0), 1},
+		{conn.MustAddrFromDomainPort("example.com", 0), 0},
+		{testAddrs[0], 0},
+	} {
+		if got := Version(c.addr); got != c.want {
+			t.Errorf("Version(%s) = %d, want %d", c.addr, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package windivert implements a transparent TCP inbound for Windows using WinDivert.
+//
+// Outbound TCP packets matching a WinDivert filter are reflected back to a local
+// TCP listener, the same way as WinDivert's streamdump example:
+//
+//   - A packet from the client (clientAddr:clientPort -> targetAddr:targetPort) is rewritten
+//     to (targetAddr:clientPort -> clientAddr:proxyPort) and reinjected as inbound.
+//   - A packet from the proxy (clientAddr:proxyPort -> targetAddr:clientPort) is rewritten
+//     to (targetAddr:targetPort -> clientAddr:clientPort) and reinjected as inbound.
+//
+// The target port is remembered in a flow table, so the proxy can reconstruct
+// the target address of each accepted connection.
+package windivert
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	ipProtocolTCP = 6
+
+	tcpFlagRST = 0x04
+)
+
+// flowIdleTimeout is how long an idle flow is kept in the flow table.
+const flowIdleTimeout = time.Hour
+
+// flowKey identifies a reflected TCP flow.
+type flowKey struct {
+	clientAddrPort netip.AddrPort
+	targetAddr     netip.Addr
+}
+
+// flowEntry stores the original target port of a flow.
+type flowEntry struct {
+	targetPort uint16
+	lastSeen   time.Time
+}
+
+// flowTable maps reflected flows to their original target ports.
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[flowKey]flowEntry
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{
+		flows: make(map[flowKey]flowEntry),
+	}
+}
+
+// lookup returns the original target port of the flow.
+func (t *flowTable) lookup(key flowKey) (uint16, bool) {
+	t.mu.Lock()
+	entry, ok := t.flows[key]
+	t.mu.Unlock()
+	return entry.targetPort, ok
+}
+
+// sweep removes flows that have been idle since before deadline.
+func (t *flowTable) sweep(deadline time.Time) {
+	t.mu.Lock()
+	for key, entry := range t.flows {
+		if entry.lastSeen.Before(deadline) {
+			delete(t.flows, key)
+		}
+	}
+	t.mu.Unlock()
+}
+
+// tcpPacket is a parsed IPv4 or IPv6 TCP packet.
+type tcpPacket struct {
+	srcAddr []byte
+	dstAddr []byte
+	tcp     []byte
+}
+
+// parseTCPPacket parses the IP and TCP headers of b.
+// It returns false if b is not an unfragmented TCP packet.
+func parseTCPPacket(b []byte) (p tcpPacket, ok bool) {
+	if len(b) < 1 {
+		return p, false
+	}
+
+	var headerLen int
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return p, false
+		}
+		headerLen = int(b[0]&0x0f) * 4
+		// Skip non-TCP packets and fragments.
+		if headerLen < 20 || b[9] != ipProtocolTCP || binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return p, false
+		}
+		p.srcAddr = b[12:16]
+		p.dstAddr = b[16:20]
+
+	case 6:
+		if len(b) < 40 {
+			return p, false
+		}
+		// Extension headers are not supported.
+		if b[6] != ipProtocolTCP {
+			return p, false
+		}
+		headerLen = 40
+		p.srcAddr = b[8:24]
+		p.dstAddr = b[24:40]
+
+	default:
+		return p, false
+	}
+
+	if len(b) < headerLen+20 {
+		return p, false
+	}
+
+	p.tcp = b[headerLen:]
+	return p, true
+}
+
+func (p tcpPacket) srcPort() uint16 {
+	return binary.BigEndian.Uint16(p.tcp[0:])
+}
+
+func (p tcpPacket) dstPort() uint16 {
+	return binary.BigEndian.Uint16(p.tcp[2:])
+}
+
+func (p tcpPacket) setSrcPort(port uint16) {
+	binary.BigEndian.PutUint16(p.tcp[0:], port)
+}
+
+func (p tcpPacket) setDstPort(port uint16) {
+	binary.BigEndian.PutUint16(p.tcp[2:], port)
+}
+
+func (p tcpPacket) flags() byte {
+	return p.tcp[13]
+}
+
+func (p tcpPacket) addrs() (src, dst netip.Addr) {
+	src, _ = netip.AddrFromSlice(p.srcAddr)
+	dst, _ = netip.AddrFromSlice(p.dstAddr)
+	return src, dst
+}
+
+// swapAddrs swaps the source and destination addresses.
+// Checksums are not affected, because the pseudo-header sum is commutative.
+func (p tcpPacket) swapAddrs() {
+	for i := range p.srcAddr {
+		p.srcAddr[i], p.dstAddr[i] = p.dstAddr[i], p.srcAddr[i]
+	}
+}
+
+// reflect rewrites an outbound TCP packet in place, so that it can be
+// reinjected as an inbound packet, and updates the flow table.
+//
+// It returns false if the packet cannot be reflected and should be dropped.
+// The caller is responsible for recalculating the TCP checksum.
+func (t *flowTable) reflect(b []byte, proxyPort uint16, now time.Time) bool {
+	p, ok := parseTCPPacket(b)
+	if !ok {
+		return false
+	}
+
+	srcAddr, dstAddr := p.addrs()
+	srcPort, dstPort := p.srcPort(), p.dstPort()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if srcPort == proxyPort {
+		// Proxy -> client.
+		key := flowKey{
+			clientAddrPort: netip.AddrPortFrom(srcAddr, dstPort),
+			targetAddr:     dstAddr,
+		}
+		entry, ok := t.flows[key]
+		if !ok {
+			return false
+		}
+		if p.flags()&tcpFlagRST != 0 {
+			delete(t.flows, key)
+		} else {
+			entry.lastSeen = now
+			t.flows[key] = entry
+		}
+		p.setSrcPort(entry.targetPort)
+		p.swapAddrs()
+		return true
+	}
+
+	// Client -> target.
+	key := flowKey{
+		clientAddrPort: netip.AddrPortFrom(srcAddr, srcPort),
+		targetAddr:     dstAddr,
+	}
+	if p.flags()&tcpFlagRST != 0 {
+		delete(t.flows, key)
+	} else {
+		t.flows[key] = flowEntry{
+			targetPort: dstPort,
+			lastSeen:   now,
+		}
+	}
+	p.setDstPort(proxyPort)
+	p.swapAddrs()
+	return true
+}
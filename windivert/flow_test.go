@@ -0,0 +1,150 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func buildTCPPacket(src, dst netip.AddrPort, flags byte) []byte {
+	var b []byte
+	if src.Addr().Is4() {
+		b = make([]byte, 20+20)
+		b[0] = 4<<4 | 5
+		b[9] = ipProtocolTCP
+		copy(b[12:16], src.Addr().AsSlice())
+		copy(b[16:20], dst.Addr().AsSlice())
+	} else {
+		b = make([]byte, 40+20)
+		b[0] = 6 << 4
+		b[6] = ipProtocolTCP
+		copy(b[8:24], src.Addr().AsSlice())
+		copy(b[24:40], dst.Addr().AsSlice())
+	}
+	tcp := b[len(b)-20:]
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return b
+}
+
+func parsedAddrPorts(t *testing.T, b []byte) (src, dst netip.AddrPort) {
+	t.Helper()
+	p, ok := parseTCPPacket(b)
+	if !ok {
+		t.Fatal("parseTCPPacket failed")
+	}
+	srcAddr, dstAddr := p.addrs()
+	return netip.AddrPortFrom(srcAddr, p.srcPort()), netip.AddrPortFrom(dstAddr, p.dstPort())
+}
+
+func testFlowTableReflect(t *testing.T, clientAddr, targetAddr netip.Addr) {
+	const (
+		proxyPort  = 12345
+		clientPort = 50000
+		targetPort = 443
+	)
+
+	clientAddrPort := netip.AddrPortFrom(clientAddr, clientPort)
+	targetAddrPort := netip.AddrPortFrom(targetAddr, targetPort)
+	now := time.Now()
+	flows := newFlowTable()
+
+	// Client -> target is reflected to the proxy.
+	b := buildTCPPacket(clientAddrPort, targetAddrPort, 0)
+	if !flows.reflect(b, proxyPort, now) {
+		t.Fatal("client packet not reflected")
+	}
+	src, dst := parsedAddrPorts(t, b)
+	if want := netip.AddrPortFrom(targetAddr, clientPort); src != want {
+		t.Errorf("reflected client packet src = %v, want %v", src, want)
+	}
+	if want := netip.AddrPortFrom(clientAddr, proxyPort); dst != want {
+		t.Errorf("reflected client packet dst = %v, want %v", dst, want)
+	}
+
+	port, ok := flows.lookup(flowKey{clientAddrPort: clientAddrPort, targetAddr: targetAddr})
+	if !ok || port != targetPort {
+		t.Errorf("lookup = %d, %t, want %d, true", port, ok, targetPort)
+	}
+
+	// Proxy -> client is reflected as target -> client.
+	b = buildTCPPacket(netip.AddrPortFrom(clientAddr, proxyPort), netip.AddrPortFrom(targetAddr, clientPort), 0)
+	if !flows.reflect(b, proxyPort, now) {
+		t.Fatal("proxy packet not reflected")
+	}
+	src, dst = parsedAddrPorts(t, b)
+	if src != targetAddrPort {
+		t.Errorf("reflected proxy packet src = %v, want %v", src, targetAddrPort)
+	}
+	if dst != clientAddrPort {
+		t.Errorf("reflected proxy packet dst = %v, want %v", dst, clientAddrPort)
+	}
+
+	// RST removes the flow.
+	b = buildTCPPacket(netip.AddrPortFrom(clientAddr, proxyPort), netip.AddrPortFrom(targetAddr, clientPort), tcpFlagRST)
+	if !flows.reflect(b, proxyPort, now) {
+		t.Fatal("proxy RST packet not reflected")
+	}
+	if _, ok = flows.lookup(flowKey{clientAddrPort: clientAddrPort, targetAddr: targetAddr}); ok {
+		t.Error("flow not removed after RST")
+	}
+
+	// Proxy packets of unknown flows are dropped.
+	b = buildTCPPacket(netip.AddrPortFrom(clientAddr, proxyPort), netip.AddrPortFrom(targetAddr, clientPort), 0)
+	if flows.reflect(b, proxyPort, now) {
+		t.Error("proxy packet of unknown flow reflected")
+	}
+}
+
+func TestFlowTableReflect(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		testFlowTableReflect(t, netip.MustParseAddr("192.168.1.2"), netip.MustParseAddr("1.1.1.1"))
+	})
+	t.Run("IPv6", func(t *testing.T) {
+		testFlowTableReflect(t, netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("2606:4700:4700::1111"))
+	})
+}
+
+func TestFlowTableSweep(t *testing.T) {
+	clientAddrPort := netip.MustParseAddrPort("192.168.1.2:50000")
+	targetAddrPort := netip.MustParseAddrPort("1.1.1.1:443")
+	now := time.Now()
+	flows := newFlowTable()
+
+	if !flows.reflect(buildTCPPacket(clientAddrPort, targetAddrPort, 0), 12345, now) {
+		t.Fatal("client packet not reflected")
+	}
+
+	key := flowKey{clientAddrPort: clientAddrPort, targetAddr: targetAddrPort.Addr()}
+
+	flows.sweep(now.Add(-flowIdleTimeout))
+	if _, ok := flows.lookup(key); !ok {
+		t.Error("active flow removed by sweep")
+	}
+
+	flows.sweep(now.Add(time.Second))
+	if _, ok := flows.lookup(key); ok {
+		t.Error("idle flow not removed by sweep")
+	}
+}
+
+func TestParseTCPPacketRejectsNonTCP(t *testing.T) {
+	b := buildTCPPacket(netip.MustParseAddrPort("192.168.1.2:50000"), netip.MustParseAddrPort("1.1.1.1:443"), 0)
+	b[9] = 17
+	if _, ok := parseTCPPacket(b); ok {
+		t.Error("UDP packet parsed as TCP")
+	}
+
+	b = buildTCPPacket(netip.MustParseAddrPort("192.168.1.2:50000"), netip.MustParseAddrPort("1.1.1.1:443"), 0)
+	binary.BigEndian.PutUint16(b[6:], 0x2000) // MF
+	if _, ok := parseTCPPacket(b); ok {
+		t.Error("fragment parsed as TCP")
+	}
+
+	if _, ok := parseTCPPacket(b[:30]); ok {
+		t.Error("truncated packet parsed as TCP")
+	}
+}
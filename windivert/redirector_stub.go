@@ -0,0 +1,35 @@
+//go:build !windows || !(amd64 || arm64)
+
+package windivert
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// Redirector is not supported on this platform.
+type Redirector struct {
+	flows *flowTable
+}
+
+// NewRedirector always returns an error on this platform.
+func NewRedirector(name, filter string, proxyPort uint16, logger *zap.Logger) (*Redirector, error) {
+	return nil, errors.New("WinDivert is only supported on Windows amd64 and arm64")
+}
+
+// String implements the service Relay String method.
+func (r *Redirector) String() string {
+	return "WinDivert redirector"
+}
+
+// Start implements the service Relay Start method.
+func (r *Redirector) Start(_ context.Context) error {
+	return errors.ErrUnsupported
+}
+
+// Stop implements the service Relay Stop method.
+func (r *Redirector) Stop() error {
+	return nil
+}
@@ -0,0 +1,156 @@
+//go:build windows && (amd64 || arm64)
+
+package windivert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows"
+)
+
+// Redirector captures outbound TCP packets with WinDivert and reflects them
+// to the local proxy listener.
+//
+// Redirector implements the service Relay interface.
+type Redirector struct {
+	name      string
+	filter    string
+	proxyPort uint16
+	flows     *flowTable
+	logger    *zap.Logger
+	handle    windows.Handle
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewRedirector returns a new redirector that diverts outbound TCP packets
+// matching filter to the local proxy listener on proxyPort.
+//
+// The filter must not match the proxy's own outbound connections,
+// or they will be diverted back to the proxy in a loop.
+func NewRedirector(name, filter string, proxyPort uint16, logger *zap.Logger) (*Redirector, error) {
+	if filter == "" {
+		return nil, errors.New("empty WinDivert filter")
+	}
+	if proxyPort == 0 {
+		return nil, errors.New("proxy port must not be zero")
+	}
+	if err := loadDLL(); err != nil {
+		return nil, err
+	}
+	return &Redirector{
+		name:      name,
+		filter:    fmt.Sprintf("outbound and !loopback and tcp and (tcp.SrcPort == %d or (%s))", proxyPort, filter),
+		proxyPort: proxyPort,
+		flows:     newFlowTable(),
+		logger:    logger,
+	}, nil
+}
+
+// String implements the service Relay String method.
+func (r *Redirector) String() string {
+	return "WinDivert redirector for " + r.name
+}
+
+// Start implements the service Relay Start method.
+func (r *Redirector) Start(_ context.Context) error {
+	handle, err := winDivertOpen(r.filter, layerNetwork, 0, 0)
+	if err != nil {
+		return err
+	}
+	r.handle = handle
+	r.done = make(chan struct{})
+
+	r.wg.Add(2)
+	go func() {
+		r.recvLoop()
+		r.wg.Done()
+	}()
+	go func() {
+		r.sweepLoop()
+		r.wg.Done()
+	}()
+
+	r.logger.Info("Started WinDivert redirector",
+		zap.String("server", r.name),
+		zap.String("filter", r.filter),
+		zap.Uint16("proxyPort", r.proxyPort),
+	)
+	return nil
+}
+
+func (r *Redirector) recvLoop() {
+	packet := make([]byte, mtuMax)
+	var addr address
+
+	for {
+		n, err := winDivertRecv(r.handle, packet, &addr)
+		if err != nil {
+			if errors.Is(err, windows.ERROR_NO_DATA) {
+				return
+			}
+			r.logger.Warn("Failed to receive packet",
+				zap.String("server", r.name),
+				zap.Error(err),
+			)
+			continue
+		}
+		b := packet[:n]
+
+		if !r.flows.reflect(b, r.proxyPort, time.Now()) {
+			continue
+		}
+
+		addr.setInbound()
+
+		if err = winDivertHelperCalcChecksums(b, &addr); err != nil {
+			r.logger.Warn("Failed to calculate checksums",
+				zap.String("server", r.name),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		if err = winDivertSend(r.handle, b, &addr); err != nil {
+			r.logger.Warn("Failed to send packet",
+				zap.String("server", r.name),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (r *Redirector) sweepLoop() {
+	ticker := time.NewTicker(flowIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.flows.sweep(now.Add(-flowIdleTimeout))
+		}
+	}
+}
+
+// Stop implements the service Relay Stop method.
+func (r *Redirector) Stop() error {
+	if r.done == nil {
+		return nil
+	}
+	if err := winDivertShutdown(r.handle, shutdownBoth); err != nil {
+		r.logger.Warn("Failed to shut down WinDivert handle",
+			zap.String("server", r.name),
+			zap.Error(err),
+		)
+	}
+	close(r.done)
+	r.wg.Wait()
+	return winDivertClose(r.handle)
+}
@@ -0,0 +1,60 @@
+package windivert
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/database64128/shadowsocks-go/conn"
+	"github.com/database64128/shadowsocks-go/direct"
+	"github.com/database64128/shadowsocks-go/zerocopy"
+)
+
+// ErrNotDiverted is returned by [TCPServer] when the accepted connection
+// does not belong to any flow reflected by the redirector.
+var ErrNotDiverted = errors.New("connection was not diverted")
+
+// TCPServer is a transparent proxy server for connections reflected by a [Redirector].
+//
+// TCPServer implements the zerocopy TCPServer interface.
+type TCPServer struct {
+	redirector *Redirector
+}
+
+// NewTCPServer returns a new TCP server that looks up target addresses from the redirector.
+func NewTCPServer(redirector *Redirector) *TCPServer {
+	return &TCPServer{
+		redirector: redirector,
+	}
+}
+
+// Info implements the zerocopy.TCPServer Info method.
+func (s *TCPServer) Info() zerocopy.TCPServerInfo {
+	return zerocopy.TCPServerInfo{
+		NativeInitialPayload: false,
+		DefaultTCPConnCloser: zerocopy.ReplyWithGibberish,
+	}
+}
+
+// Accept implements the zerocopy.TCPServer Accept method.
+func (s *TCPServer) Accept(rawRW zerocopy.DirectReadWriteCloser) (rw zerocopy.ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error) {
+	tc, ok := rawRW.(*net.TCPConn)
+	if !ok {
+		return nil, conn.Addr{}, nil, "", zerocopy.ErrAcceptRequiresTCPConn
+	}
+
+	// A reflected connection appears to come from targetAddr:clientPort to clientAddr:proxyPort.
+	remoteAddrPort := tc.RemoteAddr().(*net.TCPAddr).AddrPort()
+	localAddrPort := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+	targetIP := remoteAddrPort.Addr().Unmap()
+
+	targetPort, ok := s.redirector.flows.lookup(flowKey{
+		clientAddrPort: netip.AddrPortFrom(localAddrPort.Addr().Unmap(), remoteAddrPort.Port()),
+		targetAddr:     targetIP,
+	})
+	if !ok {
+		return nil, conn.Addr{}, nil, "", ErrNotDiverted
+	}
+
+	return direct.NewDirectStreamReadWriter(rawRW), conn.AddrFromIPPort(netip.AddrPortFrom(targetIP, targetPort)), nil, "", nil
+}
@@ -0,0 +1,136 @@
+//go:build windows && (amd64 || arm64)
+
+package windivert
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// WinDivert.dll is loaded at runtime, so that the binary does not depend on it
+// unless the WinDivert inbound is configured.
+var (
+	modWinDivert = windows.NewLazyDLL("WinDivert.dll")
+
+	procWinDivertOpen                = modWinDivert.NewProc("WinDivertOpen")
+	procWinDivertRecv                = modWinDivert.NewProc("WinDivertRecv")
+	procWinDivertSend                = modWinDivert.NewProc("WinDivertSend")
+	procWinDivertShutdown            = modWinDivert.NewProc("WinDivertShutdown")
+	procWinDivertClose               = modWinDivert.NewProc("WinDivertClose")
+	procWinDivertHelperCalcChecksums = modWinDivert.NewProc("WinDivertHelperCalcChecksums")
+)
+
+const (
+	layerNetwork = 0
+
+	shutdownBoth = 0x3
+
+	// mtuMax is WINDIVERT_MTU_MAX, the maximum packet size returned by WinDivertRecv.
+	mtuMax = 40 + 0xffff
+)
+
+// address is WINDIVERT_ADDRESS.
+type address struct {
+	Timestamp int64
+	Flags     uint32
+	Reserved2 uint32
+	Data      [64]byte
+}
+
+// addressFlagOutbound is the Outbound bit in the WINDIVERT_ADDRESS bitfield.
+const addressFlagOutbound = 1 << 17
+
+func (a *address) setInbound() {
+	a.Flags &^= addressFlagOutbound
+}
+
+// loadDLL checks that WinDivert.dll and all required procedures are available.
+func loadDLL() error {
+	for _, proc := range [...]*windows.LazyProc{
+		procWinDivertOpen,
+		procWinDivertRecv,
+		procWinDivertSend,
+		procWinDivertShutdown,
+		procWinDivertClose,
+		procWinDivertHelperCalcChecksums,
+	} {
+		if err := proc.Find(); err != nil {
+			return fmt.Errorf("failed to load WinDivert.dll: %w", err)
+		}
+	}
+	return nil
+}
+
+func winDivertOpen(filter string, layer int, priority int16, flags uint64) (windows.Handle, error) {
+	filterp, err := windows.BytePtrFromString(filter)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	r1, _, err := procWinDivertOpen.Call(uintptr(unsafe.Pointer(filterp)), uintptr(layer), uintptr(priority), uintptr(flags))
+	handle := windows.Handle(r1)
+	if handle == windows.InvalidHandle {
+		return handle, fmt.Errorf("WinDivertOpen: %w", err)
+	}
+	return handle, nil
+}
+
+func winDivertRecv(handle windows.Handle, packet []byte, addr *address) (int, error) {
+	var recvLen uint32
+	r1, _, err := procWinDivertRecv.Call(
+		uintptr(handle),
+		uintptr(unsafe.Pointer(unsafe.SliceData(packet))),
+		uintptr(len(packet)),
+		uintptr(unsafe.Pointer(&recvLen)),
+		uintptr(unsafe.Pointer(addr)),
+	)
+	if r1 == 0 {
+		return 0, fmt.Errorf("WinDivertRecv: %w", err)
+	}
+	return int(recvLen), nil
+}
+
+func winDivertSend(handle windows.Handle, packet []byte, addr *address) error {
+	var sendLen uint32
+	r1, _, err := procWinDivertSend.Call(
+		uintptr(handle),
+		uintptr(unsafe.Pointer(unsafe.SliceData(packet))),
+		uintptr(len(packet)),
+		uintptr(unsafe.Pointer(&sendLen)),
+		uintptr(unsafe.Pointer(addr)),
+	)
+	if r1 == 0 {
+		return fmt.Errorf("WinDivertSend: %w", err)
+	}
+	return nil
+}
+
+func winDivertShutdown(handle windows.Handle, how int) error {
+	r1, _, err := procWinDivertShutdown.Call(uintptr(handle), uintptr(how))
+	if r1 == 0 {
+		return fmt.Errorf("WinDivertShutdown: %w", err)
+	}
+	return nil
+}
+
+func winDivertClose(handle windows.Handle) error {
+	r1, _, err := procWinDivertClose.Call(uintptr(handle))
+	if r1 == 0 {
+		return fmt.Errorf("WinDivertClose: %w", err)
+	}
+	return nil
+}
+
+func winDivertHelperCalcChecksums(packet []byte, addr *address) error {
+	r1, _, err := procWinDivertHelperCalcChecksums.Call(
+		uintptr(unsafe.Pointer(unsafe.SliceData(packet))),
+		uintptr(len(packet)),
+		uintptr(unsafe.Pointer(addr)),
+		0,
+	)
+	if r1 == 0 {
+		return fmt.Errorf("WinDivertHelperCalcChecksums: %w", err)
+	}
+	return nil
+}
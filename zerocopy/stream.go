@@ -5,7 +5,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
 	"sync"
+	"time"
 )
 
 // defaultBufferSize is the default buffer size to use
@@ -570,3 +572,48 @@ func CopyWriteOnce(w Writer, b []byte) (n int, err error) {
 
 	return
 }
+
+// StreamConn adapts a stream from a [TCPClient] to a [net.Conn], for protocols like TLS.
+// Deadlines are not supported. Cancellation is done by closing the connection.
+type StreamConn struct {
+	*CopyReadWriter
+	rawRW DirectReadWriteCloser
+}
+
+// NewStreamConn returns a new StreamConn for the stream returned by [TCPClient.Dial].
+func NewStreamConn(rawRW DirectReadWriteCloser, rw ReadWriter) *StreamConn {
+	return &StreamConn{
+		CopyReadWriter: NewCopyReadWriter(rw),
+		rawRW:          rawRW,
+	}
+}
+
+// Close implements the net.Conn Close method.
+func (c *StreamConn) Close() error {
+	return c.rawRW.Close()
+}
+
+// LocalAddr implements the net.Conn LocalAddr method.
+func (c *StreamConn) LocalAddr() net.Addr {
+	return nil
+}
+
+// RemoteAddr implements the net.Conn RemoteAddr method.
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	return errors.ErrUnsupported
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	return errors.ErrUnsupported
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	return errors.ErrUnsupported
+}
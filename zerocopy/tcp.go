@@ -6,6 +6,7 @@ import (
 	"errors"
 	mrand "math/rand/v2"
 	"net"
+	"syscall"
 
 	"github.com/database64128/shadowsocks-go/conn"
 	"go.uber.org/zap"
@@ -62,9 +63,57 @@ type TCPServer interface {
 	//
 	// If accept fails, the returned payload must be either nil/empty or the data that has been read
 	// from the connection.
+	//
+	// If rw implements [TCPServerReplier], the client is waiting for the outcome of its request,
+	// and the caller must call Reply before relaying.
 	Accept(rawRW DirectReadWriteCloser) (rw ReadWriter, targetAddr conn.Addr, payload []byte, username string, err error)
 }
 
+// TCPReplyStatus is the outcome of a client's request, reported by [TCPServerReplier].
+type TCPReplyStatus uint8
+
+const (
+	TCPReplySucceeded TCPReplyStatus = iota
+	TCPReplyGeneralFailure
+	TCPReplyNotAllowed
+	TCPReplyNetworkUnreachable
+	TCPReplyHostUnreachable
+	TCPReplyConnectionRefused
+	TCPReplyTimedOut
+	TCPReplyShuttingDown
+)
+
+// TCPReplyStatusFromDialError returns the reply status for an error returned by [TCPClient.Dial].
+func TCPReplyStatusFromDialError(err error) TCPReplyStatus {
+	var (
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return TCPReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return TCPReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return TCPReplyHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return TCPReplyTimedOut
+	default:
+		return TCPReplyGeneralFailure
+	}
+}
+
+// TCPServerReplier is implemented by ReadWriters returned by [TCPServer.Accept] of protocols
+// that tell the client whether its request succeeded, like SOCKS5 and HTTP CONNECT.
+//
+// The reply is deferred until the request has been routed and, if possible, the remote connection
+// has been established, so that failures are reported to the client with protocol-level errors.
+type TCPServerReplier interface {
+	// Reply sends the reply for status to the client.
+	// Only the first call has an effect. After a failure status, the connection must be closed.
+	Reply(status TCPReplyStatus) error
+}
+
 // TCPConnOpener stores information for opening TCP connections.
 //
 // TCPConnOpener implements the DirectReadWriteCloserOpener interface.
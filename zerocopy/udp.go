@@ -21,6 +21,10 @@ type UDPClientInfo struct {
 
 	// ListenConfig is the [conn.ListenConfig] for opening client sockets.
 	ListenConfig conn.ListenConfig
+
+	// NATTimeout is the duration after which an inactive NAT mapping through the client expires.
+	// 0 means the server's NAT timeout is used.
+	NATTimeout time.Duration
 }
 
 // UDPClientSession contains information about a UDP client session.
@@ -53,6 +57,19 @@ type UDPClient interface {
 	NewSession(ctx context.Context) (UDPClientInfo, UDPClientSession, error)
 }
 
+// WithUDPSessionTargetAddr returns a copy of ctx with the target address of the first packet of a UDP session.
+// Relays call [UDPClient.NewSession] with the returned context, so that clients can select a path by destination.
+//
+// The target address is stored with [conn.NewTargetAddrContext].
+func WithUDPSessionTargetAddr(ctx context.Context, targetAddr conn.Addr) context.Context {
+	return conn.NewTargetAddrContext(ctx, targetAddr)
+}
+
+// UDPSessionTargetAddrFromContext returns the target address stored in ctx by [WithUDPSessionTargetAddr].
+func UDPSessionTargetAddrFromContext(ctx context.Context) (conn.Addr, bool) {
+	return conn.TargetAddrFromContext(ctx)
+}
+
 // UDPNATServerInfo contains information about a UDP NAT server.
 type UDPNATServerInfo struct {
 	// UnpackerHeadroom is the headroom required by the packet unpacker.